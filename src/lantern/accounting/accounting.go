@@ -0,0 +1,280 @@
+/*
+Package accounting keeps usage accounts for the subtree of lantern nodes below
+this node, so that organizations sponsoring masters can see how their subtree
+is being used.
+
+Every node accounts for its own usage:
+
+- the identities of the users that it relayed traffic for (RecordActiveUser())
+- the number of bytes that it relayed (see Count())
+- the number of certificates that it issued (see keys.IssuedCertificates())
+
+Every REPORT_INTERVAL, each node sends its parent a Report summarizing the usage
+of its whole subtree during that interval, which is its own usage plus the
+latest reports of its children (TYPE_USAGE_REPORT).  Reports are signed with
+the sending node's private key and carry its certificate, and parents only
+accept reports from certificates that they issued themselves (see
+keys.VerifyFromChild()).  This way, usage rolls up the tree to the subtree's
+owner without anybody being able to inflate someone else's numbers.  Reports
+from children that we haven't heard from in STALE_AFTER are dropped.
+
+Our current load - the relayed connections that are open and the rate at which
+we relay bytes - goes out with every heartbeat to our parent (see
+signaling.SetLoad()).
+
+The report for our subtree is available from the admin API at
+http://[config.UIAddress()]/admin/subtree.
+*/
+package accounting
+
+import (
+	"encoding/json"
+	"fmt"
+	"lantern/keys"
+	"lantern/signaling"
+	"lantern/ui"
+	"lantern/util"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	REPORT_INTERVAL = 5 * time.Minute     // how often we report usage to our parent
+	STALE_AFTER     = 3 * REPORT_INTERVAL // how long we keep reports from children that went quiet
+)
+
+// Report summarizes the usage of a subtree during one REPORT_INTERVAL.
+type Report struct {
+	Nodes        int       // number of nodes in the subtree
+	ActiveUsers  int       // number of users that were relayed for
+	BytesRelayed int64     // number of bytes relayed
+	CertsIssued  int64     // number of certificates issued
+	At           time.Time // when the report was made
+}
+
+// SubtreeReport is what the admin API returns.
+type SubtreeReport struct {
+	Own      Report            // our own usage during the last interval
+	Children map[string]Report // latest reports of our children, by NodeID (see keys.NodeID())
+	Total    Report            // the usage of our whole subtree
+}
+
+// signedReport is a Report as it travels over the signaling channel.
+type signedReport struct {
+	Report      []byte // the JSON encoded Report
+	Signature   []byte // the signature of Report by the sender's private key
+	Certificate []byte // the DER encoded certificate of the sender
+}
+
+var (
+	bytesRelayed    int64                      // bytes relayed during the current interval, accessed atomically
+	totalRelayed    int64                      // bytes relayed since we started, accessed atomically
+	openConns       int64                      // relayed connections that are open, accessed atomically
+	activeUsers     = make(map[string]bool)    // users relayed for during the current interval
+	lastCertsIssued int64                      // keys.IssuedCertificates() at the start of the current interval
+	own             = Report{Nodes: 1}         // our own usage during the last interval
+	children        = make(map[string]*Report) // latest reports of our children, by NodeID
+	accountsMutex   sync.Mutex                 // used to synchronize access to all of the above except bytesRelayed, totalRelayed and openConns
+)
+
+func init() {
+	ui.HandleFunc("/admin/subtree", subtreeHandler)
+	go receive()
+	util.GoLoop("accounting reporter", reporter)
+	util.GoLoop("load reporter", loadReporter)
+}
+
+// RecordActiveUser() records that we relayed traffic for the given identity.
+func RecordActiveUser(identity string) {
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+	activeUsers[identity] = true
+}
+
+// Count() wraps the given connection so that the bytes read from and written to
+// it are accounted for as relayed.
+func Count(conn net.Conn) net.Conn {
+	atomic.AddInt64(&openConns, 1)
+	return &countedConn{Conn: conn}
+}
+
+// TotalBytesRelayed() returns the number of bytes that we relayed since we
+// started.
+func TotalBytesRelayed() int64 {
+	return atomic.LoadInt64(&totalRelayed)
+}
+
+// Subtree() returns the usage report for our subtree.
+func Subtree() SubtreeReport {
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+	dropStale()
+	subtree := SubtreeReport{Own: own, Children: make(map[string]Report), Total: own}
+	for nodeID, child := range children {
+		subtree.Children[nodeID] = *child
+		subtree.Total.Nodes += child.Nodes
+		subtree.Total.ActiveUsers += child.ActiveUsers
+		subtree.Total.BytesRelayed += child.BytesRelayed
+		subtree.Total.CertsIssued += child.CertsIssued
+	}
+	return subtree
+}
+
+// reporter(), meant to be run as a goroutine, closes out each interval and
+// reports our subtree's usage to our parent.
+func reporter() {
+	for {
+		time.Sleep(REPORT_INTERVAL)
+		closeInterval()
+		if err := report(Subtree().Total); err != nil {
+			log.Printf("Unable to report usage: %s", err)
+		}
+	}
+}
+
+// loadReporter(), meant to be run as a goroutine, hands our current load to the
+// signaling channel for every heartbeat.
+func loadReporter() {
+	lastRelayed := TotalBytesRelayed()
+	for {
+		time.Sleep(signaling.HEARTBEAT_INTERVAL)
+		relayed := TotalBytesRelayed()
+		signaling.SetLoad(signaling.LoadStats{
+			Connections:    int(atomic.LoadInt64(&openConns)),
+			BytesPerSecond: (relayed - lastRelayed) / int64(signaling.HEARTBEAT_INTERVAL/time.Second),
+		})
+		lastRelayed = relayed
+	}
+}
+
+// closeInterval() records our own usage for the interval that just ended and
+// starts a new one.
+func closeInterval() {
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+	certsIssued := keys.IssuedCertificates()
+	own = Report{
+		Nodes:        1,
+		ActiveUsers:  len(activeUsers),
+		BytesRelayed: atomic.SwapInt64(&bytesRelayed, 0),
+		CertsIssued:  certsIssued - lastCertsIssued,
+		At:           time.Now(),
+	}
+	activeUsers = make(map[string]bool)
+	lastCertsIssued = certsIssued
+}
+
+// report() signs the given report and sends it to our parent.
+func report(total Report) error {
+	cert, _ := keys.Certificate()
+	if cert == nil {
+		return fmt.Errorf("No certificate to sign the report with yet")
+	}
+	reportBytes, err := json.Marshal(&total)
+	if err != nil {
+		return err
+	}
+	signature, err := keys.Sign(reportBytes)
+	if err != nil {
+		return fmt.Errorf("Unable to sign report: %s", err)
+	}
+	data, err := json.Marshal(&signedReport{Report: reportBytes, Signature: signature, Certificate: cert.Raw})
+	if err != nil {
+		return err
+	}
+	signaling.Send(signaling.Message{Type: signaling.TYPE_USAGE_REPORT, Data: string(data)})
+	return nil
+}
+
+// receive() listens for usage reports from our children.
+func receive() {
+	messages := make(chan signaling.Message)
+	signaling.RecvMatching(messages, signaling.Filter{
+		Types: []signaling.MessageType{signaling.TYPE_USAGE_REPORT},
+	})
+	// Restarts keep receiving on the same channel, which stays registered
+	util.Supervise("accounting receiver", func() error {
+		for msg := range messages {
+			if msg.Type == signaling.TYPE_USAGE_REPORT {
+				if err := accept(msg.Data); err != nil {
+					log.Printf("Unable to accept usage report: %s", err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// accept() verifies a signed report from one of our children and records it
+// as that child's latest report.
+func accept(data string) error {
+	signed := &signedReport{}
+	if err := json.Unmarshal([]byte(data), signed); err != nil {
+		return err
+	}
+	childCert, err := keys.VerifyFromChild(signed.Report, signed.Signature, signed.Certificate)
+	if err != nil {
+		return fmt.Errorf("Signature didn't verify: %s", err)
+	}
+	childReport := &Report{}
+	if err := json.Unmarshal(signed.Report, childReport); err != nil {
+		return err
+	}
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+	// Keyed by NodeID, a child's renewed certificate doesn't count as another child
+	children[keys.NodeIDOf(childCert)] = childReport
+	return nil
+}
+
+// dropStale() drops reports from children that went quiet.  accountsMutex must
+// be held.
+func dropStale() {
+	for nodeID, child := range children {
+		if time.Since(child.At) > STALE_AFTER {
+			delete(children, nodeID)
+		}
+	}
+}
+
+// subtreeHandler() returns the usage report for our subtree.
+func subtreeHandler(resp http.ResponseWriter, req *http.Request) {
+	if subtreeJson, err := json.MarshalIndent(Subtree(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(subtreeJson)
+	}
+}
+
+// countedConn is a net.Conn whose traffic is accounted for as relayed.
+type countedConn struct {
+	net.Conn
+	closed int32 // whether the connection was closed already, accessed atomically
+}
+
+func (conn *countedConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	atomic.AddInt64(&bytesRelayed, int64(n))
+	atomic.AddInt64(&totalRelayed, int64(n))
+	return n, err
+}
+
+func (conn *countedConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	atomic.AddInt64(&bytesRelayed, int64(n))
+	atomic.AddInt64(&totalRelayed, int64(n))
+	return n, err
+}
+
+func (conn *countedConn) Close() error {
+	if atomic.CompareAndSwapInt32(&conn.closed, 0, 1) {
+		atomic.AddInt64(&openConns, -1)
+	}
+	return conn.Conn.Close()
+}
@@ -0,0 +1,380 @@
+/*
+Package artifacts is a small content-addressed store that parents use to
+distribute shared static artifacts, like bootstrap lists, category lists and
+localization bundles, to their children.
+
+Artifacts are identified by name, and each version of an artifact is identified
+by the hex SHA-256 of its content.  A master publishes an artifact with
+Publish(), which stores it and pushes a signed Manifest of all of its current
+artifacts down to its children over the signaling channel
+(TYPE_ARTIFACT_MANIFEST).
+
+A child only accepts manifests that carry a valid signature from its parent.
+It then fetches just the artifacts whose content it doesn't have yet, in
+chunks of CHUNK_SIZE over the signaling channel (TYPE_ARTIFACT_FETCH and
+TYPE_ARTIFACT_CHUNK).  Interrupted fetches resume from the last chunk received
+when the next manifest arrives.  Once all chunks are in, the content has to
+hash to the version named in the signed manifest before it's applied, so
+nothing that our parent didn't sign is ever applied.  Applied artifacts are
+cached in [config.ConfigDir]/artifacts (in memory only for ephemeral nodes),
+and are in turn offered to our own children with a manifest signed by us.
+
+Consumers obtain artifacts with Get() and can Watch() for new versions.
+*/
+package artifacts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"lantern/config"
+	"lantern/keys"
+	"lantern/signaling"
+	"lantern/util"
+	"log"
+	"os"
+	"sync"
+)
+
+const (
+	CHUNK_SIZE        = 32 * 1024        // the size of the chunks in which artifacts are fetched
+	MAX_ARTIFACT_SIZE = 10 * 1024 * 1024 // the largest artifact that we accept
+)
+
+// Entry identifies the current version of an artifact.
+type Entry struct {
+	Hash string // hex SHA-256 of the artifact's content
+	Size int    // size of the artifact's content in bytes
+}
+
+// Manifest lists the current versions of the artifacts offered by a node.
+type Manifest struct {
+	Artifacts map[string]Entry // current version by artifact name
+}
+
+// signedManifest is a Manifest as it travels over the signaling channel.
+type signedManifest struct {
+	Manifest  []byte // the JSON encoded Manifest
+	Signature []byte // the signature of Manifest by the sender's private key
+}
+
+// Fetch is the payload of TYPE_ARTIFACT_FETCH.
+type Fetch struct {
+	Hash   string // the version being fetched
+	Offset int    // the offset of the requested chunk
+}
+
+// Chunk is the payload of TYPE_ARTIFACT_CHUNK.
+type Chunk struct {
+	Hash   string // the version that this chunk belongs to
+	Offset int    // the offset of this chunk
+	Total  int    // the total size of the artifact
+	Data   []byte // the chunk's content
+}
+
+var (
+	storeDir  = config.ConfigDir + "/artifacts/" // where artifacts are cached on disk
+	current   = make(map[string]Entry)           // current version by artifact name
+	contents  = make(map[string][]byte)          // content by hash
+	partial   = make(map[string][]byte)          // content received so far for fetches in progress, by hash
+	pending   = make(map[string]map[string]bool) // names waiting for the content of a hash, by hash
+	watchers  = make(map[string][]chan []byte)   // parties watching for new versions, by artifact name
+	storeLock sync.Mutex                         // used to synchronize access to all of the above
+)
+
+func init() {
+	if !config.Ephemeral() {
+		if err := os.MkdirAll(storeDir, 0755); err != nil {
+			log.Printf("Unable to create directory for artifacts '%s': %s", storeDir, err)
+		}
+	}
+	go receive()
+}
+
+// Get() returns the current version of the named artifact, if we have one.
+func Get(name string) ([]byte, bool) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	entry, found := current[name]
+	if !found {
+		return nil, false
+	}
+	return content(entry.Hash)
+}
+
+/*
+Watch() registers a channel that receives the content of the named artifact
+whenever a new version of it is applied.  Sends don't block, so slow watchers
+may miss intermediate versions.
+*/
+func Watch(name string, ch chan []byte) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	watchers[name] = append(watchers[name], ch)
+}
+
+/*
+Publish() stores the given content as the current version of the named
+artifact and pushes a signed manifest of all our artifacts down to our
+children.
+*/
+func Publish(name string, data []byte) error {
+	if len(data) > MAX_ARTIFACT_SIZE {
+		return fmt.Errorf("Artifact %s is too large: %d", name, len(data))
+	}
+	storeLock.Lock()
+	hash := store(data)
+	apply(name, Entry{Hash: hash, Size: len(data)}, data)
+	storeLock.Unlock()
+	return announce()
+}
+
+// announce() pushes a signed manifest of our current artifacts down to our
+// children.
+func announce() error {
+	storeLock.Lock()
+	manifestBytes, err := json.Marshal(&Manifest{Artifacts: current})
+	storeLock.Unlock()
+	if err != nil {
+		return err
+	}
+	signature, err := keys.Sign(manifestBytes)
+	if err != nil {
+		return fmt.Errorf("Unable to sign artifact manifest: %s", err)
+	}
+	data, err := json.Marshal(&signedManifest{Manifest: manifestBytes, Signature: signature})
+	if err != nil {
+		return err
+	}
+	signaling.Send(signaling.Message{Type: signaling.TYPE_ARTIFACT_MANIFEST, Data: string(data)})
+	return nil
+}
+
+// receive() listens for artifact messages on the signaling channel.
+func receive() {
+	messages := make(chan signaling.Message)
+	signaling.RecvMatching(messages, signaling.Filter{
+		Types: []signaling.MessageType{signaling.TYPE_ARTIFACT_MANIFEST, signaling.TYPE_ARTIFACT_FETCH, signaling.TYPE_ARTIFACT_CHUNK},
+	})
+	// Restarts keep receiving on the same channel, which stays registered
+	util.Supervise("artifacts receiver", func() error {
+		for msg := range messages {
+			var err error
+			switch msg.Type {
+			case signaling.TYPE_ARTIFACT_MANIFEST:
+				err = handleManifest(msg)
+			case signaling.TYPE_ARTIFACT_FETCH:
+				err = handleFetch(msg)
+			case signaling.TYPE_ARTIFACT_CHUNK:
+				err = handleChunk(msg)
+			}
+			if err != nil {
+				log.Printf("Unable to handle artifact message: %s", err)
+			}
+		}
+		return nil
+	})
+}
+
+/*
+handleManifest() verifies a signed manifest from our parent, applies the
+artifacts whose content we already have and starts (or resumes) fetching the
+rest.
+*/
+func handleManifest(msg signaling.Message) error {
+	signed := &signedManifest{}
+	if err := json.Unmarshal([]byte(msg.Data), signed); err != nil {
+		return err
+	}
+	if err := keys.VerifyFromParent(signed.Manifest, signed.Signature); err != nil {
+		return fmt.Errorf("Signature didn't verify: %s", err)
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(signed.Manifest, manifest); err != nil {
+		return err
+	}
+
+	fetches := make([]Fetch, 0)
+	changed := false
+	storeLock.Lock()
+	for name, entry := range manifest.Artifacts {
+		if current[name] == entry {
+			continue
+		}
+		if entry.Size > MAX_ARTIFACT_SIZE || !validHash(entry.Hash) {
+			log.Printf("Ignoring invalid artifact %s", name)
+			continue
+		}
+		if data, found := content(entry.Hash); found {
+			apply(name, entry, data)
+			changed = true
+			continue
+		}
+		if pending[entry.Hash] == nil {
+			pending[entry.Hash] = make(map[string]bool)
+		}
+		pending[entry.Hash][name] = true
+		fetches = append(fetches, Fetch{Hash: entry.Hash, Offset: len(partial[entry.Hash])})
+	}
+	storeLock.Unlock()
+
+	for _, fetch := range fetches {
+		if err := requestChunk(fetch); err != nil {
+			return err
+		}
+	}
+	if changed {
+		return announce()
+	}
+	return nil
+}
+
+// requestChunk() asks our parent for a chunk of an artifact.
+func requestChunk(fetch Fetch) error {
+	data, err := json.Marshal(&fetch)
+	if err != nil {
+		return err
+	}
+	signaling.Send(signaling.Message{Type: signaling.TYPE_ARTIFACT_FETCH, Data: string(data)})
+	return nil
+}
+
+// handleFetch() sends a chunk of an artifact that we have to the child that
+// asked for it.
+func handleFetch(msg signaling.Message) error {
+	fetch := &Fetch{}
+	if err := json.Unmarshal([]byte(msg.Data), fetch); err != nil {
+		return err
+	}
+	storeLock.Lock()
+	data, found := content(fetch.Hash)
+	storeLock.Unlock()
+	if !found {
+		return fmt.Errorf("No artifact with hash %s", fetch.Hash)
+	}
+	if fetch.Offset < 0 || fetch.Offset > len(data) {
+		return fmt.Errorf("Invalid offset %d for artifact %s", fetch.Offset, fetch.Hash)
+	}
+	end := fetch.Offset + CHUNK_SIZE
+	if end > len(data) {
+		end = len(data)
+	}
+	chunkBytes, err := json.Marshal(&Chunk{
+		Hash:   fetch.Hash,
+		Offset: fetch.Offset,
+		Total:  len(data),
+		Data:   data[fetch.Offset:end],
+	})
+	if err != nil {
+		return err
+	}
+	signaling.Send(signaling.Message{Recp: msg.Sender, Type: signaling.TYPE_ARTIFACT_CHUNK, Data: string(chunkBytes)})
+	return nil
+}
+
+/*
+handleChunk() adds a chunk to a fetch in progress.  Once the artifact is
+complete, it's verified against its hash and applied, and otherwise the next
+chunk is requested.
+*/
+func handleChunk(msg signaling.Message) error {
+	chunk := &Chunk{}
+	if err := json.Unmarshal([]byte(msg.Data), chunk); err != nil {
+		return err
+	}
+
+	storeLock.Lock()
+	names, found := pending[chunk.Hash]
+	if !found || chunk.Offset != len(partial[chunk.Hash]) {
+		// Not something that we asked for, or a duplicate
+		storeLock.Unlock()
+		return nil
+	}
+	if chunk.Total > MAX_ARTIFACT_SIZE || chunk.Offset+len(chunk.Data) > chunk.Total {
+		delete(partial, chunk.Hash)
+		storeLock.Unlock()
+		return fmt.Errorf("Invalid chunk for artifact %s", chunk.Hash)
+	}
+	data := append(partial[chunk.Hash], chunk.Data...)
+	if len(data) < chunk.Total {
+		partial[chunk.Hash] = data
+		storeLock.Unlock()
+		return requestChunk(Fetch{Hash: chunk.Hash, Offset: len(data)})
+	}
+
+	delete(partial, chunk.Hash)
+	delete(pending, chunk.Hash)
+	if hash := hashOf(data); hash != chunk.Hash {
+		storeLock.Unlock()
+		return fmt.Errorf("Artifact content hashed to %s instead of %s", hash, chunk.Hash)
+	}
+	store(data)
+	for name := range names {
+		apply(name, Entry{Hash: chunk.Hash, Size: len(data)}, data)
+	}
+	storeLock.Unlock()
+
+	// Offer the new versions to our own children
+	return announce()
+}
+
+// apply() makes the given version current for the named artifact and notifies
+// watchers.  storeLock must be held.
+func apply(name string, entry Entry, data []byte) {
+	current[name] = entry
+	log.Printf("Applied artifact %s version %s", name, entry.Hash)
+	for _, watcher := range watchers[name] {
+		select {
+		case watcher <- data:
+		default:
+		}
+	}
+}
+
+// store() stores the given content, returning its hash.  storeLock must be
+// held.
+func store(data []byte) string {
+	hash := hashOf(data)
+	contents[hash] = data
+	if !config.Ephemeral() {
+		if err := ioutil.WriteFile(storeDir+hash, data, 0644); err != nil {
+			log.Printf("Unable to cache artifact %s on disk: %s", hash, err)
+		}
+	}
+	return hash
+}
+
+// content() returns the content with the given hash from memory or from disk.
+// storeLock must be held.
+func content(hash string) ([]byte, bool) {
+	if !validHash(hash) {
+		return nil, false
+	}
+	if data, found := contents[hash]; found {
+		return data, true
+	}
+	if config.Ephemeral() {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(storeDir + hash)
+	if err != nil || hashOf(data) != hash {
+		return nil, false
+	}
+	contents[hash] = data
+	return data, true
+}
+
+// validHash() checks that the given hash is a hex SHA-256, which also keeps it
+// from being used to traverse paths.
+func validHash(hash string) bool {
+	decoded, err := hex.DecodeString(hash)
+	return err == nil && len(decoded) == sha256.Size
+}
+
+// hashOf() returns the hex SHA-256 of the given content.
+func hashOf(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
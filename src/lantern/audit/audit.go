@@ -0,0 +1,420 @@
+/*
+Package audit keeps an append-only log of security-relevant events, so that
+operators can reconstruct who got a certificate, which certificates were
+revoked, what we trusted and when our configuration was changed.  Events are:
+
+- EVENT_CERT_ISSUED - we issued a certificate (see keys.IssueCertificate())
+- EVENT_CERT_REVOKED - we revoked a certificate (see keys.Revoke())
+- EVENT_TRUST_CHANGED - a certificate was added to or removed from the trust
+  store, we adopted a new parent certificate, or a PSK was paired or removed
+- EVENT_CONFIG_CHANGED - a change was made through the admin or configuration
+  API of the UI
+- EVENT_AUTH_FAILED - someone presented an invalid UI token, or a peer failed
+  to authenticate with the remote proxy
+- EVENT_AUTH_FALLBACK - a peer authenticated with a PSK instead of its
+  certificate
+- EVENT_PEER_PENALIZED - a peer was penalized or pardoned because of its
+  reputation (see package lantern/reputation)
+
+The log is kept in [config.ConfigDir]/audit.log, one JSON encoded Entry per
+line, readable only by the user running lantern.  Ephemeral nodes keep it in
+memory.
+
+Entries are hash-chained: every Entry carries the Hash of the one before it
+and its own Hash covers all of its fields, so changing or removing an entry
+breaks the chain from there on (see Verify()).  Removing entries from the end
+can only be detected by comparing with a Head() that was noted down earlier.
+Hashes are HMAC-SHA256s under a random key that's kept apart from the log, in
+[config.ConfigDir]/keys/audit.key, so whoever can change the log but can't read
+the key can't compute a chain that fits their changes either.  Logs of older
+versions, whose hashes were unkeyed, are moved to audit-unkeyed.log when the
+key is created.
+
+Since some of the subjects and details come from the network, the log is
+bounded:
+
+- Subject and Details are truncated to MAX_SUBJECT_LENGTH and
+  MAX_DETAILS_LENGTH
+- at most AUTH_FAILURES_PER_SOURCE EVENT_AUTH_FAILED entries are recorded per
+  source IP in every AUTH_FAILURE_WINDOW.  With the first entry after the
+  window, the number of failures that weren't recorded is, in one entry per IP
+  (for at most MAX_FAILURE_SOURCES IPs, the others are counted together)
+
+Lines that can't be read back, because they're too long or don't parse, are
+skipped.  That shows as a break in the chain, but the chain goes on from the
+last entry that could be read.
+
+The log can be exported at http://[config.UIAddress()]/admin/audit.
+*/
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lantern/config"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	EVENT_CERT_ISSUED    = "cert-issued"    // we issued a certificate
+	EVENT_CERT_REVOKED   = "cert-revoked"   // we revoked a certificate
+	EVENT_TRUST_CHANGED  = "trust-changed"  // what we trust changed
+	EVENT_CONFIG_CHANGED = "config-changed" // our configuration was changed through the UI
+	EVENT_AUTH_FAILED    = "auth-failed"    // someone failed to authenticate
+	EVENT_AUTH_FALLBACK  = "auth-fallback"  // a peer authenticated with a PSK instead of its certificate
+	EVENT_PEER_PENALIZED = "peer-penalized" // a peer was penalized or pardoned because of its reputation
+
+	MAX_LINE_LENGTH          = 64 * 1024       // the longest entry that we read back
+	MAX_SUBJECT_LENGTH       = 256             // the longest Subject that we record
+	MAX_DETAILS_LENGTH       = 1024            // the longest Details that we record
+	AUTH_FAILURES_PER_SOURCE = 10              // EVENT_AUTH_FAILED entries recorded per source IP and window
+	AUTH_FAILURE_WINDOW      = 1 * time.Minute // the window in which AUTH_FAILURES_PER_SOURCE applies
+	MAX_FAILURE_SOURCES      = 1000            // source IPs that are counted apart in a window
+	OTHER_SOURCES            = "other sources" // the subject under which the failures of further IPs are summarized
+	KEY_SIZE                 = 32              // the size of the HMAC key in bytes
+)
+
+// Entry is an event in the audit log.
+type Entry struct {
+	Seq      int64     // the position of the entry in the log, starting at 1
+	At       time.Time // when the event happened
+	Event    string    // what happened, one of the EVENT_ constants
+	Subject  string    // what the event is about, like a serial number or a path
+	Details  string    // more about the event, may be empty
+	PrevHash string    // the hash of the previous entry, empty for the first one
+	Hash     string    // the hex encoded HMAC-SHA256 of the entry's other fields
+}
+
+// Export is the audit log together with the outcome of its verification.
+type Export struct {
+	Intact  bool    // whether the hash chain is intact
+	Problem string  // what's wrong with the chain, if it's broken
+	Head    string  // the hash of the last entry
+	Entries []Entry // the entries, oldest first
+}
+
+var (
+	auditFile     = filepath.Join(config.ConfigDir, "audit.log")         // where we keep the log
+	unkeyedFile   = filepath.Join(config.ConfigDir, "audit-unkeyed.log") // where the log of older versions is moved
+	keyFile       = filepath.Join(config.ConfigDir, "keys", "audit.key") // where we keep the HMAC key
+	key           []byte                                                 // the HMAC key
+	lastSeq       int64                                                  // the Seq of the last entry
+	lastHash      string                                                 // the Hash of the last entry
+	inMemory      = make([]Entry, 0)                                     // the log of ephemeral nodes
+	failureWindow time.Time                                              // when the current AUTH_FAILURE_WINDOW started
+	failures      = make(map[string]int)                                 // EVENT_AUTH_FAILED entries in the current window, by source IP
+	suppressed    = make(map[string]int)                                 // failures in the current window that weren't recorded, by source IP
+	auditMutex    sync.Mutex                                             // used to synchronize access to all of the above
+)
+
+func init() {
+	var err error
+	if key, err = loadKey(); err != nil {
+		log.Printf("Unable to load audit log key from %s, the log can't be verified across restarts: %s", keyFile, err)
+	}
+	entries, err := readEntries()
+	if err != nil {
+		log.Printf("Unable to read audit log from %s: %s", auditFile, err)
+		return
+	}
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		lastSeq, lastHash = last.Seq, last.Hash
+	}
+	if err := verify(entries); err != nil {
+		log.Printf("WARNING: Audit log at %s was tampered with: %s", auditFile, err)
+	}
+}
+
+/*
+Record() appends an entry for the given event about the given subject to the
+audit log.  Failures to write the log are logged but don't keep whatever is
+being audited from happening.
+*/
+func Record(event string, subject string, details string) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	summarizeFailures()
+	if event == EVENT_AUTH_FAILED && !allowFailure(subject) {
+		return
+	}
+	record(event, subject, details)
+}
+
+// record() appends an entry to the audit log.  auditMutex must be held.
+func record(event string, subject string, details string) {
+	entry := Entry{
+		Seq:      lastSeq + 1,
+		At:       time.Now().UTC(),
+		Event:    event,
+		Subject:  truncate(subject, MAX_SUBJECT_LENGTH),
+		Details:  truncate(details, MAX_DETAILS_LENGTH),
+		PrevHash: lastHash,
+	}
+	entry.Hash = hashOf(&entry)
+	if err := appendEntry(&entry); err != nil {
+		log.Printf("Unable to write audit log to %s: %s", auditFile, err)
+		return
+	}
+	lastSeq, lastHash = entry.Seq, entry.Hash
+}
+
+// truncate() cuts the given text down to the given number of bytes, marking
+// that it did.
+func truncate(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+	return text[:max] + "..."
+}
+
+/*
+allowFailure() checks whether an EVENT_AUTH_FAILED entry for the given subject
+(usually a host:port) may be recorded in the current window, and if not,
+counts it as suppressed.  auditMutex must be held.
+*/
+func allowFailure(subject string) bool {
+	source := subject
+	if host, _, err := net.SplitHostPort(subject); err == nil {
+		source = host
+	}
+	if _, found := failures[source]; !found && len(failures) >= MAX_FAILURE_SOURCES {
+		source = OTHER_SOURCES
+	}
+	if failures[source] >= AUTH_FAILURES_PER_SOURCE {
+		suppressed[source] += 1
+		return false
+	}
+	failures[source] += 1
+	return true
+}
+
+/*
+summarizeFailures() starts a new AUTH_FAILURE_WINDOW once the current one is
+over, recording how many failures of each source weren't recorded in it.
+auditMutex must be held.
+*/
+func summarizeFailures() {
+	if time.Since(failureWindow) < AUTH_FAILURE_WINDOW {
+		return
+	}
+	for source, count := range suppressed {
+		record(EVENT_AUTH_FAILED, source, fmt.Sprintf("%d more failures since %s weren't recorded", count, failureWindow.UTC().Format(time.RFC3339)))
+	}
+	failureWindow = time.Now()
+	failures = make(map[string]int)
+	suppressed = make(map[string]int)
+}
+
+// Recordf() is like Record() with details formatted from the given format and
+// arguments.
+func Recordf(event string, subject string, format string, args ...interface{}) {
+	Record(event, subject, fmt.Sprintf(format, args...))
+}
+
+// Head() returns the hash of the last entry in the audit log, which covers the
+// whole log before it.
+func Head() string {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	return lastHash
+}
+
+// Verify() checks the hash chain of the audit log, returning an error that
+// describes the first entry that doesn't fit.
+func Verify() error {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	entries, err := readEntries()
+	if err != nil {
+		return err
+	}
+	return verify(entries)
+}
+
+// ExportLog() returns all entries of the audit log and whether they verify.
+func ExportLog() (*Export, error) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	entries, err := readEntries()
+	if err != nil {
+		return nil, err
+	}
+	export := &Export{Intact: true, Head: lastHash, Entries: entries}
+	if err := verify(entries); err != nil {
+		export.Intact = false
+		export.Problem = err.Error()
+	}
+	return export, nil
+}
+
+// hashOf() computes the hash of the given entry, leaving out its Hash.
+func hashOf(entry *Entry) string {
+	sum := hmac.New(sha256.New, key)
+	for _, field := range []string{
+		strconv.FormatInt(entry.Seq, 10),
+		entry.At.Format(time.RFC3339Nano),
+		entry.Event,
+		entry.Subject,
+		entry.Details,
+		entry.PrevHash,
+	} {
+		// Length-prefixing keeps fields from bleeding into each other
+		fmt.Fprintf(sum, "%d:%s", len(field), field)
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// verify() checks the hash chain of the given entries.
+func verify(entries []Entry) error {
+	prevHash := ""
+	for i, entry := range entries {
+		if entry.Seq != int64(i+1) {
+			return fmt.Errorf("Entry %d has sequence number %d", i+1, entry.Seq)
+		}
+		if entry.PrevHash != prevHash {
+			return fmt.Errorf("Entry %d doesn't follow the entry before it", entry.Seq)
+		}
+		if !hmac.Equal([]byte(hashOf(&entry)), []byte(entry.Hash)) {
+			return fmt.Errorf("Entry %d was modified", entry.Seq)
+		}
+		prevHash = entry.Hash
+	}
+	return nil
+}
+
+// appendEntry() appends the given entry to the log.  auditMutex must be held.
+func appendEntry(entry *Entry) error {
+	if config.Ephemeral() {
+		inMemory = append(inMemory, *entry)
+		return nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(auditFile), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(auditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+/*
+readEntries() reads all entries of the log, skipping lines that are longer than
+MAX_LINE_LENGTH or don't parse.  auditMutex must be held.
+*/
+func readEntries() ([]Entry, error) {
+	if config.Ephemeral() {
+		return append([]Entry{}, inMemory...), nil
+	}
+	file, err := os.Open(auditFile)
+	if os.IsNotExist(err) {
+		return []Entry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries := make([]Entry, 0)
+	reader := bufio.NewReaderSize(file, MAX_LINE_LENGTH)
+	for lineNumber := 1; ; lineNumber++ {
+		line, tooLong, err := readLine(reader)
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if tooLong {
+			log.Printf("Skipping line %d of audit log, it's longer than %d bytes", lineNumber, MAX_LINE_LENGTH)
+			continue
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			log.Printf("Skipping line %d of audit log, it doesn't parse: %s", lineNumber, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+}
+
+/*
+readLine() reads the next line from the given reader, only keeping up to
+MAX_LINE_LENGTH bytes of it in memory.  Returns true if the line was longer
+than that, in which case the rest of it is discarded.
+*/
+func readLine(reader *bufio.Reader) ([]byte, bool, error) {
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		for err == bufio.ErrBufferFull {
+			_, err = reader.ReadSlice('\n')
+		}
+		if err != nil && err != io.EOF {
+			return nil, false, err
+		}
+		return nil, true, nil
+	}
+	if err == io.EOF && len(line) > 0 {
+		// The last line may lack its newline
+		err = nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return append([]byte{}, line...), false, nil
+}
+
+/*
+loadKey() returns the HMAC key, creating it if it doesn't exist yet, in which
+case an unkeyed log of an older version is moved aside.  Ephemeral nodes use a
+key that only lives as long as their log.
+*/
+func loadKey() ([]byte, error) {
+	newKey := make([]byte, KEY_SIZE)
+	if _, err := rand.Read(newKey); err != nil {
+		return nil, err
+	}
+	if config.Ephemeral() {
+		return newKey, nil
+	}
+	existing, err := ioutil.ReadFile(keyFile)
+	if err == nil && len(existing) == KEY_SIZE {
+		return existing, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return newKey, err
+	}
+	if _, err := os.Stat(auditFile); err == nil {
+		log.Printf("Moving audit log without keyed hashes to %s", unkeyedFile)
+		if err := os.Rename(auditFile, unkeyedFile); err != nil {
+			return newKey, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		return newKey, err
+	}
+	return newKey, ioutil.WriteFile(keyFile, newKey, 0600)
+}
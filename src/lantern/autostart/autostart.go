@@ -0,0 +1,112 @@
+/*
+Package autostart starts lantern when the user logs in, if they want it to (see
+config.LaunchAtStartup()).  Unlike the system services of package
+lantern/service, which run lantern unattended on servers, this is for end users
+on desktops:
+
+- on OS X, a launchd agent in ~/Library/LaunchAgents that runs at load
+- on Windows, a value under the Run key in HKEY_CURRENT_USER
+- on Linux, an XDG autostart entry in ~/.config/autostart
+
+The entry starts the current executable with the [config.BaseDir].  Since the
+executable may move (for example when it's updated), the entry is rewritten at
+every start while launching at startup is enabled.
+
+The setting can be inspected and changed at
+http://[config.UIAddress()]/admin/autostart, where a POST with the form value
+enabled (true or false) enables or disables it.
+*/
+package autostart
+
+import (
+	"encoding/json"
+	"fmt"
+	"lantern/config"
+	"lantern/ui"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const APP_NAME = "Lantern" // the name under which lantern is registered to start at login
+
+// autostartSettings is the representation of the setting used by the
+// /admin/autostart API.
+type autostartSettings struct {
+	Enabled    bool // whether lantern is supposed to start at login
+	Registered bool // whether lantern is actually registered to start at login
+}
+
+func init() {
+	ui.HandleFunc("/admin/autostart", autostartHandler)
+	if config.LaunchAtStartup() && !config.Ephemeral() {
+		if err := enable(); err != nil {
+			log.Printf("Unable to register lantern to start at login: %s", err)
+		}
+	}
+}
+
+// SetEnabled() enables or disables starting lantern at login.
+func SetEnabled(enabled bool) error {
+	if config.Ephemeral() {
+		return fmt.Errorf("Ephemeral nodes can't start at login")
+	}
+	var err error
+	if enabled {
+		err = enable()
+	} else {
+		err = disable()
+	}
+	if err != nil {
+		return err
+	}
+	config.SetLaunchAtStartup(enabled)
+	return nil
+}
+
+// command() returns the executable and arguments (including our subcommand, if
+// any) with which lantern is started at login.
+func command() (string, []string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to determine executable: %s", err)
+	}
+	baseDir, err := filepath.Abs(config.BaseDir)
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to determine config directory: %s", err)
+	}
+	if subcommand := config.Subcommand(); subcommand != "" {
+		return executable, []string{subcommand, baseDir}, nil
+	}
+	return executable, []string{baseDir}, nil
+}
+
+/*
+autostartHandler() returns the setting on GET and enables or disables starting
+at login according to the form value enabled on POST.
+*/
+func autostartHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		enabled, err := strconv.ParseBool(req.FormValue("enabled"))
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf("Invalid value for enabled: %s", req.FormValue("enabled"))))
+			return
+		}
+		if err := SetEnabled(enabled); err != nil {
+			resp.WriteHeader(500)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+	}
+	settings := &autostartSettings{Enabled: config.LaunchAtStartup(), Registered: registered()}
+	if settingsJson, err := json.MarshalIndent(settings, "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(settingsJson)
+	}
+}
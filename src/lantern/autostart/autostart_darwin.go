@@ -0,0 +1,86 @@
+package autostart
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// LAUNCHD_LABEL is the label of the launchd agent that starts lantern at login.
+const LAUNCHD_LABEL = "org.getlantern.lantern.autostart"
+
+const plistTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s	</array>
+	<key>RunAtLoad</key>
+	<true/>
+</dict>
+</plist>
+`
+
+// plistFile() returns where the launchd agent is installed.
+func plistFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", LAUNCHD_LABEL+".plist"), nil
+}
+
+// enable() writes a launchd agent that starts lantern at login.  launchd picks
+// it up at the next login, so it isn't loaded now.
+func enable() error {
+	executable, args, err := command()
+	if err != nil {
+		return err
+	}
+	var programArguments bytes.Buffer
+	for _, arg := range append([]string{executable}, args...) {
+		programArguments.WriteString("\t\t<string>")
+		xml.EscapeText(&programArguments, []byte(arg))
+		programArguments.WriteString("</string>\n")
+	}
+	plist, err := plistFile()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(plist), 0755); err != nil {
+		return err
+	}
+	content := fmt.Sprintf(plistTemplate, LAUNCHD_LABEL, programArguments.String())
+	if err := ioutil.WriteFile(plist, []byte(content), 0644); err != nil {
+		return fmt.Errorf("Unable to write %s: %s", plist, err)
+	}
+	return nil
+}
+
+// disable() removes the launchd agent.
+func disable() error {
+	plist, err := plistFile()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(plist); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// registered() indicates whether or not the launchd agent is installed.
+func registered() bool {
+	plist, err := plistFile()
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(plist)
+	return err == nil
+}
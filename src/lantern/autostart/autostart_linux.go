@@ -0,0 +1,82 @@
+package autostart
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const desktopTemplate = `[Desktop Entry]
+Type=Application
+Name=%s
+Exec=%s
+X-GNOME-Autostart-enabled=true
+`
+
+// desktopFile() returns where the XDG autostart entry is installed.
+func desktopFile() (string, error) {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		configHome = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configHome, "autostart", "lantern.desktop"), nil
+}
+
+// enable() writes an XDG autostart entry that starts lantern at login.
+func enable() error {
+	executable, args, err := command()
+	if err != nil {
+		return err
+	}
+	quoted := make([]string, 0, len(args)+1)
+	for _, arg := range append([]string{executable}, args...) {
+		quoted = append(quoted, quote(arg))
+	}
+	desktop, err := desktopFile()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(desktop), 0755); err != nil {
+		return err
+	}
+	content := fmt.Sprintf(desktopTemplate, APP_NAME, strings.Join(quoted, " "))
+	if err := ioutil.WriteFile(desktop, []byte(content), 0644); err != nil {
+		return fmt.Errorf("Unable to write %s: %s", desktop, err)
+	}
+	return nil
+}
+
+// disable() removes the XDG autostart entry.
+func disable() error {
+	desktop, err := desktopFile()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(desktop); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// registered() indicates whether or not the XDG autostart entry is installed.
+func registered() bool {
+	desktop, err := desktopFile()
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(desktop)
+	return err == nil
+}
+
+// quote() quotes an argument of the Exec key as the desktop entry
+// specification requires.
+func quote(arg string) string {
+	replacer := strings.NewReplacer(`\`, `\\\\`, `"`, `\\"`, "`", "\\\\`", "$", `\\$`)
+	return `"` + replacer.Replace(arg) + `"`
+}
@@ -0,0 +1,21 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package autostart
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func enable() error {
+	return fmt.Errorf("Starting at login isn't supported on %s", runtime.GOOS)
+}
+
+func disable() error {
+	return nil
+}
+
+func registered() bool {
+	return false
+}
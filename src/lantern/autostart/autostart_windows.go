@@ -0,0 +1,45 @@
+package autostart
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// RUN_KEY is the registry key whose values Windows starts at login.
+const RUN_KEY = `HKCU\Software\Microsoft\Windows\CurrentVersion\Run`
+
+// enable() adds a value under the Run key that starts lantern at login.
+func enable() error {
+	executable, args, err := command()
+	if err != nil {
+		return err
+	}
+	quoted := make([]string, 0, len(args)+1)
+	for _, arg := range append([]string{executable}, args...) {
+		quoted = append(quoted, `"`+arg+`"`)
+	}
+	return run("reg.exe", "add", RUN_KEY, "/v", APP_NAME, "/t", "REG_SZ", "/d", strings.Join(quoted, " "), "/f")
+}
+
+// disable() removes our value from the Run key.
+func disable() error {
+	if !registered() {
+		return nil
+	}
+	return run("reg.exe", "delete", RUN_KEY, "/v", APP_NAME, "/f")
+}
+
+// registered() indicates whether or not our value is under the Run key.
+func registered() bool {
+	return exec.Command("reg.exe", "query", RUN_KEY, "/v", APP_NAME).Run() == nil
+}
+
+// run() runs the given system command, including its output in the error if it
+// fails.
+func run(name string, args ...string) error {
+	if output, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %s: %s", name, err, output)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+/*
+Package blocklist keeps track of the identities (email addresses) that this
+lantern node refuses to proxy for when giving access to the network.
+
+The effective blocklist is a merge of three sources:
+
+- the remote blocklist, which is built up from signed deltas that our parent
+  pushes down to us over the signaling channel (TYPE_BLOCKLIST_DELTA)
+- the identities blocked by the config fragment that our parent assigned to us
+  (see package lantern/parentconfig)
+- the local operator's lists, config.BlockedIdentities() and
+  config.UnblockedIdentities()
+
+The local operator's lists always take precedence.  An identity that the
+operator has blocked stays blocked no matter what our parent says, and an
+identity that the operator has unblocked is allowed even if our parent has
+blocklisted it.
+
+Deltas are only applied if they carry a valid signature from our parent, so
+that nobody else on the signaling channel can block (or unblock) identities on
+our behalf, and if their Sequence is higher than that of the last delta that we
+applied, so that old deltas can't be replayed to undo newer ones.  Publishers
+number their deltas with the current time in nanoseconds (or one more than the
+last, if that's higher), so that their sequence keeps increasing even if they
+lose their state.
+
+The remote blocklist and the sequence numbers are saved to
+[config.ConfigDir]/blocklist.json (except on ephemeral nodes), so that they
+survive restarts.
+*/
+package blocklist
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"lantern/config"
+	"lantern/keys"
+	"lantern/parentconfig"
+	"lantern/signaling"
+	"lantern/util"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Delta captures a set of changes to the remote blocklist.
+type Delta struct {
+	Sequence int64    // higher than the Sequence of all earlier deltas from the same publisher
+	Added    []string // identities to add to the blocklist
+	Removed  []string // identities to remove from the blocklist
+}
+
+// signedDelta is a Delta as it travels over the signaling channel.
+type signedDelta struct {
+	Delta     []byte // the JSON encoded Delta
+	Signature []byte // the signature of Delta by the sender's private key
+}
+
+// state is what we save to stateFile.
+type state struct {
+	Remote        []string // identities blocklisted by our parent
+	LastApplied   int64    // the Sequence of the last delta that we applied
+	LastPublished int64    // the Sequence of the last delta that we published
+}
+
+var (
+	stateFile     = config.ConfigDir + "/blocklist.json" // where our state is saved
+	remote        = make(map[string]bool)                // identities blocklisted by our parent
+	lastApplied   int64                                  // the Sequence of the last delta that we applied
+	lastPublished int64                                  // the Sequence of the last delta that we published
+	remoteMutex   sync.RWMutex                           // used to synchronize access to all of the above
+)
+
+func init() {
+	load()
+	go receive()
+}
+
+/*
+IsBlocked() indicates whether or not the given identity is blocked, taking into
+account both the local operator's lists and the remote blocklist.
+*/
+func IsBlocked(identity string) bool {
+	for _, blocked := range config.BlockedIdentities() {
+		if blocked == identity {
+			return true
+		}
+	}
+	for _, unblocked := range config.UnblockedIdentities() {
+		if unblocked == identity {
+			return false
+		}
+	}
+	if parentconfig.IsBlocked(identity) {
+		return true
+	}
+	remoteMutex.RLock()
+	defer remoteMutex.RUnlock()
+	return remote[identity]
+}
+
+/*
+Publish() numbers the given Delta, signs it with our private key and pushes it
+down to our children over the signaling channel.
+*/
+func Publish(delta Delta) error {
+	remoteMutex.Lock()
+	delta.Sequence = time.Now().UnixNano()
+	if delta.Sequence <= lastPublished {
+		delta.Sequence = lastPublished + 1
+	}
+	lastPublished = delta.Sequence
+	save()
+	remoteMutex.Unlock()
+
+	deltaBytes, err := json.Marshal(delta)
+	if err != nil {
+		return err
+	}
+	signature, err := keys.Sign(deltaBytes)
+	if err != nil {
+		return fmt.Errorf("Unable to sign blocklist delta: %s", err)
+	}
+	data, err := json.Marshal(&signedDelta{Delta: deltaBytes, Signature: signature})
+	if err != nil {
+		return err
+	}
+	signaling.Send(signaling.Message{
+		Type: signaling.TYPE_BLOCKLIST_DELTA,
+		Data: string(data),
+	})
+	return nil
+}
+
+// receive() listens for blocklist deltas on the signaling channel.
+func receive() {
+	messages := make(chan signaling.Message)
+	signaling.RecvMatching(messages, signaling.Filter{
+		Types: []signaling.MessageType{signaling.TYPE_BLOCKLIST_DELTA},
+	})
+	// Restarts keep receiving on the same channel, which stays registered
+	util.Supervise("blocklist receiver", func() error {
+		for msg := range messages {
+			if msg.Type == signaling.TYPE_BLOCKLIST_DELTA {
+				if err := apply(msg.Data); err != nil {
+					log.Printf("Unable to apply blocklist delta: %s", err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// apply() verifies a signed delta from our parent and applies it to the
+// remote blocklist.
+func apply(data string) error {
+	signed := &signedDelta{}
+	if err := json.Unmarshal([]byte(data), signed); err != nil {
+		return err
+	}
+	if err := keys.VerifyFromParent(signed.Delta, signed.Signature); err != nil {
+		return fmt.Errorf("Signature didn't verify: %s", err)
+	}
+	delta := &Delta{}
+	if err := json.Unmarshal(signed.Delta, delta); err != nil {
+		return err
+	}
+
+	remoteMutex.Lock()
+	defer remoteMutex.Unlock()
+	if delta.Sequence <= lastApplied {
+		return fmt.Errorf("Delta %d is older than the last one that we applied (%d)", delta.Sequence, lastApplied)
+	}
+	for _, identity := range delta.Added {
+		remote[identity] = true
+	}
+	for _, identity := range delta.Removed {
+		delete(remote, identity)
+	}
+	lastApplied = delta.Sequence
+	save()
+	log.Printf("Applied blocklist delta %d, %d added, %d removed", delta.Sequence, len(delta.Added), len(delta.Removed))
+	return nil
+}
+
+// load() loads the state that we saved last time.
+func load() {
+	if config.Ephemeral() {
+		return
+	}
+	data, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		return
+	}
+	saved := &state{}
+	if err := json.Unmarshal(data, saved); err != nil {
+		log.Printf("Ignoring saved blocklist: %s", err)
+		return
+	}
+	for _, identity := range saved.Remote {
+		remote[identity] = true
+	}
+	lastApplied = saved.LastApplied
+	lastPublished = saved.LastPublished
+}
+
+// save() saves our state so that it survives restarts.  remoteMutex must be
+// held.
+func save() {
+	if config.Ephemeral() {
+		return
+	}
+	saved := &state{Remote: make([]string, 0, len(remote)), LastApplied: lastApplied, LastPublished: lastPublished}
+	for identity := range remote {
+		saved.Remote = append(saved.Remote, identity)
+	}
+	sort.Strings(saved.Remote)
+	data, err := json.MarshalIndent(saved, "", "   ")
+	if err != nil {
+		log.Printf("Unable to encode blocklist: %s", err)
+		return
+	}
+	if err := ioutil.WriteFile(stateFile, data, 0644); err != nil {
+		log.Printf("Unable to save blocklist: %s", err)
+	}
+}
@@ -0,0 +1,235 @@
+/*
+Package bootstrap maintains the list of fallback proxies that lantern uses
+when it doesn't know of any other way out, for example right after being
+installed behind a censor.
+
+Release builds ship with the latest signed list and the public half of the
+bootstrap signing key embedded (see release.go), development builds with
+neither, so they don't accept any list.  Updates of the list arrive in two ways:
+
+- over the peer network, as the ARTIFACT_NAME artifact that parents push down
+  to their children (see package lantern/artifacts)
+- from the urls in config.BootstrapSources(), which are polled every
+  REFRESH_INTERVAL, either domain fronted or through our own local proxy
+
+Whatever the source, a list is only accepted if it carries a valid Ed25519
+signature from the bootstrap signing key, whose public half is baked into the
+build as PublicKey, and if its Version is higher than that of the list
+that we have.  That way neither a parent nor whoever sits between us and a
+source can slip us their own proxies or replay an older list.  Lists fetched
+from a url are in turn published to our children as an artifact.
+
+The current list is kept in [config.ConfigDir]/bootstrap.signed (except on
+ephemeral nodes), and its proxies are available from Proxies().  Release
+tooling signs lists with Sign().
+*/
+package bootstrap
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lantern/artifacts"
+	"lantern/config"
+	"lantern/util"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ARTIFACT_NAME    = "bootstrap"      // the name of the artifact under which the list travels between peers
+	REFRESH_INTERVAL = 6 * time.Hour    // how frequently we poll config.BootstrapSources()
+	FETCH_TIMEOUT    = 30 * time.Second // how long fetching the list from a url may take
+	MAX_LIST_SIZE    = 256 * 1024       // the largest signed list that we accept
+)
+
+// List is the list of fallback proxies.
+type List struct {
+	Version int64     // increases with every list that's signed, so that older lists can't be replayed
+	Issued  time.Time // when the list was signed
+	Proxies []string  // host:ports of the fallback proxies
+}
+
+// signedList is a List as it's embedded, stored and distributed.
+type signedList struct {
+	List      []byte // the JSON encoded List
+	Signature []byte // the signature of List by the bootstrap signing key
+}
+
+var (
+	listFile  = config.ConfigDir + "/bootstrap.signed" // where the current list is kept
+	current   = &List{}                                // the current list
+	listMutex sync.RWMutex                             // used to synchronize access to current
+)
+
+func init() {
+	if _, err := verify(embedded); err != nil && release {
+		log.Fatalf("This release build has no valid bootstrap list embedded: %s", err)
+	}
+	accept(embedded, "embedded list")
+	if data, err := ioutil.ReadFile(listFile); err == nil {
+		accept(data, listFile)
+	}
+	if data, found := artifacts.Get(ARTIFACT_NAME); found {
+		accept(data, "peer network")
+	}
+	util.GoLoop("bootstrap list watcher", watcher)
+	util.GoLoop("bootstrap list refresher", refresher)
+}
+
+// Proxies() returns the host:ports of the fallback proxies on the current list.
+func Proxies() []string {
+	listMutex.RLock()
+	defer listMutex.RUnlock()
+	return append([]string{}, current.Proxies...)
+}
+
+// Current() returns the current list.
+func Current() List {
+	listMutex.RLock()
+	defer listMutex.RUnlock()
+	list := *current
+	list.Proxies = append([]string{}, current.Proxies...)
+	return list
+}
+
+/*
+Sign() signs the given list with the given private key of the bootstrap
+signing key, returning it in the form in which it's embedded and distributed.
+*/
+func Sign(list List, privateKey ed25519.PrivateKey) ([]byte, error) {
+	listBytes, err := json.Marshal(&list)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&signedList{List: listBytes, Signature: ed25519.Sign(privateKey, listBytes)})
+}
+
+// verify() checks the signature of the given signed list and decodes it.
+func verify(data []byte) (*List, error) {
+	if PublicKey == "" {
+		return nil, fmt.Errorf("No bootstrap public key was built in")
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(PublicKey))
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Invalid bootstrap public key: %s", PublicKey)
+	}
+	signed := &signedList{}
+	if err := json.Unmarshal(data, signed); err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(ed25519.PublicKey(publicKey), signed.List, signed.Signature) {
+		return nil, fmt.Errorf("Signature didn't verify")
+	}
+	list := &List{}
+	if err := json.Unmarshal(signed.List, list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+/*
+accept() makes the given signed list from the given source our current list,
+if it verifies and is newer than the one we have, returning whether or not it
+did.
+*/
+func accept(data []byte, source string) bool {
+	if len(data) == 0 {
+		return false
+	}
+	list, err := verify(data)
+	if err != nil {
+		log.Printf("Ignoring bootstrap list from %s: %s", source, err)
+		return false
+	}
+	listMutex.Lock()
+	defer listMutex.Unlock()
+	if list.Version <= current.Version {
+		return false
+	}
+	log.Printf("Using version %d of the bootstrap list from %s with %d proxies", list.Version, source, len(list.Proxies))
+	current = list
+	if !config.Ephemeral() {
+		if err := ioutil.WriteFile(listFile, data, 0644); err != nil {
+			log.Printf("Unable to save bootstrap list to %s: %s", listFile, err)
+		}
+	}
+	return true
+}
+
+// watcher() accepts the lists that arrive over the peer network.
+func watcher() {
+	updates := make(chan []byte, 1)
+	artifacts.Watch(ARTIFACT_NAME, updates)
+	for data := range updates {
+		accept(data, "peer network")
+	}
+}
+
+/*
+refresher() periodically fetches the list from config.BootstrapSources(),
+publishing the lists that it accepts to our children.
+*/
+func refresher() {
+	for {
+		for _, source := range config.BootstrapSources() {
+			data, err := fetch(source)
+			if err != nil {
+				log.Printf("Unable to fetch bootstrap list from %s: %s", source.URL, err)
+				continue
+			}
+			if accept(data, source.URL) {
+				if err := artifacts.Publish(ARTIFACT_NAME, data); err != nil {
+					log.Printf("Unable to publish bootstrap list: %s", err)
+				}
+			}
+		}
+		time.Sleep(REFRESH_INTERVAL)
+	}
+}
+
+/*
+fetch() fetches the signed list from the given source, domain fronted if it
+has a Front and through our local proxy (and thus over the peer network)
+otherwise.
+*/
+func fetch(source config.BootstrapSource) ([]byte, error) {
+	transport := &http.Transport{}
+	if source.Front == "" {
+		proxyUrl, err := url.Parse("http://" + config.LocalProxyAddress())
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	} else {
+		front := source.Front
+		transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			dialer := &tls.Dialer{Config: &tls.Config{ServerName: front}}
+			return dialer.DialContext(ctx, network, net.JoinHostPort(front, port))
+		}
+	}
+	client := &http.Client{Transport: transport, Timeout: FETCH_TIMEOUT}
+	resp, err := client.Get(source.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Unexpected response: %s", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, MAX_LIST_SIZE))
+}
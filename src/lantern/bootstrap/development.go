@@ -0,0 +1,13 @@
+//go:build !release
+// +build !release
+
+package bootstrap
+
+// Development builds (those without -tags release, see release.go) ship no
+// list and accept none, since they have no bootstrap public key.
+const release = false
+
+var (
+	embedded  []byte // the signed list that ships with this build
+	PublicKey string // the base64 encoded Ed25519 public key that bootstrap lists are signed with
+)
@@ -0,0 +1,25 @@
+//go:build release
+// +build release
+
+package bootstrap
+
+import (
+	_ "embed"
+)
+
+/*
+Release builds embed the signed list from fallbacks.signed and the base64
+encoded public key from publickey.txt, which release tooling writes next to
+this file before building with -tags release.  Neither file is in the tree, so
+a release build without them fails instead of shipping a node that has no way
+out, and init() refuses to start if the embedded list doesn't verify.
+*/
+const release = true
+
+var (
+	//go:embed fallbacks.signed
+	embedded []byte // the signed list that ships with this build
+
+	//go:embed publickey.txt
+	PublicKey string // the base64 encoded Ed25519 public key that bootstrap lists are signed with
+)
@@ -0,0 +1,100 @@
+/*
+Package client lets other Go programs tunnel their own connections through the
+lantern network without running the lantern binary:
+
+	conn, err := client.Dial(ctx, "tcp", "example.com:443")
+
+	httpClient := &http.Client{Transport: client.NewTransport()}
+
+Importing the package makes the program a lantern node of its own, with its
+own keys, certificate and config under the BaseDir that it passes in the
+config.EMBEDDED_ENV environment variable, for example:
+
+	LANTERN_EMBEDDED=/var/lib/myprogram/lantern myprogram
+
+Without it, the BaseDir is [os.UserConfigDir()]/<program>/lantern (see package
+lantern/client/embedded).
+
+Embedded nodes join the tree like any other node (through the parent address
+or invite in their config) but don't run the local proxy, the remote proxy or
+any of the other listeners (see config.SUBCOMMAND_EMBEDDED), so they don't
+take over the command line or the ports of the program.  The UI still serves
+at config.UIAddress() for configuring the node.
+
+The functions and types of this package are meant to stay as they are, while
+the packages that implement them (mostly lantern/proxy) may change at any time.
+*/
+package client
+
+import (
+	"context"
+	"fmt"
+	_ "lantern/client/embedded"
+	"lantern/keys"
+	"lantern/proxy"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	READY_CHECK_INTERVAL = 1 * time.Second // how often WaitUntilReady() checks whether we have an upstream proxy
+)
+
+// Status tells whether tunneling works right now, see CurrentStatus().
+type Status struct {
+	State     string // one of the proxy.STATE_ constants
+	Upstreams int    // how many upstream proxies we know of
+}
+
+/*
+Dial() connects to the given address through the lantern network, like
+net.Dialer.DialContext() would connect directly.  Only "tcp", "tcp4" and
+"tcp6" are supported.  Dial() fails right away if we have no certificate or
+upstream proxy yet, see WaitUntilReady().
+*/
+func Dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	return proxy.Dial(ctx, network, address)
+}
+
+/*
+NewTransport() returns an http.Transport that tunnels all of its connections
+through the lantern network.  Plain HTTP goes through the tunnel as it is, so
+the exit sees it unless the program uses HTTPS.
+*/
+func NewTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// We are the proxy, the environment's proxy settings don't apply
+	transport.Proxy = nil
+	transport.DialContext = Dial
+	return transport
+}
+
+/*
+WaitUntilReady() waits until we have a certificate and know of an upstream
+proxy, so that Dial() can succeed, or until ctx is done.
+*/
+func WaitUntilReady(ctx context.Context) error {
+	if cert, certChannel := keys.Certificate(); cert == nil {
+		select {
+		case <-certChannel:
+		case <-ctx.Done():
+			return fmt.Errorf("No certificate yet: %s", ctx.Err())
+		}
+	}
+	for {
+		if len(proxy.PeerRanking()) > 0 {
+			return nil
+		}
+		select {
+		case <-time.After(READY_CHECK_INTERVAL):
+		case <-ctx.Done():
+			return fmt.Errorf("No upstream proxy known yet: %s", ctx.Err())
+		}
+	}
+}
+
+// CurrentStatus() returns whether tunneling works right now.
+func CurrentStatus() Status {
+	return Status{State: proxy.Status().State, Upstreams: len(proxy.PeerRanking())}
+}
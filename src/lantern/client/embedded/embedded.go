@@ -0,0 +1,40 @@
+/*
+Package embedded makes sure that lantern runs embedded (see
+config.SUBCOMMAND_EMBEDDED) in programs that import lantern/client, even if
+they don't set config.EMBEDDED_ENV themselves, so that lantern never takes over
+their command line or their ports.
+
+It has to set the environment variable before package config is initialized,
+which is why it only imports the standard library: Go initializes the packages
+whose imports are initialized in the order of their import paths, and
+lantern/client/embedded comes before lantern/config.  For the same reason it
+can't use config.EMBEDDED_ENV itself.
+*/
+package embedded
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const (
+	EMBEDDED_ENV = "LANTERN_EMBEDDED" // must match config.EMBEDDED_ENV
+)
+
+func init() {
+	if os.Getenv(EMBEDDED_ENV) != "" {
+		return
+	}
+	os.Setenv(EMBEDDED_ENV, defaultBaseDir())
+}
+
+// defaultBaseDir() returns the BaseDir for programs that don't pick one, which
+// is specific to the program so that it doesn't share its node with others.
+func defaultBaseDir() string {
+	program := filepath.Base(os.Args[0])
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "." + program + "-lantern"
+	}
+	return filepath.Join(dir, program, "lantern")
+}
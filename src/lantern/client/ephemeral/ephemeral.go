@@ -0,0 +1,31 @@
+/*
+Package ephemeral makes lantern run embedded and ephemeral (see
+config.SUBCOMMAND_EMBEDDED and config.Ephemeral()) in programs that import it,
+so that lantern neither takes over their command line nor persists anything.
+Test binaries of lantern's own packages import it for that reason:
+
+	import _ "lantern/client/ephemeral"
+
+Like lantern/client/embedded, it only imports the standard library, so that it's
+initialized before package config, and it can't use the constants of package
+config.
+*/
+package ephemeral
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const (
+	EMBEDDED_ENV  = "LANTERN_EMBEDDED"  // must match config.EMBEDDED_ENV
+	EPHEMERAL_ENV = "LANTERN_EPHEMERAL" // must match config.EPHEMERAL_ENV
+)
+
+func init() {
+	os.Setenv(EPHEMERAL_ENV, "true")
+	if os.Getenv(EMBEDDED_ENV) != "" {
+		return
+	}
+	os.Setenv(EMBEDDED_ENV, filepath.Join(os.TempDir(), "lantern-"+filepath.Base(os.Args[0])))
+}
@@ -0,0 +1,33 @@
+package config
+
+/*
+AccessLog() returns what the local proxy logs about the requests that it
+serves.  Requests are only ever logged in memory, and not at all unless the
+user turns it on.
+*/
+func AccessLog() AccessLogConfig {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.AccessLog
+}
+
+func SetAccessLog(accessLog AccessLogConfig) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.AccessLog = accessLog
+	save()
+}
+
+const (
+	ACCESS_LOG_OFF    = "off"    // don't log requests at all
+	ACCESS_LOG_HOSTS  = "hosts"  // log requests with their host names
+	ACCESS_LOG_HASHED = "hashed" // log requests with hashes of their host names
+)
+
+// AccessLogConfig defines what the local proxy logs about the requests that it
+// serves (see accesslog.go in package lantern/proxy).
+type AccessLogConfig struct {
+	Mode         string // how requests are logged (an ACCESS_LOG_ constant)
+	IncludePaths bool   // whether the paths of plain HTTP requests are logged too, in ACCESS_LOG_HOSTS mode
+	MaxEntries   int    // how many of the latest requests are kept
+}
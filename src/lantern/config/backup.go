@@ -0,0 +1,376 @@
+package config
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+A backup is an encrypted archive of our [ConfigDir] (keys, certificates, config
+and everything else that we keep there), which lets a user move their node
+identity to a new machine without enrolling again:
+
+	lantern [flags] backup <archive> [BaseDir]
+	lantern [flags] restore <archive> [BaseDir]
+
+Both ask for a passphrase on the terminal (or read it from the first line of
+stdin if that isn't a terminal), do their job and exit without starting
+anything else.  The archive is a gzipped tar of [ConfigDir], encrypted with
+AES-256-GCM under a key derived from the passphrase with scrypt:
+
+	BACKUP_MAGIC | salt (BACKUP_SALT_BYTES) | nonce | ciphertext
+
+Restoring goes through the same checks as a migration (see migration.go), so
+the private key, the certificates, the peer table and config.json are only
+carried over if they're valid, and BindIP and AdvertiseIP are dropped since
+they're specific to the old machine.  Everything else in the archive is
+restored as is.  Files that get replaced are kept with a .premigration suffix,
+and the report is available from LastMigration() as after a migration.
+
+Since the restored node has the same identity as the old one, the old one
+shouldn't be started again once the new one is running.
+*/
+const (
+	BACKUP_COMMAND    = "backup"              // exports our [ConfigDir] to an encrypted archive
+	RESTORE_COMMAND   = "restore"             // imports our [ConfigDir] from an encrypted archive
+	BACKUP_MAGIC      = "lantern-backup-v1\n" // identifies backup archives
+	BACKUP_SALT_BYTES = 16                    // the size of the scrypt salt
+	BACKUP_KEY_BYTES  = 32                    // the size of the AES key (AES-256)
+	SCRYPT_N          = 1 << 15               // scrypt's CPU/memory cost
+	SCRYPT_R          = 8                     // scrypt's block size
+	SCRYPT_P          = 1                     // scrypt's parallelization
+)
+
+var (
+	archiveCommand string // BACKUP_COMMAND or RESTORE_COMMAND if we were started with one, set by parseArgs()
+	archivePath    string // the archive to back up to or restore from
+)
+
+/*
+parseArchiveArgs() takes the archive command and the path of the archive off
+the given arguments, returning the remaining ones.
+*/
+func parseArchiveArgs(args []string) []string {
+	archiveCommand = args[0]
+	if len(args) < 2 {
+		log.Fatalf("Usage: lantern [flags] %s <archive> [BaseDir]", archiveCommand)
+	}
+	archivePath = args[1]
+	return args[2:]
+}
+
+// isArchiveCommand() indicates whether the given argument is an archive
+// command.
+func isArchiveCommand(arg string) bool {
+	return arg == BACKUP_COMMAND || arg == RESTORE_COMMAND
+}
+
+// runArchiveCommand() runs the archive command that we were started with, if
+// any, and exits.
+func runArchiveCommand() {
+	var err error
+	switch archiveCommand {
+	case "":
+		return
+	case BACKUP_COMMAND:
+		err = backupTo(archivePath)
+	case RESTORE_COMMAND:
+		err = restoreFrom(archivePath)
+	}
+	if err != nil {
+		log.Fatalf("Unable to %s: %s", archiveCommand, err)
+	}
+	os.Exit(0)
+}
+
+// backupTo() writes an encrypted archive of our [ConfigDir] to the given path.
+func backupTo(path string) error {
+	archive, err := archiveConfigDir()
+	if err != nil {
+		return err
+	}
+	passphrase, err := readPassphrase("Passphrase to protect the backup: ")
+	if err != nil {
+		return err
+	}
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		confirmation, err := readPassphrase("Repeat the passphrase: ")
+		if err != nil {
+			return err
+		}
+		if confirmation != passphrase {
+			return fmt.Errorf("The passphrases don't match")
+		}
+	}
+	encrypted, err := encryptBackup(archive, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, encrypted, 0600); err != nil {
+		return err
+	}
+	log.Printf("Backed up %s to %s", ConfigDir, path)
+	return nil
+}
+
+/*
+restoreFrom() decrypts the archive at the given path and restores it into our
+[ConfigDir].
+*/
+func restoreFrom(path string) error {
+	if *ephemeral {
+		return fmt.Errorf("Ephemeral nodes don't keep any state to restore into")
+	}
+	encrypted, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	passphrase, err := readPassphrase("Passphrase of the backup: ")
+	if err != nil {
+		return err
+	}
+	archive, err := decryptBackup(encrypted, passphrase)
+	if err != nil {
+		return err
+	}
+
+	// Unpacking into a temporary directory lets the migration check everything
+	// before it's installed
+	source, err := ioutil.TempDir("", "lantern-restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(source)
+	restored, err := unarchive(archive, source)
+	if err != nil {
+		return err
+	}
+	if !isConfigDir(source) {
+		return fmt.Errorf("%s doesn't contain a lantern installation", path)
+	}
+
+	report := migrate(source, false)
+	report.Source = path
+	migrated := map[string]bool{"config.json": true}
+	for _, item := range migrationItems {
+		migrated[item.path] = true
+	}
+	for _, name := range restored {
+		if migrated[name] {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(source, filepath.FromSlash(name)))
+		if err == nil {
+			err = install(name, data)
+		}
+		if err != nil {
+			report.NotCarriedOver[name] = err.Error()
+		} else {
+			report.CarriedOver = append(report.CarriedOver, name)
+		}
+	}
+	if err := saveMigrationReport(report); err != nil {
+		log.Printf("Unable to save migration report to %s: %s", migrationFile, err)
+	}
+	log.Printf("Restored %s into %s", path, ConfigDir)
+	return nil
+}
+
+/*
+archiveConfigDir() returns a gzipped tar of the files in our [ConfigDir],
+leaving out other profiles and what earlier migrations replaced.
+*/
+func archiveConfigDir() ([]byte, error) {
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	err := filepath.Walk(ConfigDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(ConfigDir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(relative)
+		if info.IsDir() {
+			if name == PROFILES_DIR {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || !backedUp(name) {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: info.ModTime()}); err != nil {
+			return err
+		}
+		_, err = tarWriter.Write(data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tarWriter.Close(); err != nil {
+		return nil, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// backedUp() indicates whether the file with the given path relative to our
+// [ConfigDir] belongs in a backup.
+func backedUp(name string) bool {
+	if strings.HasSuffix(name, ".premigration") {
+		return false
+	}
+	// The profile selection belongs to the [BaseDir], migration.json to the
+	// machine that we migrated to
+	return name != "profile" && name != "migration.json"
+}
+
+/*
+unarchive() unpacks the given gzipped tar into the given directory, returning
+the paths of the files that it contained.
+*/
+func unarchive(archive []byte, dir string) ([]string, error) {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, err
+	}
+	tarReader := tar.NewReader(gzipReader)
+	names := make([]string, 0)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := filepath.ToSlash(filepath.Clean(header.Name))
+		if filepath.IsAbs(header.Name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("Archive contains a file outside of the ConfigDir: %s", header.Name)
+		}
+		data, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return nil, err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(target, data, 0600); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+}
+
+// encryptBackup() encrypts the given archive with the given passphrase.
+func encryptBackup(archive []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, BACKUP_SALT_BYTES)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := backupCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	encrypted := append([]byte(BACKUP_MAGIC), salt...)
+	encrypted = append(encrypted, nonce...)
+	return aead.Seal(encrypted, nonce, archive, []byte(BACKUP_MAGIC)), nil
+}
+
+// decryptBackup() decrypts the given backup with the given passphrase.
+func decryptBackup(encrypted []byte, passphrase string) ([]byte, error) {
+	if !bytes.HasPrefix(encrypted, []byte(BACKUP_MAGIC)) {
+		return nil, fmt.Errorf("Not a lantern backup")
+	}
+	encrypted = encrypted[len(BACKUP_MAGIC):]
+	if len(encrypted) < BACKUP_SALT_BYTES {
+		return nil, fmt.Errorf("Backup is truncated")
+	}
+	salt, encrypted := encrypted[:BACKUP_SALT_BYTES], encrypted[BACKUP_SALT_BYTES:]
+	aead, err := backupCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted) < aead.NonceSize() {
+		return nil, fmt.Errorf("Backup is truncated")
+	}
+	nonce, encrypted := encrypted[:aead.NonceSize()], encrypted[aead.NonceSize():]
+	archive, err := aead.Open(nil, nonce, encrypted, []byte(BACKUP_MAGIC))
+	if err != nil {
+		return nil, fmt.Errorf("Wrong passphrase or damaged backup")
+	}
+	return archive, nil
+}
+
+// backupCipher() derives the cipher for backups from the given passphrase and
+// salt.
+func backupCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, SCRYPT_N, SCRYPT_R, SCRYPT_P, BACKUP_KEY_BYTES)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/*
+readPassphrase() asks for a passphrase on the terminal without echoing it, or
+reads it from the first line of stdin if that isn't a terminal.
+*/
+func readPassphrase(prompt string) (string, error) {
+	var passphrase string
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		data, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		passphrase = string(data)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		passphrase = strings.TrimRight(line, "\r\n")
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("The passphrase must not be empty")
+	}
+	return passphrase, nil
+}
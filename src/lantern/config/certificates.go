@@ -0,0 +1,145 @@
+package config
+
+/*
+CanIssueCerts() indicates whether or not this node issues certificates to
+children, which only nodes configured as parents (masters) should do.  Root
+nodes always issue certificates, since nobody else can issue them for their
+children.
+*/
+func CanIssueCerts() bool {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.CanIssueCerts || config.ParentAddress == ""
+}
+
+func SetCanIssueCerts(canIssueCerts bool) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.CanIssueCerts = canIssueCerts
+	save()
+}
+
+/*
+EnrollAsMaster() indicates whether or not this node enrolls with its parent as a
+master, which requires the parent's operator to approve the enrollment (see
+package lantern/keys).
+*/
+func EnrollAsMaster() bool {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.EnrollAsMaster
+}
+
+func SetEnrollAsMaster(enrollAsMaster bool) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.EnrollAsMaster = enrollAsMaster
+	save()
+}
+
+/*
+ProvisioningTokens() returns the tokens that ephemeral children can present
+in lieu of a Mozilla Persona identity assertion when requesting a certificate
+from this node.
+*/
+func ProvisioningTokens() []string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return append([]string{}, config.ProvisioningTokens...)
+}
+
+func SetProvisioningTokens(provisioningTokens []string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.ProvisioningTokens = append([]string{}, provisioningTokens...)
+	save()
+}
+
+/*
+CertStatusPolicy() returns how we treat peers whose certificate status can't be
+determined, one of the CERT_STATUS_ constants (see package lantern/keys).
+*/
+func CertStatusPolicy() string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.CertStatusPolicy
+}
+
+func SetCertStatusPolicy(certStatusPolicy string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.CertStatusPolicy = certStatusPolicy
+	save()
+}
+
+/*
+KeyRotationDays() returns after how many days we rotate our private key (see
+package lantern/keys), or 0 if we only rotate it when asked to.
+*/
+func KeyRotationDays() int {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.KeyRotationDays
+}
+
+func SetKeyRotationDays(keyRotationDays int) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.KeyRotationDays = keyRotationDays
+	save()
+}
+
+/*
+EnrollmentPolicy() returns the limits on the devices per email that we issue
+certificates to, if we issue certificates.
+*/
+func EnrollmentPolicy() EnrollmentPolicyConfig {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.EnrollmentPolicy
+}
+
+func SetEnrollmentPolicy(enrollmentPolicy EnrollmentPolicyConfig) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.EnrollmentPolicy = enrollmentPolicy
+	save()
+}
+
+/*
+BannedNodes() returns the NodeIDs of the children that the local operator has
+banned from connecting to our signaling channel (see package lantern/signaling).
+*/
+func BannedNodes() []string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return append([]string{}, config.BannedNodes...)
+}
+
+func SetBannedNodes(bannedNodes []string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.BannedNodes = append([]string{}, bannedNodes...)
+	save()
+}
+
+const (
+	CERT_STATUS_OFF       = "off"       // don't check the status of peer certificates
+	CERT_STATUS_SOFT_FAIL = "soft-fail" // only reject peer certificates that are known to be revoked
+	CERT_STATUS_HARD_FAIL = "hard-fail" // also reject peer certificates whose status can't be determined
+)
+
+const (
+	EXCESS_REJECT        = "reject"        // refuse certificates for devices beyond the limit
+	EXCESS_REVOKE_OLDEST = "revoke-oldest" // revoke the certificates of the oldest devices to make room
+	EXCESS_APPROVE       = "approve"       // hold devices beyond the limit until the operator approves them
+)
+
+/*
+EnrollmentPolicyConfig limits how many devices may hold certificates that we
+issued for the same email (see package lantern/keys).
+*/
+type EnrollmentPolicyConfig struct {
+	MaxDevices int    // max devices with active certificates per email (0 means unlimited)
+	OnExcess   string // what happens to devices beyond MaxDevices (an EXCESS_ constant)
+}
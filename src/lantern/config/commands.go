@@ -0,0 +1,124 @@
+package config
+
+import (
+	"lantern/control"
+	"lantern/service"
+	"log"
+	"os"
+)
+
+/*
+Besides the archive commands (see backup.go), lantern has tool commands that
+act on a node without starting one:
+
+	lantern [flags] service install|uninstall|start|stop [BaseDir]
+	lantern [flags] diagnostics [file] [BaseDir]
+	lantern [flags] bandwidth [peer] [bytes] [BaseDir]
+
+- service - manages lantern as a system service for the node in [ConfigDir]
+  (see package lantern/service)
+- diagnostics - fetches a diagnostic bundle from the node that's running in
+  [ConfigDir] into the given file (see package lantern/diagnostics), or
+  lantern-diagnostics-<timestamp>.zip in the current directory without one (or
+  with -, to pass a BaseDir)
+- bandwidth - has the node that's running in [ConfigDir] test the bandwidth to
+  the given peer, transferring the given number of bytes in each direction
+  (see proxy/bandwidth.go), and prints the result.  Without a peer (or with -)
+  it tests its upstream proxy, without bytes (or with -) it transfers its
+  default.
+
+Like the archive commands, they run from init() before we migrate or load
+config.json, do their job and exit, so none of the subsystems start and none of
+the ports that a running node holds are touched.  The commands that talk to the
+running node (see package lantern/control) only read config.json, for the
+address of its UI.
+*/
+const (
+	SERVICE_COMMAND     = "service"     // manages lantern as a system service
+	DIAGNOSTICS_COMMAND = "diagnostics" // fetches a diagnostic bundle from the running node
+	BANDWIDTH_COMMAND   = "bandwidth"   // has the running node test the bandwidth to a peer
+)
+
+var (
+	toolCommand string   // the tool command that we were started with, if any, set by parseArgs()
+	toolArgs    []string // the arguments of the tool command
+)
+
+// isToolCommand() indicates whether the given argument is a tool command.
+func isToolCommand(arg string) bool {
+	return arg == SERVICE_COMMAND || arg == DIAGNOSTICS_COMMAND || arg == BANDWIDTH_COMMAND
+}
+
+/*
+parseToolArgs() takes the tool command and its arguments off the given
+arguments, returning the remaining ones.
+*/
+func parseToolArgs(args []string) []string {
+	toolCommand = args[0]
+	switch toolCommand {
+	case SERVICE_COMMAND:
+		if len(args) < 2 || !service.IsCommand(args[1]) {
+			log.Fatalf("Usage: lantern [flags] %s install|uninstall|start|stop [BaseDir]", toolCommand)
+		}
+		toolArgs = args[1:2]
+		return args[2:]
+	case DIAGNOSTICS_COMMAND:
+		return takeOptionalArgs(args[1:], 1)
+	case BANDWIDTH_COMMAND:
+		return takeOptionalArgs(args[1:], 2)
+	}
+	return nil
+}
+
+/*
+takeOptionalArgs() takes up to the given number of optional arguments of the
+tool command off the given arguments into toolArgs, returning the remaining
+ones.  Missing arguments and - are "".
+*/
+func takeOptionalArgs(args []string, count int) []string {
+	toolArgs = make([]string, count)
+	for i := 0; i < count && len(args) > 0; i++ {
+		if args[0] != "-" {
+			toolArgs[i] = args[0]
+		}
+		args = args[1:]
+	}
+	return args
+}
+
+// runToolCommand() runs the tool command that we were started with, if any,
+// and exits.
+func runToolCommand() {
+	var err error
+	switch toolCommand {
+	case "":
+		return
+	case SERVICE_COMMAND:
+		err = service.Run(toolArgs[0], ConfigDir)
+	case DIAGNOSTICS_COMMAND:
+		err = withRunningNode(func(uiAddress string, token string) error {
+			return control.FetchDiagnostics(uiAddress, token, toolArgs[0])
+		})
+	case BANDWIDTH_COMMAND:
+		err = withRunningNode(func(uiAddress string, token string) error {
+			return control.TestBandwidth(uiAddress, token, toolArgs[0], toolArgs[1])
+		})
+	}
+	if err != nil {
+		log.Fatalf("Unable to run %s: %s", toolCommand, err)
+	}
+	os.Exit(0)
+}
+
+/*
+withRunningNode() calls the given function with the address of the UI and the
+UI token of the node that's running in [ConfigDir].
+*/
+func withRunningNode(fn func(uiAddress string, token string) error) error {
+	token, err := control.ReadToken(ConfigDir)
+	if err != nil {
+		return err
+	}
+	readConfigFile()
+	return fn(UIAddress(), token)
+}
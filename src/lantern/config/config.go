@@ -8,7 +8,18 @@ The config.json is found in [ConfigDir].
 expected to be located at ~/.lantern/config.json.
 
 A different [ConfigDir] can be used by specifying it as the first argument to
-the lantern command.
+the lantern command (after the subcommand, if any, see roles.go).  Strictly speaking, that's the [BaseDir], which is also the
+[ConfigDir] unless we run as a profile other than the default one (see
+profiles.go).
+
+When lantern is started with the -ephemeral flag, the config.json is still read
+if present (for example from a read-only volume), but changes are only kept in
+memory and never written back to disk.
+
+This file holds the addresses, identity and lifecycle of the node, along with
+configData and its defaults.  The settings of individual features live in
+files of their own next to it, for example telemetry.go, proxies.go,
+certificates.go or routing.go.
 */
 package config
 
@@ -16,7 +27,9 @@ import (
 	"encoding/json"
 	"flag"
 	"io/ioutil"
+	"lantern/util"
 	"log"
+	"os"
 	"os/user"
 	"sync"
 )
@@ -72,8 +85,12 @@ func LocalProxyAddress() string {
 func SetLocalProxyAddress(localProxyAddress string) {
 	configMutex.Lock()
 	defer configMutex.Unlock()
+	if config.LocalProxyAddress == localProxyAddress {
+		return
+	}
 	config.LocalProxyAddress = localProxyAddress
 	save()
+	listenAddressesChanged()
 }
 
 /*
@@ -92,26 +109,171 @@ func RemoteProxyAddress() string {
 func SetRemoteProxyAddress(remoteProxyAddress string) {
 	configMutex.Lock()
 	defer configMutex.Unlock()
+	if config.RemoteProxyAddress == remoteProxyAddress {
+		return
+	}
 	config.RemoteProxyAddress = remoteProxyAddress
 	save()
+	listenAddressesChanged()
+}
+
+/*
+WPADAddress() returns the host:port at which we serve wpad.dat to browsers on
+the LAN, so that they configure our local proxy automatically.  Browsers look
+for it on port 80.
+
+A blank value means that we don't serve wpad.dat to the LAN (it's still
+available on the UI).
+*/
+func WPADAddress() string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.WPADAddress
+}
+
+func SetWPADAddress(wpadAddress string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.WPADAddress = wpadAddress
+	save()
+}
+
+/*
+WPADDNSAddress() returns the host:port at which we answer DNS lookups for the
+wpad host with our LAN IP.
+
+A blank value means that we don't answer DNS lookups.
+*/
+func WPADDNSAddress() string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.WPADDNSAddress
+}
+
+func SetWPADDNSAddress(wpadDNSAddress string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.WPADDNSAddress = wpadDNSAddress
+	save()
 }
 
 /*
 StaticProxyAddresses() returns the host:port combinations at which this lantern
-instance can find proxies with static ips (helpful for bootstrapping).
+instance can find proxies with static ips (helpful for bootstrapping).  Each
+one can list alternatives (see AlternativeAddresses()).
 
 An empty value means that there is no static proxy known.
 */
 func StaticProxyAddresses() []string {
 	configMutex.RLock()
 	defer configMutex.RUnlock()
-	return config.StaticProxyAddresses
+	return append([]string{}, config.StaticProxyAddresses...)
 }
 
 func SetStaticProxyAddresses(staticProxyAddresses []string) {
 	configMutex.Lock()
 	defer configMutex.Unlock()
-	config.StaticProxyAddresses = staticProxyAddresses
+	config.StaticProxyAddresses = append([]string{}, staticProxyAddresses...)
+	save()
+}
+
+/*
+EntryProxyAddress() returns the host:port of the peer through which we relay
+our traffic to the upstream proxy in multi-hop mode, so that the upstream
+(exit) proxy doesn't learn our IP.
+
+A blank value means that we connect to the upstream proxy directly.
+*/
+func EntryProxyAddress() string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.EntryProxyAddress
+}
+
+func SetEntryProxyAddress(entryProxyAddress string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.EntryProxyAddress = entryProxyAddress
+	save()
+}
+
+/*
+EgressProxyAddress() returns the host:port of the remote proxy through which our
+remote proxy relays the traffic of our children, typically that of our parent
+master, so that organizations can centralize where their traffic leaves the
+network (see egress.go in package lantern/proxy).
+
+A blank value means that we connect to destinations directly.
+*/
+func EgressProxyAddress() string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.EgressProxyAddress
+}
+
+func SetEgressProxyAddress(egressProxyAddress string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.EgressProxyAddress = egressProxyAddress
+	save()
+}
+
+/*
+TransparentProxyAddress() returns the host:port at which the local proxy
+accepts connections that the firewall redirected to it, for router-style
+deployments (see transparent.go in package lantern/proxy).
+
+A blank value means that we don't accept redirected connections.
+*/
+func TransparentProxyAddress() string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.TransparentProxyAddress
+}
+
+func SetTransparentProxyAddress(transparentProxyAddress string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.TransparentProxyAddress = transparentProxyAddress
+	save()
+}
+
+/*
+BindIP() returns the local IP address on which the remote proxy and signaling
+listeners bind, which allows hosts with multiple IPs to keep lantern isolated
+on one of them.
+
+A blank value means that we bind on all addresses.
+*/
+func BindIP() string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.BindIP
+}
+
+func SetBindIP(bindIP string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.BindIP = bindIP
+	save()
+}
+
+/*
+AdvertiseIP() returns the public IP address that we advertise to peers, for
+example in presence and in our certificate.
+
+A blank value means that we advertise BindIP().
+*/
+func AdvertiseIP() string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.AdvertiseIP
+}
+
+func SetAdvertiseIP(advertiseIP string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.AdvertiseIP = advertiseIP
 	save()
 }
 
@@ -144,21 +306,375 @@ func SetEmail(email string) {
 	save()
 }
 
+/*
+Role() returns the role of this node, ROLE_USER or ROLE_RELAY.  Relay nodes are
+pure relays (typically masters run by the Lantern team) that have no user, so
+they never acquire an identity and run with a certificate provisioned by their
+operator instead (see package lantern/keys).
+*/
+func Role() string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.Role
+}
+
+func SetRole(role string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.Role = role
+	save()
+}
+
+// IsRelay() indicates whether or not this node runs in the relay role, either
+// as configured or because we were started with the relay subcommand.
+func IsRelay() bool {
+	return Role() == ROLE_RELAY || Subcommand() == SUBCOMMAND_RELAY
+}
+
+/*
+AddStaticProxyAddress() adds the given host:port to StaticProxyAddresses(),
+returning false if it was already there.
+*/
+func AddStaticProxyAddress(address string) bool {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	for _, existing := range config.StaticProxyAddresses {
+		if existing == address {
+			return false
+		}
+	}
+	config.StaticProxyAddresses = append(append([]string{}, config.StaticProxyAddresses...), address)
+	save()
+	return true
+}
+
+/*
+RemoveStaticProxyAddress() removes the given host:port from
+StaticProxyAddresses(), returning false if it wasn't there.
+*/
+func RemoveStaticProxyAddress(address string) bool {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	remaining := make([]string, 0, len(config.StaticProxyAddresses))
+	for _, existing := range config.StaticProxyAddresses {
+		if existing != address {
+			remaining = append(remaining, existing)
+		}
+	}
+	if len(remaining) == len(config.StaticProxyAddresses) {
+		return false
+	}
+	config.StaticProxyAddresses = remaining
+	save()
+	return true
+}
+
+/*
+BlockedIdentities() returns the identities (email addresses) that the local
+operator has blocked from using this node as a proxy.  Local blocks always take
+precedence over anything pushed down by our parent.
+*/
+func BlockedIdentities() []string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return append([]string{}, config.BlockedIdentities...)
+}
+
+func SetBlockedIdentities(blockedIdentities []string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.BlockedIdentities = append([]string{}, blockedIdentities...)
+	save()
+}
+
+/*
+UnblockedIdentities() returns the identities (email addresses) that the local
+operator has explicitly allowed, even if our parent has blocklisted them.
+*/
+func UnblockedIdentities() []string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return append([]string{}, config.UnblockedIdentities...)
+}
+
+func SetUnblockedIdentities(unblockedIdentities []string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.UnblockedIdentities = append([]string{}, unblockedIdentities...)
+	save()
+}
+
+/*
+IntegrityDomains() returns the high-risk domains for which the local proxy
+verifies the integrity of plain HTTP responses with the exit peer.  Subdomains
+of these domains are included.
+*/
+func IntegrityDomains() []string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return append([]string{}, config.IntegrityDomains...)
+}
+
+func SetIntegrityDomains(integrityDomains []string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.IntegrityDomains = append([]string{}, integrityDomains...)
+	save()
+}
+
+/*
+Friends() returns the email addresses of the user's friends.  Introduction
+requests from friends are accepted automatically.
+*/
+func Friends() []string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return append([]string{}, config.Friends...)
+}
+
+func SetFriends(friends []string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.Friends = append([]string{}, friends...)
+	save()
+}
+
+// TraceEnabled() indicates whether or not this node annotates trace messages
+// that pass through it with hop metadata.
+func TraceEnabled() bool {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.TraceEnabled
+}
+
+func SetTraceEnabled(traceEnabled bool) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.TraceEnabled = traceEnabled
+	save()
+}
+
+/*
+BandwidthClass() returns the class of bandwidth ("low", "medium" or "high")
+that we advertise to peers in our capabilities (blank if unknown).
+*/
+func BandwidthClass() string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.BandwidthClass
+}
+
+func SetBandwidthClass(bandwidthClass string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.BandwidthClass = bandwidthClass
+	save()
+}
+
+/*
+Profiling() indicates whether or not the UI exposes the pprof and expvar
+endpoints, which let maintainers profile long-running nodes (see package
+lantern/ui).
+*/
+func Profiling() bool {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.Profiling
+}
+
+func SetProfiling(profiling bool) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.Profiling = profiling
+	save()
+}
+
+/*
+LaunchAtStartup() indicates whether or not lantern starts when the user logs in
+(see package lantern/autostart).
+*/
+func LaunchAtStartup() bool {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.LaunchAtStartup
+}
+
+func SetLaunchAtStartup(launchAtStartup bool) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.LaunchAtStartup = launchAtStartup
+	save()
+}
+
+/*
+InviteToken() returns the token of the invite that we joined with (see Invite),
+which we present to our parent instead of signing in until we have a
+certificate.
+*/
+func InviteToken() string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.InviteToken
+}
+
+func SetInviteToken(inviteToken string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.InviteToken = inviteToken
+	save()
+}
+
+// Ephemeral() indicates whether or not this node is running in ephemeral
+// (diskless) mode, in which nothing gets persisted to disk.
+func Ephemeral() bool {
+	return *ephemeral
+}
+
+/*
+FirstRun() indicates whether we started with an empty [ConfigDir], without a
+config.json or keys, in which case the setup wizard runs before anything else
+starts (see package lantern/ui).  Never true on ephemeral nodes or when started
+with the -skip-setup flag.
+*/
+func FirstRun() bool {
+	return firstRun
+}
+
+// StartupInvite() returns the invite code or link that we were told to join
+// with at startup (see Invite), if any.
+func StartupInvite() string {
+	return *inviteFlag
+}
+
+/*
+DevIdentity() indicates whether or not we run with development identities, in
+which case identity assertions of the form "test:<email>" are accepted without
+asking Mozilla Persona (see package lantern/persona).  This must never be
+enabled in production.
+*/
+func DevIdentity() bool {
+	return *devIdentity
+}
+
+/*
+ProvisioningToken() returns the token that this ephemeral node presents to its
+parent in lieu of a Mozilla Persona identity assertion.  It is taken from the
+LANTERN_PROVISIONING_TOKEN environment variable so that it can be injected into
+containers without ever touching the disk.
+*/
+func ProvisioningToken() string {
+	return os.Getenv("LANTERN_PROVISIONING_TOKEN")
+}
+
+const (
+	ROLE_USER  = "user"  // a node run by an end user, identified by their email address
+	ROLE_RELAY = "relay" // a pure relay without a user, running with an operator-provisioned certificate
+)
+
 // configData defines the data structure of the config data as it is saved on
 // disk (in JSON).
 type configData struct {
-	ParentAddress        string   // the host:port of our parent node (or "" if we're a root)
-	SignalingAddress     string   // the host:port at which we will listen for signaling connections from our children
-	LocalProxyAddress    string   // the host:port at which we will listen for local proxy connections (e.g. from the browser)
-	RemoteProxyAddress   string   // the host:port at which we will listen for remote proxy connections from peers
-	StaticProxyAddresses []string // array of host:port for known static proxies
-	UIAddress            string   // the host:port at which the UI's backend listens
-	Email                string   // the email address of the user under which this node is running (leave "" for server nodes)
+	ParentAddress           string                      // the host:port of our parent node (or "" if we're a root)
+	SignalingAddress        string                      // the host:port at which we will listen for signaling connections from our children
+	LocalProxyAddress       string                      // the host:port at which we will listen for local proxy connections (e.g. from the browser)
+	RemoteProxyAddress      string                      // the host:port at which we will listen for remote proxy connections from peers
+	StaticProxyAddresses    []string                    // array of host:port for known static proxies
+	UIAddress               string                      // the host:port at which the UI's backend listens
+	Email                   string                      // the email address of the user under which this node is running (leave "" for server nodes)
+	Role                    string                      // the role of this node (ROLE_USER or ROLE_RELAY)
+	BlockedIdentities       []string                    // emails that the local operator refuses to proxy for, regardless of our parent's blocklist
+	UnblockedIdentities     []string                    // emails that the local operator allows even if our parent blocklisted them
+	TelemetryOptIn          bool                        // whether the user has opted in to sharing aggregated telemetry and usage statistics
+	TelemetrySampleRate     float64                     // fraction of sessions that are sampled for telemetry
+	TelemetryURL            string                      // the url to which aggregated telemetry is uploaded
+	ProvisioningTokens      []string                    // tokens that ephemeral children can use to obtain a certificate from us
+	FeatureFlags            map[string]bool             // feature flags set by the local operator
+	IntegrityDomains        []string                    // domains whose plain HTTP responses get integrity verification
+	Friends                 []string                    // emails of friends whose introduction requests are accepted automatically
+	TraceEnabled            bool                        // whether we annotate trace messages with hop metadata
+	ChildQuotas             ChildQuotaConfig            // limits enforced on children connected to our signaling channel
+	SignalingHistory        HistoryConfig               // bounds of the messages kept for recipients that aren't connected yet
+	BindIP                  string                      // the local IP on which the remote proxy and signaling listeners bind (blank for all)
+	AdvertiseIP             string                      // the public IP that we advertise to peers (blank to use BindIP)
+	CanIssueCerts           bool                        // whether we issue certificates to children (root nodes always do)
+	EnrollAsMaster          bool                        // whether we enroll with our parent as a master
+	BandwidthClass          string                      // the bandwidth class that we advertise to peers ("low", "medium", "high" or blank)
+	EntryProxyAddress       string                      // the host:port of the entry peer in multi-hop mode (or "" to connect directly)
+	EgressProxyAddress      string                      // the host:port of the remote proxy through which our remote proxy egresses (or "" to egress directly)
+	ProxyLimits             ProxyLimitConfig            // limits enforced on the connections relayed by our remote proxy
+	RemoteProxyListeners    []ProxyListenerConfig       // additional listeners of the remote proxy besides RemoteProxyAddress
+	StunServers             []string                    // host:ports of STUN servers used to discover our external IP (empty, the default, disables STUN)
+	WPADAddress             string                      // the host:port at which we serve wpad.dat to the LAN (blank to disable)
+	WPADDNSAddress          string                      // the host:port at which we answer DNS lookups for wpad (blank to disable)
+	TransparentProxyAddress string                      // the host:port at which we accept redirected connections (blank to disable)
+	Cache                   CacheConfig                 // settings of the local proxy's HTTP cache
+	DetectCensorship        bool                        // whether the local proxy tries direct connections before going through a peer
+	StaticProxyCredentials  map[string]ProxyCredentials // credentials for static proxies that require them, by host:port
+	ProxyAccess             ProxyAccessConfig           // credentials that our remote proxy requires from peers
+	BootstrapSources        []BootstrapSource           // urls from which updates of the bootstrap list are fetched
+	Updates                 UpdateConfig                // settings for updating the lantern binary
+	Profiling               bool                        // whether the UI exposes the pprof and expvar endpoints
+	LaunchAtStartup         bool                        // whether lantern starts when the user logs in
+	CertStatusPolicy        string                      // how we treat peers whose certificate status can't be determined (a CERT_STATUS_ constant)
+	KeyRotationDays         int                         // after how many days we rotate our private key (0 to only rotate on demand)
+	EnrollmentPolicy        EnrollmentPolicyConfig      // limits on the devices per email that we issue certificates to
+	BannedNodes             []string                    // NodeIDs of children that may not connect to our signaling channel
+	InviteToken             string                      // the token of the invite that we joined with, until we have a certificate (see Invite)
+	DNSAddress              string                      // the host:port of the DNS forwarder (blank to disable)
+	DNSResolver             string                      // the host:port of the DNS server for domains that aren't blocked
+	DoHURL                  string                      // the url of the DNS over HTTPS server for blocked domains
+	AppRouting              AppRoutingConfig            // how the traffic of the local proxy is routed by the process that it comes from
+	AccessLog               AccessLogConfig             // what the local proxy logs about the requests that it serves
+}
+
+/*
+clone() returns a copy of the config data that shares no slices or maps with
+it, so that the copy can be modified (for example by unmarshaling into it)
+without affecting the original.
+*/
+func (data *configData) clone() *configData {
+	cloned := *data
+	cloned.StaticProxyAddresses = append([]string{}, data.StaticProxyAddresses...)
+	cloned.BlockedIdentities = append([]string{}, data.BlockedIdentities...)
+	cloned.UnblockedIdentities = append([]string{}, data.UnblockedIdentities...)
+	cloned.ProvisioningTokens = append([]string{}, data.ProvisioningTokens...)
+	cloned.FeatureFlags = copyFlags(data.FeatureFlags)
+	cloned.IntegrityDomains = append([]string{}, data.IntegrityDomains...)
+	cloned.Friends = append([]string{}, data.Friends...)
+	cloned.RemoteProxyListeners = append([]ProxyListenerConfig{}, data.RemoteProxyListeners...)
+	cloned.StunServers = append([]string{}, data.StunServers...)
+	cloned.StaticProxyCredentials = copyCredentials(data.StaticProxyCredentials)
+	cloned.ProxyAccess = data.ProxyAccess.clone()
+	cloned.BootstrapSources = append([]BootstrapSource{}, data.BootstrapSources...)
+	cloned.BannedNodes = append([]string{}, data.BannedNodes...)
+	cloned.AppRouting = data.AppRouting.clone()
+	return &cloned
 }
 
 var (
+	// flags are our command line flags, kept apart from flag.CommandLine so
+	// that programs that embed us keep theirs to themselves
+	flags = flag.NewFlagSet("lantern", flag.ExitOnError)
+	// ephemeral indicates whether we're running in ephemeral (diskless) mode
+	ephemeral = flags.Bool("ephemeral", false, "run without persisting anything to disk")
+	// migrateFrom is an old installation to migrate from at startup (see migration.go)
+	migrateFrom = flags.String("migrate-from", "", "carry over keys, config and peers from an old installation at this path")
+	// devIdentity enables fake identity assertions for development and tests
+	devIdentity = flags.Bool("dev-identity", false, "accept test:<email> identity assertions (development only)")
+	// profileFlag is the profile to run as (see profiles.go)
+	profileFlag = flags.String("profile", "", "run as the named profile instead of the selected one")
+	// skipSetup keeps the defaults on first start instead of running the setup wizard
+	skipSetup = flags.Bool("skip-setup", false, "start with the default config instead of the setup wizard on first start")
+	// inviteFlag is an invite to join with at startup (see StartupInvite())
+	inviteFlag = flags.String("invite", "", "join the tree with this invite code or lantern:// link")
+	// firstRun indicates that we started with an empty ConfigDir (see FirstRun())
+	firstRun = false
+	// BaseDir is the directory under which lantern keeps its profiles
+	BaseDir = determineConfigDir()
+	// activeProfile is the name of the profile that we're running as
+	activeProfile = determineProfile()
 	// ConfigDir is the directory where lantern's configuration files are stored
-	ConfigDir = determineConfigDir()
+	ConfigDir = profileDir(activeProfile)
 	// configFile is the location of our config file
 	configFile = ConfigDir + "/config.json"
 	// config is initialized with a set of default values
@@ -168,7 +684,85 @@ var (
 		LocalProxyAddress:    "127.0.0.1:8080",
 		RemoteProxyAddress:   ":16200",
 		StaticProxyAddresses: []string{},
-		UIAddress:            "127.0.0.1:16300"}
+		UIAddress:            "127.0.0.1:16300",
+		Role:                 ROLE_USER,
+		BlockedIdentities:    []string{},
+		UnblockedIdentities:  []string{},
+		TelemetryOptIn:       false,
+		TelemetrySampleRate:  0.01,
+		TelemetryURL:         "",
+		ProvisioningTokens:   []string{},
+		FeatureFlags:         map[string]bool{},
+		IntegrityDomains:     []string{},
+		Friends:              []string{},
+		TraceEnabled:         false,
+		ChildQuotas: ChildQuotaConfig{
+			MaxConnections:              1000,
+			MaxRegistrationsPerChild:    100,
+			MaxMessagesPerSecond:        20,
+			MaxConnectAttemptsPerMinute: 30,
+		},
+		SignalingHistory: HistoryConfig{
+			MaxMessagesPerRecipient: 10,
+			MaxRecipients:           1000,
+			TTLSeconds:              300,
+		},
+		BindIP:            "",
+		AdvertiseIP:       "",
+		CanIssueCerts:     false,
+		EnrollAsMaster:    false,
+		BandwidthClass:    "",
+		EntryProxyAddress: "",
+		ProxyLimits: ProxyLimitConfig{
+			MaxConnections:          500,
+			MaxConnectionsPerClient: 50,
+		},
+		RemoteProxyListeners:    []ProxyListenerConfig{},
+		StunServers:             []string{},
+		WPADAddress:             "",
+		WPADDNSAddress:          "",
+		TransparentProxyAddress: "",
+		Cache: CacheConfig{
+			Enabled:      false,
+			MaxSize:      256 * 1024 * 1024,
+			MaxEntrySize: 16 * 1024 * 1024,
+		},
+		DetectCensorship:       false,
+		StaticProxyCredentials: map[string]ProxyCredentials{},
+		ProxyAccess: ProxyAccessConfig{
+			RequireCredentials: false,
+			Tokens:             map[string]string{},
+			ClientCAFile:       "",
+		},
+		BootstrapSources: []BootstrapSource{},
+		Updates: UpdateConfig{
+			Enabled: true,
+			Channel: "stable",
+			URL:     "",
+		},
+		Profiling:        false,
+		LaunchAtStartup:  false,
+		CertStatusPolicy: CERT_STATUS_SOFT_FAIL,
+		KeyRotationDays:  0,
+		EnrollmentPolicy: EnrollmentPolicyConfig{
+			MaxDevices: 0,
+			OnExcess:   EXCESS_REJECT,
+		},
+		BannedNodes: []string{},
+		InviteToken: "",
+		DNSAddress:  "",
+		DNSResolver: "1.1.1.1:53",
+		DoHURL:      "https://cloudflare-dns.com/dns-query",
+		AppRouting: AppRoutingConfig{
+			Rules:     []AppRule{},
+			Unmatched: ROUTE_AUTO,
+		},
+		AccessLog: AccessLogConfig{
+			Mode:         ACCESS_LOG_OFF,
+			IncludePaths: false,
+			MaxEntries:   1000,
+		},
+	}
 	// configMutex is used to synchronize concurrent reads/writes of config properties
 	configMutex sync.RWMutex
 	// saveChannel is used to queue up requests to save the config back to disk
@@ -176,16 +770,21 @@ var (
 )
 
 func init() {
-	go saver()
+	util.GoLoop("config saver", saver)
+	initProfile()
+	runArchiveCommand()
+	runToolCommand()
+	migrateAtStartup()
 	loadConfig()
+	checkSubcommand()
+	checkConfig()
 }
 
 // determineConfigDir() determines where to load the config by checking the
 // command line and defaulting to ~/.lantern.
 func determineConfigDir() string {
-	flag.Parse()
-	if flag.NArg() > 0 {
-		return flag.Arg(0)
+	if args := parseArgs(); len(args) > 0 {
+		return args[0]
 	} else {
 		usr, err := user.Current()
 		if err != nil {
@@ -198,26 +797,43 @@ func determineConfigDir() string {
 // loadConfig() loads the configuration file from the ConfigDir.  If no file
 // is present, a file will be created based on a default configuration.
 func loadConfig() {
-	if configFileData, err := ioutil.ReadFile(configFile); err != nil {
-		log.Printf("Unable to find existing %s, keeping defaults: %s", configFile, err)
-	} else {
-		log.Printf("Initializing configuration from: %s", configFile)
-		if err := json.Unmarshal(configFileData, config); err != nil {
-			log.Printf("Unable to load config from %s, keeping defaults %s", configFile, err)
+	if !readConfigFile() {
+		if _, err := os.Stat(ConfigDir + "/keys"); os.IsNotExist(err) {
+			firstRun = !*ephemeral && !*skipSetup
 		}
 	}
 	save()
 }
 
-// save() requests a save by the saver goroutine.
+// readConfigFile() reads the configuration file from the ConfigDir, if there
+// is one, without saving anything.  It returns false if there's none.
+func readConfigFile() bool {
+	configFileData, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		log.Printf("Unable to find existing %s, keeping defaults: %s", configFile, err)
+		return false
+	}
+	log.Printf("Initializing configuration from: %s", configFile)
+	if err := json.Unmarshal(configFileData, config); err != nil {
+		log.Printf("Unable to load config from %s, keeping defaults %s", configFile, err)
+	}
+	return true
+}
+
+// save() logs new problems with the config (see Validate()) and requests a
+// save by the saver goroutine, which in ephemeral mode does nothing.
+// configMutex must be held.
 func save() {
+	config.reportProblems()
+	if *ephemeral {
+		return
+	}
 	saveChannel <- *config
 }
 
 // saver(), meant to be run as a goroutine, saves the config file after updates.
 func saver() {
-	select {
-	case updated := <-saveChannel:
+	for updated := range saveChannel {
 		log.Print("Saving config")
 		configFileData, err := json.MarshalIndent(updated, "", "   ")
 		if err != nil {
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"encoding/json"
+	_ "lantern/client/ephemeral"
+	"testing"
+)
+
+/*
+FuzzConfigFile loads arbitrary config.json contents the way readConfigFile()
+does, on top of the defaults, and validates the result, which must never panic
+however the file was damaged or tampered with.
+*/
+func FuzzConfigFile(f *testing.F) {
+	configMutex.RLock()
+	defaults := config.clone()
+	configMutex.RUnlock()
+	seed, err := json.Marshal(defaults)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(seed)
+	f.Add([]byte(`{}`))
+	f.Add([]byte(`{"UIAddress": "[::1]:0", "ParentAddress": "localhost:16100", "AppRouting": {"Rules": [{"Route": "proxy"}]}}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		loaded := defaults.clone()
+		if err := json.Unmarshal(data, loaded); err != nil {
+			return
+		}
+		loaded.problems()
+		loaded.clone()
+	})
+}
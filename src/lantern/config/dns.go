@@ -0,0 +1,51 @@
+package config
+
+/*
+DNSAddress() returns the host:port at which we run a DNS forwarder that
+resolves blocked domains through peers, so that DNS follows the same route as
+the traffic of the local proxy (see dns.go in package lantern/proxy).
+
+A blank value means that we don't run the DNS forwarder.
+*/
+func DNSAddress() string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.DNSAddress
+}
+
+func SetDNSAddress(dnsAddress string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.DNSAddress = dnsAddress
+	save()
+}
+
+// DNSResolver() returns the host:port of the DNS server that the DNS forwarder
+// asks directly about domains that aren't blocked.
+func DNSResolver() string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.DNSResolver
+}
+
+func SetDNSResolver(dnsResolver string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.DNSResolver = dnsResolver
+	save()
+}
+
+// DoHURL() returns the url of the DNS over HTTPS server that the DNS forwarder
+// asks through peers about blocked domains.
+func DoHURL() string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.DoHURL
+}
+
+func SetDoHURL(dohURL string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.DoHURL = dohURL
+	save()
+}
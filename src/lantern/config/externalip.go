@@ -0,0 +1,235 @@
+package config
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"lantern/util"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+External IP discovery finds out the public IP of this node, so that we can put
+it in our self-signed certificate and advertise our remote proxy at an address
+that peers can actually reach (see AdvertisedIP()).
+
+Sources, in order of precedence:
+
+- an explicitly configured AdvertiseIP() (or BindIP())
+- the address at which our parent saw us (see SetObservedIP()), which it
+  reports with our certificate
+- a STUN binding request to StunServers(), repeated every
+  EXTERNAL_IP_REFRESH
+
+STUN is opt-in: there are no StunServers() by default, since every binding
+request tells a third party that this address runs lantern.
+
+Nodes that care about changes of their external IP can WatchExternalIP().
+*/
+const (
+	EXTERNAL_IP_REFRESH = 30 * time.Minute // how often we repeat STUN discovery
+	STUN_TIMEOUT        = 5 * time.Second  // how long we wait for a STUN server to answer
+
+	SOURCE_PARENT = "parent" // our parent told us our external IP
+	SOURCE_STUN   = "stun"   // a STUN server told us our external IP
+
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112A442
+	stunMappedAddress   = 0x0001
+	stunXorMappedAddr   = 0x0020
+)
+
+var (
+	externalIPs       = make(map[string]string) // discovered external IPs, by source
+	externalIPWatcher = make([]chan string, 0)  // parties watching for changes of ExternalIP()
+	externalIPMutex   sync.Mutex                // used to synchronize access to the above
+	stunStarted       sync.Once                 // makes sure that we only run one stunRefresher
+)
+
+/*
+ExternalIP() returns our discovered external IP, preferring what our parent
+saw over what STUN told us.  A blank value means that we don't know it (yet).
+*/
+func ExternalIP() string {
+	externalIPMutex.Lock()
+	defer externalIPMutex.Unlock()
+	return externalIP()
+}
+
+// externalIP() implements ExternalIP().  externalIPMutex must be held.
+func externalIP() string {
+	if ip := externalIPs[SOURCE_PARENT]; ip != "" {
+		return ip
+	}
+	return externalIPs[SOURCE_STUN]
+}
+
+// SetObservedIP() records the IP at which our parent saw us.
+func SetObservedIP(ip string) {
+	if parsed := net.ParseIP(ip); parsed == nil || parsed.IsLoopback() || parsed.IsPrivate() {
+		// Our parent is on the same host or network, that doesn't tell us
+		// anything about the outside
+		return
+	}
+	setExternalIP(SOURCE_PARENT, ip)
+}
+
+// WatchExternalIP() registers a channel that receives our external IP
+// whenever it changes.  Sends don't block.
+func WatchExternalIP(ch chan string) {
+	externalIPMutex.Lock()
+	defer externalIPMutex.Unlock()
+	externalIPWatcher = append(externalIPWatcher, ch)
+}
+
+/*
+DiscoverExternalIP() returns our external IP, trying STUN right away (within
+STUN_TIMEOUT) if we don't know it yet, and from then on keeps it up to date in
+the background.
+*/
+func DiscoverExternalIP() string {
+	stunStarted.Do(func() {
+		refreshExternalIP()
+		util.GoLoop("external IP discovery", stunRefresher)
+	})
+	return ExternalIP()
+}
+
+// setExternalIP() records the external IP from the given source and notifies
+// watchers if ExternalIP() changed.
+func setExternalIP(source string, ip string) {
+	externalIPMutex.Lock()
+	defer externalIPMutex.Unlock()
+	before := externalIP()
+	externalIPs[source] = ip
+	after := externalIP()
+	if after == before {
+		return
+	}
+	log.Printf("External IP is now %s (according to %s)", after, source)
+	for _, watcher := range externalIPWatcher {
+		select {
+		case watcher <- after:
+		default:
+		}
+	}
+}
+
+// stunRefresher(), meant to be run as a goroutine, repeats STUN discovery
+// every EXTERNAL_IP_REFRESH.
+func stunRefresher() {
+	for {
+		time.Sleep(EXTERNAL_IP_REFRESH)
+		refreshExternalIP()
+	}
+}
+
+// refreshExternalIP() asks our STUN servers for our external IP until one of
+// them answers.
+func refreshExternalIP() {
+	for _, server := range StunServers() {
+		ip, err := stunExternalIP(server)
+		if err != nil {
+			log.Printf("Unable to discover external IP with %s: %s", server, err)
+			continue
+		}
+		setExternalIP(SOURCE_STUN, ip.String())
+		return
+	}
+}
+
+// stunExternalIP() asks the given STUN server for our external IP with a
+// binding request (RFC 5389).
+func stunExternalIP(server string) (net.IP, error) {
+	conn, err := net.DialTimeout("udp", server, STUN_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(STUN_TIMEOUT))
+
+	request := make([]byte, 20)
+	binary.BigEndian.PutUint16(request[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:], stunMagicCookie)
+	transactionID := request[8:20]
+	if _, err := rand.Read(transactionID); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+	response := make([]byte, 1024)
+	n, err := conn.Read(response)
+	if err != nil {
+		return nil, err
+	}
+	response = response[:n]
+	if len(response) < 20 || binary.BigEndian.Uint16(response[0:]) != stunBindingResponse ||
+		!bytes.Equal(response[8:20], transactionID) {
+		return nil, fmt.Errorf("Unexpected response")
+	}
+	return parseStunAddress(response[20:], response[4:20])
+}
+
+/*
+parseStunAddress() finds our address in the given attributes of a STUN binding
+response, given the magic cookie and transaction ID with which
+XOR-MAPPED-ADDRESS is obfuscated.
+*/
+func parseStunAddress(attributes []byte, xorKey []byte) (net.IP, error) {
+	var mapped net.IP
+	for len(attributes) >= 4 {
+		attrType := binary.BigEndian.Uint16(attributes[0:])
+		attrLength := int(binary.BigEndian.Uint16(attributes[2:]))
+		if len(attributes) < 4+attrLength {
+			break
+		}
+		value := attributes[4 : 4+attrLength]
+		if (attrType == stunXorMappedAddr || attrType == stunMappedAddress) && len(value) >= 8 {
+			ipLength := net.IPv4len
+			if value[1] == 0x02 {
+				ipLength = net.IPv6len
+			}
+			if len(value) >= 4+ipLength {
+				ip := make(net.IP, ipLength)
+				copy(ip, value[4:4+ipLength])
+				if attrType == stunXorMappedAddr {
+					for i := range ip {
+						ip[i] ^= xorKey[i]
+					}
+					return ip, nil
+				}
+				mapped = ip
+			}
+		}
+		// Attributes are padded to multiples of 4 bytes
+		attributes = attributes[4+(attrLength+3)/4*4:]
+	}
+	if mapped == nil {
+		return nil, fmt.Errorf("No mapped address in response")
+	}
+	return mapped, nil
+}
+
+/*
+StunServers() returns the host:ports of the STUN servers that we ask for our
+external IP in refreshExternalIP().  It's empty unless configured, which
+disables STUN.
+*/
+func StunServers() []string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return append([]string{}, config.StunServers...)
+}
+
+func SetStunServers(stunServers []string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.StunServers = append([]string{}, stunServers...)
+	save()
+}
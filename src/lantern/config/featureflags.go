@@ -0,0 +1,61 @@
+package config
+
+import (
+	"sync"
+)
+
+/*
+FeatureFlags() returns the feature flags that the local operator has set,
+keyed by feature name.  These take precedence over the policy pushed down by
+our parent.
+*/
+func FeatureFlags() map[string]bool {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return copyFlags(config.FeatureFlags)
+}
+
+func SetFeatureFlags(featureFlags map[string]bool) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.FeatureFlags = copyFlags(featureFlags)
+	save()
+	featureFlagsChanged()
+}
+
+var (
+	featureFlagWatchers = make([]chan bool, 0) // parties watching for changes of FeatureFlags()
+	featureFlagMutex    sync.Mutex             // used to synchronize access to featureFlagWatchers
+)
+
+/*
+WatchFeatureFlags() registers a channel that's signaled whenever FeatureFlags()
+change, so that the flags can be re-evaluated (see package lantern/features).
+Sends don't block.
+*/
+func WatchFeatureFlags(ch chan bool) {
+	featureFlagMutex.Lock()
+	defer featureFlagMutex.Unlock()
+	featureFlagWatchers = append(featureFlagWatchers, ch)
+}
+
+// featureFlagsChanged() notifies the parties watching FeatureFlags().
+func featureFlagsChanged() {
+	featureFlagMutex.Lock()
+	defer featureFlagMutex.Unlock()
+	for _, watcher := range featureFlagWatchers {
+		select {
+		case watcher <- true:
+		default:
+		}
+	}
+}
+
+// copyFlags() returns a copy of the given feature flags.
+func copyFlags(flags map[string]bool) map[string]bool {
+	copied := make(map[string]bool, len(flags))
+	for name, enabled := range flags {
+		copied[name] = enabled
+	}
+	return copied
+}
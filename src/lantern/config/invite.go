@@ -0,0 +1,84 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+/*
+An Invite lets a new node join the tree under the node that handed it out.
+Invites come as invite codes or as links, which carry the same:
+
+	lantern-invite:<base64url of the JSON encoded Invite>
+	lantern://invite/<base64url of the JSON encoded Invite>
+
+Links can also be scanned as QR codes.  New nodes take invites in the setup
+wizard, with the -invite flag or at http://[UIAddress()]/config/invite (see
+package lantern/ui).  Parents hand them out at
+http://[UIAddress()]/admin/invite (see package lantern/keys).
+
+An invite without a Token isn't secret, it only says where to find the parent
+and what its certificate looks like, so the new node still has to sign in to get
+a certificate.  An invite with a Token gets the new node its certificate
+without signing in, so it has to be passed on as carefully as a password.
+*/
+const (
+	INVITE_PREFIX      = "lantern-invite:"   // the prefix of invite codes
+	INVITE_LINK_PREFIX = "lantern://invite/" // the prefix of invite links
+)
+
+// Invite tells a new node where its parent is and which certificate to trust.
+type Invite struct {
+	ParentAddress string // the host:port of the parent's signaling listener
+	ParentCert    string // the PEM encoded certificate of the parent
+	Token         string `json:",omitempty"` // one-time token that gets the new node its certificate without signing in
+}
+
+// Code() encodes the invite as an invite code.
+func (invite *Invite) Code() (string, error) {
+	data, err := json.Marshal(invite)
+	if err != nil {
+		return "", err
+	}
+	return INVITE_PREFIX + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Link() encodes the invite as an invite link.
+func (invite *Invite) Link() (string, error) {
+	code, err := invite.Code()
+	if err != nil {
+		return "", err
+	}
+	return INVITE_LINK_PREFIX + strings.TrimPrefix(code, INVITE_PREFIX), nil
+}
+
+// ParseInvite() decodes and checks the given invite code or link.
+func ParseInvite(code string) (*Invite, error) {
+	code = strings.TrimSpace(code)
+	var encoded string
+	if strings.HasPrefix(code, INVITE_PREFIX) {
+		encoded = strings.TrimPrefix(code, INVITE_PREFIX)
+	} else if strings.HasPrefix(code, INVITE_LINK_PREFIX) {
+		encoded = strings.TrimPrefix(code, INVITE_LINK_PREFIX)
+	} else {
+		return nil, fmt.Errorf("Not an invite, it should start with %s or %s", INVITE_PREFIX, INVITE_LINK_PREFIX)
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Invite code is damaged, make sure that you copied all of it: %s", err)
+	}
+	invite := &Invite{}
+	if err := json.Unmarshal(data, invite); err != nil {
+		return nil, fmt.Errorf("Invite code is damaged, make sure that you copied all of it: %s", err)
+	}
+	if err := ValidateAddress(invite.ParentAddress); err != nil {
+		return nil, fmt.Errorf("Invite code has an invalid parent address: %s", err)
+	}
+	if block, _ := pem.Decode([]byte(invite.ParentCert)); block == nil {
+		return nil, fmt.Errorf("Invite code doesn't carry a parent certificate")
+	}
+	return invite, nil
+}
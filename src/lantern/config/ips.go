@@ -0,0 +1,279 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ROUTABILITY_TIMEOUT = 5 * time.Second // how long we wait when checking that the advertised IP reaches our bind IP
+	ADDRESS_SEPARATOR   = ","             // separates the alternative host:ports of a peer (see AlternativeAddresses())
+)
+
+var (
+	listenWatchers = make([]chan bool, 0) // parties watching for changes of the addresses that we listen on
+	listenMutex    sync.Mutex             // used to synchronize access to listenWatchers
+)
+
+/*
+WatchListenAddresses() registers a channel that's signaled whenever
+LocalProxyAddress(), RemoteProxyAddress() or RemoteProxyListeners() change, so
+that the proxies can rebind.  Sends don't block.
+*/
+func WatchListenAddresses(ch chan bool) {
+	listenMutex.Lock()
+	defer listenMutex.Unlock()
+	listenWatchers = append(listenWatchers, ch)
+}
+
+// listenAddressesChanged() notifies the parties watching the addresses that we
+// listen on.
+func listenAddressesChanged() {
+	listenMutex.Lock()
+	defer listenMutex.Unlock()
+	for _, watcher := range listenWatchers {
+		select {
+		case watcher <- true:
+		default:
+		}
+	}
+}
+
+// SignalingBindAddress() returns the host:port on which the signaling listener
+// binds, taking into account BindIP().
+func SignalingBindAddress() string {
+	return withIP(SignalingAddress(), BindIP())
+}
+
+// AdvertisedSignalingAddress() returns the host:port of our signaling listener
+// that we tell children about, taking into account AdvertiseIP().
+func AdvertisedSignalingAddress() string {
+	return withIP(SignalingAddress(), AdvertisedIP())
+}
+
+// RemoteProxyBindAddress() returns the host:port on which the remote proxy
+// binds, taking into account BindIP().
+func RemoteProxyBindAddress() string {
+	return withIP(RemoteProxyAddress(), BindIP())
+}
+
+// AdvertisedRemoteProxyAddress() returns the host:port of our remote proxy
+// that we tell peers about, taking into account AdvertiseIP().
+func AdvertisedRemoteProxyAddress() string {
+	return withIP(RemoteProxyAddress(), AdvertisedIP())
+}
+
+// RemoteProxyBindAddresses() returns the host:ports on which the remote proxy
+// binds, RemoteProxyBindAddress() first, followed by RemoteProxyListeners().
+func RemoteProxyBindAddresses() []string {
+	addresses := []string{RemoteProxyBindAddress()}
+	for _, listener := range RemoteProxyListeners() {
+		addresses = append(addresses, listener.BindAddress)
+	}
+	return addresses
+}
+
+// AdvertisedRemoteProxyAddresses() returns the host:ports of our remote proxy
+// that we tell peers about, AdvertisedRemoteProxyAddress() first, followed by
+// those of RemoteProxyListeners().
+func AdvertisedRemoteProxyAddresses() []string {
+	addresses := []string{AdvertisedRemoteProxyAddress()}
+	for _, listener := range RemoteProxyListeners() {
+		if listener.AdvertiseAddress != "" {
+			addresses = append(addresses, listener.AdvertiseAddress)
+		} else {
+			addresses = append(addresses, listener.BindAddress)
+		}
+	}
+	return addresses
+}
+
+/*
+AdvertisedIP() returns the IP that we advertise to peers, which is
+AdvertiseIP() if set, BindIP() if set and our discovered ExternalIP()
+otherwise.  A blank value means that we don't have a specific IP to advertise.
+*/
+func AdvertisedIP() string {
+	if advertiseIP := AdvertiseIP(); advertiseIP != "" {
+		return advertiseIP
+	}
+	if bindIP := BindIP(); bindIP != "" {
+		return bindIP
+	}
+	return ExternalIP()
+}
+
+// withIP() replaces the host in the given host:port with the given ip, unless
+// the ip is blank.
+func withIP(address string, ip string) string {
+	if ip == "" {
+		return address
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return net.JoinHostPort(ip, port)
+}
+
+/*
+ValidateIPs() checks the given bind and advertise IPs:
+
+- both must be blank or valid IPv4 or IPv6 addresses, and only the bind IP
+  may carry a zone (like fe80::1%eth0, for link-local addresses)
+- the bind IP must be assigned to one of our network interfaces
+- if the advertise IP differs from the bind IP, connections to the advertise
+  IP must actually reach a listener on the bind IP (for example through a
+  1:1 NAT)
+*/
+func ValidateIPs(bindIP string, advertiseIP string) error {
+	if bindIP != "" {
+		ip := net.ParseIP(withoutZone(bindIP))
+		if ip == nil {
+			return fmt.Errorf("Invalid bind IP: %s", bindIP)
+		}
+		if !isLocalIP(ip) {
+			return fmt.Errorf("Bind IP %s isn't assigned to any local interface", bindIP)
+		}
+	}
+	if advertiseIP == "" || advertiseIP == bindIP {
+		return nil
+	}
+	if net.ParseIP(advertiseIP) == nil {
+		return fmt.Errorf("Invalid advertise IP: %s", advertiseIP)
+	}
+	return checkRoutable(bindIP, advertiseIP)
+}
+
+/*
+ValidateAddress() checks that the given address is a host:port that we can
+listen on or dial: the host has to be blank, a hostname or an IP address
+(IPv6 literals in brackets, like [2001:db8::1]:16200) and the port a number.
+*/
+func ValidateAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("Invalid address %s (IPv6 addresses need brackets): %s", address, err)
+	}
+	if portNumber, err := strconv.Atoi(port); err != nil || portNumber < 0 || portNumber > 65535 {
+		return fmt.Errorf("Invalid port in address %s", address)
+	}
+	if strings.Contains(host, ":") && net.ParseIP(withoutZone(host)) == nil {
+		return fmt.Errorf("Invalid IPv6 address in %s", address)
+	}
+	return nil
+}
+
+// ValidateAddresses() checks all configured addresses with ValidateAddress().
+func ValidateAddresses() error {
+	configMutex.RLock()
+	addresses := config.addresses()
+	configMutex.RUnlock()
+	for _, address := range addresses {
+		if err := ValidateAddress(address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addresses() returns all of the addresses in the config data that are set.
+func (data *configData) addresses() []string {
+	addresses := []string{data.SignalingAddress, data.LocalProxyAddress, data.RemoteProxyAddress, data.UIAddress}
+	if data.ParentAddress != "" {
+		addresses = append(addresses, data.ParentAddress)
+	}
+	if data.EntryProxyAddress != "" {
+		addresses = append(addresses, AlternativeAddresses(data.EntryProxyAddress)...)
+	}
+	if data.EgressProxyAddress != "" {
+		addresses = append(addresses, AlternativeAddresses(data.EgressProxyAddress)...)
+	}
+	if data.DNSAddress != "" {
+		addresses = append(addresses, data.DNSAddress, data.DNSResolver)
+	}
+	for _, address := range data.StaticProxyAddresses {
+		addresses = append(addresses, AlternativeAddresses(address)...)
+	}
+	for _, listener := range data.RemoteProxyListeners {
+		addresses = append(addresses, listener.BindAddress)
+		if listener.AdvertiseAddress != "" {
+			addresses = append(addresses, listener.AdvertiseAddress)
+		}
+	}
+	return addresses
+}
+
+/*
+AlternativeAddresses() splits the given peer address into its alternative
+host:ports.  Peers that can be reached at more than one address, for example
+over IPv4 and IPv6, can be configured with all of them separated by
+ADDRESS_SEPARATOR, like 203.0.113.7:16200,[2001:db8::7]:16200, which we race
+when dialing (see util.DialHappyEyeballs()).  Everywhere else, the whole list
+stands for the peer.
+*/
+func AlternativeAddresses(address string) []string {
+	alternatives := strings.Split(address, ADDRESS_SEPARATOR)
+	for i, alternative := range alternatives {
+		alternatives[i] = strings.TrimSpace(alternative)
+	}
+	return alternatives
+}
+
+// withoutZone() strips the zone from the given IPv6 address, if it has one.
+func withoutZone(ip string) string {
+	if i := strings.Index(ip, "%"); i >= 0 {
+		return ip[:i]
+	}
+	return ip
+}
+
+// isLocalIP() checks whether the given ip is assigned to one of our network
+// interfaces.
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRoutable() checks that a connection to advertiseIP reaches a listener
+// on bindIP.
+func checkRoutable(bindIP string, advertiseIP string) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort(bindIP, "0"))
+	if err != nil {
+		return fmt.Errorf("Unable to listen on bind IP %s: %s", bindIP, err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	accepted := make(chan bool, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+			accepted <- true
+		}
+	}()
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(advertiseIP, port), ROUTABILITY_TIMEOUT)
+	if err != nil {
+		return fmt.Errorf("Advertise IP %s doesn't route to bind IP %s: %s", advertiseIP, bindIP, err)
+	}
+	defer conn.Close()
+	select {
+	case <-accepted:
+		return nil
+	case <-time.After(ROUTABILITY_TIMEOUT):
+		return fmt.Errorf("Advertise IP %s reaches a different listener than bind IP %s", advertiseIP, bindIP)
+	}
+}
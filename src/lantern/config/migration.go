@@ -0,0 +1,343 @@
+package config
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+A migration carries the state of a lantern node over from an old installation,
+for example from the disk of an old machine or a backup of the old home
+directory, so that moving machines doesn't mean setting everything up again.
+
+Migrations happen at startup, before anything else reads the state, when lantern
+is started with -migrate-from=<path>.  <path> may be the old [ConfigDir]
+itself, the old home directory or the root of an attached disk, in which case
+we look for a single home directory containing a .lantern directory (see
+DetectMigrationSource()).
+
+Every item is validated before it's imported:
+
+- keys/own/privatekey.pem (our identity) has to parse as an RSA private key
+- keys/own/certificate.pem has to match the private key and must not have
+  expired, otherwise a new one is requested from our parent as usual
+- keys/trusted/parentcert.pem has to parse as a certificate
+- keys/trusted/psks.json (our peer table) has to parse
+- config.json has to parse, and everything but BindIP and AdvertiseIP, which
+  are specific to the old machine, is carried over (including ChildQuotas)
+
+Files that get replaced are kept with a .premigration suffix.  What was and
+wasn't carried over is logged and recorded in a MigrationReport, which is
+available from LastMigration() and at http://[UIAddress()]/config/migration.
+The same report can be previewed without importing anything with
+PreviewMigration().  After a migration, we refresh our presence with our parent
+(see package lantern/signaling), since we're likely reachable at a new address.
+*/
+
+// MigrationReport records what a migration did.
+type MigrationReport struct {
+	Source         string            // the old [ConfigDir] that was migrated from
+	At             time.Time         // when the migration happened
+	Preview        bool              // whether this is just a preview
+	CarriedOver    []string          // the items that were carried over
+	NotCarriedOver map[string]string // the reasons why items weren't carried over, by item
+}
+
+// migrationItem is a file that's migrated and how it's validated.
+type migrationItem struct {
+	path     string                                 // path relative to [ConfigDir]
+	validate func(data []byte, source string) error // checks the content of the file
+}
+
+var (
+	migrationItems = []migrationItem{
+		{"keys/own/privatekey.pem", validatePrivateKey},
+		{"keys/own/certificate.pem", validateCertificate},
+		{"keys/trusted/parentcert.pem", validateParentCert},
+		{"keys/trusted/psks.json", validatePSKs},
+	}
+	migrationFile = ConfigDir + "/migration.json" // where the report of the last migration is kept
+	justMigrated  = false                         // whether we migrated during this run
+)
+
+// LastMigration() returns the report of the last migration, if there was one.
+func LastMigration() *MigrationReport {
+	data, err := ioutil.ReadFile(migrationFile)
+	if err != nil {
+		return nil
+	}
+	report := &MigrationReport{}
+	if err := json.Unmarshal(data, report); err != nil {
+		return nil
+	}
+	return report
+}
+
+// JustMigrated() indicates whether or not we migrated from an old installation
+// during this run.
+func JustMigrated() bool {
+	return justMigrated
+}
+
+// PreviewMigration() reports what a migration from the given path would carry
+// over, without importing anything.
+func PreviewMigration(path string) (*MigrationReport, error) {
+	source, err := DetectMigrationSource(path)
+	if err != nil {
+		return nil, err
+	}
+	return migrate(source, true), nil
+}
+
+/*
+DetectMigrationSource() finds the old [ConfigDir] at the given path, which may
+be the old [ConfigDir] itself, the old home directory or the root of an old
+disk.
+*/
+func DetectMigrationSource(path string) (string, error) {
+	candidates := []string{path, filepath.Join(path, ".lantern")}
+	for _, pattern := range []string{"home/*/.lantern", "Users/*/.lantern", "root/.lantern"} {
+		if matches, err := filepath.Glob(filepath.Join(path, pattern)); err == nil {
+			candidates = append(candidates, matches...)
+		}
+	}
+	found := make([]string, 0)
+	for _, candidate := range candidates {
+		if isConfigDir(candidate) {
+			found = append(found, candidate)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("No lantern installation found at %s", path)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("Found several lantern installations at %s, please pick one of %v", path, found)
+	}
+}
+
+// isConfigDir() indicates whether or not the given directory looks like a
+// [ConfigDir].
+func isConfigDir(dir string) bool {
+	for _, name := range []string{"config.json", "keys/own/privatekey.pem"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// migrateAtStartup() migrates from the path given with -migrate-from, if any.
+func migrateAtStartup() {
+	if *migrateFrom == "" {
+		return
+	}
+	if *ephemeral {
+		log.Printf("Not migrating from %s, ephemeral nodes don't keep any state", *migrateFrom)
+		return
+	}
+	source, err := DetectMigrationSource(*migrateFrom)
+	if err != nil {
+		log.Printf("Unable to migrate: %s", err)
+		return
+	}
+	if filepath.Clean(source) == filepath.Clean(ConfigDir) {
+		log.Printf("Not migrating from %s, it's our own installation", source)
+		return
+	}
+	report := migrate(source, false)
+	justMigrated = true
+	if err := saveMigrationReport(report); err != nil {
+		log.Printf("Unable to save migration report to %s: %s", migrationFile, err)
+	}
+}
+
+// saveMigrationReport() saves the given report as that of the last migration.
+func saveMigrationReport(report *MigrationReport) error {
+	data, err := json.MarshalIndent(report, "", "   ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(migrationFile, data, 0600)
+}
+
+// migrate() migrates (or previews migrating) everything from the given old
+// [ConfigDir].
+func migrate(source string, preview bool) *MigrationReport {
+	report := &MigrationReport{
+		Source:         source,
+		At:             time.Now(),
+		Preview:        preview,
+		CarriedOver:    []string{},
+		NotCarriedOver: make(map[string]string),
+	}
+	for _, item := range migrationItems {
+		if err := migrateFile(source, item, preview); err != nil {
+			report.NotCarriedOver[item.path] = err.Error()
+		} else {
+			report.CarriedOver = append(report.CarriedOver, item.path)
+		}
+	}
+	migrateConfig(source, preview, report)
+
+	if !preview {
+		for _, item := range report.CarriedOver {
+			log.Printf("Migration from %s: carried over %s", source, item)
+		}
+		for item, reason := range report.NotCarriedOver {
+			log.Printf("Migration from %s: didn't carry over %s: %s", source, item, reason)
+		}
+	}
+	return report
+}
+
+// migrateFile() validates a single file from the old [ConfigDir] and, unless
+// we're previewing, copies it into ours.
+func migrateFile(source string, item migrationItem, preview bool) error {
+	data, err := ioutil.ReadFile(filepath.Join(source, item.path))
+	if err != nil {
+		return fmt.Errorf("Not found")
+	}
+	if err := item.validate(data, source); err != nil {
+		return err
+	}
+	if preview {
+		return nil
+	}
+	return install(item.path, data)
+}
+
+/*
+migrateConfig() validates the old config.json and, unless we're previewing,
+installs it without the settings that are specific to the old machine.
+*/
+func migrateConfig(source string, preview bool, report *MigrationReport) {
+	data, err := ioutil.ReadFile(filepath.Join(source, "config.json"))
+	if err != nil {
+		report.NotCarriedOver["config.json"] = "Not found"
+		return
+	}
+	// Unmarshaling into a clone keeps the imported settings from leaking into
+	// our live config through shared slices and maps
+	configMutex.RLock()
+	imported := config.clone()
+	configMutex.RUnlock()
+	if err := json.Unmarshal(data, imported); err != nil {
+		report.NotCarriedOver["config.json"] = fmt.Sprintf("Invalid: %s", err)
+		return
+	}
+	if imported.BindIP != "" || imported.AdvertiseIP != "" {
+		report.NotCarriedOver["config.json: BindIP, AdvertiseIP"] = "Specific to the old machine, please reconfigure them"
+		imported.BindIP = ""
+		imported.AdvertiseIP = ""
+	}
+	if !preview {
+		if data, err = json.MarshalIndent(imported, "", "   "); err == nil {
+			err = install("config.json", data)
+		}
+		if err != nil {
+			report.NotCarriedOver["config.json"] = err.Error()
+			return
+		}
+	}
+	report.CarriedOver = append(report.CarriedOver, "config.json")
+}
+
+// install() writes the given data to the given path relative to our
+// [ConfigDir], keeping whatever was there with a .premigration suffix.
+func install(path string, data []byte) error {
+	target := filepath.Join(ConfigDir, path)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(target); err == nil {
+		if err := os.Rename(target, target+".premigration"); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(target, data, 0600)
+}
+
+// validatePrivateKey() checks that the given data is a PEM encoded RSA private
+// key.
+func validatePrivateKey(data []byte, source string) error {
+	_, err := parsePrivateKey(data)
+	return err
+}
+
+/*
+validateCertificate() checks that the given data is a PEM encoded certificate
+that hasn't expired and that belongs to the private key in the old
+[ConfigDir].
+*/
+func validateCertificate(data []byte, source string) error {
+	cert, err := parseCertificate(data)
+	if err != nil {
+		return err
+	}
+	if time.Now().After(cert.NotAfter) {
+		return fmt.Errorf("Expired on %s, a new one will be requested from our parent", cert.NotAfter)
+	}
+	keyData, err := ioutil.ReadFile(filepath.Join(source, "keys/own/privatekey.pem"))
+	if err != nil {
+		return fmt.Errorf("No private key to go with it")
+	}
+	privateKey, err := parsePrivateKey(keyData)
+	if err != nil {
+		return err
+	}
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok || publicKey.N.Cmp(privateKey.PublicKey.N) != 0 || publicKey.E != privateKey.PublicKey.E {
+		return fmt.Errorf("Doesn't match the private key")
+	}
+	return nil
+}
+
+// validateParentCert() checks that the given data is a PEM encoded
+// certificate.
+func validateParentCert(data []byte, source string) error {
+	_, err := parseCertificate(data)
+	return err
+}
+
+// validatePSKs() checks that the given data is a valid peer table.
+func validatePSKs(data []byte, source string) error {
+	psks := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &psks); err != nil {
+		return fmt.Errorf("Invalid: %s", err)
+	}
+	return nil
+}
+
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("Not PEM encoded")
+	}
+	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid private key: %s", err)
+	}
+	return privateKey, nil
+}
+
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("Not PEM encoded")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid certificate: %s", err)
+	}
+	return cert, nil
+}
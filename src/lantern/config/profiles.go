@@ -0,0 +1,115 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+Profiles let a user run lantern as different identities or against different
+networks (for example work and personal) without juggling directories.  Each
+profile is a complete [ConfigDir] of its own, with its own config.json and keys,
+at [BaseDir]/profiles/<name>.  The default profile (named "") is [BaseDir]
+itself, so installations that predate profiles keep working as they are.
+
+The active profile is picked at startup, from the -profile flag if given, or
+otherwise from the profile selected with SelectProfile() (which is remembered
+in [BaseDir]/profile).  Since every package sets itself up from [ConfigDir] at
+startup, switching profiles takes effect on the next start.  Profiles can also
+be listed and selected at http://[UIAddress()]/config/profiles.
+*/
+
+const PROFILES_DIR = "profiles" // the directory under [BaseDir] that holds the profiles
+
+// validProfileName matches the names that we accept for profiles.
+var validProfileName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Profile() returns the name of the active profile ("" for the default).
+func Profile() string {
+	return activeProfile
+}
+
+// SelectedProfile() returns the name of the profile that will be active on the
+// next start, unless overridden with -profile.
+func SelectedProfile() string {
+	data, err := ioutil.ReadFile(filepath.Join(BaseDir, "profile"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Profiles() lists the names of all profiles besides the default one.
+func Profiles() []string {
+	entries, err := ioutil.ReadDir(filepath.Join(BaseDir, PROFILES_DIR))
+	if err != nil {
+		return []string{}
+	}
+	profiles := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() && validProfileName.MatchString(entry.Name()) {
+			profiles = append(profiles, entry.Name())
+		}
+	}
+	sort.Strings(profiles)
+	return profiles
+}
+
+/*
+SelectProfile() selects the profile with the given name ("" for the default) to
+be active from the next start on, creating it if necessary.
+*/
+func SelectProfile(name string) error {
+	if *ephemeral {
+		return fmt.Errorf("Ephemeral nodes can't remember profile selections")
+	}
+	if name != "" {
+		if !validProfileName.MatchString(name) {
+			return fmt.Errorf("Invalid profile name: %s", name)
+		}
+		if err := os.MkdirAll(profileDir(name), 0755); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(BaseDir, "profile"), []byte(name), 0600)
+}
+
+// initProfile() makes sure that the active profile's [ConfigDir] exists.
+func initProfile() {
+	if activeProfile == "" {
+		return
+	}
+	log.Printf("Running as profile %s", activeProfile)
+	if !*ephemeral {
+		if err := os.MkdirAll(ConfigDir, 0755); err != nil {
+			log.Fatalf("Unable to create directory for profile %s: %s", activeProfile, err)
+		}
+	}
+}
+
+// determineProfile() determines the active profile from the -profile flag or
+// the remembered selection.
+func determineProfile() string {
+	name := *profileFlag
+	if name == "" {
+		name = SelectedProfile()
+	}
+	if name != "" && !validProfileName.MatchString(name) {
+		log.Fatalf("Invalid profile name: %s", name)
+	}
+	return name
+}
+
+// profileDir() returns the [ConfigDir] of the profile with the given name.
+func profileDir(name string) string {
+	if name == "" {
+		return BaseDir
+	}
+	return filepath.Join(BaseDir, PROFILES_DIR, name)
+}
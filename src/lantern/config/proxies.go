@@ -0,0 +1,146 @@
+package config
+
+/*
+RemoteProxyListeners() returns the additional listeners of the remote proxy
+besides RemoteProxyAddress(), for example on a second interface, on IPv6 or
+behind a port forwarding.  They're all served alike and all advertised to peers
+(see RemoteProxyBindAddresses() and AdvertisedRemoteProxyAddresses()).
+*/
+func RemoteProxyListeners() []ProxyListenerConfig {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return append([]ProxyListenerConfig{}, config.RemoteProxyListeners...)
+}
+
+func SetRemoteProxyListeners(listeners []ProxyListenerConfig) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.RemoteProxyListeners = append([]ProxyListenerConfig{}, listeners...)
+	save()
+	listenAddressesChanged()
+}
+
+/*
+StaticProxyCredentials() returns the credentials that we present to static
+proxies that require them, keyed by the static proxy's host:port.
+*/
+func StaticProxyCredentials() map[string]ProxyCredentials {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return copyCredentials(config.StaticProxyCredentials)
+}
+
+func SetStaticProxyCredentials(staticProxyCredentials map[string]ProxyCredentials) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.StaticProxyCredentials = copyCredentials(staticProxyCredentials)
+	save()
+}
+
+// copyCredentials() returns a copy of the given static proxy credentials.
+func copyCredentials(credentials map[string]ProxyCredentials) map[string]ProxyCredentials {
+	copied := make(map[string]ProxyCredentials, len(credentials))
+	for address, credential := range credentials {
+		copied[address] = credential
+	}
+	return copied
+}
+
+/*
+ProxyLimits() returns the limits on the connections that our remote proxy
+relays for peers, which keep low-powered donor machines from falling over.
+*/
+func ProxyLimits() ProxyLimitConfig {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.ProxyLimits
+}
+
+func SetProxyLimits(proxyLimits ProxyLimitConfig) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.ProxyLimits = proxyLimits
+	save()
+}
+
+/*
+ProxyAccess() returns the credentials that our remote proxy requires from
+peers, which lets operators run semi-public fallback proxies without becoming
+open relays.
+*/
+func ProxyAccess() ProxyAccessConfig {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.ProxyAccess.clone()
+}
+
+func SetProxyAccess(proxyAccess ProxyAccessConfig) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.ProxyAccess = proxyAccess.clone()
+	save()
+}
+
+/*
+Cache() returns the settings of the local proxy's HTTP cache, which keeps
+cacheable responses fetched through peers on disk (see package lantern/proxy).
+*/
+func Cache() CacheConfig {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.Cache
+}
+
+func SetCache(cache CacheConfig) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.Cache = cache
+	save()
+}
+
+// ProxyListenerConfig defines an additional listener of the remote proxy.
+type ProxyListenerConfig struct {
+	BindAddress      string // the host:port on which to listen
+	AdvertiseAddress string // the host:port that we tell peers about, e.g. a port forwarding (blank to use BindAddress)
+}
+
+// ProxyLimitConfig defines the limits enforced by the remote proxy (0 means
+// unlimited).
+type ProxyLimitConfig struct {
+	MaxConnections          int // max concurrent relayed connections
+	MaxConnectionsPerClient int // max concurrent relayed connections per client
+}
+
+/*
+ProxyCredentials defines what we present to a static proxy that requires
+credentials.  Relative file names are relative to [ConfigDir].
+*/
+type ProxyCredentials struct {
+	Token          string // the access token sent during the handshake (blank for none)
+	ClientCertFile string // a PEM encoded client certificate to present instead of ours (blank for none)
+	ClientKeyFile  string // the PEM encoded private key of ClientCertFile
+}
+
+// ProxyAccessConfig defines the credentials that our remote proxy requires.
+type ProxyAccessConfig struct {
+	RequireCredentials bool              // whether peers need a token or client certificate from below
+	Tokens             map[string]string // names of whoever got access tokens, by token
+	ClientCAFile       string            // PEM encoded CA certificates that issue accepted client certificates (relative to [ConfigDir])
+}
+
+// clone() returns a copy of the access config that shares no maps with it.
+func (access ProxyAccessConfig) clone() ProxyAccessConfig {
+	tokens := make(map[string]string, len(access.Tokens))
+	for token, name := range access.Tokens {
+		tokens[token] = name
+	}
+	access.Tokens = tokens
+	return access
+}
+
+// CacheConfig defines the settings of the local proxy's HTTP cache.
+type CacheConfig struct {
+	Enabled      bool  // whether cacheable responses are kept (never on ephemeral nodes)
+	MaxSize      int64 // max total size of the cached bodies in bytes
+	MaxEntrySize int64 // max size of a single cached body in bytes
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// REDACTED replaces sensitive values in Redacted().
+const REDACTED = "[redacted]"
+
+/*
+Redacted() returns the JSON encoded config with everything that identifies
+users or grants access replaced by REDACTED, for inclusion in diagnostic
+reports.
+*/
+func Redacted() ([]byte, error) {
+	configMutex.RLock()
+	redacted := config.clone()
+	configMutex.RUnlock()
+	redactAll := func(values []string) []string {
+		for i := range values {
+			values[i] = REDACTED
+		}
+		return values
+	}
+	if redacted.Email != "" {
+		redacted.Email = REDACTED
+	}
+	redactAll(redacted.BlockedIdentities)
+	redactAll(redacted.UnblockedIdentities)
+	redactAll(redacted.ProvisioningTokens)
+	redactAll(redacted.Friends)
+	if redacted.InviteToken != "" {
+		redacted.InviteToken = REDACTED
+	}
+	for address, credentials := range redacted.StaticProxyCredentials {
+		if credentials.Token != "" {
+			credentials.Token = REDACTED
+		}
+		redacted.StaticProxyCredentials[address] = credentials
+	}
+	tokens := make(map[string]string, len(redacted.ProxyAccess.Tokens))
+	for i := range len(redacted.ProxyAccess.Tokens) {
+		tokens[fmt.Sprintf("%s-%d", REDACTED, i+1)] = REDACTED
+	}
+	redacted.ProxyAccess.Tokens = tokens
+	return json.MarshalIndent(redacted, "", "   ")
+}
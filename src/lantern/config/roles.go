@@ -0,0 +1,145 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+/*
+Lantern can be started with a subcommand that names the role of the node, in
+which case only the subsystems that the role needs are started:
+
+	lantern [flags] [client|relay|root] [BaseDir]
+
+- client - a user node that gets access through peers.  Only the local proxy
+  (including the transparent proxy and WPAD) runs, the remote proxy, the
+  signaling listener and the certificate issuance endpoint don't bind their
+  ports.
+- relay - a pure relay in the relay role (see IsRelay()).  The remote proxy,
+  the signaling listener and the certificate issuance endpoint run, the local
+  proxy doesn't.
+- root - the root of the tree, which starts the same subsystems as relay but
+  refuses to start if a parent address is configured.
+
+Without a subcommand, all subsystems start as configured.  Packages check
+Runs() before they start a subsystem.
+
+Programs that embed lantern as a library (see package lantern/client) can't
+pass it a command line, so they set EMBEDDED_ENV in their environment to the
+BaseDir instead (lantern/client sets a default if they don't).  Lantern then
+leaves their command line alone and runs as if started with the embedded
+subcommand, which starts none of the subsystems above and only tunnels the
+program's own connections through our upstream proxies.  Our flags live in a
+FlagSet of their own, so they never mix with the program's.  Since they can't
+pass -ephemeral either, they set EPHEMERAL_ENV to run ephemeral (see package
+lantern/client/ephemeral, which test binaries import).
+
+The backup and restore commands (see backup.go) and the tool commands (see
+commands.go) don't start a node at all.
+*/
+const (
+	SUBCOMMAND_CLIENT   = "client"   // run as a client
+	SUBCOMMAND_RELAY    = "relay"    // run as a relay
+	SUBCOMMAND_ROOT     = "root"     // run as the root of the tree
+	SUBCOMMAND_EMBEDDED = "embedded" // run inside another program (see EMBEDDED_ENV)
+
+	EMBEDDED_ENV  = "LANTERN_EMBEDDED"  // the environment variable through which embedding programs pass the BaseDir
+	EPHEMERAL_ENV = "LANTERN_EPHEMERAL" // the environment variable through which embedding programs ask to run ephemeral
+
+	SUBSYSTEM_LOCAL_PROXY        = "local proxy"        // the local proxy and everything that feeds it
+	SUBSYSTEM_REMOTE_PROXY       = "remote proxy"       // the remote proxy that peers connect to
+	SUBSYSTEM_SIGNALING_LISTENER = "signaling listener" // the listener for signaling connections from children
+	SUBSYSTEM_CERT_ISSUANCE      = "cert issuance"      // the endpoint at which children obtain certificates
+)
+
+// subsystems are the subsystems that each subcommand starts.
+var subsystems = map[string]map[string]bool{
+	SUBCOMMAND_CLIENT: {
+		SUBSYSTEM_LOCAL_PROXY: true,
+	},
+	SUBCOMMAND_RELAY: {
+		SUBSYSTEM_REMOTE_PROXY:       true,
+		SUBSYSTEM_SIGNALING_LISTENER: true,
+		SUBSYSTEM_CERT_ISSUANCE:      true,
+	},
+	SUBCOMMAND_ROOT: {
+		SUBSYSTEM_REMOTE_PROXY:       true,
+		SUBSYSTEM_SIGNALING_LISTENER: true,
+		SUBSYSTEM_CERT_ISSUANCE:      true,
+	},
+	SUBCOMMAND_EMBEDDED: {},
+}
+
+// subcommand is the subcommand that we were started with ("" for none), set
+// by parseArgs()
+var subcommand string
+
+// Subcommand() returns the subcommand that we were started with ("" for none).
+func Subcommand() string {
+	return subcommand
+}
+
+/*
+Runs() indicates whether or not the given subsystem (one of the SUBSYSTEM_
+constants) should be started.  Without a subcommand, all of them are.
+*/
+func Runs(subsystem string) bool {
+	if subcommand == "" {
+		return true
+	}
+	return subsystems[subcommand][subsystem]
+}
+
+// Args() returns the command line arguments that follow our flags, like
+// flag.Args() (none when embedded).
+func Args() []string {
+	return flags.Args()
+}
+
+/*
+parseArgs() parses the command line and returns the arguments that follow the
+subcommand, if any.
+*/
+func parseArgs() []string {
+	if baseDir := os.Getenv(EMBEDDED_ENV); baseDir != "" {
+		// The command line belongs to the program that embeds us
+		subcommand = SUBCOMMAND_EMBEDDED
+		*ephemeral = os.Getenv(EPHEMERAL_ENV) != ""
+		return []string{baseDir}
+	}
+	flags.Parse(os.Args[1:])
+	args := flags.Args()
+	if len(args) > 0 && subsystems[args[0]] != nil {
+		subcommand = args[0]
+		args = args[1:]
+	} else if len(args) > 0 && isArchiveCommand(args[0]) {
+		args = parseArchiveArgs(args)
+	} else if len(args) > 0 && isToolCommand(args[0]) {
+		args = parseToolArgs(args)
+	}
+	return args
+}
+
+// checkSubcommand() refuses to start if the config contradicts our subcommand.
+func checkSubcommand() {
+	if err := subcommandInconsistency(); err != nil {
+		log.Fatalf("Refusing to start as %s: %s", subcommand, err)
+	}
+}
+
+// subcommandInconsistency() returns what contradicts our subcommand, if
+// anything.
+func subcommandInconsistency() error {
+	switch subcommand {
+	case SUBCOMMAND_CLIENT:
+		if Role() == ROLE_RELAY {
+			return fmt.Errorf("The config has the role %s", ROLE_RELAY)
+		}
+	case SUBCOMMAND_ROOT:
+		if !IsRootNode() {
+			return fmt.Errorf("The config has the parent address %s", ParentAddress())
+		}
+	}
+	return nil
+}
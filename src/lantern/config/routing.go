@@ -0,0 +1,67 @@
+package config
+
+/*
+DetectCensorship() indicates whether or not the local proxy tries to reach
+sites directly before going through a peer, learning which domains are
+blocked where we are (see package lantern/proxy).
+*/
+func DetectCensorship() bool {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.DetectCensorship
+}
+
+func SetDetectCensorship(detectCensorship bool) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.DetectCensorship = detectCensorship
+	save()
+}
+
+/*
+AppRouting() returns how the traffic of the local proxy is routed by the process
+that it comes from, which lets users proxy only their browser or keep a
+corporate VPN client off peers (see apps.go in package lantern/proxy).  Only
+connections from this machine can be matched to a process.
+*/
+func AppRouting() AppRoutingConfig {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.AppRouting.clone()
+}
+
+func SetAppRouting(appRouting AppRoutingConfig) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.AppRouting = appRouting.clone()
+	save()
+}
+
+const (
+	ROUTE_AUTO   = ""       // route as usual (see DetectCensorship())
+	ROUTE_PROXY  = "proxy"  // always go through peers
+	ROUTE_DIRECT = "direct" // always go directly, never through peers
+)
+
+/*
+AppRule routes the traffic of the local proxy from the given process (matched
+by the name of its executable, without a path or .exe suffix and ignoring case).
+*/
+type AppRule struct {
+	Process string // the name of the process' executable
+	Route   string // how the process' traffic is routed (a ROUTE_ constant)
+}
+
+// AppRoutingConfig defines how the traffic of the local proxy is routed by the
+// process that it comes from.
+type AppRoutingConfig struct {
+	Rules     []AppRule // the rules, the first one matching a process applies
+	Unmatched string    // how traffic from processes without a rule is routed (a ROUTE_ constant)
+}
+
+// clone() returns a copy of the app routing config that shares no slices with
+// it.
+func (routing AppRoutingConfig) clone() AppRoutingConfig {
+	routing.Rules = append([]AppRule{}, routing.Rules...)
+	return routing
+}
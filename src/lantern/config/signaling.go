@@ -0,0 +1,54 @@
+package config
+
+/*
+ChildQuotas() returns the limits that this node enforces on the children
+connected to its signaling channel, protecting it from misbehaving children.
+*/
+func ChildQuotas() ChildQuotaConfig {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.ChildQuotas
+}
+
+func SetChildQuotas(childQuotas ChildQuotaConfig) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.ChildQuotas = childQuotas
+	save()
+}
+
+/*
+SignalingHistory() returns the bounds of the history of messages that this node
+keeps for recipients that aren't connected yet (see package lantern/signaling).
+*/
+func SignalingHistory() HistoryConfig {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.SignalingHistory
+}
+
+func SetSignalingHistory(signalingHistory HistoryConfig) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.SignalingHistory = signalingHistory
+	save()
+}
+
+// ChildQuotaConfig defines the limits enforced on children (0 means unlimited).
+type ChildQuotaConfig struct {
+	MaxConnections              int     // max concurrent child connections
+	MaxRegistrationsPerChild    int     // max patterns registered per child connection
+	MaxMessagesPerSecond        float64 // max sustained message rate per child
+	MaxConnectAttemptsPerMinute int     // max connection attempts per IP per minute
+}
+
+/*
+HistoryConfig defines the bounds of the signaling message history.  Setting
+MaxMessagesPerRecipient or TTLSeconds to 0 turns the history off, setting
+MaxRecipients to 0 leaves only TTLSeconds to bound it.
+*/
+type HistoryConfig struct {
+	MaxMessagesPerRecipient int // max messages kept per recipient
+	MaxRecipients           int // max recipients for which messages are kept
+	TTLSeconds              int // how long a message is kept
+}
@@ -0,0 +1,49 @@
+package config
+
+/*
+TelemetryOptIn() indicates whether or not the user has opted in to sharing
+aggregated connection telemetry and anonymous usage statistics (see package
+lantern/telemetry).  This is false unless the user explicitly turns it on.
+*/
+func TelemetryOptIn() bool {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.TelemetryOptIn
+}
+
+func SetTelemetryOptIn(telemetryOptIn bool) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.TelemetryOptIn = telemetryOptIn
+	save()
+}
+
+// TelemetrySampleRate() returns the fraction (0 to 1) of sessions that are
+// sampled for telemetry when the user has opted in.
+func TelemetrySampleRate() float64 {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.TelemetrySampleRate
+}
+
+func SetTelemetrySampleRate(telemetrySampleRate float64) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.TelemetrySampleRate = telemetrySampleRate
+	save()
+}
+
+// TelemetryURL() returns the url to which aggregated telemetry is uploaded.  A
+// blank value means that telemetry is only ever aggregated locally.
+func TelemetryURL() string {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.TelemetryURL
+}
+
+func SetTelemetryURL(telemetryURL string) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.TelemetryURL = telemetryURL
+	save()
+}
@@ -0,0 +1,53 @@
+package config
+
+/*
+BootstrapSources() returns the urls from which updates of the signed bootstrap
+list of fallback proxies are fetched (see package lantern/bootstrap).
+*/
+func BootstrapSources() []BootstrapSource {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return append([]BootstrapSource{}, config.BootstrapSources...)
+}
+
+func SetBootstrapSources(bootstrapSources []BootstrapSource) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.BootstrapSources = append([]BootstrapSource{}, bootstrapSources...)
+	save()
+}
+
+/*
+Updates() returns the settings for updating the lantern binary automatically
+(see package lantern/update).
+*/
+func Updates() UpdateConfig {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config.Updates
+}
+
+func SetUpdates(updates UpdateConfig) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	config.Updates = updates
+	save()
+}
+
+/*
+BootstrapSource defines a url from which updates of the bootstrap list are
+fetched.  With a Front, the request is domain fronted: the connection is made
+to the Front with its name in the TLS handshake, and only the Host header names
+the real host of URL.
+*/
+type BootstrapSource struct {
+	URL   string // the https url of the signed bootstrap list
+	Front string // the domain to front the request with (blank to fetch through our local proxy)
+}
+
+// UpdateConfig defines the settings for updating the lantern binary.
+type UpdateConfig struct {
+	Enabled bool   // whether we check for and install updates (never on ephemeral nodes)
+	Channel string // the release channel that we follow ("stable" or "beta")
+	URL     string // the base url of the signed manifests, which are at <URL>/<Channel>.signed (blank to disable)
+}
@@ -0,0 +1,224 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+/*
+Validate() checks the config for mistakes that would otherwise only surface
+deep inside a listener or a connection attempt, and describes each of them in
+terms of the settings in config.json:
+
+- malformed host:ports (see ValidateAddress())
+- listeners of the subsystems that we run (see Runs()) that would bind the same
+  port on overlapping hosts
+- a parent address that points back at our own signaling listener
+- a [ConfigDir] that we can't write to (except on ephemeral nodes)
+- settings that contradict our subcommand (see roles.go)
+- unknown routes in AppRouting and an unknown mode of AccessLog
+
+We refuse to start with a config that doesn't validate (see checkConfig()).
+Changes are validated as they're made (see save()), and new problems are logged,
+but the changes are kept, since some of them only make sense together with
+changes that follow.
+*/
+
+// ConfigError lists the problems that Validate() found.
+type ConfigError struct {
+	Problems []string // what's wrong, one problem per entry
+}
+
+func (err *ConfigError) Error() string {
+	return strings.Join(err.Problems, "; ")
+}
+
+// listenerAddress is an address that one of our subsystems listens on.
+type listenerAddress struct {
+	setting string // the name of the setting in config.json
+	address string // the host:port to listen on
+}
+
+// reportedProblems are the problems that save() logged last, so that it only
+// logs them again once they change.  configMutex must be held.
+var reportedProblems string
+
+// Validate() checks the config, returning a ConfigError if anything's wrong.
+func Validate() error {
+	configMutex.RLock()
+	problems := config.problems()
+	configMutex.RUnlock()
+	if err := subcommandInconsistency(); err != nil {
+		problems = append(problems, fmt.Sprintf("%s, which contradicts starting as %s", err, subcommand))
+	}
+	if !*ephemeral {
+		if err := checkWritable(ConfigDir); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return &ConfigError{problems}
+	}
+	return nil
+}
+
+// checkConfig() refuses to start if the config doesn't validate.
+func checkConfig() {
+	if err := Validate(); err != nil {
+		log.Fatalf("Refusing to start with problems in %s: %s", configFile, err)
+	}
+}
+
+// reportProblems() logs the problems of the config data, if they changed since
+// we last logged them.  configMutex must be held.
+func (data *configData) reportProblems() {
+	problems := data.problems()
+	if summary := strings.Join(problems, "\n"); summary != reportedProblems {
+		reportedProblems = summary
+		for _, problem := range problems {
+			log.Printf("Config problem: %s", problem)
+		}
+	}
+}
+
+// problems() describes what's wrong with the config data, except for the
+// [ConfigDir].
+func (data *configData) problems() []string {
+	problems := make([]string, 0)
+	for _, address := range data.addresses() {
+		if err := ValidateAddress(address); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		// The checks below need well-formed addresses
+		return problems
+	}
+
+	listeners := data.listeners()
+	for i, first := range listeners {
+		for _, second := range listeners[i+1:] {
+			if collide(first.address, second.address) {
+				_, port, _ := net.SplitHostPort(first.address)
+				problems = append(problems, fmt.Sprintf("%s (%s) and %s (%s) both listen on port %s, change one of them", first.setting, first.address, second.setting, second.address, port))
+			}
+		}
+	}
+
+	routes := []string{data.AppRouting.Unmatched}
+	for _, rule := range data.AppRouting.Rules {
+		routes = append(routes, rule.Route)
+	}
+	for _, route := range routes {
+		if route != ROUTE_AUTO && route != ROUTE_PROXY && route != ROUTE_DIRECT {
+			problems = append(problems, fmt.Sprintf("AppRouting has the unknown route %q, use %q, %q or %q", route, ROUTE_AUTO, ROUTE_PROXY, ROUTE_DIRECT))
+		}
+	}
+
+	switch data.AccessLog.Mode {
+	case ACCESS_LOG_OFF, ACCESS_LOG_HOSTS, ACCESS_LOG_HASHED:
+	default:
+		problems = append(problems, fmt.Sprintf("AccessLog has the unknown mode %q, use %q, %q or %q", data.AccessLog.Mode, ACCESS_LOG_OFF, ACCESS_LOG_HOSTS, ACCESS_LOG_HASHED))
+	}
+
+	if data.ParentAddress != "" {
+		parentHost, parentPort, _ := net.SplitHostPort(data.ParentAddress)
+		_, ownPort, _ := net.SplitHostPort(data.SignalingAddress)
+		if parentPort == ownPort && data.isOwnHost(parentHost) {
+			problems = append(problems, fmt.Sprintf("ParentAddress (%s) points at our own SignalingAddress (%s), set it to the address of our parent or leave it blank for a root node", data.ParentAddress, data.SignalingAddress))
+		}
+	}
+	return problems
+}
+
+// listeners() returns the addresses that the subsystems that we run listen on.
+func (data *configData) listeners() []listenerAddress {
+	listeners := []listenerAddress{{"UIAddress", data.UIAddress}}
+	if Runs(SUBSYSTEM_LOCAL_PROXY) {
+		listeners = append(listeners, listenerAddress{"LocalProxyAddress", data.LocalProxyAddress})
+		if data.TransparentProxyAddress != "" {
+			listeners = append(listeners, listenerAddress{"TransparentProxyAddress", data.TransparentProxyAddress})
+		}
+		if data.WPADAddress != "" {
+			listeners = append(listeners, listenerAddress{"WPADAddress", data.WPADAddress})
+		}
+	}
+	if Runs(SUBSYSTEM_SIGNALING_LISTENER) {
+		listeners = append(listeners, listenerAddress{"SignalingAddress", withIP(data.SignalingAddress, data.BindIP)})
+	}
+	if Runs(SUBSYSTEM_REMOTE_PROXY) {
+		listeners = append(listeners, listenerAddress{"RemoteProxyAddress", withIP(data.RemoteProxyAddress, data.BindIP)})
+		for i, listener := range data.RemoteProxyListeners {
+			listeners = append(listeners, listenerAddress{fmt.Sprintf("RemoteProxyListeners[%d]", i), listener.BindAddress})
+		}
+	}
+	return listeners
+}
+
+// collide() indicates whether listeners on the two given host:ports would bind
+// the same port on overlapping hosts.
+func collide(first string, second string) bool {
+	firstHost, firstPort, _ := net.SplitHostPort(first)
+	secondHost, secondPort, _ := net.SplitHostPort(second)
+	if firstPort != secondPort || firstPort == "0" {
+		// Port 0 picks a free port
+		return false
+	}
+	if isWildcard(firstHost) || isWildcard(secondHost) {
+		return true
+	}
+	return normalizeHost(firstHost) == normalizeHost(secondHost)
+}
+
+// isWildcard() indicates whether listening on the given host listens on all
+// interfaces.
+func isWildcard(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(withoutZone(host))
+	return ip != nil && ip.IsUnspecified()
+}
+
+// normalizeHost() returns a canonical form of the given host, so that the same
+// host written differently compares equal.
+func normalizeHost(host string) string {
+	if strings.EqualFold(host, "localhost") {
+		return "127.0.0.1"
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return strings.ToLower(host)
+}
+
+// isOwnHost() indicates whether the given host is one of ours.
+func (data *configData) isOwnHost(host string) bool {
+	if isWildcard(host) || strings.EqualFold(host, "localhost") {
+		return true
+	}
+	if host == data.BindIP || host == data.AdvertiseIP {
+		return true
+	}
+	ip := net.ParseIP(withoutZone(host))
+	return ip != nil && (ip.IsLoopback() || isLocalIP(ip))
+}
+
+// checkWritable() checks that we can create files in the given directory,
+// creating it if necessary.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("Unable to create ConfigDir %s: %s", dir, err)
+	}
+	file, err := ioutil.TempFile(dir, ".writable")
+	if err != nil {
+		return fmt.Errorf("ConfigDir %s isn't writable, fix its permissions or start lantern with another directory: %s", dir, err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+	return nil
+}
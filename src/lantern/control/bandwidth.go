@@ -0,0 +1,66 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+BANDWIDTH_TIMEOUT is how long we wait for the running node to finish a
+bandwidth test, which takes up to proxy.BANDWIDTH_TEST_TIMEOUT (60 seconds) in
+each direction.
+*/
+const BANDWIDTH_TIMEOUT = 2*60*time.Second + FETCH_TIMEOUT
+
+// BandwidthResult is the outcome of a bandwidth test, as encoded by the
+// running node (must match proxy.BandwidthResult).
+type BandwidthResult struct {
+	Peer         string    // the host:port of the remote proxy
+	At           time.Time // when the test started
+	Bytes        int64     // the bytes that we tried to transfer in each direction
+	UploadMbps   float64   // the throughput to the peer, as the peer measured it
+	DownloadMbps float64   // the throughput from the peer
+	UploadLoss   float64   // the fraction of the bytes sent that didn't reach the peer
+	DownloadLoss float64   // the fraction of the bytes that the peer sent that didn't reach us
+}
+
+/*
+TestBandwidth() has the node whose UI listens at the given address test the
+bandwidth to the given peer (see proxy.MeasureBandwidth()), transferring the
+given number of bytes in each direction, and prints the result.  Without a
+peer, the node tests the upstream proxy that it uses, and without bytes, it
+transfers its default.
+*/
+func TestBandwidth(uiAddress string, token string, peer string, bytes string) error {
+	form := url.Values{}
+	if peer != "" {
+		form.Set("peer", peer)
+	}
+	if bytes != "" {
+		form.Set("bytes", bytes)
+	}
+	resp, err := request(uiAddress, token, "POST", "/admin/bandwidth", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()), BANDWIDTH_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Unable to test bandwidth: %s %s", resp.Status, body)
+	}
+	var result BandwidthResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		return err
+	}
+	fmt.Printf("Bandwidth to %s, %d bytes each way, at %s:\n", result.Peer, result.Bytes, result.At.Format(time.RFC3339))
+	fmt.Printf("  upload:   %.1f Mbit/s, %.1f%% lost\n", result.UploadMbps, result.UploadLoss*100)
+	fmt.Printf("  download: %.1f Mbit/s, %.1f%% lost\n", result.DownloadMbps, result.DownloadLoss*100)
+	return nil
+}
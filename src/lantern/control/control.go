@@ -0,0 +1,87 @@
+/*
+Package control lets the tool commands (see config/commands.go) talk to the
+node that's already running in the same [config.ConfigDir], through the admin
+endpoints of its UI.  They authenticate with the UI token that the running node
+keeps in TOKEN_FILE (see ui/auth.go).
+
+Since config imports it to run the tool commands before a node starts, this
+package only imports the standard library.
+*/
+package control
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	TOKEN_FILE    = "ui-token"           // the file in [config.ConfigDir] that holds the UI token
+	TOKEN_HEADER  = "X-Lantern-UI-Token" // header in which clients present the UI token
+	FETCH_TIMEOUT = 30 * time.Second     // how long a request to the running node may take
+)
+
+// ReadToken() reads the UI token of the node with the given [config.ConfigDir].
+func ReadToken(configDir string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(configDir, TOKEN_FILE))
+	if err != nil {
+		return "", fmt.Errorf("Unable to read the UI token, has lantern run in %s? %s", configDir, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+/*
+FetchDiagnostics() fetches a diagnostic bundle from the node whose UI listens
+at the given address into the given file (by default
+lantern-diagnostics-<timestamp>.zip in the current directory).
+*/
+func FetchDiagnostics(uiAddress string, token string, file string) error {
+	if file == "" {
+		file = "lantern-diagnostics-" + time.Now().Format("20060102-150405") + ".zip"
+	}
+	resp, err := request(uiAddress, token, "GET", "/admin/diagnostics", "", nil, FETCH_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Unable to get diagnostics: %s", resp.Status)
+	}
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote diagnostics to %s\n", file)
+	return nil
+}
+
+// request() sends a request with the given method, path and body to the node
+// whose UI listens at the given address.
+func request(uiAddress string, token string, method string, path string, contentType string, body io.Reader, timeout time.Duration) (*http.Response, error) {
+	req, err := http.NewRequest(method, "http://"+uiAddress+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set(TOKEN_HEADER, token)
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to reach lantern at %s, is it running? %s", uiAddress, err)
+	}
+	return resp, nil
+}
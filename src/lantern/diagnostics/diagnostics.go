@@ -0,0 +1,149 @@
+/*
+Package diagnostics produces report bundles that users can attach to issues,
+so that problems can be tracked down without going back and forth.
+
+A bundle is a zip file with:
+
+- logs.txt - the most recent log lines (see util.RecentLogs())
+- config.json - our config with secrets and identities redacted (see
+  config.Redacted())
+- certificate.json - the metadata of our certificate
+- peers.json - the health of the remote proxies that we use (see
+  proxy.PeerHealthTable())
+- goroutines.json - the metrics of our supervised goroutines
+- goroutines.txt - the stacks of all goroutines
+- heap.pprof - a heap profile, for go tool pprof
+
+Email addresses are replaced by REDACTED_EMAIL in all of them, since they
+identify users and their friends.  Private keys and session secrets are never
+included.
+
+The running node serves a bundle at http://[config.UIAddress()]/admin/diagnostics,
+from which the diagnostics command fetches it (see config/commands.go and
+package lantern/control).
+*/
+package diagnostics
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"lantern/config"
+	"lantern/keys"
+	"lantern/proxy"
+	"lantern/ui"
+	"lantern/util"
+	"net/http"
+	"regexp"
+	"runtime/pprof"
+	"strings"
+	"time"
+)
+
+const (
+	REDACTED_EMAIL = "[email]" // replaces email addresses in bundles
+)
+
+// emailPattern matches email addresses
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+// CertificateInfo is the metadata of our certificate included in bundles.
+type CertificateInfo struct {
+	State     string    // the state of the certificate (see keys.CertState)
+	Subject   string    // the subject of the certificate
+	Issuer    string    // the issuer of the certificate
+	Serial    string    // the serial number of the certificate
+	NotBefore time.Time // when the certificate became valid
+	NotAfter  time.Time // when the certificate expires
+	Master    bool      // whether the certificate makes us a master
+}
+
+func init() {
+	ui.HandleFunc("/admin/diagnostics", diagnosticsHandler)
+}
+
+// Bundle() writes a diagnostic bundle to out.
+func Bundle(out io.Writer) error {
+	configJson, err := config.Redacted()
+	if err != nil {
+		return err
+	}
+	goroutines := &bytes.Buffer{}
+	if err := pprof.Lookup("goroutine").WriteTo(goroutines, 2); err != nil {
+		return err
+	}
+	heap := &bytes.Buffer{}
+	if err := pprof.Lookup("heap").WriteTo(heap, 0); err != nil {
+		return err
+	}
+	files := []struct {
+		name    string
+		content []byte
+		redact  bool
+	}{
+		{"logs.txt", []byte(strings.Join(util.RecentLogs(), "\n") + "\n"), true},
+		{"config.json", configJson, true},
+		{"certificate.json", marshal(certificateInfo()), true},
+		{"peers.json", marshal(proxy.PeerHealthTable()), true},
+		{"goroutines.json", marshal(util.SupervisorMetrics()), true},
+		{"goroutines.txt", goroutines.Bytes(), true},
+		{"heap.pprof", heap.Bytes(), false},
+	}
+
+	archive := zip.NewWriter(out)
+	for _, file := range files {
+		writer, err := archive.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		content := file.content
+		if file.redact {
+			content = emailPattern.ReplaceAll(content, []byte(REDACTED_EMAIL))
+		}
+		if _, err := writer.Write(content); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// certificateInfo() returns the metadata of our certificate, or nil if we
+// don't have one yet.
+func certificateInfo() *CertificateInfo {
+	cert, _ := keys.Certificate()
+	if cert == nil {
+		return nil
+	}
+	return &CertificateInfo{
+		State:     keys.CertificateState().String(),
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		Serial:    cert.SerialNumber.String(),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		Master:    keys.IsMaster(cert),
+	}
+}
+
+// marshal() encodes v as indented JSON, or the error if that fails.
+func marshal(v interface{}) []byte {
+	data, err := json.MarshalIndent(v, "", "   ")
+	if err != nil {
+		return []byte(err.Error())
+	}
+	return data
+}
+
+// diagnosticsHandler() serves a diagnostic bundle.
+func diagnosticsHandler(resp http.ResponseWriter, req *http.Request) {
+	bundle := &bytes.Buffer{}
+	if err := Bundle(bundle); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+		return
+	}
+	resp.Header().Set("Content-Type", "application/zip")
+	resp.Header().Set("Content-Disposition", `attachment; filename="lantern-diagnostics.zip"`)
+	resp.Write(bundle.Bytes())
+}
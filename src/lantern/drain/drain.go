@@ -0,0 +1,286 @@
+/*
+Package drain takes a master node out of service gracefully, for example before
+maintenance.  Draining, which is started with Start(), goes like this:
+
+1. We stop accepting new children on the signaling channel (see
+   signaling.StopAcceptingChildren()) and new connections to our remote proxy
+   (see proxy.StopAccepting()).
+2. We tell our children to fail over to an alternate parent with a Notice
+   (TYPE_DRAIN) signed by us, which we repeat every NOTICE_INTERVAL for
+   children that missed it.
+3. We wait for the connections that our proxy relays to finish and for our
+   children to leave, but no longer than the deadline.
+4. We exit.
+
+A child only accepts notices that carry a valid signature from its parent (see
+keys.VerifyFromParent()).  It then points config.ParentAddress() at the
+alternate parent and reconnects (see signaling.Reconnect()).  If the notice
+carries the alternate parent's certificate, the child trusts it as its parent's
+from then on (see keys.SwitchParent()), otherwise the alternate parent's
+certificate has to verify against what the child already trusts.  Notices
+aren't passed on, our grandchildren stay with their parents.
+
+Operators drain with a POST to http://[config.UIAddress()]/admin/drain with the
+form values alternate (host:port of the alternate parent), alternatecert (the
+PEM encoded certificate of the alternate parent, optional) and deadline (a
+duration like 10m, DEFAULT_DEADLINE if empty).  GET shows the progress.
+*/
+package drain
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"lantern/config"
+	"lantern/keys"
+	"lantern/proxy"
+	"lantern/signaling"
+	"lantern/ui"
+	"lantern/util"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_DEADLINE = 10 * time.Minute // how long we wait for connections to finish by default
+	NOTICE_INTERVAL  = 30 * time.Second // how often we repeat our notice while draining
+	CHECK_INTERVAL   = 1 * time.Second  // how often we check whether we're done draining
+)
+
+// Notice tells children to fail over to an alternate parent.
+type Notice struct {
+	Alternate string    // host:port of the parent to fail over to
+	Deadline  time.Time // when we're going to exit at the latest
+
+	// AlternateCertificate is the certificate of the alternate parent, signed
+	// by us, if the children should trust it as their parent's
+	AlternateCertificate *keys.ParentCertUpdate `json:",omitempty"`
+}
+
+// signedNotice is a Notice as it travels over the signaling channel.
+type signedNotice struct {
+	Notice    []byte // the JSON encoded Notice
+	Signature []byte // the signature of Notice by the sender's private key
+}
+
+// Status describes the progress of draining.
+type Status struct {
+	Draining    bool      // whether we're draining
+	Alternate   string    `json:",omitempty"` // the parent that we sent our children to
+	Started     time.Time `json:",omitempty"` // when we started draining
+	Deadline    time.Time `json:",omitempty"` // when we're going to exit at the latest
+	Connections int       // connections that our proxy is still relaying
+	Children    int       // children that are still connected
+}
+
+var (
+	started    *Notice    // the notice that we're sending while draining (nil if we're not draining)
+	startedAt  time.Time  // when we started draining
+	drainMutex sync.Mutex // used to synchronize access to started and startedAt
+)
+
+func init() {
+	ui.HandleFunc("/admin/drain", drainHandler)
+	go receive()
+}
+
+/*
+Start() starts draining, sending our children to the given alternate parent
+(host:port) and exiting once we're done or the given deadline has passed.  If
+alternateCert isn't nil, our children trust it as their parent's certificate
+from then on.
+*/
+func Start(alternate string, alternateCert *x509.Certificate, deadline time.Duration) error {
+	if _, _, err := net.SplitHostPort(alternate); err != nil {
+		return fmt.Errorf("Invalid alternate parent %s: %s", alternate, err)
+	}
+	notice := &Notice{Alternate: alternate, Deadline: time.Now().Add(deadline)}
+	if alternateCert != nil {
+		signature, err := keys.Sign(alternateCert.Raw)
+		if err != nil {
+			return fmt.Errorf("Unable to sign alternate parent certificate: %s", err)
+		}
+		notice.AlternateCertificate = &keys.ParentCertUpdate{Certificate: alternateCert.Raw, Signature: signature}
+	}
+
+	drainMutex.Lock()
+	if started != nil {
+		drainMutex.Unlock()
+		return fmt.Errorf("Already draining")
+	}
+	started, startedAt = notice, time.Now()
+	drainMutex.Unlock()
+
+	log.Printf("Draining, sending our children to %s and exiting by %s", alternate, notice.Deadline)
+	signaling.StopAcceptingChildren()
+	proxy.StopAccepting()
+	util.GoLoop("drain", func() { drain(notice) })
+	return nil
+}
+
+// CurrentStatus() returns the progress of draining.
+func CurrentStatus() *Status {
+	drainMutex.Lock()
+	defer drainMutex.Unlock()
+	status := &Status{
+		Draining:    started != nil,
+		Connections: proxy.ConnectionMetrics().Connections,
+		Children:    len(signaling.Children()),
+	}
+	if started != nil {
+		status.Alternate = started.Alternate
+		status.Started = startedAt
+		status.Deadline = started.Deadline
+	}
+	return status
+}
+
+/*
+drain() repeats the given notice to our children until the connections that
+our proxy relays have finished and our children have left, or the deadline of
+the notice has passed, and then exits.
+*/
+func drain(notice *Notice) {
+	lastSent := time.Time{}
+	for {
+		status := CurrentStatus()
+		if status.Connections == 0 && status.Children == 0 {
+			log.Print("Done draining, exiting")
+			os.Exit(0)
+		}
+		if time.Now().After(notice.Deadline) {
+			log.Printf("Deadline for draining passed with %d connections and %d children left, exiting", status.Connections, status.Children)
+			os.Exit(0)
+		}
+		if time.Since(lastSent) > NOTICE_INTERVAL {
+			if err := send(notice); err != nil {
+				log.Printf("Unable to send drain notice: %s", err)
+			}
+			lastSent = time.Now()
+		}
+		time.Sleep(CHECK_INTERVAL)
+	}
+}
+
+// send() signs the given notice and sends it to our children.
+func send(notice *Notice) error {
+	noticeBytes, err := json.Marshal(notice)
+	if err != nil {
+		return err
+	}
+	signature, err := keys.Sign(noticeBytes)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(&signedNotice{Notice: noticeBytes, Signature: signature})
+	if err != nil {
+		return err
+	}
+	signaling.Send(signaling.Message{Type: signaling.TYPE_DRAIN, Data: string(data)})
+	return nil
+}
+
+// receive() listens for drain notices from our parent on the signaling
+// channel.
+func receive() {
+	messages := make(chan signaling.Message)
+	signaling.RecvMatching(messages, signaling.Filter{
+		Types: []signaling.MessageType{signaling.TYPE_DRAIN},
+	})
+	// Restarts keep receiving on the same channel, which stays registered
+	util.Supervise("drain notice receiver", func() error {
+		for msg := range messages {
+			if msg.Type == signaling.TYPE_DRAIN {
+				if err := failOver([]byte(msg.Data)); err != nil {
+					log.Printf("Unable to follow drain notice: %s", err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// failOver() verifies a signed notice from our parent and fails over to the
+// alternate parent that it names.
+func failOver(data []byte) error {
+	signed := &signedNotice{}
+	if err := json.Unmarshal(data, signed); err != nil {
+		return err
+	}
+	if err := keys.VerifyFromParent(signed.Notice, signed.Signature); err != nil {
+		return fmt.Errorf("Signature didn't verify: %s", err)
+	}
+	notice := &Notice{}
+	if err := json.Unmarshal(signed.Notice, notice); err != nil {
+		return err
+	}
+	if _, _, err := net.SplitHostPort(notice.Alternate); err != nil {
+		return fmt.Errorf("Invalid alternate parent %s: %s", notice.Alternate, err)
+	}
+	if notice.Alternate == config.ParentAddress() {
+		// Already failed over, this is a repeat
+		return nil
+	}
+	if notice.AlternateCertificate != nil {
+		if err := keys.SwitchParent(notice.AlternateCertificate); err != nil {
+			return err
+		}
+	}
+	log.Printf("Our parent is draining, failing over to %s", notice.Alternate)
+	config.SetParentAddress(notice.Alternate)
+	signaling.Reconnect()
+	return nil
+}
+
+/*
+drainHandler() shows the progress of draining, and starts draining on POST
+with the form values alternate, alternatecert and deadline.
+*/
+func drainHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		if err := startFromForm(req); err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+	}
+	if statusJson, err := json.MarshalIndent(CurrentStatus(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(statusJson)
+	}
+}
+
+// startFromForm() starts draining as requested by the form values of the given
+// request.
+func startFromForm(req *http.Request) error {
+	if cert, _ := keys.Certificate(); cert == nil || !keys.IsMaster(cert) {
+		return fmt.Errorf("Only masters can drain")
+	}
+	deadline := DEFAULT_DEADLINE
+	if value := req.FormValue("deadline"); value != "" {
+		var err error
+		if deadline, err = time.ParseDuration(value); err != nil {
+			return fmt.Errorf("Invalid deadline: %s", err)
+		}
+	}
+	var alternateCert *x509.Certificate
+	if value := req.FormValue("alternatecert"); value != "" {
+		block, _ := pem.Decode([]byte(value))
+		if block == nil {
+			return fmt.Errorf("Unable to decode alternate parent certificate")
+		}
+		var err error
+		if alternateCert, err = x509.ParseCertificate(block.Bytes); err != nil {
+			return fmt.Errorf("Invalid alternate parent certificate: %s", err)
+		}
+	}
+	return Start(req.FormValue("alternate"), alternateCert, deadline)
+}
@@ -0,0 +1,289 @@
+/*
+Package features provides a registry of feature flags that act as kill
+switches for risky functionality.
+
+Modules register their flags with Register() and consult Flag.Enabled() at
+their decision points.  Whether a flag is enabled is determined from the
+following sources, in order of precedence:
+
+1. runtime overrides set through the management API at
+   http://[config.UIAddress()]/admin/features
+2. the local operator's config (config.FeatureFlags()), which is re-evaluated
+   whenever it changes
+3. the signed policy pushed down by our parent over the signaling channel
+   (TYPE_FEATURE_POLICY)
+4. the default supplied to Register()
+
+Modules that need to react to a flag being toggled without a restart can
+Watch() it.
+*/
+package features
+
+import (
+	"encoding/json"
+	"fmt"
+	"lantern/config"
+	"lantern/keys"
+	"lantern/signaling"
+	"lantern/ui"
+	"lantern/util"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Flag is a single feature flag.
+type Flag struct {
+	Name        string // the name of the feature
+	Description string // human readable description of the feature
+	Default     bool   // whether the feature is enabled if nobody says otherwise
+	enabled     bool   // the currently effective state
+	watchers    []chan bool
+}
+
+// signedPolicy is a feature policy as it travels over the signaling channel.
+type signedPolicy struct {
+	Policy    []byte // the JSON encoded map of feature name to enabled
+	Signature []byte // the signature of Policy by the sender's private key
+}
+
+var (
+	flags      = make(map[string]*Flag) // registered flags by name
+	overrides  = make(map[string]bool)  // runtime overrides from the management API
+	policy     = make(map[string]bool)  // the policy pushed down by our parent
+	flagsMutex sync.RWMutex             // used to synchronize access to all of the above
+)
+
+func init() {
+	ui.HandleFunc("/admin/features", featuresHandler)
+	go receive()
+	changes := make(chan bool, 1)
+	config.WatchFeatureFlags(changes)
+	util.GoLoop("feature flag reloader", func() {
+		// Re-evaluate when the local operator's config changes
+		for range changes {
+			Reload()
+		}
+	})
+}
+
+/*
+Register() registers a feature flag with the given name, default and
+description, returning the Flag.  Registering the same name twice returns the
+existing Flag.
+*/
+func Register(name string, defaultValue bool, description string) *Flag {
+	flagsMutex.Lock()
+	defer flagsMutex.Unlock()
+	if flag, found := flags[name]; found {
+		return flag
+	}
+	flag := &Flag{Name: name, Description: description, Default: defaultValue}
+	flag.enabled = flag.evaluate()
+	flags[name] = flag
+	return flag
+}
+
+// Enabled() indicates whether or not the feature is currently enabled.
+func (flag *Flag) Enabled() bool {
+	flagsMutex.RLock()
+	defer flagsMutex.RUnlock()
+	return flag.enabled
+}
+
+/*
+Watch() registers a channel that receives the new state of the flag whenever
+it changes.  Notifications are dropped if the channel isn't ready to receive.
+*/
+func (flag *Flag) Watch(watcher chan bool) {
+	flagsMutex.Lock()
+	defer flagsMutex.Unlock()
+	flag.watchers = append(flag.watchers, watcher)
+}
+
+/*
+Override() sets a runtime override for the named feature, which takes
+precedence over everything else until the process exits or the override is
+cleared with ClearOverride().
+*/
+func Override(name string, enabled bool) {
+	flagsMutex.Lock()
+	defer flagsMutex.Unlock()
+	overrides[name] = enabled
+	reevaluate()
+}
+
+// ClearOverride() clears any runtime override for the named feature.
+func ClearOverride(name string) {
+	flagsMutex.Lock()
+	defer flagsMutex.Unlock()
+	delete(overrides, name)
+	reevaluate()
+}
+
+/*
+Lookup() returns the registered flag with the given name, or nil if there is
+none.
+*/
+func Lookup(name string) *Flag {
+	flagsMutex.RLock()
+	defer flagsMutex.RUnlock()
+	return flags[name]
+}
+
+/*
+SetLocal() sets the local operator's choice for the named feature in the config
+(see config.FeatureFlags()), which persists across restarts but doesn't win
+over a runtime override.
+*/
+func SetLocal(name string, enabled bool) {
+	featureFlags := config.FeatureFlags()
+	featureFlags[name] = enabled
+	config.SetFeatureFlags(featureFlags)
+	Reload()
+}
+
+/*
+Reload() re-evaluates all flags, for example after the local operator's
+config has changed.
+*/
+func Reload() {
+	flagsMutex.Lock()
+	defer flagsMutex.Unlock()
+	reevaluate()
+}
+
+// PublishPolicy() signs the given policy and pushes it down to our children.
+func PublishPolicy(newPolicy map[string]bool) error {
+	policyBytes, err := json.Marshal(newPolicy)
+	if err != nil {
+		return err
+	}
+	signature, err := keys.Sign(policyBytes)
+	if err != nil {
+		return fmt.Errorf("Unable to sign feature policy: %s", err)
+	}
+	data, err := json.Marshal(&signedPolicy{Policy: policyBytes, Signature: signature})
+	if err != nil {
+		return err
+	}
+	signaling.Send(signaling.Message{
+		Type: signaling.TYPE_FEATURE_POLICY,
+		Data: string(data),
+	})
+	return nil
+}
+
+// evaluate() determines whether the flag should be enabled.  flagsMutex must be
+// held.
+func (flag *Flag) evaluate() bool {
+	if enabled, found := overrides[flag.Name]; found {
+		return enabled
+	}
+	if enabled, found := config.FeatureFlags()[flag.Name]; found {
+		return enabled
+	}
+	if enabled, found := policy[flag.Name]; found {
+		return enabled
+	}
+	return flag.Default
+}
+
+// reevaluate() re-evaluates all flags and notifies watchers of any changes.
+// flagsMutex must be held.
+func reevaluate() {
+	for _, flag := range flags {
+		enabled := flag.evaluate()
+		if enabled == flag.enabled {
+			continue
+		}
+		flag.enabled = enabled
+		log.Printf("Feature %s is now enabled: %t", flag.Name, enabled)
+		for _, watcher := range flag.watchers {
+			select {
+			case watcher <- enabled:
+			default:
+			}
+		}
+	}
+}
+
+// receive() listens for feature policies on the signaling channel.
+func receive() {
+	messages := make(chan signaling.Message)
+	signaling.RecvMatching(messages, signaling.Filter{
+		Types: []signaling.MessageType{signaling.TYPE_FEATURE_POLICY},
+	})
+	// Restarts keep receiving on the same channel, which stays registered
+	util.Supervise("features receiver", func() error {
+		for msg := range messages {
+			if msg.Type == signaling.TYPE_FEATURE_POLICY {
+				if err := applyPolicy(msg.Data); err != nil {
+					log.Printf("Unable to apply feature policy: %s", err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// applyPolicy() verifies a signed policy from our parent and applies it.
+func applyPolicy(data string) error {
+	signed := &signedPolicy{}
+	if err := json.Unmarshal([]byte(data), signed); err != nil {
+		return err
+	}
+	if err := keys.VerifyFromParent(signed.Policy, signed.Signature); err != nil {
+		return fmt.Errorf("Signature didn't verify: %s", err)
+	}
+	newPolicy := make(map[string]bool)
+	if err := json.Unmarshal(signed.Policy, &newPolicy); err != nil {
+		return err
+	}
+
+	flagsMutex.Lock()
+	defer flagsMutex.Unlock()
+	policy = newPolicy
+	reevaluate()
+	return nil
+}
+
+/*
+featuresHandler() implements the management API.  GET lists all registered
+flags and their state, POST with the form values name and enabled sets a
+runtime override (leaving enabled blank clears the override).
+*/
+func featuresHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		name := req.FormValue("name")
+		if name == "" {
+			resp.WriteHeader(400)
+			resp.Write([]byte("Missing name"))
+			return
+		}
+		if enabledString := req.FormValue("enabled"); enabledString == "" {
+			ClearOverride(name)
+		} else if enabled, err := strconv.ParseBool(enabledString); err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf("Invalid value for enabled: %s", enabledString)))
+			return
+		} else {
+			Override(name, enabled)
+		}
+	}
+
+	flagsMutex.RLock()
+	state := make(map[string]bool)
+	for name, flag := range flags {
+		state[name] = flag.enabled
+	}
+	flagsMutex.RUnlock()
+	if stateJson, err := json.MarshalIndent(state, "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(stateJson)
+	}
+}
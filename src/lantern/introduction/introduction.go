@@ -0,0 +1,367 @@
+/*
+Package introduction lets a node ask a master to introduce it to a give-mode
+peer without revealing who is asking until the give-mode peer has consented.
+
+The flow is:
+
+1. The requester sends a TYPE_INTRO_REQUEST to its master, naming the
+   give-mode peer (Target) along with its own pseudonym and connection
+   candidates.
+2. The master holds on to the request and sends the give-mode peer a
+   TYPE_INTRO_OFFER that contains only an anonymized trust summary: which
+   master certified the requester and the requester's reputation class.
+   Only masters handle requests, and only from requesters with an identity.
+3. The give-mode peer accepts or rejects the offer with a TYPE_INTRO_RESPONSE.
+   Offers wait for the user at http://[config.UIAddress()]/introductions.
+4. Only if the offer was accepted does the master send TYPE_INTRO_REVEAL
+   messages to both sides, revealing the requester's pseudonym and candidates
+   to the give-mode peer and the give-mode peer's candidates to the requester.
+
+Offers from friends (config.Friends()) are accepted automatically without
+telling the give-mode peer who's asking.  Since the give-mode peer could guess
+the email behind any hint that it can check itself, the master does the check:
+the give-mode peer answers every offer right away with a conditional
+TYPE_INTRO_RESPONSE that carries the FriendHints of its friends (the SHA-256 of
+the offer's ID and the friend's email), and the master accepts on its behalf
+if the requester's hint is among them.  Otherwise, the master keeps waiting for
+the user's response.  The give-mode peer learns nothing about requesters,
+friends or not, until the reveal.
+*/
+package introduction
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"lantern/config"
+	"lantern/keys"
+	"lantern/signaling"
+	"lantern/ui"
+	"lantern/util"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// REPUTATION_UNKNOWN is the reputation class of requesters about whom we
+// know nothing.
+const REPUTATION_UNKNOWN = "unknown"
+
+// Request is the payload of TYPE_INTRO_REQUEST.
+type Request struct {
+	Target     string   // email of the give-mode peer to be introduced to
+	Pseudonym  string   // pseudonym under which the requester wants to be known
+	Candidates []string // host:port candidates at which the requester can be reached
+}
+
+// Offer is the payload of TYPE_INTRO_OFFER.
+type Offer struct {
+	ID              string // id of the introduction
+	CertifiedBy     string // the NodeID of the master that vouches for the requester (see keys.NodeID())
+	ReputationClass string // the reputation class of the requester
+}
+
+// Response is the payload of TYPE_INTRO_RESPONSE.
+type Response struct {
+	ID          string   // id of the introduction
+	Accepted    bool     // whether the give-mode peer accepted
+	Candidates  []string // host:port candidates of the give-mode peer, if accepted (or conditional)
+	Conditional bool     // accept only if the requester is among FriendHints, otherwise wait for another response
+	FriendHints []string // hints of the give-mode peer's friends (see friendHint()), if conditional
+}
+
+// Reveal is the payload of TYPE_INTRO_REVEAL.
+type Reveal struct {
+	ID         string   // id of the introduction
+	Accepted   bool     // whether the introduction was accepted
+	Pseudonym  string   // pseudonym of the other side (blank for the requester)
+	Candidates []string // host:port candidates of the other side
+}
+
+// held is an introduction request that a master is holding until the target
+// responds.
+type held struct {
+	requester string
+	request   Request
+}
+
+var (
+	heldRequests  = make(map[string]*held)  // requests held by us as master, by id
+	pendingOffers = make(map[string]*Offer) // offers waiting for the user, by id
+	introMutex    sync.Mutex                // used to synchronize access to the above
+
+	// Reveals receives the introductions that were accepted (or rejected) on
+	// our behalf.
+	Reveals = make(chan Reveal, 10)
+)
+
+func init() {
+	ui.HandleFunc("/introductions", introductionsHandler)
+	go receive()
+}
+
+// Ask() asks our master to introduce us to the given give-mode peer.
+func Ask(target string, pseudonym string, candidates []string) error {
+	data, err := json.Marshal(&Request{Target: target, Pseudonym: pseudonym, Candidates: candidates})
+	if err != nil {
+		return err
+	}
+	signaling.Send(signaling.Message{Type: signaling.TYPE_INTRO_REQUEST, Data: string(data)})
+	return nil
+}
+
+// PendingOffers() returns the offers that are waiting for the user to accept or
+// reject them.
+func PendingOffers() []Offer {
+	introMutex.Lock()
+	defer introMutex.Unlock()
+	offers := make([]Offer, 0, len(pendingOffers))
+	for _, offer := range pendingOffers {
+		offers = append(offers, *offer)
+	}
+	return offers
+}
+
+// Respond() accepts or rejects the pending offer with the given id, offering
+// the given candidates if accepted.
+func Respond(id string, accepted bool, candidates []string) error {
+	introMutex.Lock()
+	_, found := pendingOffers[id]
+	delete(pendingOffers, id)
+	introMutex.Unlock()
+	if !found {
+		return fmt.Errorf("No pending offer with id %s", id)
+	}
+	return respond(id, accepted, candidates)
+}
+
+func respond(id string, accepted bool, candidates []string) error {
+	response := &Response{ID: id, Accepted: accepted}
+	if accepted {
+		response.Candidates = candidates
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	signaling.Send(signaling.Message{Type: signaling.TYPE_INTRO_RESPONSE, Data: string(data)})
+	return nil
+}
+
+// respondToFriends() has the master accept the offer with the given id on our
+// behalf if it's from one of our friends.
+func respondToFriends(id string, friends []string) error {
+	hints := make([]string, 0, len(friends))
+	for _, friend := range friends {
+		hints = append(hints, friendHint(id, friend))
+	}
+	data, err := json.Marshal(&Response{
+		ID:          id,
+		Candidates:  config.AdvertisedRemoteProxyAddresses(),
+		Conditional: true,
+		FriendHints: hints,
+	})
+	if err != nil {
+		return err
+	}
+	signaling.Send(signaling.Message{Type: signaling.TYPE_INTRO_RESPONSE, Data: string(data)})
+	return nil
+}
+
+// friendHint() computes the hint that lets the master recognize friends.
+func friendHint(id string, email string) string {
+	hash := sha256.Sum256([]byte(id + "\n" + email))
+	return hex.EncodeToString(hash[:])
+}
+
+// isFriend() checks whether the given requester is among the friends of a
+// conditional response.
+func isFriend(response *Response, requester string) bool {
+	hint := friendHint(response.ID, requester)
+	for _, friendHint := range response.FriendHints {
+		if friendHint == hint {
+			return true
+		}
+	}
+	return false
+}
+
+// isMaster() indicates whether we are a master, which introduces nodes.
+func isMaster() bool {
+	cert, _ := keys.Certificate()
+	return cert != nil && keys.IsMaster(cert)
+}
+
+// receive() listens for introduction messages on the signaling channel.
+func receive() {
+	messages := make(chan signaling.Message)
+	signaling.RecvMatching(messages, signaling.Filter{
+		Types: []signaling.MessageType{signaling.TYPE_INTRO_REQUEST, signaling.TYPE_INTRO_OFFER, signaling.TYPE_INTRO_RESPONSE, signaling.TYPE_INTRO_REVEAL},
+	})
+	// Restarts keep receiving on the same channel, which stays registered
+	util.Supervise("introduction receiver", func() error {
+		for msg := range messages {
+			var err error
+			switch msg.Type {
+			case signaling.TYPE_INTRO_REQUEST:
+				err = handleRequest(msg)
+			case signaling.TYPE_INTRO_OFFER:
+				err = handleOffer(msg)
+			case signaling.TYPE_INTRO_RESPONSE:
+				err = handleResponse(msg)
+			case signaling.TYPE_INTRO_REVEAL:
+				err = handleReveal(msg)
+			}
+			if err != nil {
+				log.Printf("Unable to handle introduction message: %s", err)
+			}
+		}
+		return nil
+	})
+}
+
+// handleRequest() holds a request (as master) and sends an anonymized offer to
+// the target.
+func handleRequest(msg signaling.Message) error {
+	if !isMaster() {
+		return fmt.Errorf("Not a master, ignoring introduction request from %s", msg.Sender)
+	}
+	if msg.Sender == "" || msg.Sender == signaling.MASTER_SENDER {
+		return fmt.Errorf("Introduction request from a node without an identity")
+	}
+	request := Request{}
+	if err := json.Unmarshal([]byte(msg.Data), &request); err != nil {
+		return err
+	}
+	id := msg.ID
+	introMutex.Lock()
+	heldRequests[id] = &held{requester: msg.Sender, request: request}
+	introMutex.Unlock()
+
+	data, err := json.Marshal(&Offer{
+		ID:              id,
+		CertifiedBy:     keys.NodeID(),
+		ReputationClass: REPUTATION_UNKNOWN,
+	})
+	if err != nil {
+		return err
+	}
+	signaling.Send(signaling.Message{Recp: request.Target, Type: signaling.TYPE_INTRO_OFFER, Data: string(data)})
+	return nil
+}
+
+// handleOffer() queues an offer for the user, and has the master accept it
+// right away if it's from one of our friends.
+func handleOffer(msg signaling.Message) error {
+	offer := &Offer{}
+	if err := json.Unmarshal([]byte(msg.Data), offer); err != nil {
+		return err
+	}
+	introMutex.Lock()
+	pendingOffers[offer.ID] = offer
+	introMutex.Unlock()
+	if friends := config.Friends(); len(friends) > 0 {
+		return respondToFriends(offer.ID, friends)
+	}
+	return nil
+}
+
+// handleResponse() reveals both sides to each other (as master) if the target
+// accepted, or just tells the requester that it was rejected.
+func handleResponse(msg signaling.Message) error {
+	if !isMaster() {
+		return fmt.Errorf("Not a master, ignoring introduction response from %s", msg.Sender)
+	}
+	response := Response{}
+	if err := json.Unmarshal([]byte(msg.Data), &response); err != nil {
+		return err
+	}
+	introMutex.Lock()
+	h, found := heldRequests[response.ID]
+	introMutex.Unlock()
+	if !found {
+		return fmt.Errorf("No held request with id %s", response.ID)
+	}
+	if msg.Sender != h.request.Target {
+		return fmt.Errorf("Response for %s came from %s", h.request.Target, msg.Sender)
+	}
+	if response.Conditional {
+		if !isFriend(&response, h.requester) {
+			// Keep waiting for the user's response
+			return nil
+		}
+		log.Printf("Automatically accepting introduction %s for a friend of %s", response.ID, h.request.Target)
+		response.Accepted = true
+	}
+	introMutex.Lock()
+	_, found = heldRequests[response.ID]
+	delete(heldRequests, response.ID)
+	introMutex.Unlock()
+	if !found {
+		return fmt.Errorf("Introduction %s was answered already", response.ID)
+	}
+
+	toRequester := &Reveal{ID: response.ID, Accepted: response.Accepted}
+	if response.Accepted {
+		toRequester.Candidates = response.Candidates
+		if err := sendReveal(h.request.Target, &Reveal{
+			ID:         response.ID,
+			Accepted:   true,
+			Pseudonym:  h.request.Pseudonym,
+			Candidates: h.request.Candidates,
+		}); err != nil {
+			return err
+		}
+	}
+	return sendReveal(h.requester, toRequester)
+}
+
+func sendReveal(recp string, reveal *Reveal) error {
+	data, err := json.Marshal(reveal)
+	if err != nil {
+		return err
+	}
+	signaling.Send(signaling.Message{Recp: recp, Type: signaling.TYPE_INTRO_REVEAL, Data: string(data)})
+	return nil
+}
+
+// handleReveal() hands a reveal to whoever is listening on Reveals.  An offer
+// that the master accepted on our behalf doesn't wait for the user anymore.
+func handleReveal(msg signaling.Message) error {
+	reveal := Reveal{}
+	if err := json.Unmarshal([]byte(msg.Data), &reveal); err != nil {
+		return err
+	}
+	introMutex.Lock()
+	delete(pendingOffers, reveal.ID)
+	introMutex.Unlock()
+	select {
+	case Reveals <- reveal:
+	default:
+		log.Printf("Dropping introduction reveal %s, nobody is listening", reveal.ID)
+	}
+	return nil
+}
+
+/*
+introductionsHandler() lists pending offers on GET and accepts or rejects one
+on POST with the form values id and accept.
+*/
+func introductionsHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		accepted := req.FormValue("accept") == "true"
+		if err := Respond(req.FormValue("id"), accepted, config.AdvertisedRemoteProxyAddresses()); err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+	}
+	if offersJson, err := json.MarshalIndent(PendingOffers(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(offersJson)
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Package issuance lets children obtain their certificate over the signaling
+channel, as an alternative to POSTing to the parent's /mycert endpoint (see
+package lantern/keys).  This helps children behind restrictive networks that
+can't reach their parent's web port directly but can reach it through whatever
+signaling transport works.
+
+If a child couldn't get its certificate over HTTPS, it sends a
+TYPE_CERT_REQUEST to its parent carrying a keys.CertRequest.  The parent
+authenticates the request just like an HTTPS request (see
+keys.IssueCertificate()) and answers with a TYPE_CERT_RESPONSE (see
+signaling.Call() and signaling.Reply()), which carries either the certificate
+or the reason why it wasn't issued.  Requests that go unanswered for
+CERT_REQUEST_TIMEOUT are retried after CERT_REQUEST_RETRY.
+
+Parents also push their own certificate down whenever they renew it, so that
+children keep trusting them (see keys.ParentCertUpdate).
+
+Certificates and CSRs are only a couple of KB, well below
+signaling.MAX_DATA_LENGTH, so requests and responses always fit in a single
+message.
+*/
+package issuance
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"lantern/config"
+	"lantern/keys"
+	"lantern/signaling"
+	"lantern/util"
+	"log"
+	"time"
+)
+
+const (
+	CERT_REQUEST_TIMEOUT = 2 * time.Minute // how long we wait for a response to a certificate request
+	CERT_REQUEST_RETRY   = 1 * time.Minute // how long we wait before retrying a failed certificate request
+)
+
+// Response is the payload of TYPE_CERT_RESPONSE.
+type Response struct {
+	Certificate []byte   // DER bytes of the issued certificate
+	Chain       [][]byte // DER bytes of the chain of the issued certificate (see keys.IssuerChain())
+	Error       string   // why the certificate wasn't issued, if it wasn't
+}
+
+func init() {
+	go receive()
+	if config.CanIssueCerts() && config.Runs(config.SUBSYSTEM_CERT_ISSUANCE) {
+		util.GoLoop("parent certificate publisher", publishParentCert)
+	}
+	if !config.IsRootNode() && !config.IsRelay() {
+		if cert, certChannel := keys.Certificate(); cert == nil {
+			go requestCertificate(certChannel)
+		}
+	}
+}
+
+/*
+requestCertificate(), meant to be run as a goroutine, keeps requesting a
+certificate over the signaling channel until we have one, whether through the
+signaling channel or otherwise.
+*/
+func requestCertificate(certChannel chan *x509.Certificate) {
+	csrBytes, err := keys.CertificateRequest()
+	if err != nil {
+		log.Printf("Unable to create certificate signing request: %s", err)
+		return
+	}
+	for {
+		done := make(chan error, 1)
+		go func() {
+			done <- request(keys.NewCertRequest(csrBytes))
+		}()
+		select {
+		case <-certChannel:
+			return
+		case err := <-done:
+			if err == nil {
+				log.Print("Obtained certificate over the signaling channel")
+				return
+			}
+			log.Printf("Unable to obtain certificate over the signaling channel, will retry in %s: %s", CERT_REQUEST_RETRY, err)
+		}
+		select {
+		case <-certChannel:
+			return
+		case <-time.After(CERT_REQUEST_RETRY):
+		}
+	}
+}
+
+// request() sends the given certificate request to our parent and installs
+// the certificate that comes back.
+func request(certRequest *keys.CertRequest) error {
+	data, err := json.Marshal(certRequest)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), CERT_REQUEST_TIMEOUT)
+	defer cancel()
+	msg, err := signaling.Call(ctx, signaling.Message{Type: signaling.TYPE_CERT_REQUEST, Data: string(data)})
+	if err != nil {
+		return fmt.Errorf("No response: %s", err)
+	}
+	response := &Response{}
+	if err := json.Unmarshal([]byte(msg.Data), response); err != nil {
+		return fmt.Errorf("Unable to decode certificate response: %s", err)
+	}
+	if response.Error != "" {
+		return fmt.Errorf("Parent refused to issue certificate: %s", response.Error)
+	}
+	return keys.InstallCertificate(response.Certificate, response.Chain)
+}
+
+// receive() issues certificates for requests from our children and installs
+// parent certificate updates.
+func receive() {
+	messages := make(chan signaling.Message)
+	signaling.RecvMatching(messages, signaling.Filter{
+		Types: []signaling.MessageType{signaling.TYPE_CERT_REQUEST, signaling.TYPE_PARENT_CERT},
+	})
+	// Restarts keep receiving on the same channel, which stays registered
+	util.Supervise("issuance receiver", func() error {
+		for msg := range messages {
+			switch msg.Type {
+			case signaling.TYPE_CERT_REQUEST:
+				if err := issue(msg); err != nil {
+					log.Printf("Unable to respond to certificate request: %s", err)
+				}
+			case signaling.TYPE_PARENT_CERT:
+				if !config.IsRootNode() {
+					installParentCert(msg)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// issue() issues a certificate (as parent) for the given request message.
+func issue(msg signaling.Message) error {
+	response := &Response{}
+	certRequest := &keys.CertRequest{}
+	if err := json.Unmarshal([]byte(msg.Data), certRequest); err != nil {
+		response.Error = fmt.Sprintf("Unable to decode certificate request: %s", err)
+	} else if certBytes, err := keys.IssueCertificate(certRequest); err != nil {
+		response.Error = err.Error()
+	} else {
+		response.Certificate = certBytes
+		response.Chain = keys.IssuerChain()
+	}
+	if response.Error != "" {
+		log.Print(response.Error)
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	return signaling.Reply(msg, string(data))
+}
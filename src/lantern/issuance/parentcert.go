@@ -0,0 +1,67 @@
+package issuance
+
+import (
+	"bytes"
+	"encoding/json"
+	"lantern/keys"
+	"lantern/signaling"
+	"log"
+	"time"
+)
+
+const (
+	PARENT_CERT_CHECK_INTERVAL   = 1 * time.Minute // how often we check whether our certificate changed
+	PARENT_CERT_PUBLISH_INTERVAL = 6 * time.Hour   // how often we republish it for children that were offline
+)
+
+/*
+publishParentCert(), meant to be run as a goroutine by nodes that issue
+certificates, pushes our certificate down to our children as a
+keys.ParentCertUpdate (TYPE_PARENT_CERT) whenever it changes, and periodically
+in between for children that missed it.
+*/
+func publishParentCert() {
+	if cert, certChannel := keys.Certificate(); cert == nil {
+		// wait for cert
+		<-certChannel
+	}
+	var published []byte
+	lastPublished := time.Time{}
+	for {
+		cert, _ := keys.Certificate()
+		if !bytes.Equal(cert.Raw, published) || time.Since(lastPublished) > PARENT_CERT_PUBLISH_INTERVAL {
+			if err := sendParentCert(); err != nil {
+				log.Printf("Unable to publish parent certificate: %s", err)
+			} else {
+				published = cert.Raw
+				lastPublished = time.Now()
+			}
+		}
+		time.Sleep(PARENT_CERT_CHECK_INTERVAL)
+	}
+}
+
+// sendParentCert() sends our current certificate to our children.
+func sendParentCert() error {
+	update, err := keys.NewParentCertUpdate()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	signaling.Send(signaling.Message{Type: signaling.TYPE_PARENT_CERT, Data: string(data)})
+	return nil
+}
+
+// installParentCert() installs the parent certificate update in the given
+// message from our parent.
+func installParentCert(msg signaling.Message) {
+	update := &keys.ParentCertUpdate{}
+	if err := json.Unmarshal([]byte(msg.Data), update); err != nil {
+		log.Printf("Unable to decode parent certificate update: %s", err)
+	} else if err := keys.InstallParentCert(update); err != nil {
+		log.Printf("Unable to install parent certificate update: %s", err)
+	}
+}
@@ -0,0 +1,365 @@
+package keys
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"lantern/audit"
+	"lantern/config"
+	"lantern/persona"
+	"log"
+	"math/big"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+A CertAuthority issues certificates to our children, however their requests
+reach us (see serveCerts() and package lantern/issuance).  Authority is the
+CertAuthority in use, which signs with our own key and certificate.  Only nodes
+that issue certificates (see config.CanIssueCerts()) need it, and tests can
+replace it with a mock.
+*/
+type CertAuthority interface {
+	// IssueCertificate() authenticates the given certificate request and, if
+	// successful, issues a certificate for it, returning the DER bytes of the
+	// certificate.  Failures are reported as IssueErrors.
+	IssueCertificate(certRequest *CertRequest) ([]byte, error)
+
+	// ReissueCertificate() renews the given certificate that we issued earlier
+	// for the given CSR.  Renewed certificates keep the lifetime and role of
+	// the original.
+	ReissueCertificate(peerCert *x509.Certificate, csrBytes []byte) ([]byte, error)
+
+	// Enroll() handles an enrollment request with the given pairing code and
+	// CSR from the given source IP (see enrollment.go), returning the
+	// master-level certificate once our operator has approved it and an
+	// IssueError with STATUS_PENDING until then.
+	Enroll(code string, csrBytes []byte, source string) ([]byte, error)
+}
+
+// localAuthority is the CertAuthority that issues certificates signed by our
+// own key.
+type localAuthority struct{}
+
+// Authority is the CertAuthority that issues certificates to our children.
+var Authority CertAuthority = &localAuthority{}
+
+// IssueCertificate() issues a certificate for the given request using
+// Authority.
+func IssueCertificate(certRequest *CertRequest) ([]byte, error) {
+	return Authority.IssueCertificate(certRequest)
+}
+
+func (ca *localAuthority) IssueCertificate(certRequest *CertRequest) ([]byte, error) {
+	if !config.CanIssueCerts() {
+		return nil, &IssueError{404, "Not configured to issue certificates"}
+	}
+	validity := TWO_WEEKS
+	if certRequest.Ephemeral {
+		validity = EPHEMERAL_CERT_VALIDITY
+	}
+
+	email, held, err := releaseHeldDevice(certRequest.CSR)
+	if err != nil {
+		return nil, err
+	}
+	provisioned := false
+	if held {
+		// Held devices authenticated before they were held (see ledger.go),
+		// and the CSR proves that it's still them
+	} else if certRequest.ProvisioningToken != "" {
+		if !validProvisioningToken(certRequest.ProvisioningToken) {
+			return nil, &IssueError{403, "Invalid provisioning token"}
+		}
+		// Provisioned nodes aren't tied to an email address and are always
+		// treated as ephemeral
+		validity = EPHEMERAL_CERT_VALIDITY
+		email = provisionedIdentity(certRequest.ProvisioningToken)
+		provisioned = true
+	} else if certRequest.InviteToken != "" {
+		if email, err = redeemInvite(certRequest.InviteToken, certRequest.CSR); err != nil {
+			return nil, err
+		}
+	} else if certRequest.Assertion == "" {
+		return nil, &IssueError{400, "Request didn't include an identity assertion"}
+	} else if certRequest.Audience == "" {
+		return nil, &IssueError{400, "Request didn't include an audience"}
+	} else if pr, err := persona.ValidateAssertion(certRequest.Assertion, certRequest.Audience); err != nil {
+		return nil, &IssueError{400, "Identity failed to validate with Mozilla"}
+	} else {
+		email = pr.Email
+	}
+
+	if len(certRequest.CSR) == 0 {
+		return nil, &IssueError{400, "Request didn't include a CSR"}
+	}
+	if email != "" && !held && !provisioned {
+		if err := admitDevice(email, certRequest.CSR); err != nil {
+			return nil, err
+		}
+	}
+	certBytes, err := certificateForCSR(email, certRequest.CSR, validity, false)
+	if err != nil {
+		return nil, &IssueError{400, fmt.Sprintf("Unable to generate certificate: %s", err)}
+	}
+	atomic.AddInt64(&issuedCertificates, 1)
+	auditIssuance(email, certBytes, nil)
+	if email != "" && !provisioned {
+		recordIssuance(email, certBytes, nil)
+	}
+	return certBytes, nil
+}
+
+func (ca *localAuthority) ReissueCertificate(peerCert *x509.Certificate, csrBytes []byte) ([]byte, error) {
+	if !config.CanIssueCerts() {
+		return nil, &IssueError{404, "Not configured to issue certificates"}
+	}
+	if err := checkRenewable(peerCert); err != nil {
+		return nil, &IssueError{403, fmt.Sprintf("Unable to renew certificate: %s", err)}
+	}
+	email, err := Identity(peerCert)
+	if err != nil {
+		return nil, &IssueError{403, fmt.Sprintf("Unable to decrypt email: %s", err)}
+	}
+	validity := peerCert.NotAfter.Sub(peerCert.NotBefore) - backdatingOf(peerCert)
+	certBytes, err := certificateForCSR(email, csrBytes, validity, IsMaster(peerCert))
+	if err != nil {
+		return nil, &IssueError{400, fmt.Sprintf("Unable to generate certificate: %s", err)}
+	}
+	if err := retireRenewed(peerCert, certBytes); err != nil {
+		return nil, &IssueError{500, fmt.Sprintf("Unable to revoke renewed certificate: %s", err)}
+	}
+	atomic.AddInt64(&issuedCertificates, 1)
+	auditIssuance(email, certBytes, peerCert)
+	if email != "" && !strings.HasPrefix(email, PROVISIONED_PREFIX) {
+		recordIssuance(email, certBytes, peerCert)
+	}
+	return certBytes, nil
+}
+
+/*
+retireRenewed() revokes the given certificate, which we renewed with the given
+one, if the renewal is for another key (see Rotate()).  That way, every device
+holds a single valid certificate, and renewing can't mint certificates for more
+devices than config.EnrollmentPolicy() allows.  Renewals for the same key are
+for the same device, so the old certificate is left to expire.
+*/
+func retireRenewed(renewed *x509.Certificate, certBytes []byte) error {
+	cert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return err
+	}
+	if NodeIDOf(cert) == NodeIDOf(renewed) {
+		return nil
+	}
+	return Revoke(renewed.SerialNumber.String())
+}
+
+/*
+auditIssuance() records in the audit log that we issued the given certificate
+for the given email (empty for provisioned nodes), renewing the given
+certificate unless that's nil.
+*/
+func auditIssuance(email string, certBytes []byte, renewed *x509.Certificate) {
+	cert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return
+	}
+	holder := email
+	if holder == "" {
+		holder = "a provisioned node"
+	}
+	details := fmt.Sprintf("for %s (node %s), valid until %s", holder, NodeIDOf(cert), cert.NotAfter.Format(time.RFC3339))
+	if renewed != nil {
+		details += ", renewing " + renewed.SerialNumber.String()
+	}
+	audit.Record(audit.EVENT_CERT_ISSUED, cert.SerialNumber.String(), details)
+}
+
+// checkRenewable() checks that we issued the given certificate, that it's
+// still valid and that we didn't revoke it.
+func checkRenewable(peerCert *x509.Certificate) error {
+	if err := issuedByUs(peerCert); err != nil {
+		return fmt.Errorf("Client certificate wasn't issued by us: %s", err)
+	}
+	if time.Now().After(peerCert.NotAfter) {
+		return fmt.Errorf("Client certificate has expired")
+	}
+	if isRevoked(peerCert.SerialNumber.String()) {
+		return fmt.Errorf("Client certificate %s was revoked", peerCert.SerialNumber)
+	}
+	return nil
+}
+
+/*
+provisionedIdentity() returns the identity of the nodes that were provisioned
+with the given token: PROVISIONED_PREFIX followed by the start of the token's
+SHA-256 hash.  That way, the nodes of each token can be told apart (and
+blocked) without revealing the token, and they never pass for a user.
+*/
+func provisionedIdentity(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return PROVISIONED_PREFIX + hex.EncodeToString(hash[:8])
+}
+
+// validProvisioningToken() checks whether the given token is one of our
+// configured provisioning tokens.
+func validProvisioningToken(token string) bool {
+	for _, candidate := range config.ProvisioningTokens() {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Same as certificateForPublicKey(), with the public key supplied as the DER bytes
+of a PKCS#10 certificate signing request.  The CSR's signature is verified
+before issuing, which proves that the requester possesses the private key.
+Only RSA keys are supported.  Nothing but the public key is taken from the CSR.
+Unlike certificateForPublicKey(), it takes certMutex itself.
+*/
+func certificateForCSR(email string, csrBytes []byte, validity time.Duration, master bool) ([]byte, error) {
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("Invalid CSR signature: %s", err)
+	}
+	switch pk := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		certMutex.RLock()
+		issuer, issuerKey := certificate, privateKey
+		certMutex.RUnlock()
+		certificateBytes, err := certificateSignedBy(email, pk, validity, master, issuer, issuerKey)
+		if err != nil {
+			return nil, err
+		}
+		return certificateBytes, nil
+	default:
+		return nil, fmt.Errorf("Unsupported key type: %s", reflect.TypeOf(pk))
+	}
+}
+
+/*
+certificateForPublicKey() creates a certificate from the given public key,
+returning DER bytes for the Certificate.  The supplied email is encrypted and
+stored in the certificate's identity extension (see identity.go) so that the
+issuer can associate this certificate with the email address later on, without
+exposing the email address to other clients.  The common name is the holder's
+NodeID.  The certificate is valid for the given duration.  If master is true,
+the certificate is marked as a master-level certificate (see IsMaster()).
+certMutex must be held.
+*/
+func certificateForPublicKey(email string, publicKey *rsa.PublicKey, validity time.Duration, master bool) ([]byte, error) {
+	return certificateSignedBy(email, publicKey, validity, master, certificate, privateKey)
+}
+
+/*
+backdating() returns how far a certificate with the given validity is
+backdated: CLOCK_SKEW_ALLOWANCE for those of ephemeral nodes, which are too
+short-lived to be worth reusing much longer, and ONE_WEEK otherwise.
+*/
+func backdating(validity time.Duration) time.Duration {
+	if validity <= EPHEMERAL_CERT_VALIDITY {
+		return CLOCK_SKEW_ALLOWANCE
+	}
+	return ONE_WEEK
+}
+
+// backdatingOf() returns how far the given certificate that we issued was
+// backdated (see backdating()).
+func backdatingOf(cert *x509.Certificate) time.Duration {
+	if cert.NotAfter.Sub(cert.NotBefore) <= EPHEMERAL_CERT_VALIDITY+CLOCK_SKEW_ALLOWANCE {
+		return CLOCK_SKEW_ALLOWANCE
+	}
+	return ONE_WEEK
+}
+
+/*
+certificateSignedBy() is certificateForPublicKey() with the given issuer
+certificate and signing key, self-signing with the template if issuerCertificate
+is nil.  The email is encrypted for the signing key, like Encrypt() does for
+ours, so that it doesn't need certMutex.
+*/
+func certificateSignedBy(email string, publicKey *rsa.PublicKey, validity time.Duration, master bool, issuerCertificate *x509.Certificate, signer *rsa.PrivateKey) ([]byte, error) {
+	encryptedEmail, err := encryptCN(&signer.PublicKey, email, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	nodeID, err := nodeIDForKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), SERIAL_BITS))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"Lantern Network"},
+			CommonName:   nodeID,
+		},
+		NotBefore: now.Add(-1 * backdating(validity)),
+		NotAfter:  now.Add(validity),
+
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	if master {
+		template.Subject.OrganizationalUnit = []string{MASTER_UNIT}
+	}
+
+	if issuerCertificate != nil {
+		// Tell peers where to check whether the certificate was revoked (see
+		// certstatus.go)
+		template.OCSPServer = []string{"https://" + config.AdvertisedSignalingAddress() + STATUS_PATH}
+	} else {
+		log.Println("We don't have a cert, self-signing using template")
+		// Note - for self-signed certificates, we include the host's external IP
+		// address, limited to the advertised IP if one was selected, or
+		// otherwise the one that we discover, falling back to the loopback
+		// addresses of both IPv4 and IPv6
+		advertisedIP := net.ParseIP(config.AdvertisedIP())
+		if advertisedIP == nil {
+			advertisedIP = net.ParseIP(config.DiscoverExternalIP())
+		}
+		if advertisedIP != nil {
+			template.IPAddresses = []net.IP{advertisedIP}
+		} else {
+			template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+		}
+	}
+	// The identity goes into the subjectAltName, along with the IP addresses
+	// (see identity.go)
+	identity, err := identityExtension(encryptedEmail, template.IPAddresses)
+	if err != nil {
+		return nil, err
+	}
+	template.ExtraExtensions = []pkix.Extension{identity}
+	if issuerCertificate == nil {
+		issuerCertificate = &template
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, issuerCertificate, publicKey, signer)
+	if err != nil {
+		return nil, err
+	}
+	return derBytes, nil
+}
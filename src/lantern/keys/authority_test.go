@@ -0,0 +1,38 @@
+package keys
+
+import (
+	"crypto/x509"
+	_ "lantern/client/ephemeral"
+	"testing"
+)
+
+/*
+FuzzCertificateForCSR feeds arbitrary bytes to the CSR parsing of the
+certificate request handler, which must never panic and may only issue
+certificates for the key that signed the CSR.
+*/
+func FuzzCertificateForCSR(f *testing.F) {
+	csrBytes, err := CertificateRequest()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(csrBytes)
+	f.Add([]byte{0x30, 0x82, 0x00, 0x00})
+	f.Fuzz(func(t *testing.T, csrBytes []byte) {
+		nodeID, csrErr := nodeIDOfCSR(csrBytes)
+		derBytes, err := certificateForCSR("", csrBytes, EPHEMERAL_CERT_VALIDITY, false)
+		if err != nil {
+			return
+		}
+		if csrErr != nil {
+			t.Fatalf("Issued a certificate for a CSR that nodeIDOfCSR() refuses: %s", csrErr)
+		}
+		cert, err := x509.ParseCertificate(derBytes)
+		if err != nil {
+			t.Fatalf("Issued a certificate that doesn't parse: %s", err)
+		}
+		if NodeIDOf(cert) != nodeID {
+			t.Fatalf("Issued a certificate for %s to the holder of %s", NodeIDOf(cert), nodeID)
+		}
+	})
+}
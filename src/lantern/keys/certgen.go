@@ -1,10 +1,16 @@
 /*
 This file contains private logic for the keys package that encapsulates an
 http-based channel to allow child user nodes to request a certificate from their
-parents.
+parents.  This is the parent's side, the child's side is the
+EnrollmentClient in enrollclient.go.
 
-Certificates are requested by POSTing the DER bytes of the child's public key
-to https://[parent's signaling address]/mycert.
+Certificates are requested by POSTing the DER bytes of a PKCS#10 certificate
+signing request (CSR) for the child's public key to
+https://[parent's signaling address]/mycert.  The CSR is signed by the child's
+private key, so the parent can verify that the child actually possesses it.
+PATH is served on a dedicated TLS listener and ServeMux, so it isn't exposed on
+any other server, and only on nodes that are configured to issue certificates
+(see config.CanIssueCerts()).
 
 The parent authenticates the child on the basis of their email address using
 Mozilla Persona.  Before requesting a certificate, the child obtains an
@@ -12,18 +18,35 @@ identity assertion from Mozilla Persona (see package lantern/persona).  That
 identity assertion is then included with the certificate request in the
 X-Lantern-Identity header, which the parent then independently verifies with
 Mozilla Persona.
+
+Ephemeral children (see config.Ephemeral()) can't go through the Mozilla
+Persona flow, so they instead present a provisioning token in the
+X-Lantern-Provisioning-Token header, which the parent checks against
+config.ProvisioningTokens().  Certificates issued this way are tied to no email
+address but to an identity derived from the token (see provisionedIdentity()),
+and are only valid for EPHEMERAL_CERT_VALIDITY.  Like all certificates of
+ephemeral nodes, they're only backdated by CLOCK_SKEW_ALLOWANCE.
+
+Children that joined with an invite that carries a token (see invites.go)
+present it in the X-Lantern-Invite-Token header instead of signing in.
+
+Authentication and issuance are independent of HTTP (see CertRequest and
+IssueCertificate()), so that children who can't reach their parent's web port
+can obtain their certificate over the signaling channel instead (see package
+lantern/issuance).
 */
 package keys
 
 import (
-	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"lantern/config"
-	"lantern/persona"
 //	"lantern/signaling"
+	"lantern/util"
 	"log"
+	"net"
 	"net/http"
 )
 
@@ -39,51 +62,147 @@ const X_LANTERN_IDENTITY = "X-Lantern-Identity"
 // TODO: make sure that this is secure enough
 const X_LANTERN_AUDIENCE = "X-Lantern-Audience"
 
-// tr is an http transport that trusts this lantern's parent on the basis of
-// the certs stored in TrustedParents.
-var tr = &http.Transport{
-	TLSClientConfig: &tls.Config{RootCAs: TrustedParents},
+// X_LANTERN_PROVISIONING_TOKEN is the header that's used by ephemeral nodes to
+// transmit their provisioning token in lieu of an identity assertion.
+const X_LANTERN_PROVISIONING_TOKEN = "X-Lantern-Provisioning-Token"
+
+// X_LANTERN_INVITE_TOKEN is the header that's used by children that joined
+// with an invite to transmit its token in lieu of an identity assertion.
+const X_LANTERN_INVITE_TOKEN = "X-Lantern-Invite-Token"
+
+// X_LANTERN_RENEWAL is the header that's used to indicate that a child is
+// renewing a certificate that we issued to it previously, authenticating with
+// that certificate instead of an identity assertion.
+const X_LANTERN_RENEWAL = "X-Lantern-Renewal"
+
+// X_LANTERN_EPHEMERAL is the header that's used by ephemeral nodes to indicate
+// that they want a short-lived certificate.
+const X_LANTERN_EPHEMERAL = "X-Lantern-Ephemeral"
+
+// X_LANTERN_OBSERVED_IP is the header that's used by the parent to tell the
+// child at which IP it saw the certificate request coming from.
+const X_LANTERN_OBSERVED_IP = "X-Lantern-Observed-IP"
+
+/*
+CertRequest is a request for a certificate, independent of how it's
+transported (HTTPS POST to PATH or the signaling channel).
+*/
+type CertRequest struct {
+	CSR               []byte // DER bytes of the child's PKCS#10 certificate signing request
+	Assertion         string // Mozilla Persona identity assertion
+	Audience          string // audience against which Assertion is validated
+	ProvisioningToken string // provisioning token, used in lieu of Assertion by ephemeral children
+	InviteToken       string // invite token, used in lieu of Assertion by children that joined with an invite
+	Ephemeral         bool   // whether the child wants a short-lived certificate
 }
 
-// client uses the tr transport to trust the right parent
-var client = &http.Client{Transport: tr}
+// IssueError indicates that a certificate couldn't be issued.
+type IssueError struct {
+	Status int    // HTTP-style status code
+	Reason string // why the certificate couldn't be issued
+}
 
-func init() {
-	// Register genCert to handle requests to PATH
-	http.HandleFunc(PATH, genCert)
+func (err *IssueError) Error() string {
+	return err.Reason
 }
 
-// requestCertFromParent() requests a certificate from the parent node for the
-// given public key.
-func requestCertFromParent(publicKeyBytes []byte) (chan []byte, error) {
-	// Get our identity assertion (this blocks until the UI flow for getting
-	// the identity assertion has finished)
-	identityAssertion := <-persona.GetIdentityAssertion()
+// certMux is the ServeMux for certificate issuance
+var certMux = http.NewServeMux()
 
-	// Set up our request to the parent
-	url := "https://" + config.ParentAddress() + PATH
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(publicKeyBytes))
-	if err != nil {
-		return nil, err
+/*
+HandlePeers() registers the given handler for the given path on the server at
+our signaling address, next to PATH, for requests from children that don't
+belong to certificate issuance (see package lantern/signaling).  Requests carry
+the client certificates that the children presented, if any.
+*/
+func HandlePeers(path string, handler func(http.ResponseWriter, *http.Request)) {
+	certMux.HandleFunc(path, handler)
+}
+
+/*
+serveCerts(), meant to be run as a goroutine, serves certificate requests from
+our children over TLS on our signaling address, once we have a certificate of
+our own.  Client certificates are requested (but not required) so that
+children can renew their certificates, and the ones presented have to chain to
+TrustedParents (see verifyPresentedCertificate()).
+*/
+func serveCerts() {
+	cert, certChannel := Certificate()
+	if cert == nil {
+		// wait for cert
+		cert = <-certChannel
 	}
-	req.Header.Add(X_LANTERN_IDENTITY, identityAssertion)
-	req.Header.Add(X_LANTERN_AUDIENCE, config.UIAddress())
 
-	// Make our request
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	// Only nodes that issue certificates expose PATH, everywhere else it's a
+	// 404
+	if config.CanIssueCerts() {
+		certMux.HandleFunc(PATH, genCert)
+		certMux.HandleFunc(STATUS_PATH, certStatusHandler)
 	} else {
-		defer resp.Body.Close()
-		if resp.StatusCode != 200 {
-			return nil, fmt.Errorf("http request failed: %s %s", resp.StatusCode, resp.Status)
+		log.Printf("Not configured to issue certificates, not serving %s", PATH)
+	}
+
+	server := &http.Server{
+		Addr:    config.SignalingBindAddress(),
+		Handler: certMux,
+		TLSConfig: SecurePeerConfig(&tls.Config{
+			ClientCAs:             TrustedParents,
+			ClientAuth:            tls.RequestClientCert,
+			VerifyPeerCertificate: verifyPresentedCertificate,
+			GetCertificate:        GetCertificate,
+		}),
+	}
+
+	log.Printf("About to start serving certificates at: %s", config.SignalingBindAddress())
+	util.Supervise("certificate server", func() error {
+		listener, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			return err
 		}
-		_, err := ioutil.ReadAll(resp.Body)
+		// Unlike ListenAndServeTLS(), which clones it, tls.NewListener() uses
+		// server.TLSConfig itself, so it sees rotated session ticket keys
+		return server.Serve(tls.NewListener(listener, server.TLSConfig))
+	})
+}
+
+/*
+verifyPresentedCertificate() refuses the TLS handshake of a child that presents
+a certificate that doesn't chain to TrustedParents, so that the trust model
+applies to everything served at our signaling address (including signaling
+connections, see HandlePeers()) before any request is read.  Children that
+present no certificate are let in, since they connect to request one.
+
+tls.VerifyClientCertIfGiven would do the same, except that it insists on
+ExtKeyUsageClientAuth, which our certificates don't have.  Whether we issued
+the certificate is checked where it matters (see VerifyChild()).
+*/
+func verifyPresentedCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return nil
+	}
+	presented := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, rawCert := range rawCerts {
+		cert, err := x509.ParseCertificate(rawCert)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("Unable to parse client certificate: %s", err)
 		}
-		return nil, nil
+		presented = append(presented, cert)
 	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range presented[1:] {
+		intermediates.AddCert(cert)
+	}
+	trustMutex.Lock()
+	defer trustMutex.Unlock()
+	_, err := presented[0].Verify(x509.VerifyOptions{
+		Roots:         TrustedParents,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("Untrusted client certificate: %s", err)
+	}
+	return nil
 }
 
 // genCert() handles requests from a child to generate a certificate.
@@ -98,30 +217,53 @@ func genCert(resp http.ResponseWriter, req *http.Request) {
 		resp.Write([]byte(msg))
 	}
 
-	if assertion := req.Header.Get(X_LANTERN_IDENTITY); assertion == "" {
-		respond(400, fmt.Sprintf("Request didn't include a %s header", X_LANTERN_IDENTITY))
-	} else {
-		if audience := req.Header.Get(X_LANTERN_AUDIENCE); audience == "" {
-			respond(400, fmt.Sprintf("Request didn't include a %s header", X_LANTERN_AUDIENCE))
+	csrBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		respond(400, "Request didn't include a CSR")
+		return
+	}
+
+	var certBytes []byte
+	if req.Header.Get(X_LANTERN_RENEWAL) != "" {
+		if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+			err = &IssueError{403, "Unable to renew certificate: No client certificate presented"}
 		} else {
-			if pr, err := persona.ValidateAssertion(assertion, audience); err != nil {
-				respond(400, "Identity failed to validate with Mozilla")
-			} else {
-				if publicKeyBytes, err := ioutil.ReadAll(req.Body); err != nil {
-					respond(400, "Request didn't include the public key's bytes")
-				} else {
-					certBytes, err := certificateForBytes(pr.Email, publicKeyBytes)
-					if err != nil {
-						respond(500, fmt.Sprintf("Unable to generate certificate: %s", err))
-					}
-					resp.Header().Set("Content-Type", "application/octet-stream")
-					_, err = resp.Write(certBytes)
-					if err != nil {
-						log.Printf("Unexpected error in returning certificate bytes: %s", err)
-						resp.WriteHeader(500)
-					}
-				}
-			}
+			certBytes, err = Authority.ReissueCertificate(req.TLS.PeerCertificates[0], csrBytes)
+		}
+	} else if code := req.Header.Get(X_LANTERN_PAIRING_CODE); code != "" {
+		source, _, _ := net.SplitHostPort(req.RemoteAddr)
+		certBytes, err = Authority.Enroll(code, csrBytes, source)
+	} else {
+		certBytes, err = IssueCertificate(&CertRequest{
+			CSR:               csrBytes,
+			Assertion:         req.Header.Get(X_LANTERN_IDENTITY),
+			Audience:          req.Header.Get(X_LANTERN_AUDIENCE),
+			ProvisioningToken: req.Header.Get(X_LANTERN_PROVISIONING_TOKEN),
+			InviteToken:       req.Header.Get(X_LANTERN_INVITE_TOKEN),
+			Ephemeral:         req.Header.Get(X_LANTERN_EPHEMERAL) != "",
+		})
+	}
+	if err != nil {
+		statusCode := 500
+		if issueErr, ok := err.(*IssueError); ok {
+			statusCode = issueErr.Status
 		}
+		respond(statusCode, err.Error())
+		return
+	}
+
+	if req.Header.Get(X_LANTERN_ACCEPT_CHAIN) != "" {
+		certBytes = EncodeChain(certBytes, IssuerChain())
+		resp.Header().Set("Content-Type", CONTENT_TYPE_CHAIN)
+	} else {
+		resp.Header().Set("Content-Type", "application/octet-stream")
+	}
+	// Tell the child where we saw it coming from (see config.SetObservedIP())
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		resp.Header().Set(X_LANTERN_OBSERVED_IP, host)
+	}
+	if _, err = resp.Write(certBytes); err != nil {
+		log.Printf("Unexpected error in returning certificate bytes: %s", err)
 	}
 }
+
@@ -0,0 +1,384 @@
+package keys
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lantern/audit"
+	"lantern/config"
+	"lantern/ui"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Issuing nodes answer online status queries for the certificates that they
+issued, so that peers learn about revocations before the certificates expire.
+The certificates that we issue name our status endpoint,
+https://[config.AdvertisedSignalingAddress()]/certstatus, in their OCSPServer
+field, and the endpoint answers GET /certstatus?serial=<serial number> with a
+CertStatus that's signed by our private key, or by the archived key whose
+certificate has the fingerprint given in the optional issuer parameter (see
+rotation.go).  Like PATH, it's only served by nodes that issue certificates.
+
+The operator revokes certificates by serial number with Revoke() or at
+http://[config.UIAddress()]/admin/revocations, where GET lists when
+certificates were revoked by serial number and POST with the form value serial
+revokes one.  Revocations are kept in [config.ConfigDir]/keys/revoked.json.
+
+Every peer TLS config (see SecurePeerConfig()) checks the status of the
+certificate that the other side presents with its issuer, which has to have
+signed the answer.  The issuer is taken from the presented chain (see
+chain.go) or our trust store.  Answers are cached until their NextUpdate and
+failed lookups for STATUS_RETRY.  What happens when the status can't be
+determined is up to the operator (see config.CertStatusPolicy()):
+
+- config.CERT_STATUS_OFF - nothing is checked
+- config.CERT_STATUS_SOFT_FAIL (the default) - only certificates that are known
+  to be revoked are rejected
+- config.CERT_STATUS_HARD_FAIL - certificates whose status can't be determined
+  are rejected too, including those that don't name a status endpoint
+
+Self-signed certificates in our trust store (those of root nodes) have nobody
+to ask and aren't checked.  Any other self-signed certificate counts as one
+whose status can't be determined, so that revoked nodes can't dodge the check
+by presenting one.
+
+Certificates that we issued ourselves are checked against our revocations
+directly, also when they're presented to renew them (see checkRenewable()) or
+to authenticate (see VerifyChild()).
+*/
+const (
+	STATUS_PATH       = "/certstatus"   // the path at which we answer status queries
+	STATUS_GOOD       = "good"          // the certificate hasn't been revoked
+	STATUS_REVOKED    = "revoked"       // the certificate has been revoked
+	STATUS_VALIDITY   = 1 * time.Hour   // how long our answers may be cached
+	STATUS_RETRY      = 1 * time.Minute // how long we wait before asking again after a failed lookup
+	STATUS_TIMEOUT    = 5 * time.Second // how long a status lookup may take
+	MAX_STATUS_LENGTH = 64 * 1024       // the largest answer that we accept
+)
+
+// CertStatus is the status of a certificate as answered by its issuer.
+type CertStatus struct {
+	Serial     string    // the serial number of the certificate
+	Status     string    // STATUS_GOOD or STATUS_REVOKED
+	RevokedAt  time.Time // when the certificate was revoked (if it was)
+	ProducedAt time.Time // when the answer was produced
+	NextUpdate time.Time // until when the answer may be cached
+}
+
+// signedStatus is a CertStatus as it's served.
+type signedStatus struct {
+	Status    []byte // the JSON encoded CertStatus
+	Signature []byte // the signature of Status by the issuer's private key
+}
+
+// cachedStatus is the outcome of a status lookup.
+type cachedStatus struct {
+	status *CertStatus // the status, if the lookup succeeded
+	err    error       // why the lookup failed, if it did
+	until  time.Time   // when we have to ask again
+}
+
+var (
+	revocationsFile  = config.ConfigDir + "/keys/revoked.json" // where revocations are kept
+	revocations      = make(map[string]time.Time)              // when certificates were revoked, by serial number
+	revocationsMutex sync.RWMutex                              // used to synchronize access to revocations
+	statusCache      = make(map[string]*cachedStatus)          // outcomes of status lookups, by issuer fingerprint and serial number
+	statusCacheMutex sync.Mutex                                // used to synchronize access to statusCache
+
+	// statusClient looks up certificate statuses.  Answers are signed, so the
+	// TLS connection doesn't need to be authenticated.
+	statusClient = &http.Client{
+		Timeout:   STATUS_TIMEOUT,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+)
+
+func init() {
+	loadRevocations()
+	ui.HandleFunc("/admin/revocations", revocationsHandler)
+}
+
+// Revoke() revokes the certificate with the given serial number.
+func Revoke(serial string) error {
+	if _, ok := new(big.Int).SetString(serial, 10); !ok {
+		return fmt.Errorf("Invalid serial number: %s", serial)
+	}
+	revocationsMutex.Lock()
+	defer revocationsMutex.Unlock()
+	if _, found := revocations[serial]; found {
+		return nil
+	}
+	revocations[serial] = time.Now()
+	log.Printf("Revoked certificate %s", serial)
+	audit.Record(audit.EVENT_CERT_REVOKED, serial, "")
+	return saveRevocations()
+}
+
+// Revocations() returns when certificates were revoked, by serial number.
+func Revocations() map[string]time.Time {
+	revocationsMutex.RLock()
+	defer revocationsMutex.RUnlock()
+	copied := make(map[string]time.Time, len(revocations))
+	for serial, revokedAt := range revocations {
+		copied[serial] = revokedAt
+	}
+	return copied
+}
+
+// isRevoked() indicates whether we revoked the certificate with the given
+// serial number.
+func isRevoked(serial string) bool {
+	revocationsMutex.RLock()
+	defer revocationsMutex.RUnlock()
+	_, found := revocations[serial]
+	return found
+}
+
+// ownStatus() returns the status of the certificate with the given serial
+// number that we issued.
+func ownStatus(serial string) *CertStatus {
+	now := time.Now()
+	status := &CertStatus{Serial: serial, Status: STATUS_GOOD, ProducedAt: now, NextUpdate: now.Add(STATUS_VALIDITY)}
+	revocationsMutex.RLock()
+	defer revocationsMutex.RUnlock()
+	if revokedAt, found := revocations[serial]; found {
+		status.Status = STATUS_REVOKED
+		status.RevokedAt = revokedAt
+	}
+	return status
+}
+
+/*
+verifyPeerStatus() is the VerifyPeerCertificate of our peer TLS configs, which
+checks the status of the certificate that the other side presented according
+to config.CertStatusPolicy().
+*/
+func verifyPeerStatus(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	policy := config.CertStatusPolicy()
+	if policy == config.CERT_STATUS_OFF || len(rawCerts) == 0 {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	var status *CertStatus
+	if cert.CheckSignatureFrom(cert) == nil {
+		if isTrusted(cert) {
+			// A root that we trust, nobody to ask
+			return nil
+		}
+		err = fmt.Errorf("Self-signed certificate isn't in our trust store")
+	} else {
+		status, err = certStatus(cert, issuerOf(cert, rawCerts[1:]))
+	}
+	if err != nil {
+		if policy == config.CERT_STATUS_HARD_FAIL {
+			return fmt.Errorf("Unable to determine status of peer certificate %s: %s", cert.SerialNumber, err)
+		}
+		return nil
+	}
+	if status.Status == STATUS_REVOKED {
+		return fmt.Errorf("Peer certificate %s was revoked at %s", cert.SerialNumber, status.RevokedAt)
+	}
+	return nil
+}
+
+/*
+verifyResumedPeerStatus() is the VerifyConnection of our peer TLS configs,
+which does the work of verifyPeerStatus() for resumed sessions, where
+VerifyPeerCertificate isn't called.
+*/
+func verifyResumedPeerStatus(state tls.ConnectionState) error {
+	if !state.DidResume {
+		return nil
+	}
+	rawCerts := make([][]byte, 0, len(state.PeerCertificates))
+	for _, cert := range state.PeerCertificates {
+		rawCerts = append(rawCerts, cert.Raw)
+	}
+	return verifyPeerStatus(rawCerts, nil)
+}
+
+// issuerOf() finds the issuer of the given certificate in the given chain or
+// our trust store, returning nil if it's in neither.
+func issuerOf(cert *x509.Certificate, certChain [][]byte) *x509.Certificate {
+	if len(certChain) > 0 {
+		if issuer, err := x509.ParseCertificate(certChain[0]); err == nil && cert.CheckSignatureFrom(issuer) == nil {
+			return issuer
+		}
+	}
+	trustMutex.Lock()
+	defer trustMutex.Unlock()
+	for _, trusted := range trustedCerts {
+		if cert.CheckSignatureFrom(trusted.cert) == nil {
+			return trusted.cert
+		}
+	}
+	return nil
+}
+
+/*
+certStatus() returns the status of the given certificate, as answered by the
+given issuer, from the cache if possible.
+*/
+func certStatus(cert *x509.Certificate, issuer *x509.Certificate) (*CertStatus, error) {
+	if issuer == nil {
+		return nil, fmt.Errorf("Issuer unknown")
+	}
+	if isOwnCertificate(issuer) {
+		// We issued it ourselves
+		return ownStatus(cert.SerialNumber.String()), nil
+	}
+	key := fingerprint(issuer) + "/" + cert.SerialNumber.String()
+	statusCacheMutex.Lock()
+	cached, found := statusCache[key]
+	statusCacheMutex.Unlock()
+	if found && time.Now().Before(cached.until) {
+		return cached.status, cached.err
+	}
+
+	status, err := fetchStatus(cert, issuer)
+	cached = &cachedStatus{status: status, err: err, until: time.Now().Add(STATUS_RETRY)}
+	if err != nil {
+		log.Printf("Unable to look up status of certificate %s: %s", cert.SerialNumber, err)
+	} else {
+		cached.until = status.NextUpdate
+	}
+	statusCacheMutex.Lock()
+	statusCache[key] = cached
+	statusCacheMutex.Unlock()
+	return status, err
+}
+
+// fetchStatus() asks the status endpoint named by the given certificate for
+// its status and checks that the answer was signed by the given issuer.
+func fetchStatus(cert *x509.Certificate, issuer *x509.Certificate) (*CertStatus, error) {
+	if len(cert.OCSPServer) == 0 {
+		return nil, fmt.Errorf("Certificate names no status endpoint")
+	}
+	serial := cert.SerialNumber.String()
+	resp, err := statusClient.Get(cert.OCSPServer[0] + "?serial=" + url.QueryEscape(serial) + "&issuer=" + fingerprint(issuer))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Unexpected response: %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_STATUS_LENGTH))
+	if err != nil {
+		return nil, err
+	}
+	signed := &signedStatus{}
+	if err := json.Unmarshal(data, signed); err != nil {
+		return nil, err
+	}
+	if err := issuer.CheckSignature(x509.SHA256WithRSA, signed.Status, signed.Signature); err != nil {
+		return nil, fmt.Errorf("Signature didn't verify: %s", err)
+	}
+	status := &CertStatus{}
+	if err := json.Unmarshal(signed.Status, status); err != nil {
+		return nil, err
+	}
+	if status.Serial != serial {
+		return nil, fmt.Errorf("Answer is for certificate %s", status.Serial)
+	}
+	if time.Now().After(status.NextUpdate) {
+		return nil, fmt.Errorf("Answer is stale")
+	}
+	return status, nil
+}
+
+// certStatusHandler() answers status queries for the certificates that we
+// issued.
+func certStatusHandler(resp http.ResponseWriter, req *http.Request) {
+	serial := req.FormValue("serial")
+	if _, ok := new(big.Int).SetString(serial, 10); !ok {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Invalid serial number"))
+		return
+	}
+	statusBytes, err := json.Marshal(ownStatus(serial))
+	if err != nil {
+		resp.WriteHeader(500)
+		return
+	}
+	// Certificates issued before we rotated our key are answered for with the
+	// key that issued them
+	signature, err := signWith(ownKeyFor(req.FormValue("issuer")), statusBytes)
+	if err != nil {
+		log.Printf("Unable to sign certificate status: %s", err)
+		resp.WriteHeader(500)
+		return
+	}
+	data, err := json.Marshal(&signedStatus{Status: statusBytes, Signature: signature})
+	if err != nil {
+		resp.WriteHeader(500)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(data)
+}
+
+// loadRevocations() loads the revocations from disk, if there are any.
+func loadRevocations() {
+	if config.Ephemeral() {
+		return
+	}
+	data, err := ioutil.ReadFile(revocationsFile)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &revocations); err != nil {
+		log.Printf("Unable to load revocations from %s: %s", revocationsFile, err)
+	}
+}
+
+// saveRevocations() saves the revocations to disk.  revocationsMutex must be
+// held.
+func saveRevocations() error {
+	if config.Ephemeral() {
+		return nil
+	}
+	data, err := json.MarshalIndent(revocations, "", "   ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(revocationsFile, data, 0600); err != nil {
+		return err
+	}
+	// WriteFile() keeps the mode of files that older versions created
+	return os.Chmod(revocationsFile, 0600)
+}
+
+/*
+revocationsHandler() lists when we revoked certificates by serial number on
+GET and revokes the one given in the form value serial on POST.
+*/
+func revocationsHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		if err := Revoke(req.FormValue("serial")); err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+	}
+	if revocationsJson, err := json.MarshalIndent(Revocations(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(revocationsJson)
+	}
+}
@@ -0,0 +1,121 @@
+package keys
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+)
+
+/*
+Certificates are delivered to children together with the chain of their
+issuer, so that nodes that only trust a node higher up in the tree (like the
+root) can still verify nodes further down.  A chain lists the DER bytes of the
+issuing certificates, starting with the issuer of the certificate that it
+belongs to and going up towards the root.  The chain that we hand to our
+children is our own certificate followed by our own chain (see
+IssuerChain()).
+
+Over HTTPS, children that understand chains ask for them with the
+X-Lantern-Accept-Chain header, in which case the parent responds with a PEM
+bundle of the child's certificate followed by its chain (CONTENT_TYPE_CHAIN).
+Older children get just the DER bytes of their certificate, like before.  Over
+the signaling channel, the chain travels next to the certificate (see package
+lantern/issuance).
+
+Our chain is kept after our certificate in certificate.pem and presented after
+it in TLS handshakes (see TLSCertificate()).
+*/
+const (
+	// X_LANTERN_ACCEPT_CHAIN is the header with which children ask for their
+	// certificate to be returned with its chain
+	X_LANTERN_ACCEPT_CHAIN = "X-Lantern-Accept-Chain"
+
+	// CONTENT_TYPE_CHAIN is the content type of a PEM encoded certificate
+	// followed by its chain
+	CONTENT_TYPE_CHAIN = "application/x-pem-file"
+
+	// MAX_CHAIN_LENGTH is the longest chain that we accept, which is plenty
+	// for the depth of our tree
+	MAX_CHAIN_LENGTH = 16
+)
+
+// IssuerChain() returns the chain for the certificates that we issue, which is
+// our certificate followed by our own chain.
+func IssuerChain() [][]byte {
+	certMutex.RLock()
+	defer certMutex.RUnlock()
+	if certificate == nil {
+		return nil
+	}
+	return append([][]byte{certificate.Raw}, chain...)
+}
+
+// EncodeChain() PEM encodes the given certificate followed by its chain.
+func EncodeChain(derBytes []byte, certChain [][]byte) []byte {
+	encoded := &bytes.Buffer{}
+	for _, certBytes := range append([][]byte{derBytes}, certChain...) {
+		pem.Encode(encoded, &pem.Block{Type: PEM_HEADER_CERTIFICATE, Bytes: certBytes})
+	}
+	return encoded.Bytes()
+}
+
+/*
+decodeIssued() decodes a certificate as returned by our parent, which is either
+the DER bytes of the certificate or a PEM bundle of the certificate followed by
+its chain.  Returns the DER bytes of the certificate and the chain.
+*/
+func decodeIssued(data []byte) ([]byte, [][]byte, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		return data, nil, nil
+	}
+	blocks, err := decodePEMCertificates(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return blocks[0], blocks[1:], nil
+}
+
+// decodePEMCertificates() returns the DER bytes of all certificates in the
+// given PEM data, of which there has to be at least one.
+func decodePEMCertificates(data []byte) ([][]byte, error) {
+	certs := make([][]byte, 0)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == PEM_HEADER_CERTIFICATE {
+			certs = append(certs, block.Bytes)
+		}
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("Unable to decode PEM encoded certificate")
+	}
+	if len(certs) > MAX_CHAIN_LENGTH+1 {
+		return nil, fmt.Errorf("Certificate chain is longer than %d", MAX_CHAIN_LENGTH)
+	}
+	return certs, nil
+}
+
+/*
+checkChain() checks that each certificate in the given chain issued the one
+before it, starting with the given certificate.
+*/
+func checkChain(cert *x509.Certificate, certChain [][]byte) error {
+	if len(certChain) > MAX_CHAIN_LENGTH {
+		return fmt.Errorf("Certificate chain is longer than %d", MAX_CHAIN_LENGTH)
+	}
+	for i, issuerBytes := range certChain {
+		issuer, err := x509.ParseCertificate(issuerBytes)
+		if err != nil {
+			return fmt.Errorf("Unable to parse certificate %d of chain: %s", i, err)
+		}
+		if err := cert.CheckSignatureFrom(issuer); err != nil {
+			return fmt.Errorf("Certificate %d of chain didn't issue the one before it: %s", i, err)
+		}
+		cert = issuer
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package keys
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+The emails that we put in the certificates that we issue (see identity.go) and
+in PSK IDs are encrypted for our own key, so that only we can read them (see
+Encrypt() and Decrypt()).  Encrypted values are versioned:
+
+	lcn1:<algorithm>:<standard base64 of the ciphertext>
+
+with one of the following algorithms:
+
+- CN_ALGORITHM_HYBRID - the value is sealed with AES-256-GCM under a fresh key,
+  which is encrypted for our public key with RSA-OAEP (SHA-256).  The
+  ciphertext is the encrypted AES key, followed by the GCM nonce and the sealed
+  value.  Drawn from the source of randomness in that order: the AES key, the
+  OAEP seed and the nonce.  This is what Encrypt() produces.
+- CN_ALGORITHM_PKCS1 - the value is encrypted for our public key with RSA
+  PKCS #1 v1.5.  We never produce it, but before values were versioned, they
+  were base64 encoded ciphertexts of this algorithm without a prefix, so
+  unprefixed values are decrypted as CN_ALGORITHM_PKCS1.  That way, parents
+  can still renew the certificates that they issued before the hybrid scheme.
+
+Known answers pin the format (see cnformat_test.go), so that changes to the
+format or to the libraries underneath can't silently make the identities in
+existing certificates unreadable.
+*/
+const (
+	CN_FORMAT_PREFIX    = "lcn1:" // the prefix of versioned encrypted values
+	CN_ALGORITHM_HYBRID = "h1"    // RSA-OAEP (SHA-256) wrapped AES-256-GCM
+	CN_ALGORITHM_PKCS1  = "r1"    // RSA PKCS #1 v1.5 (legacy)
+	CN_AES_KEY_BYTES    = 32      // the length of the AES keys of CN_ALGORITHM_HYBRID
+)
+
+/*
+encryptCN() encrypts the given value for the given public key in the versioned
+format with CN_ALGORITHM_HYBRID, drawing the AES key, OAEP seed and nonce from
+random.
+*/
+func encryptCN(publicKey *rsa.PublicKey, value string, random io.Reader) (string, error) {
+	aesKey := make([]byte, CN_AES_KEY_BYTES)
+	if _, err := io.ReadFull(random, aesKey); err != nil {
+		return "", err
+	}
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), random, publicKey, aesKey, nil)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newCNCipher(aesKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(random, nonce); err != nil {
+		return "", err
+	}
+	ciphertext := append(wrappedKey, nonce...)
+	ciphertext = gcm.Seal(ciphertext, nonce, []byte(value), nil)
+	return CN_FORMAT_PREFIX + CN_ALGORITHM_HYBRID + ":" + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+/*
+decryptCN() decrypts the given value with the given private key, which may be
+in the versioned format with any of our algorithms or an unprefixed legacy
+value (see CN_ALGORITHM_PKCS1).
+*/
+func decryptCN(key *rsa.PrivateKey, value string) (string, error) {
+	algorithm, encoded := CN_ALGORITHM_PKCS1, value
+	if strings.HasPrefix(value, CN_FORMAT_PREFIX) {
+		parts := strings.SplitN(strings.TrimPrefix(value, CN_FORMAT_PREFIX), ":", 2)
+		if len(parts) != 2 {
+			return "", fmt.Errorf("Malformed encrypted value")
+		}
+		algorithm, encoded = parts[0], parts[1]
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	switch algorithm {
+	case CN_ALGORITHM_PKCS1:
+		plaintext, err := rsa.DecryptPKCS1v15(rand.Reader, key, ciphertext)
+		if err != nil {
+			return "", err
+		}
+		return string(plaintext), nil
+	case CN_ALGORITHM_HYBRID:
+		keySize := key.PublicKey.Size()
+		if len(ciphertext) < keySize {
+			return "", fmt.Errorf("Encrypted value is too short")
+		}
+		aesKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, ciphertext[:keySize], nil)
+		if err != nil {
+			return "", err
+		}
+		gcm, err := newCNCipher(aesKey)
+		if err != nil {
+			return "", err
+		}
+		sealed := ciphertext[keySize:]
+		if len(sealed) < gcm.NonceSize() {
+			return "", fmt.Errorf("Encrypted value is too short")
+		}
+		plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+		if err != nil {
+			return "", err
+		}
+		return string(plaintext), nil
+	default:
+		return "", fmt.Errorf("Unknown encryption algorithm %s", algorithm)
+	}
+}
+
+// newCNCipher() returns the AES-GCM cipher for the given key.
+func newCNCipher(aesKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
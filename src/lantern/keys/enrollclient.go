@@ -0,0 +1,183 @@
+package keys
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base32"
+	"fmt"
+	"io/ioutil"
+	"lantern/config"
+	"lantern/persona"
+	"lantern/util"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+/*
+An EnrollmentClient obtains our certificate from our parent.  Enroller is the
+EnrollmentClient in use, which talks HTTPS to PATH on our parent (see
+certgen.go).  Root nodes don't need it, since they sign their own certificates,
+and tests can replace it with a mock.
+*/
+type EnrollmentClient interface {
+	// RequestCertificate() requests a certificate for the given CSR, returning
+	// the certificate as the parent sent it (see decodeIssued()).
+	RequestCertificate(csrBytes []byte) ([]byte, error)
+
+	// RenewCertificate() renews our certificate for the given CSR,
+	// authenticating with our current certificate.  The request is abandoned
+	// if it hasn't completed by the given deadline.
+	RenewCertificate(csrBytes []byte, deadline time.Time) ([]byte, error)
+
+	// EnrollAsMaster() enrolls us as a master (see enrollment.go), blocking
+	// until the parent's operator has approved the enrollment.  Returns our
+	// master-level certificate as the parent sent it (see decodeIssued()).
+	EnrollAsMaster(csrBytes []byte) ([]byte, error)
+}
+
+// httpEnrollmentClient is the EnrollmentClient that talks HTTPS to our parent.
+type httpEnrollmentClient struct{}
+
+// Enroller is the EnrollmentClient that obtains our certificate from our
+// parent.
+var Enroller EnrollmentClient = &httpEnrollmentClient{}
+
+// tr is an http transport that trusts this lantern's parent on the basis of
+// the certs stored in TrustedParents.
+var tr = &http.Transport{
+	TLSClientConfig: &tls.Config{RootCAs: TrustedParents},
+	DialContext:     dialParent,
+}
+
+// client uses the tr transport to trust the right parent
+var client = &http.Client{Transport: tr}
+
+// dialParent() connects to our parent at the given address, racing the
+// addresses that its host resolves to (see util.DialHappyEyeballs()).
+func dialParent(ctx context.Context, network string, address string) (net.Conn, error) {
+	return util.DialHappyEyeballs(ctx, []string{address})
+}
+
+func (enroller *httpEnrollmentClient) RequestCertificate(csrBytes []byte) ([]byte, error) {
+	// Set up our request to the parent
+	url := "https://" + config.ParentAddress() + PATH
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(csrBytes))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add(X_LANTERN_ACCEPT_CHAIN, "true")
+	certRequest := NewCertRequest(csrBytes)
+	if certRequest.Ephemeral {
+		req.Header.Add(X_LANTERN_EPHEMERAL, "true")
+	}
+	if certRequest.ProvisioningToken != "" {
+		req.Header.Add(X_LANTERN_PROVISIONING_TOKEN, certRequest.ProvisioningToken)
+	} else if certRequest.InviteToken != "" {
+		req.Header.Add(X_LANTERN_INVITE_TOKEN, certRequest.InviteToken)
+	} else {
+		req.Header.Add(X_LANTERN_IDENTITY, certRequest.Assertion)
+		req.Header.Add(X_LANTERN_AUDIENCE, certRequest.Audience)
+	}
+
+	return doCertRequest(client, req)
+}
+
+func (enroller *httpEnrollmentClient) RenewCertificate(csrBytes []byte, deadline time.Time) ([]byte, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	url := "https://" + config.ParentAddress() + PATH
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(csrBytes))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add(X_LANTERN_RENEWAL, "true")
+	req.Header.Add(X_LANTERN_ACCEPT_CHAIN, "true")
+
+	// Present our current certificate so that we can renew it without going
+	// through Mozilla Persona again
+	renewalClient := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs:              TrustedParents,
+			GetClientCertificate: GetClientCertificate,
+		},
+		DialContext: dialParent,
+	}}
+	return doCertRequest(renewalClient, req)
+}
+
+func (enroller *httpEnrollmentClient) EnrollAsMaster(csrBytes []byte) ([]byte, error) {
+	code := newPairingCode()
+	log.Printf("Enrolling as a master, ask the operator of %s to approve pairing code %s", config.ParentAddress(), code)
+	url := "https://" + config.ParentAddress() + PATH
+	for {
+		req, err := http.NewRequest("POST", url, bytes.NewBuffer(csrBytes))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add(X_LANTERN_PAIRING_CODE, code)
+		req.Header.Add(X_LANTERN_ACCEPT_CHAIN, "true")
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("Unable to check enrollment with parent: %s", err)
+		} else {
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode == 200 {
+				return body, err
+			} else if resp.StatusCode != STATUS_PENDING {
+				return nil, fmt.Errorf("Enrollment failed: %s %s", resp.Status, body)
+			}
+		}
+		time.Sleep(ENROLLMENT_POLL_INTERVAL)
+	}
+}
+
+/*
+NewCertRequest() builds a request for a certificate for the given CSR,
+authenticated with a provisioning token (for ephemeral nodes that have one),
+the token of the invite that we joined with (if any) or otherwise with a
+Mozilla Persona identity assertion.  Getting the identity assertion blocks until
+the UI flow for getting it has finished.
+*/
+func NewCertRequest(csrBytes []byte) *CertRequest {
+	certRequest := &CertRequest{CSR: csrBytes, Ephemeral: config.Ephemeral()}
+	if token := config.ProvisioningToken(); config.Ephemeral() && token != "" {
+		certRequest.ProvisioningToken = token
+	} else if token := config.InviteToken(); token != "" {
+		certRequest.InviteToken = token
+	} else {
+		certRequest.Assertion = <-persona.GetIdentityAssertion()
+		certRequest.Audience = config.UIAddress()
+	}
+	return certRequest
+}
+
+// doCertRequest() makes the given certificate request using the given client
+// and returns the certificate as the parent sent it (see decodeIssued()).
+func doCertRequest(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	} else {
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("http request failed: %d %s", resp.StatusCode, resp.Status)
+		}
+		if observedIP := resp.Header.Get(X_LANTERN_OBSERVED_IP); observedIP != "" {
+			config.SetObservedIP(observedIP)
+		}
+		return ioutil.ReadAll(resp.Body)
+	}
+}
+
+// newPairingCode() generates a random pairing code of the form XXXX-XXXX.
+func newPairingCode() string {
+	b := make([]byte, 5)
+	rand.Read(b)
+	code := base32.StdEncoding.EncodeToString(b)
+	return code[:4] + "-" + code[4:]
+}
@@ -0,0 +1,218 @@
+/*
+This file contains the enrollment flow through which child master nodes obtain
+master-level certificates (see IsMaster()) from their parents.  Since masters
+may act on behalf of any user, they can't just authenticate with an identity
+assertion, instead a human operator of the parent has to approve them.
+
+The flow is a simple challenge/response:
+
+1. The child (configured with config.EnrollAsMaster()) generates a random
+   pairing code and logs it, so that its operator can pass it on to the
+   parent's operator out of band.
+2. The child POSTs its CSR to PATH with the pairing code in the
+   X-Lantern-Pairing-Code header.  The CSR's signature proves that the child
+   possesses the private key.  The parent records a pending enrollment and
+   answers with 202 Accepted.
+3. The parent's operator looks at the pending enrollments at
+   http://[config.UIAddress()]/admin/enrollments and approves (or rejects) the
+   one whose pairing code matches what the child's operator told them.
+4. The child keeps POSTing the same request every ENROLLMENT_POLL_INTERVAL.
+   Once approved, the parent answers with a master-level certificate for the
+   key in the CSR that came with the pairing code.
+
+Pending enrollments expire after ENROLLMENT_TIMEOUT.  Since anybody can ask to
+enroll, at most MAX_PENDING_ENROLLMENTS of them wait at any time, and each
+source IP may only start MAX_ENROLLMENTS_PER_SOURCE of them per
+ENROLLMENT_WINDOW (polling doesn't count).  Further requests are answered with
+429 Too Many Requests.
+*/
+package keys
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"lantern/config"
+	"lantern/ui"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// X_LANTERN_PAIRING_CODE is the header that's used by children enrolling as
+// masters to transmit their pairing code.
+const X_LANTERN_PAIRING_CODE = "X-Lantern-Pairing-Code"
+
+const (
+	STATUS_PENDING              = 202              // the status with which pending enrollments are answered
+	STATUS_TOO_MANY_ENROLLMENTS = 429              // the status with which enrollments over our limits are answered
+	ENROLLMENT_POLL_INTERVAL    = 30 * time.Second // how often children check whether their enrollment was approved
+	ENROLLMENT_TIMEOUT          = 24 * time.Hour   // how long pending enrollments wait for approval
+	MAX_PENDING_ENROLLMENTS     = 100              // how many enrollments may wait for approval at once
+	MAX_ENROLLMENTS_PER_SOURCE  = 3                // how many enrollments a source IP may start per ENROLLMENT_WINDOW
+	ENROLLMENT_WINDOW           = 1 * time.Hour    // the window of MAX_ENROLLMENTS_PER_SOURCE
+)
+
+// Enrollment is a child's request to become a master.
+type Enrollment struct {
+	PairingCode string    // the code that the child's operator passes on out of band
+	Fingerprint string    // hex SHA-256 of the child's public key
+	RequestedAt time.Time // when the child first asked
+	Source      string    // the IP that the child first asked from
+	Approved    bool      // whether our operator approved the enrollment
+	rejected    bool      // whether our operator rejected the enrollment
+	csr         []byte    // the child's CSR
+}
+
+var (
+	enrollments         = make(map[string]*Enrollment) // enrollments by pairing code
+	enrollmentWindow    = time.Now()                   // start of the current ENROLLMENT_WINDOW
+	enrollmentsBySource = make(map[string]int)         // enrollments started in the current window by source IP
+	enrollmentsMutex    sync.Mutex                     // used to synchronize access to all of the above
+)
+
+func init() {
+	ui.HandleFunc("/admin/enrollments", enrollmentsHandler)
+}
+
+func (ca *localAuthority) Enroll(code string, csrBytes []byte, source string) ([]byte, error) {
+	if !config.CanIssueCerts() {
+		return nil, &IssueError{404, "Not configured to issue certificates"}
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		return nil, &IssueError{400, fmt.Sprintf("Unable to parse CSR: %s", err)}
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, &IssueError{400, fmt.Sprintf("Invalid CSR signature: %s", err)}
+	}
+	fingerprint := sha256.Sum256(csr.RawSubjectPublicKeyInfo)
+
+	enrollmentsMutex.Lock()
+	expireEnrollments()
+	enrollment, found := enrollments[code]
+	if !found {
+		if err := allowEnrollment(source); err != nil {
+			enrollmentsMutex.Unlock()
+			return nil, err
+		}
+		enrollments[code] = &Enrollment{
+			PairingCode: code,
+			Fingerprint: hex.EncodeToString(fingerprint[:]),
+			RequestedAt: time.Now(),
+			Source:      source,
+			csr:         csrBytes,
+		}
+		enrollmentsMutex.Unlock()
+		log.Printf("New master enrollment with pairing code %s is waiting for approval", code)
+		return nil, &IssueError{STATUS_PENDING, "Waiting for operator approval"}
+	}
+	if enrollment.Fingerprint != hex.EncodeToString(fingerprint[:]) {
+		enrollmentsMutex.Unlock()
+		return nil, &IssueError{403, "Pairing code belongs to a different key"}
+	}
+	if enrollment.rejected {
+		delete(enrollments, code)
+		enrollmentsMutex.Unlock()
+		return nil, &IssueError{403, "Enrollment was rejected"}
+	}
+	if !enrollment.Approved {
+		enrollmentsMutex.Unlock()
+		return nil, &IssueError{STATUS_PENDING, "Waiting for operator approval"}
+	}
+	delete(enrollments, code)
+	enrollmentsMutex.Unlock()
+
+	certBytes, err := certificateForCSR("", enrollment.csr, TWO_WEEKS, true)
+	if err != nil {
+		return nil, &IssueError{500, fmt.Sprintf("Unable to generate certificate: %s", err)}
+	}
+	atomic.AddInt64(&issuedCertificates, 1)
+	log.Printf("Issued master certificate for pairing code %s", code)
+	return certBytes, nil
+}
+
+// PendingEnrollments() returns the enrollments that are waiting for our
+// operator's approval.
+func PendingEnrollments() []Enrollment {
+	enrollmentsMutex.Lock()
+	defer enrollmentsMutex.Unlock()
+	expireEnrollments()
+	pending := make([]Enrollment, 0, len(enrollments))
+	for _, enrollment := range enrollments {
+		if !enrollment.rejected {
+			pending = append(pending, *enrollment)
+		}
+	}
+	return pending
+}
+
+// ApproveEnrollment() approves (or rejects) the enrollment with the given
+// pairing code.
+func ApproveEnrollment(code string, approved bool) error {
+	enrollmentsMutex.Lock()
+	defer enrollmentsMutex.Unlock()
+	enrollment, found := enrollments[code]
+	if !found || enrollment.rejected {
+		return fmt.Errorf("No pending enrollment with pairing code %s", code)
+	}
+	// Rejected enrollments are kept until the child hears about it
+	enrollment.Approved = approved
+	enrollment.rejected = !approved
+	return nil
+}
+
+/*
+allowEnrollment() checks whether the given source IP may start a new
+enrollment, and if so counts it.  enrollmentsMutex must be held.
+*/
+func allowEnrollment(source string) error {
+	if len(enrollments) >= MAX_PENDING_ENROLLMENTS {
+		return &IssueError{STATUS_TOO_MANY_ENROLLMENTS, "Too many enrollments are waiting for approval"}
+	}
+	if time.Since(enrollmentWindow) > ENROLLMENT_WINDOW {
+		enrollmentWindow = time.Now()
+		enrollmentsBySource = make(map[string]int)
+	}
+	if enrollmentsBySource[source] >= MAX_ENROLLMENTS_PER_SOURCE {
+		return &IssueError{STATUS_TOO_MANY_ENROLLMENTS, fmt.Sprintf("Too many enrollments from %s", source)}
+	}
+	enrollmentsBySource[source] += 1
+	return nil
+}
+
+// expireEnrollments() forgets enrollments that have been waiting too long.
+// enrollmentsMutex must be held.
+func expireEnrollments() {
+	for code, enrollment := range enrollments {
+		if time.Since(enrollment.RequestedAt) > ENROLLMENT_TIMEOUT {
+			delete(enrollments, code)
+		}
+	}
+}
+
+/*
+enrollmentsHandler() lists pending enrollments on GET and approves or rejects
+one on POST with the form values code and approve.
+*/
+func enrollmentsHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		approved := req.FormValue("approve") == "true"
+		if err := ApproveEnrollment(req.FormValue("code"), approved); err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+	}
+	if enrollmentsJson, err := json.MarshalIndent(PendingEnrollments(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(enrollmentsJson)
+	}
+}
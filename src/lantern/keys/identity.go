@@ -0,0 +1,167 @@
+package keys
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net"
+)
+
+/*
+The certificates that we issue carry the identity of their holder, that is
+their email encrypted for our key (see cnformat.go), as an otherName in their
+subjectAltName extension, whose type-id is OID_ENCRYPTED_IDENTITY and whose
+value is the encrypted email as an ASN.1 UTF8String.  Their common name is the
+NodeID of their holder (see nodeid.go), which keeps it within the length limits
+of X.509 and readable for tooling.
+
+OID_ENCRYPTED_IDENTITY lives under the 2.25 arc of X.667, which is derived from
+a UUID and thus needs no registration.  Its single 128 bit arc is too large for
+asn1.ObjectIdentifier, though, and crypto/x509 refuses certificates with such
+an extension id, which is why the identity is an otherName (whose type-id
+crypto/x509 doesn't parse) rather than an extension of its own, and why we
+compare type-ids in their DER encoding (identityTypeID).
+
+Certificates issued before carry the encrypted email in an extension under
+LEGACY_OID_ENCRYPTED_IDENTITY, and the oldest ones in their common name.
+EncryptedIdentity() reads all three formats, so the old ones keep working
+during the transition, which ends once the last of those certificates has been
+renewed (renewals are issued in the new format) or has expired.
+*/
+const (
+	OID_ENCRYPTED_IDENTITY = "2.25.100265393053756407053013000304256936629" // UUID 4b6e698b-a0ac-4f95-8b69-9f0d8948eab5
+)
+
+var (
+	// LEGACY_OID_ENCRYPTED_IDENTITY identifies the extension that carried the
+	// encrypted identity of a certificate's holder before
+	LEGACY_OID_ENCRYPTED_IDENTITY = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 54361, 1, 1}
+
+	oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+	identityTypeID    = uuidOID(OID_ENCRYPTED_IDENTITY[len("2.25."):]) // the DER encoding of OID_ENCRYPTED_IDENTITY
+)
+
+const (
+	sanOtherName = 0 // the tag of an otherName in a subjectAltName
+	sanIPAddress = 7 // the tag of an iPAddress in a subjectAltName
+)
+
+/*
+EncryptedIdentity() returns the encrypted identity that the given certificate
+carries, from its subjectAltName or, for certificates in the old formats, its
+legacy identity extension or its common name.
+*/
+func EncryptedIdentity(cert *x509.Certificate) string {
+	for _, extension := range cert.Extensions {
+		if extension.Id.Equal(oidSubjectAltName) {
+			if encrypted, found := identityFromSAN(extension.Value); found {
+				return encrypted
+			}
+		}
+	}
+	for _, extension := range cert.Extensions {
+		if extension.Id.Equal(LEGACY_OID_ENCRYPTED_IDENTITY) {
+			var encrypted string
+			if _, err := asn1.Unmarshal(extension.Value, &encrypted); err == nil {
+				return encrypted
+			}
+		}
+	}
+	return cert.Subject.CommonName
+}
+
+// Identity() decrypts the identity (email) that the given certificate, which we
+// issued, carries.  Check peers' certificates with VerifyChild() first.
+func Identity(cert *x509.Certificate) (string, error) {
+	return Decrypt(EncryptedIdentity(cert))
+}
+
+/*
+identityExtension() returns the subjectAltName extension carrying the given
+encrypted identity and IP addresses.  It replaces the one that crypto/x509
+would generate from a template's IPAddresses, so those have to go here.
+*/
+func identityExtension(encrypted string, ips []net.IP) (pkix.Extension, error) {
+	value, err := asn1.MarshalWithParams(encrypted, "utf8")
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	explicitValue, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: value})
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	names := []asn1.RawValue{{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        sanOtherName,
+		IsCompound: true,
+		Bytes:      append(append([]byte{}, identityTypeID...), explicitValue...),
+	}}
+	for _, ip := range ips {
+		if ipv4 := ip.To4(); ipv4 != nil {
+			ip = ipv4
+		}
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: sanIPAddress, Bytes: ip})
+	}
+	san, err := asn1.Marshal(names)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidSubjectAltName, Critical: false, Value: san}, nil
+}
+
+// identityFromSAN() finds the encrypted identity in the given subjectAltName
+// extension value.
+func identityFromSAN(san []byte) (string, bool) {
+	var names []asn1.RawValue
+	if rest, err := asn1.Unmarshal(san, &names); err != nil || len(rest) > 0 {
+		return "", false
+	}
+	for _, name := range names {
+		if name.Class != asn1.ClassContextSpecific || name.Tag != sanOtherName || !bytes.HasPrefix(name.Bytes, identityTypeID) {
+			continue
+		}
+		var explicitValue asn1.RawValue
+		if _, err := asn1.Unmarshal(name.Bytes[len(identityTypeID):], &explicitValue); err != nil {
+			continue
+		}
+		var encrypted string
+		if _, err := asn1.Unmarshal(explicitValue.Bytes, &encrypted); err == nil {
+			return encrypted, true
+		}
+	}
+	return "", false
+}
+
+// uuidOID() returns the DER encoding of the OID 2.25.<arc>, for an arc that's
+// the decimal form of a UUID.
+func uuidOID(arc string) []byte {
+	value, ok := new(big.Int).SetString(arc, 10)
+	if !ok {
+		panic("Invalid UUID arc " + arc)
+	}
+	mask := big.NewInt(0x7f)
+	encoded := []byte{}
+	for continuation := byte(0); ; continuation = 0x80 {
+		encoded = append([]byte{byte(new(big.Int).And(value, mask).Int64()) | continuation}, encoded...)
+		if value.Rsh(value, 7).Sign() == 0 {
+			break
+		}
+	}
+	der, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagOID, Bytes: append([]byte{2*40 + 25}, encoded...)})
+	if err != nil {
+		panic(err)
+	}
+	return der
+}
+
+// nodeIDForKey() returns the NodeID of the holder of the given public key.
+func nodeIDForKey(publicKey *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	return nodeIDFor(der), nil
+}
@@ -0,0 +1,70 @@
+package keys
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	_ "lantern/client/ephemeral"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestIdentityInSAN checks that the certificates that we issue parse and carry
+// the identity and IP addresses that we put into their subjectAltName.
+func TestIdentityInSAN(t *testing.T) {
+	key := PrivateKey()
+	derBytes, err := certificateSignedBy("a@example.com", &key.PublicKey, EPHEMERAL_CERT_VALIDITY, false, nil, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		t.Fatalf("Issued a certificate that doesn't parse: %s", err)
+	}
+	if len(cert.IPAddresses) == 0 {
+		t.Errorf("Expected the self-signed certificate to carry IP addresses")
+	}
+	email, err := Identity(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if email != "a@example.com" {
+		t.Errorf("Expected identity a@example.com, got %s", email)
+	}
+}
+
+// TestLegacyIdentity checks that we still read the identity of certificates
+// that carry it in the legacy extension.
+func TestLegacyIdentity(t *testing.T) {
+	key := PrivateKey()
+	encrypted, err := Encrypt("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := asn1.MarshalWithParams(encrypted, "utf8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: "legacy"},
+		NotBefore:       time.Now(),
+		NotAfter:        time.Now().Add(time.Hour),
+		IPAddresses:     []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtraExtensions: []pkix.Extension{{Id: LEGACY_OID_ENCRYPTED_IDENTITY, Value: value}},
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if EncryptedIdentity(cert) != encrypted {
+		t.Errorf("Expected the identity from the legacy extension, got %s", EncryptedIdentity(cert))
+	}
+}
@@ -0,0 +1,316 @@
+package keys
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/skip2/go-qrcode"
+	"io/ioutil"
+	"lantern/config"
+	"lantern/ui"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Nodes that issue certificates hand out invites (see config.Invite) to new
+children at http://[config.UIAddress()]/admin/invite, so that nobody has to
+email our certificate around anymore:
+
+- GET shows an invite without a token, which points new children at our
+  advertised signaling listener and carries our certificate.  Children that
+  join with it still sign in to get their certificate.
+- POST creates an invite with a one-time token that gets a new child its
+  certificate without signing in.  The certificate is tied to the email in the
+  form value email (blank for none), and the invite is valid for the number of
+  days in the form value days (INVITE_VALIDITY if blank).  The first child that
+  presents the token redeems it, after which only the same node (by NodeID) may
+  present it again, for example while its device is held for approval (see
+  ledger.go).
+
+Both answer with the invite as a code and as a lantern:// link, and with the
+path at which the UI renders the link as a QR code for scanning with a phone
+(http://[config.UIAddress()]/admin/invite/qr, with the token in the form value
+invite for invites that carry one).
+
+Invites with tokens are kept in [config.ConfigDir]/keys/invites.json until they
+expire.
+*/
+const (
+	INVITE_VALIDITY    = 7 * ONE_DAY // how long invites with tokens are valid by default
+	INVITE_TOKEN_BYTES = 16          // random bytes in an invite token
+	INVITE_QR_SIZE     = 256         // the width and height of invite QR codes in pixels
+)
+
+// pendingInvite is an invite with a token that we handed out.
+type pendingInvite struct {
+	Token   string    // the one-time token of the invite
+	Email   string    // the email that the certificate is tied to (blank for none)
+	Created time.Time // when the invite was created
+	Expires time.Time // when the invite expires
+	NodeID  string    // the NodeID of the child that redeemed the invite (blank until redeemed)
+}
+
+// InviteCode is what /admin/invite shows.
+type InviteCode struct {
+	Code          string    // the invite code
+	Link          string    // the invite link
+	QRCode        string    // the path of the QR code of Link on the UI
+	ParentAddress string    // the address of our signaling listener that the invite points at
+	Email         string    // the email that the certificate is tied to, for invites with tokens
+	Expires       time.Time // when the invite expires, for invites with tokens
+}
+
+var (
+	invitesFile  = config.ConfigDir + "/keys/invites.json" // where invites with tokens are kept
+	invites      = make([]*pendingInvite, 0)               // the invites with tokens that we handed out
+	invitesMutex sync.Mutex                                // used to synchronize access to invites
+)
+
+func init() {
+	loadInvites()
+	ui.HandleFunc("/admin/invite", inviteHandler)
+	ui.HandleFunc("/admin/invite/qr", inviteQRHandler)
+}
+
+/*
+NewInvite() returns an invite for new children, pointing at our advertised
+signaling listener (see config.AdvertisedSignalingAddress()) and carrying our
+current certificate.
+*/
+func NewInvite() (*config.Invite, error) {
+	if !config.CanIssueCerts() {
+		return nil, fmt.Errorf("We don't issue certificates, so we can't take children")
+	}
+	cert, _ := Certificate()
+	if cert == nil {
+		return nil, fmt.Errorf("We don't have a certificate yet")
+	}
+	return &config.Invite{
+		ParentAddress: config.AdvertisedSignalingAddress(),
+		ParentCert:    string(pem.EncodeToMemory(&pem.Block{Type: PEM_HEADER_CERTIFICATE, Bytes: cert.Raw})),
+	}, nil
+}
+
+/*
+CreateInvite() returns an invite with a fresh token that gets a new child a
+certificate for the given email (blank for none) without signing in, valid for
+the given duration.
+*/
+func CreateInvite(email string, validity time.Duration) (*config.Invite, time.Time, error) {
+	invite, err := NewInvite()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	b := make([]byte, INVITE_TOKEN_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		return nil, time.Time{}, err
+	}
+	invite.Token = hex.EncodeToString(b)
+	now := time.Now()
+	pending := &pendingInvite{Token: invite.Token, Email: email, Created: now, Expires: now.Add(validity)}
+
+	invitesMutex.Lock()
+	defer invitesMutex.Unlock()
+	invites = append(invites, pending)
+	saveInvites()
+	log.Printf("Created invite for %s, valid until %s", emailOrNone(email), pending.Expires)
+	return invite, pending.Expires, nil
+}
+
+/*
+redeemInvite() checks the given invite token for a request for a certificate
+for the given CSR, returning the email that the certificate is tied to or an
+IssueError if the token is unknown, has expired or was redeemed by another
+node.
+*/
+func redeemInvite(token string, csrBytes []byte) (string, error) {
+	nodeID, err := nodeIDOfCSR(csrBytes)
+	if err != nil {
+		return "", &IssueError{400, fmt.Sprintf("Invalid CSR: %s", err)}
+	}
+	invitesMutex.Lock()
+	defer invitesMutex.Unlock()
+	expireInvites()
+	for _, pending := range invites {
+		if subtle.ConstantTimeCompare([]byte(pending.Token), []byte(token)) != 1 {
+			continue
+		}
+		if pending.NodeID == "" {
+			pending.NodeID = nodeID
+			saveInvites()
+			log.Printf("Node %s redeemed invite for %s", ShortNodeID(nodeID), emailOrNone(pending.Email))
+		} else if pending.NodeID != nodeID {
+			return "", &IssueError{403, "Invite was already used by another device"}
+		}
+		return pending.Email, nil
+	}
+	return "", &IssueError{403, "Invalid or expired invite"}
+}
+
+// findInvite() returns the invite with the given token, or nil if there's
+// none.
+func findInvite(token string) *pendingInvite {
+	invitesMutex.Lock()
+	defer invitesMutex.Unlock()
+	expireInvites()
+	for _, pending := range invites {
+		if subtle.ConstantTimeCompare([]byte(pending.Token), []byte(token)) == 1 {
+			copied := *pending
+			return &copied
+		}
+	}
+	return nil
+}
+
+// expireInvites() forgets invites that have expired.  invitesMutex must be
+// held.
+func expireInvites() {
+	now := time.Now()
+	kept := make([]*pendingInvite, 0, len(invites))
+	for _, pending := range invites {
+		if now.Before(pending.Expires) {
+			kept = append(kept, pending)
+		}
+	}
+	if len(kept) != len(invites) {
+		invites = kept
+		saveInvites()
+	}
+}
+
+// emailOrNone() returns the given email for logging, or "no email" if it's
+// blank.
+func emailOrNone(email string) string {
+	if email == "" {
+		return "no email"
+	}
+	return email
+}
+
+// loadInvites() loads the invites with tokens from disk, if there are any.
+func loadInvites() {
+	if config.Ephemeral() {
+		return
+	}
+	data, err := ioutil.ReadFile(invitesFile)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &invites); err != nil {
+		log.Printf("Unable to load invites from %s: %s", invitesFile, err)
+	}
+}
+
+// saveInvites() saves the invites with tokens to disk.  invitesMutex must be
+// held.
+func saveInvites() {
+	if config.Ephemeral() {
+		return
+	}
+	data, err := json.MarshalIndent(invites, "", "   ")
+	if err != nil {
+		return
+	}
+	if err := ioutil.WriteFile(invitesFile, data, 0600); err != nil {
+		log.Printf("Unable to save invites: %s", err)
+	}
+}
+
+/*
+inviteHandler() shows an invite without a token on GET, and creates an invite
+with a token on POST with the form values email and days.
+*/
+func inviteHandler(resp http.ResponseWriter, req *http.Request) {
+	var invite *config.Invite
+	var expires time.Time
+	var err error
+	if req.Method == "POST" {
+		validity := INVITE_VALIDITY
+		if value := req.FormValue("days"); value != "" {
+			days, err := strconv.Atoi(value)
+			if err != nil || days <= 0 {
+				resp.WriteHeader(400)
+				resp.Write([]byte(fmt.Sprintf("Invalid number of days: %s", value)))
+				return
+			}
+			validity = time.Duration(days) * ONE_DAY
+		}
+		invite, expires, err = CreateInvite(req.FormValue("email"), validity)
+	} else {
+		invite, err = NewInvite()
+	}
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(err.Error()))
+		return
+	}
+
+	inviteCode := &InviteCode{
+		QRCode:        "/admin/invite/qr",
+		ParentAddress: invite.ParentAddress,
+		Email:         req.FormValue("email"),
+		Expires:       expires,
+	}
+	if invite.Token != "" {
+		inviteCode.QRCode += "?invite=" + url.QueryEscape(invite.Token)
+	}
+	if inviteCode.Code, err = invite.Code(); err == nil {
+		inviteCode.Link, err = invite.Link()
+	}
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+		return
+	}
+	if inviteJson, err := json.MarshalIndent(inviteCode, "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(inviteJson)
+	}
+}
+
+/*
+inviteQRHandler() renders the link of an invite as a PNG QR code, that of the
+invite with the token in the form value invite or, if that's blank, that of the
+invite without a token.
+*/
+func inviteQRHandler(resp http.ResponseWriter, req *http.Request) {
+	invite, err := NewInvite()
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(err.Error()))
+		return
+	}
+	if token := req.FormValue("invite"); token != "" {
+		if findInvite(token) == nil {
+			resp.WriteHeader(404)
+			resp.Write([]byte("Invalid or expired invite"))
+			return
+		}
+		invite.Token = token
+	}
+	link, err := invite.Link()
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+		return
+	}
+	png, err := qrcode.Encode(link, qrcode.Medium, INVITE_QR_SIZE)
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+		return
+	}
+	resp.Header().Set("Content-Type", "image/png")
+	resp.Write(png)
+}
@@ -12,37 +12,59 @@ directory structure:
 
 own/
     privatekey.pem (our private key)
-	certificate.pem (our certificate)
+	certificate.pem (our certificate, followed by its chain)
+	archive/ (keys that we rotated away from, see rotation.go)
 trusted/
 	parentcert.pem (our parent's certificate)
 
 Any and all of these can be prepopulated with pregenerated values, which keys
 will happily use.  For child nodes, parentcert.pem has to be prepopulated,
 meaning that that part of the key exchange has to happen out of band (for
-example via email).  privatekey.pem and certificate.pem will be generated
+example via email), usually with an invite from the parent (see invites.go)
+that the user pastes into the setup wizard on first start (see package
+lantern/ui).  privatekey.pem and certificate.pem will be generated
 as necessary.
 
-TODO: handle certificate expirations to make sure we rotate certificates
-frequently.
+Ephemeral nodes (see config.Ephemeral()) never touch the disk.  Their private
+key can be injected as PEM via the LANTERN_PRIVATE_KEY environment variable
+(otherwise a fresh one is generated on every boot), their parent's certificate
+can be injected via LANTERN_PARENT_CERT and their own certificate is requested
+from the parent on every boot using a provisioning token.  Parents issue
+ephemeral nodes certificates that are valid for only EPHEMERAL_CERT_VALIDITY.
+
+Relay nodes (see config.IsRelay()) never request a certificate, they run with
+one provisioned by their operator (see relay.go).
+
+Certificates are renewed in the background well before they expire (see
+CertState).  If renewal fails, we keep using our existing certificate until it
+has truly expired.
+
+The package is made up of three parts that only interact through interfaces,
+so that each of them can be mocked and nodes only use what they need:
+
+- KeyStore (Store) persists our private key and certificate
+- CertAuthority (Authority) issues certificates to our children, which only
+  nodes that issue certificates need
+- EnrollmentClient (Enroller) obtains our certificate from our parent, which
+  only nodes with a parent need
 */
 package keys
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/base64"
-	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"lantern/config"
 	"log"
-	"math/big"
-	"net"
 	"os"
-	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -53,6 +75,21 @@ const (
 	KEY_BITS               = 2048
 	ONE_WEEK               = 7 * 24 * time.Hour
 	TWO_WEEKS              = ONE_WEEK * 2
+	ONE_DAY                = 24 * time.Hour
+	MASTER_UNIT            = "Master"       // organizational unit that marks master-level certificates
+	PROVISIONED_PREFIX     = "provisioned:" // prefix of the identities of provisioned nodes (see provisionedIdentity())
+
+	// CLOCK_SKEW_ALLOWANCE is how far certificates issued to ephemeral nodes
+	// are backdated, others are backdated by ONE_WEEK (see backdating())
+	CLOCK_SKEW_ALLOWANCE = 5 * time.Minute
+
+	// EPHEMERAL_CERT_VALIDITY is how long certificates issued to ephemeral
+	// nodes remain valid
+	EPHEMERAL_CERT_VALIDITY = ONE_DAY
+
+	// SERIAL_BITS is the size of the random serial numbers of the certificates
+	// that we issue, so that they're unique and can't be predicted
+	SERIAL_BITS = 128
 )
 
 var (
@@ -61,54 +98,181 @@ var (
 	TrustedParents  = x509.NewCertPool() // pool of trusted parent certificates
 )
 
+// PrivateKey() returns our current private key, which changes when we rotate
+// it (see rotation.go).
 func PrivateKey() *rsa.PrivateKey {
+	certMutex.RLock()
+	defer certMutex.RUnlock()
 	return privateKey
 }
 
 // Certificate() returns our certificate and, if there's no certificate,
 // a channel from which the certificate can be obtained.
 func Certificate() (*x509.Certificate, chan *x509.Certificate) {
-	certMutex.RLock()
-	defer certMutex.RUnlock()
+	certMutex.Lock()
+	defer certMutex.Unlock()
 	if certificate != nil {
 		return certificate, nil
 	} else {
-		certMutex.Lock()
-		defer certMutex.Unlock()
-		waitingForCert := make(chan *x509.Certificate)
+		waitingForCert := make(chan *x509.Certificate, 1)
 		waitingForCerts = append(waitingForCerts, waitingForCert)
 		return nil, waitingForCert
 	}
 }
 
-// Encrypt() encrypts the given string and returns it as a base64 encoded string
-func Encrypt(value string) (string, error) {
-	if bytes, err := rsa.EncryptPKCS1v15(rand.Reader, &(privateKey.PublicKey), []byte(value)); err != nil {
-		return "", err
-	} else {
-		return base64.StdEncoding.EncodeToString(bytes), nil
+/*
+IsMaster() indicates whether or not the given certificate is a master-level
+certificate, meaning that its holder is a master node that may act on behalf of
+any user.  Only certificates that passed VerifyChild() (or our own) can be
+taken at their word.
+*/
+func IsMaster(cert *x509.Certificate) bool {
+	for _, unit := range cert.Subject.OrganizationalUnit {
+		if unit == MASTER_UNIT {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+TLSCertificate() returns our certificate (followed by its chain) and private key
+for use with TLS.  Unlike tls.LoadX509KeyPair(), this works for ephemeral nodes
+too.
+*/
+func TLSCertificate() tls.Certificate {
+	certMutex.RLock()
+	defer certMutex.RUnlock()
+	return tls.Certificate{
+		Certificate: append([][]byte{certificate.Raw}, chain...),
+		PrivateKey:  privateKey,
+		Leaf:        certificate,
 	}
 }
 
-// Decrypt() decryptes a string value from the given base64 encoded string
+/*
+GetCertificate() is meant to be used as the GetCertificate of a server's
+tls.Config.  It looks up our current certificate for every handshake, so that
+renewed certificates take effect on new connections without restarting the
+server.
+*/
+func GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return currentTLSCertificate()
+}
+
+// GetClientCertificate() is the equivalent of GetCertificate() for the
+// GetClientCertificate of a client's tls.Config.
+func GetClientCertificate(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return currentTLSCertificate()
+}
+
+func currentTLSCertificate() (*tls.Certificate, error) {
+	certMutex.RLock()
+	haveCert := certificate != nil
+	certMutex.RUnlock()
+	if !haveCert {
+		return nil, fmt.Errorf("We don't have a certificate yet")
+	}
+	cert := TLSCertificate()
+	return &cert, nil
+}
+
+// Encrypt() encrypts the given string for our own key in the versioned format
+// of cnformat.go
+func Encrypt(value string) (string, error) {
+	return encryptCN(&PrivateKey().PublicKey, value, rand.Reader)
+}
+
+// Decrypt() decryptes a string value that we encrypted with Encrypt(), falling
+// back to the keys that we rotated away from (see rotation.go)
 func Decrypt(value string) (string, error) {
-	if bytes, err := base64.StdEncoding.DecodeString(value); err != nil {
-		return "", err
-	} else {
-		if bytes, err := rsa.DecryptPKCS1v15(rand.Reader, privateKey, bytes); err != nil {
-			return "", err
-		} else {
-			return string(bytes), nil
+	decrypted, err := decryptCN(PrivateKey(), value)
+	for _, archived := range archivedKeys() {
+		if err == nil {
+			break
 		}
+		decrypted, err = decryptCN(archived.privateKey, value)
+	}
+	return decrypted, err
+}
+
+// Sign() signs the given data with our private key using SHA-256
+func Sign(data []byte) ([]byte, error) {
+	return signWith(PrivateKey(), data)
+}
+
+// signWith() signs the given data with the given private key using SHA-256
+func signWith(key *rsa.PrivateKey, data []byte) ([]byte, error) {
+	hashed := sha256.Sum256(data)
+	return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+}
+
+// VerifyFromParent() checks that the given signature over data was produced
+// by our parent.
+func VerifyFromParent(data []byte, signature []byte) error {
+	parentCertificate := parentCert()
+	if parentCertificate == nil {
+		return fmt.Errorf("No parent certificate available to verify signature")
+	}
+	return parentCertificate.CheckSignature(x509.SHA256WithRSA, data, signature)
+}
+
+/*
+VerifyFromChild() checks that the given signature over data was produced by the
+holder of the given (DER encoded) certificate, and that we issued that
+certificate.  Returns the parsed certificate.
+*/
+func VerifyFromChild(data []byte, signature []byte, certBytes []byte) (*x509.Certificate, error) {
+	childCert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := VerifyChild(childCert); err != nil {
+		return nil, err
+	}
+	if err := childCert.CheckSignature(x509.SHA256WithRSA, data, signature); err != nil {
+		return nil, err
+	}
+	return childCert, nil
+}
+
+/*
+VerifyChild() checks that we issued the given certificate, which a peer
+presented, and that it has neither expired nor been revoked.  Our TLS listeners request client
+certificates without verifying them (peers may fall back to PSKs), so anybody
+can present a self-signed certificate claiming any identity (see Identity()) or
+master privileges (see IsMaster()).  Those claims only count once
+VerifyChild() passed.
+*/
+func VerifyChild(cert *x509.Certificate) error {
+	if err := issuedByUs(cert); err != nil {
+		return fmt.Errorf("Child certificate wasn't issued by us: %s", err)
 	}
+	if time.Now().After(cert.NotAfter) {
+		return fmt.Errorf("Child certificate has expired")
+	}
+	if isRevoked(cert.SerialNumber.String()) {
+		return fmt.Errorf("Child certificate %s was revoked", cert.SerialNumber)
+	}
+	return nil
+}
+
+// IssuedCertificates() returns the number of certificates that we've issued
+// (including renewals) since we started.
+func IssuedCertificates() int64 {
+	return atomic.LoadInt64(&issuedCertificates)
 }
 
 var (
-	privateKey      *rsa.PrivateKey                     // our private key
-	certificate     *x509.Certificate                   // our certificate
-	parentCertFile  string                              // our parent's certificate
-	certMutex       sync.RWMutex                        // used to synchronize access to our certificate
-	waitingForCerts = make([]chan *x509.Certificate, 0) // callbacks of parties waiting for us to get/generate a cert
+	privateKey         *rsa.PrivateKey                     // our private key
+	certificate        *x509.Certificate                   // our certificate
+	chain              [][]byte                            // the chain of our certificate (see chain.go)
+	parentCertFile     string                              // our parent's certificate
+	parentCertificate  *x509.Certificate                   // our parent's certificate, parsed
+	parentCertMutex    sync.RWMutex                        // used to synchronize access to parentCertificate
+	certMutex          sync.RWMutex                        // used to synchronize access to our certificate
+	waitingForCerts    = make([]chan *x509.Certificate, 0) // callbacks of parties waiting for us to get/generate a cert
+	issuedCertificates int64                               // number of certificates issued to children, accessed atomically
 )
 
 func init() {
@@ -118,68 +282,85 @@ func init() {
 	PrivateKeyFile = ownPath + "privatekey.pem"
 	CertificateFile = ownPath + "certificate.pem"
 	parentCertFile = trustedPath + "parentcert.pem"
-	if err := os.MkdirAll(ownPath, 0755); err != nil {
-		log.Fatalf("Unable to create directory for own keys '%s': %s", ownPath, err)
+	if config.Ephemeral() {
+		Store = &ephemeralKeyStore{}
+	} else {
+		if err := os.MkdirAll(ownPath, 0755); err != nil {
+			// Saving our keys will fail, but we can still run with them in
+			// memory
+			log.Printf("Unable to create directory for own keys '%s': %s", ownPath, err)
+		}
+		Store = &fileKeyStore{privateKeyFile: PrivateKeyFile, certificateFile: CertificateFile}
 	}
 	if !config.IsRootNode() {
 		loadParentCert()
 	}
 	loadPrivateKey()
+	logNodeID()
+	if config.IsRelay() {
+		checkRelay()
+	}
 	loadCertificate()
+	if !config.Ephemeral() {
+		loadAddedCerts()
+	}
+	if config.Runs(config.SUBSYSTEM_CERT_ISSUANCE) {
+		go serveCerts()
+	}
 }
 
-// loadPrivateKey() loads our private key from disk and, if not found, creates it
+// loadPrivateKey() loads our private key from Store and, if not found, creates
+// it
 func loadPrivateKey() {
-	if privateKeyData, err := ioutil.ReadFile(PrivateKeyFile); err != nil {
-		log.Print("Unable to read private key file from disk, creating")
+	var err error
+	if privateKey, err = Store.LoadPrivateKey(); err != nil {
+		log.Printf("%s, creating", err)
 		createPrivateKey()
 	} else {
-		block, _ := pem.Decode(privateKeyData)
-		if block == nil {
-			log.Print("Unable to decode PEM encoded private key data, creating")
-			createPrivateKey()
-		} else {
-			privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
-			if err != nil {
-				log.Print("Unable to decode X509 private key data, creating")
-				createPrivateKey()
-			} else {
-				log.Printf("Read private key")
-			}
-		}
+		log.Printf("Read private key")
 	}
 }
 
-// createPrivateKey() creates an RSA private key and saves it to disk
+/*
+createPrivateKey() creates an RSA private key and saves it to Store.  If saving
+fails, we keep using the key from memory, which means that we'll have a new
+identity after a restart.
+*/
 func createPrivateKey() {
 	newPrivateKey, err := rsa.GenerateKey(rand.Reader, KEY_BITS)
 	if err != nil {
+		// Without a source of randomness, there's nothing we can do
 		log.Fatalf("Failed to generate private key: %s", err)
 	}
 
 	privateKey = newPrivateKey
-	keyOut, err := os.OpenFile(PrivateKeyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		log.Fatalf("Failed to open %s for writing: %s", PrivateKeyFile, err)
-	}
-	if err := pem.Encode(keyOut, &pem.Block{Type: PEM_HEADER_PRIVATE_KEY, Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}); err != nil {
-		log.Fatalf("Unable to PEM encode private key: %s", err)
+	if err := Store.SavePrivateKey(privateKey); err != nil {
+		log.Printf("Unable to save private key, only keeping it in memory: %s", err)
 	}
-	keyOut.Close()
-	log.Printf("Wrote private key to %s", PrivateKeyFile)
 }
 
-// loadParentCert() loads the parent cert from disk
+// loadParentCert() loads the parent cert from disk, or for ephemeral nodes from
+// the LANTERN_PARENT_CERT environment variable if it's been set.
 func loadParentCert() {
-	if certificateData, err := ioutil.ReadFile(parentCertFile); err != nil {
+	injected := os.Getenv("LANTERN_PARENT_CERT")
+	if config.Ephemeral() && injected != "" {
+		addParentCert([]byte(injected))
+	} else if certificateData, err := ioutil.ReadFile(parentCertFile); err != nil {
 		log.Fatal("Unable to read parent certificate file from disk")
 	} else {
-		if TrustedParents.AppendCertsFromPEM(certificateData) {
-			log.Print("Added trusted parent cert")
-		} else {
-			log.Fatal("Unable to add trusted parent cert")
-		}
+		addParentCert(certificateData)
+	}
+}
+
+// addParentCert() trusts the given PEM encoded parent cert
+func addParentCert(certificateData []byte) {
+	cert, err := parsePEMCertificate(certificateData)
+	if err != nil {
+		log.Fatalf("Unable to add trusted parent cert: %s", err)
 	}
+	trust(cert, TRUST_PARENT)
+	parentCertificate = cert
+	log.Print("Added trusted parent cert")
 }
 
 /*
@@ -190,137 +371,160 @@ generating a self-signed certificate (if we're a root node).
 func loadCertificate() {
 	certMutex.Lock()
 	defer certMutex.Unlock()
-	if certificateData, err := ioutil.ReadFile(CertificateFile); err != nil {
-		log.Printf("Unable to read certificate file from disk: %s", err)
-		initCertificate()
+	var err error
+	if certificate, chain, err = Store.LoadCertificate(); err != nil {
+		log.Printf("%s, initializing certificate", err)
+		certificate = nil
+		err = initCertificate()
+	} else if time.Now().After(certificate.NotAfter) {
+		log.Print("Certificate on disk has expired")
+		err = initCertificate()
 	} else {
-		block, _ := pem.Decode(certificateData)
-		if block == nil {
-			log.Print("Unable to decode PEM encoded certificate")
-			initCertificate()
-		} else {
-			certificate, err = x509.ParseCertificate(block.Bytes)
-			if err != nil {
-				log.Print("Unable to decode X509 certificate data")
-				initCertificate()
-			}
-			log.Printf("Read certificate")
-		}
+		log.Printf("Read certificate")
+	}
+	if err != nil {
+		// certRenewer() retries for root nodes, children may still get their
+		// certificate over the signaling channel (see InstallCertificate())
+		log.Printf("Unable to initialize certificate: %s", err)
 	}
 
 	// Add ourselves to the trust store
-	TrustedParents.AddCert(certificate)
+	if certificate != nil {
+		trust(certificate, TRUST_OWN)
+	}
+	certRenewer()
 }
 
 /*
 initCertificate() initializes our certificate either by requesting a cert from
 our parent (if we have one) or generating a self-signed certificate (if we're a
-root node).
+root node).  certMutex must be held.
 */
-func initCertificate() {
+func initCertificate() error {
 	var derBytes []byte
+	var issuerChain [][]byte
 	var err error
 	if config.IsRootNode() {
 		log.Print("This is a root node, generating self-signed certificate")
-		derBytes, err = certificateForPublicKey("", &privateKey.PublicKey)
+		derBytes, err = certificateForPublicKey("", &privateKey.PublicKey, TWO_WEEKS, true)
 		if err != nil {
-			log.Fatalf("Unable to generate self-signed certificate: %s", err)
+			return fmt.Errorf("Unable to generate self-signed certificate: %s", err)
 		}
+	} else if config.IsRelay() {
+		return fmt.Errorf("Relay nodes only run with a certificate provisioned by their operator")
 	} else {
 		log.Print("We have a parent, requesting a certificate from parent")
-		publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+		csrBytes, err := certificateRequestFor(privateKey)
 		if err != nil {
-			log.Fatalf("Unable to get DER encoded bytes for public key: %s", err)
+			return fmt.Errorf("Unable to create certificate signing request: %s", err)
+		}
+		var issued []byte
+		if config.EnrollAsMaster() {
+			issued, err = Enroller.EnrollAsMaster(csrBytes)
+		} else {
+			issued, err = Enroller.RequestCertificate(csrBytes)
 		}
-		_, err = requestCertFromParent(publicKeyBytes)
 		if err != nil {
-			log.Fatalf("Unable to request certificate from parent: %s", err)
+			// The certificate may still arrive over the signaling channel (see
+			// InstallCertificate())
+			log.Printf("Unable to request certificate from parent, waiting for one over the signaling channel: %s", err)
+			return nil
+		}
+		if derBytes, issuerChain, err = decodeIssued(issued); err != nil {
+			return fmt.Errorf("Unable to decode certificate from parent: %s", err)
 		}
 	}
 
-	saveCertificate(derBytes)
-
-	// Notify anyone waiting for a cert
-	for _, waitingForCert := range waitingForCerts {
-		waitingForCert <- certificate
+	if err := saveCertificate(derBytes, issuerChain); err != nil {
+		return err
 	}
+	notifyWaitingForCerts()
+	return nil
 }
 
 /*
-Same as certificateForPublicKey(), with the public key supplied as the DER bytes.
+InstallCertificate() installs a certificate and its chain (see chain.go) that
+were obtained from our parent through some other channel than HTTPS, for
+example the signaling channel.  The certificate has to be for our public key.
 */
-func certificateForBytes(email string, publicKeyBytes []byte) ([]byte, error) {
-	publicKey, err := x509.ParsePKIXPublicKey(publicKeyBytes)
+func InstallCertificate(derBytes []byte, issuerChain [][]byte) error {
+	cert, err := x509.ParseCertificate(derBytes)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	switch pk := publicKey.(type) {
-	case *rsa.PublicKey:
-		certificateBytes, err := certificateForPublicKey(email, pk)
-		if err != nil {
-			return nil, err
+	ownKey := PrivateKey()
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok || publicKey.N.Cmp(ownKey.PublicKey.N) != 0 || publicKey.E != ownKey.PublicKey.E {
+		return fmt.Errorf("Certificate isn't for our public key")
+	}
+	if parentCertificate := parentCert(); parentCertificate != nil {
+		if err := cert.CheckSignatureFrom(parentCertificate); err != nil {
+			return fmt.Errorf("Certificate wasn't issued by our parent: %s", err)
 		}
-		return certificateBytes, nil
-	default:
-		return nil, fmt.Errorf("Unsupported key type: %s", reflect.TypeOf(pk))
 	}
-}
 
-/*
-certificateForPublicKey() creates a certificate from the given public key,
-returning DER bytes for the Certificate.  The supplied email is encrypted and
-stored as the common name so that the issuer can associate this certificate
-with the email address later on, without exposing the email address to other
-clients.
-*/
-func certificateForPublicKey(email string, publicKey *rsa.PublicKey) ([]byte, error) {
-	encryptedEmail, err := Encrypt(email)
-	if err != nil {
-		return nil, err
+	certMutex.Lock()
+	defer certMutex.Unlock()
+	if err := saveCertificate(derBytes, issuerChain); err != nil {
+		return err
 	}
-	now := time.Now()
-
-	template := x509.Certificate{
-		SerialNumber: new(big.Int).SetInt64(int64(time.Now().Nanosecond())),
-		Subject: pkix.Name{
-			Organization: []string{"Lantern Network"},
-			CommonName:   encryptedEmail,
-		},
-		NotBefore: now.Add(-1 * ONE_WEEK),
-		NotAfter:  now.Add(TWO_WEEKS),
+	trust(certificate, TRUST_OWN)
+	notifyWaitingForCerts()
+	return nil
+}
 
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-		IsCA: true,
+// notifyWaitingForCerts() notifies anyone waiting for a cert.  certMutex must
+// be held.
+func notifyWaitingForCerts() {
+	for _, waitingForCert := range waitingForCerts {
+		waitingForCert <- certificate
 	}
+	waitingForCerts = make([]chan *x509.Certificate, 0)
+}
 
-	issuerCertificate := certificate
-	if issuerCertificate == nil {
-		log.Println("We don't have a cert, self-signing using template")
-		// Note - for self-signed certificates, we include the host's external IP address
-		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
-		issuerCertificate = &template
-	}
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, issuerCertificate, publicKey, privateKey)
-	if err != nil {
-		return nil, err
-	}
-	return derBytes, nil
+/*
+CertificateRequest() creates a PKCS#10 certificate signing request for our
+public key, signed by our private key so that parents can verify that we
+actually possess it.  Returns the DER bytes of the CSR.
+*/
+func CertificateRequest() ([]byte, error) {
+	return certificateRequestFor(PrivateKey())
 }
 
-// saveCertificate() saves our certificate to disk
-func saveCertificate(derBytes []byte) {
-	certOut, err := os.Create(CertificateFile)
-	if err != nil {
-		log.Fatalf("Failed to open %s for writing: %s", CertificateFile, err)
+// certificateRequestFor() creates a CSR like CertificateRequest() for the given
+// private key.
+func certificateRequestFor(key *rsa.PrivateKey) ([]byte, error) {
+	template := &x509.CertificateRequest{
+		Subject:            pkix.Name{Organization: []string{"Lantern Network"}},
+		SignatureAlgorithm: x509.SHA256WithRSA,
 	}
-	pem.Encode(certOut, &pem.Block{Type: PEM_HEADER_CERTIFICATE, Bytes: derBytes})
-	certOut.Close()
-	log.Printf("Wrote certificate to %s", CertificateFile)
+	return x509.CreateCertificateRequest(rand.Reader, template, key)
+}
 
-	certificate, err = x509.ParseCertificate(derBytes)
+/*
+saveCertificate() makes the given certificate and its chain ours and saves them
+to Store.  A chain that doesn't check out is dropped, since the certificate
+still works with peers that trust our parent.  If saving fails, we keep using
+the certificate from memory and request a new one after a restart.  certMutex
+must be held.
+*/
+func saveCertificate(derBytes []byte, issuerChain [][]byte) error {
+	cert, err := x509.ParseCertificate(derBytes)
 	if err != nil {
-		log.Fatalf("Failed to parse der bytes into Certificate: %s", err)
+		return fmt.Errorf("Failed to parse der bytes into Certificate: %s", err)
+	}
+	if err := checkChain(cert, issuerChain); err != nil {
+		log.Printf("Dropping the chain of our certificate: %s", err)
+		issuerChain = nil
+	}
+	certificate = cert
+	chain = issuerChain
+	if err := Store.SaveCertificate(derBytes, issuerChain); err != nil {
+		log.Printf("Unable to save certificate, only keeping it in memory: %s", err)
+	}
+	if config.InviteToken() != "" {
+		// Our invite is used up (see invites.go)
+		config.SetInviteToken("")
 	}
+	return nil
 }
@@ -0,0 +1,128 @@
+package keys
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+/*
+A KeyStore persists our private key and certificate.  Store is the KeyStore in
+use: a fileKeyStore in [config.ConfigDir]/keys/own, or for ephemeral nodes an
+ephemeralKeyStore that never touches the disk.  Tests can replace it with a
+mock.
+*/
+type KeyStore interface {
+	// LoadPrivateKey() returns the stored private key, or an error if there
+	// isn't a usable one.
+	LoadPrivateKey() (*rsa.PrivateKey, error)
+
+	// SavePrivateKey() stores the given private key.
+	SavePrivateKey(privateKey *rsa.PrivateKey) error
+
+	// LoadCertificate() returns the stored certificate and its chain (see
+	// chain.go), or an error if there isn't a usable certificate.
+	LoadCertificate() (*x509.Certificate, [][]byte, error)
+
+	// SaveCertificate() stores the certificate with the given DER bytes and
+	// its chain.
+	SaveCertificate(derBytes []byte, chain [][]byte) error
+}
+
+// fileKeyStore keeps our private key and certificate in PEM files.
+type fileKeyStore struct {
+	privateKeyFile  string // the location of our private key on disk
+	certificateFile string // the location of our certificate on disk
+}
+
+/*
+ephemeralKeyStore keeps nothing.  The private key can be injected as PEM via
+the LANTERN_PRIVATE_KEY environment variable, otherwise a fresh one is
+generated on every boot.
+*/
+type ephemeralKeyStore struct{}
+
+// Store is the KeyStore that keeps our private key and certificate.
+var Store KeyStore
+
+func (store *fileKeyStore) LoadPrivateKey() (*rsa.PrivateKey, error) {
+	privateKeyData, err := ioutil.ReadFile(store.privateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read private key file from disk")
+	}
+	block, _ := pem.Decode(privateKeyData)
+	if block == nil {
+		return nil, fmt.Errorf("Unable to decode PEM encoded private key data")
+	}
+	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode X509 private key data")
+	}
+	return privateKey, nil
+}
+
+func (store *fileKeyStore) SavePrivateKey(privateKey *rsa.PrivateKey) error {
+	keyOut, err := os.OpenFile(store.privateKeyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s for writing: %s", store.privateKeyFile, err)
+	}
+	defer keyOut.Close()
+	if err := pem.Encode(keyOut, &pem.Block{Type: PEM_HEADER_PRIVATE_KEY, Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}); err != nil {
+		return fmt.Errorf("Unable to PEM encode private key: %s", err)
+	}
+	log.Printf("Wrote private key to %s", store.privateKeyFile)
+	return nil
+}
+
+func (store *fileKeyStore) LoadCertificate() (*x509.Certificate, [][]byte, error) {
+	certificateData, err := ioutil.ReadFile(store.certificateFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to read certificate file from disk: %s", err)
+	}
+	certs, err := decodePEMCertificates(certificateData)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(certs[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to decode X509 certificate data")
+	}
+	return cert, certs[1:], nil
+}
+
+func (store *fileKeyStore) SaveCertificate(derBytes []byte, chain [][]byte) error {
+	if err := ioutil.WriteFile(store.certificateFile, EncodeChain(derBytes, chain), 0644); err != nil {
+		return fmt.Errorf("Failed to write %s: %s", store.certificateFile, err)
+	}
+	log.Printf("Wrote certificate to %s", store.certificateFile)
+	return nil
+}
+
+func (store *ephemeralKeyStore) LoadPrivateKey() (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(os.Getenv("LANTERN_PRIVATE_KEY")))
+	if block == nil {
+		return nil, fmt.Errorf("No private key injected for ephemeral node")
+	}
+	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		// Silently generating a different identity would be worse
+		log.Fatalf("Unable to decode injected private key: %s", err)
+	}
+	return privateKey, nil
+}
+
+func (store *ephemeralKeyStore) SavePrivateKey(privateKey *rsa.PrivateKey) error {
+	return nil
+}
+
+func (store *ephemeralKeyStore) LoadCertificate() (*x509.Certificate, [][]byte, error) {
+	return nil, nil, fmt.Errorf("Ephemeral node")
+}
+
+func (store *ephemeralKeyStore) SaveCertificate(derBytes []byte, chain [][]byte) error {
+	return nil
+}
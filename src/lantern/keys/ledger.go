@@ -0,0 +1,317 @@
+package keys
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"lantern/config"
+	"lantern/ui"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+The issuance ledger records the certificates that we issue for emails by
+device, so that we can limit how many devices of the same email hold our
+certificates (see config.EnrollmentPolicy()).  Devices are told apart by their
+NodeID (see nodeid.go), so repeated requests and renewals don't count as new
+devices, and neither do key rotations (see Rotate()), since the renewal for the
+new key replaces the old certificate, which is revoked (see retireRenewed()).
+Revoked certificates can't be renewed.  A device is active as long as its
+latest certificate hasn't expired or been revoked (see Revoke()).  Certificates
+that aren't tied to an email, like master-level and provisioned ones, aren't
+limited.
+
+When an email that already has MaxDevices active devices asks for a
+certificate for another one, what happens depends on OnExcess:
+
+- config.EXCESS_REJECT (the default) - the request is refused
+- config.EXCESS_REVOKE_OLDEST - the certificates of the devices that got theirs
+  first are revoked to make room
+- config.EXCESS_APPROVE - the device is held, and requests for it are answered
+  with STATUS_PENDING until our operator approves or rejects it.  Once
+  approved, the device gets its certificate the next time it asks with the
+  same key, without authenticating again (children keep asking over the
+  signaling channel, see package lantern/issuance).  Held devices are
+  forgotten after ENROLLMENT_TIMEOUT.
+
+The ledger is kept in [config.ConfigDir]/keys/ledger.json, without the entries
+of expired certificates.  At http://[config.UIAddress()]/admin/devices, GET
+lists the active and held devices and POST with the form values node and
+approve approves or rejects a held device.
+*/
+
+// Issuance is an entry of the issuance ledger.
+type Issuance struct {
+	Serial   string    // the serial number of the certificate
+	Email    string    // the email that the certificate was issued for
+	NodeID   string    // the NodeID of the device that the certificate was issued to
+	IssuedAt time.Time // when the certificate was issued
+	NotAfter time.Time // when the certificate expires
+	Replaced bool      // whether a later certificate of the same device replaced it
+}
+
+// HeldDevice is a device beyond the limit of its email that's waiting for our
+// operator's approval.
+type HeldDevice struct {
+	Email       string    // the email that the device authenticated with
+	NodeID      string    // the NodeID of the device
+	RequestedAt time.Time // when the device first asked
+	Approved    bool      // whether our operator approved the device
+	rejected    bool      // whether our operator rejected the device
+}
+
+// DeviceList is what /admin/devices shows.
+type DeviceList struct {
+	Active []Issuance   // the latest certificates of active devices, oldest first
+	Held   []HeldDevice // the devices that are waiting for approval
+}
+
+var (
+	ledgerFile  = config.ConfigDir + "/keys/ledger.json" // where the issuance ledger is kept
+	ledger      = make([]*Issuance, 0)                   // the issuance ledger
+	heldDevices = make(map[string]*HeldDevice)           // devices waiting for approval, by NodeID
+	ledgerMutex sync.Mutex                               // used to synchronize access to ledger and heldDevices
+)
+
+func init() {
+	loadLedger()
+	ui.HandleFunc("/admin/devices", devicesHandler)
+}
+
+/*
+admitDevice() applies config.EnrollmentPolicy() to a request for a certificate
+for the given email and CSR, returning an IssueError if no certificate may be
+issued for it (yet).
+*/
+func admitDevice(email string, csrBytes []byte) error {
+	policy := config.EnrollmentPolicy()
+	if policy.MaxDevices <= 0 {
+		return nil
+	}
+	nodeID, err := nodeIDOfCSR(csrBytes)
+	if err != nil {
+		// certificateForCSR() will refuse it
+		return nil
+	}
+
+	ledgerMutex.Lock()
+	defer ledgerMutex.Unlock()
+	others := make([]*Issuance, 0)
+	for _, device := range activeDevices() {
+		if device.Email == email && device.NodeID != nodeID {
+			others = append(others, device)
+		}
+	}
+	if len(others) < policy.MaxDevices {
+		return nil
+	}
+	switch policy.OnExcess {
+	case config.EXCESS_REVOKE_OLDEST:
+		for _, device := range others[:len(others)-policy.MaxDevices+1] {
+			if err := Revoke(device.Serial); err != nil {
+				return &IssueError{500, fmt.Sprintf("Unable to revoke certificate of oldest device: %s", err)}
+			}
+			log.Printf("Revoked certificate %s of device %s to make room for another device of %s", device.Serial, ShortNodeID(device.NodeID), email)
+		}
+		return nil
+	case config.EXCESS_APPROVE:
+		if _, found := heldDevices[nodeID]; !found {
+			heldDevices[nodeID] = &HeldDevice{Email: email, NodeID: nodeID, RequestedAt: time.Now()}
+			log.Printf("New device %s of %s is waiting for approval", ShortNodeID(nodeID), email)
+		}
+		return &IssueError{STATUS_PENDING, "Waiting for operator approval"}
+	default:
+		return &IssueError{403, fmt.Sprintf("Certificates were already issued to %d devices of this email", len(others))}
+	}
+}
+
+/*
+releaseHeldDevice() looks up the held device that the given CSR is for.
+Returns the email of the device once it's been approved, an IssueError while it
+waits or if it was rejected, and whether there's a held device at all.
+*/
+func releaseHeldDevice(csrBytes []byte) (string, bool, error) {
+	nodeID, err := nodeIDOfCSR(csrBytes)
+	if err != nil {
+		return "", false, nil
+	}
+	ledgerMutex.Lock()
+	defer ledgerMutex.Unlock()
+	expireHeldDevices()
+	held, found := heldDevices[nodeID]
+	if !found {
+		return "", false, nil
+	}
+	if held.rejected {
+		delete(heldDevices, nodeID)
+		return "", true, &IssueError{403, "Device was rejected"}
+	}
+	if !held.Approved {
+		return "", true, &IssueError{STATUS_PENDING, "Waiting for operator approval"}
+	}
+	delete(heldDevices, nodeID)
+	return held.Email, true, nil
+}
+
+/*
+recordIssuance() enters the given certificate that we issued for the given
+email into the ledger, replacing the earlier certificates of the same device
+and, for renewals, the certificate that was renewed.
+*/
+func recordIssuance(email string, certBytes []byte, renewed *x509.Certificate) {
+	cert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return
+	}
+	nodeID := NodeIDOf(cert)
+	ledgerMutex.Lock()
+	defer ledgerMutex.Unlock()
+	for _, entry := range ledger {
+		if entry.Email == email && (entry.NodeID == nodeID || (renewed != nil && entry.Serial == renewed.SerialNumber.String())) {
+			entry.Replaced = true
+		}
+	}
+	ledger = append(ledger, &Issuance{
+		Serial:   cert.SerialNumber.String(),
+		Email:    email,
+		NodeID:   nodeID,
+		IssuedAt: time.Now(),
+		NotAfter: cert.NotAfter,
+	})
+	saveLedger()
+}
+
+// activeDevices() returns the ledger entries of active devices, oldest first.
+// ledgerMutex must be held.
+func activeDevices() []*Issuance {
+	now := time.Now()
+	revoked := Revocations()
+	active := make([]*Issuance, 0)
+	for _, entry := range ledger {
+		if _, isRevoked := revoked[entry.Serial]; !entry.Replaced && !isRevoked && now.Before(entry.NotAfter) {
+			active = append(active, entry)
+		}
+	}
+	sort.SliceStable(active, func(i, j int) bool {
+		return active[i].IssuedAt.Before(active[j].IssuedAt)
+	})
+	return active
+}
+
+// nodeIDOfCSR() returns the NodeID of the key that the given CSR is for,
+// checking that the CSR is signed by that key.
+func nodeIDOfCSR(csrBytes []byte) (string, error) {
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		return "", err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return "", err
+	}
+	return nodeIDFor(csr.RawSubjectPublicKeyInfo), nil
+}
+
+// Devices() lists the active and held devices.
+func Devices() *DeviceList {
+	ledgerMutex.Lock()
+	defer ledgerMutex.Unlock()
+	expireHeldDevices()
+	devices := &DeviceList{Active: make([]Issuance, 0), Held: make([]HeldDevice, 0)}
+	for _, entry := range activeDevices() {
+		devices.Active = append(devices.Active, *entry)
+	}
+	for _, held := range heldDevices {
+		if !held.rejected {
+			devices.Held = append(devices.Held, *held)
+		}
+	}
+	return devices
+}
+
+// ApproveDevice() approves (or rejects) the held device with the given NodeID.
+func ApproveDevice(nodeID string, approved bool) error {
+	ledgerMutex.Lock()
+	defer ledgerMutex.Unlock()
+	held, found := heldDevices[nodeID]
+	if !found || held.rejected {
+		return fmt.Errorf("No held device with node ID %s", nodeID)
+	}
+	// Rejected devices are kept until the device hears about it
+	held.Approved = approved
+	held.rejected = !approved
+	return nil
+}
+
+// expireHeldDevices() forgets devices that have been waiting too long.
+// ledgerMutex must be held.
+func expireHeldDevices() {
+	for nodeID, held := range heldDevices {
+		if time.Since(held.RequestedAt) > ENROLLMENT_TIMEOUT {
+			delete(heldDevices, nodeID)
+		}
+	}
+}
+
+// loadLedger() loads the issuance ledger from disk, if there is one.
+func loadLedger() {
+	if config.Ephemeral() {
+		return
+	}
+	data, err := ioutil.ReadFile(ledgerFile)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &ledger); err != nil {
+		log.Printf("Unable to load issuance ledger from %s: %s", ledgerFile, err)
+	}
+}
+
+// saveLedger() drops the entries of expired certificates from the ledger and
+// saves it to disk.  ledgerMutex must be held.
+func saveLedger() {
+	now := time.Now()
+	kept := make([]*Issuance, 0, len(ledger))
+	for _, entry := range ledger {
+		if now.Before(entry.NotAfter) {
+			kept = append(kept, entry)
+		}
+	}
+	ledger = kept
+	if config.Ephemeral() {
+		return
+	}
+	data, err := json.MarshalIndent(ledger, "", "   ")
+	if err != nil {
+		return
+	}
+	if err := ioutil.WriteFile(ledgerFile, data, 0644); err != nil {
+		log.Printf("Unable to save issuance ledger: %s", err)
+	}
+}
+
+/*
+devicesHandler() lists the active and held devices on GET and approves or
+rejects a held device on POST with the form values node and approve.
+*/
+func devicesHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		approved := req.FormValue("approve") == "true"
+		if err := ApproveDevice(req.FormValue("node"), approved); err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+	}
+	if devicesJson, err := json.MarshalIndent(Devices(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(devicesJson)
+	}
+}
@@ -0,0 +1,64 @@
+package keys
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"log"
+)
+
+/*
+A NodeID identifies a lantern node independently of its addresses, its
+connections and its certificates.  It's the hex encoded SHA-256 of the node's
+public key (its DER encoded SubjectPublicKeyInfo), truncated to NODE_ID_BYTES,
+so it stays the same across IP changes and certificate renewals, and across
+reinstalls that carry over the key (see config.PreviewMigration()), but not
+across key rotations (see Rotate()).
+
+Parents learn the NodeIDs of their children from the certificates that they
+present (NodeIDOf()), so NodeIDs can't be spoofed any more than certificates
+can.  Our own NodeID is logged at startup and prefixes all of our log lines in
+its short form (SHORT_NODE_ID_LENGTH characters).
+*/
+const (
+	NODE_ID_BYTES        = 16 // bytes of the public key's hash in a NodeID
+	SHORT_NODE_ID_LENGTH = 8  // characters of a NodeID shown in log lines
+)
+
+// NodeID() returns our NodeID.
+func NodeID() string {
+	der, err := x509.MarshalPKIXPublicKey(&PrivateKey().PublicKey)
+	if err != nil {
+		log.Printf("Unable to encode our public key: %s", err)
+		return ""
+	}
+	return nodeIDFor(der)
+}
+
+// NodeIDOf() returns the NodeID of the node that holds the given certificate.
+func NodeIDOf(cert *x509.Certificate) string {
+	return nodeIDFor(cert.RawSubjectPublicKeyInfo)
+}
+
+// ShortNodeID() returns the short form of the given NodeID, for logging.
+func ShortNodeID(nodeID string) string {
+	if len(nodeID) > SHORT_NODE_ID_LENGTH {
+		return nodeID[:SHORT_NODE_ID_LENGTH]
+	}
+	return nodeID
+}
+
+// nodeIDFor() returns the NodeID for the given DER encoded
+// SubjectPublicKeyInfo.
+func nodeIDFor(der []byte) string {
+	hash := sha256.Sum256(der)
+	return hex.EncodeToString(hash[:NODE_ID_BYTES])
+}
+
+// logNodeID() logs our NodeID and prefixes all further log lines with it.
+func logNodeID() {
+	nodeID := NodeID()
+	log.Printf("Our node ID is %s", nodeID)
+	log.SetPrefix("[" + ShortNodeID(nodeID) + "] ")
+	log.SetFlags(log.Flags() | log.Lmsgprefix)
+}
@@ -0,0 +1,156 @@
+package keys
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"lantern/audit"
+	"lantern/config"
+	"log"
+	"os"
+	"time"
+)
+
+/*
+Children trust their parent through trusted/parentcert.pem, but parents renew
+their certificates (root nodes every couple of weeks), so the parent pushes its
+new certificate down before the old one expires (see package lantern/issuance).
+
+A ParentCertUpdate carries the new certificate signed with the key of the
+certificate that the children currently trust, so children can verify it with
+VerifyFromParent() before switching over.  Children only accept certificates
+that are currently valid and that expire later than the one they have, so old
+updates can't be replayed to roll them back.  The new certificate replaces
+parentcert.pem atomically (written next to it and renamed over it).
+
+When we rotate our key (see rotation.go), our children still trust the
+certificate of the old key, so until that certificate expires updates also
+carry a PreviousSignature by the old key, which children accept instead.
+
+New children get our certificate with an invite (see invites.go).
+*/
+
+// ParentCertUpdate is a replacement for the parent certificate that children
+// trust.
+type ParentCertUpdate struct {
+	Certificate []byte // DER bytes of the new parent certificate
+	Signature   []byte // signature of Certificate by the key of the certificate being replaced
+
+	// PreviousSignature is the signature of Certificate by the key that we
+	// rotated away from, if its certificate hasn't expired yet
+	PreviousSignature []byte
+}
+
+/*
+NewParentCertUpdate() creates a ParentCertUpdate for our current certificate,
+for our children.  We keep our key when renewing our certificate, so it's
+signed by the same key as the certificate it replaces, and additionally by our
+previous key if we rotated recently.
+*/
+func NewParentCertUpdate() (*ParentCertUpdate, error) {
+	cert, _ := Certificate()
+	if cert == nil {
+		return nil, fmt.Errorf("We don't have a certificate yet")
+	}
+	signature, err := Sign(cert.Raw)
+	if err != nil {
+		return nil, err
+	}
+	update := &ParentCertUpdate{Certificate: cert.Raw, Signature: signature}
+	if previous := previousKey(); previous != nil {
+		if update.PreviousSignature, err = signWith(previous.privateKey, cert.Raw); err != nil {
+			return nil, err
+		}
+	}
+	return update, nil
+}
+
+// InstallParentCert() verifies the given update from our parent and, if it's
+// newer than the parent certificate that we trust, starts trusting it instead.
+func InstallParentCert(update *ParentCertUpdate) error {
+	current := parentCert()
+	if current == nil {
+		return fmt.Errorf("No parent certificate to verify the update with")
+	}
+	if bytes.Equal(update.Certificate, current.Raw) {
+		// Nothing new
+		return nil
+	}
+	if err := VerifyFromParent(update.Certificate, update.Signature); err != nil {
+		// Our parent may have rotated its key
+		if update.PreviousSignature == nil || VerifyFromParent(update.Certificate, update.PreviousSignature) != nil {
+			return fmt.Errorf("Signature didn't verify: %s", err)
+		}
+	}
+	cert, err := x509.ParseCertificate(update.Certificate)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("New parent certificate isn't valid now")
+	}
+	if !cert.NotAfter.After(current.NotAfter) {
+		return fmt.Errorf("New parent certificate doesn't expire later than the current one")
+	}
+	return adoptParentCert(cert)
+}
+
+/*
+SwitchParent() verifies the given update from our parent, which carries the
+certificate of another parent that we're supposed to fail over to (see package
+lantern/drain), and starts trusting that certificate as our parent's instead.
+*/
+func SwitchParent(update *ParentCertUpdate) error {
+	if err := VerifyFromParent(update.Certificate, update.Signature); err != nil {
+		return fmt.Errorf("Signature didn't verify: %s", err)
+	}
+	cert, err := x509.ParseCertificate(update.Certificate)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("Alternate parent certificate isn't valid now")
+	}
+	return adoptParentCert(cert)
+}
+
+// adoptParentCert() saves the given certificate as our parent's and starts
+// trusting it.
+func adoptParentCert(cert *x509.Certificate) error {
+	if !config.Ephemeral() {
+		if err := replaceFile(parentCertFile, pem.EncodeToMemory(&pem.Block{Type: PEM_HEADER_CERTIFICATE, Bytes: cert.Raw})); err != nil {
+			return fmt.Errorf("Unable to save parent certificate: %s", err)
+		}
+	}
+	trust(cert, TRUST_PARENT)
+	parentCertMutex.Lock()
+	defer parentCertMutex.Unlock()
+	parentCertificate = cert
+	log.Printf("Now trusting parent certificate that expires on %s", cert.NotAfter)
+	audit.Recordf(audit.EVENT_TRUST_CHANGED, fingerprint(cert), "adopted parent certificate %s, valid until %s", cert.Subject, cert.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// parentCert() returns the parent certificate that we currently trust.
+func parentCert() *x509.Certificate {
+	parentCertMutex.RLock()
+	defer parentCertMutex.RUnlock()
+	return parentCertificate
+}
+
+// replaceFile() atomically replaces the file at path with the given data.
+func replaceFile(path string, data []byte) error {
+	tmp := path + ".new"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+/*
+This file contains the pre-shared keys (PSKs) that long-paired peers can use to
+authenticate each other on the direct proxy hop if the PKI breaks, for example
+because the root was compromised or certificates were revoked en masse.
+
+PSKs are established while PKI trust is still healthy (see package
+lantern/proxy) and are stored per peer in [config.ConfigDir]/keys/trusted/psks.json
+(in memory only for ephemeral nodes).  They're never used for anything other
+than the direct proxy hop.
+
+A PSK proof binds the PSK to a specific TLS connection by MACing keying material
+exported from that connection, so proofs can't be replayed on other
+connections.
+*/
+package keys
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"lantern/audit"
+	"lantern/config"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	PSK_LENGTH      = 32                     // length of PSKs in bytes
+	PSK_EKM_LABEL   = "EXPORTER-lantern-psk" // label for the keying material that PSK proofs are bound to
+	PSK_ROLE_CLIENT = "client"               // role of the peer initiating the connection
+	PSK_ROLE_SERVER = "server"               // role of the peer accepting the connection
+)
+
+// PSKPairing is a PSK that we share with one peer.
+type PSKPairing struct {
+	ID       string    // identifies the PSK to the peer that issued it
+	Key      []byte    // the PSK itself
+	PairedAt time.Time // when the pairing was established
+}
+
+var (
+	pskFile  = config.ConfigDir + "/keys/trusted/psks.json" // where PSKs are stored
+	psks     = make(map[string]*PSKPairing)                 // PSKs by peer
+	pskMutex sync.RWMutex                                   // used to synchronize access to psks
+)
+
+func init() {
+	if !config.Ephemeral() {
+		if pskData, err := ioutil.ReadFile(pskFile); err == nil {
+			if err := json.Unmarshal(pskData, &psks); err != nil {
+				log.Printf("Unable to read PSKs from %s: %s", pskFile, err)
+			}
+		}
+	}
+}
+
+// NewPSK() generates a new PSK with the given ID for the given peer and stores
+// it.
+func NewPSK(peer string, id string) (*PSKPairing, error) {
+	key := make([]byte, PSK_LENGTH)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	pairing := &PSKPairing{ID: id, Key: key, PairedAt: time.Now()}
+	return pairing, SetPSK(peer, pairing)
+}
+
+// SetPSK() stores the given PSK for the given peer.
+func SetPSK(peer string, pairing *PSKPairing) error {
+	if len(pairing.Key) != PSK_LENGTH {
+		return fmt.Errorf("Invalid PSK length: %d", len(pairing.Key))
+	}
+	pskMutex.Lock()
+	defer pskMutex.Unlock()
+	psks[peer] = pairing
+	audit.Record(audit.EVENT_TRUST_CHANGED, peer, "paired PSK")
+	return savePSKs()
+}
+
+// PSK() returns the PSK for the given peer, if we're paired with it.
+func PSK(peer string) (*PSKPairing, bool) {
+	pskMutex.RLock()
+	defer pskMutex.RUnlock()
+	pairing, found := psks[peer]
+	return pairing, found
+}
+
+/*
+PSKProof() computes the proof that the party in the given role on the given TLS
+connection knows the given PSK.
+*/
+func PSKProof(psk []byte, state tls.ConnectionState, role string) ([]byte, error) {
+	ekm, err := state.ExportKeyingMaterial(PSK_EKM_LABEL, nil, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, psk)
+	mac.Write(ekm)
+	mac.Write([]byte(role))
+	return mac.Sum(nil), nil
+}
+
+// VerifyPSKProof() checks a proof computed by PSKProof().
+func VerifyPSKProof(psk []byte, state tls.ConnectionState, role string, proof []byte) error {
+	expected, err := PSKProof(psk, state, role)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expected, proof) {
+		return fmt.Errorf("PSK proof didn't verify")
+	}
+	return nil
+}
+
+// savePSKs() saves our PSKs to disk (unless we're ephemeral).  pskMutex must be
+// held.
+func savePSKs() error {
+	if config.Ephemeral() {
+		return nil
+	}
+	pskData, err := json.Marshal(psks)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pskFile, pskData, 0600)
+}
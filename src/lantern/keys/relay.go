@@ -0,0 +1,72 @@
+package keys
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"lantern/config"
+	"log"
+	"time"
+)
+
+/*
+Relay nodes (see config.IsRelay()) have no user, so they never acquire an
+identity through Mozilla Persona.  Instead, their operator provisions a
+master-level certificate issued by their parent in [config.ConfigDir]/keys/own,
+next to the private key that it was issued for, and renewals authenticate with
+that certificate.  Root relay nodes sign their own certificates like any other
+root node.
+
+checkRelay() refuses to start a relay node whose config and credentials don't
+fit its role, that is if:
+
+- it has an email address (see config.Email())
+- it's ephemeral or enrolls as a master, both of which acquire a certificate at
+  runtime
+- it isn't a root node and doesn't have a provisioned certificate that's for
+  our private key, issued by our parent, master-level and not expired
+*/
+func checkRelay() {
+	if err := relayInconsistency(); err != nil {
+		log.Fatalf("Refusing to start as a relay: %s", err)
+	}
+}
+
+// relayInconsistency() returns what doesn't fit the relay role, if anything.
+func relayInconsistency() error {
+	if config.Email() != "" {
+		return fmt.Errorf("Relay nodes have no email address, but %s is configured", config.Email())
+	}
+	if config.Ephemeral() {
+		return fmt.Errorf("Relay nodes need a provisioned certificate, which ephemeral nodes can't keep")
+	}
+	if config.EnrollAsMaster() {
+		return fmt.Errorf("Relay nodes use provisioned certificates and don't enroll as masters")
+	}
+	cert, provisionedChain, err := Store.LoadCertificate()
+	if err != nil {
+		if config.IsRootNode() {
+			// We'll sign our own
+			return nil
+		}
+		return fmt.Errorf("No provisioned certificate: %s", err)
+	}
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok || publicKey.N.Cmp(privateKey.PublicKey.N) != 0 || publicKey.E != privateKey.PublicKey.E {
+		return fmt.Errorf("Provisioned certificate isn't for our private key")
+	}
+	if !IsMaster(cert) {
+		return fmt.Errorf("Provisioned certificate isn't a master-level certificate")
+	}
+	if time.Now().After(cert.NotAfter) {
+		return fmt.Errorf("Provisioned certificate expired at %s", cert.NotAfter)
+	}
+	if parentCertificate := parentCert(); parentCertificate != nil {
+		if err := cert.CheckSignatureFrom(parentCertificate); err != nil {
+			return fmt.Errorf("Provisioned certificate wasn't issued by our parent: %s", err)
+		}
+	}
+	if err := checkChain(cert, provisionedChain); err != nil {
+		return fmt.Errorf("Provisioned certificate chain is invalid: %s", err)
+	}
+	return nil
+}
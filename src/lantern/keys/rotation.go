@@ -0,0 +1,389 @@
+package keys
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"lantern/config"
+	"lantern/ui"
+	"lantern/util"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Rotate() replaces our private key with a fresh one while keeping our identity.
+Root nodes self-sign a certificate for the new key, other nodes renew their
+current certificate for the new key with their parent, which carries over the
+email and role of the old one (see ReissueCertificate()).  Our listeners pick up
+the new key and certificate with the next handshake (see GetCertificate()).
+
+The old key is archived in [config.ConfigDir]/keys/own/archive together with
+its last certificate, so that we can still:
+
+- decrypt the common names of certificates that we issued with it (see
+  Decrypt())
+- renew, verify and answer status queries for the certificates of our children
+  that it issued, until its certificate expires (see issuedByUs())
+- have our children switch over to our new certificate, since they still trust
+  the old one (see ParentCertUpdate)
+
+Our NodeID is derived from our public key, so it changes with every rotation.
+
+The archive is bounded: we keep at most MAX_ARCHIVED_KEYS keys, and forget
+(and delete) those whose certificate expired more than ARCHIVED_KEY_RETENTION
+ago, by which time the certificates that they issued with the usual validity
+(TWO_WEEKS) have expired too.
+
+Keys are rotated by keyRotator() once they're older than
+config.KeyRotationDays() (if set) and on demand with a POST to
+http://[config.UIAddress()]/admin/keys/rotate, where GET shows when our current
+key was created and which keys have been archived.  Ephemeral nodes don't
+rotate, their key lives no longer than they do.
+*/
+const (
+	KEY_ROTATION_CHECK_INTERVAL = 1 * time.Hour // how often keyRotator() checks whether our key is due for rotation
+	MAX_ARCHIVED_KEYS           = 16            // the most keys that we keep in the archive
+	ARCHIVED_KEY_RETENTION      = TWO_WEEKS     // how long we keep archived keys after their certificate expired
+)
+
+// archivedKey is a private key that we rotated away from, with the last
+// certificate that we had for it.
+type archivedKey struct {
+	privateKey  *rsa.PrivateKey
+	certificate *x509.Certificate
+	archived    time.Time
+}
+
+// RotationStatus describes our current key and the ones that we rotated away
+// from.
+type RotationStatus struct {
+	NodeID       string      // our current NodeID
+	KeyCreated   time.Time   // when our current key was created
+	RotationDays int         // after how many days we rotate (see config.KeyRotationDays())
+	Archived     []time.Time // when we rotated away from our previous keys, newest first
+}
+
+var (
+	archivePath   = config.ConfigDir + "/keys/own/archive/" // where the keys that we rotated away from are kept
+	archived      = make([]*archivedKey, 0)                 // the keys that we rotated away from, newest first
+	archiveMutex  sync.RWMutex                              // used to synchronize access to archived
+	rotationMutex sync.Mutex                                // keeps rotations and renewals from running at the same time
+)
+
+func init() {
+	loadArchivedKeys()
+	ui.HandleFunc("/admin/keys/rotate", rotateHandler)
+	if !config.Ephemeral() {
+		util.GoLoop("key rotator", keyRotator)
+	}
+}
+
+// Rotate() replaces our private key and certificate with new ones for the same
+// identity, archiving the old ones.
+func Rotate() error {
+	if config.Ephemeral() {
+		return fmt.Errorf("Ephemeral nodes don't rotate their key")
+	}
+	rotationMutex.Lock()
+	defer rotationMutex.Unlock()
+	certMutex.RLock()
+	oldKey, oldCert := privateKey, certificate
+	certMutex.RUnlock()
+	if oldCert == nil {
+		return fmt.Errorf("We don't have a certificate to carry over to a new key yet")
+	}
+
+	newKey, err := rsa.GenerateKey(rand.Reader, KEY_BITS)
+	if err != nil {
+		return fmt.Errorf("Unable to generate private key: %s", err)
+	}
+	derBytes, issuerChain, err := certificateForNewKey(newKey)
+	if err != nil {
+		return fmt.Errorf("Unable to obtain certificate for new key: %s", err)
+	}
+
+	certMutex.Lock()
+	if err := archiveKey(oldKey, oldCert); err != nil {
+		// Without the old key, we'd lose track of what it issued
+		certMutex.Unlock()
+		return fmt.Errorf("Unable to archive old key: %s", err)
+	}
+	if err := Store.SavePrivateKey(newKey); err != nil {
+		certMutex.Unlock()
+		return fmt.Errorf("Unable to save new key: %s", err)
+	}
+	privateKey = newKey
+	err = saveCertificate(derBytes, issuerChain)
+	if err == nil {
+		trust(certificate, TRUST_OWN)
+	}
+	certMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	log.Print("Rotated our private key")
+	logNodeID()
+	return nil
+}
+
+/*
+certificateForNewKey() obtains a certificate for the given new key, self-signed
+if we're a root node and otherwise renewed by our parent.  Returns the DER bytes
+of the certificate and its chain.
+*/
+func certificateForNewKey(newKey *rsa.PrivateKey) ([]byte, [][]byte, error) {
+	if config.IsRootNode() {
+		derBytes, err := certificateSignedBy("", &newKey.PublicKey, TWO_WEEKS, true, nil, newKey)
+		return derBytes, nil, err
+	}
+
+	csrBytes, err := certificateRequestFor(newKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The renewal presents our current certificate, which proves our identity
+	issued, err := Enroller.RenewCertificate(csrBytes, time.Now().Add(RENEWAL_TIMEOUT))
+	if err != nil {
+		return nil, nil, err
+	}
+	derBytes, issuerChain, err := decodeIssued(issued)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok || publicKey.N.Cmp(newKey.PublicKey.N) != 0 || publicKey.E != newKey.PublicKey.E {
+		return nil, nil, fmt.Errorf("Certificate from parent isn't for our new key")
+	}
+	return derBytes, issuerChain, nil
+}
+
+// archiveStore() returns the KeyStore for the key that was archived at the
+// given time.
+func archiveStore(stamp string) *fileKeyStore {
+	return &fileKeyStore{
+		privateKeyFile:  archivePath + stamp + "-privatekey.pem",
+		certificateFile: archivePath + stamp + "-certificate.pem",
+	}
+}
+
+// archiveKey() saves the given key and certificate to the archive and keeps
+// them around for as long as we run.
+func archiveKey(key *rsa.PrivateKey, cert *x509.Certificate) error {
+	if err := os.MkdirAll(archivePath, 0700); err != nil {
+		return err
+	}
+	now := time.Now()
+	store := archiveStore(strconv.FormatInt(now.Unix(), 10))
+	if err := store.SavePrivateKey(key); err != nil {
+		return err
+	}
+	if err := store.SaveCertificate(cert.Raw, nil); err != nil {
+		return err
+	}
+	archiveMutex.Lock()
+	defer archiveMutex.Unlock()
+	archived = append([]*archivedKey{{privateKey: key, certificate: cert, archived: now}}, archived...)
+	pruneArchive()
+	return nil
+}
+
+/*
+pruneArchive() forgets and deletes the archived keys beyond MAX_ARCHIVED_KEYS
+and those whose certificate expired more than ARCHIVED_KEY_RETENTION ago.
+archiveMutex must be held.
+*/
+func pruneArchive() {
+	kept := make([]*archivedKey, 0, len(archived))
+	for _, key := range archived {
+		if len(kept) < MAX_ARCHIVED_KEYS && time.Since(key.certificate.NotAfter) < ARCHIVED_KEY_RETENTION {
+			kept = append(kept, key)
+			continue
+		}
+		store := archiveStore(strconv.FormatInt(key.archived.Unix(), 10))
+		for _, file := range []string{store.privateKeyFile, store.certificateFile} {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				log.Printf("Unable to delete archived key file %s: %s", file, err)
+			}
+		}
+		log.Printf("Forgot the key that we rotated away from at %s", key.archived.Format(time.RFC3339))
+	}
+	archived = kept
+}
+
+// loadArchivedKeys() loads the keys that we rotated away from in earlier runs
+// and keeps trusting their certificates until they expire.
+func loadArchivedKeys() {
+	if config.Ephemeral() {
+		return
+	}
+	files, err := filepath.Glob(archivePath + "*-privatekey.pem")
+	if err != nil {
+		return
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(files)))
+	for _, file := range files {
+		stamp := strings.TrimSuffix(filepath.Base(file), "-privatekey.pem")
+		seconds, err := strconv.ParseInt(stamp, 10, 64)
+		if err != nil {
+			continue
+		}
+		store := archiveStore(stamp)
+		key, err := store.LoadPrivateKey()
+		if err != nil {
+			log.Printf("Unable to load archived key %s: %s", file, err)
+			continue
+		}
+		cert, _, err := store.LoadCertificate()
+		if err != nil {
+			log.Printf("Unable to load certificate of archived key %s: %s", file, err)
+			continue
+		}
+		archived = append(archived, &archivedKey{privateKey: key, certificate: cert, archived: time.Unix(seconds, 0)})
+		if time.Now().Before(cert.NotAfter) {
+			trust(cert, TRUST_OWN)
+		}
+	}
+	archiveMutex.Lock()
+	defer archiveMutex.Unlock()
+	pruneArchive()
+}
+
+// archivedKeys() returns the keys that we rotated away from, newest first.
+func archivedKeys() []*archivedKey {
+	archiveMutex.RLock()
+	defer archiveMutex.RUnlock()
+	return append([]*archivedKey{}, archived...)
+}
+
+// previousKey() returns the key that we last rotated away from if its
+// certificate hasn't expired yet, otherwise nil.
+func previousKey() *archivedKey {
+	keys := archivedKeys()
+	if len(keys) == 0 || time.Now().After(keys[0].certificate.NotAfter) {
+		return nil
+	}
+	return keys[0]
+}
+
+/*
+issuedByUs() checks that the given certificate was issued by our current
+certificate or by the unexpired certificate of a key that we rotated away from.
+*/
+func issuedByUs(cert *x509.Certificate) error {
+	certMutex.RLock()
+	own := certificate
+	certMutex.RUnlock()
+	if own == nil {
+		return fmt.Errorf("We don't have a certificate of our own yet")
+	}
+	err := cert.CheckSignatureFrom(own)
+	if err == nil {
+		return nil
+	}
+	for _, previous := range archivedKeys() {
+		if time.Now().Before(previous.certificate.NotAfter) && cert.CheckSignatureFrom(previous.certificate) == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+/*
+ownKeyFor() returns our private key that belongs to the certificate with the
+given fingerprint, which is our current key unless the certificate is that of
+an archived key.
+*/
+func ownKeyFor(certFingerprint string) *rsa.PrivateKey {
+	for _, previous := range archivedKeys() {
+		if fingerprint(previous.certificate) == certFingerprint {
+			return previous.privateKey
+		}
+	}
+	return PrivateKey()
+}
+
+// isOwnCertificate() indicates whether the given certificate is our current
+// one or that of an archived key.
+func isOwnCertificate(cert *x509.Certificate) bool {
+	certMutex.RLock()
+	own := certificate
+	certMutex.RUnlock()
+	if own != nil && own.Equal(cert) {
+		return true
+	}
+	for _, previous := range archivedKeys() {
+		if previous.certificate.Equal(cert) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyRotator() rotates our key whenever it gets older than
+// config.KeyRotationDays(), and prunes the archive.
+func keyRotator() {
+	for {
+		time.Sleep(KEY_ROTATION_CHECK_INTERVAL)
+		archiveMutex.Lock()
+		pruneArchive()
+		archiveMutex.Unlock()
+		days := config.KeyRotationDays()
+		if days > 0 && time.Since(keyCreated()) > time.Duration(days)*ONE_DAY {
+			log.Printf("Our key is older than %d days, rotating it", days)
+			if err := Rotate(); err != nil {
+				log.Printf("Unable to rotate key, will retry in %s: %s", KEY_ROTATION_CHECK_INTERVAL, err)
+			}
+		}
+	}
+}
+
+// keyCreated() returns when our current key was created, which is when it was
+// last written to disk (now if we can't tell).
+func keyCreated() time.Time {
+	info, err := os.Stat(PrivateKeyFile)
+	if err != nil {
+		return time.Now()
+	}
+	return info.ModTime()
+}
+
+// rotateHandler() rotates our key on POST and describes our keys.
+func rotateHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		if err := Rotate(); err != nil {
+			resp.WriteHeader(500)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+	}
+	status := &RotationStatus{
+		NodeID:       NodeID(),
+		KeyCreated:   keyCreated(),
+		RotationDays: config.KeyRotationDays(),
+		Archived:     make([]time.Time, 0),
+	}
+	for _, previous := range archivedKeys() {
+		status.Archived = append(status.Archived, previous.archived)
+	}
+	if statusJson, err := json.MarshalIndent(status, "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(statusJson)
+	}
+}
@@ -0,0 +1,89 @@
+package keys
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	_ "lantern/client/ephemeral"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+TestEncryptDuringRotation encrypts, decrypts and signs while our private key is
+swapped the way Rotate() swaps it.  Run it with -race.
+*/
+func TestEncryptDuringRotation(t *testing.T) {
+	certMutex.RLock()
+	original := privateKey
+	certMutex.RUnlock()
+	rotated, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		certMutex.Lock()
+		privateKey = original
+		certMutex.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			certMutex.Lock()
+			if i%2 == 0 {
+				privateKey = rotated
+			} else {
+				privateKey = original
+			}
+			certMutex.Unlock()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if _, err := Encrypt("user@example.com"); err != nil {
+				t.Error(err)
+			}
+			if _, err := Sign([]byte("data")); err != nil {
+				t.Error(err)
+			}
+			NodeID()
+		}
+	}()
+	wg.Wait()
+}
+
+// TestPruneArchive checks that the archive keeps at most MAX_ARCHIVED_KEYS
+// keys and drops those whose certificate expired long enough ago.
+func TestPruneArchive(t *testing.T) {
+	archiveMutex.Lock()
+	defer archiveMutex.Unlock()
+	original := archived
+	defer func() {
+		archived = original
+	}()
+
+	now := time.Now()
+	archived = make([]*archivedKey, 0)
+	for i := 0; i < MAX_ARCHIVED_KEYS+2; i++ {
+		archived = append(archived, &archivedKey{certificate: &x509.Certificate{NotAfter: now}, archived: now.Add(-time.Duration(i) * time.Hour)})
+	}
+	pruneArchive()
+	if len(archived) != MAX_ARCHIVED_KEYS {
+		t.Errorf("Expected %d archived keys, got %d", MAX_ARCHIVED_KEYS, len(archived))
+	}
+
+	expired := now.Add(-ARCHIVED_KEY_RETENTION - time.Hour)
+	archived = []*archivedKey{
+		{certificate: &x509.Certificate{NotAfter: now}, archived: now},
+		{certificate: &x509.Certificate{NotAfter: expired}, archived: expired},
+	}
+	pruneArchive()
+	if len(archived) != 1 || !archived[0].certificate.NotAfter.Equal(now) {
+		t.Errorf("Expected only the unexpired key to remain, got %d keys", len(archived))
+	}
+}
@@ -0,0 +1,217 @@
+package keys
+
+import (
+	"crypto/x509"
+	"lantern/config"
+	"lantern/util"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+CertState describes where our certificate is in its lifecycle:
+
+- CERT_MISSING - we don't have a certificate yet
+- CERT_VALID - the certificate is valid and not yet due for renewal
+- CERT_RENEWING - the certificate is due for renewal and we're renewing it
+- CERT_STALE - renewal has failed so far, but the certificate is still valid
+  and we keep using it while we retry
+- CERT_EXPIRED - the certificate has expired and can no longer be used
+
+Certificates become due for renewal once RENEWAL_POINT of their lifetime has
+passed.  Each renewal attempt has to complete within RENEWAL_TIMEOUT, and
+failed attempts are retried after RENEWAL_RETRY.  Root nodes without a usable
+certificate (for example because self-signing failed at startup) keep trying to
+self-sign one on the same schedule.
+*/
+type CertState int
+
+const (
+	CERT_MISSING CertState = iota
+	CERT_VALID
+	CERT_RENEWING
+	CERT_STALE
+	CERT_EXPIRED
+)
+
+const (
+	RENEWAL_POINT          = 2.0 / 3.0        // the fraction of a certificate's lifetime after which we renew it
+	RENEWAL_TIMEOUT        = 30 * time.Second // how long a single renewal attempt may take
+	RENEWAL_RETRY          = 5 * time.Minute  // how long to wait after a failed renewal before trying again
+	CERT_STATE_CHECK_DELAY = time.Minute      // how often the certificate's state is checked
+)
+
+var (
+	renewalFailed  = false                     // whether the last renewal attempt failed
+	nextRenewal    time.Time                   // earliest time at which to attempt the next renewal
+	stateWatchers  = make([]chan CertState, 0) // parties watching for state changes
+	stateMutex     sync.Mutex                  // used to synchronize access to the above
+	renewerStarted sync.Once                   // makes sure that we only run one certRenewer
+)
+
+func (state CertState) String() string {
+	switch state {
+	case CERT_MISSING:
+		return "missing"
+	case CERT_VALID:
+		return "valid"
+	case CERT_RENEWING:
+		return "renewing"
+	case CERT_STALE:
+		return "stale"
+	case CERT_EXPIRED:
+		return "expired"
+	}
+	return "unknown"
+}
+
+// Usable() indicates whether a certificate in this state can still be used.
+func (state CertState) Usable() bool {
+	return state == CERT_VALID || state == CERT_RENEWING || state == CERT_STALE
+}
+
+// CertificateState() returns the current state of our certificate.
+func CertificateState() CertState {
+	certMutex.RLock()
+	cert := certificate
+	certMutex.RUnlock()
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	return stateOf(cert, time.Now())
+}
+
+/*
+WatchCertificateState() registers a channel that receives our certificate's
+state whenever it changes.  Sends don't block, so slow watchers may miss
+intermediate states.
+*/
+func WatchCertificateState(ch chan CertState) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	stateWatchers = append(stateWatchers, ch)
+}
+
+// stateOf() computes the state of the given certificate at the given time.
+// stateMutex must be held.
+func stateOf(cert *x509.Certificate, now time.Time) CertState {
+	if cert == nil {
+		return CERT_MISSING
+	} else if now.After(cert.NotAfter) {
+		return CERT_EXPIRED
+	} else if now.Before(renewalDue(cert)) {
+		return CERT_VALID
+	} else if renewalFailed {
+		return CERT_STALE
+	}
+	return CERT_RENEWING
+}
+
+// renewalDue() returns the time at which the given certificate is due for
+// renewal.  The backdating of our certificates (see backdatingOf()) doesn't
+// count toward their lifetime.
+func renewalDue(cert *x509.Certificate) time.Time {
+	start := cert.NotBefore.Add(backdatingOf(cert))
+	lifetime := cert.NotAfter.Sub(start)
+	return start.Add(time.Duration(float64(lifetime) * RENEWAL_POINT))
+}
+
+/*
+certRenewer() starts the supervised goroutine that periodically checks our
+certificate (see renewCertificates()), unless it's already running.
+*/
+func certRenewer() {
+	renewerStarted.Do(func() {
+		util.GoLoop("certificate renewer", renewCertificates)
+	})
+}
+
+// renewCertificates() periodically checks our certificate, renews it when it's
+// due and notifies watchers of state changes.
+func renewCertificates() {
+	lastState := CertificateState()
+	for {
+		now := time.Now()
+		state := CertificateState()
+		stateMutex.Lock()
+		// Root nodes can always self-sign, even if they failed to
+		// initialize their certificate
+		renewable := state == CERT_RENEWING || state == CERT_STALE || (!state.Usable() && config.IsRootNode())
+		due := renewable && !now.Before(nextRenewal)
+		stateMutex.Unlock()
+		if due {
+			if err := renewCertificate(); err != nil {
+				log.Printf("Unable to renew certificate, will retry in %s: %s", RENEWAL_RETRY, err)
+				stateMutex.Lock()
+				renewalFailed = true
+				nextRenewal = now.Add(RENEWAL_RETRY)
+				stateMutex.Unlock()
+			} else {
+				log.Print("Renewed certificate")
+				stateMutex.Lock()
+				renewalFailed = false
+				stateMutex.Unlock()
+			}
+			state = CertificateState()
+		}
+		if state != lastState {
+			log.Printf("Certificate is now %s", state)
+			notifyStateWatchers(state)
+			lastState = state
+		}
+		time.Sleep(CERT_STATE_CHECK_DELAY)
+	}
+}
+
+func notifyStateWatchers(state CertState) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	for _, watcher := range stateWatchers {
+		select {
+		case watcher <- state:
+		default:
+		}
+	}
+}
+
+/*
+renewCertificate() renews our certificate, either by self-signing a new one (if
+we're a root node) or by asking our parent to renew it within RENEWAL_TIMEOUT.
+Until renewal succeeds, we keep using the existing certificate.
+*/
+func renewCertificate() error {
+	// A renewal for our old key must not overwrite a rotation (see rotation.go)
+	rotationMutex.Lock()
+	defer rotationMutex.Unlock()
+	if config.IsRootNode() {
+		certMutex.Lock()
+		defer certMutex.Unlock()
+		derBytes, err := certificateForPublicKey("", &privateKey.PublicKey, TWO_WEEKS, true)
+		if err != nil {
+			return err
+		}
+		if err := saveCertificate(derBytes, nil); err != nil {
+			return err
+		}
+		notifyWaitingForCerts()
+		return nil
+	}
+
+	csrBytes, err := CertificateRequest()
+	if err != nil {
+		return err
+	}
+	// Don't hold certMutex while talking to our parent, since the request
+	// presents our current certificate
+	issued, err := Enroller.RenewCertificate(csrBytes, time.Now().Add(RENEWAL_TIMEOUT))
+	if err != nil {
+		return err
+	}
+	derBytes, issuerChain, err := decodeIssued(issued)
+	if err != nil {
+		return err
+	}
+	certMutex.Lock()
+	defer certMutex.Unlock()
+	return saveCertificate(derBytes, issuerChain)
+}
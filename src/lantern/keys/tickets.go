@@ -0,0 +1,132 @@
+/*
+This file contains the TLS settings that the keys package enforces on
+connections between lantern peers in order to guarantee forward secrecy, and
+that keep handshakes between peers cheap.
+
+- Only ECDHE key exchange is allowed (TLS 1.2 with PEER_CIPHER_SUITES, or
+  TLS 1.3, whose key exchange is always ephemeral), over PEER_CURVES.
+- Session ticket keys are shared by all of this node's TLS servers and are
+  rotated every TICKET_KEY_ROTATION.  Only the last TICKET_KEYS_KEPT keys are
+  kept around for resuming sessions, so a compromised ticket key can only ever
+  expose a bounded window of traffic.
+- Our TLS clients keep the last PEER_SESSIONS_KEPT sessions with peers and
+  resume them, which saves the RSA signatures of a full handshake.  A resumed
+  handshake doesn't present certificates again, so the status of the
+  certificate of the session is checked again (see verifyResumedPeerStatus()).
+*/
+package keys
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"lantern/util"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	TICKET_KEY_ROTATION = 1 * time.Hour // how often session ticket keys are rotated
+	TICKET_KEYS_KEPT    = 2             // how many ticket keys are kept for resumption
+	PEER_SESSIONS_KEPT  = 256           // how many sessions with peers our clients keep for resumption
+)
+
+// PEER_CIPHER_SUITES are the only TLS 1.2 cipher suites that lantern peers
+// will negotiate with each other.  All of them use ECDHE key exchange.
+var PEER_CIPHER_SUITES = []uint16{
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// PEER_CURVES are the key exchanges that lantern peers prefer, fastest first
+// except for the post-quantum hybrid, which costs little on top of X25519.
+var PEER_CURVES = []tls.CurveID{
+	tls.X25519MLKEM768,
+	tls.X25519,
+	tls.CurveP256,
+}
+
+var (
+	peerSessions    = tls.NewLRUClientSessionCache(PEER_SESSIONS_KEPT) // sessions with peers, shared by all our clients
+	ticketKeys      [][32]byte                                         // current ticket keys, newest first
+	ticketConfigs   []*tls.Config                                      // server configs that share our ticket keys
+	ticketKeysMutex sync.Mutex                                         // used to synchronize access to ticketKeys and ticketConfigs
+)
+
+func init() {
+	rotateTicketKeys()
+	util.GoLoop("session ticket key rotator", ticketKeyRotator)
+}
+
+/*
+SecurePeerConfig() restricts the given tls.Config to forward-secret key
+exchange, checks the status of the certificates that peers present (see
+certstatus.go) and hooks it up to our rotating session ticket keys for server
+configs and to our session cache for client configs.  It returns the same
+config for convenience.
+*/
+func SecurePeerConfig(tlsConfig *tls.Config) *tls.Config {
+	tlsConfig.MinVersion = tls.VersionTLS12
+	tlsConfig.CipherSuites = PEER_CIPHER_SUITES
+	tlsConfig.CurvePreferences = PEER_CURVES
+	tlsConfig.VerifyPeerCertificate = verifyPeerStatus
+	tlsConfig.VerifyConnection = verifyResumedPeerStatus
+	tlsConfig.ClientSessionCache = peerSessions
+
+	ticketKeysMutex.Lock()
+	defer ticketKeysMutex.Unlock()
+	tlsConfig.SetSessionTicketKeys(ticketKeys)
+	ticketConfigs = append(ticketConfigs, tlsConfig)
+	return tlsConfig
+}
+
+/*
+PeerSessionCache() returns a session cache for connections to the given peer
+that don't have the peer's address, for example connections nested inside a
+connection to another peer, whose sessions would otherwise be mixed up.
+*/
+func PeerSessionCache(peer string) tls.ClientSessionCache {
+	return &peerSessionCache{peer: peer}
+}
+
+// peerSessionCache is a view of peerSessions for a single peer.
+type peerSessionCache struct {
+	peer string // the address of the peer
+}
+
+func (cache *peerSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	return peerSessions.Get(cache.peer)
+}
+
+func (cache *peerSessionCache) Put(sessionKey string, session *tls.ClientSessionState) {
+	peerSessions.Put(cache.peer, session)
+}
+
+// ticketKeyRotator(), meant to be run as a goroutine, periodically rotates our
+// session ticket keys.
+func ticketKeyRotator() {
+	for {
+		time.Sleep(TICKET_KEY_ROTATION)
+		rotateTicketKeys()
+	}
+}
+
+// rotateTicketKeys() generates a new session ticket key, drops the oldest one
+// and pushes the result to all registered configs.
+func rotateTicketKeys() {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		log.Fatalf("Unable to generate session ticket key: %s", err)
+	}
+
+	ticketKeysMutex.Lock()
+	defer ticketKeysMutex.Unlock()
+	ticketKeys = append([][32]byte{key}, ticketKeys...)
+	if len(ticketKeys) > TICKET_KEYS_KEPT {
+		ticketKeys = ticketKeys[:TICKET_KEYS_KEPT]
+	}
+	for _, tlsConfig := range ticketConfigs {
+		tlsConfig.SetSessionTicketKeys(ticketKeys)
+	}
+}
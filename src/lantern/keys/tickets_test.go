@@ -0,0 +1,104 @@
+package keys
+
+import (
+	"crypto/tls"
+	_ "lantern/client/ephemeral"
+	"net"
+	"strings"
+	"testing"
+)
+
+// rsaKeyExchangeSuites are TLS 1.2 cipher suites without forward secrecy,
+// which lantern peers must never negotiate.
+var rsaKeyExchangeSuites = []uint16{
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+}
+
+// TestPeerCipherSuites checks that every cipher suite that a peer config
+// allows uses ECDHE key exchange and AEAD encryption and isn't insecure.
+func TestPeerCipherSuites(t *testing.T) {
+	insecure := make(map[uint16]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.ID] = true
+	}
+	tlsConfig := SecurePeerConfig(&tls.Config{})
+	if len(tlsConfig.CipherSuites) == 0 {
+		t.Fatal("Peer config allows Go's default cipher suites")
+	}
+	for _, id := range tlsConfig.CipherSuites {
+		name := tls.CipherSuiteName(id)
+		tests := []struct {
+			property string
+			holds    bool
+		}{
+			{"uses ECDHE key exchange", strings.HasPrefix(name, "TLS_ECDHE_")},
+			{"uses AEAD encryption", strings.Contains(name, "_GCM_") || strings.Contains(name, "_CHACHA20_POLY1305")},
+			{"isn't insecure", !insecure[id]},
+		}
+		for _, test := range tests {
+			if !test.holds {
+				t.Errorf("Cipher suite %s doesn't hold: %s", name, test.property)
+			}
+		}
+	}
+	if tlsConfig.MinVersion < tls.VersionTLS12 {
+		t.Errorf("Peer config allows versions before TLS 1.2: %x", tlsConfig.MinVersion)
+	}
+}
+
+// TestNoRSAKeyExchange checks that a peer refuses to handshake with a server
+// and with a client that only offer RSA key exchange, but does handshake with
+// a peer of its own.
+func TestNoRSAKeyExchange(t *testing.T) {
+	cert := TLSCertificate()
+	rsaOnly := func() *tls.Config {
+		return &tls.Config{
+			Certificates:       []tls.Certificate{cert},
+			CipherSuites:       rsaKeyExchangeSuites,
+			MaxVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: true,
+		}
+	}
+	peer := func() *tls.Config {
+		return SecurePeerConfig(&tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true})
+	}
+
+	tests := []struct {
+		name    string
+		server  *tls.Config
+		client  *tls.Config
+		succeed bool
+	}{
+		{"RSA key exchange on both sides", rsaOnly(), rsaOnly(), true},
+		{"peer client, RSA key exchange server", rsaOnly(), peer(), false},
+		{"RSA key exchange client, peer server", peer(), rsaOnly(), false},
+		{"peers on both sides", peer(), peer(), true},
+	}
+	for _, test := range tests {
+		state, err := handshake(test.server, test.client)
+		if test.succeed && err != nil {
+			t.Errorf("%s: expected handshake to succeed, got %s", test.name, err)
+		} else if !test.succeed && err == nil {
+			t.Errorf("%s: expected handshake to fail, negotiated %s", test.name, tls.CipherSuiteName(state.CipherSuite))
+		}
+	}
+}
+
+// handshake() runs a TLS handshake between the given server and client configs
+// over a pipe and returns the client's view of the connection.
+func handshake(serverConfig *tls.Config, clientConfig *tls.Config) (tls.ConnectionState, error) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	server := tls.Server(serverConn, serverConfig)
+	go func() {
+		server.Handshake()
+		serverConn.Close()
+	}()
+	client := tls.Client(clientConn, clientConfig)
+	err := client.Handshake()
+	return client.ConnectionState(), err
+}
@@ -0,0 +1,297 @@
+package keys
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"lantern/audit"
+	"lantern/config"
+	"lantern/ui"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The trust store is everything in TrustedParents: our own certificate, our
+parent's certificate and any certificates that the operator added at runtime.
+It can be managed through TrustedCerts(), AddTrustedCert() and
+RemoveTrustedCert() or at http://[config.UIAddress()]/admin/trust:
+
+- GET lists the trusted certificates
+- POST with the form value add (a PEM encoded certificate) adds a certificate
+- POST with the form value remove (a fingerprint) removes a certificate
+
+Added certificates are kept in [config.ConfigDir]/keys/trusted/added/, one PEM
+file per certificate named by its fingerprint.  Our current certificate and our
+current parent certificate can't be removed, since we'd stop trusting
+ourselves or our parent, but older ones (for example parent certificates that
+were replaced by a ParentCertUpdate) can.
+
+Since tls.Configs hold on to TrustedParents, it's never replaced.  Instead,
+removing a certificate rebuilds its content in place.
+
+The PSKs that we share with peers (see PSK()) can be managed in the same way at
+http://[config.UIAddress()]/admin/trust/peers:
+
+- GET lists the peers that we're paired with (but not the keys)
+- POST with the form values peer, id and key (hex encoded) adds a PSK
+- POST with the form value remove (a peer) removes a PSK
+*/
+const (
+	TRUST_OWN    = "own"    // our own certificate
+	TRUST_PARENT = "parent" // our parent's certificate
+	TRUST_ADDED  = "added"  // a certificate added by the operator
+)
+
+// TrustedCert describes a certificate in the trust store.
+type TrustedCert struct {
+	Fingerprint string    // hex SHA-256 of the DER bytes of the certificate
+	Subject     string    // the subject of the certificate
+	NotAfter    time.Time // when the certificate expires
+	Source      string    // why we trust it, one of the TRUST_ constants
+	cert        *x509.Certificate
+}
+
+// PSKPeer describes a peer that we share a PSK with.
+type PSKPeer struct {
+	Peer     string    // the peer
+	ID       string    // identifies the PSK to the peer that issued it
+	PairedAt time.Time // when the pairing was established
+}
+
+var (
+	addedCertsDir = config.ConfigDir + "/keys/trusted/added" // where added certificates are kept
+	trustedCerts  = make(map[string]*TrustedCert)            // certificates in TrustedParents, by fingerprint
+	trustMutex    sync.Mutex                                 // used to synchronize access to trustedCerts and TrustedParents
+)
+
+func init() {
+	ui.HandleFunc("/admin/trust", trustHandler)
+	ui.HandleFunc("/admin/trust/peers", trustedPeersHandler)
+}
+
+// fingerprint() returns the hex SHA-256 of the DER bytes of the given
+// certificate.
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// trust() adds the given certificate to TrustedParents.
+func trust(cert *x509.Certificate, source string) {
+	trustMutex.Lock()
+	defer trustMutex.Unlock()
+	fp := fingerprint(cert)
+	if _, found := trustedCerts[fp]; found {
+		return
+	}
+	trustedCerts[fp] = &TrustedCert{
+		Fingerprint: fp,
+		Subject:     cert.Subject.String(),
+		NotAfter:    cert.NotAfter,
+		Source:      source,
+		cert:        cert,
+	}
+	TrustedParents.AddCert(cert)
+}
+
+// isTrusted() indicates whether the given certificate is in the trust store.
+func isTrusted(cert *x509.Certificate) bool {
+	trustMutex.Lock()
+	defer trustMutex.Unlock()
+	_, found := trustedCerts[fingerprint(cert)]
+	return found
+}
+
+// loadAddedCerts() trusts the certificates that were added at runtime in
+// earlier runs.
+func loadAddedCerts() {
+	files, err := filepath.Glob(filepath.Join(addedCertsDir, "*.pem"))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if data, err := ioutil.ReadFile(file); err != nil {
+			log.Printf("Unable to read trusted certificate %s: %s", file, err)
+		} else if cert, err := parsePEMCertificate(data); err != nil {
+			log.Printf("Unable to parse trusted certificate %s: %s", file, err)
+		} else {
+			trust(cert, TRUST_ADDED)
+		}
+	}
+}
+
+// TrustedCerts() lists the certificates in the trust store, soonest expiring
+// first.
+func TrustedCerts() []TrustedCert {
+	trustMutex.Lock()
+	defer trustMutex.Unlock()
+	list := make([]TrustedCert, 0, len(trustedCerts))
+	for _, trusted := range trustedCerts {
+		list = append(list, *trusted)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].NotAfter.Before(list[j].NotAfter) })
+	return list
+}
+
+// AddTrustedCert() adds the given PEM encoded certificate to the trust store and
+// keeps it there across restarts.
+func AddTrustedCert(pemData []byte) (*TrustedCert, error) {
+	cert, err := parsePEMCertificate(pemData)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(cert.NotAfter) {
+		return nil, fmt.Errorf("Certificate expired on %s", cert.NotAfter)
+	}
+	fp := fingerprint(cert)
+	if !config.Ephemeral() {
+		if err := os.MkdirAll(addedCertsDir, 0755); err != nil {
+			return nil, err
+		}
+		pemData = pem.EncodeToMemory(&pem.Block{Type: PEM_HEADER_CERTIFICATE, Bytes: cert.Raw})
+		if err := ioutil.WriteFile(filepath.Join(addedCertsDir, fp+".pem"), pemData, 0644); err != nil {
+			return nil, err
+		}
+	}
+	trust(cert, TRUST_ADDED)
+	log.Printf("Added trusted certificate %s (%s)", fp, cert.Subject)
+	audit.Recordf(audit.EVENT_TRUST_CHANGED, fp, "added %s, valid until %s", cert.Subject, cert.NotAfter.Format(time.RFC3339))
+	trustMutex.Lock()
+	defer trustMutex.Unlock()
+	trusted := *trustedCerts[fp]
+	return &trusted, nil
+}
+
+// RemoveTrustedCert() removes the certificate with the given fingerprint from
+// the trust store.
+func RemoveTrustedCert(fp string) error {
+	fp = strings.ToLower(fp)
+	certMutex.RLock()
+	own := certificate
+	certMutex.RUnlock()
+	if own != nil && fingerprint(own) == fp {
+		return fmt.Errorf("Can't remove our own current certificate")
+	}
+	if parent := parentCert(); parent != nil && fingerprint(parent) == fp {
+		return fmt.Errorf("Can't remove our parent's current certificate")
+	}
+
+	trustMutex.Lock()
+	defer trustMutex.Unlock()
+	trusted, found := trustedCerts[fp]
+	if !found {
+		return fmt.Errorf("No trusted certificate with fingerprint %s", fp)
+	}
+	if trusted.Source == TRUST_ADDED && !config.Ephemeral() {
+		if err := os.Remove(filepath.Join(addedCertsDir, fp+".pem")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	delete(trustedCerts, fp)
+	pool := x509.NewCertPool()
+	for _, remaining := range trustedCerts {
+		pool.AddCert(remaining.cert)
+	}
+	*TrustedParents = *pool
+	log.Printf("Removed trusted certificate %s (%s)", fp, trusted.Subject)
+	audit.Recordf(audit.EVENT_TRUST_CHANGED, fp, "removed %s", trusted.Subject)
+	return nil
+}
+
+// PSKPeers() lists the peers that we share a PSK with.
+func PSKPeers() []PSKPeer {
+	pskMutex.RLock()
+	defer pskMutex.RUnlock()
+	list := make([]PSKPeer, 0, len(psks))
+	for peer, pairing := range psks {
+		list = append(list, PSKPeer{Peer: peer, ID: pairing.ID, PairedAt: pairing.PairedAt})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Peer < list[j].Peer })
+	return list
+}
+
+// RemovePSK() forgets the PSK that we share with the given peer.
+func RemovePSK(peer string) error {
+	pskMutex.Lock()
+	defer pskMutex.Unlock()
+	if _, found := psks[peer]; !found {
+		return fmt.Errorf("Not paired with %s", peer)
+	}
+	delete(psks, peer)
+	audit.Record(audit.EVENT_TRUST_CHANGED, peer, "removed PSK")
+	return savePSKs()
+}
+
+func parsePEMCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != PEM_HEADER_CERTIFICATE {
+		return nil, fmt.Errorf("Not a PEM encoded certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// trustHandler() lists, adds and removes trusted certificates.
+func trustHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		var err error
+		if add := req.FormValue("add"); add != "" {
+			_, err = AddTrustedCert([]byte(add))
+		} else if remove := req.FormValue("remove"); remove != "" {
+			err = RemoveTrustedCert(remove)
+		} else {
+			err = fmt.Errorf("Missing add or remove")
+		}
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+	}
+	if listJson, err := json.MarshalIndent(TrustedCerts(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(listJson)
+	}
+}
+
+// trustedPeersHandler() lists, adds and removes PSKs.
+func trustedPeersHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		var err error
+		if remove := req.FormValue("remove"); remove != "" {
+			err = RemovePSK(remove)
+		} else if peer := req.FormValue("peer"); peer != "" {
+			var key []byte
+			if key, err = hex.DecodeString(req.FormValue("key")); err == nil {
+				err = SetPSK(peer, &PSKPairing{ID: req.FormValue("id"), Key: key, PairedAt: time.Now()})
+			}
+		} else {
+			err = fmt.Errorf("Missing peer or remove")
+		}
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+	}
+	if listJson, err := json.MarshalIndent(PSKPeers(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(listJson)
+	}
+}
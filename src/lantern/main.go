@@ -0,0 +1,50 @@
+/*
+Lantern is a peer-to-peer proxy.  Usage:
+
+	lantern [flags] [client|relay|root] [BaseDir]
+	lantern [flags] backup|restore <archive> [BaseDir]
+	lantern [flags] service install|uninstall|start|stop [BaseDir]
+
+Everything happens as the packages below are initialized: package config
+parses the command line, runs the archive and tool commands (which exit), and
+loads the config, after which each package starts the subsystems that it's
+responsible for (see config.Runs()).  main() then only shows the tray icon in
+builds that have one (see package lantern/tray), and otherwise keeps the
+process running until it's stopped.
+*/
+package main
+
+import (
+	_ "lantern/accounting"
+	_ "lantern/artifacts"
+	_ "lantern/audit"
+	_ "lantern/autostart"
+	_ "lantern/blocklist"
+	_ "lantern/bootstrap"
+	_ "lantern/config"
+	_ "lantern/diagnostics"
+	_ "lantern/drain"
+	_ "lantern/features"
+	_ "lantern/introduction"
+	_ "lantern/issuance"
+	_ "lantern/keys"
+	_ "lantern/parentconfig"
+	_ "lantern/persona"
+	_ "lantern/proxy"
+	_ "lantern/reputation"
+	_ "lantern/service"
+	_ "lantern/signaling"
+	_ "lantern/telemetry"
+	_ "lantern/trace"
+	"lantern/tray"
+	_ "lantern/ui"
+	_ "lantern/update"
+	_ "lantern/util"
+)
+
+func main() {
+	if tray.Run() {
+		return
+	}
+	select {}
+}
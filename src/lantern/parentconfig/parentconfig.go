@@ -0,0 +1,357 @@
+/*
+Package parentconfig lets master nodes push selected configuration down to
+their children over the signaling channel (TYPE_CONFIG_FRAGMENT), for example
+new fallback proxies, recommended transports or additional identities to block.
+
+A master publishes a Fragment with Publish(), which signs it with our private
+key.  A child only accepts fragments that carry a valid signature from its
+parent (see keys.VerifyFromParent()) and whose Version is higher than that of
+the fragment it already has, so that replayed or reordered fragments can't
+roll it back.  An accepted fragment replaces the previous one wholesale, is
+saved to [config.ConfigDir]/parentconfig.signed (except on ephemeral nodes) and
+is in turn pushed down to our own children, signed by us.  Fragments are
+republished every REPUBLISH_INTERVAL for children that were offline.
+
+Fragments are merged with the local operator's config, which always takes
+precedence:
+
+- FallbackProxies are tried after config.StaticProxyAddresses() and before the
+  proxies of the bootstrap list (see package lantern/bootstrap)
+- Transports only reorder the transports that we support, they never enable
+  anything else
+- BlockedIdentities are blocked in addition to the remote blocklist, unless the
+  local operator has unblocked them (see package lantern/blocklist)
+
+The current fragment can be seen at
+http://[config.UIAddress()]/admin/parentconfig, where masters can POST a new
+one (as JSON) to publish it.
+*/
+package parentconfig
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lantern/config"
+	"lantern/keys"
+	"lantern/signaling"
+	"lantern/ui"
+	"lantern/util"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	REPUBLISH_INTERVAL = 6 * time.Hour // how often we republish our fragment for children that were offline
+	MAX_ENTRIES        = 256           // the most entries that we accept in each list of a fragment
+	MAX_FRAGMENT_SIZE  = 64 * 1024     // the largest fragment that we accept through the UI
+)
+
+// Fragment is the configuration that a parent assigns to its children.
+type Fragment struct {
+	Version           int64     // the version of the fragment, higher versions replace lower ones
+	Issued            time.Time // when the fragment was published
+	FallbackProxies   []string  // host:port of additional proxies to fall back to
+	Transports        []string  // recommended transports, most preferred first
+	BlockedIdentities []string  // identities to block in addition to the remote blocklist
+}
+
+// signedFragment is a Fragment as it travels over the signaling channel.
+type signedFragment struct {
+	Fragment  []byte // the JSON encoded Fragment
+	Signature []byte // the signature of Fragment by the sender's private key
+}
+
+var (
+	fragmentFile  = config.ConfigDir + "/parentconfig.signed" // where the current fragment is saved
+	current       *Fragment                                   // the current fragment (nil if we have none)
+	fragmentMutex sync.RWMutex                                // used to synchronize access to current
+)
+
+func init() {
+	load()
+	ui.HandleFunc("/admin/parentconfig", parentConfigHandler)
+	go receive()
+	util.GoLoop("config fragment publisher", republisher)
+}
+
+// Current() returns the current fragment, or nil if we have none.
+func Current() *Fragment {
+	fragmentMutex.RLock()
+	defer fragmentMutex.RUnlock()
+	return current
+}
+
+// FallbackProxies() returns the fallback proxies assigned by our parent.
+func FallbackProxies() []string {
+	if fragment := Current(); fragment != nil {
+		return append([]string{}, fragment.FallbackProxies...)
+	}
+	return nil
+}
+
+/*
+Transports() orders the given transports that we support by the
+recommendation of our parent.  Recommended transports come first, in the
+recommended order, and the others keep their order after them.
+*/
+func Transports(supported []string) []string {
+	fragment := Current()
+	if fragment == nil {
+		return supported
+	}
+	remaining := util.NewStringSet(supported...)
+	ordered := make([]string, 0, len(supported))
+	for _, transport := range fragment.Transports {
+		if remaining.Contains(transport) {
+			remaining.Remove(transport)
+			ordered = append(ordered, transport)
+		}
+	}
+	for _, transport := range supported {
+		if remaining.Contains(transport) {
+			ordered = append(ordered, transport)
+		}
+	}
+	return ordered
+}
+
+// IsBlocked() indicates whether our parent assigned us to block the given
+// identity.
+func IsBlocked(identity string) bool {
+	fragment := Current()
+	if fragment == nil {
+		return false
+	}
+	for _, blocked := range fragment.BlockedIdentities {
+		if blocked == identity {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Publish() makes the given fragment our current one and pushes it down to our
+children, signed by us.  Its Version is raised above that of our current
+fragment if necessary.
+*/
+func Publish(fragment Fragment) error {
+	if err := fragment.validate(); err != nil {
+		return err
+	}
+	fragmentMutex.Lock()
+	if current != nil && fragment.Version <= current.Version {
+		fragment.Version = current.Version + 1
+	}
+	if fragment.Issued.IsZero() {
+		fragment.Issued = time.Now()
+	}
+	current = &fragment
+	fragmentMutex.Unlock()
+	data, err := send(&fragment)
+	if err != nil {
+		return err
+	}
+	save(data)
+	log.Printf("Published config fragment version %d", fragment.Version)
+	return nil
+}
+
+// republisher() pushes our current fragment down to our children every
+// REPUBLISH_INTERVAL.
+func republisher() {
+	for {
+		time.Sleep(REPUBLISH_INTERVAL)
+		if fragment := Current(); fragment != nil {
+			if _, err := send(fragment); err != nil {
+				log.Printf("Unable to republish config fragment: %s", err)
+			}
+		}
+	}
+}
+
+// send() signs the given fragment and sends it to our children, returning the
+// signed fragment.
+func send(fragment *Fragment) ([]byte, error) {
+	fragmentBytes, err := json.Marshal(fragment)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := keys.Sign(fragmentBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to sign config fragment: %s", err)
+	}
+	data, err := json.Marshal(&signedFragment{Fragment: fragmentBytes, Signature: signature})
+	if err != nil {
+		return nil, err
+	}
+	signaling.Send(signaling.Message{
+		Type: signaling.TYPE_CONFIG_FRAGMENT,
+		Data: string(data),
+	})
+	return data, nil
+}
+
+// receive() listens for config fragments on the signaling channel.
+func receive() {
+	messages := make(chan signaling.Message)
+	signaling.RecvMatching(messages, signaling.Filter{
+		Types: []signaling.MessageType{signaling.TYPE_CONFIG_FRAGMENT},
+	})
+	// Restarts keep receiving on the same channel, which stays registered
+	util.Supervise("config fragment receiver", func() error {
+		for msg := range messages {
+			if msg.Type == signaling.TYPE_CONFIG_FRAGMENT {
+				if err := apply([]byte(msg.Data)); err != nil {
+					log.Printf("Unable to apply config fragment: %s", err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+/*
+apply() verifies a signed fragment from our parent and makes it our current
+one if it's newer, passing it on to our children.
+*/
+func apply(data []byte) error {
+	fragment, err := verify(data, false)
+	if err != nil {
+		return err
+	}
+	fragmentMutex.Lock()
+	if current != nil && fragment.Version <= current.Version {
+		fragmentMutex.Unlock()
+		return nil
+	}
+	current = fragment
+	fragmentMutex.Unlock()
+	save(data)
+	log.Printf("Applied config fragment version %d from our parent", fragment.Version)
+
+	// Pass it on to our own children
+	_, err = send(fragment)
+	return err
+}
+
+/*
+verify() checks the signature of the given signed fragment against our
+parent's certificate (or our own if ours is true) and decodes it.
+*/
+func verify(data []byte, ours bool) (*Fragment, error) {
+	signed := &signedFragment{}
+	if err := json.Unmarshal(data, signed); err != nil {
+		return nil, err
+	}
+	if ours {
+		cert, _ := keys.Certificate()
+		if cert == nil {
+			return nil, fmt.Errorf("No certificate of our own available to verify signature")
+		}
+		if err := cert.CheckSignature(x509.SHA256WithRSA, signed.Fragment, signed.Signature); err != nil {
+			return nil, fmt.Errorf("Signature didn't verify: %s", err)
+		}
+	} else if err := keys.VerifyFromParent(signed.Fragment, signed.Signature); err != nil {
+		return nil, fmt.Errorf("Signature didn't verify: %s", err)
+	}
+	fragment := &Fragment{}
+	if err := json.Unmarshal(signed.Fragment, fragment); err != nil {
+		return nil, err
+	}
+	if err := fragment.validate(); err != nil {
+		return nil, err
+	}
+	return fragment, nil
+}
+
+// validate() checks that the fragment is well formed.
+func (fragment *Fragment) validate() error {
+	if len(fragment.FallbackProxies) > MAX_ENTRIES || len(fragment.Transports) > MAX_ENTRIES || len(fragment.BlockedIdentities) > MAX_ENTRIES {
+		return fmt.Errorf("Config fragment has more than %d entries in a list", MAX_ENTRIES)
+	}
+	for _, proxy := range fragment.FallbackProxies {
+		if _, _, err := net.SplitHostPort(proxy); err != nil {
+			return fmt.Errorf("Invalid fallback proxy %s: %s", proxy, err)
+		}
+	}
+	return nil
+}
+
+/*
+load() loads the fragment that we saved last time, as long as it still
+verifies against our parent's certificate or, if we published it ourselves,
+our own.
+*/
+func load() {
+	if config.Ephemeral() {
+		return
+	}
+	data, err := ioutil.ReadFile(fragmentFile)
+	if err != nil {
+		return
+	}
+	fragment, err := verify(data, false)
+	if err != nil {
+		fragment, err = verify(data, true)
+	}
+	if err != nil {
+		log.Printf("Ignoring saved config fragment: %s", err)
+		return
+	}
+	current = fragment
+}
+
+// save() saves the given signed fragment so that it survives restarts.
+func save(data []byte) {
+	if config.Ephemeral() {
+		return
+	}
+	if err := ioutil.WriteFile(fragmentFile, data, 0644); err != nil {
+		log.Printf("Unable to save config fragment: %s", err)
+	}
+}
+
+/*
+parentConfigHandler() shows our current fragment, and publishes the JSON
+encoded Fragment in the body of a POST if we're a master.
+*/
+func parentConfigHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		if cert, _ := keys.Certificate(); cert == nil || !keys.IsMaster(cert) {
+			resp.WriteHeader(400)
+			resp.Write([]byte("Only masters can publish config fragments"))
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, MAX_FRAGMENT_SIZE))
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+		fragment := Fragment{}
+		if err := json.Unmarshal(body, &fragment); err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf("Invalid fragment: %s", err)))
+			return
+		}
+		if err := Publish(fragment); err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+	}
+	if fragmentJson, err := json.MarshalIndent(Current(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(fragmentJson)
+	}
+}
@@ -0,0 +1,100 @@
+package persona
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"lantern/config"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+/*
+The login page is served on the UI, which any website that the user visits can
+post to.  To keep malicious websites from driving the login flow, loginHandler()
+only accepts requests that:
+
+- come from the UI itself according to their Origin header (or their Referer
+  header if there's no Origin)
+- carry a CSRF token that indexHandler() embedded in the login page it served,
+  both in the form value csrf and in the SameSite lantern-csrf cookie
+
+CSRF tokens are valid for CSRF_TOKEN_VALIDITY and can only be used once.
+*/
+const (
+	CSRF_COOKIE         = "lantern-csrf"   // cookie that carries the CSRF token
+	CSRF_PARAM          = "csrf"           // form value that carries the CSRF token
+	CSRF_TOKEN_BYTES    = 32               // random bytes in a CSRF token
+	CSRF_TOKEN_VALIDITY = 30 * time.Minute // how long a login page may be used
+)
+
+var (
+	csrfTokens = make(map[string]time.Time) // when outstanding CSRF tokens expire, by token
+	csrfMutex  sync.Mutex                   // used to synchronize access to csrfTokens
+)
+
+// newCSRFToken() issues a CSRF token for a login page and sets its cookie.
+func newCSRFToken(w http.ResponseWriter) (string, error) {
+	b := make([]byte, CSRF_TOKEN_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	now := time.Now()
+	csrfMutex.Lock()
+	for outstanding, expires := range csrfTokens {
+		if now.After(expires) {
+			delete(csrfTokens, outstanding)
+		}
+	}
+	csrfTokens[token] = now.Add(CSRF_TOKEN_VALIDITY)
+	csrfMutex.Unlock()
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRF_COOKIE,
+		Value:    token,
+		Path:     "/auth",
+		MaxAge:   int(CSRF_TOKEN_VALIDITY / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token, nil
+}
+
+// checkCSRF() checks that the given login request came from a login page that
+// we served, using up its CSRF token.
+func checkCSRF(r *http.Request) error {
+	if err := checkOrigin(r); err != nil {
+		return err
+	}
+	token := r.FormValue(CSRF_PARAM)
+	cookie, err := r.Cookie(CSRF_COOKIE)
+	if token == "" || err != nil || cookie.Value != token {
+		return fmt.Errorf("Missing or mismatched CSRF token")
+	}
+	csrfMutex.Lock()
+	defer csrfMutex.Unlock()
+	expires, found := csrfTokens[token]
+	if !found || time.Now().After(expires) {
+		return fmt.Errorf("Unknown or expired CSRF token")
+	}
+	delete(csrfTokens, token)
+	return nil
+}
+
+// checkOrigin() checks that the given request was made by a page on the UI.
+func checkOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return fmt.Errorf("Missing Origin and Referer")
+	}
+	originUrl, err := url.Parse(origin)
+	if err != nil || originUrl.Scheme != "http" || originUrl.Host != config.UIAddress() {
+		return fmt.Errorf("Request from foreign origin %s", origin)
+	}
+	return nil
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/toqueteos/webbrowser"
 	"io/ioutil"
 	"lantern/config"
+	"lantern/ui"
 	"log"
 	"net/http"
 	"net/url"
@@ -48,19 +49,32 @@ matter much because if we can't authenticate, there's no point to running
 Lantern.
 */
 func GetIdentityAssertion() chan string {
-	url := "http://" + config.UIAddress() + "/auth"
-	log.Printf("Opening browser to: %s", url)
-	webbrowser.Open(url)
+	if assertion := testAssertion(); assertion != "" {
+		result := make(chan string, 1)
+		result <- assertion
+		return result
+	}
+	log.Printf("Opening browser to: http://%s/auth", config.UIAddress())
+	// The URL carries the UI token, which gets the browser past ui's
+	// authentication
+	webbrowser.Open(ui.URL("/auth"))
 	return assertionResult
 }
 
 /*
 ValidateAssertion() takes an identity assertion from MozillaPersona and
-validates it using Mozilla Persona's backend.  If the identity assertion checks
-out, this returns a PersonaResponse with the data obtained from Mozilla, else
-it returns an error.
+validates it using the DefaultVerifier, which is Mozilla Persona's backend
+unless we run with development identities (see verifier.go).  If the identity
+assertion checks out, this returns a PersonaResponse with the data obtained
+from Mozilla, else it returns an error.
 */
 func ValidateAssertion(assertion string, audience string) (*PersonaResponse, error) {
+	return DefaultVerifier.Verify(assertion, audience)
+}
+
+// validateWithMozilla() validates an identity assertion using Mozilla
+// Persona's backend.
+func validateWithMozilla(assertion string, audience string) (*PersonaResponse, error) {
 	data := url.Values{"assertion": {assertion}, "audience": {audience}}
 
 	resp, err := http.PostForm("https://verifier.login.persona.org/verify", data)
@@ -91,9 +105,13 @@ func ValidateAssertion(assertion string, audience string) (*PersonaResponse, err
 var assertionResult = make(chan string)
 
 func init() {
-	http.HandleFunc("/auth", indexHandler)
-	http.HandleFunc("/auth/login", loginHandler)
-	go http.ListenAndServe(config.UIAddress(), nil)
+	if config.IsRelay() {
+		// Relay nodes have no user who could log in
+		return
+	}
+	// The login pages are only exposed on the UI
+	ui.HandleFunc("/auth", indexHandler)
+	ui.HandleFunc("/auth/login", loginHandler)
 }
 
 var template = `
@@ -149,7 +167,7 @@ var template = `
 		    var xhr = new XMLHttpRequest();
 		    xhr.open("POST", "/auth/login", true);
 		    // see http://www.openjs.com/articles/ajax_xmlhttp_using_post.php
-		    var param = "assertion="+assertion;
+		    var param = "assertion="+encodeURIComponent(assertion)+"&csrf=%s";
 		    xhr.setRequestHeader("Content-type", "application/x-www-form-urlencoded");
 		    xhr.send(param); // for verification by your backend
 		
@@ -176,9 +194,16 @@ var template = `
 </html>
 `
 
-// indexHandler() shows the index page
+// indexHandler() shows the index page with a fresh CSRF token
 func indexHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, template)
+	csrfToken, err := newCSRFToken(w)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		w.Write([]byte("Internal Server Error."))
+		return
+	}
+	fmt.Fprintf(w, template, csrfToken)
 }
 
 /*
@@ -197,6 +222,13 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Bad Request."))
 	}
 
+	if err := checkCSRF(r); err != nil {
+		log.Printf("Rejecting login: %s", err)
+		w.WriteHeader(403)
+		w.Write([]byte("Forbidden."))
+		return
+	}
+
 	assertion := r.FormValue("assertion")
 	if assertion == "" {
 		log.Println("Didn't get assertion")
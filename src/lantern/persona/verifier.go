@@ -0,0 +1,73 @@
+package persona
+
+import (
+	"fmt"
+	"lantern/config"
+	"log"
+	"strings"
+)
+
+/*
+A Verifier validates identity assertions.  By default, assertions are
+validated with Mozilla Persona (see ValidateAssertion()).  When lantern runs
+with -dev-identity (see config.DevIdentity()), assertions of the form
+"test:<email>" are accepted as is instead, so that developers and CI can
+exercise the certificate request flow without any external identity service.
+Children running with -dev-identity also present such an assertion for
+config.Email() instead of opening the browser (see GetIdentityAssertion()).
+*/
+type Verifier interface {
+	// Verify() validates the given assertion against the given audience.
+	Verify(assertion string, audience string) (*PersonaResponse, error)
+}
+
+// TEST_ASSERTION_PREFIX marks the assertions accepted by the fake verifier.
+const TEST_ASSERTION_PREFIX = "test:"
+
+// DefaultVerifier is the Verifier used by ValidateAssertion().
+var DefaultVerifier Verifier = &mozillaVerifier{}
+
+func init() {
+	if config.DevIdentity() {
+		log.Print("Accepting test identity assertions, don't use this in production!")
+		DefaultVerifier = &fakeVerifier{DefaultVerifier}
+	}
+}
+
+// mozillaVerifier validates assertions with Mozilla Persona's backend.
+type mozillaVerifier struct{}
+
+func (v *mozillaVerifier) Verify(assertion string, audience string) (*PersonaResponse, error) {
+	return validateWithMozilla(assertion, audience)
+}
+
+// fakeVerifier accepts "test:<email>" assertions and hands everything else to
+// the next Verifier.
+type fakeVerifier struct {
+	next Verifier
+}
+
+func (v *fakeVerifier) Verify(assertion string, audience string) (*PersonaResponse, error) {
+	if !strings.HasPrefix(assertion, TEST_ASSERTION_PREFIX) {
+		return v.next.Verify(assertion, audience)
+	}
+	email := strings.TrimPrefix(assertion, TEST_ASSERTION_PREFIX)
+	if !strings.Contains(email, "@") {
+		return nil, fmt.Errorf("Assertion failed to validate: invalid test email %s", email)
+	}
+	return &PersonaResponse{
+		Status:   "okay",
+		Email:    email,
+		Audience: audience,
+		Issuer:   "test",
+	}, nil
+}
+
+// testAssertion() returns a test assertion for config.Email(), or "" if we
+// don't run with development identities or don't have an email.
+func testAssertion() string {
+	if !config.DevIdentity() || config.Email() == "" {
+		return ""
+	}
+	return TEST_ASSERTION_PREFIX + config.Email()
+}
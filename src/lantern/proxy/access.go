@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"lantern/config"
+	"net/http"
+	"path/filepath"
+)
+
+/*
+Access credentials let operators run semi-public fallback proxies that only
+relay for whoever they handed credentials to, rather than for anybody who
+finds them.
+
+An operator who sets config.ProxyAccess().RequireCredentials only lets peers
+through that present either:
+
+- one of the access tokens in config.ProxyAccess().Tokens, which peers send
+  during the handshake (see FLAG_TOKEN in handshake.go)
+- a client certificate that was issued by one of the CAs in
+  config.ProxyAccess().ClientCAFile
+
+Other peers are answered with 403 Forbidden.  Token holders are identified as
+"token:<name>" and certificate holders as "cert:<common name>" in place of an
+email, so the usual blocklists, limits and accounting apply to them.
+
+On the other side, config.StaticProxyCredentials() holds the token and/or
+client certificate to present to each static proxy that requires them.  A
+client certificate configured for a static proxy is presented instead of our
+own certificate.
+*/
+
+// peerTLSConfig() returns the TLS config for connecting to the given peer,
+// which presents the client certificate configured for it, if any.
+func peerTLSConfig(peer string) (*tls.Config, error) {
+	credentials := config.StaticProxyCredentials()[peer]
+	if credentials.ClientCertFile == "" {
+		return tlsConfig, nil
+	}
+	cert, err := tls.LoadX509KeyPair(configPath(credentials.ClientCertFile), configPath(credentials.ClientKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load client certificate for %s: %s", peer, err)
+	}
+	peerConfig := tlsConfig.Clone()
+	peerConfig.GetClientCertificate = nil
+	peerConfig.Certificates = []tls.Certificate{cert}
+	return peerConfig, nil
+}
+
+/*
+credentialIdentity() returns the identity of the peer that sent req if it
+authenticated with an access token or a client certificate from one of the
+accepted CAs, and "" otherwise.
+*/
+func credentialIdentity(req *http.Request) string {
+	access := config.ProxyAccess()
+	if conn, ok := req.Context().Value(peerConnKey{}).(*handshakeConn); ok && conn.token != "" {
+		if name, found := access.Tokens[conn.token]; found {
+			return "token:" + name
+		}
+	}
+	if access.ClientCAFile == "" || req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	roots, err := loadClientCAs(access.ClientCAFile)
+	if err != nil {
+		return ""
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range req.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = req.TLS.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return ""
+	}
+	return "cert:" + req.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+// checkAccess() makes sure that the peer that sent req presented credentials,
+// if our remote proxy requires them.
+func checkAccess(req *http.Request) error {
+	if !config.ProxyAccess().RequireCredentials || credentialIdentity(req) != "" {
+		return nil
+	}
+	return fmt.Errorf("Credentials required")
+}
+
+// loadClientCAs() loads the CA certificates that issue accepted client
+// certificates from the given file.
+func loadClientCAs(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(configPath(file))
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates found in %s", file)
+	}
+	return roots, nil
+}
+
+// configPath() resolves the given file name relative to config.ConfigDir.
+func configPath(file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(config.ConfigDir, file)
+}
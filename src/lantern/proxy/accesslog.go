@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"lantern/config"
+	"lantern/ui"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+The access log lets users see what the local proxy did for them, for example to
+check which sites went through which peer.  It's off unless the user turns it
+on (see config.AccessLog()), and even then it's only kept in memory, holding the
+last MaxEntries requests.  For every request, it records:
+
+- when the request came in
+- the host that it was for, or in ACCESS_LOG_HASHED mode an HMAC of the host
+  under a key that's made up at every start, so that requests to the same host
+  can be told apart from others without revealing it, and only until we restart
+- the path of plain HTTP requests, only with IncludePaths in ACCESS_LOG_HOSTS
+  mode (CONNECT requests don't have one that we could see)
+- the peer that it went through, or "direct"
+- the bytes relayed in both directions
+- the latency until the first byte of the response and the total duration
+
+The log is at http://[config.UIAddress()]/admin/accesslog: GET returns it,
+POST changes the settings from the form values mode and paths (true or false)
+and empties it with clear=true.  Changing the mode empties it too, so that
+switching the log off or to hashes doesn't leave host names behind.
+*/
+
+const DIRECT = "direct" // the peer of requests that went directly
+
+// AccessRecord is what the access log records about a request.
+type AccessRecord struct {
+	At         time.Time // when the request came in
+	Host       string    // the host of the request, or its hash
+	Path       string    `json:",omitempty"` // the path of the request, if paths are logged
+	Peer       string    // the upstream proxy that the request went through, or DIRECT
+	Bytes      int64     // the bytes relayed in both directions
+	LatencyMs  int64     // milliseconds until the first byte of the response (0 if there was none)
+	DurationMs int64     // milliseconds until the request was done
+}
+
+/*
+accessEntry tracks a request for the access log until it's done.  A nil
+*accessEntry is valid and simply records nothing, which is what requests carry
+while the access log is off.
+*/
+type accessEntry struct {
+	record   AccessRecord // what gets recorded, except for the bytes
+	bytes    int64        // the bytes relayed so far, accessed atomically
+	latency  int64        // nanoseconds until the first byte of the response, accessed atomically
+	pipes    int32        // the directions of the request's pipe that are still running, accessed atomically
+	finished sync.Once    // makes sure that the request is only recorded once
+	mutex    sync.Mutex   // used to synchronize access to record.Peer
+}
+
+// accessEntryKey is the key of the access entry of a request in its context.
+type accessEntryKey struct{}
+
+var (
+	accessRecords    = make([]AccessRecord, 0) // the latest requests, oldest first
+	accessHashKey    = make([]byte, 32)        // the key of the host name hashes
+	accessLogMutex   sync.Mutex                // used to synchronize access to accessRecords
+	accessHashKeyErr error                     // why we couldn't make up accessHashKey, in which case nothing is logged in ACCESS_LOG_HASHED mode
+)
+
+func init() {
+	_, accessHashKeyErr = rand.Read(accessHashKey)
+	ui.HandleFunc("/admin/accesslog", accessLogHandler)
+}
+
+/*
+withAccessEntry() returns req carrying a new access entry, unless it already
+carries one or the access log is off.
+*/
+func withAccessEntry(req *http.Request) *http.Request {
+	if _, found := req.Context().Value(accessEntryKey{}).(*accessEntry); found {
+		return req
+	}
+	settings := config.AccessLog()
+	entry := &accessEntry{record: AccessRecord{At: time.Now()}}
+	switch settings.Mode {
+	case config.ACCESS_LOG_HOSTS:
+		entry.record.Host = requestDomain(req)
+		if settings.IncludePaths && req.Method != "CONNECT" {
+			entry.record.Path = req.URL.Path
+		}
+	case config.ACCESS_LOG_HASHED:
+		if accessHashKeyErr != nil {
+			return req
+		}
+		mac := hmac.New(sha256.New, accessHashKey)
+		mac.Write([]byte(requestDomain(req)))
+		entry.record.Host = hex.EncodeToString(mac.Sum(nil)[:8])
+	default:
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), accessEntryKey{}, entry))
+}
+
+// accessEntryOf() returns the access entry that req carries, or nil if it
+// carries none.
+func accessEntryOf(req *http.Request) *accessEntry {
+	entry, _ := req.Context().Value(accessEntryKey{}).(*accessEntry)
+	return entry
+}
+
+// via() records that the request goes through the given peer (or DIRECT).
+func (entry *accessEntry) via(peer string) {
+	if entry == nil {
+		return
+	}
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	entry.record.Peer = peer
+}
+
+// relayed() records n bytes relayed, which are part of the response if
+// response is true.
+func (entry *accessEntry) relayed(n int, response bool) {
+	if entry == nil || n == 0 {
+		return
+	}
+	atomic.AddInt64(&entry.bytes, int64(n))
+	if response {
+		atomic.CompareAndSwapInt64(&entry.latency, 0, int64(time.Since(entry.record.At)))
+	}
+}
+
+// piped() records that the request is being piped, in which case it's done
+// once both directions of the pipe are (see pipeDone()).
+func (entry *accessEntry) piped() {
+	if entry == nil {
+		return
+	}
+	atomic.AddInt32(&entry.pipes, 2)
+}
+
+// pipeDone() records that one direction of the request's pipe is done.
+func (entry *accessEntry) pipeDone() {
+	if entry == nil {
+		return
+	}
+	if atomic.AddInt32(&entry.pipes, -1) == 0 {
+		entry.finish()
+	}
+}
+
+// handled() records that the handler of the request returned, which means
+// that it's done unless it's being piped.
+func (entry *accessEntry) handled() {
+	if entry == nil || atomic.LoadInt32(&entry.pipes) > 0 {
+		return
+	}
+	entry.finish()
+}
+
+// finish() adds the request to the access log.
+func (entry *accessEntry) finish() {
+	entry.finished.Do(func() {
+		entry.mutex.Lock()
+		record := entry.record
+		entry.mutex.Unlock()
+		record.Bytes = atomic.LoadInt64(&entry.bytes)
+		record.LatencyMs = int64(time.Duration(atomic.LoadInt64(&entry.latency)) / time.Millisecond)
+		record.DurationMs = int64(time.Since(record.At) / time.Millisecond)
+
+		settings := config.AccessLog()
+		if settings.Mode == config.ACCESS_LOG_OFF {
+			return
+		}
+		accessLogMutex.Lock()
+		defer accessLogMutex.Unlock()
+		accessRecords = append(accessRecords, record)
+		if excess := len(accessRecords) - settings.MaxEntries; excess > 0 {
+			accessRecords = append([]AccessRecord{}, accessRecords[excess:]...)
+		}
+	})
+}
+
+// count() wraps resp so that what's written to it counts as the response to
+// the request.
+func (entry *accessEntry) count(resp http.ResponseWriter) http.ResponseWriter {
+	if counting, ok := resp.(*countingResponseWriter); entry == nil || ok && counting.entry == entry {
+		return resp
+	}
+	return &countingResponseWriter{ResponseWriter: resp, entry: entry}
+}
+
+// countingResponseWriter is an http.ResponseWriter that records what's written
+// to it in an access entry.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	entry *accessEntry
+}
+
+func (resp *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := resp.ResponseWriter.Write(b)
+	resp.entry.relayed(n, true)
+	return n, err
+}
+
+func (resp *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return resp.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+// AccessLog() returns the requests in the access log, oldest first.
+func AccessLog() []AccessRecord {
+	accessLogMutex.Lock()
+	defer accessLogMutex.Unlock()
+	return append([]AccessRecord{}, accessRecords...)
+}
+
+// ClearAccessLog() empties the access log.
+func ClearAccessLog() {
+	accessLogMutex.Lock()
+	defer accessLogMutex.Unlock()
+	accessRecords = make([]AccessRecord, 0)
+}
+
+/*
+accessLogHandler() returns the access log on GET and, on POST, changes its
+settings from the form values mode and paths and empties it with clear=true.
+*/
+func accessLogHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		settings := config.AccessLog()
+		previousMode := settings.Mode
+		if mode := req.FormValue("mode"); mode != "" {
+			if mode != config.ACCESS_LOG_OFF && mode != config.ACCESS_LOG_HOSTS && mode != config.ACCESS_LOG_HASHED {
+				resp.WriteHeader(400)
+				resp.Write([]byte("Unknown mode " + mode))
+				return
+			}
+			settings.Mode = mode
+		}
+		if paths := req.FormValue("paths"); paths != "" {
+			settings.IncludePaths = paths == "true"
+		}
+		config.SetAccessLog(settings)
+		if settings.Mode != previousMode || req.FormValue("clear") == "true" {
+			ClearAccessLog()
+		}
+	}
+	if logJson, err := json.MarshalIndent(AccessLog(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(logJson)
+	}
+}
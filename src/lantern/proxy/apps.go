@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"lantern/config"
+	"lantern/ui"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+/*
+Per-app routing lets the user decide by process how the traffic of the local
+proxy is routed (see config.AppRouting()), for example to only proxy their
+browser or to keep a corporate VPN client off peers.  Each request is matched
+to the process that opened its connection, by asking the platform which process
+owns the other end of the connection (see processOf()):
+
+- Linux - the sockets in /proc/net/tcp and /proc/net/tcp6 and the file
+  descriptors in /proc/[pid]/fd
+- macOS - lsof
+- Windows - GetExtendedTcpTable() and QueryFullProcessImageName()
+
+The first rule whose process matches the name of the executable applies,
+otherwise the route for unmatched processes does.  ROUTE_PROXY always goes
+through peers, ROUTE_DIRECT always goes directly without ever falling back to
+peers (see peersAllowed()) and ROUTE_AUTO routes as usual (see detection.go).
+Connections from other machines, for example on the LAN, and connections whose
+process can't be found are unmatched.  The lookup only happens while any route
+besides ROUTE_AUTO is configured.
+
+The rules can be seen and changed at http://[config.UIAddress()]/config/apps:
+GET returns them, POST sets the route of the process in the form value process
+to the form value route (or removes its rule with remove=true) and sets the route
+for unmatched processes to the form value unmatched, if given.
+*/
+
+// appRouteKey is the key of the route of a request in its context.
+type appRouteKey struct{}
+
+func init() {
+	ui.HandleFunc("/config/apps", appsHandler)
+}
+
+/*
+withAppRoute() returns req carrying the route for the process that it comes
+from, unless it already carries one.
+*/
+func withAppRoute(req *http.Request) *http.Request {
+	if _, found := req.Context().Value(appRouteKey{}).(string); found {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), appRouteKey{}, appRoute(req)))
+}
+
+// routeOf() returns the route that req carries (see withAppRoute()).
+func routeOf(req *http.Request) string {
+	route, _ := req.Context().Value(appRouteKey{}).(string)
+	return route
+}
+
+// peersAllowed() indicates whether or not req may go through peers.
+func peersAllowed(req *http.Request) bool {
+	return localGet.Enabled() && routeOf(req) != config.ROUTE_DIRECT
+}
+
+// appRoute() returns the route for the process that req comes from.
+func appRoute(req *http.Request) string {
+	routing := config.AppRouting()
+	if len(routing.Rules) == 0 && routing.Unmatched == config.ROUTE_AUTO {
+		return config.ROUTE_AUTO
+	}
+	process, err := requestProcess(req)
+	if err != nil {
+		return routing.Unmatched
+	}
+	for _, rule := range routing.Rules {
+		if processName(rule.Process) == process {
+			return rule.Route
+		}
+	}
+	return routing.Unmatched
+}
+
+// requestProcess() returns the name of the process that req comes from, if it
+// comes from this machine.
+func requestProcess(req *http.Request) (string, error) {
+	client, err := net.ResolveTCPAddr("tcp", req.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+	if !client.IP.IsLoopback() && !isLocalAddress(client.IP) {
+		return "", fmt.Errorf("%s isn't on this machine", client)
+	}
+	server, ok := req.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	if !ok {
+		return "", fmt.Errorf("Unknown local address")
+	}
+	process, err := processOf(client, server)
+	if err != nil {
+		return "", err
+	}
+	return processName(process), nil
+}
+
+// processName() returns the name of the given executable as rules match it.
+func processName(executable string) string {
+	name := filepath.Base(strings.Replace(executable, "\\", "/", -1))
+	return strings.TrimSuffix(strings.ToLower(name), ".exe")
+}
+
+// isLocalAddress() indicates whether the given IP is assigned to one of our
+// network interfaces.
+func isLocalAddress(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+appsHandler() returns the app routing rules on GET and changes them on POST
+with the form values process, route, remove and unmatched.
+*/
+func appsHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		if err := changeAppRouting(req); err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+	}
+	if routingJson, err := json.MarshalIndent(config.AppRouting(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(routingJson)
+	}
+}
+
+// changeAppRouting() applies the changes to the app routing rules in the form
+// values of req.
+func changeAppRouting(req *http.Request) error {
+	routing := config.AppRouting()
+	checkRoute := func(route string) error {
+		if route != config.ROUTE_AUTO && route != config.ROUTE_PROXY && route != config.ROUTE_DIRECT {
+			return fmt.Errorf("Unknown route %q, use %q, %q or %q", route, config.ROUTE_AUTO, config.ROUTE_PROXY, config.ROUTE_DIRECT)
+		}
+		return nil
+	}
+	if process := strings.TrimSpace(req.FormValue("process")); process != "" {
+		rules := make([]config.AppRule, 0, len(routing.Rules)+1)
+		for _, rule := range routing.Rules {
+			if processName(rule.Process) != processName(process) {
+				rules = append(rules, rule)
+			}
+		}
+		if req.FormValue("remove") != "true" {
+			route := req.FormValue("route")
+			if err := checkRoute(route); err != nil {
+				return err
+			}
+			rules = append(rules, config.AppRule{Process: process, Route: route})
+		}
+		routing.Rules = rules
+	}
+	if _, given := req.Form["unmatched"]; given {
+		if err := checkRoute(req.FormValue("unmatched")); err != nil {
+			return err
+		}
+		routing.Unmatched = req.FormValue("unmatched")
+	}
+	config.SetAppRouting(routing)
+	log.Printf("App routing changed to %d rules, unmatched processes route %q", len(routing.Rules), routing.Unmatched)
+	return nil
+}
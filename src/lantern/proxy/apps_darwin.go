@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// processOf() returns the name of the process that owns the socket connected
+// from client to server, as lsof reports it.
+func processOf(client *net.TCPAddr, server *net.TCPAddr) (string, error) {
+	// +c 0 keeps lsof from truncating command names, -F pcn lists the pid,
+	// command and name (local->remote) of every matching socket
+	output, err := exec.Command("lsof", "+c", "0", "-n", "-P", "-iTCP:"+strconv.Itoa(client.Port), "-F", "pcn").Output()
+	if err != nil {
+		return "", fmt.Errorf("Unable to run lsof: %s", err)
+	}
+	suffix := fmt.Sprintf(":%d->", client.Port)
+	remote := fmt.Sprintf(":%d", server.Port)
+	command := ""
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		switch line[0] {
+		case 'p':
+			command = ""
+		case 'c':
+			command = line[1:]
+		case 'n':
+			if strings.Contains(line, suffix) && strings.HasSuffix(line, remote) && command != "" {
+				return command, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("No process owns the socket from %s to %s", client, server)
+}
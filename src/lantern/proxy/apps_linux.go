@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// processOf() returns the executable of the process that owns the socket
+// connected from client to server.
+func processOf(client *net.TCPAddr, server *net.TCPAddr) (string, error) {
+	inode := ""
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		found, err := socketInode(table, client.Port, server.Port)
+		if err != nil {
+			return "", err
+		}
+		if found != "" {
+			inode = found
+			break
+		}
+	}
+	if inode == "" {
+		return "", fmt.Errorf("No socket from %s to %s", client, server)
+	}
+	link := "socket:[" + inode + "]"
+	pids, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return "", err
+	}
+	for _, pid := range pids {
+		fds, err := ioutil.ReadDir(pid + "/fd")
+		if err != nil {
+			// Other users' processes aren't ours to look into
+			continue
+		}
+		for _, fd := range fds {
+			if target, err := os.Readlink(pid + "/fd/" + fd.Name()); err == nil && target == link {
+				return processExecutable(pid)
+			}
+		}
+	}
+	return "", fmt.Errorf("No process owns the socket from %s to %s", client, server)
+}
+
+/*
+socketInode() returns the inode of the socket in the given socket table (in the
+format of /proc/net/tcp) whose local port is localPort and whose remote port is
+remotePort, or "" if there's none.
+*/
+func socketInode(table string, localPort int, remotePort int) (string, error) {
+	file, err := os.Open(table)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // skip the header
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		if hexPort(fields[1]) == localPort && hexPort(fields[2]) == remotePort {
+			return fields[9], nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// hexPort() returns the port of the given address in the format of
+// /proc/net/tcp (hex IP:hex port), or -1 if it's malformed.
+func hexPort(address string) int {
+	i := strings.LastIndex(address, ":")
+	if i < 0 {
+		return -1
+	}
+	port, err := strconv.ParseInt(address[i+1:], 16, 32)
+	if err != nil {
+		return -1
+	}
+	return int(port)
+}
+
+// processExecutable() returns the executable of the process with the given
+// /proc directory, falling back to its (possibly truncated) command name.
+func processExecutable(pid string) (string, error) {
+	if executable, err := os.Readlink(pid + "/exe"); err == nil {
+		return strings.TrimSuffix(executable, " (deleted)"), nil
+	}
+	comm, err := ioutil.ReadFile(pid + "/comm")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(comm)), nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// processOf() isn't supported on this platform yet.
+func processOf(client *net.TCPAddr, server *net.TCPAddr) (string, error) {
+	return "", fmt.Errorf("Per-app routing isn't supported on %s", runtime.GOOS)
+}
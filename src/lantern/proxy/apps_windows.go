@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	TCP_TABLE_OWNER_PID_ALL           = 5      // the table class of GetExtendedTcpTable() with the owning pids
+	PROCESS_QUERY_LIMITED_INFORMATION = 0x1000 // the access that QueryFullProcessImageName() needs
+	tcpRowSize                        = 24     // the size of MIB_TCPROW_OWNER_PID
+	tcp6RowSize                       = 56     // the size of MIB_TCP6ROW_OWNER_PID
+)
+
+var (
+	iphlpapi                      = syscall.NewLazyDLL("iphlpapi.dll")
+	kernel32                      = syscall.NewLazyDLL("kernel32.dll")
+	procGetExtendedTcpTable       = iphlpapi.NewProc("GetExtendedTcpTable")
+	procQueryFullProcessImageName = kernel32.NewProc("QueryFullProcessImageNameW")
+)
+
+// processOf() returns the executable of the process that owns the socket
+// connected from client to server.
+func processOf(client *net.TCPAddr, server *net.TCPAddr) (string, error) {
+	for _, family := range []int{syscall.AF_INET, syscall.AF_INET6} {
+		pid, err := owningPid(family, client.Port, server.Port)
+		if err != nil {
+			return "", err
+		}
+		if pid != 0 {
+			return processExecutable(pid)
+		}
+	}
+	return "", fmt.Errorf("No process owns the socket from %s to %s", client, server)
+}
+
+/*
+owningPid() returns the pid of the process that owns the TCP socket of the
+given address family whose local port is localPort and whose remote port is
+remotePort, or 0 if there's none.
+*/
+func owningPid(family int, localPort int, remotePort int) (uint32, error) {
+	size := uint32(0)
+	procGetExtendedTcpTable.Call(0, uintptr(unsafe.Pointer(&size)), 0, uintptr(family), TCP_TABLE_OWNER_PID_ALL, 0)
+	if size == 0 {
+		return 0, nil
+	}
+	// The table may grow between the calls, so leave some room
+	table := make([]byte, size*2)
+	size = uint32(len(table))
+	ret, _, _ := procGetExtendedTcpTable.Call(uintptr(unsafe.Pointer(&table[0])), uintptr(unsafe.Pointer(&size)), 0, uintptr(family), TCP_TABLE_OWNER_PID_ALL, 0)
+	if ret != 0 {
+		return 0, fmt.Errorf("GetExtendedTcpTable() failed with %d", ret)
+	}
+	entries := int(binary.LittleEndian.Uint32(table))
+	rowSize, localPortAt, remotePortAt, pidAt := tcpRowSize, 8, 16, 20
+	if family == syscall.AF_INET6 {
+		rowSize, localPortAt, remotePortAt, pidAt = tcp6RowSize, 20, 44, 52
+	}
+	for i := 0; i < entries; i++ {
+		row := table[4+i*rowSize:]
+		if len(row) < rowSize {
+			break
+		}
+		// Ports are in network byte order in the low 16 bits
+		if int(binary.BigEndian.Uint16(row[localPortAt:])) == localPort && int(binary.BigEndian.Uint16(row[remotePortAt:])) == remotePort {
+			return binary.LittleEndian.Uint32(row[pidAt:]), nil
+		}
+	}
+	return 0, nil
+}
+
+// processExecutable() returns the path of the executable of the process with
+// the given pid.
+func processExecutable(pid uint32) (string, error) {
+	handle, err := syscall.OpenProcess(PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return "", err
+	}
+	defer syscall.CloseHandle(handle)
+	buf := make([]uint16, syscall.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	ret, _, err := procQueryFullProcessImageName.Call(uintptr(handle), 0, uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)))
+	if ret == 0 {
+		return "", err
+	}
+	return syscall.UTF16ToString(buf[:size]), nil
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"lantern/ui"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+The bandwidth test measures the throughput between us and a peer on demand, so
+that operators can check the capacity that they donate and the selector learns
+how much each peer can carry (see PeerHealth).
+
+We dial the peer like any upstream proxy and POST it Bytes of random data with
+X_LANTERN_BANDWIDTH_TEST set to the number of bytes that it should send back.
+The peer counts what it received, reports that and how long it took in
+X_LANTERN_BANDWIDTH_RECEIVED and X_LANTERN_BANDWIDTH_ELAPSED, and then sends
+the requested bytes of random data.  Loss is the fraction of the bytes in each
+direction that didn't arrive before the connection broke or timed out.
+
+Both sizes are limited to MAX_BANDWIDTH_TEST_BYTES, and tests count against the
+peer's connection limits like any other request (see limits.go).
+
+A test can be started with a POST to http://[config.UIAddress()]/admin/bandwidth
+with the form values peer (by default the upstream proxy that we use) and bytes
+(by default DEFAULT_BANDWIDTH_TEST_BYTES).  The bandwidth command offers the
+same on the command line (see config/commands.go).
+*/
+const (
+	X_LANTERN_BANDWIDTH_TEST     = "X-Lantern-Bandwidth-Test"
+	X_LANTERN_BANDWIDTH_RECEIVED = "X-Lantern-Bandwidth-Received"
+	X_LANTERN_BANDWIDTH_ELAPSED  = "X-Lantern-Bandwidth-Elapsed"
+
+	DEFAULT_BANDWIDTH_TEST_BYTES = 4 * 1024 * 1024  // how much data a test transfers in each direction by default
+	MAX_BANDWIDTH_TEST_BYTES     = 32 * 1024 * 1024 // the most data that a test may transfer in each direction
+	BANDWIDTH_TEST_TIMEOUT       = 60 * time.Second // how long each direction of a test may take
+)
+
+// BandwidthResult is the outcome of a bandwidth test (mirrored by
+// control.BandwidthResult).
+type BandwidthResult struct {
+	Peer         string    // the host:port of the remote proxy
+	At           time.Time // when the test started
+	Bytes        int64     // the bytes that we tried to transfer in each direction
+	UploadMbps   float64   // the throughput to the peer, as the peer measured it
+	DownloadMbps float64   // the throughput from the peer
+	UploadLoss   float64   // the fraction of the bytes sent that didn't reach the peer
+	DownloadLoss float64   // the fraction of the bytes that the peer sent that didn't reach us
+}
+
+func init() {
+	ui.HandleFunc("/admin/bandwidth", bandwidthHandler)
+}
+
+/*
+MeasureBandwidth() runs a bandwidth test with the given peer, transferring the
+given number of bytes in each direction, and records the result in the peer's
+health.
+*/
+func MeasureBandwidth(peer string, bytes int64) (*BandwidthResult, error) {
+	if bytes <= 0 || bytes > MAX_BANDWIDTH_TEST_BYTES {
+		return nil, fmt.Errorf("A test can transfer between 1 and %d bytes", MAX_BANDWIDTH_TEST_BYTES)
+	}
+	result := &BandwidthResult{Peer: peer, At: time.Now(), Bytes: bytes}
+	connOut, err := dialUpstream(peer)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open socket to %s: %s", peer, err)
+	}
+	defer connOut.Close()
+	req, err := http.NewRequest("POST", "http://"+peerHost(peer)+"/", io.LimitReader(rand.Reader, bytes))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = bytes
+	req.Header.Set(X_LANTERN_BANDWIDTH_TEST, strconv.FormatInt(bytes, 10))
+	if err := authenticateUpstream(peer, connOut, req); err != nil {
+		return nil, fmt.Errorf("Unable to authenticate %s: %s", peer, err)
+	}
+
+	connOut.SetDeadline(time.Now().Add(BANDWIDTH_TEST_TIMEOUT))
+	if err := req.Write(connOut); err != nil {
+		return nil, fmt.Errorf("Unable to upload to %s: %s", peer, err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(connOut), req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read response from %s: %s", peer, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s refused the test: %s", peer, resp.Status)
+	}
+	received, err := strconv.ParseInt(resp.Header.Get(X_LANTERN_BANDWIDTH_RECEIVED), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s didn't report what it received", peer)
+	}
+	elapsedMs, err := strconv.ParseInt(resp.Header.Get(X_LANTERN_BANDWIDTH_ELAPSED), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s didn't report how long it took", peer)
+	}
+	result.UploadMbps = megabitsPerSecond(received, time.Duration(elapsedMs)*time.Millisecond)
+	result.UploadLoss = loss(received, bytes)
+
+	// The download ends early if the peer breaks off or we time out, which
+	// counts as loss
+	connOut.SetDeadline(time.Now().Add(BANDWIDTH_TEST_TIMEOUT))
+	start := time.Now()
+	downloaded, _ := io.Copy(io.Discard, resp.Body)
+	result.DownloadMbps = megabitsPerSecond(downloaded, time.Since(start))
+	result.DownloadLoss = loss(downloaded, bytes)
+	recordBandwidth(result)
+	return result, nil
+}
+
+// megabitsPerSecond() returns the throughput of transferring the given number
+// of bytes in elapsed.
+func megabitsPerSecond(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes*8) / 1e6 / elapsed.Seconds()
+}
+
+// loss() returns the fraction of the expected bytes that weren't received.
+func loss(received int64, expected int64) float64 {
+	if received >= expected {
+		return 0
+	}
+	return float64(expected-received) / float64(expected)
+}
+
+// recordBandwidth() records the given result in the health of its peer.
+func recordBandwidth(result *BandwidthResult) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	health, found := peerHealth[result.Peer]
+	if !found {
+		health = &PeerHealth{Address: result.Peer}
+		peerHealth[result.Peer] = health
+	}
+	health.UploadMbps = result.UploadMbps
+	health.DownloadMbps = result.DownloadMbps
+	health.LastBandwidthTest = result.At
+}
+
+/*
+answerBandwidthTest() is the peer's side of a bandwidth test: it receives the
+uploaded data, then reports on it and sends back the requested bytes.
+*/
+func answerBandwidthTest(resp http.ResponseWriter, req *http.Request) {
+	size, err := strconv.ParseInt(req.Header.Get(X_LANTERN_BANDWIDTH_TEST), 10, 64)
+	if err != nil || size < 0 || size > MAX_BANDWIDTH_TEST_BYTES || req.ContentLength > MAX_BANDWIDTH_TEST_BYTES {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Invalid bandwidth test"))
+		return
+	}
+	// The test may take longer than the server's usual timeouts allow
+	controller := http.NewResponseController(resp)
+	controller.SetReadDeadline(time.Now().Add(BANDWIDTH_TEST_TIMEOUT))
+	start := time.Now()
+	received, _ := io.Copy(io.Discard, io.LimitReader(req.Body, MAX_BANDWIDTH_TEST_BYTES))
+	elapsed := time.Since(start)
+
+	controller.SetWriteDeadline(time.Now().Add(BANDWIDTH_TEST_TIMEOUT))
+	resp.Header().Set(X_LANTERN_BANDWIDTH_RECEIVED, strconv.FormatInt(received, 10))
+	resp.Header().Set(X_LANTERN_BANDWIDTH_ELAPSED, strconv.FormatInt(int64(elapsed/time.Millisecond), 10))
+	resp.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	resp.WriteHeader(200)
+	io.Copy(resp, io.LimitReader(rand.Reader, size))
+}
+
+/*
+bandwidthHandler() runs a bandwidth test with the peer in the form value peer
+(by default the upstream proxy that we use), transferring the bytes in the form
+value bytes (by default DEFAULT_BANDWIDTH_TEST_BYTES).
+*/
+func bandwidthHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		resp.WriteHeader(405)
+		return
+	}
+	peer := req.FormValue("peer")
+	if peer == "" {
+		upstreamProxy, err := selectUpstream()
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+		peer = upstreamProxy
+	}
+	bytes := int64(DEFAULT_BANDWIDTH_TEST_BYTES)
+	if value := req.FormValue("bytes"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf("Invalid value for bytes: %s", value)))
+			return
+		}
+		bytes = parsed
+	}
+	result, err := MeasureBandwidth(peer, bytes)
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+		return
+	}
+	if resultJson, err := json.MarshalIndent(result, "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(resultJson)
+	}
+}
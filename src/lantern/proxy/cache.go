@@ -0,0 +1,633 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lantern/config"
+	"lantern/ui"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The cache keeps cacheable responses that the local proxy fetched through peers
+on disk, so that pages that are visited again don't have to cross expensive
+peer links again.  It's switched on with config.Cache() and never used on
+ephemeral nodes.
+
+Since the local proxy may also serve other clients on the LAN (see wpad.go and
+transparent.go), the cache is a shared cache in the terms of RFC 9111:
+
+- only GET requests for plain HTTP are looked up, since everything else is
+  either not cacheable or (for HTTPS) not visible to us
+- requests with Authorization or Range headers or Cache-Control: no-store
+  bypass the cache, and requests with Cache-Control: no-cache or max-age=0 (or
+  Pragma: no-cache) always revalidate
+- responses are stored unless they're marked no-store or private, set cookies
+  or carry Vary: *, and only if they're explicitly fresh (max-age or Expires)
+  or heuristically cacheable by their status code and Last-Modified
+  (HEURISTIC_FRACTION of their age, at most MAX_HEURISTIC_LIFETIME)
+- fresh responses are served from the cache with an Age header, stale ones (or
+  those marked no-cache) are revalidated with If-None-Match or
+  If-Modified-Since, and a 304 refreshes the stored response
+- only the most recent variant of each URL is kept, and it's only served to
+  requests that match the request headers named by its Vary header
+- unsafe requests (POST, PUT, DELETE and so on) invalidate the cached response
+  for their URL
+
+Bodies larger than config.Cache().MaxEntrySize aren't stored, and the least
+recently used responses are evicted once the bodies exceed
+config.Cache().MaxSize.  Statistics are available at
+http://[config.UIAddress()]/admin/cache, and POSTing purge=all or url=<url>
+there purges the whole cache or a single URL.
+*/
+const (
+	HEURISTIC_FRACTION     = 10             // heuristic freshness is 1/HEURISTIC_FRACTION of the time since Last-Modified
+	MAX_HEURISTIC_LIFETIME = 24 * time.Hour // the longest heuristic freshness that we allow
+)
+
+// heuristicallyCacheable are the status codes that may be cached without
+// explicit freshness information (RFC 9110 section 15.1).
+var heuristicallyCacheable = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// CacheStats describes the state of the cache.
+type CacheStats struct {
+	Enabled       bool  // whether the cache is in use
+	Entries       int   // the number of cached responses
+	Size          int64 // the total size of the cached bodies in bytes
+	MaxSize       int64 // the size at which responses get evicted
+	Hits          int64 // requests served from the cache without asking a peer
+	Revalidations int64 // requests served from the cache after a 304 from a peer
+	Misses        int64 // requests that had to be fetched through a peer
+	Evictions     int64 // responses evicted to make room
+}
+
+// cacheEntry is a cached response, which is kept in <hash>.json next to its
+// body in <hash> (see cachePath()).
+type cacheEntry struct {
+	URL          string      // the URL that the response is for
+	Vary         http.Header // the request headers that the response varies by
+	StatusCode   int         // the status of the response
+	Header       http.Header // the headers of the response
+	RequestTime  time.Time   // when the request for the response was sent
+	ResponseTime time.Time   // when the response was received
+	Size         int64       // the size of the body
+	lastUsed     time.Time   // when the entry was last stored or served
+}
+
+var (
+	cacheDir     = config.ConfigDir + "/cache"  // where cached responses are kept
+	cacheEntries = make(map[string]*cacheEntry) // cached responses, by URL
+	cacheStats   = CacheStats{}                 // counts of hits, misses and so on
+	cacheLoaded  sync.Once                      // makes sure that the cache is only loaded from disk once
+	cacheMutex   sync.Mutex                     // used to synchronize access to all of the above
+)
+
+func init() {
+	ui.HandleFunc("/admin/cache", cacheHandler)
+}
+
+// cacheEnabled() indicates whether or not the cache is in use.
+func cacheEnabled() bool {
+	return config.Cache().Enabled && !config.Ephemeral()
+}
+
+// cacheable() indicates whether or not req may be answered from the cache.
+func cacheable(req *http.Request) bool {
+	if !cacheEnabled() || req.Method != "GET" || integrityRequired(req) {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" || req.Header.Get("Range") != "" {
+		return false
+	}
+	_, noStore := cacheControl(req.Header)["no-store"]
+	return !noStore
+}
+
+/*
+serveCached() answers req from the cache if possible, and otherwise fetches it
+through the upstream proxy, caching the response if it's cacheable.
+*/
+func serveCached(resp http.ResponseWriter, req *http.Request, upstreamProxy string) {
+	cacheLoaded.Do(loadCache)
+	url := req.URL.String()
+	entry := lookupCached(req)
+	if entry != nil && entry.fresh() && !requiresRevalidation(req) {
+		if serveEntry(resp, entry) {
+			countCache(&cacheStats.Hits)
+			return
+		}
+		entry = nil
+	}
+
+	upstreamReq := req.Clone(req.Context())
+	if entry != nil && !conditional(req) {
+		cacheMutex.Lock()
+		etag, lastModified := entry.Header.Get("ETag"), entry.Header.Get("Last-Modified")
+		cacheMutex.Unlock()
+		if etag != "" {
+			upstreamReq.Header.Set("If-None-Match", etag)
+		}
+		if lastModified != "" {
+			upstreamReq.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+	requestTime := time.Now()
+	upstreamResp, err := fetchThroughPeer(upstreamReq, upstreamProxy)
+	if err != nil {
+		respondBadGateway(resp, req, err.Error())
+		return
+	}
+	defer upstreamResp.Body.Close()
+	responseTime := time.Now()
+
+	// Only answer 304s from the cache if the client didn't make its own
+	// request conditional, in which case the 304 is meant for it
+	if upstreamResp.StatusCode == 304 && entry != nil && !conditional(req) {
+		refreshEntry(entry, upstreamResp, requestTime, responseTime)
+		if serveEntry(resp, entry) {
+			countCache(&cacheStats.Revalidations)
+		} else {
+			respondBadGateway(resp, req, "Cached response disappeared during revalidation")
+		}
+		return
+	}
+	countCache(&cacheStats.Misses)
+	if !storable(upstreamResp) || conditional(req) {
+		copyResponse(resp, upstreamResp)
+		return
+	}
+	entry = &cacheEntry{
+		URL:          url,
+		Vary:         varyingHeaders(req, upstreamResp),
+		StatusCode:   upstreamResp.StatusCode,
+		Header:       upstreamResp.Header.Clone(),
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	removeHopByHopHeaders(entry.Header)
+	storeEntry(resp, upstreamResp, entry)
+}
+
+/*
+fetchThroughPeer() sends req to the upstream proxy, over a multiplexed
+connection if possible and over a connection of its own otherwise.
+*/
+func fetchThroughPeer(req *http.Request, upstreamProxy string) (*http.Response, error) {
+	if transport := multiplexer(upstreamProxy); transport != nil {
+		return roundTripMultiplexed(req, upstreamProxy, transport)
+	}
+	connOut, err := dialUpstream(upstreamProxy)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open socket to upstream proxy: %s", err)
+	}
+	if err := authenticateUpstream(upstreamProxy, connOut, req); err != nil {
+		connOut.Close()
+		return nil, fmt.Errorf("Unable to authenticate upstream proxy: %s", err)
+	}
+	removeHopByHopHeaders(req.Header)
+	if err := req.Write(connOut); err != nil {
+		connOut.Close()
+		return nil, fmt.Errorf("Unable to write request to upstream proxy: %s", err)
+	}
+	upstreamResp, err := http.ReadResponse(bufio.NewReader(connOut), req)
+	if err != nil {
+		connOut.Close()
+		return nil, fmt.Errorf("Unable to read response from upstream proxy: %s", err)
+	}
+	upstreamResp.Body = &connBody{upstreamResp.Body, connOut}
+	return upstreamResp, nil
+}
+
+// connBody is a response body that closes its connection when it's closed.
+type connBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (body *connBody) Close() error {
+	body.ReadCloser.Close()
+	return body.conn.Close()
+}
+
+// invalidateCached() drops the cached response for the URL of req if req is
+// unsafe, since it's likely to change what's there.
+func invalidateCached(req *http.Request) {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "CONNECT":
+		return
+	}
+	if cacheEnabled() {
+		cacheLoaded.Do(loadCache)
+		PurgeCache(req.URL.String())
+	}
+}
+
+// lookupCached() returns the cached response for req, or nil if there is none
+// that matches it.
+func lookupCached(req *http.Request) *cacheEntry {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	entry := cacheEntries[req.URL.String()]
+	if entry == nil {
+		return nil
+	}
+	for name, values := range entry.Vary {
+		if strings.Join(req.Header.Values(name), ",") != strings.Join(values, ",") {
+			return nil
+		}
+	}
+	entry.lastUsed = time.Now()
+	return entry
+}
+
+// serveEntry() writes the cached response to resp, returning false if its
+// body is gone.
+func serveEntry(resp http.ResponseWriter, entry *cacheEntry) bool {
+	body, err := os.Open(cachePath(entry.URL))
+	if err != nil {
+		PurgeCache(entry.URL)
+		return false
+	}
+	defer body.Close()
+	cacheMutex.Lock()
+	header, statusCode, age := entry.Header.Clone(), entry.StatusCode, entry.age()
+	cacheMutex.Unlock()
+	for key, values := range header {
+		for _, value := range values {
+			resp.Header().Add(key, value)
+		}
+	}
+	resp.Header().Set("Age", strconv.Itoa(int(age/time.Second)))
+	resp.WriteHeader(statusCode)
+	io.Copy(resp, body)
+	return true
+}
+
+/*
+storeEntry() writes the response to resp while storing its body in the cache,
+and stores the entry once the whole body made it.  Bodies that turn out to be
+too large are still written to resp but not stored.
+*/
+func storeEntry(resp http.ResponseWriter, upstreamResp *http.Response, entry *cacheEntry) {
+	maxEntrySize := config.Cache().MaxEntrySize
+	if upstreamResp.ContentLength > maxEntrySize {
+		copyResponse(resp, upstreamResp)
+		return
+	}
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		log.Printf("Unable to create cache directory: %s", err)
+		copyResponse(resp, upstreamResp)
+		return
+	}
+	file, err := ioutil.TempFile(cacheDir, "tmp-")
+	if err != nil {
+		log.Printf("Unable to create cache file: %s", err)
+		copyResponse(resp, upstreamResp)
+		return
+	}
+	defer os.Remove(file.Name())
+	tee := &cacheWriter{file: file, max: maxEntrySize}
+	upstreamResp.Body = ioutil.NopCloser(io.TeeReader(upstreamResp.Body, tee))
+	copyResponse(resp, upstreamResp)
+	file.Close()
+	// A body that was cut short would look complete in the cache, so only
+	// bodies of the announced length are stored
+	if tee.err != nil || (upstreamResp.ContentLength >= 0 && tee.size != upstreamResp.ContentLength) {
+		return
+	}
+	entry.Size = tee.size
+	entry.lastUsed = time.Now()
+	metadata, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Unable to encode cache entry for %s: %s", entry.URL, err)
+		return
+	}
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	path := cachePath(entry.URL)
+	if err := ioutil.WriteFile(path+".json", metadata, 0600); err != nil {
+		log.Printf("Unable to save cache entry for %s: %s", entry.URL, err)
+		return
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		log.Printf("Unable to save cached body for %s: %s", entry.URL, err)
+		os.Remove(path + ".json")
+		return
+	}
+	if old := cacheEntries[entry.URL]; old != nil {
+		cacheStats.Size -= old.Size
+	}
+	cacheEntries[entry.URL] = entry
+	cacheStats.Size += entry.Size
+	evict()
+}
+
+// cacheWriter writes a body to a cache file until it grows too large.
+type cacheWriter struct {
+	file *os.File
+	max  int64 // the largest body that we store
+	size int64 // the size of the body so far
+	err  error // the first error, after which nothing more is written
+}
+
+// Write() never fails, so that the body keeps flowing to the client.
+func (writer *cacheWriter) Write(b []byte) (int, error) {
+	writer.size += int64(len(b))
+	if writer.err == nil && writer.size > writer.max {
+		writer.err = fmt.Errorf("Body too large to cache")
+	}
+	if writer.err == nil {
+		_, writer.err = writer.file.Write(b)
+	}
+	return len(b), nil
+}
+
+// refreshEntry() updates a cached response with the headers of a 304 that
+// revalidated it (RFC 9111 section 4.3.4).
+func refreshEntry(entry *cacheEntry, notModified *http.Response, requestTime time.Time, responseTime time.Time) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	removeHopByHopHeaders(notModified.Header)
+	for key, values := range notModified.Header {
+		if key != "Content-Length" {
+			entry.Header[key] = values
+		}
+	}
+	entry.RequestTime = requestTime
+	entry.ResponseTime = responseTime
+	if metadata, err := json.Marshal(entry); err == nil {
+		ioutil.WriteFile(cachePath(entry.URL)+".json", metadata, 0600)
+	}
+}
+
+/*
+evict() evicts the least recently used responses until the cache fits into
+config.Cache().MaxSize.  Must be called with cacheMutex held.
+*/
+func evict() {
+	maxSize := config.Cache().MaxSize
+	if cacheStats.Size <= maxSize {
+		return
+	}
+	entries := make([]*cacheEntry, 0, len(cacheEntries))
+	for _, entry := range cacheEntries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastUsed.Before(entries[j].lastUsed)
+	})
+	for _, entry := range entries {
+		if cacheStats.Size <= maxSize {
+			break
+		}
+		removeEntry(entry)
+		cacheStats.Evictions += 1
+	}
+}
+
+// removeEntry() drops a cached response.  Must be called with cacheMutex held.
+func removeEntry(entry *cacheEntry) {
+	path := cachePath(entry.URL)
+	os.Remove(path)
+	os.Remove(path + ".json")
+	delete(cacheEntries, entry.URL)
+	cacheStats.Size -= entry.Size
+}
+
+// PurgeCache() drops the cached response for the given URL, if any.
+func PurgeCache(url string) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	if entry := cacheEntries[url]; entry != nil {
+		removeEntry(entry)
+	}
+}
+
+// PurgeAllCache() drops all cached responses.
+func PurgeAllCache() {
+	cacheLoaded.Do(loadCache)
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	for _, entry := range cacheEntries {
+		removeEntry(entry)
+	}
+}
+
+// CacheStatistics() returns a snapshot of the statistics of the cache.
+func CacheStatistics() CacheStats {
+	cacheLoaded.Do(loadCache)
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	stats := cacheStats
+	stats.Enabled = cacheEnabled()
+	stats.Entries = len(cacheEntries)
+	stats.MaxSize = config.Cache().MaxSize
+	return stats
+}
+
+// countCache() increments one of the counters in cacheStats.
+func countCache(counter *int64) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	*counter += 1
+}
+
+// loadCache() loads the index of the cache from disk, cleaning up whatever
+// was left behind half written.
+func loadCache() {
+	files, err := filepath.Glob(filepath.Join(cacheDir, "*"))
+	if err != nil {
+		return
+	}
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	for _, file := range files {
+		if strings.HasPrefix(filepath.Base(file), "tmp-") {
+			os.Remove(file)
+			continue
+		}
+		if !strings.HasSuffix(file, ".json") {
+			continue
+		}
+		entry := &cacheEntry{}
+		data, err := ioutil.ReadFile(file)
+		if err == nil {
+			err = json.Unmarshal(data, entry)
+		}
+		if err != nil || cachePath(entry.URL)+".json" != file {
+			log.Printf("Dropping invalid cache entry %s", file)
+			os.Remove(file)
+			os.Remove(strings.TrimSuffix(file, ".json"))
+			continue
+		}
+		entry.lastUsed = entry.ResponseTime
+		cacheEntries[entry.URL] = entry
+		cacheStats.Size += entry.Size
+	}
+	evict()
+}
+
+// cachePath() returns the path of the cached body for the given URL, which is
+// named by the URL's hash.
+func cachePath(url string) string {
+	hash := sha256.Sum256([]byte(url))
+	return filepath.Join(cacheDir, hex.EncodeToString(hash[:]))
+}
+
+// age() returns the current age of the cached response (RFC 9111 section
+// 4.2.3).
+func (entry *cacheEntry) age() time.Duration {
+	apparentAge := time.Duration(0)
+	if date, err := http.ParseTime(entry.Header.Get("Date")); err == nil && entry.ResponseTime.After(date) {
+		apparentAge = entry.ResponseTime.Sub(date)
+	}
+	correctedAge := entry.ResponseTime.Sub(entry.RequestTime)
+	if ageValue, err := strconv.Atoi(entry.Header.Get("Age")); err == nil {
+		correctedAge += time.Duration(ageValue) * time.Second
+	}
+	if apparentAge > correctedAge {
+		correctedAge = apparentAge
+	}
+	return correctedAge + time.Since(entry.ResponseTime)
+}
+
+// lifetime() returns the freshness lifetime of a response with the given
+// status and headers (RFC 9111 section 4.2.1), or 0 if it has none.
+func lifetime(statusCode int, header http.Header) time.Duration {
+	directives := cacheControl(header)
+	if maxAge, found := directives["max-age"]; found {
+		if seconds, err := strconv.Atoi(maxAge); err == nil {
+			return time.Duration(seconds) * time.Second
+		}
+		return 0
+	}
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		return 0
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		if expiry, err := http.ParseTime(expires); err == nil && expiry.After(date) {
+			return expiry.Sub(date)
+		}
+		return 0
+	}
+	if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil && heuristicallyCacheable[statusCode] && date.After(lastModified) {
+		heuristic := date.Sub(lastModified) / HEURISTIC_FRACTION
+		if heuristic > MAX_HEURISTIC_LIFETIME {
+			heuristic = MAX_HEURISTIC_LIFETIME
+		}
+		return heuristic
+	}
+	return 0
+}
+
+// fresh() indicates whether or not the cached response may be served without
+// revalidation.
+func (entry *cacheEntry) fresh() bool {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	if _, noCache := cacheControl(entry.Header)["no-cache"]; noCache {
+		return false
+	}
+	return lifetime(entry.StatusCode, entry.Header) > entry.age()
+}
+
+// storable() indicates whether or not the given response may be stored.
+func storable(upstreamResp *http.Response) bool {
+	directives := cacheControl(upstreamResp.Header)
+	if _, noStore := directives["no-store"]; noStore {
+		return false
+	}
+	// Responses meant for a single user must not reach other clients on the
+	// LAN
+	if _, private := directives["private"]; private || len(upstreamResp.Header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	if upstreamResp.Header.Get("Vary") == "*" || upstreamResp.StatusCode == 206 || upstreamResp.StatusCode == 304 {
+		return false
+	}
+	_, noCache := directives["no-cache"]
+	validated := upstreamResp.Header.Get("ETag") != "" || upstreamResp.Header.Get("Last-Modified") != ""
+	return lifetime(upstreamResp.StatusCode, upstreamResp.Header) > 0 || (noCache && validated)
+}
+
+// requiresRevalidation() indicates whether or not the client insists on a
+// response that's validated with the origin server.
+func requiresRevalidation(req *http.Request) bool {
+	directives := cacheControl(req.Header)
+	_, noCache := directives["no-cache"]
+	return noCache || directives["max-age"] == "0" || strings.Contains(req.Header.Get("Pragma"), "no-cache")
+}
+
+// conditional() indicates whether or not the client made req conditional
+// itself.
+func conditional(req *http.Request) bool {
+	return req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+}
+
+// varyingHeaders() returns the headers of req that the response varies by.
+func varyingHeaders(req *http.Request, upstreamResp *http.Response) http.Header {
+	vary := make(http.Header)
+	for _, value := range upstreamResp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				vary[http.CanonicalHeaderKey(name)] = req.Header.Values(name)
+			}
+		}
+	}
+	return vary
+}
+
+// cacheControl() parses the Cache-Control directives in header.
+func cacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, argument, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(argument, "\"")
+			}
+		}
+	}
+	return directives
+}
+
+// cacheHandler() shows the statistics of the cache, and purges it on request.
+func cacheHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		if req.FormValue("purge") == "all" {
+			PurgeAllCache()
+		} else if url := req.FormValue("url"); url != "" {
+			cacheLoaded.Do(loadCache)
+			PurgeCache(url)
+		} else {
+			resp.WriteHeader(400)
+			resp.Write([]byte("Specify purge=all or url=<url>"))
+			return
+		}
+	}
+	if statsJson, err := json.MarshalIndent(CacheStatistics(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(statsJson)
+	}
+}
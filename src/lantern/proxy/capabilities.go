@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"lantern/config"
+	"lantern/parentconfig"
+	"lantern/signaling"
+	"log"
+)
+
+const (
+	PROTOCOL_VERSION = 2     // the highest version of the proxy protocol that we speak (see handshake.go)
+	TRANSPORT_TLS    = "tls" // HTTP proxying over TLS, the only transport we support so far
+)
+
+/*
+advertiseCapabilities(), meant to be run as a goroutine, advertises the
+capabilities of our remote proxy over the signaling channel (see
+signaling.SetCapabilities()) and updates them whenever relaying is switched on
+or off or our external IP changes (see config.WatchExternalIP()).
+*/
+func advertiseCapabilities() {
+	relayChanges := make(chan bool, 1)
+	relay.Watch(relayChanges)
+	externalIPChanges := make(chan string, 1)
+	config.WatchExternalIP(externalIPChanges)
+	if config.AdvertiseIP() == "" && config.BindIP() == "" {
+		go config.DiscoverExternalIP()
+	}
+	giveMode := relay.Enabled()
+	for {
+		addresses := config.AdvertisedRemoteProxyAddresses()
+		if len(addresses) > signaling.MAX_ADVERTISED {
+			log.Printf("Only advertising the first %d of our proxy addresses", signaling.MAX_ADVERTISED)
+			addresses = addresses[:signaling.MAX_ADVERTISED]
+		}
+		err := signaling.SetCapabilities(signaling.Capabilities{
+			ProxyAddresses: addresses,
+			Transports:     parentconfig.Transports([]string{TRANSPORT_TLS}),
+			ProtocolVersions: map[string]int{
+				"proxy":     PROTOCOL_VERSION,
+				"signaling": signaling.PROTOCOL_VERSION,
+			},
+			GiveMode:       giveMode,
+			BandwidthClass: config.BandwidthClass(),
+		})
+		if err != nil {
+			log.Printf("Unable to advertise capabilities: %s", err)
+		}
+		select {
+		case giveMode = <-relayChanges:
+		case <-externalIPChanges:
+		}
+	}
+}
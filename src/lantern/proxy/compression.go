@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"lantern/features"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+Compression saves bandwidth for users on constrained links by having the exit
+peer gzip compressible responses before they cross the peer hop, and the local
+proxy decompress them before they reach the browser.
+
+It only applies to plain HTTP requests over multiplexed connections (see
+multiplex.go), since those are the only responses that the exit peer parses.
+Peers negotiate it with FLAG_COMPRESSION during the handshake, and the local
+proxy asks for it by marking requests with X_LANTERN_ACCEPT_COMPRESSION unless
+the "compression" feature flag is switched off.
+
+The exit peer only compresses responses that aren't encoded already, that have
+a body of at least MIN_COMPRESSIBLE_LENGTH bytes (if it's known) and whose
+Content-Type is one of compressibleTypes, so images, video and archives pass
+through untouched.  Compressed responses are marked with
+X_LANTERN_COMPRESSION.  Their Content-Length no longer matches, so the original
+is passed along in X_LANTERN_CONTENT_LENGTH.  Brotli would compress better,
+but isn't in the standard library.
+*/
+const (
+	X_LANTERN_ACCEPT_COMPRESSION = "X-Lantern-Accept-Compression"
+	X_LANTERN_COMPRESSION        = "X-Lantern-Compression"
+	X_LANTERN_CONTENT_LENGTH     = "X-Lantern-Content-Length"
+
+	COMPRESSION_GZIP        = "gzip" // the only compression that we support so far
+	MIN_COMPRESSIBLE_LENGTH = 1024   // bodies shorter than this aren't worth compressing
+)
+
+// compression is the switch for asking exit peers to compress responses
+var compression = features.Register("compression", true, "have exit peers compress responses to save bandwidth")
+
+// compressibleTypes are the media types whose content compresses well, besides
+// text/*.
+var compressibleTypes = map[string]bool{
+	"application/javascript": true,
+	"application/json":       true,
+	"application/xml":        true,
+	"application/xhtml+xml":  true,
+	"application/rss+xml":    true,
+	"application/atom+xml":   true,
+	"image/svg+xml":          true,
+}
+
+// requestCompression() marks the given request to an upstream proxy to ask for
+// compression, if the upstream proxy supports it and we want it.
+func requestCompression(upstreamProxy string, req *http.Request) {
+	if compression.Enabled() && peerSupports(upstreamProxy, FLAG_COMPRESSION) {
+		req.Header.Set(X_LANTERN_ACCEPT_COMPRESSION, COMPRESSION_GZIP)
+	}
+}
+
+/*
+acceptsCompression() indicates whether or not the downstream peer asked for
+compression of the response to req, stripping the marker so that it isn't
+passed on to the origin server.
+*/
+func acceptsCompression(req *http.Request) bool {
+	accepted := req.Header.Get(X_LANTERN_ACCEPT_COMPRESSION) == COMPRESSION_GZIP
+	req.Header.Del(X_LANTERN_ACCEPT_COMPRESSION)
+	return accepted && negotiated(req, FLAG_COMPRESSION)
+}
+
+// compressResponse() compresses the body of the given response from the origin
+// server to req, if it's worth it.
+func compressResponse(req *http.Request, originResp *http.Response) {
+	if !compressible(req, originResp) {
+		return
+	}
+	body := originResp.Body
+	reader, writer := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(writer)
+		_, err := io.Copy(gz, body)
+		if err == nil {
+			err = gz.Close()
+		}
+		body.Close()
+		writer.CloseWithError(err)
+	}()
+	originResp.Body = reader
+	if originResp.ContentLength >= 0 {
+		originResp.Header.Set(X_LANTERN_CONTENT_LENGTH, strconv.FormatInt(originResp.ContentLength, 10))
+	}
+	originResp.Header.Del("Content-Length")
+	originResp.ContentLength = -1
+	originResp.Header.Set(X_LANTERN_COMPRESSION, COMPRESSION_GZIP)
+}
+
+// compressible() indicates whether or not the given response is worth
+// compressing.
+func compressible(req *http.Request, originResp *http.Response) bool {
+	if req.Method == "HEAD" || originResp.StatusCode == 204 || originResp.StatusCode == 304 {
+		return false
+	}
+	if encoding := originResp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return false
+	}
+	if originResp.ContentLength >= 0 && originResp.ContentLength < MIN_COMPRESSIBLE_LENGTH {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(originResp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType]
+}
+
+// decompressResponse() undoes compressResponse() on a response that we got
+// from an upstream proxy.
+func decompressResponse(upstreamResp *http.Response) error {
+	if upstreamResp.Header.Get(X_LANTERN_COMPRESSION) == "" {
+		return nil
+	}
+	gz, err := gzip.NewReader(upstreamResp.Body)
+	if err != nil {
+		return err
+	}
+	upstreamResp.Body = &decompressedBody{gz, upstreamResp.Body}
+	upstreamResp.Header.Del(X_LANTERN_COMPRESSION)
+	if length := upstreamResp.Header.Get(X_LANTERN_CONTENT_LENGTH); length != "" {
+		upstreamResp.Header.Set("Content-Length", length)
+		upstreamResp.Header.Del(X_LANTERN_CONTENT_LENGTH)
+	}
+	return nil
+}
+
+// decompressedBody reads the decompressed content of a response body and
+// closes the response body when it's closed.
+type decompressedBody struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (body *decompressedBody) Close() error {
+	if err := body.Reader.Close(); err != nil {
+		log.Printf("Unable to finish decompressing response: %s", err)
+	}
+	return body.body.Close()
+}
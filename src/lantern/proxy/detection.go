@@ -0,0 +1,342 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"lantern/config"
+	"lantern/ui"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Censorship detection lets the local proxy learn which sites are blocked where
+we are, so that only those need to go through peers and everything else takes
+the faster direct route.  It's switched on with config.DetectCensorship().
+
+Unless its domain is already known to be blocked, every request is first tried
+directly:
+
+- CONNECT requests are answered right away and the client's first bytes
+  (normally a TLS ClientHello, which is what SNI filtering looks at) are sent
+  to the site.  If the site doesn't answer within DIRECT_TIMEOUT, or the
+  connection is reset or can't be opened in the first place, the same bytes go
+  through a peer instead.  Clients that wait for the site to speak first can't
+  be checked, so after CLIENT_FIRST_TIMEOUT without any bytes from the client
+  they simply stay direct.
+- plain HTTP requests are sent to the site and fall back to a peer the same
+  way, as long as they never made it out or are safe to repeat (GET, HEAD and
+  OPTIONS).
+
+Whatever goes wrong with a direct attempt counts as blocking, be it a timeout,
+a reset, a refused connection or a failed DNS lookup, since censors use all of
+them.  The domain is then remembered as blocked for BLOCKED_TTL, during which
+its requests go straight to peers.  The learned domains are kept in
+[ConfigDir]/blocked.json (except on ephemeral nodes) and listed at
+http://[config.UIAddress()]/diagnostics/blocked, where POSTing forget=<domain>
+forgets one.
+
+When the "get" feature is switched off (see localGet in local.go), everything
+goes directly without ever falling back to peers, and so does the traffic of
+processes routed directly (see apps.go).
+
+Block pages that censors serve in place of the real content look like any
+other response, so they aren't detected.  Requests to integrity domains (see
+integrity.go) always go through peers.
+*/
+const (
+	DIRECT_TIMEOUT       = 5 * time.Second // how long a direct attempt may take before we consider it blocked
+	CLIENT_FIRST_TIMEOUT = time.Second     // how long we wait for the first bytes of a CONNECTing client
+	BLOCKED_TTL          = 24 * time.Hour  // how long a domain is remembered as blocked
+	FIRST_BYTES_SIZE     = 16 * 1024       // the most that we read of the first bytes of either side
+)
+
+var (
+	blockedDomains = make(map[string]time.Time)         // when domains stop counting as blocked, by domain
+	blockedFile    = config.ConfigDir + "/blocked.json" // where the blocked domains are kept
+	blockedLoaded  sync.Once                            // makes sure that the blocked domains are only loaded once
+	blockedMutex   sync.Mutex                           // used to synchronize access to blockedDomains and blockedFile
+)
+
+func init() {
+	ui.HandleFunc("/diagnostics/blocked", blockedHandler)
+}
+
+/*
+tryDirect() indicates whether or not req should be tried directly first, which
+is always the case when we don't get access through peers (see localGet in
+local.go), and otherwise depends on the process that req comes from (see
+apps.go) and on what we learned about its domain.
+*/
+func tryDirect(req *http.Request) bool {
+	if !localGet.Enabled() {
+		return true
+	}
+	switch routeOf(req) {
+	case config.ROUTE_DIRECT:
+		return true
+	case config.ROUTE_PROXY:
+		return false
+	}
+	return !integrityRequired(req) && tryDomainDirect(requestDomain(req))
+}
+
+/*
+tryDomainDirect() indicates whether or not traffic to the given domain should
+be tried directly first, leaving aside what depends on the request itself, like
+integrity verification.
+*/
+func tryDomainDirect(domain string) bool {
+	if !localGet.Enabled() {
+		return true
+	}
+	return config.DetectCensorship() && !knownBlocked(domain)
+}
+
+// requestDomain() returns the domain that req is for.
+func requestDomain(req *http.Request) string {
+	return strings.ToLower(req.URL.Hostname())
+}
+
+// serveDirect() serves req directly, falling back to a peer if the site seems
+// to be blocked.
+func serveDirect(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "CONNECT" {
+		tunnelDirect(resp, req)
+	} else {
+		fetchDirect(resp, req)
+	}
+}
+
+/*
+tunnelDirect() tunnels the client's connection directly to the host that the
+CONNECT request req is for, or through a peer if the host doesn't answer.
+*/
+func tunnelDirect(resp http.ResponseWriter, req *http.Request) {
+	host := hostIncludingPort(req)
+	connIn, _, err := resp.(http.Hijacker).Hijack()
+	if err != nil {
+		respondBadGateway(resp, req, fmt.Sprintf("Unable to access underlying connection from client: %s", err))
+		return
+	}
+	connIn.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+	connOut, err := net.DialTimeout("tcp", host, DIRECT_TIMEOUT)
+	if err != nil {
+		tunnelThroughPeer(connIn, req, nil, err)
+		return
+	}
+
+	clientFirst := make([]byte, FIRST_BYTES_SIZE)
+	connIn.SetReadDeadline(time.Now().Add(CLIENT_FIRST_TIMEOUT))
+	n, err := connIn.Read(clientFirst)
+	connIn.SetReadDeadline(time.Time{})
+	if netErr, ok := err.(net.Error); n == 0 && ok && netErr.Timeout() {
+		// The site speaks first, so there's nothing that we can check
+		pipe(connIn, connOut, newFlow(req))
+		return
+	} else if n == 0 {
+		connIn.Close()
+		connOut.Close()
+		return
+	}
+	clientFirst = clientFirst[:n]
+
+	serverFirst := make([]byte, FIRST_BYTES_SIZE)
+	connOut.SetDeadline(time.Now().Add(DIRECT_TIMEOUT))
+	_, err = connOut.Write(clientFirst)
+	if err == nil {
+		n, err = connOut.Read(serverFirst)
+	}
+	connOut.SetDeadline(time.Time{})
+	if n == 0 {
+		connOut.Close()
+		tunnelThroughPeer(connIn, req, clientFirst, err)
+		return
+	}
+	if _, err := connIn.Write(serverFirst[:n]); err != nil {
+		connIn.Close()
+		connOut.Close()
+		return
+	}
+	accessEntryOf(req).relayed(len(clientFirst), false)
+	accessEntryOf(req).relayed(n, true)
+	pipe(connIn, connOut, newFlow(req))
+}
+
+// tunnelThroughPeer() remembers the host of req as blocked and tunnels the
+// client's connection to it through a peer, starting with clientFirst.
+func tunnelThroughPeer(connIn net.Conn, req *http.Request, clientFirst []byte, directErr error) {
+	if !peersAllowed(req) {
+		log.Printf("Unable to reach %s directly: %s", req.Host, directErr)
+		connIn.Close()
+		return
+	}
+	markBlocked(requestDomain(req), directErr)
+	if upstreamProxy, err := selectUpstream(); err == nil {
+		// connectUpstream() goes through the same upstream proxy
+		accessEntryOf(req).via(upstreamProxy)
+	}
+	connOut, err := connectUpstream(hostIncludingPort(req))
+	if err != nil {
+		log.Printf("Unable to tunnel to %s through a peer: %s", req.Host, err)
+		connIn.Close()
+		return
+	}
+	if _, err := connOut.Write(clientFirst); err != nil {
+		connIn.Close()
+		connOut.Close()
+		return
+	}
+	accessEntryOf(req).relayed(len(clientFirst), false)
+	pipe(connIn, connOut, newFlow(req))
+}
+
+// fetchDirect() fetches the plain HTTP request req directly from the origin
+// server, or through a peer if the origin server doesn't answer.
+func fetchDirect(resp http.ResponseWriter, req *http.Request) {
+	directReq := req.Clone(req.Context())
+	directReq.RequestURI = ""
+	removeHopByHopHeaders(directReq.Header)
+	connOut, err := net.DialTimeout("tcp", hostIncludingPort(req), DIRECT_TIMEOUT)
+	if err != nil && !peersAllowed(req) {
+		respondBadGateway(resp, req, fmt.Sprintf("Unable to reach %s directly: %s", req.Host, err))
+		return
+	} else if err != nil {
+		markBlocked(requestDomain(req), err)
+		handleLocalRequest(resp, req)
+		return
+	}
+	connOut.SetDeadline(time.Now().Add(DIRECT_TIMEOUT))
+	err = directReq.Write(connOut)
+	var originResp *http.Response
+	if err == nil {
+		originResp, err = http.ReadResponse(bufio.NewReader(connOut), directReq)
+	}
+	if err != nil && !peersAllowed(req) {
+		connOut.Close()
+		respondBadGateway(resp, req, fmt.Sprintf("Unable to reach %s directly: %s", req.Host, err))
+		return
+	} else if err != nil {
+		connOut.Close()
+		markBlocked(requestDomain(req), err)
+		if repeatable(req) {
+			handleLocalRequest(resp, req)
+		} else {
+			respondBadGateway(resp, req, fmt.Sprintf("Unable to reach %s directly, it seems to be blocked: %s", req.Host, err))
+		}
+		return
+	}
+	connOut.SetDeadline(time.Time{})
+	defer connOut.Close()
+	defer originResp.Body.Close()
+	copyResponse(resp, originResp)
+}
+
+// repeatable() indicates whether or not req may be sent again after a direct
+// attempt failed.
+func repeatable(req *http.Request) bool {
+	return req.Method == "GET" || req.Method == "HEAD" || req.Method == "OPTIONS"
+}
+
+// knownBlocked() indicates whether or not the given domain was recently found
+// to be blocked.
+func knownBlocked(domain string) bool {
+	blockedLoaded.Do(loadBlocked)
+	blockedMutex.Lock()
+	defer blockedMutex.Unlock()
+	expiry, found := blockedDomains[domain]
+	if found && time.Now().After(expiry) {
+		delete(blockedDomains, domain)
+		return false
+	}
+	return found
+}
+
+// markBlocked() remembers the given domain as blocked because of the given
+// error from a direct attempt.
+func markBlocked(domain string, directErr error) {
+	blockedLoaded.Do(loadBlocked)
+	log.Printf("%s seems to be blocked, going through peers for the next %s: %s", domain, BLOCKED_TTL, directErr)
+	blockedMutex.Lock()
+	defer blockedMutex.Unlock()
+	blockedDomains[domain] = time.Now().Add(BLOCKED_TTL)
+	saveBlocked()
+}
+
+// BlockedDomains() returns the domains that are currently known to be
+// blocked, and when they stop counting as blocked.
+func BlockedDomains() map[string]time.Time {
+	blockedLoaded.Do(loadBlocked)
+	blockedMutex.Lock()
+	defer blockedMutex.Unlock()
+	domains := make(map[string]time.Time)
+	for domain, expiry := range blockedDomains {
+		if time.Now().Before(expiry) {
+			domains[domain] = expiry
+		}
+	}
+	return domains
+}
+
+// ForgetBlocked() forgets that the given domain was found to be blocked, so
+// that it's tried directly again.
+func ForgetBlocked(domain string) {
+	blockedLoaded.Do(loadBlocked)
+	blockedMutex.Lock()
+	defer blockedMutex.Unlock()
+	delete(blockedDomains, strings.ToLower(domain))
+	saveBlocked()
+}
+
+// loadBlocked() loads the blocked domains that we learned before.
+func loadBlocked() {
+	data, err := ioutil.ReadFile(blockedFile)
+	if err != nil {
+		return
+	}
+	blockedMutex.Lock()
+	defer blockedMutex.Unlock()
+	if err := json.Unmarshal(data, &blockedDomains); err != nil {
+		log.Printf("Unable to load blocked domains from %s: %s", blockedFile, err)
+	}
+}
+
+// saveBlocked() saves the blocked domains.  Must be called with blockedMutex
+// held.
+func saveBlocked() {
+	if config.Ephemeral() {
+		return
+	}
+	if data, err := json.MarshalIndent(blockedDomains, "", "   "); err != nil {
+		log.Printf("Unable to encode blocked domains: %s", err)
+	} else if err := ioutil.WriteFile(blockedFile, data, 0600); err != nil {
+		log.Printf("Unable to save blocked domains to %s: %s", blockedFile, err)
+	}
+}
+
+// blockedHandler() shows the domains that are known to be blocked, and
+// forgets one on request.
+func blockedHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		domain := req.FormValue("forget")
+		if domain == "" {
+			resp.WriteHeader(400)
+			resp.Write([]byte("Specify forget=<domain>"))
+			return
+		}
+		ForgetBlocked(domain)
+	}
+	if blockedJson, err := json.MarshalIndent(BlockedDomains(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(blockedJson)
+	}
+}
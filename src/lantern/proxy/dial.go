@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+/*
+Dial() connects to the given address through our upstream proxy, which it
+selects, authenticates and has CONNECT to the address just like the local proxy
+would for a CONNECT from the browser, so the connection goes the same path
+(multiplexed, through an entry proxy and so on).  Only TCP networks are
+supported.  Cancelling ctx abandons the dial, but not the connection once it's
+returned.
+
+Unlike the local proxy, Dial() never goes directly, not even when we don't get
+access through peers, since whoever asks for a tunnel asks for it on purpose.
+*/
+func Dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("Unable to dial %s, only TCP is tunneled", network)
+	}
+	type dialed struct {
+		conn net.Conn
+		err  error
+	}
+	result := make(chan dialed, 1)
+	go func() {
+		conn, err := connectUpstream(address)
+		result <- dialed{conn, err}
+	}()
+	select {
+	case d := <-result:
+		return d.conn, d.err
+	case <-ctx.Done():
+		go func() {
+			// Whatever we get now nobody waits for anymore
+			if d := <-result; d.conn != nil {
+				d.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,453 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lantern/config"
+	"lantern/util"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The DNS forwarder at config.DNSAddress() keeps DNS in line with how the local
+proxy routes traffic, so that poisoned answers for blocked domains don't send
+apps that resolve names themselves to the wrong place.  Pointing the system's
+DNS at it (or the LAN's, together with the transparent proxy) is enough.
+
+Every query is routed like traffic to the domain that it's about (see
+tryDomainDirect() and detection.go):
+
+- domains that are tried directly are resolved directly with
+  config.DNSResolver(), and if that doesn't answer within DNS_TIMEOUT the query
+  goes through a peer instead.  Once DNS_FAILURES_TO_BLOCK direct lookups of a
+  domain in a row failed, the domain counts as blocked, just like when a direct
+  connection fails
+- blocked domains, integrity domains (see integrity.go) and, without
+  censorship detection, all domains are resolved through a peer with DNS over
+  HTTPS (RFC 8484) at config.DoHURL(), so that censors between us and our
+  peers never see the query
+
+Queries are passed on as they are and answers come back unchanged, the
+forwarder doesn't cache anything.  Queries that can't be answered either way
+get SERVFAIL.
+
+The forwarder answers over both UDP and TCP at the same address.  Answers over
+UDP that are larger than the client accepts (MIN_DNS_UDP_SIZE, or whatever it
+announces with EDNS up to MAX_DNS_MESSAGE) are truncated to the question with
+the TC flag set, so that the client asks again over TCP.  At most
+MAX_DNS_QUERIES queries are resolved at once, further UDP queries are dropped
+(clients ask again) and TCP clients wait, and at most MAX_DNS_CONNECTIONS TCP
+clients are served at once.
+*/
+const (
+	DNS_TIMEOUT           = 2 * time.Second           // how long the direct resolver may take to answer
+	DOH_TIMEOUT           = 10 * time.Second          // how long a lookup through a peer may take
+	DNS_TCP_IDLE_TIMEOUT  = 10 * time.Second          // how long a TCP client may stay silent between queries
+	DNS_FAILURES_TO_BLOCK = 3                         // how many direct lookups of a domain in a row have to fail before it counts as blocked
+	DNS_FAILURES_TRACKED  = 1000                      // for how many domains we count failed direct lookups before we start over
+	MAX_DNS_QUERIES       = 100                       // how many queries we resolve at once
+	MAX_DNS_CONNECTIONS   = 50                        // how many TCP clients we serve at once
+	MIN_DNS_UDP_SIZE      = 512                       // the size of the UDP answers that clients without EDNS accept
+	MAX_DNS_MESSAGE       = 4096                      // the largest DNS message that we pass on over UDP
+	MAX_DNS_TCP_MESSAGE   = 65535                     // the largest DNS message over TCP
+	DNS_MESSAGE_TYPE      = "application/dns-message" // the content type of DNS over HTTPS
+	dnsRcodeServfail      = 2
+	dnsFlagTruncated      = 0x02 // the TC flag in the third byte of the header
+	dnsTypeOPT            = 41   // the type of the EDNS pseudo record
+)
+
+// dnsQuestion is the question of a DNS query.
+type dnsQuestion struct {
+	labels []string // the labels of the name in the question
+	qtype  uint16   // the type of the question
+	qclass uint16   // the class of the question
+	end    int      // the offset in the query at which the question ends
+}
+
+// dohClient makes DNS over HTTPS requests through peers.
+var dohClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return connectUpstream(addr)
+		},
+	},
+	Timeout: DOH_TIMEOUT,
+}
+
+var (
+	dnsQueries          = make(chan bool, MAX_DNS_QUERIES)     // holds a value for every query that's being resolved
+	dnsConnections      = make(chan bool, MAX_DNS_CONNECTIONS) // holds a value for every TCP client that's being served
+	directFailures      = make(map[string]int)                 // direct lookups that failed in a row, by domain
+	directFailuresMutex sync.Mutex                             // used to synchronize access to directFailures
+)
+
+func init() {
+	if !config.Runs(config.SUBSYSTEM_LOCAL_PROXY) {
+		// The forwarder routes like the local proxy, which doesn't run
+		return
+	}
+	if address := config.DNSAddress(); address != "" {
+		util.Go("dns forwarder", func() error {
+			return forwardDNS(address)
+		})
+		util.Go("dns forwarder over tcp", func() error {
+			return forwardDNSOverTCP(address)
+		})
+	}
+}
+
+// forwardDNS() answers DNS queries over UDP at the given address until it
+// fails.
+func forwardDNS(address string) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Printf("About to forward DNS at: %s", address)
+	for {
+		buf := make([]byte, MAX_DNS_MESSAGE)
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		select {
+		case dnsQueries <- true:
+		default:
+			// The client asks again if it doesn't get an answer
+			continue
+		}
+		go func(query []byte, from net.Addr) {
+			defer func() { <-dnsQueries }()
+			if answer := resolve(query); answer != nil {
+				conn.WriteTo(truncateForUDP(query, answer), from)
+			}
+		}(buf[:n], from)
+	}
+}
+
+// forwardDNSOverTCP() answers DNS queries over TCP at the given address until
+// it fails.
+func forwardDNSOverTCP(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		select {
+		case dnsConnections <- true:
+		default:
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer func() { <-dnsConnections }()
+			serveDNSConn(conn)
+		}()
+	}
+}
+
+// serveDNSConn() answers the queries of a TCP client one after the other,
+// until it stays silent for DNS_TCP_IDLE_TIMEOUT.
+func serveDNSConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(DNS_TCP_IDLE_TIMEOUT))
+		query, err := readDNSMessage(reader)
+		if err != nil {
+			return
+		}
+		dnsQueries <- true
+		answer := resolve(query)
+		<-dnsQueries
+		if answer == nil {
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(DNS_TCP_IDLE_TIMEOUT))
+		if err := writeDNSMessage(conn, answer); err != nil {
+			return
+		}
+	}
+}
+
+// readDNSMessage() reads a DNS message prefixed by its length, as used over
+// TCP.
+func readDNSMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// writeDNSMessage() writes the given DNS message prefixed by its length, as
+// used over TCP.
+func writeDNSMessage(w io.Writer, message []byte) error {
+	if len(message) > MAX_DNS_TCP_MESSAGE {
+		return fmt.Errorf("DNS message too large: %d bytes", len(message))
+	}
+	prefixed := make([]byte, 2, 2+len(message))
+	binary.BigEndian.PutUint16(prefixed, uint16(len(message)))
+	_, err := w.Write(append(prefixed, message...))
+	return err
+}
+
+/*
+truncateForUDP() returns the given answer to the given query if the client
+accepts answers of its size over UDP, and otherwise just the header and
+question of the answer with the TC flag set.
+*/
+func truncateForUDP(query []byte, answer []byte) []byte {
+	question := parseQuestion(query)
+	if question == nil || len(answer) <= udpPayloadSize(query, question) {
+		return answer
+	}
+	response := make([]byte, 12, question.end)
+	copy(response, answer[:4])
+	response[2] |= dnsFlagTruncated
+	binary.BigEndian.PutUint16(response[4:], 1)
+	return append(response, query[12:question.end]...)
+}
+
+/*
+udpPayloadSize() returns the size of the UDP answers that the client accepts,
+as announced in the EDNS pseudo record of the given query (between
+MIN_DNS_UDP_SIZE and MAX_DNS_MESSAGE), or MIN_DNS_UDP_SIZE without one.
+*/
+func udpPayloadSize(query []byte, question *dnsQuestion) int {
+	size := MIN_DNS_UDP_SIZE
+	answers := int(binary.BigEndian.Uint16(query[6:])) + int(binary.BigEndian.Uint16(query[8:]))
+	additional := int(binary.BigEndian.Uint16(query[10:]))
+	i := question.end
+	for record := 0; record < answers+additional; record++ {
+		if i = skipName(query, i); i < 0 || i+10 > len(query) {
+			break
+		}
+		// The class of the OPT record is the UDP payload size
+		if record >= answers && binary.BigEndian.Uint16(query[i:]) == dnsTypeOPT {
+			size = int(binary.BigEndian.Uint16(query[i+2:]))
+		}
+		i += 10 + int(binary.BigEndian.Uint16(query[i+8:]))
+	}
+	if size < MIN_DNS_UDP_SIZE {
+		return MIN_DNS_UDP_SIZE
+	}
+	if size > MAX_DNS_MESSAGE {
+		return MAX_DNS_MESSAGE
+	}
+	return size
+}
+
+// skipName() returns the offset after the name at the given offset of the
+// given DNS message, or -1 if it's malformed.
+func skipName(message []byte, i int) int {
+	for i < len(message) {
+		length := int(message[i])
+		switch {
+		case length == 0:
+			return i + 1
+		case length&0xC0 == 0xC0:
+			// A compression pointer ends the name
+			if i+2 > len(message) {
+				return -1
+			}
+			return i + 2
+		case length > 63:
+			return -1
+		}
+		i += 1 + length
+	}
+	return -1
+}
+
+/*
+resolve() answers the given DNS query, either directly or through a peer
+depending on the domain that it's about.  Returns nil if the query is
+malformed.
+*/
+func resolve(query []byte) []byte {
+	question := parseQuestion(query)
+	if question == nil {
+		return nil
+	}
+	domain := strings.ToLower(strings.Join(question.labels, "."))
+	if tryDomainDirect(domain) && !isIntegrityDomain(domain) {
+		answer, err := resolveDirect(query)
+		if err == nil {
+			directLookupSucceeded(domain)
+			return answer
+		}
+		if !localGet.Enabled() {
+			log.Printf("Unable to resolve %s directly: %s", domain, err)
+			return dnsFailure(query, question)
+		}
+		if directLookupFailed(domain) {
+			markBlocked(domain, err)
+		}
+	}
+	answer, err := resolveThroughPeer(query)
+	if err != nil {
+		log.Printf("Unable to resolve %s through a peer: %s", domain, err)
+		return dnsFailure(query, question)
+	}
+	return answer
+}
+
+// directLookupSucceeded() forgets the failed direct lookups of the given
+// domain.
+func directLookupSucceeded(domain string) {
+	directFailuresMutex.Lock()
+	defer directFailuresMutex.Unlock()
+	delete(directFailures, domain)
+}
+
+// directLookupFailed() counts a failed direct lookup of the given domain,
+// returning true once DNS_FAILURES_TO_BLOCK of them failed in a row.
+func directLookupFailed(domain string) bool {
+	directFailuresMutex.Lock()
+	defer directFailuresMutex.Unlock()
+	if len(directFailures) >= DNS_FAILURES_TRACKED {
+		directFailures = make(map[string]int)
+	}
+	directFailures[domain] += 1
+	if directFailures[domain] < DNS_FAILURES_TO_BLOCK {
+		return false
+	}
+	delete(directFailures, domain)
+	return true
+}
+
+/*
+resolveDirect() asks config.DNSResolver() the given query, over TCP if the
+answer over UDP is truncated.
+*/
+func resolveDirect(query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", config.DNSResolver(), DNS_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(DNS_TIMEOUT))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, MAX_DNS_MESSAGE)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Answers with another ID aren't ours, which is what spoofers get wrong
+		if n >= 3 && bytes.Equal(buf[:2], query[:2]) {
+			if buf[2]&dnsFlagTruncated != 0 {
+				return resolveDirectOverTCP(query)
+			}
+			return buf[:n], nil
+		}
+	}
+}
+
+// resolveDirectOverTCP() asks config.DNSResolver() the given query over TCP.
+func resolveDirectOverTCP(query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", config.DNSResolver(), DNS_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(DNS_TIMEOUT))
+	if err := writeDNSMessage(conn, query); err != nil {
+		return nil, err
+	}
+	answer, err := readDNSMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(answer) < 12 || !bytes.Equal(answer[:2], query[:2]) {
+		return nil, fmt.Errorf("Unexpected answer over TCP")
+	}
+	return answer, nil
+}
+
+// resolveThroughPeer() asks config.DoHURL() the given query through a peer.
+func resolveThroughPeer(query []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", config.DoHURL(), bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", DNS_MESSAGE_TYPE)
+	req.Header.Set("Accept", DNS_MESSAGE_TYPE)
+	resp, err := dohClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Unexpected response from DNS over HTTPS server: %s", resp.Status)
+	}
+	answer, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_DNS_TCP_MESSAGE))
+	if err != nil {
+		return nil, err
+	}
+	if len(answer) < 12 {
+		return nil, fmt.Errorf("DNS over HTTPS server answered with %d bytes", len(answer))
+	}
+	// DNS over HTTPS servers may zero the ID, which our client expects back
+	copy(answer[:2], query[:2])
+	return answer, nil
+}
+
+// dnsFailure() builds a SERVFAIL response to the given query.
+func dnsFailure(query []byte, question *dnsQuestion) []byte {
+	response := make([]byte, 12, question.end)
+	copy(response, query[:4])
+	response[2] = 0x80 | query[2]&0x79 // response, opcode and RD of the query
+	response[3] = 0x80 | dnsRcodeServfail
+	binary.BigEndian.PutUint16(response[4:], 1)
+	return append(response, query[12:question.end]...)
+}
+
+// parseQuestion() parses the question of the given DNS query, returning nil if
+// the query is malformed.
+func parseQuestion(query []byte) *dnsQuestion {
+	if len(query) < 12 || query[2]&0x80 != 0 || binary.BigEndian.Uint16(query[4:]) != 1 {
+		return nil
+	}
+	// Find the end of the question, names in queries aren't compressed
+	question := &dnsQuestion{labels: make([]string, 0)}
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		length := int(query[i])
+		if length > 63 || i+1+length > len(query) {
+			return nil
+		}
+		question.labels = append(question.labels, string(query[i+1:i+1+length]))
+		i += 1 + length
+	}
+	if i+5 > len(query) {
+		return nil
+	}
+	question.qtype = binary.BigEndian.Uint16(query[i+1:])
+	question.qclass = binary.BigEndian.Uint16(query[i+3:])
+	question.end = i + 5
+	return question
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"lantern/config"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+/*
+Egress chaining lets a master route the traffic that its remote proxy relays
+for its children through another master's remote proxy, typically its parent's,
+instead of connecting to destinations directly (see
+config.EgressProxyAddress()).  That way, organizations can have all of their
+subtree's traffic leave the network at a few egress points.
+
+Our remote proxy then acts as a client of the egress proxy: it dials it like an
+upstream proxy, authenticating with our own certificate, and has it CONNECT to
+each destination.  The egress proxy may chain on to its own egress proxy in
+turn.  Every hop counts up X_LANTERN_EGRESS_HOPS, and we refuse to relay
+traffic that already went through MAX_EGRESS_HOPS egress proxies, so that
+masters that were accidentally configured to egress through each other don't
+relay in circles.
+
+Fetches for integrity verification (see integrity.go) egress the same way.
+*/
+const (
+	X_LANTERN_EGRESS_HOPS = "X-Lantern-Egress-Hops"
+
+	MAX_EGRESS_HOPS = 4 // the most egress proxies that traffic may go through
+)
+
+// httpClient fetches from origin servers on behalf of downstream peers, through
+// our egress proxy if we have one.
+var httpClient = &http.Client{Transport: originTransport()}
+
+// originTransport() returns the transport for httpClient.
+func originTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	var dialer net.Dialer
+	transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		if config.EgressProxyAddress() == "" {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		return dialOrigin(addr, 0)
+	}
+	return transport
+}
+
+/*
+takeEgressHops() returns how many egress proxies the given request from a
+downstream peer went through already, and removes the header that says so,
+which is meant for us only.  Negative counts are taken as 0, so that peers
+can't buy themselves extra hops.
+*/
+func takeEgressHops(req *http.Request) int {
+	hops, _ := strconv.Atoi(req.Header.Get(X_LANTERN_EGRESS_HOPS))
+	req.Header.Del(X_LANTERN_EGRESS_HOPS)
+	if hops < 0 {
+		return 0
+	}
+	return hops
+}
+
+/*
+dialOrigin() connects to the given destination on behalf of a downstream peer
+whose traffic went through the given number of egress proxies already, either
+directly or through our egress proxy.
+*/
+func dialOrigin(destination string, hops int) (net.Conn, error) {
+	egressProxy := config.EgressProxyAddress()
+	if egressProxy == "" {
+		return net.Dial("tcp", destination)
+	}
+	if hops >= MAX_EGRESS_HOPS {
+		return nil, fmt.Errorf("Traffic went through %d egress proxies already, they may be configured in a loop", hops)
+	}
+	egressConfig, err := peerTLSConfig(egressProxy)
+	if err != nil {
+		return nil, err
+	}
+	connOut, err := dialPeer(egressProxy, func() (*tls.Conn, error) {
+		return dialTLS(egressProxy, egressConfig)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to egress proxy %s: %s", egressProxy, err)
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Host: destination},
+		Host:   destination,
+		Header: make(http.Header),
+	}
+	req.Header.Set(X_LANTERN_EGRESS_HOPS, strconv.Itoa(hops+1))
+	if err := authenticateUpstream(egressProxy, connOut, req); err != nil {
+		connOut.Close()
+		return nil, fmt.Errorf("Unable to authenticate egress proxy %s: %s", egressProxy, err)
+	}
+	if err := req.Write(connOut); err != nil {
+		connOut.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(connOut)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		connOut.Close()
+		return nil, fmt.Errorf("Unable to read CONNECT response from egress proxy %s: %s", egressProxy, err)
+	}
+	if resp.StatusCode != 200 {
+		connOut.Close()
+		return nil, fmt.Errorf("Egress proxy %s refused to CONNECT: %s", egressProxy, resp.Status)
+	}
+	// The destination may already have sent something that the reader
+	// buffered
+	return &bufferedConn{Conn: connOut, reader: reader}, nil
+}
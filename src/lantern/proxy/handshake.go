@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"lantern/config"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+Right after TLS, peers perform a small application handshake so that changes to
+the wire format (multiplexing, UDP relay and so on) can be negotiated instead of
+guessed.
+
+The downstream peer sends a hello consisting of HANDSHAKE_MAGIC, the highest
+PROTOCOL_VERSION it speaks (1 byte) and the flags for the optional features it
+supports (4 bytes, big endian).  The remote proxy answers in the same format
+with the version and flags that both sides support, which then apply to the
+rest of the connection.  If FLAG_TOKEN was negotiated, the downstream peer
+then sends its access token for the remote proxy (see access.go), prefixed with
+its length (1 byte).  The connection then continues with HTTP/1.1 like the
+legacy protocol does, or with HTTP/2 if FLAG_MULTIPLEX was negotiated (see
+multiplex.go).
+
+Peers that predate the handshake (LEGACY_PROTOCOL_VERSION) start talking HTTP
+right away.  The remote proxy recognizes them because their first bytes aren't
+HANDSHAKE_MAGIC, and simply carries on with HTTP.  A legacy remote proxy
+doesn't answer our hello within HANDSHAKE_TIMEOUT (or hangs up or answers with
+an HTTP error), in which case we reconnect without a handshake and remember not
+to try again for LEGACY_RECHECK_INTERVAL.
+*/
+const (
+	HANDSHAKE_MAGIC         = "LNTN"          // marks the start of a handshake
+	HANDSHAKE_LENGTH        = 9               // length of a hello: magic, version and flags
+	HANDSHAKE_TIMEOUT       = 5 * time.Second // how long we wait for the other side of the handshake
+	LEGACY_PROTOCOL_VERSION = 1               // the version spoken by peers that don't handshake
+	LEGACY_RECHECK_INTERVAL = time.Hour       // how long we assume that a legacy peer stays legacy
+	MAX_TOKEN_LENGTH        = 255             // the longest access token that fits into the handshake
+
+	FLAG_MULTIPLEX   uint32 = 1 << 0                                         // multiple streams over one connection, using HTTP/2
+	FLAG_UDP_RELAY   uint32 = 1 << 1                                         // relaying of UDP datagrams (reserved)
+	FLAG_COMPRESSION uint32 = 1 << 2                                         // compression of responses (see compression.go)
+	FLAG_TOKEN       uint32 = 1 << 3                                         // an access token follows the handshake (only offered if we have one)
+	SUPPORTED_FLAGS  uint32 = FLAG_MULTIPLEX | FLAG_COMPRESSION | FLAG_TOKEN // the flags that we support so far
+)
+
+// errLegacyPeer indicates that the remote proxy doesn't understand handshakes.
+var errLegacyPeer = errors.New("Peer only speaks the legacy protocol")
+
+// peerConnKey is the context key under which the remote proxy keeps the
+// connection of a request (see handshakeListener).
+type peerConnKey struct{}
+
+var (
+	legacyPeers = make(map[string]time.Time) // when remote proxies were found to be legacy, by address
+	peerFlags   = make(map[string]uint32)    // the flags last negotiated with remote proxies, by address
+	legacyMutex sync.Mutex                   // used to synchronize access to legacyPeers and peerFlags
+)
+
+// hello encodes a handshake message with the given version and flags.
+func hello(version int, flags uint32) []byte {
+	msg := make([]byte, HANDSHAKE_LENGTH)
+	copy(msg, HANDSHAKE_MAGIC)
+	msg[len(HANDSHAKE_MAGIC)] = byte(version)
+	binary.BigEndian.PutUint32(msg[len(HANDSHAKE_MAGIC)+1:], flags)
+	return msg
+}
+
+// parseHello() decodes a handshake message.
+func parseHello(msg []byte) (int, uint32, error) {
+	if string(msg[:len(HANDSHAKE_MAGIC)]) != HANDSHAKE_MAGIC {
+		return 0, 0, errLegacyPeer
+	}
+	version := int(msg[len(HANDSHAKE_MAGIC)])
+	if version <= LEGACY_PROTOCOL_VERSION {
+		return 0, 0, fmt.Errorf("Invalid protocol version in handshake: %d", version)
+	}
+	return version, binary.BigEndian.Uint32(msg[len(HANDSHAKE_MAGIC)+1:]), nil
+}
+
+/*
+handshake() performs the handshake with the remote proxy on conn, presenting
+the given access token (if any), and returns the negotiated version and flags,
+or errLegacyPeer if the remote proxy doesn't understand handshakes (in which
+case conn is no longer usable).
+*/
+func handshake(conn *tls.Conn, token string) (int, uint32, error) {
+	if len(token) > MAX_TOKEN_LENGTH {
+		return 0, 0, fmt.Errorf("Access token is longer than %d bytes", MAX_TOKEN_LENGTH)
+	}
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+	flags := SUPPORTED_FLAGS &^ FLAG_TOKEN
+	if token != "" {
+		flags |= FLAG_TOKEN
+	}
+	if _, err := conn.Write(hello(PROTOCOL_VERSION, flags)); err != nil {
+		return 0, 0, err
+	}
+	reply := make([]byte, HANDSHAKE_LENGTH)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		// Legacy peers wait for the rest of what they take to be an HTTP
+		// request line until they time out
+		if netErr, ok := err.(net.Error); (ok && netErr.Timeout()) || err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, 0, errLegacyPeer
+		}
+		return 0, 0, err
+	}
+	version, flags, err := parseHello(reply)
+	if err == nil && flags&FLAG_TOKEN != 0 {
+		_, err = conn.Write(append([]byte{byte(len(token))}, token...))
+	}
+	return version, flags, err
+}
+
+/*
+dialPeer() connects to the remote proxy at the given address using dial and
+performs the handshake, falling back to the legacy protocol if the remote proxy
+doesn't understand it.  The outcome counts towards the peer's health (see
+health.go).
+*/
+func dialPeer(peer string, dial func() (*tls.Conn, error)) (*tls.Conn, error) {
+	start := time.Now()
+	conn, err := negotiatePeer(peer, dial)
+	resumed := err == nil && conn.ConnectionState().DidResume
+	recordDial(peer, time.Since(start), resumed, err)
+	return conn, err
+}
+
+// tlsTransport() names the transport of the given connection for telemetry,
+// telling resumed TLS sessions apart from full handshakes.
+func tlsTransport(conn *tls.Conn) string {
+	if conn.ConnectionState().DidResume {
+		return "tls-resumed"
+	}
+	return "tls"
+}
+
+// negotiatePeer() does the work of dialPeer().
+func negotiatePeer(peer string, dial func() (*tls.Conn, error)) (*tls.Conn, error) {
+	conn, err := dial()
+	if err != nil || isLegacyPeer(peer) {
+		return conn, err
+	}
+	_, flags, err := handshake(conn, config.StaticProxyCredentials()[peer].Token)
+	if err == nil {
+		legacyMutex.Lock()
+		peerFlags[peer] = flags
+		legacyMutex.Unlock()
+		return conn, nil
+	}
+	conn.Close()
+	if err != errLegacyPeer {
+		return nil, fmt.Errorf("Unable to handshake with %s: %s", peer, err)
+	}
+	log.Printf("%s only speaks the legacy protocol, falling back", peer)
+	legacyMutex.Lock()
+	legacyPeers[peer] = time.Now()
+	delete(peerFlags, peer)
+	legacyMutex.Unlock()
+	return dial()
+}
+
+// peerSupports() indicates whether or not we negotiated the given flag with the
+// remote proxy at the given address the last time that we connected to it.
+func peerSupports(peer string, flag uint32) bool {
+	legacyMutex.Lock()
+	defer legacyMutex.Unlock()
+	return peerFlags[peer]&flag != 0
+}
+
+// isLegacyPeer() indicates whether or not we recently found the remote proxy at
+// the given address to only speak the legacy protocol.
+func isLegacyPeer(peer string) bool {
+	legacyMutex.Lock()
+	defer legacyMutex.Unlock()
+	since, found := legacyPeers[peer]
+	if found && time.Since(since) > LEGACY_RECHECK_INTERVAL {
+		delete(legacyPeers, peer)
+		return false
+	}
+	return found
+}
+
+/*
+handshakeListener wraps the remote proxy's TLS listener so that the handshake is
+performed on every accepted connection.  The handshake happens on the first
+Read() (in the server's goroutine for the connection), so slow peers don't hold
+up Accept().
+*/
+type handshakeListener struct {
+	net.Listener
+}
+
+func (listener *handshakeListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := conn.(*tls.Conn)
+	return &handshakeConn{Conn: tlsConn, tlsConn: tlsConn, version: LEGACY_PROTOCOL_VERSION}, nil
+}
+
+/*
+handshakeConn is a connection accepted by handshakeListener.  It deliberately
+hides the TLS connection underneath from net/http, which would otherwise insist
+on ALPN for HTTP/2 instead of accepting it with prior knowledge (see
+multiplex.go).
+*/
+type handshakeConn struct {
+	net.Conn
+	tlsConn *tls.Conn     // the TLS connection underneath Conn
+	reader  *bufio.Reader // reads from Conn, including whatever was peeked during the handshake
+	once    sync.Once     // makes sure that the handshake only happens once
+	err     error         // the error from the handshake, if any
+	version int           // the negotiated protocol version
+	flags   uint32        // the negotiated flags
+	token   string        // the access token that the peer presented, if any
+}
+
+func (conn *handshakeConn) Read(b []byte) (int, error) {
+	conn.once.Do(conn.handshake)
+	if conn.err != nil {
+		return 0, conn.err
+	}
+	return conn.reader.Read(b)
+}
+
+// handshake() answers the peer's hello, if it sent one.
+func (conn *handshakeConn) handshake() {
+	// The server's ReadTimeout applies to the handshake too
+	conn.reader = bufio.NewReader(conn.Conn)
+	magic, err := conn.reader.Peek(len(HANDSHAKE_MAGIC))
+	if err != nil || string(magic) != HANDSHAKE_MAGIC {
+		// Legacy peer, or a broken connection that HTTP will find out about
+		return
+	}
+	msg := make([]byte, HANDSHAKE_LENGTH)
+	if _, conn.err = io.ReadFull(conn.reader, msg); conn.err != nil {
+		return
+	}
+	version, flags, err := parseHello(msg)
+	if err != nil {
+		conn.err = err
+		return
+	}
+	if version > PROTOCOL_VERSION {
+		version = PROTOCOL_VERSION
+	}
+	conn.version = version
+	conn.flags = flags & SUPPORTED_FLAGS
+	if _, conn.err = conn.Conn.Write(hello(conn.version, conn.flags)); conn.err != nil {
+		return
+	}
+	if conn.flags&FLAG_TOKEN != 0 {
+		conn.token, conn.err = readToken(conn.reader)
+	}
+}
+
+// readToken() reads an access token, prefixed with its length, from reader.
+func readToken(reader *bufio.Reader) (string, error) {
+	length, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	token := make([]byte, length)
+	if _, err := io.ReadFull(reader, token); err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+/*
+restoreTLS() sets req.TLS for requests that came in through a handshakeConn,
+which net/http doesn't do since the handshakeConn hides its TLS connection.
+*/
+func restoreTLS(req *http.Request) {
+	if conn, ok := req.Context().Value(peerConnKey{}).(*handshakeConn); ok && req.TLS == nil {
+		state := conn.tlsConn.ConnectionState()
+		req.TLS = &state
+	}
+}
+
+// negotiated() indicates whether or not the given flag was negotiated on the
+// connection that req came in on.
+func negotiated(req *http.Request, flag uint32) bool {
+	conn, ok := req.Context().Value(peerConnKey{}).(*handshakeConn)
+	return ok && conn.flags&flag != 0
+}
+
+// rememberConn() is the http.Server's ConnContext for the remote proxy.
+func rememberConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, peerConnKey{}, conn)
+}
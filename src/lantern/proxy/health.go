@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"lantern/bootstrap"
+	"lantern/config"
+	"lantern/features"
+	"lantern/keys"
+	"lantern/parentconfig"
+	"lantern/ui"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Peer health tracks how our connections to remote proxies fare, so that
+problems with particular peers show up in diagnostics.  Every dial of a remote
+proxy (including the handshake) is recorded, and PeerHealthTable() combines
+that with what we know about each peer from the handshake.  The table can be
+inspected at http://[config.UIAddress()]/diagnostics/peers.
+
+Front ends (like the tray icon) get a summary of it from Status() or
+http://[config.UIAddress()]/api/status, which also tells whether we give access
+to peers (the "relay" feature) and get access through them (the "get"
+feature).  POSTing the form values give and/or get to /api/status switches those
+for good (see features.SetLocal()).
+*/
+const (
+	STATE_CONNECTED    = "connected"    // the last dial of one of our upstream proxies succeeded
+	STATE_CONNECTING   = "connecting"   // we haven't dialed any of our upstream proxies yet
+	STATE_DISCONNECTED = "disconnected" // we know of no upstream proxy or none of them answers
+	STATE_DIRECT       = "direct"       // we don't get access through peers
+	STATE_NO_CERT      = "no-cert"      // we don't have a usable certificate
+)
+
+// NodeStatus summarizes the state of this node for front ends.
+type NodeStatus struct {
+	State   string // one of the STATE_ constants
+	Giving  bool   // whether we give access to peers
+	Getting bool   // whether we get access through peers
+}
+
+// PeerHealth describes how our connections to a single remote proxy fare.
+type PeerHealth struct {
+	Address             string        // the host:port of the remote proxy
+	Source              string        // where we know the peer from ("static", "parent", "bootstrap", "entry", "egress" or blank if we no longer do)
+	Legacy              bool          // whether the peer only speaks the legacy protocol
+	Flags               uint32        // the flags last negotiated with the peer
+	Dials               int64         // how often we dialed the peer
+	Failures            int64         // how many of those dials failed
+	ConsecutiveFailures int64         // how many dials failed since the last one that succeeded
+	LastDial            time.Time     // when we last dialed the peer
+	LastSuccess         time.Time     // when a dial last succeeded
+	LastError           string        // the error of the last failed dial
+	ResumedDials        int64         // how many of the successful dials resumed a TLS session
+	ConnectTime         time.Duration // how long the last successful dial took, including the handshake
+	HandshakeEWMA       time.Duration // the moving average of ConnectTime (see latency.go)
+	FirstByteEWMA       time.Duration // the moving average of the time to the first byte (see latency.go)
+	UploadMbps          float64       // the throughput to the peer in the last bandwidth test (see bandwidth.go)
+	DownloadMbps        float64       // the throughput from the peer in the last bandwidth test
+	LastBandwidthTest   time.Time     // when we last tested the bandwidth of the peer
+}
+
+var (
+	peerHealth  = make(map[string]*PeerHealth) // health by peer address
+	healthMutex sync.Mutex                     // used to synchronize access to peerHealth
+)
+
+func init() {
+	ui.HandleFunc("/diagnostics/peers", peersHandler)
+	ui.HandleFunc("/api/status", statusHandler)
+}
+
+// recordDial() records the outcome of dialing the given peer, which took
+// elapsed and resumed a TLS session if resumed is true.
+func recordDial(peer string, elapsed time.Duration, resumed bool, err error) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	health, found := peerHealth[peer]
+	if !found {
+		health = &PeerHealth{Address: peer}
+		peerHealth[peer] = health
+	}
+	health.Dials += 1
+	health.LastDial = time.Now()
+	if err != nil {
+		health.Failures += 1
+		health.ConsecutiveFailures += 1
+		health.LastError = err.Error()
+	} else {
+		health.ConsecutiveFailures = 0
+		health.LastSuccess = health.LastDial
+		if resumed {
+			health.ResumedDials += 1
+		}
+		health.ConnectTime = elapsed
+		health.HandshakeEWMA = ewma(health.HandshakeEWMA, elapsed)
+	}
+}
+
+/*
+PeerHealthTable() returns the health of all remote proxies that we know of or
+dialed, in the order in which we prefer them.
+*/
+func PeerHealthTable() []PeerHealth {
+	sources := peerSources()
+	peers := upstreamProxies()
+	if entryProxy := config.EntryProxyAddress(); entryProxy != "" {
+		peers = append(peers, entryProxy)
+	}
+
+	healthMutex.Lock()
+	listed := make(map[string]bool)
+	table := make([]PeerHealth, 0, len(peers))
+	for _, address := range peers {
+		if listed[address] {
+			continue
+		}
+		listed[address] = true
+		health := PeerHealth{Address: address}
+		if known, found := peerHealth[address]; found {
+			health = *known
+		}
+		table = append(table, health)
+	}
+	for address, health := range peerHealth {
+		if !listed[address] {
+			table = append(table, *health)
+		}
+	}
+	healthMutex.Unlock()
+
+	for i := range table {
+		table[i].Source = sources[table[i].Address]
+		table[i].Legacy = isLegacyPeer(table[i].Address)
+		legacyMutex.Lock()
+		table[i].Flags = peerFlags[table[i].Address]
+		legacyMutex.Unlock()
+	}
+	return table
+}
+
+// peerSources() returns where we know each peer from by its address.
+func peerSources() map[string]string {
+	sources := make(map[string]string)
+	for _, address := range bootstrap.Proxies() {
+		sources[address] = "bootstrap"
+	}
+	for _, address := range parentconfig.FallbackProxies() {
+		sources[address] = "parent"
+	}
+	for _, address := range config.StaticProxyAddresses() {
+		sources[address] = "static"
+	}
+	if entryProxy := config.EntryProxyAddress(); entryProxy != "" {
+		sources[entryProxy] = "entry"
+	}
+	if egressProxy := config.EgressProxyAddress(); egressProxy != "" {
+		sources[egressProxy] = "egress"
+	}
+	return sources
+}
+
+// peersHandler() shows PeerHealthTable().
+func peersHandler(resp http.ResponseWriter, req *http.Request) {
+	if tableJson, err := json.MarshalIndent(PeerHealthTable(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(tableJson)
+	}
+}
+
+// Status() returns the state of this node.
+func Status() NodeStatus {
+	return NodeStatus{State: connectionState(), Giving: relay.Enabled(), Getting: localGet.Enabled()}
+}
+
+// SetGiving() switches giving access to peers on or off.
+func SetGiving(giving bool) {
+	features.SetLocal(relay.Name, giving)
+}
+
+// SetGetting() switches getting access through peers on or off.
+func SetGetting(getting bool) {
+	features.SetLocal(localGet.Name, getting)
+}
+
+// connectionState() summarizes how our connections to upstream proxies fare.
+func connectionState() string {
+	if !keys.CertificateState().Usable() {
+		return STATE_NO_CERT
+	}
+	if !localGet.Enabled() {
+		return STATE_DIRECT
+	}
+	pool := upstreamProxies()
+	if len(pool) == 0 {
+		return STATE_DISCONNECTED
+	}
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	state := STATE_CONNECTING
+	for _, address := range pool {
+		health, found := peerHealth[address]
+		if !found {
+			continue
+		}
+		if health.ConsecutiveFailures == 0 {
+			return STATE_CONNECTED
+		}
+		state = STATE_DISCONNECTED
+	}
+	return state
+}
+
+/*
+statusHandler() shows Status(), switching giving and getting access according
+to the form values give and get on POST.
+*/
+func statusHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		switches := make(map[string]bool)
+		for _, name := range []string{"give", "get"} {
+			if value := req.FormValue(name); value != "" {
+				enabled, err := strconv.ParseBool(value)
+				if err != nil {
+					resp.WriteHeader(400)
+					resp.Write([]byte(fmt.Sprintf("Invalid value for %s: %s", name, value)))
+					return
+				}
+				switches[name] = enabled
+			}
+		}
+		if giving, found := switches["give"]; found {
+			SetGiving(giving)
+		}
+		if getting, found := switches["get"]; found {
+			SetGetting(getting)
+		}
+	}
+	if statusJson, err := json.MarshalIndent(Status(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(statusJson)
+	}
+}
@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lantern/config"
+	"lantern/keys"
+	"lantern/reputation"
+	"log"
+	"net/http"
+	"strings"
+)
+
+/*
+Integrity verification protects plain HTTP responses from high-risk domains
+(config.IntegrityDomains()) against tampering along the way.
+
+The local proxy marks requests to these domains with X_LANTERN_INTEGRITY.  The
+exit peer then fetches the full response itself, and returns it along with the
+SHA-256 hash of the body (X_LANTERN_CONTENT_HASH) and its signature over the
+request URL and that hash (X_LANTERN_CONTENT_SIGNATURE).  The local proxy checks
+the signature against the exit peer's TLS certificate and the hash against the
+body it actually received before handing anything to the browser.  Since
+anybody can sign with a throwaway certificate, the signature only counts if the
+exit peer authenticated, either by a certificate that chains up to our trust
+store (see verifyUpstream()) or by the PSK that we share with it.  Mismatches
+are logged and shown to the user as a prominent warning page instead of the
+content.
+
+HTTPS (CONNECT) requests are already protected end-to-end by TLS and are never
+subject to integrity verification.
+*/
+const (
+	X_LANTERN_INTEGRITY         = "X-Lantern-Integrity"
+	X_LANTERN_CONTENT_HASH      = "X-Lantern-Content-Hash"
+	X_LANTERN_CONTENT_SIGNATURE = "X-Lantern-Content-Signature"
+)
+
+// MAX_VERIFIED_BODY is the largest body that we're willing to buffer for
+// integrity verification.
+const MAX_VERIFIED_BODY = 10 * 1024 * 1024
+
+const integrityWarning = `<html>
+<head><title>Lantern: content integrity check failed</title></head>
+<body style="background: #c00; color: #fff; font-family: sans-serif;">
+<h1>WARNING: this page may have been tampered with</h1>
+<p>Lantern was unable to verify the integrity of %s, so it has not been shown.</p>
+<p>%s</p>
+</body>
+</html>`
+
+// integrityRequired() indicates whether or not the given request needs
+// integrity verification.
+func integrityRequired(req *http.Request) bool {
+	if req.Method == "CONNECT" {
+		return false
+	}
+	// Hostname() takes care of IPv6 literals, whose brackets contain colons
+	return isIntegrityDomain(req.URL.Hostname())
+}
+
+// isIntegrityDomain() indicates whether or not the given host is or is under
+// one of the integrity domains.
+func isIntegrityDomain(host string) bool {
+	host = strings.ToLower(host)
+	for _, domain := range config.IntegrityDomains() {
+		domain = strings.ToLower(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// contentDigest() returns the data that gets signed for a given url and body
+// hash.
+func contentDigest(url string, hash []byte) []byte {
+	return append([]byte(url+"\n"), hash...)
+}
+
+/*
+fetchWithIntegrity() sends req to the given exit peer over connOut, verifies the
+response and, if it checks out, writes it to resp.
+*/
+func fetchWithIntegrity(resp http.ResponseWriter, req *http.Request, upstreamProxy string, connOut *tls.Conn) {
+	// authenticateUpstream() only marks the request with our PSK once the
+	// exit peer proved that it holds it too
+	if err := verifyUpstream(connOut.ConnectionState()); err != nil && req.Header.Get(X_LANTERN_PSK_ID) == "" {
+		err = fmt.Errorf("Exit peer %s didn't authenticate: %s", upstreamProxy, err)
+		log.Printf("Unable to verify integrity of %s: %s", req.URL, err)
+		respondIntegrityWarning(resp, req, err)
+		return
+	}
+	req.Header.Set(X_LANTERN_INTEGRITY, "1")
+	if err := req.WriteProxy(connOut); err != nil {
+		respondBadGateway(resp, req, fmt.Sprintf("Unable to write request to upstream proxy: %s", err))
+		return
+	}
+	upstreamResp, err := http.ReadResponse(bufio.NewReader(connOut), req)
+	if err != nil {
+		respondBadGateway(resp, req, fmt.Sprintf("Unable to read response from upstream proxy: %s", err))
+		return
+	}
+	defer upstreamResp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(upstreamResp.Body, MAX_VERIFIED_BODY+1))
+	if err != nil {
+		respondBadGateway(resp, req, fmt.Sprintf("Unable to read response body: %s", err))
+		return
+	}
+	peerCertificates := connOut.ConnectionState().PeerCertificates
+	if err := verifyContent(req.URL.String(), upstreamResp, body, peerCertificates); err != nil {
+		log.Printf("INTEGRITY CHECK FAILED for %s: %s", req.URL, err)
+		var exitCert *x509.Certificate
+		if len(peerCertificates) > 0 {
+			exitCert = peerCertificates[0]
+		}
+		if err := reputation.ReportExit(upstreamProxy, exitCert, reputation.KIND_MALICIOUS_EXIT, fmt.Sprintf("Integrity check failed for %s: %s", req.URL.Host, err)); err != nil {
+			log.Printf("Unable to report %s: %s", upstreamProxy, err)
+		}
+		respondIntegrityWarning(resp, req, err)
+		return
+	}
+
+	for key, values := range upstreamResp.Header {
+		if key == X_LANTERN_CONTENT_HASH || key == X_LANTERN_CONTENT_SIGNATURE {
+			continue
+		}
+		for _, value := range values {
+			resp.Header().Add(key, value)
+		}
+	}
+	resp.WriteHeader(upstreamResp.StatusCode)
+	resp.Write(body)
+}
+
+// respondIntegrityWarning() shows the user the warning page instead of the
+// content, because its integrity couldn't be verified for the given reason.
+func respondIntegrityWarning(resp http.ResponseWriter, req *http.Request, reason error) {
+	resp.Header().Set("Content-Type", "text/html")
+	resp.WriteHeader(502)
+	fmt.Fprintf(resp, integrityWarning, req.URL, reason)
+}
+
+// verifyContent() checks the hash and signature of a response body.
+func verifyContent(url string, upstreamResp *http.Response, body []byte, peerCertificates []*x509.Certificate) error {
+	if len(body) > MAX_VERIFIED_BODY {
+		return fmt.Errorf("Response body too large to verify")
+	}
+	if len(peerCertificates) == 0 {
+		return fmt.Errorf("Exit peer didn't present a certificate")
+	}
+	hash, err := base64.StdEncoding.DecodeString(upstreamResp.Header.Get(X_LANTERN_CONTENT_HASH))
+	if err != nil || len(hash) == 0 {
+		return fmt.Errorf("Exit peer didn't provide a valid content hash")
+	}
+	signature, err := base64.StdEncoding.DecodeString(upstreamResp.Header.Get(X_LANTERN_CONTENT_SIGNATURE))
+	if err != nil || len(signature) == 0 {
+		return fmt.Errorf("Exit peer didn't provide a valid content signature")
+	}
+	if err := peerCertificates[0].CheckSignature(x509.SHA256WithRSA, contentDigest(url, hash), signature); err != nil {
+		return fmt.Errorf("Content signature didn't verify: %s", err)
+	}
+	actual := sha256.Sum256(body)
+	if string(actual[:]) != string(hash) {
+		return fmt.Errorf("Content hash mismatch")
+	}
+	return nil
+}
+
+/*
+serveWithIntegrity() fetches req on behalf of a downstream peer that asked for
+integrity verification, and responds with the body along with its signed hash.
+*/
+func serveWithIntegrity(resp http.ResponseWriter, req *http.Request) {
+	outReq, err := http.NewRequest(req.Method, req.URL.String(), req.Body)
+	if err != nil {
+		respondBadGateway(resp, req, fmt.Sprintf("Unable to create request: %s", err))
+		return
+	}
+	for key, values := range req.Header {
+		if key == X_LANTERN_INTEGRITY || key == "Proxy-Connection" || key == "Connection" {
+			continue
+		}
+		outReq.Header[key] = values
+	}
+	originResp, err := httpClient.Do(outReq)
+	if err != nil {
+		respondBadGateway(resp, req, fmt.Sprintf("Unable to fetch from origin: %s", err))
+		return
+	}
+	defer originResp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(originResp.Body, MAX_VERIFIED_BODY+1))
+	if err != nil {
+		respondBadGateway(resp, req, fmt.Sprintf("Unable to read body from origin: %s", err))
+		return
+	}
+	if len(body) > MAX_VERIFIED_BODY {
+		respondBadGateway(resp, req, "Response body too large to verify")
+		return
+	}
+	hash := sha256.Sum256(body)
+	signature, err := keys.Sign(contentDigest(req.URL.String(), hash[:]))
+	if err != nil {
+		respondBadGateway(resp, req, fmt.Sprintf("Unable to sign content: %s", err))
+		return
+	}
+
+	for key, values := range originResp.Header {
+		if key == "Content-Length" || key == "Transfer-Encoding" || key == "Connection" {
+			continue
+		}
+		resp.Header()[key] = values
+	}
+	resp.Header().Set(X_LANTERN_CONTENT_HASH, base64.StdEncoding.EncodeToString(hash[:]))
+	resp.Header().Set(X_LANTERN_CONTENT_SIGNATURE, base64.StdEncoding.EncodeToString(signature))
+	resp.WriteHeader(originResp.StatusCode)
+	resp.Write(body)
+}
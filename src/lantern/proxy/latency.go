@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"lantern/config"
+	"lantern/ui"
+	"lantern/util"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Latency measurement keeps track of how quickly each upstream proxy responds, so
+that selectUpstream() can pick the fastest one instead of simply the first in
+upstreamProxies().  Two latencies are measured for every peer and smoothed with
+an exponentially weighted moving average (EWMA_WEIGHT):
+
+- the handshake time of every successful dial, including TLS and our own
+  handshake (see recordDial()), which we also probe every LATENCY_PROBE_INTERVAL
+  so that it stays current for peers that we don't use at the moment
+- the time to the first byte, from sending a CONNECT until the peer responds
+  to it (see recordFirstByte())
+
+A peer's score is the sum of both, with UNMEASURED_LATENCY standing in for
+latencies that we haven't measured yet, plus FAILURE_PENALTY for every dial
+that failed since the last one that succeeded.  The peer with the lowest score
+wins, peers with equal scores keep the order of upstreamProxies().
+
+The ranking is at http://[config.UIAddress()]/api/peers, so that users can see
+why we use the peer that we use.
+*/
+const (
+	LATENCY_PROBE_INTERVAL = 1 * time.Minute  // how frequently we probe the handshake time of all peers
+	EWMA_WEIGHT            = 0.3              // the weight of a new measurement in the moving averages
+	UNMEASURED_LATENCY     = 1 * time.Second  // what we assume for latencies that we haven't measured
+	FAILURE_PENALTY        = 10 * time.Second // added to the score of a peer for every consecutive failed dial
+)
+
+// PeerRank describes where a peer ranks for selectUpstream() and why.
+type PeerRank struct {
+	Rank                int    // the position of the peer in the ranking, 1 is the peer that we use
+	Address             string // the host:port of the remote proxy
+	Source              string // where we know the peer from (see PeerHealth)
+	ScoreMs             int64  // the score of the peer, lower is better
+	HandshakeMs         int64  // the average handshake time, 0 if unmeasured
+	FirstByteMs         int64  // the average time to the first byte, 0 if unmeasured
+	ConsecutiveFailures int64  // how many dials failed since the last one that succeeded
+	Reason              string // what the score comes down to
+}
+
+// firstByteConn is a net.Conn that records the time to the first byte that it
+// reads as the latency of its peer.
+type firstByteConn struct {
+	net.Conn
+	peer  string    // the peer at the other end
+	start time.Time // when we started waiting for the first byte
+	once  sync.Once // makes sure that only the first byte is recorded
+}
+
+func init() {
+	ui.HandleFunc("/api/peers", rankingHandler)
+	if config.Runs(config.SUBSYSTEM_LOCAL_PROXY) {
+		util.GoLoop("latency prober", probeLatency)
+	}
+}
+
+// ewma() folds the given sample into the given average.
+func ewma(average time.Duration, sample time.Duration) time.Duration {
+	if average == 0 {
+		return sample
+	}
+	return time.Duration(EWMA_WEIGHT*float64(sample) + (1-EWMA_WEIGHT)*float64(average))
+}
+
+// recordFirstByte() records that the given peer took elapsed to send the first
+// byte of a response.
+func recordFirstByte(peer string, elapsed time.Duration) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	health, found := peerHealth[peer]
+	if !found {
+		health = &PeerHealth{Address: peer}
+		peerHealth[peer] = health
+	}
+	health.FirstByteEWMA = ewma(health.FirstByteEWMA, elapsed)
+}
+
+/*
+timeFirstByte() wraps the given connection to the given peer so that the time
+until its first byte is recorded (see recordFirstByte()), counting from now.
+Only use it for responses that the peer sends itself, otherwise we measure the
+origin server.
+*/
+func timeFirstByte(peer string, conn net.Conn) net.Conn {
+	return &firstByteConn{Conn: conn, peer: peer, start: time.Now()}
+}
+
+func (conn *firstByteConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if n > 0 {
+		conn.once.Do(func() {
+			recordFirstByte(conn.peer, time.Since(conn.start))
+		})
+	}
+	return n, err
+}
+
+/*
+PeerRanking() returns the upstream proxies in the order in which
+selectUpstream() prefers them.
+*/
+func PeerRanking() []PeerRank {
+	sources := peerSources()
+	pool := upstreamProxies()
+	ranking := make([]PeerRank, 0, len(pool))
+	healthMutex.Lock()
+	for _, address := range pool {
+		rank := PeerRank{Address: address, Source: sources[address]}
+		score := 2 * UNMEASURED_LATENCY
+		if health, found := peerHealth[address]; found {
+			score = latencyOrDefault(health.HandshakeEWMA) + latencyOrDefault(health.FirstByteEWMA)
+			score += time.Duration(health.ConsecutiveFailures) * FAILURE_PENALTY
+			rank.HandshakeMs = int64(health.HandshakeEWMA / time.Millisecond)
+			rank.FirstByteMs = int64(health.FirstByteEWMA / time.Millisecond)
+			rank.ConsecutiveFailures = health.ConsecutiveFailures
+		}
+		rank.ScoreMs = int64(score / time.Millisecond)
+		ranking = append(ranking, rank)
+	}
+	healthMutex.Unlock()
+
+	sort.SliceStable(ranking, func(i, j int) bool {
+		return ranking[i].ScoreMs < ranking[j].ScoreMs
+	})
+	for i := range ranking {
+		ranking[i].Rank = i + 1
+		ranking[i].Reason = rankReason(ranking[i])
+	}
+	return ranking
+}
+
+// latencyOrDefault() returns the given average latency, or UNMEASURED_LATENCY
+// if it hasn't been measured.
+func latencyOrDefault(latency time.Duration) time.Duration {
+	if latency == 0 {
+		return UNMEASURED_LATENCY
+	}
+	return latency
+}
+
+// rankReason() explains the score of the given rank.
+func rankReason(rank PeerRank) string {
+	switch {
+	case rank.ConsecutiveFailures > 0:
+		return fmt.Sprintf("the last %d dials failed", rank.ConsecutiveFailures)
+	case rank.HandshakeMs == 0 && rank.FirstByteMs == 0:
+		return "not measured yet"
+	case rank.FirstByteMs == 0:
+		return fmt.Sprintf("%dms to handshake, time to first byte not measured yet", rank.HandshakeMs)
+	default:
+		return fmt.Sprintf("%dms to handshake, %dms to first byte", rank.HandshakeMs, rank.FirstByteMs)
+	}
+}
+
+/*
+probeLatency(), meant to be run as a goroutine, periodically dials all upstream
+proxies to keep their handshake times current.
+*/
+func probeLatency() {
+	for {
+		time.Sleep(LATENCY_PROBE_INTERVAL)
+		if !localGet.Enabled() {
+			continue
+		}
+		for _, upstreamProxy := range upstreamProxies() {
+			// dialUpstream() records the outcome through dialPeer()
+			if conn, err := dialUpstream(upstreamProxy); err != nil {
+				log.Printf("Unable to probe %s: %s", upstreamProxy, err)
+			} else {
+				conn.Close()
+			}
+		}
+	}
+}
+
+// rankingHandler() shows PeerRanking().
+func rankingHandler(resp http.ResponseWriter, req *http.Request) {
+	if rankingJson, err := json.MarshalIndent(PeerRanking(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(rankingJson)
+	}
+}
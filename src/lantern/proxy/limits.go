@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"encoding/json"
+	"lantern/config"
+	"lantern/ui"
+	"net"
+	"net/http"
+	"sync"
+)
+
+/*
+Connection limits keep low-powered donor machines from falling over under load
+(see config.ProxyLimits()).  The remote proxy caps the total number of
+connections that it relays at once, as well as the number that it relays at
+once for any single client.  Requests beyond either cap are answered with 503
+Service Unavailable and counted in ConnectionMetrics(), which can be inspected
+at http://[config.UIAddress()]/diagnostics/connections.
+
+Once StopAccepting() has been called, for example while the node drains before
+maintenance (see package lantern/drain), every new connection is answered with
+503 Service Unavailable, while the ones already being relayed carry on.
+*/
+
+// LimitMetrics counts relayed connections and rejections.
+type LimitMetrics struct {
+	Connections               int   // connections currently being relayed
+	RejectedConnections       int64 // connections rejected for exceeding MaxConnections
+	RejectedClientConnections int64 // connections rejected for exceeding MaxConnectionsPerClient
+	RejectedWhileDraining     int64 // connections rejected after StopAccepting()
+	Draining                  bool  // whether we stopped accepting new connections
+}
+
+var (
+	connections  = make(map[string]int) // connections currently being relayed, by client
+	limitMetrics = LimitMetrics{}       // counts of relayed connections and rejections
+	limitsMutex  sync.Mutex             // used to synchronize access to all of the above
+)
+
+func init() {
+	ui.HandleFunc("/diagnostics/connections", connectionsHandler)
+}
+
+/*
+admitConnection() checks whether we may relay another connection for the given
+client, and if so counts it until the returned function is called.  Returns a
+reason if we may not.
+*/
+func admitConnection(client string) (func(), string) {
+	limits := config.ProxyLimits()
+	limitsMutex.Lock()
+	defer limitsMutex.Unlock()
+	if limitMetrics.Draining {
+		limitMetrics.RejectedWhileDraining += 1
+		return nil, "Draining, try another proxy"
+	}
+	if limits.MaxConnections > 0 && limitMetrics.Connections >= limits.MaxConnections {
+		limitMetrics.RejectedConnections += 1
+		return nil, "Too many connections"
+	}
+	if limits.MaxConnectionsPerClient > 0 && connections[client] >= limits.MaxConnectionsPerClient {
+		limitMetrics.RejectedClientConnections += 1
+		return nil, "Too many connections from your client"
+	}
+	connections[client] += 1
+	limitMetrics.Connections += 1
+	var once sync.Once
+	return func() { once.Do(func() { releaseConnection(client) }) }, ""
+}
+
+// releaseConnection() stops counting a connection for the given client.
+func releaseConnection(client string) {
+	limitsMutex.Lock()
+	defer limitsMutex.Unlock()
+	connections[client] -= 1
+	if connections[client] <= 0 {
+		delete(connections, client)
+	}
+	limitMetrics.Connections -= 1
+}
+
+// StopAccepting() makes us reject all new connections, letting the ones that
+// we're already relaying finish.
+func StopAccepting() {
+	limitsMutex.Lock()
+	defer limitsMutex.Unlock()
+	limitMetrics.Draining = true
+}
+
+// ConnectionMetrics() returns a snapshot of the connection limit metrics.
+func ConnectionMetrics() LimitMetrics {
+	limitsMutex.Lock()
+	defer limitsMutex.Unlock()
+	return limitMetrics
+}
+
+// connectionsHandler() shows the connection limit metrics.
+func connectionsHandler(resp http.ResponseWriter, req *http.Request) {
+	if metricsJson, err := json.MarshalIndent(ConnectionMetrics(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(metricsJson)
+	}
+}
+
+// releasingConn is a net.Conn that releases its connection limit when closed.
+type releasingConn struct {
+	net.Conn
+	release func()
+}
+
+func (conn *releasingConn) Close() error {
+	conn.release()
+	return conn.Conn.Close()
+}
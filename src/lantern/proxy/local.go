@@ -1,37 +1,53 @@
 package proxy
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
 	"fmt"
+	"lantern/bootstrap"
 	"lantern/config"
+	"lantern/features"
 	"lantern/keys"
+	"lantern/parentconfig"
+	"lantern/service"
+	"lantern/telemetry"
+	"lantern/util"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"time"
 )
 
 var tlsConfig *tls.Config
 
+// localGet is the switch for getting access through peers, which nodes that
+// only give access turn off so that their own traffic goes directly
+var localGet = features.Register("get", true, "proxy our own traffic through other lantern nodes")
+
 func init() {
 	x509cert, certChannel := keys.Certificate()
-	if x509cert == nil {
-		// wait for cert
+	if x509cert == nil && config.Subcommand() != config.SUBCOMMAND_EMBEDDED {
+		// wait for cert, except in programs that embed us, whose start
+		// mustn't hang on it (see client.WaitUntilReady())
 		x509cert = <-certChannel
 	}
 
-	if cert, err := tls.LoadX509KeyPair(keys.CertificateFile, keys.PrivateKeyFile); err != nil {
-		log.Fatalf("Unable to load x509 key pair: %s", err)
-	} else {
-		tlsConfig = &tls.Config{
-			RootCAs:      keys.TrustedParents,
-			Certificates: []tls.Certificate{cert},
-			InsecureSkipVerify: true, // TODO: disable this to get security back
-		}
-		go runLocal()
+	tlsConfig = keys.SecurePeerConfig(&tls.Config{
+		RootCAs:              keys.TrustedParents,
+		GetClientCertificate: keys.GetClientCertificate,
+		InsecureSkipVerify:   true, // verified after the handshake, so that we can fall back to PSKs (see authenticateUpstream())
+	})
+	if !config.Runs(config.SUBSYSTEM_LOCAL_PROXY) {
+		log.Printf("Not starting the local proxy as %s", config.Subcommand())
+		return
 	}
+	util.Go("local proxy", runLocal)
 }
 
-func runLocal() {
+// runLocal() starts the local proxy.
+func runLocal() error {
 	server := &http.Server{
 		Addr:         config.LocalProxyAddress(),
 		Handler:      http.HandlerFunc(handleLocalRequest),
@@ -39,26 +55,211 @@ func runLocal() {
 		WriteTimeout: 10 * time.Second,
 	}
 
-	log.Printf("About to start local proxy at: %s", config.LocalProxyAddress())
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Unable to start local proxy: %s", err)
+	listeners := util.NewRebinder("local proxy", server, nil)
+	if err := listeners.Rebind(localAddresses()); err != nil {
+		return err
+	}
+	// We're usable as soon as the local proxy is listening
+	if err := service.Ready(); err != nil {
+		log.Printf("Unable to notify service manager: %s", err)
+	}
+	util.GoLoop("local proxy rebinder", func() {
+		followListenAddresses(listeners, localAddresses)
+	})
+	return nil
+}
+
+// localAddresses() returns the host:ports on which the local proxy listens.
+func localAddresses() []string {
+	return []string{config.LocalProxyAddress()}
+}
+
+/*
+upstreamProxies() returns the pool of upstream proxies that we know of, our
+static proxies first, then the fallback proxies assigned by our parent (see
+package lantern/parentconfig) and the fallback proxies from the bootstrap list
+after them (see package lantern/bootstrap).
+*/
+func upstreamProxies() []string {
+	pool := config.StaticProxyAddresses()
+	known := util.NewStringSet(pool...)
+	fallbacks := append(parentconfig.FallbackProxies(), bootstrap.Proxies()...)
+	for _, fallback := range fallbacks {
+		if known.Add(fallback) {
+			pool = append(pool, fallback)
+		}
+	}
+	return pool
+}
+
+// selectUpstream() picks the upstream proxy through which we proxy, the one
+// that ranks first by latency (see latency.go).
+func selectUpstream() (string, error) {
+	// TODO: this needs to come from auto-discovery too
+	ranking := PeerRanking()
+	if len(ranking) == 0 {
+		return "", fmt.Errorf("No upstream proxy known")
 	}
+	return ranking[0].Address, nil
 }
 
 func handleLocalRequest(resp http.ResponseWriter, req *http.Request) {
-	// TODO: this needs to come from auto-discovery and statically configured fallback info
-	upstreamProxy := config.StaticProxyAddresses()[0]
+	req = withAccessEntry(withAppRoute(req))
+	entry := accessEntryOf(req)
+	resp = entry.count(resp)
+	defer entry.handled()
+	upstreamProxy, upstreamErr := selectUpstream()
+	entry.via(upstreamProxy)
 
-	if connOut, err := tls.Dial("tcp", upstreamProxy, tlsConfig); err != nil {
+	session := telemetry.Sample()
+	start := time.Now()
+	invalidateCached(req)
+	if tryDirect(req) {
+		entry.via(DIRECT)
+		serveDirect(resp, req)
+	} else if upstreamErr != nil {
+		respondUnavailable(resp, req, upstreamErr.Error())
+	} else if keys.CertificateState() == keys.CERT_EXPIRED {
+		respondUnavailable(resp, req, "Our certificate has expired")
+	} else if cacheable(req) {
+		serveCached(resp, req, upstreamProxy)
+	} else if transport := multiplexer(upstreamProxy); transport != nil && !integrityRequired(req) {
+		proxyMultiplexed(resp, req, upstreamProxy, transport, session)
+	} else if connOut, err := dialUpstream(upstreamProxy); err != nil {
 		msg := fmt.Sprintf("Unable to open socket to upstream proxy: %s", err)
 		respondBadGateway(resp, req, msg)
 	} else {
-		if connIn, _, err := resp.(http.Hijacker).Hijack(); err != nil {
+		session.Handshake(tlsTransport(connOut), time.Since(start))
+		if err := authenticateUpstream(upstreamProxy, connOut, req); err != nil {
+			connOut.Close()
+			msg := fmt.Sprintf("Unable to authenticate upstream proxy: %s", err)
+			respondBadGateway(resp, req, msg)
+		} else if integrityRequired(req) {
+			defer connOut.Close()
+			fetchWithIntegrity(resp, req, upstreamProxy, connOut)
+		} else if connIn, _, err := resp.(http.Hijacker).Hijack(); err != nil {
 			msg := fmt.Sprintf("Unable to access underlying connection from client: %s", err)
 			respondBadGateway(resp, req, msg)
 		} else {
 			req.Write(connOut)
-			pipe(connIn, connOut)
+			var upstream net.Conn = connOut
+			if req.Method == "CONNECT" {
+				// The upstream proxy answers CONNECTs itself
+				upstream = timeFirstByte(upstreamProxy, connOut)
+			}
+			pipe(connIn, session.Watch(upstream), newFlow(req))
+		}
+	}
+}
+
+/*
+dialUpstream() opens a TLS connection to the upstream proxy.
+
+In multi-hop mode (see config.EntryProxyAddress()), we first connect to the
+entry proxy and have it CONNECT us to the upstream proxy, which acts as the
+exit.  The TLS connection to the exit proxy is nested inside the one to the
+entry proxy, so the exit proxy only ever sees the entry proxy's IP and the
+entry proxy never sees our traffic.
+*/
+func dialUpstream(upstreamProxy string) (*tls.Conn, error) {
+	upstreamConfig, err := peerTLSConfig(upstreamProxy)
+	if err != nil {
+		return nil, err
+	}
+	entryProxy := config.EntryProxyAddress()
+	if entryProxy == "" {
+		return dialPeer(upstreamProxy, func() (*tls.Conn, error) {
+			return dialTLS(upstreamProxy, upstreamConfig)
+		})
+	}
+	entryConfig, err := peerTLSConfig(entryProxy)
+	if err != nil {
+		return nil, err
+	}
+	return dialPeer(upstreamProxy, func() (*tls.Conn, error) {
+		connEntry, err := dialPeer(entryProxy, func() (*tls.Conn, error) {
+			return dialTLS(entryProxy, entryConfig)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to connect to entry proxy %s: %s", entryProxy, err)
+		}
+		// PSKs are only used on the direct hop, the entry proxy has to verify
+		// by its certificate
+		if err := verifyUpstream(connEntry.ConnectionState()); err != nil {
+			connEntry.Close()
+			return nil, fmt.Errorf("Certificate of entry proxy %s didn't verify: %s", entryProxy, err)
 		}
+		return tunnel(connEntry, entryProxy, upstreamProxy, upstreamConfig)
+	})
+}
+
+/*
+dialTLS() connects to the given peer, racing its alternative addresses (see
+config.AlternativeAddresses()), and performs the TLS handshake.
+*/
+func dialTLS(peer string, peerConfig *tls.Config) (*tls.Conn, error) {
+	addresses := config.AlternativeAddresses(peer)
+	conn, err := util.DialHappyEyeballs(context.Background(), addresses)
+	if err != nil {
+		return nil, err
+	}
+	// Like tls.Dial(), but the address that won doesn't decide which session
+	// we resume
+	peerConfig = peerConfig.Clone()
+	if peerConfig.ServerName == "" {
+		peerConfig.ServerName, _, _ = net.SplitHostPort(addresses[0])
+	}
+	peerConfig.ClientSessionCache = keys.PeerSessionCache(peer)
+	connOut := tls.Client(conn, peerConfig)
+	if err := connOut.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return connOut, nil
+}
+
+// peerHost() returns the host:port that stands for the given peer in requests,
+// the first of its alternative addresses.
+func peerHost(peer string) string {
+	return config.AlternativeAddresses(peer)[0]
+}
+
+/*
+tunnel() has the entry proxy on connEntry CONNECT us to the exit proxy, and
+returns the TLS connection to the exit proxy (using exitConfig) nested inside
+connEntry.  The entry proxy dials the first of the exit proxy's alternative
+addresses.
+*/
+func tunnel(connEntry *tls.Conn, entryProxy string, exitProxy string, exitConfig *tls.Config) (*tls.Conn, error) {
+	connectReq := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Host: peerHost(exitProxy)},
+		Host:   peerHost(exitProxy),
+		Header: make(http.Header),
+	}
+	if err := connectReq.Write(connEntry); err != nil {
+		connEntry.Close()
+		return nil, fmt.Errorf("Unable to write CONNECT to entry proxy %s: %s", entryProxy, err)
+	}
+	// The exit proxy doesn't send anything before our TLS handshake, so the
+	// reader can't buffer anything beyond the response
+	connectResp, err := http.ReadResponse(bufio.NewReader(connEntry), connectReq)
+	if err != nil {
+		connEntry.Close()
+		return nil, fmt.Errorf("Unable to read CONNECT response from entry proxy %s: %s", entryProxy, err)
+	}
+	if connectResp.StatusCode != 200 {
+		connEntry.Close()
+		return nil, fmt.Errorf("Entry proxy %s refused to CONNECT: %s", entryProxy, connectResp.Status)
+	}
+	// The nested connection has the entry proxy's address, which mustn't
+	// decide which session we resume
+	exitConfig = exitConfig.Clone()
+	exitConfig.ClientSessionCache = keys.PeerSessionCache(exitProxy)
+	connOut := tls.Client(connEntry, exitConfig)
+	if err := connOut.Handshake(); err != nil {
+		connEntry.Close()
+		return nil, fmt.Errorf("Unable to handshake with exit proxy through %s: %s", entryProxy, err)
 	}
+	return connOut, nil
 }
@@ -0,0 +1,376 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"lantern/features"
+	"lantern/telemetry"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Multiplexing carries many requests to the same upstream proxy as streams over a
+single HTTP/2 connection, instead of opening a new TLS connection for each
+request.  Besides saving handshakes, this gets us HPACK header compression and
+keeps one lost packet on a lossy link from stalling more than one connection's
+worth of setup.
+
+Peers negotiate it with FLAG_MULTIPLEX during the handshake (see handshake.go).
+After a handshake with the flag, the downstream peer may speak HTTP/2 with
+prior knowledge on the connection (the TLS is ours, so there's no ALPN), or
+keep using HTTP/1.1 as before.  The remote proxy recognizes HTTP/2 by its
+connection preface.
+
+HTTP/2 streams can't be hijacked, so:
+
+- CONNECT requests turn their stream into a tunnel, as described in RFC 9113
+  section 8.5
+- plain HTTP requests are forwarded by the exit peer and their responses
+  relayed back like any other HTTP/2 response
+
+Requests that need integrity verification (see integrity.go) or PSK fallback
+(see psk.go) rely on the TLS connection that carries them, so they keep using a
+connection of their own.  Multiplexing can be switched off with the
+"multiplex" feature flag.
+
+HTTP/3 would help even more on lossy links, but needs a QUIC implementation
+that we don't have, so it isn't offered yet.
+*/
+const (
+	MULTIPLEX_IDLE_TIMEOUT     = 90 * time.Second // how long an idle multiplexed connection is kept open
+	MULTIPLEX_RECHECK_INTERVAL = 10 * time.Minute // how long we avoid multiplexing with an upstream proxy that didn't verify
+)
+
+// multiplex is the kill switch for multiplexing requests to upstream proxies
+var multiplex = features.Register("multiplex", true, "multiplex requests to upstream proxies over HTTP/2")
+
+// hopByHopHeaders are the headers that only apply to a single connection, and
+// which HTTP/2 doesn't allow.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+var (
+	multiplexers   = make(map[string]*http.Transport) // HTTP/2 transports, by upstream proxy
+	unverified     = make(map[string]time.Time)       // when upstream proxies last failed to verify for multiplexing
+	multiplexMutex sync.Mutex                         // used to synchronize access to all of the above
+)
+
+/*
+multiplexer() returns the transport that multiplexes requests to the given
+upstream proxy, or nil if we can't multiplex with it.
+*/
+func multiplexer(upstreamProxy string) *http.Transport {
+	if !multiplex.Enabled() || !peerSupports(upstreamProxy, FLAG_MULTIPLEX) {
+		return nil
+	}
+	multiplexMutex.Lock()
+	defer multiplexMutex.Unlock()
+	if since, found := unverified[upstreamProxy]; found {
+		if time.Since(since) < MULTIPLEX_RECHECK_INTERVAL {
+			return nil
+		}
+		delete(unverified, upstreamProxy)
+	}
+	transport := multiplexers[upstreamProxy]
+	if transport == nil {
+		protocols := &http.Protocols{}
+		protocols.SetUnencryptedHTTP2(true)
+		transport = &http.Transport{
+			Protocols: protocols,
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				return dialMultiplexed(upstreamProxy)
+			},
+			IdleConnTimeout: MULTIPLEX_IDLE_TIMEOUT,
+			// Requests go out as the client sent them (see compression.go)
+			DisableCompression: true,
+		}
+		multiplexers[upstreamProxy] = transport
+	}
+	return transport
+}
+
+/*
+dialMultiplexed() opens a connection to the upstream proxy that carries
+HTTP/2, taking a pre-warmed one if there is one (see prewarm.go).  The upstream
+proxy has to verify by its certificate, since we can't fall back to PSKs on a
+connection that's shared by many requests.
+*/
+func dialMultiplexed(upstreamProxy string) (net.Conn, error) {
+	connOut := takeWarmConn(upstreamProxy)
+	if connOut == nil {
+		var err error
+		if connOut, err = dialUpstream(upstreamProxy); err != nil {
+			return nil, err
+		}
+	}
+	if !peerSupports(upstreamProxy, FLAG_MULTIPLEX) {
+		connOut.Close()
+		return nil, fmt.Errorf("Upstream proxy %s no longer supports multiplexing", upstreamProxy)
+	}
+	if certErr := verifyUpstream(connOut.ConnectionState()); certErr != nil {
+		// Requests go over connections of their own, which can fall back to a
+		// PSK (see authenticateUpstream())
+		connOut.Close()
+		multiplexMutex.Lock()
+		unverified[upstreamProxy] = time.Now()
+		multiplexMutex.Unlock()
+		return nil, fmt.Errorf("Certificate of upstream proxy %s didn't verify, not multiplexing: %s", upstreamProxy, certErr)
+	}
+	verifiedUpstream(upstreamProxy)
+	return trackMultiplexed(upstreamProxy, connOut), nil
+}
+
+// proxyMultiplexed() proxies req to the upstream proxy over the given
+// multiplexing transport.
+func proxyMultiplexed(resp http.ResponseWriter, req *http.Request, upstreamProxy string, transport *http.Transport, session *telemetry.Session) {
+	if req.Method == "CONNECT" {
+		tunnelMultiplexed(resp, req, upstreamProxy, transport, session)
+		return
+	}
+	upstreamResp, err := roundTripMultiplexed(req, upstreamProxy, transport)
+	if err != nil {
+		respondBadGateway(resp, req, err.Error())
+		return
+	}
+	defer upstreamResp.Body.Close()
+	copyResponse(resp, upstreamResp)
+}
+
+// roundTripMultiplexed() sends a plain HTTP request to the upstream proxy over
+// the given multiplexing transport and returns the (decompressed) response.
+func roundTripMultiplexed(req *http.Request, upstreamProxy string, transport *http.Transport) (*http.Response, error) {
+	upstreamReq := req.Clone(req.Context())
+	upstreamReq.RequestURI = ""
+	// The stream goes to the upstream proxy, which finds the origin server by
+	// the :authority
+	upstreamReq.URL.Scheme = "http"
+	upstreamReq.URL.Host = upstreamProxy
+	removeHopByHopHeaders(upstreamReq.Header)
+	requestCompression(upstreamProxy, upstreamReq)
+	upstreamResp, err := transport.RoundTrip(upstreamReq)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to proxy through upstream proxy %s: %s", upstreamProxy, err)
+	}
+	if err := decompressResponse(upstreamResp); err != nil {
+		upstreamResp.Body.Close()
+		return nil, fmt.Errorf("Unable to decompress response from upstream proxy %s: %s", upstreamProxy, err)
+	}
+	return upstreamResp, nil
+}
+
+/*
+tunnelMultiplexed() has the upstream proxy CONNECT a stream to the host that req
+is for, and tunnels the client's connection through it.
+*/
+func tunnelMultiplexed(resp http.ResponseWriter, req *http.Request, upstreamProxy string, transport *http.Transport, session *telemetry.Session) {
+	stream, upstreamResp, err := connectMultiplexed(req, upstreamProxy, transport)
+	if err != nil {
+		respondBadGateway(resp, req, err.Error())
+	} else if stream == nil {
+		defer upstreamResp.Body.Close()
+		copyResponse(resp, upstreamResp)
+	} else if connIn, _, err := resp.(http.Hijacker).Hijack(); err != nil {
+		stream.Close()
+		msg := fmt.Sprintf("Unable to access underlying connection from client: %s", err)
+		respondBadGateway(resp, req, msg)
+	} else {
+		connIn.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+		pipe(connIn, session.Watch(stream), newFlow(req))
+	}
+}
+
+/*
+connectMultiplexed() has the upstream proxy CONNECT a stream to the host that
+the CONNECT request req is for.  If the upstream proxy refuses, its response is
+returned instead of the stream.
+*/
+func connectMultiplexed(req *http.Request, upstreamProxy string, transport *http.Transport) (*streamConn, *http.Response, error) {
+	bodyReader, bodyWriter := io.Pipe()
+	upstreamReq := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Scheme: "http", Host: upstreamProxy},
+		Host:   req.Host,
+		Header: req.Header.Clone(),
+		Body:   bodyReader,
+	}
+	removeHopByHopHeaders(upstreamReq.Header)
+	upstreamResp, err := transport.RoundTrip(upstreamReq)
+	if err != nil {
+		bodyWriter.Close()
+		return nil, nil, fmt.Errorf("Unable to CONNECT through upstream proxy %s: %s", upstreamProxy, err)
+	}
+	if upstreamResp.StatusCode != 200 {
+		bodyWriter.Close()
+		return nil, upstreamResp, nil
+	}
+	return newStreamConn(upstreamResp.Body, bodyWriter, req.RemoteAddr, upstreamProxy), nil, nil
+}
+
+/*
+relayStream() relays a request that came in on an HTTP/2 stream to connOut.  A
+CONNECT turns the stream into a tunnel to connOut, which lasts until either
+side closes it.
+*/
+func relayStream(resp http.ResponseWriter, req *http.Request, connOut net.Conn) {
+	controller := http.NewResponseController(resp)
+	// Tunnels last for as long as they're used, not as long as the server's
+	// timeouts
+	controller.SetReadDeadline(time.Time{})
+	controller.SetWriteDeadline(time.Time{})
+	if req.Method != "CONNECT" {
+		defer connOut.Close()
+		forwardStream(resp, req, connOut)
+		return
+	}
+	resp.WriteHeader(200)
+	if err := controller.Flush(); err != nil {
+		connOut.Close()
+		log.Printf("Unable to answer CONNECT for %s: %s", req.Host, err)
+		return
+	}
+	stream := newStreamConn(req.Body, &flushWriter{resp: resp, controller: controller}, req.Host, req.RemoteAddr)
+	// The stream ends with the handler, so closing either side ends it
+	pipe(stream, &releasingConn{connOut, func() { stream.Close() }}, newFlow(req))
+	<-stream.done
+}
+
+// forwardStream() forwards a plain HTTP request that came in on an HTTP/2
+// stream to the origin server on connOut, and relays the response.
+func forwardStream(resp http.ResponseWriter, req *http.Request, connOut net.Conn) {
+	removeHopByHopHeaders(req.Header)
+	compress := acceptsCompression(req)
+	if err := req.Write(connOut); err != nil {
+		respondBadGateway(resp, req, fmt.Sprintf("Unable to write request to server: %s", err))
+		return
+	}
+	originResp, err := http.ReadResponse(bufio.NewReader(connOut), req)
+	if err != nil {
+		respondBadGateway(resp, req, fmt.Sprintf("Unable to read response from server: %s", err))
+		return
+	}
+	defer originResp.Body.Close()
+	if compress {
+		compressResponse(req, originResp)
+	}
+	copyResponse(resp, originResp)
+}
+
+// copyResponse() writes the given response to resp, minus the headers that
+// only applied to the connection it came in on.
+func copyResponse(resp http.ResponseWriter, from *http.Response) {
+	removeHopByHopHeaders(from.Header)
+	for key, values := range from.Header {
+		for _, value := range values {
+			resp.Header().Add(key, value)
+		}
+	}
+	resp.WriteHeader(from.StatusCode)
+	io.Copy(resp, from.Body)
+}
+
+// removeHopByHopHeaders() removes the hop-by-hop headers from header,
+// including the ones listed in its Connection header.
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// streamConn is a net.Conn made of the two halves of an HTTP/2 stream.
+// Deadlines aren't supported.
+type streamConn struct {
+	in     io.ReadCloser  // the half of the stream that we receive
+	out    io.WriteCloser // the half of the stream that we send
+	local  streamAddr     // our end of the stream
+	remote streamAddr     // the other end of the stream
+	once   sync.Once      // makes sure that the stream is only closed once
+	done   chan bool      // closed once the stream is closed
+}
+
+// streamAddr is the address of either end of a stream.
+type streamAddr string
+
+func (addr streamAddr) Network() string { return "h2" }
+func (addr streamAddr) String() string  { return string(addr) }
+
+func newStreamConn(in io.ReadCloser, out io.WriteCloser, local string, remote string) *streamConn {
+	return &streamConn{
+		in:     in,
+		out:    out,
+		local:  streamAddr(local),
+		remote: streamAddr(remote),
+		done:   make(chan bool),
+	}
+}
+
+func (conn *streamConn) Read(b []byte) (int, error)  { return conn.in.Read(b) }
+func (conn *streamConn) Write(b []byte) (int, error) { return conn.out.Write(b) }
+func (conn *streamConn) LocalAddr() net.Addr         { return conn.local }
+func (conn *streamConn) RemoteAddr() net.Addr        { return conn.remote }
+
+func (conn *streamConn) Close() error {
+	conn.once.Do(func() {
+		conn.out.Close()
+		conn.in.Close()
+		close(conn.done)
+	})
+	return nil
+}
+
+func (conn *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (conn *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (conn *streamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+/*
+flushWriter writes to a ResponseWriter, flushing every write so that tunneled
+data isn't held back.  Once closed, it refuses writes, since the ResponseWriter
+mustn't be used after the handler returns.
+*/
+type flushWriter struct {
+	resp       http.ResponseWriter
+	controller *http.ResponseController
+	closed     bool       // whether the writer has been closed
+	mutex      sync.Mutex // used to synchronize access to the ResponseWriter and closed
+}
+
+func (writer *flushWriter) Write(b []byte) (int, error) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	if writer.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := writer.resp.Write(b)
+	if err == nil {
+		err = writer.controller.Flush()
+	}
+	return n, err
+}
+
+func (writer *flushWriter) Close() error {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	writer.closed = true
+	return nil
+}
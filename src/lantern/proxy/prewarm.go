@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"lantern/config"
+	"lantern/features"
+	"lantern/util"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+Pre-warming keeps a connection to each of the PREWARM_PEERS best upstream
+proxies (see PeerRanking()) dialed and handshaken ahead of time, so that the
+first request after a quiet spell, like when the browser opens, doesn't pay for
+the dial and the handshakes.  dialMultiplexed() takes the pre-warmed connection
+if there is one, and the next one is dialed shortly after.
+
+Remote proxies close connections that don't send a request within their read
+timeout, so pre-warmed connections that haven't been used within
+PREWARM_LIFETIME are replaced by fresh ones.  Session resumption (see
+keys.SecurePeerConfig()) keeps that churn cheap.  Peers that we have a
+multiplexed connection to already don't need one, and neither do peers that
+can't multiplex or whose last dial failed less than PREWARM_RETRY ago.
+
+Pre-warming can be switched off with the "prewarm" feature flag, and is off
+whenever multiplexing is.
+*/
+const (
+	PREWARM_PEERS          = 2               // how many of the best upstream proxies we keep a connection to
+	PREWARM_LIFETIME       = 8 * time.Second // how long a pre-warmed connection is kept before it's replaced
+	PREWARM_CHECK_INTERVAL = 1 * time.Second // how frequently we check the pre-warmed connections
+	PREWARM_RETRY          = 1 * time.Minute // how long we wait before pre-warming for a peer whose dial failed
+)
+
+// prewarm is the switch for pre-warming connections to upstream proxies
+var prewarm = features.Register("prewarm", true, "keep connections to the best upstream proxies ready ahead of time")
+
+// warmConn is a pre-warmed connection to an upstream proxy.
+type warmConn struct {
+	conn   *tls.Conn // the connection, dialed and handshaken
+	dialed time.Time // when the connection was dialed
+}
+
+var (
+	warmConns       = make(map[string]*warmConn) // pre-warmed connections, by upstream proxy
+	openMultiplexed = make(map[string]int)       // open multiplexed connections, by upstream proxy
+	prewarmMutex    sync.Mutex                   // used to synchronize access to warmConns and openMultiplexed
+)
+
+func init() {
+	if config.Runs(config.SUBSYSTEM_LOCAL_PROXY) {
+		util.GoLoop("connection pre-warmer", prewarmer)
+	}
+}
+
+/*
+takeWarmConn() returns the pre-warmed connection to the given upstream proxy,
+or nil if there isn't one that's fresh enough.
+*/
+func takeWarmConn(upstreamProxy string) *tls.Conn {
+	prewarmMutex.Lock()
+	defer prewarmMutex.Unlock()
+	warm, found := warmConns[upstreamProxy]
+	if !found {
+		return nil
+	}
+	delete(warmConns, upstreamProxy)
+	if time.Since(warm.dialed) >= PREWARM_LIFETIME {
+		warm.conn.Close()
+		return nil
+	}
+	return warm.conn
+}
+
+/*
+trackMultiplexed() counts the given multiplexed connection to the given
+upstream proxy as open until it's closed, so that we don't pre-warm a
+connection that isn't needed.
+*/
+func trackMultiplexed(upstreamProxy string, conn net.Conn) net.Conn {
+	prewarmMutex.Lock()
+	openMultiplexed[upstreamProxy] += 1
+	prewarmMutex.Unlock()
+	var once sync.Once
+	return &releasingConn{conn, func() {
+		once.Do(func() {
+			prewarmMutex.Lock()
+			defer prewarmMutex.Unlock()
+			openMultiplexed[upstreamProxy] -= 1
+			if openMultiplexed[upstreamProxy] == 0 {
+				delete(openMultiplexed, upstreamProxy)
+			}
+		})
+	}}
+}
+
+// prewarmer(), meant to be run as a goroutine, keeps pre-warmed connections to
+// the best upstream proxies.
+func prewarmer() {
+	for {
+		time.Sleep(PREWARM_CHECK_INTERVAL)
+		wanted := make(map[string]bool)
+		if prewarm.Enabled() && multiplex.Enabled() && localGet.Enabled() {
+			for _, rank := range PeerRanking() {
+				if len(wanted) == PREWARM_PEERS {
+					break
+				}
+				wanted[rank.Address] = true
+			}
+		}
+		for _, upstreamProxy := range dropWarmConns(wanted) {
+			if err := prewarmFor(upstreamProxy); err != nil {
+				log.Printf("Unable to pre-warm a connection to %s: %s", upstreamProxy, err)
+			}
+		}
+	}
+}
+
+/*
+dropWarmConns() closes the pre-warmed connections that are stale or to upstream
+proxies that aren't wanted anymore, and returns the wanted upstream proxies that
+need a new one.
+*/
+func dropWarmConns(wanted map[string]bool) []string {
+	prewarmMutex.Lock()
+	defer prewarmMutex.Unlock()
+	for upstreamProxy, warm := range warmConns {
+		if !wanted[upstreamProxy] || openMultiplexed[upstreamProxy] > 0 || time.Since(warm.dialed) >= PREWARM_LIFETIME {
+			warm.conn.Close()
+			delete(warmConns, upstreamProxy)
+		}
+	}
+	needed := make([]string, 0, len(wanted))
+	for upstreamProxy := range wanted {
+		if warmConns[upstreamProxy] == nil && openMultiplexed[upstreamProxy] == 0 && worthPrewarming(upstreamProxy) {
+			needed = append(needed, upstreamProxy)
+		}
+	}
+	return needed
+}
+
+/*
+worthPrewarming() indicates whether the given upstream proxy can use a
+pre-warmed connection, which it can't if it doesn't multiplex or didn't answer
+recently.
+*/
+func worthPrewarming(upstreamProxy string) bool {
+	legacyMutex.Lock()
+	flags, known := peerFlags[upstreamProxy]
+	legacyMutex.Unlock()
+	if isLegacyPeer(upstreamProxy) || known && flags&FLAG_MULTIPLEX == 0 {
+		return false
+	}
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	if health, found := peerHealth[upstreamProxy]; found && health.ConsecutiveFailures > 0 {
+		return time.Since(health.LastDial) >= PREWARM_RETRY
+	}
+	return true
+}
+
+// prewarmFor() dials a pre-warmed connection to the given upstream proxy.
+func prewarmFor(upstreamProxy string) error {
+	conn, err := dialUpstream(upstreamProxy)
+	if err != nil {
+		return err
+	}
+	if !peerSupports(upstreamProxy, FLAG_MULTIPLEX) {
+		conn.Close()
+		return nil
+	}
+	prewarmMutex.Lock()
+	defer prewarmMutex.Unlock()
+	if previous, found := warmConns[upstreamProxy]; found {
+		previous.conn.Close()
+	}
+	warmConns[upstreamProxy] = &warmConn{conn: conn, dialed: time.Now()}
+	return nil
+}
@@ -2,7 +2,6 @@ package proxy
 
 import (
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
@@ -14,13 +13,24 @@ func respondBadGateway(resp http.ResponseWriter, req *http.Request, msg string)
 	resp.Write([]byte(fmt.Sprintf("Bad Gateway: %s - %s", req.URL, msg)))
 }
 
-func pipe(connIn net.Conn, connOut net.Conn) {
+// pipe() relays between connIn and connOut in both directions, shaping the
+// traffic as the given flow (see shaping.go).
+func pipe(connIn net.Conn, connOut net.Conn, flow *flow) {
+	flow.entry.piped()
 	go func() {
+		defer flow.entry.pipeDone()
 		defer connIn.Close()
-		io.Copy(connOut, connIn)
+		flow.copy(connOut, connIn, false)
 	}()
 	go func() {
+		defer flow.entry.pipeDone()
 		defer connOut.Close()
-		io.Copy(connIn, connOut)
+		flow.copy(connIn, connOut, true)
 	}()
 }
+
+func respondUnavailable(resp http.ResponseWriter, req *http.Request, msg string) {
+	log.Println(msg)
+	resp.WriteHeader(503)
+	resp.Write([]byte(fmt.Sprintf("Service Unavailable: %s - %s", req.URL, msg)))
+}
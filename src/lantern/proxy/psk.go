@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"lantern/audit"
+	"lantern/keys"
+	"lantern/ui"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+PSK fallback lets long-paired peers keep talking over the direct proxy hop when
+the PKI breaks, for example because the root was compromised or certificates
+were revoked en masse.  It's never used anywhere but on the direct proxy hop.
+
+While the upstream proxy's certificate verifies against keys.TrustedParents,
+the local proxy pairs with it once by sending a request marked with
+X_LANTERN_PSK_PAIR.  The remote proxy authenticates the request by its client
+certificate, generates a PSK (see keys.NewPSK()) and returns it in X_LANTERN_PSK
+along with an ID (X_LANTERN_PSK_ID) that only it can map back to the peer's
+identity.  Both sides store the PSK.
+
+When the upstream proxy's certificate stops verifying and we're paired with it,
+the local proxy first sends a probe (X_LANTERN_PSK_PROBE) carrying the PSK ID
+and its proof (X_LANTERN_PSK_PROOF, see keys.PSKProof()).  The remote proxy
+answers with its own proof, which the local proxy checks before it sends the
+actual request with the same proofs.  The remote proxy only authenticates peers
+with a PSK when their client certificate doesn't authenticate them.
+
+Whenever a PSK is used in place of a certificate, a warning is logged and the
+peer is listed at http://[config.UIAddress()]/diagnostics/psk, so that users
+can tell that they're relying on the fallback.
+*/
+const (
+	X_LANTERN_PSK_PAIR  = "X-Lantern-PSK-Pair"
+	X_LANTERN_PSK       = "X-Lantern-PSK"
+	X_LANTERN_PSK_ID    = "X-Lantern-PSK-Id"
+	X_LANTERN_PSK_PROBE = "X-Lantern-PSK-Probe"
+	X_LANTERN_PSK_PROOF = "X-Lantern-PSK-Proof"
+)
+
+// pskStatus is what /diagnostics/psk returns.
+type pskStatus struct {
+	Upstream   map[string]time.Time // upstream proxies that we last authenticated with a PSK, and when
+	Downstream map[string]time.Time // peers that last authenticated to us with a PSK, and when
+}
+
+var (
+	pskUpstream   = make(map[string]time.Time) // upstream proxies currently authenticated with a PSK
+	pskDownstream = make(map[string]time.Time) // peers currently authenticating to us with a PSK
+	pairing       = make(map[string]bool)      // upstream proxies that we're currently pairing with
+	pskMutex      sync.Mutex                   // used to synchronize access to all of the above
+)
+
+func init() {
+	ui.HandleFunc("/diagnostics/psk", pskHandler)
+}
+
+// verifyUpstream() checks the upstream proxy's certificate against
+// keys.TrustedParents.
+func verifyUpstream(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("Upstream proxy didn't present a certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         keys.TrustedParents,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+/*
+authenticateUpstream() makes sure that we trust the upstream proxy on connOut,
+by its certificate or, failing that, by the PSK that we share with it.  If PSK
+fallback is needed, req is marked with our proof.  Upstream proxies that we
+trust by neither are rejected, since the handshake itself doesn't verify them
+(see tlsConfig).
+*/
+func authenticateUpstream(upstreamProxy string, connOut *tls.Conn, req *http.Request) error {
+	certErr := verifyUpstream(connOut.ConnectionState())
+	if certErr == nil {
+		verifiedUpstream(upstreamProxy)
+		return nil
+	}
+	psk, found := keys.PSK(upstreamProxy)
+	if !found {
+		return fmt.Errorf("Certificate of upstream proxy %s didn't verify and we aren't paired with it: %s", upstreamProxy, certErr)
+	}
+	log.Printf("WARNING: certificate of upstream proxy %s didn't verify (%s), falling back to PSK", upstreamProxy, certErr)
+	proof, err := keys.PSKProof(psk.Key, connOut.ConnectionState(), keys.PSK_ROLE_CLIENT)
+	if err != nil {
+		return err
+	}
+	probe, err := http.NewRequest("GET", "http://"+peerHost(upstreamProxy)+"/", nil)
+	if err != nil {
+		return err
+	}
+	markWithPSK(probe, psk.ID, proof)
+	probe.Header.Set(X_LANTERN_PSK_PROBE, "1")
+	if err := probe.Write(connOut); err != nil {
+		return err
+	}
+	probeResp, err := http.ReadResponse(bufio.NewReader(connOut), probe)
+	if err != nil {
+		return err
+	}
+	probeResp.Body.Close()
+	serverProof, err := base64.StdEncoding.DecodeString(probeResp.Header.Get(X_LANTERN_PSK_PROOF))
+	if probeResp.StatusCode != 200 || err != nil {
+		return fmt.Errorf("Upstream proxy rejected PSK: %s", probeResp.Status)
+	}
+	if err := keys.VerifyPSKProof(psk.Key, connOut.ConnectionState(), keys.PSK_ROLE_SERVER, serverProof); err != nil {
+		return err
+	}
+	pskMutex.Lock()
+	pskUpstream[upstreamProxy] = time.Now()
+	pskMutex.Unlock()
+	markWithPSK(req, psk.ID, proof)
+	return nil
+}
+
+// verifiedUpstream() notes that the upstream proxy's certificate verified,
+// pairing with it if we haven't yet.
+func verifiedUpstream(upstreamProxy string) {
+	pskMutex.Lock()
+	delete(pskUpstream, upstreamProxy)
+	pskMutex.Unlock()
+	if _, found := keys.PSK(upstreamProxy); !found {
+		go pairWith(upstreamProxy)
+	}
+}
+
+// markWithPSK() adds the given PSK ID and proof to the given request.
+func markWithPSK(req *http.Request, id string, proof []byte) {
+	req.Header.Set(X_LANTERN_PSK_ID, id)
+	req.Header.Set(X_LANTERN_PSK_PROOF, base64.StdEncoding.EncodeToString(proof))
+}
+
+// pairWith() establishes a PSK with the given upstream proxy while we still
+// trust its certificate.
+func pairWith(upstreamProxy string) {
+	pskMutex.Lock()
+	if pairing[upstreamProxy] {
+		pskMutex.Unlock()
+		return
+	}
+	pairing[upstreamProxy] = true
+	pskMutex.Unlock()
+	defer func() {
+		pskMutex.Lock()
+		delete(pairing, upstreamProxy)
+		pskMutex.Unlock()
+	}()
+
+	if err := doPair(upstreamProxy); err != nil {
+		log.Printf("Unable to pair with upstream proxy %s: %s", upstreamProxy, err)
+	} else {
+		log.Printf("Paired with upstream proxy %s", upstreamProxy)
+	}
+}
+
+func doPair(upstreamProxy string) error {
+	connOut, err := dialUpstream(upstreamProxy)
+	if err != nil {
+		return err
+	}
+	defer connOut.Close()
+	if err := verifyUpstream(connOut.ConnectionState()); err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", "http://"+peerHost(upstreamProxy)+"/", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(X_LANTERN_PSK_PAIR, "1")
+	if err := req.Write(connOut); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(connOut), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Upstream proxy refused to pair: %s", resp.Status)
+	}
+	key, err := base64.StdEncoding.DecodeString(resp.Header.Get(X_LANTERN_PSK))
+	if err != nil {
+		return err
+	}
+	return keys.SetPSK(upstreamProxy, &keys.PSKPairing{
+		ID:       resp.Header.Get(X_LANTERN_PSK_ID),
+		Key:      key,
+		PairedAt: time.Now(),
+	})
+}
+
+/*
+peerIdentity() authenticates the downstream peer that sent req, by its access
+credentials (see access.go), its client certificate or, failing that, by a PSK
+proof.  Returns the peer's email and,
+if it was authenticated with a PSK, that PSK.
+*/
+func peerIdentity(req *http.Request) (string, *keys.PSKPairing, error) {
+	if identity := credentialIdentity(req); identity != "" {
+		return identity, nil, nil
+	}
+	peerCertificates := req.TLS.PeerCertificates
+	var certErr error
+	if len(peerCertificates) == 0 {
+		certErr = fmt.Errorf("No peer certificates provided")
+	} else if err := keys.VerifyChild(peerCertificates[0]); err != nil {
+		certErr = err
+	} else if email, err := keys.Identity(peerCertificates[0]); err != nil {
+		certErr = fmt.Errorf("Unable to decrypt email: %s", err)
+	} else {
+		pskMutex.Lock()
+		delete(pskDownstream, email)
+		pskMutex.Unlock()
+		return email, nil, nil
+	}
+
+	id := req.Header.Get(X_LANTERN_PSK_ID)
+	if id == "" {
+		return "", nil, certErr
+	}
+	psk, found := keys.PSK(id)
+	if !found {
+		return "", nil, fmt.Errorf("%s, and unknown PSK", certErr)
+	}
+	proof, err := base64.StdEncoding.DecodeString(req.Header.Get(X_LANTERN_PSK_PROOF))
+	if err != nil {
+		return "", nil, err
+	}
+	if err := keys.VerifyPSKProof(psk.Key, *req.TLS, keys.PSK_ROLE_CLIENT, proof); err != nil {
+		return "", nil, err
+	}
+	email, err := keys.Decrypt(id)
+	if err != nil {
+		return "", nil, err
+	}
+	log.Printf("WARNING: %s, authenticated %s with PSK", certErr, email)
+	pskMutex.Lock()
+	_, fellBack := pskDownstream[email]
+	pskDownstream[email] = time.Now()
+	pskMutex.Unlock()
+	if !fellBack {
+		// Only the first request of a fallback is worth auditing
+		audit.Recordf(audit.EVENT_AUTH_FALLBACK, req.RemoteAddr, "%s authenticated with PSK: %s", email, certErr)
+	}
+	return email, psk, nil
+}
+
+// issuePSK() pairs with the downstream peer with the given email, answering
+// with the new PSK.
+func issuePSK(resp http.ResponseWriter, req *http.Request, email string) {
+	id, err := keys.Encrypt(email)
+	if err != nil {
+		respondBadGateway(resp, req, fmt.Sprintf("Unable to generate PSK ID: %s", err))
+		return
+	}
+	psk, err := keys.NewPSK(id, id)
+	if err != nil {
+		respondBadGateway(resp, req, fmt.Sprintf("Unable to generate PSK: %s", err))
+		return
+	}
+	log.Printf("Paired with %s", email)
+	resp.Header().Set(X_LANTERN_PSK_ID, id)
+	resp.Header().Set(X_LANTERN_PSK, base64.StdEncoding.EncodeToString(psk.Key))
+	resp.WriteHeader(200)
+}
+
+// answerPSKProbe() proves to a downstream peer that authenticated with a PSK
+// that we know it too.
+func answerPSKProbe(resp http.ResponseWriter, req *http.Request, psk *keys.PSKPairing) {
+	proof, err := keys.PSKProof(psk.Key, *req.TLS, keys.PSK_ROLE_SERVER)
+	if err != nil {
+		respondBadGateway(resp, req, fmt.Sprintf("Unable to compute PSK proof: %s", err))
+		return
+	}
+	resp.Header().Set(X_LANTERN_PSK_PROOF, base64.StdEncoding.EncodeToString(proof))
+	resp.WriteHeader(200)
+}
+
+// stripPSKHeaders() removes our PSK headers from a request before it's relayed.
+func stripPSKHeaders(req *http.Request) {
+	for _, header := range []string{X_LANTERN_PSK_PAIR, X_LANTERN_PSK_ID, X_LANTERN_PSK_PROBE, X_LANTERN_PSK_PROOF} {
+		req.Header.Del(header)
+	}
+}
+
+// pskHandler() lists the peers that we're currently authenticating with PSKs
+// instead of certificates.
+func pskHandler(resp http.ResponseWriter, req *http.Request) {
+	pskMutex.Lock()
+	statusJson, err := json.MarshalIndent(&pskStatus{Upstream: pskUpstream, Downstream: pskDownstream}, "", "   ")
+	pskMutex.Unlock()
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(statusJson)
+	}
+}
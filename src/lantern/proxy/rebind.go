@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"lantern/config"
+	"lantern/util"
+	"log"
+)
+
+/*
+The local and remote proxy follow changes of their addresses at runtime, for
+example when the operator changes config.LocalProxyAddress() or
+config.RemoteProxyAddress() in the UI.  Both listen through a util.Rebinder,
+which starts accepting at the new addresses before it stops accepting at the
+old ones and lets the tunnels that the old listeners accepted finish within
+util.REBIND_DRAIN_DEADLINE.  If a new address can't be bound, the proxy keeps
+listening where it did and tries again with the next change.
+*/
+
+/*
+followListenAddresses(), meant to be run as a goroutine, rebinds the given
+listeners to the given addresses whenever the addresses that we listen on
+change.
+*/
+func followListenAddresses(listeners *util.Rebinder, addresses func() []string) {
+	changes := make(chan bool, 1)
+	config.WatchListenAddresses(changes)
+	for range changes {
+		if err := listeners.Rebind(addresses()); err != nil {
+			log.Printf("Unable to rebind, keeping the current addresses: %s", err)
+		}
+	}
+}
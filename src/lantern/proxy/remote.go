@@ -3,8 +3,13 @@ package proxy
 import (
 	"crypto/tls"
 	"fmt"
+	"lantern/accounting"
+	"lantern/audit"
+	"lantern/blocklist"
 	"lantern/config"
+	"lantern/features"
 	"lantern/keys"
+	"lantern/util"
 	"log"
 	"net"
 	"net/http"
@@ -12,9 +17,14 @@ import (
 	"time"
 )
 
-var httpClient = &http.Client{}
+// relay is the kill switch for proxying on behalf of other lantern nodes
+var relay = features.Register("relay", true, "proxy traffic on behalf of other lantern nodes")
 
 func init() {
+	if !config.Runs(config.SUBSYSTEM_REMOTE_PROXY) {
+		log.Printf("Not starting the remote proxy as %s", config.Subcommand())
+		return
+	}
 	go runRemote()
 }
 
@@ -25,41 +35,106 @@ func runRemote() {
 		cert = <-certChannel
 	}
 
+	// The operator can fix an invalid configuration in the UI, so we keep
+	// checking until it's valid
+	util.Supervise("remote proxy configuration", validateRemote)
+	util.GoLoop("capability advertiser", advertiseCapabilities)
+
 	server := &http.Server{
-		Addr:         config.RemoteProxyAddress(),
+		Addr:         config.RemoteProxyBindAddress(),
 		Handler:      http.HandlerFunc(handleRemoteRequest),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
-		TLSConfig: &tls.Config{
-			ClientCAs:  keys.TrustedParents,
-			ClientAuth: tls.RequestClientCert,
-		},
+		TLSConfig: keys.SecurePeerConfig(&tls.Config{
+			ClientCAs:      keys.TrustedParents,
+			ClientAuth:     tls.RequestClientCert,
+			GetCertificate: keys.GetCertificate,
+		}),
+		ConnContext: rememberConn,
 	}
+	// handshakeConns hide their TLS from net/http, so peers that negotiated
+	// FLAG_MULTIPLEX speak HTTP/2 with prior knowledge (see multiplex.go)
+	server.Protocols = &http.Protocols{}
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+
+	listeners := util.NewRebinder("remote proxy", server, func(listener net.Listener) net.Listener {
+		return &handshakeListener{tls.NewListener(listener, server.TLSConfig)}
+	})
+	util.Supervise("remote proxy", func() error {
+		return listeners.Rebind(config.RemoteProxyBindAddresses())
+	})
+	util.GoLoop("remote proxy rebinder", func() {
+		followListenAddresses(listeners, config.RemoteProxyBindAddresses)
+	})
+}
 
-	log.Printf("About to start remote proxy at: %s", config.RemoteProxyAddress())
-	if err := server.ListenAndServeTLS(keys.CertificateFile, keys.PrivateKeyFile); err != nil {
-		log.Fatalf("Unable to start remote proxy: %s", err)
+// validateRemote() checks the IP and address configuration of the remote
+// proxy.
+func validateRemote() error {
+	if err := config.ValidateIPs(config.BindIP(), config.AdvertiseIP()); err != nil {
+		return fmt.Errorf("Invalid IP configuration: %s", err)
 	}
+	if err := config.ValidateAddresses(); err != nil {
+		return fmt.Errorf("Invalid address configuration: %s", err)
+	}
+	return nil
 }
 
 func handleRemoteRequest(resp http.ResponseWriter, req *http.Request) {
-	peerCertificates := req.TLS.PeerCertificates
-	if len(peerCertificates) == 0 {
-		log.Printf("No peer certificates provided")
+	restoreTLS(req)
+	if !relay.Enabled() {
+		resp.WriteHeader(503)
+		resp.Write([]byte("Relaying is disabled"))
+	} else if keys.CertificateState() == keys.CERT_EXPIRED {
+		respondUnavailable(resp, req, "Our certificate has expired")
 	} else {
-		peerCertificate := peerCertificates[0]
-		if _, err := keys.Decrypt(peerCertificate.Subject.CommonName); err != nil {
-			msg := fmt.Sprintf("Unable to decrypt email: %s", err)
-			respondBadGateway(resp, req, msg)
+		pair := req.Header.Get(X_LANTERN_PSK_PAIR) != ""
+		probe := req.Header.Get(X_LANTERN_PSK_PROBE) != ""
+		email, psk, err := peerIdentity(req)
+		// Our PSK and egress headers are meant for us only and mustn't be
+		// relayed
+		stripPSKHeaders(req)
+		hops := takeEgressHops(req)
+		if err != nil {
+			audit.Record(audit.EVENT_AUTH_FAILED, req.RemoteAddr, fmt.Sprintf("remote proxy: %s", err))
+			respondBadGateway(resp, req, err.Error())
+		} else if err := checkAccess(req); err != nil {
+			log.Printf("Rejecting request from %s: %s", email, err)
+			resp.WriteHeader(403)
+			resp.Write([]byte("Forbidden"))
+		} else if blocklist.IsBlocked(email) {
+			log.Printf("Rejecting request from blocked identity: %s", email)
+			resp.WriteHeader(403)
+			resp.Write([]byte("Forbidden"))
+		} else if pair && psk == nil {
+			issuePSK(resp, req, email)
+		} else if probe && psk != nil {
+			answerPSKProbe(resp, req, psk)
+		} else if release, reason := admitConnection(email); release == nil {
+			respondUnavailable(resp, req, reason)
+		} else if req.Header.Get(X_LANTERN_BANDWIDTH_TEST) != "" {
+			defer release()
+			answerBandwidthTest(resp, req)
+		} else if req.Method != "CONNECT" && req.Header.Get(X_LANTERN_INTEGRITY) != "" {
+			defer release()
+			serveWithIntegrity(resp, req)
 		} else {
 			// TODO: check email?  Maybe this is only needed for the signaling channel
 			//log.Printf("Peer Email is: %s", email)
+			accounting.RecordActiveUser(email)
 			host := hostIncludingPort(req)
-			if connOut, err := net.Dial("tcp", host); err != nil {
+			if connOut, err := dialOrigin(host, hops); err != nil {
+				release()
 				msg := fmt.Sprintf("Unable to open socket to server: %s", err)
 				respondBadGateway(resp, req, msg)
+			} else if req.ProtoMajor == 2 {
+				// HTTP/2 streams can't be hijacked (see multiplex.go)
+				relayStream(resp, req, accounting.Count(&releasingConn{connOut, release}))
 			} else {
+				connOut = &releasingConn{connOut, release}
 				if connIn, _, err := resp.(http.Hijacker).Hijack(); err != nil {
+					connOut.Close()
 					msg := fmt.Sprintf("Unable to access underlying connection from downstream proxy: %s", err)
 					respondBadGateway(resp, req, msg)
 				} else {
@@ -68,21 +143,22 @@ func handleRemoteRequest(resp http.ResponseWriter, req *http.Request) {
 					} else {
 						req.Write(connOut)
 					}
-					pipe(connIn, connOut)
+					pipe(connIn, accounting.Count(connOut), newFlow(req))
 				}
 			}
 		}
 	}
 }
 
-func hostIncludingPort(req *http.Request) (host string) {
-	host = req.Host
-	if !strings.Contains(host, ":") {
-		if req.Method == "CONNECT" {
-			host = host + ":443"
-		} else {
-			host = host + ":80"
-		}
+// hostIncludingPort() returns the host:port that the given request is for,
+// defaulting the port from the method.  IPv6 literals come back in brackets.
+func hostIncludingPort(req *http.Request) string {
+	if _, _, err := net.SplitHostPort(req.Host); err == nil {
+		return req.Host
+	}
+	port := "80"
+	if req.Method == "CONNECT" {
+		port = "443"
 	}
-	return
+	return net.JoinHostPort(strings.Trim(req.Host, "[]"), port)
 }
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Traffic shaping keeps one big download through a node from starving everybody
+else's web browsing.
+
+Every piped connection is a flow that's classified as either interactive or
+bulk.  Flows start out interactive if they look like web browsing (plain HTTP
+or a CONNECT to port 443) and bulk otherwise.  Interactive flows become bulk
+once they've relayed more than BULK_THRESHOLD bytes in frames that average at
+least SMALL_FRAME bytes, which is what large downloads look like, while chatty
+flows with small frames stay interactive.
+
+Writes from all flows go through a weighted scheduler that allows at most
+MAX_WRITES_IN_FLIGHT concurrent writes.  When writes have to wait, interactive
+flows get INTERACTIVE_WEIGHT turns for every turn of a bulk flow.  A write that
+stalls (for example because the other end stopped reading) gives up its turn
+after MAX_WRITE_HOLD, so it can't block the scheduler.
+*/
+const (
+	CLASS_INTERACTIVE = 0 // latency sensitive flows, like web browsing
+	CLASS_BULK        = 1 // throughput oriented flows, like large downloads
+
+	PIPE_BUFFER_SIZE     = 32 * 1024              // the largest chunk that's read and written at once
+	BULK_THRESHOLD       = 1024 * 1024            // bytes after which a flow with large frames counts as bulk
+	SMALL_FRAME          = 4 * 1024               // average frame size below which a flow stays interactive
+	MAX_WRITES_IN_FLIGHT = 8                      // concurrent writes allowed before flows have to take turns
+	INTERACTIVE_WEIGHT   = 4                      // interactive turns for each bulk turn
+	MAX_WRITE_HOLD       = 500 * time.Millisecond // how long a write keeps its turn
+)
+
+// flow tracks a piped connection for classification.
+type flow struct {
+	class  int          // the initial class of the flow
+	bytes  int64        // bytes relayed so far, accessed atomically
+	frames int64        // frames relayed so far, accessed atomically
+	entry  *accessEntry // the access entry of the request (see accesslog.go)
+}
+
+// scheduler hands out turns to write.
+type scheduler struct {
+	inFlight         int            // writes currently holding a turn
+	waiting          [2][]chan bool // writers waiting for a turn, by class
+	interactiveTurns int            // interactive turns since the last bulk turn
+	mutex            sync.Mutex     // used to synchronize access to all of the above
+}
+
+// shaper is the scheduler shared by all piped connections.
+var shaper = &scheduler{}
+
+// newFlow() creates a flow for the given request.
+func newFlow(req *http.Request) *flow {
+	class := CLASS_INTERACTIVE
+	if req.Method == "CONNECT" {
+		if _, port, err := net.SplitHostPort(req.Host); err != nil || port != "443" {
+			class = CLASS_BULK
+		}
+	}
+	return &flow{class: class, entry: accessEntryOf(req)}
+}
+
+// record() records a frame of n bytes and returns the flow's current class.
+func (flow *flow) record(n int) int {
+	bytes := atomic.AddInt64(&flow.bytes, int64(n))
+	frames := atomic.AddInt64(&flow.frames, 1)
+	if flow.class == CLASS_INTERACTIVE && bytes > BULK_THRESHOLD && bytes/frames >= SMALL_FRAME {
+		return CLASS_BULK
+	}
+	return flow.class
+}
+
+// copy() copies from src to dst until either side fails, taking turns with
+// other flows for every write.  response indicates whether src is the side
+// that responds.
+func (flow *flow) copy(dst io.Writer, src io.Reader, response bool) {
+	buf := make([]byte, PIPE_BUFFER_SIZE)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			flow.entry.relayed(n, response)
+			release := shaper.acquire(flow.record(n))
+			timer := time.AfterFunc(MAX_WRITE_HOLD, release)
+			_, writeErr := dst.Write(buf[:n])
+			timer.Stop()
+			release()
+			if writeErr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// acquire() waits for a turn for a flow of the given class, returning the
+// function that gives it up again (which may safely be called more than once).
+func (s *scheduler) acquire(class int) func() {
+	var once sync.Once
+	release := func() { once.Do(s.release) }
+	s.mutex.Lock()
+	if s.inFlight < MAX_WRITES_IN_FLIGHT && len(s.waiting[CLASS_INTERACTIVE]) == 0 && len(s.waiting[CLASS_BULK]) == 0 {
+		s.inFlight += 1
+		s.mutex.Unlock()
+		return release
+	}
+	turn := make(chan bool)
+	s.waiting[class] = append(s.waiting[class], turn)
+	s.mutex.Unlock()
+	<-turn
+	return release
+}
+
+// release() passes a turn on to the next waiting writer, if any.
+func (s *scheduler) release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	interactive, bulk := s.waiting[CLASS_INTERACTIVE], s.waiting[CLASS_BULK]
+	if len(interactive) > 0 && (s.interactiveTurns < INTERACTIVE_WEIGHT || len(bulk) == 0) {
+		s.interactiveTurns += 1
+		s.waiting[CLASS_INTERACTIVE] = interactive[1:]
+		close(interactive[0])
+	} else if len(bulk) > 0 {
+		s.interactiveTurns = 0
+		s.waiting[CLASS_BULK] = bulk[1:]
+		close(bulk[0])
+	} else {
+		s.inFlight -= 1
+	}
+}
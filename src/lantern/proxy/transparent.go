@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"lantern/config"
+	"lantern/keys"
+	"lantern/telemetry"
+	"lantern/util"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+/*
+Transparent proxying lets lantern run on a router (or any other box that
+traffic passes through) and proxy connections without configuring the clients
+at all.  The firewall redirects outgoing TCP connections to
+config.TransparentProxyAddress(), for example with iptables:
+
+    iptables -t nat -A PREROUTING -i br-lan -p tcp -j REDIRECT --to-ports 8081
+
+or with TPROXY, in which case the listener is made transparent (IP_TRANSPARENT)
+so that it can accept connections for any destination:
+
+    iptables -t mangle -A PREROUTING -i br-lan -p tcp -j TPROXY --on-port 8081 --tproxy-mark 1
+
+We recover the original destination of every redirected connection (see
+originalDestination()) and relay it through our upstream proxy like a CONNECT
+from the browser would be, so redirected connections take the same path as
+everything else.  Recovering the original destination is only supported on
+Linux so far, macOS pf redirection would need its NAT state lookup (DIOCNATLOOK).
+*/
+
+func init() {
+	if address := config.TransparentProxyAddress(); address != "" && config.Runs(config.SUBSYSTEM_LOCAL_PROXY) {
+		util.Go("transparent proxy", func() error {
+			return runTransparent(address)
+		})
+	}
+}
+
+// runTransparent() accepts redirected connections at the given address until
+// it fails.
+func runTransparent(address string) error {
+	log.Printf("About to start transparent proxy at: %s", address)
+	listener, err := listenTransparent(address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go handleTransparentConn(conn)
+	}
+}
+
+/*
+handleTransparentConn() relays a redirected connection to its original
+destination through our upstream proxy, or directly if we don't get access
+through peers.
+*/
+func handleTransparentConn(connIn net.Conn) {
+	destination, err := originalDestination(connIn)
+	if err != nil {
+		log.Printf("Unable to determine original destination of %s: %s", connIn.RemoteAddr(), err)
+		connIn.Close()
+		return
+	}
+	var connOut net.Conn
+	if localGet.Enabled() {
+		connOut, err = connectUpstream(destination)
+	} else {
+		connOut, err = net.DialTimeout("tcp", destination, DIRECT_TIMEOUT)
+	}
+	if err != nil {
+		log.Printf("Unable to relay %s to %s: %s", connIn.RemoteAddr(), destination, err)
+		connIn.Close()
+		return
+	}
+	pipe(connIn, connOut, newFlow(&http.Request{Method: "CONNECT", Host: destination}))
+}
+
+/*
+connectUpstream() has our upstream proxy CONNECT us to the given destination,
+returning the tunnel.  Unlike with a CONNECT from the browser, the client (for
+example a redirected one) doesn't expect the CONNECT response, so we consume it
+here.
+*/
+func connectUpstream(destination string) (net.Conn, error) {
+	upstreamProxy, err := selectUpstream()
+	if err != nil {
+		return nil, err
+	}
+	if keys.CertificateState() == keys.CERT_EXPIRED {
+		return nil, fmt.Errorf("Our certificate has expired")
+	}
+
+	session := telemetry.Sample()
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Host: destination},
+		Host:   destination,
+		Header: make(http.Header),
+	}
+	if transport := multiplexer(upstreamProxy); transport != nil {
+		stream, upstreamResp, err := connectMultiplexed(req, upstreamProxy, transport)
+		if err != nil {
+			return nil, err
+		}
+		if stream == nil {
+			upstreamResp.Body.Close()
+			return nil, fmt.Errorf("Upstream proxy refused to CONNECT: %s", upstreamResp.Status)
+		}
+		return session.Watch(stream), nil
+	}
+	start := time.Now()
+	connOut, err := dialUpstream(upstreamProxy)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open socket to upstream proxy: %s", err)
+	}
+	session.Handshake(tlsTransport(connOut), time.Since(start))
+	if err := authenticateUpstream(upstreamProxy, connOut, req); err != nil {
+		connOut.Close()
+		return nil, fmt.Errorf("Unable to authenticate upstream proxy: %s", err)
+	}
+	if err := req.Write(connOut); err != nil {
+		connOut.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(timeFirstByte(upstreamProxy, connOut))
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		connOut.Close()
+		return nil, fmt.Errorf("Unable to read CONNECT response: %s", err)
+	}
+	if resp.StatusCode != 200 {
+		connOut.Close()
+		return nil, fmt.Errorf("Upstream proxy refused to CONNECT: %s", resp.Status)
+	}
+	// The destination may already have sent something that the reader
+	// buffered
+	return session.Watch(&bufferedConn{Conn: connOut, reader: reader}), nil
+}
+
+// bufferedConn is a net.Conn whose reads go through a bufio.Reader that may
+// have buffered some of its data already.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
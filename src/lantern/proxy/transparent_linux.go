@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// SO_ORIGINAL_DST is the socket option with which netfilter reveals the
+// original destination of a REDIRECTed connection (see linux/netfilter_ipv4.h).
+const SO_ORIGINAL_DST = 80
+
+/*
+listenTransparent() listens at the given address with IP_TRANSPARENT set, so
+that TPROXY can hand us connections for any destination.  Setting it requires
+CAP_NET_ADMIN, without which we still accept REDIRECTed connections.
+*/
+func listenTransparent(address string) (net.Listener, error) {
+	listenConfig := &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				if err := syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+					log.Printf("Unable to make transparent proxy listener transparent, only REDIRECT will work: %s", err)
+				}
+			})
+		},
+	}
+	return listenConfig.Listen(context.Background(), "tcp", address)
+}
+
+/*
+originalDestination() returns the host:port to which the given redirected
+connection was originally headed.  For REDIRECTed connections, netfilter tells
+us with SO_ORIGINAL_DST (IPv4 only).  For TPROXY, the connection's local
+address already is the original destination.
+*/
+func originalDestination(conn net.Conn) (string, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", fmt.Errorf("Not a TCP connection")
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var destination string
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		// sockaddr_in fits into the 16 bytes of an IPv6Mreq
+		var addr *syscall.IPv6Mreq
+		addr, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, SO_ORIGINAL_DST)
+		if sockErr == nil {
+			raw := addr.Multiaddr
+			port := int(raw[2])<<8 | int(raw[3])
+			destination = net.JoinHostPort(net.IP(raw[4:8]).String(), strconv.Itoa(port))
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if sockErr != nil {
+		// Not REDIRECTed, so it's TPROXY (or IPv6)
+		return conn.LocalAddr().String(), nil
+	}
+	if destination == conn.LocalAddr().String() {
+		return "", fmt.Errorf("Connection wasn't redirected")
+	}
+	return destination, nil
+}
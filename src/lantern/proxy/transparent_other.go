@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// listenTransparent() listens at the given address.
+func listenTransparent(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+// originalDestination() isn't supported on this platform yet.
+func originalDestination(conn net.Conn) (string, error) {
+	return "", fmt.Errorf("Transparent proxying isn't supported on %s", runtime.GOOS)
+}
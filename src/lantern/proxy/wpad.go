@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"lantern/config"
+	"lantern/ui"
+	"lantern/util"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/*
+WPAD (Web Proxy Auto-Discovery) gets browsers configured to use our local
+proxy without touching them, which is handy for kiosk-style deployments where
+lantern serves a whole LAN.
+
+Browsers with automatic proxy detection fetch http://wpad.<domain>/wpad.dat, a
+proxy auto-config (PAC) file that sends everything through our local proxy.  We
+serve it at:
+
+- http://[config.UIAddress()]/wpad.dat, for the browser on this machine
+- http://[config.WPADAddress()]/wpad.dat, for browsers on the LAN (this has to
+  be on port 80, which is where browsers look for it)
+
+For browsers on the LAN to find us, the wpad host has to resolve to this
+machine.  Either point DHCP option 252 of the LAN's DHCP server at
+http://<our LAN IP>/wpad.dat, or have the LAN's DNS server forward lookups for
+the wpad host to config.WPADDNSAddress(), where we answer them with our LAN IP.
+This is a minimal responder for wpad only, everything else is refused.
+
+For any of this to work, the local proxy has to listen on an address that's
+reachable from the LAN (see config.LocalProxyAddress()).
+*/
+const (
+	WPAD_PATH     = "/wpad.dat"                         // where browsers look for the PAC file
+	PAC_MIME_TYPE = "application/x-ns-proxy-autoconfig" // the content type of PAC files
+	WPAD_TTL      = 300                                 // seconds for which DNS answers may be cached
+
+	dnsTypeA       = 1
+	dnsClassIN     = 1
+	dnsRcodeRefuse = 5
+)
+
+// pacTemplate is the PAC file, which sends everything but local hosts through
+// the proxy at the given host:port.
+const pacTemplate = `function FindProxyForURL(url, host) {
+	if (isPlainHostName(host) || host == "localhost" || host == "127.0.0.1") {
+		return "DIRECT";
+	}
+	return "PROXY %s";
+}
+`
+
+func init() {
+	ui.HandleFunc(WPAD_PATH, wpadHandler)
+	if !config.Runs(config.SUBSYSTEM_LOCAL_PROXY) {
+		// Without a local proxy, there's nothing to point browsers at
+		return
+	}
+	if address := config.WPADAddress(); address != "" {
+		util.Go("wpad server", func() error {
+			log.Printf("About to serve %s at: %s", WPAD_PATH, address)
+			mux := http.NewServeMux()
+			mux.HandleFunc(WPAD_PATH, wpadHandler)
+			return http.ListenAndServe(address, mux)
+		})
+	}
+	if address := config.WPADDNSAddress(); address != "" {
+		util.Go("wpad dns responder", func() error {
+			return answerWPADLookups(address)
+		})
+	}
+}
+
+// wpadHandler() serves the PAC file.
+func wpadHandler(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", PAC_MIME_TYPE)
+	fmt.Fprintf(resp, pacTemplate, pacProxyAddress(req))
+}
+
+/*
+pacProxyAddress() returns the host:port of our local proxy as seen by the
+browser that made the given request.  If the local proxy listens on all
+interfaces, that's the IP on which the request reached us.
+*/
+func pacProxyAddress(req *http.Request) string {
+	host, port, err := net.SplitHostPort(config.LocalProxyAddress())
+	if err != nil {
+		return config.LocalProxyAddress()
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		if local, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			if localHost, _, err := net.SplitHostPort(local.String()); err == nil {
+				host = localHost
+			}
+		}
+	} else if ip != nil && ip.IsLoopback() && !isLoopbackRequest(req) {
+		log.Printf("Serving %s to %s, but the local proxy only listens on %s", WPAD_PATH, req.RemoteAddr, host)
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// isLoopbackRequest() indicates whether or not the given request came from
+// this machine.
+func isLoopbackRequest(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	ip := net.ParseIP(host)
+	return err == nil && ip != nil && ip.IsLoopback()
+}
+
+/*
+lanIP() returns the IPv4 address at which browsers on the LAN reach us, which
+is the IP of config.LocalProxyAddress() if it's a specific one, or otherwise
+the first private IPv4 address of our network interfaces.
+*/
+func lanIP() net.IP {
+	if host, _, err := net.SplitHostPort(config.LocalProxyAddress()); err == nil {
+		if ip := net.ParseIP(host).To4(); ip != nil && !ip.IsLoopback() && !ip.IsUnspecified() {
+			return ip
+		}
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && ipNet.IP.IsPrivate() {
+			return ipNet.IP.To4()
+		}
+	}
+	return nil
+}
+
+// answerWPADLookups() answers DNS lookups for the wpad host at the given
+// address until it fails.
+func answerWPADLookups(address string) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Printf("About to answer wpad lookups at: %s", address)
+	buf := make([]byte, 512)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if answer := wpadAnswer(buf[:n]); answer != nil {
+			conn.WriteTo(answer, from)
+		}
+	}
+}
+
+/*
+wpadAnswer() builds the response to the given DNS query, which answers an A
+query for a name starting with the label wpad with lanIP(), has no answers for
+other queries about such names and refuses queries for any other name.  Returns
+nil if the query is malformed.
+*/
+func wpadAnswer(query []byte) []byte {
+	question := parseQuestion(query)
+	if question == nil {
+		return nil
+	}
+	response := make([]byte, 12, 512)
+	copy(response, query[:4])
+	response[2] = 0x84 | query[2]&0x79 // response, authoritative, opcode and RD of the query
+	response[3] = 0
+	binary.BigEndian.PutUint16(response[4:], 1)
+	response = append(response, query[12:question.end]...)
+
+	ip := lanIP()
+	if len(question.labels) == 0 || !strings.EqualFold(question.labels[0], "wpad") || ip == nil {
+		response[3] = dnsRcodeRefuse
+		return response
+	}
+	if question.qtype == dnsTypeA && question.qclass == dnsClassIN {
+		binary.BigEndian.PutUint16(response[6:], 1)
+		answer := make([]byte, 16)
+		binary.BigEndian.PutUint16(answer[0:], 0xC00C) // pointer to the name in the question
+		binary.BigEndian.PutUint16(answer[2:], dnsTypeA)
+		binary.BigEndian.PutUint16(answer[4:], dnsClassIN)
+		binary.BigEndian.PutUint32(answer[6:], WPAD_TTL)
+		binary.BigEndian.PutUint16(answer[10:], net.IPv4len)
+		copy(answer[12:], ip)
+		response = append(response, answer...)
+	}
+	return response
+}
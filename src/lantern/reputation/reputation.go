@@ -0,0 +1,579 @@
+/*
+Package reputation lets nodes report peers that misbehave to their parent, so
+that the parents who vouch for those peers can do something about it:
+
+- exits report clients that abuse them (KIND_ABUSIVE_CLIENT), by NodeID (see
+  keys.NodeID())
+- clients report exits that don't work (KIND_BROKEN_EXIT) or that tampered with
+  content (KIND_MALICIOUS_EXIT, which the local proxy reports by itself when an
+  integrity check fails), by address and, if they saw its certificate, NodeID
+
+Reports travel up the signaling tree (TYPE_REPUTATION_REPORT), signed with the
+reporter's private key and carrying its certificate, and parents only accept
+them from certificates that they issued themselves (see
+keys.VerifyFromChild()), just like usage reports.  A node reports the same peer
+for the same thing at most once per REPORT_COOLDOWN, and a parent accepts at
+most MAX_REPORTS_PER_CHILD reports from each child per RATE_WINDOW.
+
+Parents aggregate reports into a Standing per peer, which counts how many
+distinct nodes reported the peer within REPORT_WINDOW, so that a single
+reporter can't ruin anyone's reputation.  Once PENALIZE_AT nodes reported a
+peer, the parent penalizes it if it can:
+
+- clients that we issued a certificate to are blocklisted by email, which our
+  subtree's exits pick up (see blocklist.Publish())
+- exits among the fallback proxies that we assigned to our children are
+  dropped from them (see parentconfig.Publish())
+
+Reports about peers that we can't penalize are passed on to our parent, with the
+original reporter vouched for by us.  Only master nodes vouch for others, the
+reports of user nodes always count as their own.
+
+Operators see the standings at http://[config.UIAddress()]/admin/reputation
+and POST there with the form value action to act on them:
+
+- report - reports the peer with the form values kind, node, peer (address of
+  an exit) and reason to our parent
+- penalize - penalizes the peer with the form values kind and subject (the
+  NodeID or, for exits without one, the address) right away
+- pardon - lifts the penalty and forgets the reports of that peer
+- revoke - revokes the certificates that we issued to that peer (see
+  keys.Revoke())
+*/
+package reputation
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"lantern/audit"
+	"lantern/blocklist"
+	"lantern/keys"
+	"lantern/parentconfig"
+	"lantern/signaling"
+	"lantern/ui"
+	"lantern/util"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	KIND_ABUSIVE_CLIENT = "abusive-client" // a client abused an exit
+	KIND_BROKEN_EXIT    = "broken-exit"    // an exit didn't relay traffic
+	KIND_MALICIOUS_EXIT = "malicious-exit" // an exit tampered with content
+
+	REPORT_COOLDOWN       = 1 * time.Hour      // how long we wait before reporting the same peer for the same thing again
+	REPORT_WINDOW         = 7 * 24 * time.Hour // how long reports count towards a peer's standing
+	PENALIZE_AT           = 3                  // how many distinct reporters within REPORT_WINDOW get a peer penalized
+	RATE_WINDOW           = 1 * time.Hour      // the window in which we limit the reports from each child
+	MAX_REPORTS_PER_CHILD = 30                 // the most reports that we accept from a child per RATE_WINDOW
+	MAX_REASON_LENGTH     = 256                // the longest reason that we keep
+	MAX_REASONS_KEPT      = 5                  // how many of the latest reasons we keep per peer
+)
+
+// Report is a report of a misbehaving peer.
+type Report struct {
+	Kind     string    // what the peer is reported for, one of the KIND_ constants
+	NodeID   string    // the NodeID of the peer, may be empty for exits whose certificate wasn't seen
+	Address  string    // the host:port of a reported exit, empty for clients
+	Reason   string    // what the reporter observed
+	Reporter string    // the NodeID of the node that made the report
+	At       time.Time // when the report was made
+}
+
+// Standing aggregates the reports about a peer.
+type Standing struct {
+	Kind      string               // what the peer was reported for
+	NodeID    string               // the NodeID of the peer, if known
+	Address   string               // the host:port of an exit, if known
+	Reporters map[string]time.Time // when each reporter last reported the peer, by NodeID
+	Reasons   []string             // the latest reasons given, newest last
+	Penalized bool                 // whether we penalized the peer
+	Revoked   bool                 // whether we revoked the peer's certificates
+	Forwarded bool                 // whether we passed reports about the peer on to our parent
+}
+
+// signedReport is a Report as it travels over the signaling channel.
+type signedReport struct {
+	Report      []byte // the JSON encoded Report
+	Signature   []byte // the signature of Report by the sender's private key
+	Certificate []byte // the DER encoded certificate of the sender
+}
+
+var (
+	lastSent        = make(map[string]time.Time)   // when we last reported or forwarded a report, by subject and reporter
+	accepted        = make(map[string][]time.Time) // when we accepted the recent reports of each child, by NodeID
+	standings       = make(map[string]*Standing)   // the standings of reported peers, by kind and subject
+	reputationMutex sync.Mutex                     // used to synchronize access to all of the above
+)
+
+func init() {
+	ui.HandleFunc("/admin/reputation", reputationHandler)
+	go receive()
+}
+
+// ReportClient() reports the client with the given NodeID as abusive for the
+// given reason.
+func ReportClient(nodeID string, reason string) error {
+	return report(&Report{Kind: KIND_ABUSIVE_CLIENT, NodeID: nodeID, Reason: reason})
+}
+
+/*
+ReportExit() reports the exit at the given address, which presented the given
+certificate (nil if we don't have it), for the given kind of misbehavior and
+reason.
+*/
+func ReportExit(address string, cert *x509.Certificate, kind string, reason string) error {
+	r := &Report{Kind: kind, Address: address, Reason: reason}
+	if cert != nil {
+		r.NodeID = keys.NodeIDOf(cert)
+	}
+	return report(r)
+}
+
+// Standings() returns the standings of the peers that were reported to us,
+// most reported first.
+func Standings() []Standing {
+	reputationMutex.Lock()
+	defer reputationMutex.Unlock()
+	expire()
+	list := make([]Standing, 0, len(standings))
+	for _, standing := range standings {
+		list = append(list, standing.copy())
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return len(list[i].Reporters) > len(list[j].Reporters)
+	})
+	return list
+}
+
+// subject() identifies the peer that the report is about.
+func (r *Report) subject() string {
+	if r.NodeID != "" {
+		return r.NodeID
+	}
+	return r.Address
+}
+
+// key() identifies the standing that the report counts towards.
+func (r *Report) key() string {
+	return standingKey(r.Kind, r.subject())
+}
+
+func standingKey(kind string, subject string) string {
+	return kind + " " + subject
+}
+
+// validate() checks that the report is about somebody for something that we
+// know, and shortens overly long reasons.
+func (r *Report) validate() error {
+	switch r.Kind {
+	case KIND_ABUSIVE_CLIENT:
+		if r.NodeID == "" {
+			return fmt.Errorf("Clients are reported by NodeID")
+		}
+	case KIND_BROKEN_EXIT, KIND_MALICIOUS_EXIT:
+		if r.subject() == "" {
+			return fmt.Errorf("Exits are reported by address or NodeID")
+		}
+	default:
+		return fmt.Errorf("Unknown kind of report: %s", r.Kind)
+	}
+	if len(r.Reason) > MAX_REASON_LENGTH {
+		r.Reason = r.Reason[:MAX_REASON_LENGTH]
+	}
+	return nil
+}
+
+func (standing *Standing) copy() Standing {
+	copied := *standing
+	copied.Reporters = make(map[string]time.Time, len(standing.Reporters))
+	for reporter, at := range standing.Reporters {
+		copied.Reporters[reporter] = at
+	}
+	copied.Reasons = append([]string{}, standing.Reasons...)
+	return copied
+}
+
+// report() reports the given peer to our parent, unless we did so within
+// REPORT_COOLDOWN.
+func report(r *Report) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	r.Reporter = keys.NodeID()
+	r.At = time.Now()
+	if !due(r) {
+		return nil
+	}
+	log.Printf("Reporting %s %s: %s", r.Kind, r.subject(), r.Reason)
+	return send(r)
+}
+
+// due() indicates whether the given report is due to be sent, and if so,
+// remembers that it was sent.
+func due(r *Report) bool {
+	reputationMutex.Lock()
+	defer reputationMutex.Unlock()
+	sentKey := r.key() + " " + r.Reporter
+	if time.Since(lastSent[sentKey]) < REPORT_COOLDOWN {
+		return false
+	}
+	lastSent[sentKey] = time.Now()
+	return true
+}
+
+// send() signs the given report and sends it to our parent.
+func send(r *Report) error {
+	cert, _ := keys.Certificate()
+	if cert == nil {
+		return fmt.Errorf("No certificate to sign the report with yet")
+	}
+	reportBytes, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	signature, err := keys.Sign(reportBytes)
+	if err != nil {
+		return fmt.Errorf("Unable to sign report: %s", err)
+	}
+	data, err := json.Marshal(&signedReport{Report: reportBytes, Signature: signature, Certificate: cert.Raw})
+	if err != nil {
+		return err
+	}
+	signaling.Send(signaling.Message{Type: signaling.TYPE_REPUTATION_REPORT, Data: string(data)})
+	return nil
+}
+
+// receive() listens for reputation reports from our children.
+func receive() {
+	messages := make(chan signaling.Message)
+	signaling.RecvMatching(messages, signaling.Filter{
+		Types: []signaling.MessageType{signaling.TYPE_REPUTATION_REPORT},
+	})
+	// Restarts keep receiving on the same channel, which stays registered
+	util.Supervise("reputation receiver", func() error {
+		for msg := range messages {
+			if msg.Type == signaling.TYPE_REPUTATION_REPORT {
+				if err := accept(msg.Data); err != nil {
+					log.Printf("Unable to accept reputation report: %s", err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+/*
+accept() verifies a signed report from one of our children and counts it
+towards the standing of the reported peer, penalizing the peer or passing the
+report on as necessary.
+*/
+func accept(data string) error {
+	signed := &signedReport{}
+	if err := json.Unmarshal([]byte(data), signed); err != nil {
+		return err
+	}
+	childCert, err := keys.VerifyFromChild(signed.Report, signed.Signature, signed.Certificate)
+	if err != nil {
+		return fmt.Errorf("Signature didn't verify: %s", err)
+	}
+	child := keys.NodeIDOf(childCert)
+	if !allow(child) {
+		return fmt.Errorf("%s sent more than %d reports within %s", child, MAX_REPORTS_PER_CHILD, RATE_WINDOW)
+	}
+	r := &Report{}
+	if err := json.Unmarshal(signed.Report, r); err != nil {
+		return err
+	}
+	if err := r.validate(); err != nil {
+		return err
+	}
+	if r.Reporter == "" || !keys.IsMaster(childCert) {
+		// Only masters vouch for the reports that they pass on
+		r.Reporter = child
+	}
+
+	email := issuedEmail(r.NodeID)
+	forward := email == "" && !isFallbackProxy(r.Address)
+	if standing := count(r, forward); standing != nil {
+		return penalize(standing, email)
+	}
+	if forward && due(r) {
+		// Whoever can do something about the peer is further up
+		return send(r)
+	}
+	return nil
+}
+
+// allow() indicates whether we accept another report from the given child
+// within RATE_WINDOW, counting it if so.
+func allow(child string) bool {
+	reputationMutex.Lock()
+	defer reputationMutex.Unlock()
+	recent := make([]time.Time, 0, MAX_REPORTS_PER_CHILD)
+	for _, at := range accepted[child] {
+		if time.Since(at) < RATE_WINDOW {
+			recent = append(recent, at)
+		}
+	}
+	if len(recent) >= MAX_REPORTS_PER_CHILD {
+		accepted[child] = recent
+		return false
+	}
+	accepted[child] = append(recent, time.Now())
+	return true
+}
+
+// standingFor() returns the standing that the given report counts towards,
+// creating it if necessary.  reputationMutex must be held.
+func standingFor(r *Report) *Standing {
+	standing, found := standings[r.key()]
+	if !found {
+		standing = &Standing{Kind: r.Kind, Reporters: make(map[string]time.Time), Reasons: make([]string, 0)}
+		standings[r.key()] = standing
+	}
+	if r.NodeID != "" {
+		standing.NodeID = r.NodeID
+	}
+	if r.Address != "" {
+		standing.Address = r.Address
+	}
+	return standing
+}
+
+/*
+count() counts the given report towards the standing of the reported peer and
+returns a copy of the standing if the peer is due to be penalized, nil
+otherwise.  Peers whose reports we forward are never due.
+*/
+func count(r *Report, forward bool) *Standing {
+	reputationMutex.Lock()
+	defer reputationMutex.Unlock()
+	standing := standingFor(r)
+	standing.Reporters[r.Reporter] = time.Now()
+	if r.Reason != "" {
+		standing.Reasons = append(standing.Reasons, r.Reason)
+		if len(standing.Reasons) > MAX_REASONS_KEPT {
+			standing.Reasons = standing.Reasons[len(standing.Reasons)-MAX_REASONS_KEPT:]
+		}
+	}
+	expire()
+	if forward {
+		standing.Forwarded = true
+		return nil
+	}
+	if standing.Penalized || len(standing.Reporters) < PENALIZE_AT {
+		return nil
+	}
+	standing.Penalized = true
+	copied := standing.copy()
+	return &copied
+}
+
+// expire() forgets reports older than REPORT_WINDOW, and the standings of
+// peers that weren't penalized and have no reports left.  reputationMutex must
+// be held.
+func expire() {
+	for key, standing := range standings {
+		for reporter, at := range standing.Reporters {
+			if time.Since(at) > REPORT_WINDOW {
+				delete(standing.Reporters, reporter)
+			}
+		}
+		if len(standing.Reporters) == 0 && !standing.Penalized && !standing.Revoked {
+			delete(standings, key)
+		}
+	}
+	for sentKey, at := range lastSent {
+		if time.Since(at) > REPORT_COOLDOWN {
+			delete(lastSent, sentKey)
+		}
+	}
+}
+
+// issuedEmail() returns the email of the active device with the given NodeID
+// that we issued a certificate to, or "" if there's none.
+func issuedEmail(nodeID string) string {
+	if nodeID == "" {
+		return ""
+	}
+	for _, device := range keys.Devices().Active {
+		if device.NodeID == nodeID {
+			return device.Email
+		}
+	}
+	return ""
+}
+
+// isFallbackProxy() indicates whether the given address is among the fallback
+// proxies that we assigned to our children.
+func isFallbackProxy(address string) bool {
+	if address == "" {
+		return false
+	}
+	for _, proxy := range parentconfig.FallbackProxies() {
+		if proxy == address {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+penalize() penalizes the peer with the given standing, whose certificate we
+issued for the given email ("" if we didn't), as far as we can.
+*/
+func penalize(standing *Standing, email string) error {
+	log.Printf("Penalizing %s %s after reports from %d nodes", standing.Kind, standing.subject(), len(standing.Reporters))
+	audit.Recordf(audit.EVENT_PEER_PENALIZED, standing.subject(), "penalized as %s after reports from %d nodes", standing.Kind, len(standing.Reporters))
+	if standing.Kind == KIND_ABUSIVE_CLIENT && email != "" {
+		if err := blocklist.Publish(blocklist.Delta{Added: []string{email}}); err != nil {
+			return err
+		}
+	}
+	if standing.Kind != KIND_ABUSIVE_CLIENT && isFallbackProxy(standing.Address) {
+		fragment := *parentconfig.Current()
+		fragment.Issued = time.Time{}
+		fragment.FallbackProxies = make([]string, 0, len(fragment.FallbackProxies))
+		for _, proxy := range parentconfig.FallbackProxies() {
+			if proxy != standing.Address {
+				fragment.FallbackProxies = append(fragment.FallbackProxies, proxy)
+			}
+		}
+		if err := parentconfig.Publish(fragment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (standing *Standing) subject() string {
+	if standing.NodeID != "" {
+		return standing.NodeID
+	}
+	return standing.Address
+}
+
+// lookup() returns the standing of the peer with the given kind and subject.
+func lookup(kind string, subject string) (*Standing, error) {
+	reputationMutex.Lock()
+	defer reputationMutex.Unlock()
+	standing, found := standings[standingKey(kind, subject)]
+	if !found {
+		return nil, fmt.Errorf("No reports of %s as %s", subject, kind)
+	}
+	copied := standing.copy()
+	return &copied, nil
+}
+
+// Penalize() penalizes the peer with the given kind and subject right away.
+func Penalize(kind string, subject string) error {
+	standing, err := lookup(kind, subject)
+	if err != nil {
+		return err
+	}
+	if err := penalize(standing, issuedEmail(standing.NodeID)); err != nil {
+		return err
+	}
+	reputationMutex.Lock()
+	defer reputationMutex.Unlock()
+	if current, found := standings[standingKey(kind, subject)]; found {
+		current.Penalized = true
+	}
+	return nil
+}
+
+/*
+Pardon() forgets the reports about the peer with the given kind and subject
+and unblocks it if it's a client that we blocklisted.  Exits that were dropped
+from our fallback proxies have to be added back by the operator.
+*/
+func Pardon(kind string, subject string) error {
+	standing, err := lookup(kind, subject)
+	if err != nil {
+		return err
+	}
+	if standing.Penalized && standing.Kind == KIND_ABUSIVE_CLIENT {
+		if email := issuedEmail(standing.NodeID); email != "" {
+			if err := blocklist.Publish(blocklist.Delta{Removed: []string{email}}); err != nil {
+				return err
+			}
+		}
+	}
+	audit.Recordf(audit.EVENT_PEER_PENALIZED, subject, "pardoned as %s", kind)
+	reputationMutex.Lock()
+	defer reputationMutex.Unlock()
+	delete(standings, standingKey(kind, subject))
+	return nil
+}
+
+// Revoke() revokes the certificates that we issued to the peer with the given
+// kind and subject.
+func Revoke(kind string, subject string) error {
+	standing, err := lookup(kind, subject)
+	if err != nil {
+		return err
+	}
+	revoked := 0
+	for _, device := range keys.Devices().Active {
+		if standing.NodeID != "" && device.NodeID == standing.NodeID {
+			if err := keys.Revoke(device.Serial); err != nil {
+				return err
+			}
+			revoked += 1
+		}
+	}
+	if revoked == 0 {
+		return fmt.Errorf("We didn't issue a certificate to %s", subject)
+	}
+	reputationMutex.Lock()
+	defer reputationMutex.Unlock()
+	if current, found := standings[standingKey(kind, subject)]; found {
+		current.Revoked = true
+	}
+	return nil
+}
+
+/*
+reputationHandler() lists the standings on GET and, on POST, reports, penalizes,
+pardons or revokes depending on the form value action.
+*/
+func reputationHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		kind := req.FormValue("kind")
+		subject := req.FormValue("subject")
+		var err error
+		switch req.FormValue("action") {
+		case "report":
+			if kind == KIND_ABUSIVE_CLIENT {
+				err = ReportClient(req.FormValue("node"), req.FormValue("reason"))
+			} else {
+				err = report(&Report{Kind: kind, NodeID: req.FormValue("node"), Address: req.FormValue("peer"), Reason: req.FormValue("reason")})
+			}
+		case "penalize":
+			err = Penalize(kind, subject)
+		case "pardon":
+			err = Pardon(kind, subject)
+		case "revoke":
+			err = Revoke(kind, subject)
+		default:
+			err = fmt.Errorf("Unknown action: %s", req.FormValue("action"))
+		}
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+	}
+	if standingsJson, err := json.MarshalIndent(Standings(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(standingsJson)
+	}
+}
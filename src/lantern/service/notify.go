@@ -0,0 +1,34 @@
+package service
+
+import (
+	"net"
+	"os"
+)
+
+/*
+Ready() tells the service manager that lantern is up, using the sd_notify
+protocol (a READY=1 datagram to the socket in $NOTIFY_SOCKET).  It does nothing
+when we're not running under a service manager that asked for notifications.
+*/
+func Ready() error {
+	return notify("READY=1")
+}
+
+// notify() sends the given state to the socket in $NOTIFY_SOCKET, if set.
+func notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// Abstract socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
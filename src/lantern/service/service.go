@@ -0,0 +1,92 @@
+/*
+Package service lets lantern run unattended as a system service on servers and
+desktops: as a systemd unit on Linux, a launchd agent on OS X and a Windows
+service on Windows.
+
+Package config runs the service command through Run() before it starts a
+node (see config/commands.go):
+
+	lantern [flags] service install|uninstall|start|stop [BaseDir]
+
+- install - registers lantern to start automatically, using the current
+  executable and [config.ConfigDir]
+- uninstall - stops lantern and removes the registration
+- start - starts the registered service
+- stop - stops the registered service
+
+Since config imports it, this package only imports the standard library.
+
+Under systemd, the unit is of Type=notify and lantern tells systemd that it's
+ready with Ready() once its proxies are listening (sd_notify).
+*/
+package service
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+const (
+	SERVICE_NAME        = "lantern"                    // the name under which lantern is registered
+	SERVICE_DESCRIPTION = "Lantern peer-to-peer proxy" // human readable description of the service
+)
+
+const (
+	COMMAND_INSTALL   = "install"   // registers the service
+	COMMAND_UNINSTALL = "uninstall" // removes the service
+	COMMAND_START     = "start"     // starts the service
+	COMMAND_STOP      = "stop"      // stops the service
+)
+
+// IsCommand() indicates whether the given argument is a service command.
+func IsCommand(arg string) bool {
+	switch arg {
+	case COMMAND_INSTALL, COMMAND_UNINSTALL, COMMAND_START, COMMAND_STOP:
+		return true
+	}
+	return false
+}
+
+/*
+Run() runs the given service command (one of the COMMAND_ constants) for the
+node with the given [config.ConfigDir].
+*/
+func Run(command string, configDir string) error {
+	switch command {
+	case COMMAND_INSTALL:
+		return install(configDir)
+	case COMMAND_UNINSTALL:
+		return uninstall()
+	case COMMAND_START:
+		return start()
+	case COMMAND_STOP:
+		return stop()
+	default:
+		return fmt.Errorf("Unknown service command: %s", command)
+	}
+}
+
+// command() returns the executable and arguments with which the service runs
+// lantern with the given [config.ConfigDir].
+func command(configDir string) (string, []string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to determine executable: %s", err)
+	}
+	configDir, err = filepath.Abs(configDir)
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to determine config directory: %s", err)
+	}
+	return executable, []string{configDir}, nil
+}
+
+// run() runs the given system command, including its output in the error if it
+// fails.
+func run(name string, args ...string) error {
+	if output, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %s: %s", name, err, output)
+	}
+	return nil
+}
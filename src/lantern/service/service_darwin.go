@@ -0,0 +1,86 @@
+package service
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// LAUNCHD_LABEL is the label of lantern's launchd agent.
+const LAUNCHD_LABEL = "org.getlantern." + SERVICE_NAME
+
+const plistTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+</dict>
+</plist>
+`
+
+// plistFile() returns where lantern's launchd agent is installed.
+func plistFile() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", LAUNCHD_LABEL+".plist"), nil
+}
+
+// install() installs and loads a launchd agent for lantern with the given
+// [config.ConfigDir].
+func install(configDir string) error {
+	executable, args, err := command(configDir)
+	if err != nil {
+		return err
+	}
+	var programArguments bytes.Buffer
+	for _, arg := range append([]string{executable}, args...) {
+		programArguments.WriteString("\t\t<string>")
+		xml.EscapeText(&programArguments, []byte(arg))
+		programArguments.WriteString("</string>\n")
+	}
+	plist, err := plistFile()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(plist), 0755); err != nil {
+		return err
+	}
+	content := fmt.Sprintf(plistTemplate, LAUNCHD_LABEL, programArguments.String())
+	if err := ioutil.WriteFile(plist, []byte(content), 0644); err != nil {
+		return fmt.Errorf("Unable to write %s: %s", plist, err)
+	}
+	return run("launchctl", "load", "-w", plist)
+}
+
+// uninstall() unloads and removes lantern's launchd agent.
+func uninstall() error {
+	plist, err := plistFile()
+	if err != nil {
+		return err
+	}
+	if err := run("launchctl", "unload", "-w", plist); err != nil {
+		return err
+	}
+	return os.Remove(plist)
+}
+
+func start() error {
+	return run("launchctl", "start", LAUNCHD_LABEL)
+}
+
+func stop() error {
+	return run("launchctl", "stop", LAUNCHD_LABEL)
+}
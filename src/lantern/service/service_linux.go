@@ -0,0 +1,63 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// UNIT_FILE is where the systemd unit is installed.
+const UNIT_FILE = "/etc/systemd/system/" + SERVICE_NAME + ".service"
+
+const unitTemplate = `[Unit]
+Description=%s
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=notify
+ExecStart=%s
+Restart=on-failure
+RestartSec=5
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// install() installs and enables a systemd unit for lantern with the given
+// [config.ConfigDir].
+func install(configDir string) error {
+	executable, args, err := command(configDir)
+	if err != nil {
+		return err
+	}
+	execStart := strings.Join(append([]string{executable}, args...), " ")
+	unit := fmt.Sprintf(unitTemplate, SERVICE_DESCRIPTION, execStart)
+	if err := ioutil.WriteFile(UNIT_FILE, []byte(unit), 0644); err != nil {
+		return fmt.Errorf("Unable to write %s: %s", UNIT_FILE, err)
+	}
+	if err := run("systemctl", "daemon-reload"); err != nil {
+		return err
+	}
+	return run("systemctl", "enable", SERVICE_NAME)
+}
+
+// uninstall() stops, disables and removes lantern's systemd unit.
+func uninstall() error {
+	if err := run("systemctl", "disable", "--now", SERVICE_NAME); err != nil {
+		return err
+	}
+	if err := os.Remove(UNIT_FILE); err != nil {
+		return fmt.Errorf("Unable to remove %s: %s", UNIT_FILE, err)
+	}
+	return run("systemctl", "daemon-reload")
+}
+
+func start() error {
+	return run("systemctl", "start", SERVICE_NAME)
+}
+
+func stop() error {
+	return run("systemctl", "stop", SERVICE_NAME)
+}
@@ -0,0 +1,25 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package service
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func install(configDir string) error {
+	return fmt.Errorf("Service mode isn't supported on %s", runtime.GOOS)
+}
+
+func uninstall() error {
+	return install("")
+}
+
+func start() error {
+	return install("")
+}
+
+func stop() error {
+	return install("")
+}
@@ -0,0 +1,40 @@
+package service
+
+import (
+	"strings"
+)
+
+// install() registers lantern with the given [config.ConfigDir] as a Windows
+// service that starts automatically.
+//
+// TODO: answer the service control manager (golang.org/x/sys/windows/svc) so
+// that it doesn't give up on starting us
+func install(configDir string) error {
+	executable, args, err := command(configDir)
+	if err != nil {
+		return err
+	}
+	quoted := make([]string, 0, len(args)+1)
+	for _, arg := range append([]string{executable}, args...) {
+		quoted = append(quoted, `"`+arg+`"`)
+	}
+	if err := run("sc.exe", "create", SERVICE_NAME, "binPath=", strings.Join(quoted, " "), "start=", "auto", "DisplayName=", SERVICE_DESCRIPTION); err != nil {
+		return err
+	}
+	return run("sc.exe", "description", SERVICE_NAME, SERVICE_DESCRIPTION)
+}
+
+// uninstall() stops lantern and removes its Windows service registration.
+func uninstall() error {
+	// Stopping fails if we're not running, which is fine
+	stop()
+	return run("sc.exe", "delete", SERVICE_NAME)
+}
+
+func start() error {
+	return run("sc.exe", "start", SERVICE_NAME)
+}
+
+func stop() error {
+	return run("sc.exe", "stop", SERVICE_NAME)
+}
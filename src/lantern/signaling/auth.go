@@ -0,0 +1,93 @@
+/*
+This file contains the logic for authorizing messages received from children
+on the basis of the client certificates they presented.
+
+  - Master nodes (presenting a master-level certificate, see keys.IsMaster())
+    may register and deregister any email address or pattern (see routes.go).
+  - User nodes may only register and deregister the email address embedded
+    (encrypted) in the CN of their certificate.
+
+Certificates count only if we issued them (see keys.VerifyChild()), since the
+listener only verifies that they chain to one of the certificates that we trust,
+which include our parent's.  The Sender of every message from a user node is
+overwritten with the identity from the certificate, and the SenderNode of every
+message with the NodeID of the certificate's key, so children can't
+impersonate anybody else.  Master nodes keep the Sender of the messages that
+they pass on from their own subtree, and messages that they originate get
+MASTER_SENDER.
+
+The one exception are certificate requests (TYPE_CERT_REQUEST), which children
+send precisely because they don't have a certificate yet.  These are accepted
+from anybody with a blank Sender, and are authenticated by whoever issues the
+certificate (see keys.IssueCertificate()).
+*/
+package signaling
+
+import (
+	"crypto/x509"
+	"fmt"
+	"lantern/keys"
+)
+
+// MASTER_SENDER is the Sender recorded for messages from master nodes.
+const MASTER_SENDER = "master"
+
+/*
+authorize() checks that the child identified by the given peer certificates is
+allowed to send msg, and sets msg.Sender and msg.SenderNode to that child's
+identity.
+*/
+func authorize(msg *Message, peerCertificates []*x509.Certificate) error {
+	if msg.Type == TYPE_CERT_REQUEST {
+		msg.Sender = ""
+		msg.SenderNode = ""
+		return nil
+	}
+	if len(peerCertificates) == 0 {
+		return fmt.Errorf("No peer certificates provided")
+	}
+	peerCertificate := peerCertificates[0]
+	if err := keys.VerifyChild(peerCertificate); err != nil {
+		return err
+	}
+	msg.SenderNode = keys.NodeIDOf(peerCertificate)
+	if keys.IsMaster(peerCertificate) {
+		if msg.Sender == "" {
+			msg.Sender = MASTER_SENDER
+		}
+		return nil
+	}
+
+	email, err := keys.Identity(peerCertificate)
+	if err != nil {
+		return fmt.Errorf("Unable to decrypt email: %s", err)
+	}
+	if email == "" {
+		return fmt.Errorf("Certificate isn't tied to an email address")
+	}
+	msg.Sender = email
+
+	switch msg.Type {
+	case TYPE_REGISTRATION, TYPE_DEREGISTRATION:
+		patterns, err := registrationPatterns(msg)
+		if err != nil {
+			return err
+		}
+		for _, pattern := range patterns {
+			if pattern != email {
+				return fmt.Errorf("%s may not (de)register %s", email, pattern)
+			}
+		}
+	case TYPE_HEARTBEAT:
+		heartbeat, err := decodeHeartbeat(msg)
+		if err != nil {
+			return err
+		}
+		for _, pattern := range heartbeat.Presence {
+			if pattern != email {
+				return fmt.Errorf("%s may not refresh presence for %s", email, pattern)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package signaling
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+The message bus connects the signaling channel with the subsystems that send
+and receive messages over it, without letting any of them deadlock the node.
+
+Sending never blocks forever.  Outgoing messages are queued in a buffer of
+SEND_BUFFER messages, and when that's full, SendContext() gives up once its
+context is done, while Send() gives up after SEND_TIMEOUT.
+
+Incoming messages are delivered to Subscriptions, each of which has a buffered
+channel of its own (see Subscribe()).  A subscriber that falls behind only
+holds up the bus for a little while: once its buffer is full, a message waits
+at most DELIVERY_TIMEOUT for room before it's dropped for that subscriber (and
+counted in Dropped()).  Since the signaling channel is unreliable anyway,
+subscribers have to cope with missing messages regardless.
+
+Subscriptions can be limited to certain message types and recipients with a
+Filter (see SubscribeTo() and RecvMatching()), so that subsystems only see the
+messages meant for them.
+*/
+const (
+	SEND_BUFFER                 = 100              // outgoing messages that are queued before senders have to wait
+	SEND_TIMEOUT                = 30 * time.Second // how long Send() waits for room in the queue
+	DELIVERY_TIMEOUT            = 5 * time.Second  // how long a message waits for room with a subscriber
+	DEFAULT_SUBSCRIPTION_BUFFER = 100              // buffer of subscriptions that don't ask for a specific size
+)
+
+// Filter selects the messages that a subscription receives.
+type Filter struct {
+	Types      []MessageType // the types of messages to receive (any if empty)
+	Recipients []string      // the recipients of messages to receive (any if empty)
+}
+
+// Subscription receives the messages arriving on the signaling bus.
+type Subscription struct {
+	C       <-chan Message // the channel on which messages are delivered
+	ch      chan Message   // the same channel, for sending
+	filter  Filter         // the messages that this subscription receives
+	dropped int64          // messages dropped because the subscriber fell behind, accessed atomically
+	owned   bool           // whether we created ch and close it in Close()
+}
+
+var (
+	subscriptions      = make([]*Subscription, 0) // current subscriptions
+	subscriptionsMutex sync.RWMutex               // used to synchronize access to subscriptions
+)
+
+/*
+SendContext() sends a Message to the Lantern network, giving up with the
+context's error if the message can't be queued before the context is done.
+*/
+func SendContext(ctx context.Context, m Message) error {
+	stamp(&m)
+	select {
+	case messages <- m:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+Subscribe() subscribes to the messages arriving on the signaling bus, buffering
+up to the given number of messages (DEFAULT_SUBSCRIPTION_BUFFER if 0).  The
+subscription has to be closed when it's no longer needed.
+*/
+func Subscribe(buffer int) *Subscription {
+	return SubscribeTo(Filter{}, buffer)
+}
+
+// SubscribeTo() is like Subscribe(), but only for the messages matching the
+// given filter.
+func SubscribeTo(filter Filter, buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = DEFAULT_SUBSCRIPTION_BUFFER
+	}
+	sub := subscribe(make(chan Message, buffer), filter)
+	sub.owned = true
+	return sub
+}
+
+// RecvMatching() is like RecvAt(), but only for the messages matching the
+// given filter.
+func RecvMatching(receiver chan Message, filter Filter) {
+	subscribe(receiver, filter)
+}
+
+// subscribe() subscribes the given channel to the messages arriving on the
+// signaling bus that match the given filter.
+func subscribe(ch chan Message, filter Filter) *Subscription {
+	sub := &Subscription{C: ch, ch: ch, filter: filter}
+	subscriptionsMutex.Lock()
+	defer subscriptionsMutex.Unlock()
+	subscriptions = append(subscriptions, sub)
+	return sub
+}
+
+/*
+Recv() waits for the next message on this subscription, giving up with the
+context's error once the context is done.  Fails with context.Canceled if the
+subscription has been closed.
+*/
+func (sub *Subscription) Recv(ctx context.Context) (Message, error) {
+	select {
+	case msg, ok := <-sub.C:
+		if !ok {
+			return Message{}, context.Canceled
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+// Dropped() returns the number of messages that were dropped because this
+// subscriber fell behind.
+func (sub *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&sub.dropped)
+}
+
+// Close() ends the subscription, closing C.  Closing twice is harmless.
+func (sub *Subscription) Close() {
+	subscriptionsMutex.Lock()
+	defer subscriptionsMutex.Unlock()
+	for i, existing := range subscriptions {
+		if existing == sub {
+			subscriptions = append(subscriptions[:i:i], subscriptions[i+1:]...)
+			if sub.owned {
+				close(sub.ch)
+			}
+			return
+		}
+	}
+}
+
+// Matches() indicates whether or not the given message passes this filter.
+func (filter Filter) Matches(msg Message) bool {
+	return (len(filter.Types) == 0 || containsType(filter.Types, msg.Type)) &&
+		(len(filter.Recipients) == 0 || containsString(filter.Recipients, msg.Recp))
+}
+
+func containsType(types []MessageType, t MessageType) bool {
+	for _, candidate := range types {
+		if candidate == t {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(strings []string, s string) bool {
+	for _, candidate := range strings {
+		if candidate == s {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+deliver() delivers an incoming message to all subscriptions whose filter it
+matches, dropping it for subscribers that don't make room for it within
+DELIVERY_TIMEOUT.
+*/
+func deliver(msg Message) {
+	subscriptionsMutex.RLock()
+	defer subscriptionsMutex.RUnlock()
+	for _, sub := range subscriptions {
+		if !sub.filter.Matches(msg) {
+			continue
+		}
+		select {
+		case sub.ch <- msg:
+			continue
+		default:
+		}
+		timer := time.NewTimer(DELIVERY_TIMEOUT)
+		select {
+		case sub.ch <- msg:
+		case <-timer.C:
+			atomic.AddInt64(&sub.dropped, 1)
+		}
+		timer.Stop()
+	}
+}
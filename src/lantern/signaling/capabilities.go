@@ -0,0 +1,120 @@
+/*
+This file contains the capabilities that nodes advertise along with their
+presence, so that proxy selection downstream can make informed choices instead
+of assuming that every peer speaks the same protocols.
+
+A node sets its capabilities with SetCapabilities().  They're sent to our
+parent with every heartbeat (see heartbeat.go), so that a parent that lost
+track of them, for example after we reconnected, learns them again within
+HEARTBEAT_INTERVAL.  Registrations covering multiple patterns can carry them
+too (see registrationData).
+
+Parents keep the latest capabilities of each connected child and forget them
+when the child disconnects.  PeerCapabilities() returns the capabilities of the
+children that messages for a given email would be routed to.
+*/
+package signaling
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+const (
+	BANDWIDTH_LOW    = "low"    // bandwidth class of constrained peers, e.g. on mobile
+	BANDWIDTH_MEDIUM = "medium" // bandwidth class of typical residential peers
+	BANDWIDTH_HIGH   = "high"   // bandwidth class of well-connected peers, e.g. servers
+
+	MAX_ADVERTISED = 8 // the maximum number of proxy addresses, transports and protocols in Capabilities
+)
+
+// Capabilities describes what a node can do for its peers.
+type Capabilities struct {
+	ProxyAddresses   []string       // host:port at which the node accepts proxy connections from peers
+	Transports       []string       // transports that the node's proxy supports, e.g. "tls"
+	ProtocolVersions map[string]int // the highest version spoken, by protocol name
+	GiveMode         bool           // whether the node currently proxies for other nodes
+	BandwidthClass   string         // BANDWIDTH_LOW, BANDWIDTH_MEDIUM, BANDWIDTH_HIGH or blank if unknown
+}
+
+var (
+	ourCapabilities   *Capabilities                   // the capabilities that we advertise, if set
+	childCapabilities = make(map[string]Capabilities) // latest advertised capabilities by child
+	capabilitiesMutex sync.RWMutex                    // used to synchronize access to all of the above
+)
+
+// SetCapabilities() sets the capabilities that we advertise to our parent.
+func SetCapabilities(capabilities Capabilities) error {
+	if err := validateCapabilities(&capabilities); err != nil {
+		return err
+	}
+	capabilitiesMutex.Lock()
+	defer capabilitiesMutex.Unlock()
+	ourCapabilities = &capabilities
+	return nil
+}
+
+/*
+PeerCapabilities() returns the capabilities of the children to which messages
+for the given email would be routed, by child.  Children that haven't
+advertised any capabilities are omitted.
+*/
+func PeerCapabilities(email string) map[string]Capabilities {
+	capabilitiesMutex.RLock()
+	defer capabilitiesMutex.RUnlock()
+	result := make(map[string]Capabilities)
+	for _, child := range route(email) {
+		if capabilities, found := childCapabilities[child]; found {
+			result[child] = capabilities
+		}
+	}
+	return result
+}
+
+// advertisedCapabilities() returns a copy of the capabilities that we
+// advertise, if set.
+func advertisedCapabilities() *Capabilities {
+	capabilitiesMutex.RLock()
+	defer capabilitiesMutex.RUnlock()
+	if ourCapabilities == nil {
+		return nil
+	}
+	capabilities := *ourCapabilities
+	return &capabilities
+}
+
+// recordCapabilities() records the capabilities advertised by the given child.
+func recordCapabilities(child string, capabilities Capabilities) {
+	capabilitiesMutex.Lock()
+	defer capabilitiesMutex.Unlock()
+	childCapabilities[child] = capabilities
+}
+
+// forgetCapabilities() forgets the capabilities of the given child, for
+// example when it disconnects.
+func forgetCapabilities(child string) {
+	capabilitiesMutex.Lock()
+	defer capabilitiesMutex.Unlock()
+	delete(childCapabilities, child)
+}
+
+// validateCapabilities() checks that the given capabilities are well formed.
+func validateCapabilities(capabilities *Capabilities) error {
+	if len(capabilities.ProxyAddresses) > MAX_ADVERTISED ||
+		len(capabilities.Transports) > MAX_ADVERTISED ||
+		len(capabilities.ProtocolVersions) > MAX_ADVERTISED {
+		return fmt.Errorf("Too many capabilities advertised")
+	}
+	for _, address := range capabilities.ProxyAddresses {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("Invalid proxy address %s: %s", address, err)
+		}
+	}
+	switch capabilities.BandwidthClass {
+	case "", BANDWIDTH_LOW, BANDWIDTH_MEDIUM, BANDWIDTH_HIGH:
+		return nil
+	default:
+		return fmt.Errorf("Invalid bandwidth class: %s", capabilities.BandwidthClass)
+	}
+}
@@ -0,0 +1,220 @@
+/*
+This file keeps track of the children connected to our signaling channel, so
+that operators can see who is connected and disconnect or ban children at
+http://[config.UIAddress()]/api/children.
+
+GET lists the connected children (see Child).  POST takes the connection ID of
+a child in the form value id and the action in the form value action:
+
+  - disconnect - closes the child's connection, the child may reconnect
+  - ban - closes the child's connection and refuses further connections from its
+    node (see config.BannedNodes()).  With the form value revoke=true, the
+    child's certificate is revoked as well (see keys.Revoke()), so that it's no
+    longer accepted anywhere in our subtree.
+  - unban - lifts the ban of the node with the NodeID in the form value node
+
+Children are identified by their connection ID, the remote address of their
+connection (see listen()).
+*/
+package signaling
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"lantern/config"
+	"lantern/keys"
+	"lantern/ui"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Child is a child connected to our signaling channel.
+type Child struct {
+	ID           string     // the connection ID of the child
+	NodeID       string     // the NodeID of the child, from its certificate (see keys.NodeID())
+	Serial       string     // the serial number of the child's certificate
+	Emails       []string   // the patterns that the child registered (see routes.go)
+	ConnectedAt  time.Time  // when the child connected
+	BytesRelayed int64      // the bytes of messages from the child that we relayed
+	Load         *LoadStats // the load that the child reported with its last heartbeat, if any
+	disconnect   func() error
+}
+
+var (
+	connected      = make(map[string]*Child) // connected children by connection ID
+	connectedMutex sync.Mutex                // used to synchronize access to connected
+)
+
+func init() {
+	ui.HandleFunc("/api/children", childrenHandler)
+}
+
+/*
+trackChild() starts tracking the newly connected child with the given
+connection ID and certificates, which the given function disconnects.  Returns
+an error if the child's node is banned.
+*/
+func trackChild(child string, peerCertificates []*x509.Certificate, disconnect func() error) error {
+	tracked := &Child{ID: child, ConnectedAt: time.Now(), disconnect: disconnect}
+	if len(peerCertificates) > 0 && keys.VerifyChild(peerCertificates[0]) == nil {
+		tracked.NodeID = keys.NodeIDOf(peerCertificates[0])
+		tracked.Serial = peerCertificates[0].SerialNumber.String()
+	}
+	if tracked.NodeID != "" && isBanned(tracked.NodeID) {
+		return fmt.Errorf("Node %s is banned", keys.ShortNodeID(tracked.NodeID))
+	}
+	connectedMutex.Lock()
+	defer connectedMutex.Unlock()
+	connected[child] = tracked
+	return nil
+}
+
+// untrackChild() stops tracking the given child, for example when it
+// disconnects.
+func untrackChild(child string) {
+	connectedMutex.Lock()
+	defer connectedMutex.Unlock()
+	delete(connected, child)
+}
+
+// countChildBytes() counts the given number of bytes that the given child sent
+// us.
+func countChildBytes(child string, bytes int) {
+	connectedMutex.Lock()
+	defer connectedMutex.Unlock()
+	if tracked, found := connected[child]; found {
+		tracked.BytesRelayed += int64(bytes)
+	}
+}
+
+// recordLoad() records the load that the given child reported.
+func recordLoad(child string, load LoadStats) {
+	connectedMutex.Lock()
+	defer connectedMutex.Unlock()
+	if tracked, found := connected[child]; found {
+		tracked.Load = &load
+	}
+}
+
+// Children() lists the connected children, longest connected first.
+func Children() []Child {
+	connectedMutex.Lock()
+	list := make([]Child, 0, len(connected))
+	for _, tracked := range connected {
+		list = append(list, *tracked)
+	}
+	connectedMutex.Unlock()
+
+	routesMutex.RLock()
+	defer routesMutex.RUnlock()
+	for i := range list {
+		list[i].Emails = make([]string, 0)
+		for pattern, registered := range routes {
+			// Leave out the recipients of replies (see rpc.go)
+			if registered.Contains(list[i].ID) && validatePattern(pattern) == nil {
+				list[i].Emails = append(list[i].Emails, pattern)
+			}
+		}
+		sort.Strings(list[i].Emails)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ConnectedAt.Before(list[j].ConnectedAt) })
+	return list
+}
+
+// Disconnect() closes the connection of the child with the given connection
+// ID.
+func Disconnect(child string) error {
+	connectedMutex.Lock()
+	tracked, found := connected[child]
+	connectedMutex.Unlock()
+	if !found {
+		return fmt.Errorf("No child connected as %s", child)
+	}
+	log.Printf("Disconnecting child %s", child)
+	return tracked.disconnect()
+}
+
+/*
+Ban() disconnects the child with the given connection ID and refuses further
+connections from its node, revoking its certificate too if revoke is true.
+*/
+func Ban(child string, revoke bool) error {
+	connectedMutex.Lock()
+	tracked, found := connected[child]
+	connectedMutex.Unlock()
+	if !found {
+		return fmt.Errorf("No child connected as %s", child)
+	}
+	if tracked.NodeID == "" {
+		return fmt.Errorf("Child %s didn't present a certificate", child)
+	}
+	if !isBanned(tracked.NodeID) {
+		config.SetBannedNodes(append(config.BannedNodes(), tracked.NodeID))
+		log.Printf("Banned node %s", keys.ShortNodeID(tracked.NodeID))
+	}
+	if revoke {
+		if err := keys.Revoke(tracked.Serial); err != nil {
+			return err
+		}
+	}
+	return Disconnect(child)
+}
+
+// Unban() lifts the ban of the node with the given NodeID.
+func Unban(nodeID string) error {
+	banned := config.BannedNodes()
+	for i, bannedNode := range banned {
+		if bannedNode == nodeID {
+			config.SetBannedNodes(append(banned[:i], banned[i+1:]...))
+			log.Printf("Lifted ban of node %s", keys.ShortNodeID(nodeID))
+			return nil
+		}
+	}
+	return fmt.Errorf("Node %s isn't banned", nodeID)
+}
+
+// isBanned() indicates whether the node with the given NodeID is banned.
+func isBanned(nodeID string) bool {
+	for _, bannedNode := range config.BannedNodes() {
+		if bannedNode == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+childrenHandler() lists the connected children on GET and disconnects, bans or
+unbans one on POST with the form values id, action, revoke and node.
+*/
+func childrenHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		var err error
+		switch req.FormValue("action") {
+		case "disconnect":
+			err = Disconnect(req.FormValue("id"))
+		case "ban":
+			err = Ban(req.FormValue("id"), req.FormValue("revoke") == "true")
+		case "unban":
+			err = Unban(req.FormValue("node"))
+		default:
+			err = fmt.Errorf("Unknown action: %s", req.FormValue("action"))
+		}
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+	}
+	if childrenJson, err := json.MarshalIndent(Children(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(childrenJson)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+This file contains the logic that keeps messages from being delivered more than
+once or circulating forever in a misconfigured tree.
+
+Every message carries a random ID and a TTL (the number of hops it may still
+travel).  Each node remembers the IDs of the last SEEN_CACHE_SIZE messages that
+it has handled and drops any message it has already seen, and it decrements
+the TTL on every hop, dropping messages whose TTL has run out.
+
+Nodes that predate DEDUP_PROTOCOL_VERSION neither send nor accept IDs and
+TTLs, so they're stripped from messages for them (see Message.ForVersion())
+and messages from them are adopted as if we originated them (see adopt()).
+*/
+package signaling
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+)
+
+const (
+	DEFAULT_TTL     = 16   // the number of hops that a new message may travel
+	SEEN_CACHE_SIZE = 4096 // the number of message IDs that we remember
+)
+
+var (
+	seen      = make(map[string]bool)           // IDs of recently seen messages
+	seenOrder = make([]string, SEEN_CACHE_SIZE) // ring buffer of seen IDs, oldest gets evicted first
+	seenNext  = 0                               // next position in seenOrder
+	seenMutex sync.Mutex                        // used to synchronize access to the seen cache
+)
+
+// newMessageID() generates a new random message ID.
+func newMessageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// stamp() assigns an ID and TTL to a message that we're originating, and
+// remembers it so that it isn't delivered back to us.
+func stamp(m *Message) {
+	if m.ID == "" {
+		m.ID = newMessageID()
+	}
+	if m.TTL == 0 {
+		m.TTL = DEFAULT_TTL
+	}
+	markSeen(m.ID)
+}
+
+/*
+adopt() gives a message from a node that predates DEDUP_PROTOCOL_VERSION the ID
+and TTL that the node couldn't give it, so that it's admitted and deduplicated
+from here on.
+*/
+func adopt(m *Message) {
+	m.ID = newMessageID()
+	m.TTL = DEFAULT_TTL
+}
+
+/*
+admit() decides whether a message received from another node should be
+handled, returning false for duplicates and for messages whose TTL has run
+out.  Admitted messages have their TTL decremented for the next hop.
+*/
+func admit(m *Message) bool {
+	if m.ID == "" || m.TTL == 0 {
+		return false
+	}
+	if !markSeen(m.ID) {
+		return false
+	}
+	m.TTL -= 1
+	return true
+}
+
+// markSeen() remembers the given message ID, returning false if we had already
+// seen it.
+func markSeen(id string) bool {
+	seenMutex.Lock()
+	defer seenMutex.Unlock()
+	if seen[id] {
+		return false
+	}
+	if evicted := seenOrder[seenNext]; evicted != "" {
+		delete(seen, evicted)
+	}
+	seen[id] = true
+	seenOrder[seenNext] = id
+	seenNext = (seenNext + 1) % SEEN_CACHE_SIZE
+	return true
+}
@@ -0,0 +1,47 @@
+package signaling
+
+import (
+	"log"
+	"sync"
+)
+
+/*
+While a master drains before maintenance (see package lantern/drain), it
+refuses new children (see admitChild()) and tells the ones that it has to fail
+over to an alternate parent (TYPE_DRAIN).  Children follow by pointing
+config.ParentAddress() at the alternate and calling Reconnect().
+*/
+
+var (
+	draining      bool       // whether we stopped accepting new children
+	drainingMutex sync.Mutex // used to synchronize access to draining
+)
+
+// StopAcceptingChildren() makes us refuse new children, the ones that are
+// connected stay connected.
+func StopAcceptingChildren() {
+	drainingMutex.Lock()
+	defer drainingMutex.Unlock()
+	draining = true
+}
+
+// Draining() indicates whether we stopped accepting new children.
+func Draining() bool {
+	drainingMutex.Lock()
+	defer drainingMutex.Unlock()
+	return draining
+}
+
+/*
+Reconnect() closes our connection to our parent and connects again to
+config.ParentAddress(), for example after our parent told us to fail over to
+another one.  Does nothing if we're not connected.
+*/
+func Reconnect() {
+	select {
+	case restart <- Message{}:
+		log.Print("Reconnecting to our parent")
+	default:
+		log.Print("Not connected to our parent, nothing to reconnect")
+	}
+}
@@ -0,0 +1,160 @@
+/*
+This file contains the composite heartbeat frame (TYPE_HEARTBEAT), which
+batches the small periodic messages that a child sends to its parent - presence
+refreshes, load stats and capabilities - into a single message per
+HEARTBEAT_INTERVAL.  Parents show the load of their children at /api/children
+(see children.go).
+
+Heartbeats are only understood by parents that speak HEARTBEAT_PROTOCOL_VERSION
+or later, which is learned during the connection handshake (see
+SetParentProtocolVersion()).  For older parents, pending presence refreshes are
+sent as individual TYPE_REGISTRATION messages instead, and stats (which older
+parents don't know about) are dropped.
+
+Every heartbeat refreshes our presence (see ourPresence()), so that our parent
+keeps routing messages for us even if it restarted in the meantime.
+*/
+package signaling
+
+import (
+	"encoding/json"
+	"lantern/config"
+	"lantern/keys"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	PROTOCOL_VERSION           = 4                // the signaling protocol version spoken by this node
+	HEARTBEAT_PROTOCOL_VERSION = 2                // the first protocol version that supports heartbeats
+	NODE_ID_PROTOCOL_VERSION   = 3                // the first protocol version that supports Message.SenderNode
+	DEDUP_PROTOCOL_VERSION     = 3                // the first protocol version that supports Message.ID and TTL (see dedup.go)
+	KEEPALIVE_PROTOCOL_VERSION = 4                // the first protocol version that supports keepalive frames (see transport.go)
+	HEARTBEAT_INTERVAL         = 30 * time.Second // how often heartbeats are sent
+)
+
+// Heartbeat is the payload of a TYPE_HEARTBEAT message.
+type Heartbeat struct {
+	Presence     []string      // patterns whose registrations are being refreshed
+	Load         *LoadStats    // our current load, if known
+	Capabilities *Capabilities // our capabilities, if set (see capabilities.go)
+}
+
+// LoadStats captures a minimal summary of a node's load.
+type LoadStats struct {
+	Connections    int   // number of open proxy connections
+	BytesPerSecond int64 // current proxy throughput
+}
+
+var (
+	pending               = &Heartbeat{} // what goes out with the next heartbeat
+	parentProtocolVersion = 1            // the protocol version spoken by our parent
+	pendingMutex          sync.Mutex     // used to synchronize access to pending and parentProtocolVersion
+)
+
+// SetParentProtocolVersion() records the protocol version that our parent
+// advertised during the connection handshake.
+func SetParentProtocolVersion(version int) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	parentProtocolVersion = version
+}
+
+// parentVersion() returns the protocol version spoken by our parent.
+func parentVersion() int {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	return parentProtocolVersion
+}
+
+// QueuePresence() queues a presence refresh for the given patterns.
+func QueuePresence(patterns ...string) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	pending.Presence = append(pending.Presence, patterns...)
+}
+
+// SetLoad() sets the load stats reported with the next heartbeat (see package
+// lantern/accounting).
+func SetLoad(load LoadStats) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	pending.Load = &load
+}
+
+// heartbeats(), meant to be run as a goroutine, periodically flushes whatever
+// is pending.
+func heartbeats() {
+	for {
+		time.Sleep(HEARTBEAT_INTERVAL)
+		QueuePresence(ourPresence()...)
+		for _, msg := range flushHeartbeat() {
+			Send(msg)
+		}
+	}
+}
+
+/*
+ourPresence() returns the patterns that we refresh with every heartbeat: our
+own email address, and if we're a master, everything that our children
+registered, since master nodes register their subtree up the chain.
+*/
+func ourPresence() []string {
+	presence := make([]string, 0)
+	if email := config.Email(); email != "" {
+		presence = append(presence, email)
+	}
+	if cert, _ := keys.Certificate(); cert != nil && keys.IsMaster(cert) {
+		presence = append(presence, registeredPatterns()...)
+	}
+	return presence
+}
+
+/*
+flushHeartbeat() returns the messages needed to deliver everything that's
+pending to our parent, taking into account the protocol version that it
+speaks.
+*/
+func flushHeartbeat() []Message {
+	pendingMutex.Lock()
+	heartbeat := pending
+	pending = &Heartbeat{}
+	version := parentProtocolVersion
+	pendingMutex.Unlock()
+	heartbeat.Capabilities = advertisedCapabilities()
+
+	if version >= HEARTBEAT_PROTOCOL_VERSION {
+		data, err := json.Marshal(heartbeat)
+		if err != nil {
+			log.Printf("Unable to encode heartbeat: %s", err)
+			return nil
+		}
+		return []Message{Message{Type: TYPE_HEARTBEAT, Data: string(data)}}
+	}
+
+	msgs := make([]Message, 0, len(heartbeat.Presence))
+	for _, pattern := range heartbeat.Presence {
+		msgs = append(msgs, Message{Recp: pattern, Type: TYPE_REGISTRATION})
+	}
+	return msgs
+}
+
+// decodeHeartbeat() decodes the payload of a TYPE_HEARTBEAT message.
+func decodeHeartbeat(msg *Message) (*Heartbeat, error) {
+	heartbeat := &Heartbeat{}
+	if err := json.Unmarshal([]byte(msg.Data), heartbeat); err != nil {
+		return nil, err
+	}
+	for _, pattern := range heartbeat.Presence {
+		if err := validatePattern(pattern); err != nil {
+			return nil, err
+		}
+	}
+	if heartbeat.Capabilities != nil {
+		if err := validateCapabilities(heartbeat.Capabilities); err != nil {
+			return nil, err
+		}
+	}
+	return heartbeat, nil
+}
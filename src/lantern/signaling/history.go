@@ -0,0 +1,148 @@
+/*
+This file contains the message history that lets a parent hold on to messages
+that it has nowhere to pass on, so that recipients that aren't connected yet
+get them once they register (see config.SignalingHistory()).
+
+A message is kept when there's no child registered for its recipient and we
+can't pass it up, because we're a root or aren't connected to our parent.  The
+history is bounded so that it can't grow on long-running master nodes:
+
+  - only the latest MaxMessagesPerRecipient messages are kept per recipient
+  - at most MaxRecipients recipients are kept, the ones that we kept a message
+    for least recently are dropped first
+  - messages expire after TTLSeconds, whether or not anybody registered
+
+When a child registers patterns, the unexpired messages for the recipients that
+they match are passed on to that child only, and forgotten.  Replies and
+certificate responses are never kept, since nobody is waiting for them anymore
+once their requester is gone.  Setting MaxMessagesPerRecipient or TTLSeconds to
+0 turns the history off.
+*/
+package signaling
+
+import (
+	"lantern/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HISTORY_EXPIRY_INTERVAL = 1 * time.Minute // how often expired messages are dropped from the history
+)
+
+// keptMessage is a message in the history.
+type keptMessage struct {
+	msg     Message   // the message
+	expires time.Time // when the message is dropped from the history
+}
+
+var (
+	history      = make(map[string][]keptMessage) // kept messages by recipient, oldest first
+	historyOrder = make([]string, 0)              // recipients in the order in which we last kept a message for them
+	historyMutex sync.Mutex                       // used to synchronize access to history and historyOrder
+)
+
+/*
+keep() adds the given message to the history of its recipient, dropping the
+oldest messages and recipients beyond the configured bounds.
+*/
+func keep(msg Message) {
+	limits := config.SignalingHistory()
+	if limits.MaxMessagesPerRecipient <= 0 || limits.TTLSeconds <= 0 || msg.Recp == "" {
+		return
+	}
+	if strings.HasPrefix(msg.Recp, REPLY_PREFIX) || strings.HasPrefix(msg.Recp, CERT_RESPONSE_PREFIX) {
+		return
+	}
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	now := time.Now()
+	kept := append(unexpired(history[msg.Recp], now), keptMessage{msg, now.Add(time.Duration(limits.TTLSeconds) * time.Second)})
+	if len(kept) > limits.MaxMessagesPerRecipient {
+		kept = kept[len(kept)-limits.MaxMessagesPerRecipient:]
+	}
+	history[msg.Recp] = kept
+	historyOrder = append(withoutRecipient(historyOrder, msg.Recp), msg.Recp)
+	for limits.MaxRecipients > 0 && len(historyOrder) > limits.MaxRecipients {
+		delete(history, historyOrder[0])
+		historyOrder = historyOrder[1:]
+	}
+}
+
+/*
+replay() passes the unexpired messages kept for recipients that match the given
+patterns on to the given child, which just registered them, and forgets them.
+*/
+func replay(child string, patterns []string) {
+	historyMutex.Lock()
+	matching := make([]keptMessage, 0)
+	now := time.Now()
+	for recipient, kept := range history {
+		if !matchesAny(recipient, patterns) {
+			continue
+		}
+		matching = append(matching, unexpired(kept, now)...)
+		delete(history, recipient)
+		historyOrder = withoutRecipient(historyOrder, recipient)
+	}
+	historyMutex.Unlock()
+	for _, kept := range matching {
+		sendToChildren([]string{child}, kept.msg)
+	}
+}
+
+// expireHistory(), meant to be run as a goroutine, periodically drops expired
+// messages, including those for recipients that never register.
+func expireHistory() {
+	for {
+		time.Sleep(HISTORY_EXPIRY_INTERVAL)
+		historyMutex.Lock()
+		now := time.Now()
+		for recipient, kept := range history {
+			if kept = unexpired(kept, now); len(kept) > 0 {
+				history[recipient] = kept
+			} else {
+				delete(history, recipient)
+				historyOrder = withoutRecipient(historyOrder, recipient)
+			}
+		}
+		historyMutex.Unlock()
+	}
+}
+
+// unexpired() returns the given kept messages without the ones that expired.
+func unexpired(kept []keptMessage, now time.Time) []keptMessage {
+	remaining := make([]keptMessage, 0, len(kept))
+	for _, candidate := range kept {
+		if now.Before(candidate.expires) {
+			remaining = append(remaining, candidate)
+		}
+	}
+	return remaining
+}
+
+// withoutRecipient() returns the given recipients without the given one.
+func withoutRecipient(recipients []string, recipient string) []string {
+	remaining := recipients[:0]
+	for _, candidate := range recipients {
+		if candidate != recipient {
+			remaining = append(remaining, candidate)
+		}
+	}
+	return remaining
+}
+
+// matchesAny() checks whether the given email address matches any of the given
+// patterns (see routes.go).
+func matchesAny(email string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if pattern == WILDCARD || pattern == email {
+			return true
+		}
+		if strings.HasPrefix(pattern, WILDCARD+"@") && strings.HasSuffix(email, pattern[len(WILDCARD):]) {
+			return true
+		}
+	}
+	return false
+}
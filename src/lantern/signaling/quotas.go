@@ -0,0 +1,193 @@
+/*
+This file contains the quotas that a parent enforces on its children so that a
+single misbehaving child can't exhaust it (see config.ChildQuotas()):
+
+  - the number of concurrent child connections
+  - the number of distinct patterns registered per child connection, so that
+    refreshing a registration doesn't count against it again
+  - the sustained message rate per child (a token bucket that allows bursts of
+    up to one second's worth of messages)
+  - the number of connection attempts per IP per minute
+
+Violations are reported as QuotaErrors, which carry an HTTP-style 429 status,
+and are counted in QuotaMetrics(), which can be inspected at
+http://[config.UIAddress()]/diagnostics/quotas.
+*/
+package signaling
+
+import (
+	"encoding/json"
+	"fmt"
+	"lantern/config"
+	"lantern/ui"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// STATUS_TOO_MANY_REQUESTS is the status code of QuotaErrors.
+const STATUS_TOO_MANY_REQUESTS = 429
+
+// QuotaError indicates that a child exceeded one of its quotas.
+type QuotaError struct {
+	Status int    // always STATUS_TOO_MANY_REQUESTS
+	Reason string // which quota was exceeded
+}
+
+func (err *QuotaError) Error() string {
+	return fmt.Sprintf("%d Too Many Requests: %s", err.Status, err.Reason)
+}
+
+// Metrics counts quota rejections.
+type Metrics struct {
+	Children                int   // currently connected children
+	RejectedConnections     int64 // connections rejected for exceeding MaxConnections
+	RejectedConnectAttempts int64 // connections rejected for exceeding MaxConnectAttemptsPerMinute
+	RejectedRegistrations   int64 // registrations rejected for exceeding MaxRegistrationsPerChild
+	RejectedMessages        int64 // messages rejected for exceeding MaxMessagesPerSecond
+}
+
+// childQuota tracks the usage of a single child.
+type childQuota struct {
+	tokens        float64         // tokens left in the message rate bucket
+	lastRefill    time.Time       // when tokens was last refilled
+	registrations map[string]bool // the patterns registered
+}
+
+var (
+	children      = make(map[string]*childQuota) // usage by child
+	connectWindow = time.Now()                   // start of the current connection attempt window
+	connectsByIP  = make(map[string]int)         // connection attempts by IP in the current window
+	metrics       = Metrics{}                    // counts of quota rejections
+	quotasMutex   sync.Mutex                     // used to synchronize access to all of the above
+)
+
+func init() {
+	ui.HandleFunc("/diagnostics/quotas", quotasHandler)
+}
+
+/*
+admitChild() checks whether a new connection from the given child (identified
+by its remote address) coming from the given IP may be accepted, and if so
+starts tracking it.
+*/
+func admitChild(child string, ip string) error {
+	if Draining() {
+		return fmt.Errorf("Not accepting children while draining")
+	}
+	quotas := config.ChildQuotas()
+	quotasMutex.Lock()
+	defer quotasMutex.Unlock()
+
+	if time.Since(connectWindow) > time.Minute {
+		connectWindow = time.Now()
+		connectsByIP = make(map[string]int)
+	}
+	connectsByIP[ip] += 1
+	if quotas.MaxConnectAttemptsPerMinute > 0 && connectsByIP[ip] > quotas.MaxConnectAttemptsPerMinute {
+		metrics.RejectedConnectAttempts += 1
+		return &QuotaError{STATUS_TOO_MANY_REQUESTS, fmt.Sprintf("too many connection attempts from %s", ip)}
+	}
+	if quotas.MaxConnections > 0 && len(children) >= quotas.MaxConnections {
+		metrics.RejectedConnections += 1
+		return &QuotaError{STATUS_TOO_MANY_REQUESTS, "too many child connections"}
+	}
+	children[child] = &childQuota{tokens: quotas.MaxMessagesPerSecond, lastRefill: time.Now(), registrations: make(map[string]bool)}
+	metrics.Children = len(children)
+	return nil
+}
+
+// releaseChild() stops tracking the given child, for example when it
+// disconnects.
+func releaseChild(child string) {
+	quotasMutex.Lock()
+	defer quotasMutex.Unlock()
+	delete(children, child)
+	metrics.Children = len(children)
+}
+
+// allowMessage() checks whether the given child may send another message.
+func allowMessage(child string) error {
+	maxRate := config.ChildQuotas().MaxMessagesPerSecond
+	if maxRate <= 0 {
+		return nil
+	}
+	quotasMutex.Lock()
+	defer quotasMutex.Unlock()
+	quota, found := children[child]
+	if !found {
+		return fmt.Errorf("Unknown child: %s", child)
+	}
+	now := time.Now()
+	quota.tokens += now.Sub(quota.lastRefill).Seconds() * maxRate
+	if quota.tokens > maxRate {
+		quota.tokens = maxRate
+	}
+	quota.lastRefill = now
+	if quota.tokens < 1 {
+		metrics.RejectedMessages += 1
+		return &QuotaError{STATUS_TOO_MANY_REQUESTS, "message rate exceeded"}
+	}
+	quota.tokens -= 1
+	return nil
+}
+
+/*
+allowRegistrations() checks whether the given child may register the given
+patterns, and if so counts the ones that it hasn't registered yet against its
+quota.  Patterns that the child registered already don't count again, since
+children refresh their registrations periodically.
+*/
+func allowRegistrations(child string, patterns []string) error {
+	maxRegistrations := config.ChildQuotas().MaxRegistrationsPerChild
+	quotasMutex.Lock()
+	defer quotasMutex.Unlock()
+	quota, found := children[child]
+	if !found {
+		return fmt.Errorf("Unknown child: %s", child)
+	}
+	added := make(map[string]bool)
+	for _, pattern := range patterns {
+		if !quota.registrations[pattern] {
+			added[pattern] = true
+		}
+	}
+	if len(added) > 0 && maxRegistrations > 0 && len(quota.registrations)+len(added) > maxRegistrations {
+		metrics.RejectedRegistrations += 1
+		return &QuotaError{STATUS_TOO_MANY_REQUESTS, "too many registrations"}
+	}
+	for pattern := range added {
+		quota.registrations[pattern] = true
+	}
+	return nil
+}
+
+// releaseRegistrations() credits the given deregistered patterns back to the
+// given child's quota.
+func releaseRegistrations(child string, patterns []string) {
+	quotasMutex.Lock()
+	defer quotasMutex.Unlock()
+	if quota, found := children[child]; found {
+		for _, pattern := range patterns {
+			delete(quota.registrations, pattern)
+		}
+	}
+}
+
+// QuotaMetrics() returns a snapshot of the quota metrics.
+func QuotaMetrics() Metrics {
+	quotasMutex.Lock()
+	defer quotasMutex.Unlock()
+	return metrics
+}
+
+// quotasHandler() shows the quota metrics.
+func quotasHandler(resp http.ResponseWriter, req *http.Request) {
+	if metricsJson, err := json.MarshalIndent(QuotaMetrics(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(metricsJson)
+	}
+}
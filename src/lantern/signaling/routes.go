@@ -0,0 +1,242 @@
+/*
+This file contains the routing table that parents use to decide which children
+to forward messages to.
+
+Children register patterns for the email addresses that they can deliver:
+
+- "a@gmail.com" - exactly that email address
+- "*@gmail.com" - any email address at gmail.com
+- "*"           - any email address at all
+
+User nodes can only register their own email address (see auth.go), but master
+nodes can register any patterns, so they can tell their parents that they "can
+deliver anything" without enumerating addresses.
+
+A registration message can cover several patterns at once by carrying a
+registrationData payload.  If it doesn't, Recp is the only pattern.
+
+When routing a message, only the children registered under the most specific
+matching pattern are used: an exact match beats a domain wildcard, which beats
+"*".  A node may be connected more than once, for example while its old
+connection hasn't timed out yet after it reconnected from a new IP.  Children
+are told apart by their NodeIDs (see keys.NodeID()), so that such a node only
+gets a message once, over the connection that it used most recently.
+*/
+package signaling
+
+import (
+	"encoding/json"
+	"fmt"
+	"lantern/util"
+	"strings"
+	"sync"
+)
+
+// WILDCARD is the pattern that matches any email address.
+const WILDCARD = "*"
+
+// CERT_RESPONSE_PREFIX prefixes the recipients of certificate responses (see
+// CertResponseRecipient()).
+const CERT_RESPONSE_PREFIX = "cert-response:"
+
+// registrationData is the payload of TYPE_REGISTRATION and
+// TYPE_DEREGISTRATION messages that cover multiple patterns.
+type registrationData struct {
+	Patterns     []string      // the patterns being (de)registered
+	Capabilities *Capabilities // the capabilities of the registering node, if advertised
+}
+
+var (
+	routes       = make(map[string]*util.StringSet) // children by pattern
+	childNodes   = make(map[string]string)          // NodeIDs by child
+	nodeChildren = make(map[string]string)          // the child that each node used most recently, by NodeID
+	routesMutex  sync.RWMutex                       // used to synchronize access to all of the above
+)
+
+/*
+registrationPatterns() returns the patterns covered by a registration or
+deregistration message.
+*/
+func registrationPatterns(msg *Message) ([]string, error) {
+	if msg.Data == "" {
+		return []string{msg.Recp}, nil
+	}
+	data := &registrationData{}
+	if err := json.Unmarshal([]byte(msg.Data), data); err != nil {
+		return nil, err
+	}
+	for _, pattern := range data.Patterns {
+		if err := validatePattern(pattern); err != nil {
+			return nil, err
+		}
+	}
+	if data.Capabilities != nil {
+		if err := validateCapabilities(data.Capabilities); err != nil {
+			return nil, err
+		}
+	}
+	return data.Patterns, nil
+}
+
+// registrationCapabilities() returns the capabilities advertised with a
+// registration message, if any.
+func registrationCapabilities(msg *Message) *Capabilities {
+	if msg.Data == "" {
+		return nil
+	}
+	data := &registrationData{}
+	if err := json.Unmarshal([]byte(msg.Data), data); err != nil {
+		return nil
+	}
+	return data.Capabilities
+}
+
+// validatePattern() checks that the given pattern is well formed.
+func validatePattern(pattern string) error {
+	if pattern == WILDCARD {
+		return nil
+	}
+	at := strings.LastIndex(pattern, "@")
+	if at <= 0 || at == len(pattern)-1 {
+		return fmt.Errorf("Invalid pattern: %s", pattern)
+	}
+	if strings.Contains(pattern[at+1:], "*") || (strings.Contains(pattern[:at], "*") && pattern[:at] != WILDCARD) {
+		return fmt.Errorf("Invalid pattern: %s", pattern)
+	}
+	return nil
+}
+
+// register() registers the given child for the given patterns.
+func register(child string, patterns []string) {
+	routesMutex.Lock()
+	defer routesMutex.Unlock()
+	for _, pattern := range patterns {
+		children, found := routes[pattern]
+		if !found {
+			children = util.NewStringSet()
+			routes[pattern] = children
+		}
+		children.Add(child)
+	}
+}
+
+// deregister() deregisters the given child from the given patterns.
+func deregister(child string, patterns []string) {
+	routesMutex.Lock()
+	defer routesMutex.Unlock()
+	for _, pattern := range patterns {
+		if children, found := routes[pattern]; found {
+			children.Remove(child)
+			if children.Len() == 0 {
+				delete(routes, pattern)
+			}
+		}
+	}
+}
+
+// forgetChild() removes all registrations for the given child, for example
+// when it disconnects.
+func forgetChild(child string) {
+	routesMutex.Lock()
+	defer routesMutex.Unlock()
+	for pattern, children := range routes {
+		children.Remove(child)
+		if children.Len() == 0 {
+			delete(routes, pattern)
+		}
+	}
+}
+
+/*
+registeredPatterns() returns the email addresses and patterns that our children
+registered, leaving out the temporary registrations for replies.
+*/
+func registeredPatterns() []string {
+	routesMutex.RLock()
+	defer routesMutex.RUnlock()
+	patterns := make([]string, 0, len(routes))
+	for pattern := range routes {
+		if !strings.HasPrefix(pattern, REPLY_PREFIX) && !strings.HasPrefix(pattern, CERT_RESPONSE_PREFIX) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// forgetRecipient() removes all registrations for the given pattern, for
+// example once the reply to a request has been passed on.
+func forgetRecipient(pattern string) {
+	routesMutex.Lock()
+	defer routesMutex.Unlock()
+	delete(routes, pattern)
+}
+
+// recordNode() records that the given child is the node with the given NodeID
+// (if known).
+func recordNode(child string, nodeID string) {
+	if nodeID == "" {
+		return
+	}
+	routesMutex.Lock()
+	defer routesMutex.Unlock()
+	childNodes[child] = nodeID
+	nodeChildren[nodeID] = child
+}
+
+// forgetNode() forgets which node the given child is, for example when it
+// disconnects.
+func forgetNode(child string) {
+	routesMutex.Lock()
+	defer routesMutex.Unlock()
+	nodeID, found := childNodes[child]
+	if !found {
+		return
+	}
+	delete(childNodes, child)
+	if nodeChildren[nodeID] == child {
+		delete(nodeChildren, nodeID)
+	}
+}
+
+/*
+CertResponseRecipient() returns the recipient to which the response to the
+TYPE_CERT_REQUEST with the given message ID is addressed.  Children that send a
+certificate request are temporarily registered under this recipient, since
+they can't register an email address before they have a certificate.
+*/
+func CertResponseRecipient(requestID string) string {
+	return CERT_RESPONSE_PREFIX + requestID
+}
+
+/*
+route() returns the children to which a message for the given email should be
+forwarded, using the most specific matching pattern and only one child per
+node.
+*/
+func route(email string) []string {
+	routesMutex.RLock()
+	defer routesMutex.RUnlock()
+	candidates := []string{email}
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		candidates = append(candidates, WILDCARD+email[at:])
+	}
+	candidates = append(candidates, WILDCARD)
+	for _, pattern := range candidates {
+		if children, found := routes[pattern]; found && children.Len() > 0 {
+			return onePerNode(children.Values())
+		}
+	}
+	return nil
+}
+
+// onePerNode() drops the children that aren't the connection most recently used
+// by their node.  routesMutex must be held.
+func onePerNode(children []string) []string {
+	deduplicated := make([]string, 0, len(children))
+	for _, child := range children {
+		if nodeID, found := childNodes[child]; !found || nodeChildren[nodeID] == child {
+			deduplicated = append(deduplicated, child)
+		}
+	}
+	return deduplicated
+}
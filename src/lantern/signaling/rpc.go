@@ -0,0 +1,113 @@
+package signaling
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+Call() provides request/response semantics on top of the unreliable signaling
+bus, for things like certificate requests.
+
+A request type is paired with the type of its replies using RegisterRPC().
+Every attempt at a request gets a fresh message ID (so that dedup.go doesn't
+drop retries), and the reply to an attempt is addressed to the
+ReplyRecipient() of that attempt's ID.  Parents temporarily register the child
+that sent a request under that recipient, so that the reply finds its way back
+even if the child hasn't registered an email address (yet).  The node that
+handles a request answers with Reply().
+
+An attempt that isn't answered within CALL_ATTEMPT_TIMEOUT is retried, up to
+CALL_ATTEMPTS attempts in total, and the reply to any of the attempts is
+accepted.
+*/
+const (
+	REPLY_PREFIX         = "reply:"         // prefixes the recipients of replies (see ReplyRecipient())
+	CALL_ATTEMPTS        = 3                // how often Call() sends a request before giving up
+	CALL_ATTEMPT_TIMEOUT = 30 * time.Second // how long Call() waits for a reply to each attempt
+)
+
+var (
+	replyTypes      = map[MessageType]MessageType{TYPE_CERT_REQUEST: TYPE_CERT_RESPONSE} // reply types by request type
+	replyTypesMutex sync.RWMutex                                                         // used to synchronize access to replyTypes
+)
+
+// RegisterRPC() registers replyType as the type of replies to requests of
+// requestType.
+func RegisterRPC(requestType MessageType, replyType MessageType) {
+	replyTypesMutex.Lock()
+	defer replyTypesMutex.Unlock()
+	replyTypes[requestType] = replyType
+}
+
+// replyType() returns the type of replies to requests of the given type, if
+// it's a request type.
+func replyType(requestType MessageType) (MessageType, bool) {
+	replyTypesMutex.RLock()
+	defer replyTypesMutex.RUnlock()
+	t, found := replyTypes[requestType]
+	return t, found
+}
+
+/*
+ReplyRecipient() returns the recipient to which the reply to the given request
+is addressed.  Certificate requests keep using CertResponseRecipient() so that
+we stay compatible with nodes that predate Call().
+*/
+func ReplyRecipient(request Message) string {
+	if request.Type == TYPE_CERT_REQUEST {
+		return CertResponseRecipient(request.ID)
+	}
+	return REPLY_PREFIX + request.ID
+}
+
+/*
+Call() sends the given request and waits for the reply, retrying as described
+above.  Fails if the request's type hasn't been registered with RegisterRPC(),
+if the context is done before a reply arrives or if none of the attempts are
+answered.
+*/
+func Call(ctx context.Context, request Message) (Message, error) {
+	t, found := replyType(request.Type)
+	if !found {
+		return Message{}, fmt.Errorf("Not a request type: %d", request.Type)
+	}
+	attempts := make([]Message, CALL_ATTEMPTS)
+	recipients := make([]string, CALL_ATTEMPTS)
+	for i := range attempts {
+		attempts[i] = request
+		attempts[i].ID = newMessageID()
+		recipients[i] = ReplyRecipient(attempts[i])
+	}
+	// Subscribe before sending anything so that we can't miss a quick reply
+	replies := SubscribeTo(Filter{Types: []MessageType{t}, Recipients: recipients}, 1)
+	defer replies.Close()
+
+	for _, attempt := range attempts {
+		if err := SendContext(ctx, attempt); err != nil {
+			return Message{}, err
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, CALL_ATTEMPT_TIMEOUT)
+		reply, err := replies.Recv(attemptCtx)
+		cancel()
+		if err == nil {
+			return reply, nil
+		}
+		if ctx.Err() != nil {
+			return Message{}, ctx.Err()
+		}
+	}
+	return Message{}, fmt.Errorf("No reply after %d attempts", CALL_ATTEMPTS)
+}
+
+// Reply() sends a reply with the given data to the given request.
+func Reply(request Message, data string) error {
+	t, found := replyType(request.Type)
+	if !found {
+		return fmt.Errorf("Not a request type: %d", request.Type)
+	}
+	Send(Message{Recp: ReplyRecipient(request), Type: t, Data: data})
+	return nil
+}
@@ -20,14 +20,15 @@ they authenticate against the Lantern network differs.
 Let as assume the following tree of lantern nodes.
 
 root
-  1
-    1.1
-    1.2
-      1.2.1
-      1.2.2 (a@gmail.com)
-  2
-    2.1
-    2.2 (b@yahoo.com)
+
+	1
+	  1.1
+	  1.2
+	    1.2.1
+	    1.2.2 (a@gmail.com)
+	2
+	  2.1
+	  2.2 (b@yahoo.com)
 
 - 1 is the parent of 1.1
 - 1.1 is a child of 1
@@ -77,11 +78,11 @@ any given node may or may not be online or reachable at any given moment, the
 signaling mechanism should be considered unreliable.  This has several
 implications:
 
-- lantern nodes need to be designed to function correctly whether or not
-  a message has gotten through.
-- because messages like presence notifications may not make it to all intended
-  recipients, they should be resent periodically.  This is a good idea anyway
-  because user nodes can come on and offline all the time.
+  - lantern nodes need to be designed to function correctly whether or not
+    a message has gotten through.
+  - because messages like presence notifications may not make it to all intended
+    recipients, they should be resent periodically.  This is a good idea anyway
+    because user nodes can come on and offline all the time.
 
 Also, because of the potential size of the network, messages should be kept
 small - this is not a mechanism for transferring large payloads, it's a
@@ -91,20 +92,20 @@ Trust and Authentication
 ------------------------
 Nodes trust each other based on a scheme that combines PKI and Mozilla Persona.
 
-- All children trust their parents based on a certificate distributed to the
-  child via some out-of-band mechanism (e.g. email)
-- Parents trust child master nodes based on them presenting a master-level
-  certificate signed by the parent.
-- Parents initially trust child user nodes based on them presenting a
-  Mozilla Persona identity assertion which the parent is able to verify with
-  Mozilla Persona.  After the initial authentication of the child, the parent
-  issues a certificate to the child that is tied to the child's email address.
-  In particular, the CN of the certificate contains the child's email address,
-  encrypted by the parent so that only the parent can read it.  On subsequent
-  requests to the parent, the child is identified by this certificate.
-- Master nodes maintain certificate revocation lists that allow them to revoke
-  any certificates that they have previously issued, both to other master nodes
-  and to child nodes.
+  - All children trust their parents based on a certificate distributed to the
+    child via some out-of-band mechanism (e.g. email)
+  - Parents trust child master nodes based on them presenting a master-level
+    certificate signed by the parent.
+  - Parents initially trust child user nodes based on them presenting a
+    Mozilla Persona identity assertion which the parent is able to verify with
+    Mozilla Persona.  After the initial authentication of the child, the parent
+    issues a certificate to the child that is tied to the child's email address.
+    In particular, the CN of the certificate contains the child's email address,
+    encrypted by the parent so that only the parent can read it.  On subsequent
+    requests to the parent, the child is identified by this certificate.
+  - Master nodes maintain certificate revocation lists that allow them to revoke
+    any certificates that they have previously issued, both to other master nodes
+    and to child nodes.
 
 All of the certificate management stuff is implemented by package
 lantern/keystore.
@@ -114,141 +115,470 @@ All of the Mozilla Persona stuff is implemented by the package lantern/persona.
 package signaling
 
 import (
-//	"crypto/tls"
+	"bufio"
+	"context"
+	"crypto/tls"
 	"crypto/x509"
-//	"encoding/json"
-//	"github.com/oxtoacart/ftcp"
+	"fmt"
 	"lantern/config"
+	"lantern/keys"
+	"lantern/util"
 	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type MessageType uint8
 
 const (
-	TYPE_CERT_REQUEST   = 1 // request a cert
-	TYPE_CERT_RESPONSE  = 2 // response to a request for a cert
-	TYPE_REGISTRATION   = 3 // registration of a new email address
-	TYPE_DEREGISTRATION = 4 // deregistration of an email address
+	TYPE_CERT_REQUEST      = 1  // request a cert
+	TYPE_CERT_RESPONSE     = 2  // response to a request for a cert
+	TYPE_REGISTRATION      = 3  // registration of a new email address (Recp)
+	TYPE_DEREGISTRATION    = 4  // deregistration of an email address (Recp)
+	TYPE_BLOCKLIST_DELTA   = 5  // signed changes to the blocklist, pushed down from a parent
+	TYPE_KEEPALIVE         = 6  // reserved, keepalives are empty frames rather than messages (see transport.go)
+	TYPE_FEATURE_POLICY    = 7  // signed feature flag policy, pushed down from a parent
+	TYPE_HEARTBEAT         = 8  // batched presence, stats and acks from a child (see heartbeat.go)
+	TYPE_INTRO_REQUEST     = 9  // request to be introduced to a give-mode peer
+	TYPE_INTRO_OFFER       = 10 // anonymized introduction offer to a give-mode peer
+	TYPE_INTRO_RESPONSE    = 11 // give-mode peer's acceptance or rejection of an offer
+	TYPE_INTRO_REVEAL      = 12 // identities and candidates revealed after acceptance
+	TYPE_TRACE             = 13 // trace message recording the path it takes (see trace.go)
+	TYPE_TRACE_REPLY       = 14 // reply to a trace message, carrying the recorded path
+	TYPE_ARTIFACT_MANIFEST = 15 // signed manifest of the artifacts offered by a parent
+	TYPE_ARTIFACT_FETCH    = 16 // request for a chunk of an artifact from a child
+	TYPE_ARTIFACT_CHUNK    = 17 // chunk of an artifact in response to TYPE_ARTIFACT_FETCH
+	TYPE_USAGE_REPORT      = 18 // signed usage report for a child's subtree (see package lantern/accounting)
+	TYPE_PARENT_CERT       = 19 // replacement parent certificate signed by the parent's current key
+	TYPE_CONFIG_FRAGMENT   = 20 // signed configuration fragment, pushed down from a parent (see package lantern/parentconfig)
+	TYPE_DRAIN             = 21 // signed notice that the parent is draining, naming an alternate parent (see package lantern/drain)
+	TYPE_REPUTATION_REPORT = 22 // signed report of an abusive client or a broken or malicious exit (see package lantern/reputation)
 )
 
+/*
+Message is a message sent over the signaling channel.  See wire.go for how
+Messages are encoded on the wire.
+*/
 type Message struct {
-	Recp   string      // the recipient email address
-	Type   MessageType // the type of message
-	Sender string      // the sender of the message based on its certificate
+	Recp       string      // the recipient email address
+	Type       MessageType // the type of message
+	Sender     string      // the sender of the message based on its certificate
+	Data       string      // the JSON encoded payload of the message
+	ID         string      `json:",omitempty"` // unique id of the message, used to suppress duplicates
+	TTL        uint8       `json:",omitempty"` // number of hops that the message may still travel
+	SenderNode string      `json:",omitempty"` // the NodeID of the sender based on its certificate (see keys.NodeID())
 }
 
 type MessageBus interface {
 	Send(m Message)
 
+	SendContext(ctx context.Context, m Message) error
+
 	RecvAt(receiver chan Message)
+
+	RecvMatching(receiver chan Message, filter Filter)
+
+	Subscribe(buffer int) *Subscription
+
+	SubscribeTo(filter Filter, buffer int) *Subscription
 }
 
 var (
-	// Channels that receive new messages sent via the signaling bus
-	receivers = make([]chan Message, 0)
-
 	// Channel for sending messages to the signaling bus
-	messages = make(chan Message)
-
-	// Channel for receiving requests to register receivers
-	registrations = make(chan chan Message)
+	messages = make(chan Message, SEND_BUFFER)
 
 	// Channel for receiving restart requests
 	restart = make(chan Message)
+
+	// Makes sure that we start only once
+	startOnce sync.Once
 )
 
+func init() {
+	Start(keys.TrustedParents)
+}
+
 /*
-Send sends a Message to the Lantern network.
+Send sends a Message to the Lantern network, dropping it if it can't be queued
+within SEND_TIMEOUT (see bus.go).
 */
 func Send(m Message) {
-	messages <- m
+	ctx, cancel := context.WithTimeout(context.Background(), SEND_TIMEOUT)
+	defer cancel()
+	if err := SendContext(ctx, m); err != nil {
+		log.Printf("Dropping message of type %d for %s: %s", m.Type, m.Recp, err)
+	}
 }
 
 /*
 RecvAt allows one to register to receive messages through the
-supplied channel.
+supplied channel.  Messages are delivered like they are to a Subscription, so
+a receiver that doesn't keep up misses messages.
 */
 func RecvAt(receiver chan Message) {
-	registrations <- receiver
+	subscribe(receiver, Filter{})
 }
 
 /*
-Start starts the signaling channel.
+Start starts the signaling channel, which happens as soon as this package is
+loaded.  Starting it again does nothing.
 */
 func Start(rootCAs *x509.CertPool) {
-	go connect(rootCAs)
-	go listen(rootCAs)
-	log.Printf("Listening for signaling connections at: %s", config.SignalingAddress())
+	startOnce.Do(func() {
+		util.GoLoop("signaling router", routeOutgoing)
+		util.GoLoop("signaling history", expireHistory)
+		go connect(rootCAs)
+		util.GoLoop("heartbeats", heartbeats)
+		if config.JustMigrated() && config.Email() != "" {
+			// We're likely reachable through a new route, let our parent know
+			log.Printf("Refreshing presence of %s after migration", config.Email())
+			QueuePresence(config.Email())
+		}
+		if !config.Runs(config.SUBSYSTEM_SIGNALING_LISTENER) {
+			log.Printf("Not listening for signaling connections as %s", config.Subcommand())
+			return
+		}
+		listen()
+		log.Printf("Listening for signaling connections at: %s", config.SignalingBindAddress())
+	})
 }
 
 /*
-connect connects to our parent.
+connect, meant to be run as a goroutine, keeps us connected to our parent at
+config.ParentAddress(), connecting again RECONNECT_INTERVAL after the
+connection fails or right away when asked to (see Reconnect()).  Root nodes
+keep checking whether they got a parent.
+
+Until we have a certificate, we connect without one, so that we can request one
+over the signaling channel (see package lantern/issuance).  Once we get it, we
+connect again to present it.
 */
 func connect(rootCAs *x509.CertPool) {
-//	tlsConfig := &tls.Config{RootCAs: rootCAs}
-//	if conn, err := ftcp.DialTLS(config.ParentAddress(), tlsConfig); err != nil {
-//		log.Fatalf("Unable to connect to parent {}: {}", config.ParentAddress(), err)
-//	} else {
-//		go func() {
-//			for {
-//				select {
-//				case msg := <-messages:
-//					if bytes, err := json.Marshal(msg); err != nil {
-//						log.Printf("Unable to write message to parent: {}", err)
-//					} else {
-//						if err := conn.Write(bytes); err != nil {
-//							log.Printf("Unable to write message to parent: {}", err)
-//						}
-//					}
-//				}
-//			}
-//		}()
-//	}
+	tlsConfig := keys.SecurePeerConfig(&tls.Config{
+		RootCAs:              rootCAs,
+		GetClientCertificate: clientCertificate,
+	})
+	for {
+		parentAddress := config.ParentAddress()
+		if parentAddress == "" {
+			time.Sleep(RECONNECT_INTERVAL)
+			continue
+		}
+		_, certChannel := keys.Certificate()
+		parent, err := dialParent(parentAddress, tlsConfig)
+		if err != nil {
+			log.Printf("Unable to connect to parent %s: %s", parentAddress, err)
+			time.Sleep(RECONNECT_INTERVAL)
+			continue
+		}
+		log.Printf("Connected to parent %s, which speaks protocol version %d", parentAddress, parent.version)
+		if !serveParent(parent, certChannel) {
+			time.Sleep(RECONNECT_INTERVAL)
+		}
+	}
+}
+
+// clientCertificate() presents our certificate to our parent, or no
+// certificate at all if we don't have one yet.
+func clientCertificate(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if cert, _ := keys.Certificate(); cert == nil {
+		return &tls.Certificate{}, nil
+	}
+	return keys.GetClientCertificate(info)
+}
+
+/*
+dialParent() connects to our parent at the given address and upgrades the
+connection to a signaling connection (see transport.go).
+*/
+func dialParent(parentAddress string, tlsConfig *tls.Config) (*peerConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), HANDSHAKE_TIMEOUT)
+	defer cancel()
+	conn, err := util.DialHappyEyeballs(ctx, []string{parentAddress})
+	if err != nil {
+		return nil, err
+	}
+	parentConfig := tlsConfig.Clone()
+	parentConfig.ServerName, _, _ = net.SplitHostPort(parentAddress)
+	tlsConn := tls.Client(conn, parentConfig)
+	tlsConn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+
+	req, err := http.NewRequest("GET", "https://"+parentAddress+PATH, nil)
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", UPGRADE_PROTOCOL)
+	req.Header.Set("Accept", CONTENT_TYPE_BINARY+", "+CONTENT_TYPE_JSON)
+	req.Header.Set(X_LANTERN_SIGNALING_VERSION, strconv.Itoa(PROTOCOL_VERSION))
+	if err := req.Write(tlsConn); err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(tlsConn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		tlsConn.Close()
+		return nil, fmt.Errorf("Parent refused signaling connection: %s", resp.Status)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	version := peerVersion(resp.Header)
+	format := NegotiateFormat([]string{resp.Header.Get("Content-Type")})
+	return newPeerConn(tlsConn, reader, version, format), nil
+}
+
+/*
+serveParent() relays messages between us and our parent until the connection
+fails or has to be made again, because we were asked to reconnect or because
+the given channel delivers our new certificate.  Returns true in the latter
+cases.
+*/
+func serveParent(parent *peerConn, certChannel <-chan *x509.Certificate) bool {
+	SetParentProtocolVersion(parent.version)
+	setParent(parent)
+	defer setParent(nil)
+	defer parent.close()
+
+	failed := make(chan error, 1)
+	go func() {
+		failed <- readFromParent(parent)
+	}()
+	select {
+	case <-restart:
+		// Connect again, possibly to another parent
+		return true
+	case <-certChannel:
+		log.Print("Got a certificate, connecting to our parent again to present it")
+		return true
+	case err := <-failed:
+		log.Printf("Lost connection to parent: %s", err)
+		return false
+	}
+}
+
+// readFromParent() handles the messages from our parent until the connection
+// fails.
+func readFromParent(parent *peerConn) error {
+	for {
+		if parent.version >= KEEPALIVE_PROTOCOL_VERSION {
+			// Parents that send keepalives are never silent for long
+			parent.conn.SetReadDeadline(time.Now().Add(PARENT_IDLE_TIMEOUT))
+		}
+		frame, err := readFrame(parent.reader)
+		if err != nil {
+			return err
+		}
+		if len(frame) == 0 {
+			// A keepalive
+			continue
+		}
+		msg, err := Decode(frame)
+		if err != nil {
+			log.Printf("Rejecting invalid message from parent: %s", err)
+			continue
+		}
+		if parent.version < DEDUP_PROTOCOL_VERSION {
+			adopt(msg)
+		}
+		if !admit(msg) {
+			continue
+		}
+		annotateTrace(msg)
+		routeFromParent(*msg)
+	}
+}
+
+/*
+listen has children's signaling connections accepted on the server at our
+signaling address (see keys.HandlePeers()), which requests but doesn't require
+client certificates, so that children can request their first certificate over
+the signaling channel.
+*/
+func listen() {
+	keys.HandlePeers(PATH, serveChild)
+}
+
+/*
+serveChild() upgrades a connection from a child to a signaling connection and
+relays messages between us and the child until either side closes it.  The
+child's messages are subject to its quotas (see quotas.go), deduplicated (see
+dedup.go) and authorized (see auth.go) before we handle or pass them on.
+*/
+func serveChild(resp http.ResponseWriter, req *http.Request) {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), UPGRADE_PROTOCOL) || req.TLS == nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Expected an upgrade to " + UPGRADE_PROTOCOL))
+		return
+	}
+	child := newChildID(req.RemoteAddr)
+	ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+	if err := admitChild(child, ip); err != nil {
+		log.Printf("Rejecting child %s: %s", child, err)
+		status := 503
+		if quotaErr, ok := err.(*QuotaError); ok {
+			status = quotaErr.Status
+		}
+		resp.WriteHeader(status)
+		resp.Write([]byte(err.Error()))
+		return
+	}
+	defer releaseChild(child)
+	hijacker, ok := resp.(http.Hijacker)
+	if !ok {
+		resp.WriteHeader(500)
+		resp.Write([]byte("Unable to upgrade connection"))
+		return
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("Unable to upgrade connection from %s: %s", child, err)
+		return
+	}
+	defer conn.Close()
+	peerCertificates := req.TLS.PeerCertificates
+	if err := trackChild(child, peerCertificates, conn.Close); err != nil {
+		log.Printf("Rejecting child %s: %s", child, err)
+		writeUpgradeResponse(buffered.Writer, "403 Forbidden", http.Header{})
+		return
+	}
+	defer untrackChild(child)
+	version := peerVersion(req.Header)
+	format := NegotiateFormat(strings.Split(strings.Replace(req.Header.Get("Accept"), " ", "", -1), ","))
+	header := http.Header{}
+	header.Set("Connection", "Upgrade")
+	header.Set("Upgrade", UPGRADE_PROTOCOL)
+	header.Set("Content-Type", ContentType(format))
+	header.Set(X_LANTERN_SIGNALING_VERSION, strconv.Itoa(PROTOCOL_VERSION))
+	conn.SetWriteDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	if err := writeUpgradeResponse(buffered.Writer, "101 Switching Protocols", header); err != nil {
+		log.Printf("Unable to upgrade connection from %s: %s", child, err)
+		return
+	}
+	peer := newPeerConn(conn, buffered.Reader, version, format)
+	defer peer.close()
+	addChild(child, peer)
+	defer removeChild(child)
+	defer forgetChild(child)
+	defer forgetNode(child)
+	defer forgetCapabilities(child)
+
+	for {
+		if version >= HEARTBEAT_PROTOCOL_VERSION {
+			// Children that send heartbeats are never silent for long
+			conn.SetReadDeadline(time.Now().Add(CHILD_IDLE_TIMEOUT))
+		}
+		frame, err := readFrame(peer.reader)
+		if err != nil {
+			log.Printf("Closing connection from %s: %s", child, err)
+			return
+		}
+		countChildBytes(child, len(frame))
+		if err := allowMessage(child); err != nil {
+			log.Printf("Dropping message from %s: %s", child, err)
+			continue
+		}
+		if len(frame) == 0 {
+			// A keepalive
+			continue
+		}
+		msg, err := Decode(frame)
+		if err != nil {
+			log.Printf("Rejecting invalid message from %s: %s", child, err)
+			continue
+		}
+		if version < DEDUP_PROTOCOL_VERSION {
+			adopt(msg)
+		}
+		if !admit(msg) {
+			continue
+		}
+		if err := authorize(msg, peerCertificates); err != nil {
+			log.Printf("Rejecting unauthorized message from %s: %s", child, err)
+			continue
+		}
+		recordNode(child, msg.SenderNode)
+		annotateTrace(msg)
+		if _, isRequest := replyType(msg.Type); isRequest {
+			register(child, []string{ReplyRecipient(*msg)})
+		}
+		if err := updateRegistrations(child, msg); err != nil {
+			log.Printf("Rejecting registration from %s: %s", child, err)
+			continue
+		}
+		routeFromChild(child, *msg)
+	}
+}
+
+// writeUpgradeResponse() answers an upgrade request on a hijacked connection.
+func writeUpgradeResponse(w *bufio.Writer, status string, header http.Header) error {
+	w.WriteString("HTTP/1.1 " + status + "\r\n")
+	header.Write(w)
+	w.WriteString("\r\n")
+	return w.Flush()
+}
+
+// peerVersion() returns the protocol version in the given handshake headers,
+// which nodes that predate the header speak implicitly.
+func peerVersion(header http.Header) int {
+	version, err := strconv.Atoi(header.Get(X_LANTERN_SIGNALING_VERSION))
+	if err != nil || version < 1 {
+		return 1
+	}
+	return version
 }
 
 /*
-listen listens for new connections from clients
+updateRegistrations() applies the registrations, deregistrations and presence
+refreshes in the given message from the given child, counting them against the
+child's quota.
 */
-func listen(rootCAs *x509.CertPool) {
-//	tlsConfig := &tls.Config{
-//		ClientCAs:  rootCAs,
-//		ClientAuth: tls.RequestClientCert,
-//	}
-//	listener, err := ftcp.ListenTLS(config.SignalingAddress(), tlsConfig)
-//	if err != nil {
-//		log.Fatalf("Unable to listen for connections at {}: {}", config.SignalingAddress(), err)
-//	}
-//
-//	newConns := make(chan *ftcp.Conn)
-//
-//	// accept connections
-//	go func() {
-//		conn, err := listener.Accept()
-//		if err == nil {
-//			newConns <- conn
-//		}
-//	}()
-//
-//	for {
-//		select {
-//		case conn := <-newConns:
-//			// Continuously read from client connection
-//			go func() {
-//				defer conn.Close()
-//				for {
-//					if wrappedMsg, err := conn.Read(); err == nil {
-//						msg := Message{}
-//						json.Unmarshal(wrappedMsg.Data, &msg)
-//						for _, receiver := range receivers {
-//							receiver <- msg
-//						}
-//					} else {
-//						return
-//					}
-//				}
-//			}()
-//		case receiver := <-registrations:
-//			receivers = append(receivers, receiver)
-//		}
-//	}
+func updateRegistrations(child string, msg *Message) error {
+	switch msg.Type {
+	case TYPE_REGISTRATION:
+		patterns, err := registrationPatterns(msg)
+		if err != nil {
+			return err
+		}
+		if err := allowRegistrations(child, patterns); err != nil {
+			return err
+		}
+		register(child, patterns)
+		replay(child, patterns)
+		if capabilities := registrationCapabilities(msg); capabilities != nil {
+			recordCapabilities(child, *capabilities)
+		}
+	case TYPE_DEREGISTRATION:
+		patterns, err := registrationPatterns(msg)
+		if err != nil {
+			return err
+		}
+		releaseRegistrations(child, patterns)
+		deregister(child, patterns)
+	case TYPE_HEARTBEAT:
+		heartbeat, err := decodeHeartbeat(msg)
+		if err != nil {
+			return err
+		}
+		if err := allowRegistrations(child, heartbeat.Presence); err != nil {
+			return err
+		}
+		register(child, heartbeat.Presence)
+		replay(child, heartbeat.Presence)
+		if heartbeat.Load != nil {
+			recordLoad(child, *heartbeat.Load)
+		}
+		if heartbeat.Capabilities != nil {
+			recordCapabilities(child, *heartbeat.Capabilities)
+		}
+	}
+	return nil
 }
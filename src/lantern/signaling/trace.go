@@ -0,0 +1,54 @@
+/*
+This file contains the hop annotation for trace messages (TYPE_TRACE).
+
+When trace mode is enabled (config.TraceEnabled()), every node that forwards a
+trace message appends a TraceHop describing itself to the message's payload.
+Nodes without trace mode forward trace messages untouched, so gaps in the
+recorded path point at nodes that either don't have trace mode on or dropped
+the message.
+
+See package lantern/trace for injecting traces and collecting the results.
+*/
+package signaling
+
+import (
+	"encoding/json"
+	"lantern/config"
+	"lantern/keys"
+	"log"
+	"time"
+)
+
+// TraceHop records a single node that a trace message passed through.
+type TraceHop struct {
+	Node string    // the NodeID of the node (see keys.NodeID())
+	At   time.Time // when the node saw the message
+	TTL  uint8     // the TTL of the message when the node saw it
+}
+
+// TracePayload is the payload of TYPE_TRACE and TYPE_TRACE_REPLY messages.
+type TracePayload struct {
+	ID     string     // id of the trace, used to match replies
+	Origin string     // email of the node that started the trace
+	Hops   []TraceHop // the hops recorded so far
+}
+
+// annotateTrace() appends a hop for this node to a trace message that we're
+// forwarding, if trace mode is enabled.
+func annotateTrace(msg *Message) {
+	if msg.Type != TYPE_TRACE || !config.TraceEnabled() {
+		return
+	}
+	payload := &TracePayload{}
+	if err := json.Unmarshal([]byte(msg.Data), payload); err != nil {
+		log.Printf("Unable to annotate trace: %s", err)
+		return
+	}
+	payload.Hops = append(payload.Hops, TraceHop{Node: keys.NodeID(), At: time.Now(), TTL: msg.TTL})
+	data, err := json.Marshal(payload)
+	if err != nil || len(data) > MAX_DATA_LENGTH {
+		log.Printf("Unable to annotate trace, leaving it as is")
+		return
+	}
+	msg.Data = string(data)
+}
@@ -0,0 +1,355 @@
+/*
+This file contains the transport that carries Messages between parents and
+children.
+
+Children connect to their parent's signaling address over TLS and ask the
+server there (see keys.HandlePeers()) to switch the connection at PATH to the
+UPGRADE_PROTOCOL.  The upgrade request and its 101 response carry the protocol
+version that each side speaks (X_LANTERN_SIGNALING_VERSION) and the content
+types that the child understands and the parent picked (see
+NegotiateFormat()).  From then on, each Message travels as a frame consisting
+of the length of the encoded Message as 4 big-endian bytes followed by the
+encoded Message (see wire.go).
+
+A frame of length 0 is a keepalive.  Each side of a connection that speaks
+KEEPALIVE_PROTOCOL_VERSION or later writes one when it hasn't written anything
+for KEEPALIVE_INTERVAL, so that the connection keeps carrying traffic in both
+directions.  Children give up on a parent that has been silent for
+PARENT_IDLE_TIMEOUT and connect again, instead of waiting for TCP to notice
+that a NAT along the way dropped the connection, and parents give up on
+children that have been silent for CHILD_IDLE_TIMEOUT.  In practice, children
+are rarely idle, since they send heartbeats (see heartbeat.go) at the same
+interval.
+
+The keepalive interval is fixed rather than negotiated per connection: the
+heartbeats already refresh the NAT mappings along the path to the parent more
+often than NATs expire TCP mappings, and lantern doesn't punch holes for
+direct paths between peers, whose UDP mappings would need shorter, adaptive
+intervals.  Adaptive keepalive negotiation (probing the mapping lifetime,
+coordinating the interval through TYPE_KEEPALIVE messages and backing off on
+battery) was declined for that reason.
+
+Every connection has a queue of PEER_SEND_BUFFER outgoing messages.  Messages
+for a peer that doesn't keep up are dropped rather than holding up the bus,
+just like messages for our parent are dropped while we aren't connected to it.
+
+Messages are routed by type and recipient:
+
+  - downTypes are pushed down by a parent to all of its children.  Children
+    handle them but don't pass them on, it's up to them to publish their own.
+  - controlTypes (registrations and heartbeats) only ever go to the parent.
+  - Messages without a recipient go to the parent, which handles them.
+  - Messages with a recipient go to the children registered for it (see
+    route()), or up to the parent if there are none.  A node handles the
+    messages for its own email address, and messages for which its parent found
+    no child of ours to pass them on to, like the replies to its requests.
+    Messages that can't go anywhere are kept for a while (see history.go).
+*/
+package signaling
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"lantern/config"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PATH                        = "/signaling"                  // the path at which parents accept signaling connections
+	UPGRADE_PROTOCOL            = "lantern-signaling"           // the protocol to which signaling connections are upgraded
+	X_LANTERN_SIGNALING_VERSION = "X-Lantern-Signaling-Version" // the header carrying the protocol version of each side
+	FRAME_HEADER_SIZE           = 4                             // the size of the length that prefixes each frame
+	PEER_SEND_BUFFER            = 100                           // outgoing messages that are queued per connection
+	HANDSHAKE_TIMEOUT           = 30 * time.Second              // how long the upgrade may take
+	WRITE_TIMEOUT               = 30 * time.Second              // how long writing a single frame may take
+	CHILD_IDLE_TIMEOUT          = 3 * HEARTBEAT_INTERVAL        // how long a child that sends heartbeats may stay silent
+	KEEPALIVE_INTERVAL          = HEARTBEAT_INTERVAL            // how long a connection may be idle before we write a keepalive
+	PARENT_IDLE_TIMEOUT         = 3 * KEEPALIVE_INTERVAL        // how long a parent that sends keepalives may stay silent
+	RECONNECT_INTERVAL          = 10 * time.Second              // how long we wait before connecting to our parent again
+)
+
+// downTypes are the types of messages that parents push down to all of their
+// children.
+var downTypes = map[MessageType]bool{
+	TYPE_BLOCKLIST_DELTA:   true,
+	TYPE_FEATURE_POLICY:    true,
+	TYPE_ARTIFACT_MANIFEST: true,
+	TYPE_PARENT_CERT:       true,
+	TYPE_CONFIG_FRAGMENT:   true,
+	TYPE_DRAIN:             true,
+}
+
+// controlTypes are the types of messages that children send to maintain their
+// registrations with their parent.
+var controlTypes = map[MessageType]bool{
+	TYPE_REGISTRATION:   true,
+	TYPE_DEREGISTRATION: true,
+	TYPE_HEARTBEAT:      true,
+}
+
+// peerConn is a signaling connection to our parent or to one of our children.
+type peerConn struct {
+	conn      net.Conn      // the underlying connection
+	reader    *bufio.Reader // reads frames from conn
+	version   int           // the protocol version spoken by the other side
+	format    byte          // the negotiated wire format
+	out       chan Message  // messages waiting to be written
+	done      chan bool     // closed once the connection is closed
+	closeOnce sync.Once     // makes sure that done is closed only once
+}
+
+var (
+	parentConn  *peerConn                    // our connection to our parent, nil while we aren't connected
+	childConns  = make(map[string]*peerConn) // connections to our children, by child
+	connsMutex  sync.RWMutex                 // used to synchronize access to parentConn and childConns
+	lastChildID uint64                       // the number of the last connection ID handed out (see newChildID()), accessed atomically
+)
+
+/*
+newChildID() returns a new connection ID for a child connecting from the given
+address.  The registry of our children (childConns and the maps in routes.go,
+children.go and quotas.go) is keyed by connection ID, and each connection gets
+a different one even if a child reconnects from the same address, so that the
+cleanup of an old connection never removes a newer one.
+*/
+func newChildID(address string) string {
+	return fmt.Sprintf("%s#%d", address, atomic.AddUint64(&lastChildID, 1))
+}
+
+// newPeerConn() starts writing queued messages to the given connection.
+func newPeerConn(conn net.Conn, reader *bufio.Reader, version int, format byte) *peerConn {
+	peer := &peerConn{
+		conn:    conn,
+		reader:  reader,
+		version: version,
+		format:  format,
+		out:     make(chan Message, PEER_SEND_BUFFER),
+		done:    make(chan bool),
+	}
+	go peer.write()
+	return peer
+}
+
+// send() queues the given message for the other side, dropping it if the
+// queue is full or if the message can't travel any further.
+func (peer *peerConn) send(msg Message) {
+	if msg.TTL == 0 {
+		return
+	}
+	select {
+	case peer.out <- msg:
+	default:
+		log.Printf("Dropping message of type %d for %s, %s isn't keeping up", msg.Type, msg.Recp, peer.conn.RemoteAddr())
+	}
+}
+
+/*
+write() writes queued messages until the connection is closed, and keepalives
+while there are none if the other side understands them.
+*/
+func (peer *peerConn) write() {
+	keepalives := time.NewTicker(KEEPALIVE_INTERVAL)
+	defer keepalives.Stop()
+	lastWrite := time.Now()
+	for {
+		select {
+		case <-peer.done:
+			return
+		case <-keepalives.C:
+			if peer.version < KEEPALIVE_PROTOCOL_VERSION || time.Since(lastWrite) < KEEPALIVE_INTERVAL {
+				continue
+			}
+			peer.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+			if err := writeFrame(peer.conn, nil); err != nil {
+				log.Printf("Unable to write keepalive to %s: %s", peer.conn.RemoteAddr(), err)
+				peer.close()
+				return
+			}
+			lastWrite = time.Now()
+		case msg := <-peer.out:
+			forPeer := msg.ForVersion(peer.version)
+			frame, err := EncodeAs(&forPeer, peer.format)
+			if err != nil {
+				log.Printf("Unable to encode message of type %d: %s", msg.Type, err)
+				continue
+			}
+			peer.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+			if err := writeFrame(peer.conn, frame); err != nil {
+				log.Printf("Unable to write message to %s: %s", peer.conn.RemoteAddr(), err)
+				peer.close()
+				return
+			}
+			lastWrite = time.Now()
+		}
+	}
+}
+
+// close() closes the connection.  Closing twice is harmless.
+func (peer *peerConn) close() error {
+	peer.closeOnce.Do(func() {
+		close(peer.done)
+	})
+	return peer.conn.Close()
+}
+
+// writeFrame() writes the given encoded message as a single frame.
+func writeFrame(w io.Writer, encoded []byte) error {
+	frame := make([]byte, FRAME_HEADER_SIZE, FRAME_HEADER_SIZE+len(encoded))
+	binary.BigEndian.PutUint32(frame, uint32(len(encoded)))
+	_, err := w.Write(append(frame, encoded...))
+	return err
+}
+
+// readFrame() reads a single frame, refusing frames larger than
+// MAX_MESSAGE_SIZE before reading them.
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, FRAME_HEADER_SIZE)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > MAX_MESSAGE_SIZE {
+		return nil, fmt.Errorf("Frame too large: %d bytes", length)
+	}
+	encoded := make([]byte, length)
+	if _, err := io.ReadFull(r, encoded); err != nil {
+		return nil, err
+	}
+	return encoded, nil
+}
+
+// setParent() records our connection to our parent (nil once it's gone).
+func setParent(parent *peerConn) {
+	connsMutex.Lock()
+	defer connsMutex.Unlock()
+	parentConn = parent
+}
+
+// addChild() records the connection to the given child.
+func addChild(child string, peer *peerConn) {
+	connsMutex.Lock()
+	defer connsMutex.Unlock()
+	childConns[child] = peer
+}
+
+// removeChild() forgets the connection to the given child.
+func removeChild(child string) {
+	connsMutex.Lock()
+	defer connsMutex.Unlock()
+	delete(childConns, child)
+}
+
+// sendToParent() sends the given message to our parent, if we're connected.
+// Returns false if we aren't.
+func sendToParent(msg Message) bool {
+	connsMutex.RLock()
+	defer connsMutex.RUnlock()
+	if parentConn == nil {
+		return false
+	}
+	parentConn.send(msg)
+	return true
+}
+
+// sendToChildren() sends the given message to the given children, or to all of
+// our children if children is nil.
+func sendToChildren(children []string, msg Message) {
+	connsMutex.RLock()
+	defer connsMutex.RUnlock()
+	if children == nil {
+		for _, peer := range childConns {
+			peer.send(msg)
+		}
+		return
+	}
+	for _, child := range children {
+		if peer, found := childConns[child]; found {
+			peer.send(msg)
+		}
+	}
+}
+
+// routeOutgoing(), meant to be run as a goroutine, routes the messages that we
+// send.
+func routeOutgoing() {
+	for msg := range messages {
+		switch {
+		case downTypes[msg.Type]:
+			sendToChildren(nil, msg)
+		case controlTypes[msg.Type] || msg.Recp == "":
+			sendToParent(msg)
+		default:
+			routeAddressed(msg, "", false)
+		}
+	}
+}
+
+// routeFromParent() handles or passes on a message that our parent sent us.
+func routeFromParent(msg Message) {
+	switch {
+	case downTypes[msg.Type]:
+		deliver(msg)
+	case controlTypes[msg.Type] || msg.Recp == "":
+		log.Printf("Ignoring message of type %d from our parent, it's meant for parents", msg.Type)
+	default:
+		routeAddressed(msg, "", true)
+	}
+}
+
+// routeFromChild() handles or passes on a message that the given child sent
+// us, once it has been authorized.
+func routeFromChild(child string, msg Message) {
+	switch {
+	case downTypes[msg.Type]:
+		log.Printf("Ignoring message of type %d from %s, only parents send it", msg.Type, child)
+	case controlTypes[msg.Type] || msg.Recp == "":
+		deliver(msg)
+	default:
+		routeAddressed(msg, child, false)
+	}
+}
+
+/*
+routeAddressed() handles or passes on a message with a recipient that either
+we're sending, that the given child sent us or that our parent sent us.
+*/
+func routeAddressed(msg Message, fromChild string, fromParent bool) {
+	if email := config.Email(); email != "" && msg.Recp == email {
+		deliver(msg)
+		return
+	}
+	if children := except(route(msg.Recp), fromChild); len(children) > 0 {
+		sendToChildren(children, msg)
+		if strings.HasPrefix(msg.Recp, REPLY_PREFIX) || strings.HasPrefix(msg.Recp, CERT_RESPONSE_PREFIX) {
+			// Replies are only expected once per request
+			forgetRecipient(msg.Recp)
+		}
+		return
+	}
+	if fromParent {
+		deliver(msg)
+		return
+	}
+	if !sendToParent(msg) {
+		// Nobody to pass it on to yet, see history.go
+		keep(msg)
+	}
+}
+
+// except() returns the given children without the given child.
+func except(children []string, child string) []string {
+	remaining := make([]string, 0, len(children))
+	for _, candidate := range children {
+		if candidate != child {
+			remaining = append(remaining, candidate)
+		}
+	}
+	return remaining
+}
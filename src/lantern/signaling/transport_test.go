@@ -0,0 +1,129 @@
+package signaling
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	_ "lantern/client/ephemeral"
+	"net"
+	"sync"
+	"testing"
+)
+
+const (
+	testGoroutines = 20  // the number of goroutines that use the registry at once
+	testRounds     = 100 // how often each of them connects, registers, sends and disconnects
+)
+
+// testPeer() returns a connection whose other side discards everything that
+// we write.
+func testPeer(t *testing.T) *peerConn {
+	ours, theirs := net.Pipe()
+	go io.Copy(io.Discard, theirs)
+	t.Cleanup(func() {
+		theirs.Close()
+	})
+	return newPeerConn(ours, bufio.NewReader(ours), PROTOCOL_VERSION, FORMAT_BINARY)
+}
+
+func TestChildIDsAreUnique(t *testing.T) {
+	var mutex sync.Mutex
+	seen := make(map[string]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < testGoroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < testRounds; j++ {
+				id := newChildID("127.0.0.1:1234")
+				mutex.Lock()
+				if seen[id] {
+					t.Errorf("Connection ID %s handed out twice", id)
+				}
+				seen[id] = true
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+/*
+TestConcurrentRegistry has children connect, register, receive messages,
+deregister and disconnect concurrently with messages being routed to them and
+to our parent coming and going, as they do in serveChild() and serveParent().
+Run it with -race.
+*/
+func TestConcurrentRegistry(t *testing.T) {
+	patterns := []string{"a@example.com", "*@example.com"}
+	msg := Message{Type: TYPE_INTRO_REQUEST, Recp: "a@example.com", Data: "{}", ID: newMessageID(), TTL: DEFAULT_TTL}
+
+	var wg sync.WaitGroup
+	for i := 0; i < testGoroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < testRounds; j++ {
+				child := newChildID("127.0.0.1:1234")
+				peer := testPeer(t)
+				addChild(child, peer)
+				register(child, patterns)
+				recordNode(child, child)
+				sendToChildren(route(msg.Recp), msg)
+				sendToChildren(nil, msg)
+				deregister(child, patterns)
+				forgetChild(child)
+				forgetNode(child)
+				removeChild(child)
+				peer.close()
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < testRounds; j++ {
+			parent := testPeer(t)
+			setParent(parent)
+			sendToParent(msg)
+			setParent(nil)
+			parent.close()
+		}
+	}()
+	wg.Wait()
+
+	if children := route(msg.Recp); len(children) > 0 {
+		t.Errorf("Expected no routes after all children disconnected, got %v", children)
+	}
+	connsMutex.RLock()
+	defer connsMutex.RUnlock()
+	if len(childConns) > 0 {
+		t.Errorf("Expected no connections after all children disconnected, got %d", len(childConns))
+	}
+}
+
+// TestKeepaliveFrames checks that keepalives travel as empty frames between
+// the messages around them.
+func TestKeepaliveFrames(t *testing.T) {
+	msg := Message{Type: TYPE_REGISTRATION, Recp: "a@example.com", ID: newMessageID(), TTL: DEFAULT_TTL}
+	encoded, err := EncodeAs(&msg, FORMAT_BINARY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	framed := &bytes.Buffer{}
+	for _, frame := range [][]byte{nil, encoded, nil} {
+		if err := writeFrame(framed, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader := bufio.NewReader(framed)
+	for i, expected := range []int{0, len(encoded), 0} {
+		frame, err := readFrame(reader)
+		if err != nil {
+			t.Fatalf("Unable to read frame %d: %s", i, err)
+		}
+		if len(frame) != expected {
+			t.Errorf("Expected frame %d to have %d bytes, got %d", i, expected, len(frame))
+		}
+	}
+}
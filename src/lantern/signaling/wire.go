@@ -0,0 +1,267 @@
+/*
+This file contains the canonical wire format for signaling Messages.
+
+On the wire, a Message is a single format byte followed by the encoded
+Message.  Two formats are supported:
+
+  - WIRE_VERSION (FORMAT_JSON): the JSON encoding of the Message.  All nodes
+    understand this format.
+  - FORMAT_BINARY: a compact binary encoding consisting of the type byte followed
+    by Recp, Sender, Data and ID, each prefixed by its length as a uvarint, and
+    finally the TTL byte.  A SenderNode, if any, follows the TTL byte, prefixed
+    by its length as a uvarint.  Messages without ID, TTL and SenderNode end
+    after Data, just like they did before DEDUP_PROTOCOL_VERSION.
+
+Nodes that predate NODE_ID_PROTOCOL_VERSION reject messages with a SenderNode,
+and nodes that predate DEDUP_PROTOCOL_VERSION reject messages with an ID or
+TTL, in either format (Decode() rejects unknown fields).  These fields are
+therefore stripped from messages for such nodes (see ForVersion()) and left out
+of the encoding when they're empty.
+
+Which format to use on a given connection is negotiated during the transport's
+handshake.  Each side offers the content types it understands (see
+CONTENT_TYPE_JSON and CONTENT_TYPE_BINARY) and NegotiateFormat() picks the
+most compact format that both sides support, falling back to JSON.  Decode()
+accepts either format regardless of what was negotiated.
+
+Messages are validated both when they are encoded and when they are decoded,
+and anything larger than MAX_MESSAGE_SIZE is rejected outright so that a
+misbehaving child can't tie up a master node with huge messages.
+*/
+package signaling
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	WIRE_VERSION  = 1            // the original version of the wire format (JSON)
+	FORMAT_JSON   = WIRE_VERSION // JSON encoding
+	FORMAT_BINARY = 2            // compact binary encoding
+)
+
+const (
+	MAX_MESSAGE_SIZE = 64 * 1024 // maximum size of an encoded message in bytes
+	MAX_EMAIL_LENGTH = 254       // maximum length of Recp and Sender
+	MAX_DATA_LENGTH  = 60 * 1024 // maximum length of Data
+	MAX_ID_LENGTH    = 64        // maximum length of ID
+	MAX_NODE_LENGTH  = 64        // maximum length of SenderNode
+)
+
+const (
+	CONTENT_TYPE_JSON   = "application/json"
+	CONTENT_TYPE_BINARY = "application/x-lantern-signaling"
+)
+
+// knownTypes are the MessageTypes that we accept on the wire.
+var knownTypes = map[MessageType]bool{
+	TYPE_CERT_REQUEST:      true,
+	TYPE_CERT_RESPONSE:     true,
+	TYPE_REGISTRATION:      true,
+	TYPE_DEREGISTRATION:    true,
+	TYPE_BLOCKLIST_DELTA:   true,
+	TYPE_FEATURE_POLICY:    true,
+	TYPE_HEARTBEAT:         true,
+	TYPE_INTRO_REQUEST:     true,
+	TYPE_INTRO_OFFER:       true,
+	TYPE_INTRO_RESPONSE:    true,
+	TYPE_INTRO_REVEAL:      true,
+	TYPE_TRACE:             true,
+	TYPE_TRACE_REPLY:       true,
+	TYPE_ARTIFACT_MANIFEST: true,
+	TYPE_ARTIFACT_FETCH:    true,
+	TYPE_ARTIFACT_CHUNK:    true,
+	TYPE_USAGE_REPORT:      true,
+	TYPE_PARENT_CERT:       true,
+	TYPE_CONFIG_FRAGMENT:   true,
+	TYPE_DRAIN:             true,
+	TYPE_REPUTATION_REPORT: true,
+}
+
+/*
+Validate() checks that the Message has a known type and that none of its fields
+exceed their maximum lengths.  Data, if present, has to be valid JSON.
+*/
+func (m *Message) Validate() error {
+	if !knownTypes[m.Type] {
+		return fmt.Errorf("Unknown message type: %d", m.Type)
+	}
+	if len(m.Recp) > MAX_EMAIL_LENGTH {
+		return fmt.Errorf("Recp too long: %d", len(m.Recp))
+	}
+	if len(m.Sender) > MAX_EMAIL_LENGTH {
+		return fmt.Errorf("Sender too long: %d", len(m.Sender))
+	}
+	if len(m.ID) > MAX_ID_LENGTH {
+		return fmt.Errorf("ID too long: %d", len(m.ID))
+	}
+	if len(m.SenderNode) > MAX_NODE_LENGTH {
+		return fmt.Errorf("SenderNode too long: %d", len(m.SenderNode))
+	}
+	if len(m.Data) > MAX_DATA_LENGTH {
+		return fmt.Errorf("Data too long: %d", len(m.Data))
+	}
+	if m.Data != "" && !json.Valid([]byte(m.Data)) {
+		return fmt.Errorf("Data is not valid JSON")
+	}
+	return nil
+}
+
+/*
+NegotiateFormat() picks the wire format to use given the content types offered
+by the other side.  Binary is preferred if the other side offers it, otherwise
+we fall back to JSON.
+*/
+func NegotiateFormat(offered []string) byte {
+	for _, contentType := range offered {
+		if contentType == CONTENT_TYPE_BINARY {
+			return FORMAT_BINARY
+		}
+	}
+	return FORMAT_JSON
+}
+
+// ContentType() returns the content type corresponding to the given format.
+func ContentType(format byte) string {
+	if format == FORMAT_BINARY {
+		return CONTENT_TYPE_BINARY
+	}
+	return CONTENT_TYPE_JSON
+}
+
+// Encode() validates the given Message and encodes it in the JSON wire format.
+func Encode(m *Message) ([]byte, error) {
+	return EncodeAs(m, FORMAT_JSON)
+}
+
+// EncodeAs() validates the given Message and encodes it in the given wire
+// format.
+func EncodeAs(m *Message, format byte) ([]byte, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	var messageBytes []byte
+	switch format {
+	case FORMAT_JSON:
+		var err error
+		if messageBytes, err = json.Marshal(m); err != nil {
+			return nil, err
+		}
+	case FORMAT_BINARY:
+		messageBytes = encodeBinary(m)
+	default:
+		return nil, fmt.Errorf("Unsupported wire format: %d", format)
+	}
+	if len(messageBytes)+1 > MAX_MESSAGE_SIZE {
+		return nil, fmt.Errorf("Message too large: %d bytes", len(messageBytes)+1)
+	}
+	return append([]byte{format}, messageBytes...), nil
+}
+
+/*
+Decode() decodes a Message from either wire format, rejecting messages that are
+oversized, have an unsupported format, contain unknown fields or fail
+validation.
+*/
+func Decode(b []byte) (*Message, error) {
+	if len(b) > MAX_MESSAGE_SIZE {
+		return nil, fmt.Errorf("Message too large: %d bytes", len(b))
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("Empty message")
+	}
+	m := &Message{}
+	switch b[0] {
+	case FORMAT_JSON:
+		decoder := json.NewDecoder(bytes.NewReader(b[1:]))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(m); err != nil {
+			return nil, err
+		}
+	case FORMAT_BINARY:
+		if err := decodeBinary(b[1:], m); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported wire format: %d", b[0])
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// encodeBinary() encodes the given Message in the compact binary format.
+func encodeBinary(m *Message) []byte {
+	buf := make([]byte, 0, 2+5*binary.MaxVarintLen64+len(m.Recp)+len(m.Sender)+len(m.Data)+len(m.ID)+len(m.SenderNode))
+	buf = append(buf, byte(m.Type))
+	for _, field := range []string{m.Recp, m.Sender, m.Data} {
+		buf = binary.AppendUvarint(buf, uint64(len(field)))
+		buf = append(buf, field...)
+	}
+	if m.ID == "" && m.TTL == 0 && m.SenderNode == "" {
+		// Understood by nodes that predate DEDUP_PROTOCOL_VERSION
+		return buf
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(m.ID)))
+	buf = append(buf, m.ID...)
+	buf = append(buf, m.TTL)
+	if m.SenderNode != "" {
+		buf = binary.AppendUvarint(buf, uint64(len(m.SenderNode)))
+		buf = append(buf, m.SenderNode...)
+	}
+	return buf
+}
+
+// decodeBinary() decodes a Message from the compact binary format.
+func decodeBinary(b []byte, m *Message) error {
+	if len(b) == 0 {
+		return fmt.Errorf("Missing message type")
+	}
+	m.Type = MessageType(b[0])
+	b = b[1:]
+	for i, field := range []*string{&m.Recp, &m.Sender, &m.Data, &m.ID} {
+		if i == 3 && len(b) == 0 {
+			// Sent by a node that predates DEDUP_PROTOCOL_VERSION
+			return nil
+		}
+		length, n := binary.Uvarint(b)
+		if n <= 0 || length > uint64(len(b)-n) {
+			return fmt.Errorf("Truncated binary message")
+		}
+		*field = string(b[n : n+int(length)])
+		b = b[n+int(length):]
+	}
+	if len(b) == 0 {
+		return fmt.Errorf("Missing TTL in binary message")
+	}
+	m.TTL = b[0]
+	b = b[1:]
+	if len(b) == 0 {
+		return nil
+	}
+	length, n := binary.Uvarint(b)
+	if n <= 0 || length != uint64(len(b)-n) {
+		return fmt.Errorf("Truncated SenderNode or trailing bytes in binary message")
+	}
+	m.SenderNode = string(b[n:])
+	return nil
+}
+
+/*
+ForVersion() returns a copy of the message that nodes speaking the given
+signaling protocol version understand.
+*/
+func (m Message) ForVersion(version int) Message {
+	if version < NODE_ID_PROTOCOL_VERSION {
+		m.SenderNode = ""
+	}
+	if version < DEDUP_PROTOCOL_VERSION {
+		m.ID = ""
+		m.TTL = 0
+	}
+	return m
+}
@@ -0,0 +1,76 @@
+package signaling
+
+import (
+	"bufio"
+	"bytes"
+	_ "lantern/client/ephemeral"
+	"reflect"
+	"testing"
+)
+
+// fuzzSeedMessages are valid messages from which the fuzz targets start.
+var fuzzSeedMessages = []Message{
+	{Type: TYPE_REGISTRATION, Recp: "a@example.com"},
+	{Type: TYPE_INTRO_REQUEST, Recp: "a@example.com", Sender: "b@example.com", Data: `{"x":1}`, ID: "0123456789abcdef", TTL: DEFAULT_TTL},
+	{Type: TYPE_HEARTBEAT, Data: "{}", ID: "0123456789abcdef", TTL: 1, SenderNode: "0123456789abcdef0123456789abcdef"},
+}
+
+// FuzzDecode checks that Decode() never panics and that whatever it accepts
+// survives encoding in the same format and decoding again.
+func FuzzDecode(f *testing.F) {
+	for _, msg := range fuzzSeedMessages {
+		for _, format := range []byte{FORMAT_JSON, FORMAT_BINARY} {
+			encoded, err := EncodeAs(&msg, format)
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add(encoded)
+		}
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		msg, err := Decode(b)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeAs(msg, b[0])
+		if err != nil {
+			t.Fatalf("Unable to encode decoded message %+v: %s", msg, err)
+		}
+		again, err := Decode(encoded)
+		if err != nil {
+			t.Fatalf("Unable to decode encoded message %+v: %s", msg, err)
+		}
+		if !reflect.DeepEqual(msg, again) {
+			t.Fatalf("Message changed in encoding: %+v became %+v", msg, again)
+		}
+	})
+}
+
+// FuzzReadFrame checks that readFrame() never panics or returns frames larger
+// than MAX_MESSAGE_SIZE, whatever the peer sends.
+func FuzzReadFrame(f *testing.F) {
+	for _, msg := range fuzzSeedMessages {
+		encoded, err := EncodeAs(&msg, FORMAT_BINARY)
+		if err != nil {
+			f.Fatal(err)
+		}
+		framed := &bytes.Buffer{}
+		if err := writeFrame(framed, encoded); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(framed.Bytes())
+	}
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		reader := bufio.NewReader(bytes.NewReader(b))
+		for {
+			frame, err := readFrame(reader)
+			if err != nil {
+				return
+			}
+			if len(frame) > MAX_MESSAGE_SIZE {
+				t.Fatalf("Read a frame of %d bytes", len(frame))
+			}
+		}
+	})
+}
@@ -0,0 +1,292 @@
+/*
+Package telemetry collects connection-level performance data to help improve
+lantern's transports, along with anonymous Usage statistics that tell us
+roughly where and how much lantern is used (see usage.go).
+
+Telemetry is strictly opt-in (see config.TelemetryOptIn()), with a single
+consent covering both.  When the user hasn't opted in, nothing is sampled,
+aggregated or uploaded.
+
+When the user has opted in, only a small fraction of sessions is sampled (see
+config.TelemetrySampleRate()).  Sampled sessions are never recorded
+individually.  Instead, they are folded into local histograms with coarse,
+fixed buckets:
+
+- handshake time to the upstream proxy
+- number of stalls (responses that took longer than STALL_THRESHOLD to start
+  arriving after we sent something, idle connections never stall)
+- transport used
+
+Every UPLOAD_INTERVAL, the aggregated Report is uploaded to
+config.TelemetryURL() through our own local proxy, so that the collector never
+sees our IP, with the Usage as of the upload.  Sessions keep being folded into
+a fresh Report in the meantime, and if the upload fails, the uploaded Report is
+merged back into it.
+
+The exact Report that would be uploaded next can be previewed at any time at
+http://[config.UIAddress()]/telemetry/preview.
+*/
+package telemetry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"lantern/config"
+	"lantern/ui"
+	"lantern/util"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	STALL_THRESHOLD = 5 * time.Second // responses taking longer than this to start arriving count as a stall
+	UPLOAD_INTERVAL = 24 * time.Hour  // how frequently we upload aggregates
+	OVERFLOW        = "+Inf"          // label of the bucket for values above the highest bound
+)
+
+var (
+	// upper bounds (in milliseconds) of the handshake time histogram buckets
+	handshakeBounds = []int64{50, 100, 250, 500, 1000, 2500, 5000}
+	// upper bounds of the stall count histogram buckets
+	stallBounds = []int64{0, 1, 2, 5, 10}
+)
+
+/*
+Report is the aggregated telemetry data, exactly as it gets uploaded.  Each
+histogram maps a bucket label (its inclusive upper bound, or OVERFLOW) to the
+number of sampled sessions that fell into that bucket.
+*/
+type Report struct {
+	Usage       Usage            // the usage statistics as of the upload
+	Since       time.Time        // when we started aggregating this report
+	Sessions    int64            // number of sampled sessions
+	HandshakeMs map[string]int64 // histogram of handshake times in milliseconds
+	Stalls      map[string]int64 // histogram of stalls per session
+	Transports  map[string]int64 // number of sessions by transport
+}
+
+/*
+Session tracks a single sampled session until it ends.  A nil *Session is valid
+and simply records nothing, which is what Sample() returns for sessions that
+aren't sampled.
+*/
+type Session struct {
+	stalls int64
+	ended  sync.Once
+}
+
+var (
+	report      = newReport()
+	reportMutex sync.Mutex // used to synchronize access to report
+)
+
+func init() {
+	ui.HandleFunc("/telemetry/preview", previewHandler)
+	util.GoLoop("telemetry uploader", uploader)
+}
+
+/*
+Sample() decides whether or not to sample a new session.  It returns nil if
+the user hasn't opted in or if the session wasn't selected for sampling.
+*/
+func Sample() *Session {
+	if !config.TelemetryOptIn() {
+		return nil
+	}
+	if rand.Float64() >= config.TelemetrySampleRate() {
+		return nil
+	}
+	return &Session{}
+}
+
+// Handshake() records the transport and time taken to handshake with the
+// upstream proxy.
+func (session *Session) Handshake(transport string, elapsed time.Duration) {
+	if session == nil {
+		return
+	}
+	reportMutex.Lock()
+	defer reportMutex.Unlock()
+	report.Sessions += 1
+	report.Transports[transport] += 1
+	report.HandshakeMs[bucket(handshakeBounds, int64(elapsed/time.Millisecond))] += 1
+}
+
+/*
+Watch() wraps the given connection so that stalls on it are counted toward
+this session.  The session ends when the connection is closed.  If session is
+nil, conn is returned unchanged.
+*/
+func (session *Session) Watch(conn net.Conn) net.Conn {
+	if session == nil {
+		return conn
+	}
+	return &watchedConn{Conn: conn, session: session}
+}
+
+// end() records the final stall count for this session.
+func (session *Session) end() {
+	session.ended.Do(func() {
+		reportMutex.Lock()
+		defer reportMutex.Unlock()
+		report.Stalls[bucket(stallBounds, atomic.LoadInt64(&session.stalls))] += 1
+	})
+}
+
+// Preview() returns the Report that would be uploaded next.
+func Preview() Report {
+	usage, _ := currentUsage()
+	reportMutex.Lock()
+	defer reportMutex.Unlock()
+	preview := copyReport(report)
+	preview.Usage = usage
+	return preview
+}
+
+// watchedConn is a net.Conn that counts stalls on reads.
+type watchedConn struct {
+	net.Conn
+	session *Session
+	// awaitingSince is when we first wrote since we last read something (in
+	// nanoseconds since the epoch, 0 when we aren't waiting for a response),
+	// accessed atomically
+	awaitingSince int64
+}
+
+func (conn *watchedConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if n > 0 || err != nil {
+		awaitingSince := atomic.SwapInt64(&conn.awaitingSince, 0)
+		if awaitingSince != 0 && time.Since(time.Unix(0, awaitingSince)) > STALL_THRESHOLD {
+			atomic.AddInt64(&conn.session.stalls, 1)
+		}
+	}
+	return n, err
+}
+
+func (conn *watchedConn) Write(b []byte) (int, error) {
+	atomic.CompareAndSwapInt64(&conn.awaitingSince, 0, time.Now().UnixNano())
+	return conn.Conn.Write(b)
+}
+
+func (conn *watchedConn) Close() error {
+	conn.session.end()
+	return conn.Conn.Close()
+}
+
+// bucket() returns the label of the bucket into which value falls.
+func bucket(bounds []int64, value int64) string {
+	for _, bound := range bounds {
+		if value <= bound {
+			return fmt.Sprintf("%d", bound)
+		}
+	}
+	return OVERFLOW
+}
+
+func newReport() *Report {
+	return &Report{
+		Since:       time.Now(),
+		HandshakeMs: make(map[string]int64),
+		Stalls:      make(map[string]int64),
+		Transports:  make(map[string]int64),
+	}
+}
+
+func copyReport(r *Report) Report {
+	c := *newReport()
+	c.Since = r.Since
+	c.Sessions = r.Sessions
+	for k, v := range r.HandshakeMs {
+		c.HandshakeMs[k] = v
+	}
+	for k, v := range r.Stalls {
+		c.Stalls[k] = v
+	}
+	for k, v := range r.Transports {
+		c.Transports[k] = v
+	}
+	return c
+}
+
+// previewHandler() shows exactly what would be uploaded next.
+func previewHandler(resp http.ResponseWriter, req *http.Request) {
+	if reportJson, err := json.MarshalIndent(Preview(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(reportJson)
+	}
+}
+
+// uploader(), meant to be run as a goroutine, periodically uploads the
+// aggregated report.
+func uploader() {
+	for {
+		time.Sleep(UPLOAD_INTERVAL)
+		if !config.TelemetryOptIn() || config.TelemetryURL() == "" {
+			continue
+		}
+		usage, relayed := currentUsage()
+		reportMutex.Lock()
+		uploading := report
+		report = newReport()
+		reportMutex.Unlock()
+		uploading.Usage = usage
+		if err := upload(*uploading); err != nil {
+			log.Printf("Unable to upload telemetry: %s", err)
+			restore(uploading)
+		} else {
+			uploadedUsage(relayed)
+		}
+	}
+}
+
+// restore() merges the given report, which we failed to upload, back into the
+// current one.
+func restore(r *Report) {
+	reportMutex.Lock()
+	defer reportMutex.Unlock()
+	report.Since = r.Since
+	report.Sessions += r.Sessions
+	for k, v := range r.HandshakeMs {
+		report.HandshakeMs[k] += v
+	}
+	for k, v := range r.Stalls {
+		report.Stalls[k] += v
+	}
+	for k, v := range r.Transports {
+		report.Transports[k] += v
+	}
+}
+
+// upload() posts the given report to the telemetry url via our local proxy,
+// so that it travels through the tunnel like any other traffic.
+func upload(r Report) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	proxyUrl, err := url.Parse("http://" + config.LocalProxyAddress())
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+	resp, err := client.Post(config.TelemetryURL(), "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Unexpected response from telemetry server: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package telemetry
+
+import (
+	"lantern/accounting"
+	"lantern/update"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Usage tells us roughly where and how much lantern is used without telling us
+who uses it.  It's part of every Report and carries nothing but coarse
+aggregates:
+
+- the country of the system's locale (never looked up from our IP)
+- the version of lantern that we run
+- the number of bytes that we relayed since the last upload, rounded down to
+  one significant digit of megabytes
+- our uptime, rounded down to whole hours
+
+It carries no identifiers, no addresses and no timestamps.
+*/
+type Usage struct {
+	Country          string // ISO 3166 code of the country of the system's locale ("" if unknown)
+	Version          string // the version of lantern that we run
+	MegabytesRelayed int64  // megabytes relayed since the last upload, rounded down to one significant digit
+	UptimeHours      int64  // hours since we started, rounded down
+}
+
+const (
+	MEGABYTE    = 1024 * 1024   // the unit in which we report bytes relayed
+	DEV_VERSION = "development" // the version reported by builds without a version
+)
+
+var (
+	started          = time.Now() // when we started
+	lastRelayed      int64        // accounting.TotalBytesRelayed() as of the last upload
+	lastRelayedMutex sync.Mutex   // used to synchronize access to lastRelayed
+)
+
+// usageAt() returns the Usage for when we had relayed the given total number of
+// bytes.
+func usageAt(totalRelayed int64) Usage {
+	lastRelayedMutex.Lock()
+	relayed := totalRelayed - lastRelayed
+	lastRelayedMutex.Unlock()
+	version := update.Version
+	if version == "" {
+		version = DEV_VERSION
+	}
+	return Usage{
+		Country:          localeCountry(),
+		Version:          version,
+		MegabytesRelayed: roundDown(relayed / MEGABYTE),
+		UptimeHours:      int64(time.Since(started) / time.Hour),
+	}
+}
+
+// uploadedUsage() remembers that we uploaded the Usage as of the given total
+// number of bytes relayed.
+func uploadedUsage(totalRelayed int64) {
+	lastRelayedMutex.Lock()
+	defer lastRelayedMutex.Unlock()
+	lastRelayed = totalRelayed
+}
+
+// currentUsage() returns the Usage as of now, along with the total number of
+// bytes relayed that it's based on.
+func currentUsage() (Usage, int64) {
+	relayed := accounting.TotalBytesRelayed()
+	return usageAt(relayed), relayed
+}
+
+/*
+localeCountry() returns the country of the system's locale, taken from the
+usual environment variables (for example US for en_US.UTF-8), or "" if we can't
+tell.
+*/
+func localeCountry() string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		locale := os.Getenv(name)
+		if locale == "" {
+			continue
+		}
+		locale = strings.SplitN(strings.SplitN(locale, ".", 2)[0], "@", 2)[0]
+		parts := strings.SplitN(locale, "_", 2)
+		if len(parts) == 2 && len(parts[1]) == 2 {
+			return strings.ToUpper(parts[1])
+		}
+		return ""
+	}
+	return ""
+}
+
+// roundDown() rounds the given number down to one significant digit, for
+// example 3456 to 3000.
+func roundDown(value int64) int64 {
+	magnitude := int64(1)
+	for value/magnitude >= 10 {
+		magnitude *= 10
+	}
+	return value / magnitude * magnitude
+}
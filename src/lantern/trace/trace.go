@@ -0,0 +1,152 @@
+/*
+Package trace is a debugging tap for the signaling channel.  It injects trace
+messages toward an email address and reports the path that they took, which
+is invaluable for figuring out why, for example, presence isn't reaching a
+node.
+
+A trace is started at http://[config.UIAddress()]/api/trace?email=[email].
+The node running as that email replies with the hops that were recorded along
+the way (see signaling.TraceHop), which are returned as JSON.  If no reply
+arrives within TRACE_TIMEOUT, the request fails.
+
+Only nodes that have trace mode enabled (config.TraceEnabled()) record hops and
+reply, so that nobody can probe whether a node is online through traces unless
+its operator asked for it.  Replies only go to an Origin that is the
+authenticated Sender of the trace, so traces can't direct replies at anybody
+else, and can only be routed back to nodes that are running as an email
+address.
+*/
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"lantern/config"
+	"lantern/signaling"
+	"lantern/ui"
+	"lantern/util"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TRACE_TIMEOUT is how long we wait for a reply to a trace.
+const TRACE_TIMEOUT = 30 * time.Second
+
+var (
+	waiting      = make(map[string]chan []signaling.TraceHop) // callers waiting for replies, by trace id
+	waitingMutex sync.Mutex                                   // used to synchronize access to waiting
+)
+
+func init() {
+	ui.HandleFunc("/api/trace", traceHandler)
+	go receive()
+}
+
+/*
+Trace() sends a trace message toward the given email and waits up to timeout
+for the path that it took.
+*/
+func Trace(email string, timeout time.Duration) ([]signaling.TraceHop, error) {
+	idBytes := make([]byte, 16)
+	rand.Read(idBytes)
+	id := hex.EncodeToString(idBytes)
+	data, err := json.Marshal(&signaling.TracePayload{ID: id, Origin: config.Email()})
+	if err != nil {
+		return nil, err
+	}
+
+	replies := make(chan []signaling.TraceHop, 1)
+	waitingMutex.Lock()
+	waiting[id] = replies
+	waitingMutex.Unlock()
+	defer func() {
+		waitingMutex.Lock()
+		delete(waiting, id)
+		waitingMutex.Unlock()
+	}()
+
+	signaling.Send(signaling.Message{Recp: email, Type: signaling.TYPE_TRACE, Data: string(data)})
+	select {
+	case hops := <-replies:
+		return hops, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("No reply from %s within %s", email, timeout)
+	}
+}
+
+// receive() answers traces addressed to us (if trace mode is enabled) and
+// hands replies to whoever is waiting for them.
+func receive() {
+	messages := make(chan signaling.Message)
+	signaling.RecvMatching(messages, signaling.Filter{
+		Types: []signaling.MessageType{signaling.TYPE_TRACE, signaling.TYPE_TRACE_REPLY},
+	})
+	// Restarts keep receiving on the same channel, which stays registered
+	util.Supervise("trace receiver", func() error {
+		for msg := range messages {
+			if msg.Type != signaling.TYPE_TRACE && msg.Type != signaling.TYPE_TRACE_REPLY {
+				continue
+			}
+			payload := signaling.TracePayload{}
+			if err := json.Unmarshal([]byte(msg.Data), &payload); err != nil {
+				log.Printf("Unable to decode trace: %s", err)
+				continue
+			}
+			if msg.Type == signaling.TYPE_TRACE {
+				if shouldReply(msg, &payload) {
+					signaling.Send(signaling.Message{Recp: payload.Origin, Type: signaling.TYPE_TRACE_REPLY, Data: msg.Data})
+				}
+				continue
+			}
+			waitingMutex.Lock()
+			replies, found := waiting[payload.ID]
+			waitingMutex.Unlock()
+			if found {
+				select {
+				case replies <- payload.Hops:
+				default:
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// shouldReply() indicates whether we answer the given trace.
+func shouldReply(msg signaling.Message, payload *signaling.TracePayload) bool {
+	if !config.TraceEnabled() || msg.Recp != config.Email() || payload.Origin == "" {
+		return false
+	}
+	if payload.Origin != msg.Sender {
+		log.Printf("Not answering trace from %s on behalf of %s", msg.Sender, payload.Origin)
+		return false
+	}
+	return true
+}
+
+// traceHandler() starts a trace toward the email given in the query string.
+func traceHandler(resp http.ResponseWriter, req *http.Request) {
+	email := req.FormValue("email")
+	if email == "" {
+		resp.WriteHeader(400)
+		resp.Write([]byte("Missing email"))
+		return
+	}
+	hops, err := Trace(email, TRACE_TIMEOUT)
+	if err != nil {
+		resp.WriteHeader(504)
+		resp.Write([]byte(err.Error()))
+		return
+	}
+	if hopsJson, err := json.MarshalIndent(hops, "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(hopsJson)
+	}
+}
@@ -0,0 +1,24 @@
+/*
+Package tray shows lantern as an icon in the system tray (the notification area
+on Windows, the menu bar on OS X and whatever the desktop offers on Linux), so
+that end users never need to touch the command line.
+
+The icon's tooltip and menu show the state of this node (see proxy.Status()),
+and the menu lets users:
+
+- switch giving access to peers on and off (proxy.SetGiving())
+- switch getting access through peers on and off (proxy.SetGetting())
+- open the dashboard of the UI in their web browser
+- quit lantern
+
+The tray needs github.com/getlantern/systray and is only built with the tray
+build tag.  Without it, Run() returns right away.
+*/
+package tray
+
+/*
+Icon is the image shown in the tray (ICO on Windows, PNG elsewhere), which the
+packaging sets before calling Run().  Without it, only the title "Lantern" is
+shown where the platform supports that.
+*/
+var Icon []byte
@@ -0,0 +1,9 @@
+//go:build !tray
+// +build !tray
+
+package tray
+
+// Run() returns false right away, since this build has no tray (see tray.go).
+func Run() bool {
+	return false
+}
@@ -0,0 +1,114 @@
+//go:build tray
+// +build tray
+
+package tray
+
+import (
+	"lantern/proxy"
+	"lantern/ui"
+	"log"
+	"os/exec"
+	"runtime"
+	"time"
+
+	"github.com/getlantern/systray"
+)
+
+const STATUS_INTERVAL = 2 * time.Second // how frequently the shown state is refreshed
+
+/*
+Run() shows the tray icon until the user quits, and must be called from the
+main goroutine since some platforms insist on running their UI there.  It
+returns true once the user quit, or false right away if this build has no tray.
+*/
+func Run() bool {
+	systray.Run(onReady, nil)
+	return true
+}
+
+// onReady() sets up the icon and its menu and handles clicks on the menu.
+func onReady() {
+	if len(Icon) > 0 {
+		systray.SetIcon(Icon)
+	}
+	systray.SetTitle("Lantern")
+	status := proxy.Status()
+	stateItem := systray.AddMenuItem("", "")
+	stateItem.Disable()
+	systray.AddSeparator()
+	giveItem := systray.AddMenuItemCheckbox("Give access", "Let other lantern users proxy through this computer", status.Giving)
+	getItem := systray.AddMenuItemCheckbox("Get access", "Proxy your traffic through other lantern users", status.Getting)
+	systray.AddSeparator()
+	dashboardItem := systray.AddMenuItem("Open dashboard", "Open lantern's dashboard in your web browser")
+	quitItem := systray.AddMenuItem("Quit", "Quit lantern")
+	show(status, stateItem, giveItem, getItem)
+
+	go func() {
+		ticker := time.NewTicker(STATUS_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-giveItem.ClickedCh:
+				proxy.SetGiving(!giveItem.Checked())
+			case <-getItem.ClickedCh:
+				proxy.SetGetting(!getItem.Checked())
+			case <-dashboardItem.ClickedCh:
+				if err := openBrowser(ui.URL("/")); err != nil {
+					log.Printf("Unable to open dashboard: %s", err)
+				}
+			case <-quitItem.ClickedCh:
+				log.Print("Quitting at the user's request")
+				systray.Quit()
+				return
+			}
+			show(proxy.Status(), stateItem, giveItem, getItem)
+		}
+	}()
+}
+
+// show() shows the given status on the icon and its menu.
+func show(status proxy.NodeStatus, stateItem *systray.MenuItem, giveItem *systray.MenuItem, getItem *systray.MenuItem) {
+	description := describe(status.State)
+	systray.SetTooltip("Lantern - " + description)
+	stateItem.SetTitle(description)
+	setChecked(giveItem, status.Giving)
+	setChecked(getItem, status.Getting)
+}
+
+func setChecked(item *systray.MenuItem, checked bool) {
+	if checked {
+		item.Check()
+	} else {
+		item.Uncheck()
+	}
+}
+
+// describe() describes the given state (see proxy.Status()) to users.
+func describe(state string) string {
+	switch state {
+	case proxy.STATE_CONNECTED:
+		return "Connected"
+	case proxy.STATE_CONNECTING:
+		return "Connecting..."
+	case proxy.STATE_DISCONNECTED:
+		return "Not connected"
+	case proxy.STATE_DIRECT:
+		return "Not getting access"
+	case proxy.STATE_NO_CERT:
+		return "Waiting for a certificate"
+	}
+	return state
+}
+
+// openBrowser() opens the given url in the user's web browser.
+func openBrowser(url string) error {
+	switch runtime.GOOS {
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+	case "darwin":
+		return exec.Command("open", url).Start()
+	default:
+		return exec.Command("xdg-open", url).Start()
+	}
+}
@@ -0,0 +1,99 @@
+package ui
+
+import (
+	"encoding/json"
+	"fmt"
+	"lantern/audit"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+/*
+Changes made through the admin and configuration API (every request to
+/admin or /config other than GET and HEAD) are recorded in the audit log with
+the names of the form values that they carried, but not the values, which may
+be secrets.  The log itself can be exported from /admin/audit (see package
+lantern/audit).
+*/
+
+// statusRecorder is an http.ResponseWriter that remembers the status code of
+// the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int // the status code of the response, 0 until it's written
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(b []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = 200
+	}
+	return recorder.ResponseWriter.Write(b)
+}
+
+// Unwrap() lets http.ResponseController reach the underlying ResponseWriter.
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+// isChange() indicates whether the given request may change something and
+// should be audited.
+func isChange(req *http.Request) bool {
+	if req.Method == "GET" || req.Method == "HEAD" {
+		return false
+	}
+	path := req.URL.Path
+	return path == "/admin" || path == "/config" || strings.HasPrefix(path, "/admin/") || strings.HasPrefix(path, "/config/")
+}
+
+// serveAudited() serves the given request with the given handler and records
+// it in the audit log.
+func serveAudited(handler http.Handler, resp http.ResponseWriter, req *http.Request) {
+	recorder := &statusRecorder{ResponseWriter: resp}
+	handler.ServeHTTP(recorder, req)
+	names := make([]string, 0, len(req.Form))
+	for name := range req.Form {
+		if name != UI_TOKEN_PARAM {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	status := recorder.status
+	if status == 0 {
+		status = 200
+	}
+	audit.Recordf(audit.EVENT_CONFIG_CHANGED, req.URL.Path, "%s with %s answered %d", req.Method, formatNames(names), status)
+}
+
+// formatNames() lists the given form value names for the audit log.
+func formatNames(names []string) string {
+	if len(names) == 0 {
+		return "no form values"
+	}
+	return fmt.Sprintf("form values %s", strings.Join(names, ", "))
+}
+
+// auditHandler() exports the audit log, together with whether it's intact.
+func auditHandler(resp http.ResponseWriter, req *http.Request) {
+	export, err := audit.ExportLog()
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+		return
+	}
+	if exportJson, err := json.MarshalIndent(export, "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Header().Set("Content-Disposition", "attachment; filename=audit.json")
+		resp.Write(exportJson)
+	}
+}
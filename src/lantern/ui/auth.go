@@ -0,0 +1,183 @@
+package ui
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"lantern/audit"
+	"lantern/config"
+	"lantern/control"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+/*
+The UI only listens on localhost, but that doesn't keep other local processes
+from triggering auth flows or changing our config, so requests to sensitive
+endpoints (PROTECTED_PREFIXES) have to carry our UI token, either in the
+X-Lantern-UI-Token header or in the lantern-ui-token cookie.
+
+The token is generated at startup and kept in [config.ConfigDir]/ui-token,
+readable only by the user running lantern (ephemeral nodes keep it in memory).
+Local tools can read it from there (see package lantern/control).  Browsers get it by opening a URL from URL(),
+which carries the token in the form value token.  On such a request, we set the
+cookie and redirect to the same URL without the token, so that it doesn't stick
+around in the address bar or the browser history.
+
+To keep web pages from reaching the UI through DNS rebinding (pointing a host
+name of theirs at localhost), requests are only served if their Host is
+config.UIAddress(), localhost or a loopback IP (see allowedHost()).
+*/
+const (
+	UI_TOKEN_HEADER = control.TOKEN_HEADER // header in which clients present our UI token
+	UI_TOKEN_COOKIE = "lantern-ui-token"   // cookie in which browsers present our UI token
+	UI_TOKEN_PARAM  = "token"              // form value with which browsers obtain the cookie
+	UI_TOKEN_BYTES  = 32                   // random bytes in a UI token
+)
+
+// PROTECTED_PREFIXES are the path prefixes that require our UI token.
+var PROTECTED_PREFIXES = []string{"/api", "/auth", "/admin", "/config", "/diagnostics", "/introductions", "/update"}
+
+var (
+	uiToken      string     // our UI token
+	uiTokenMutex sync.Mutex // used to synchronize access to uiToken
+)
+
+// Token() returns our UI token, generating it if necessary.
+func Token() string {
+	uiTokenMutex.Lock()
+	defer uiTokenMutex.Unlock()
+	if uiToken == "" {
+		uiToken = loadToken()
+	}
+	return uiToken
+}
+
+/*
+URL() returns the URL of the given path on the UI, including our UI token, for
+opening in the user's web browser.  It shouldn't be logged, use
+"http://" + config.UIAddress() + path for that.
+*/
+func URL(path string) string {
+	return "http://" + config.UIAddress() + path + "?" + UI_TOKEN_PARAM + "=" + url.QueryEscape(Token())
+}
+
+// loadToken() reads our UI token from disk, or generates and saves a new one.
+func loadToken() string {
+	tokenFile := filepath.Join(config.ConfigDir, control.TOKEN_FILE)
+	if !config.Ephemeral() {
+		if data, err := ioutil.ReadFile(tokenFile); err == nil {
+			if token := strings.TrimSpace(string(data)); token != "" {
+				return token
+			}
+		}
+	}
+	b := make([]byte, UI_TOKEN_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Unable to generate UI token: %s", err)
+	}
+	token := hex.EncodeToString(b)
+	if !config.Ephemeral() {
+		if err := os.MkdirAll(config.ConfigDir, 0755); err != nil {
+			log.Printf("Unable to create %s: %s", config.ConfigDir, err)
+		} else if err := ioutil.WriteFile(tokenFile, []byte(token), 0600); err != nil {
+			log.Printf("Unable to save UI token to %s: %s", tokenFile, err)
+		}
+	}
+	return token
+}
+
+// isProtected() indicates whether or not the given path requires our UI token.
+func isProtected(path string) bool {
+	for _, prefix := range PROTECTED_PREFIXES {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedHost() indicates whether or not the UI answers requests for the given
+// Host.
+func allowedHost(host string) bool {
+	if host == config.UIAddress() {
+		return true
+	}
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	hostname = strings.Trim(hostname, "[]")
+	if uiHost, _, err := net.SplitHostPort(config.UIAddress()); err == nil && uiHost != "" && hostname == uiHost {
+		return true
+	}
+	if ip := net.ParseIP(hostname); ip != nil {
+		return ip.IsLoopback()
+	}
+	return hostname == "localhost"
+}
+
+// validToken() indicates whether or not the given token is our UI token.
+func validToken(token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(Token())) == 1
+}
+
+// authenticate() wraps the given handler so that requests to protected paths
+// require our UI token.
+func authenticate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if !allowedHost(req.Host) {
+			audit.Recordf(audit.EVENT_AUTH_FAILED, req.RemoteAddr, "UI: request for unexpected host %s", req.Host)
+			resp.WriteHeader(403)
+			resp.Write([]byte("Unexpected Host"))
+			return
+		}
+		if token := req.URL.Query().Get(UI_TOKEN_PARAM); token != "" {
+			if !validToken(token) {
+				audit.Record(audit.EVENT_AUTH_FAILED, req.RemoteAddr, "UI: invalid token in URL")
+				resp.WriteHeader(403)
+				resp.Write([]byte("Invalid UI token"))
+				return
+			}
+			http.SetCookie(resp, &http.Cookie{
+				Name:     UI_TOKEN_COOKIE,
+				Value:    token,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+			query := req.URL.Query()
+			query.Del(UI_TOKEN_PARAM)
+			redirect := *req.URL
+			redirect.RawQuery = query.Encode()
+			http.Redirect(resp, req, redirect.RequestURI(), http.StatusFound)
+			return
+		}
+		if isProtected(req.URL.Path) {
+			token := req.Header.Get(UI_TOKEN_HEADER)
+			if cookie, err := req.Cookie(UI_TOKEN_COOKIE); token == "" && err == nil {
+				token = cookie.Value
+			}
+			if !validToken(token) {
+				if token != "" {
+					audit.Recordf(audit.EVENT_AUTH_FAILED, req.RemoteAddr, "UI: invalid token for %s", req.URL.Path)
+				}
+				resp.WriteHeader(401)
+				resp.Write([]byte("This requires the UI token"))
+				return
+			}
+		}
+		if isChange(req) {
+			serveAudited(handler, resp, req)
+			return
+		}
+		handler.ServeHTTP(resp, req)
+	})
+}
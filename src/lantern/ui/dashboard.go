@@ -0,0 +1,46 @@
+package ui
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var dashboardTemplate = `
+<html>
+  <head>
+    <title>Lantern</title>
+  </head>
+  <body>
+    <h1>Lantern</h1>
+    <ul>
+%s
+    </ul>
+  </body>
+</html>
+`
+
+/*
+dashboardHandler() shows the dashboard, which links to all plain paths that are
+registered on the UI, so that users who open the UI from the tray icon or
+URL() find their way around.
+*/
+func dashboardHandler(resp http.ResponseWriter, req *http.Request) {
+	patternMutex.Lock()
+	paths := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if pattern != "/{$}" && !strings.ContainsAny(pattern, "{ ") {
+			paths = append(paths, pattern)
+		}
+	}
+	patternMutex.Unlock()
+	sort.Strings(paths)
+	links := make([]string, 0, len(paths))
+	for _, path := range paths {
+		links = append(links, fmt.Sprintf(`      <li><a href="%s">%s</a></li>`, html.EscapeString(path), html.EscapeString(path)))
+	}
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(resp, dashboardTemplate, strings.Join(links, "\n"))
+}
@@ -0,0 +1,52 @@
+package ui
+
+import (
+	"expvar"
+	"lantern/config"
+	"lantern/util"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+/*
+When config.Profiling() is enabled, the UI exposes the usual runtime
+introspection endpoints under /admin, so that they require the UI token:
+
+- /admin/debug/pprof/ - the profiles of net/http/pprof, for example
+  go tool pprof http://[config.UIAddress()]/admin/debug/pprof/heap (with the UI
+  token in the X-Lantern-UI-Token header)
+- /admin/debug/vars - the variables of expvar, including the number of
+  goroutines and the metrics of our supervised goroutines
+
+Otherwise, they answer 404 Not Found.  Importing net/http/pprof and expvar also
+registers them on http.DefaultServeMux, but nothing of ours serves that.
+*/
+
+// debugMux serves the introspection endpoints at their usual paths.
+var debugMux = http.NewServeMux()
+
+func init() {
+	debugMux.HandleFunc("/debug/pprof/", pprof.Index)
+	debugMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	debugMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	debugMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	debugMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	debugMux.Handle("/debug/vars", expvar.Handler())
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("supervisor", expvar.Func(func() interface{} {
+		return util.SupervisorMetrics()
+	}))
+	HandleFunc("/admin/debug/", debugHandler)
+}
+
+// debugHandler() serves the introspection endpoints if profiling is enabled.
+func debugHandler(resp http.ResponseWriter, req *http.Request) {
+	if !config.Profiling() {
+		http.NotFound(resp, req)
+		return
+	}
+	http.StripPrefix("/admin", debugMux).ServeHTTP(resp, req)
+}
@@ -0,0 +1,62 @@
+package ui
+
+import (
+	"fmt"
+	"lantern/config"
+	"log"
+	"net/http"
+)
+
+/*
+New nodes can join with an invite (see config.Invite) without going through the
+setup wizard, either by starting with -invite [code or link] or by posting the
+invite to http://[config.UIAddress()]/config/invite in the form value invite,
+for example from a handler for lantern:// links.  Joining points
+config.ParentAddress() at the parent, saves its certificate like the setup
+wizard does and, for invites that carry a token, keeps the token for the
+certificate request (see config.InviteToken()).
+*/
+
+// joinWithInvite() joins the parent of the given invite code or link.
+func joinWithInvite(code string) error {
+	invite, err := config.ParseInvite(code)
+	if err != nil {
+		return err
+	}
+	if err := checkPEMCertificate([]byte(invite.ParentCert)); err != nil {
+		return fmt.Errorf("Invite code has an invalid parent certificate: %s", err)
+	}
+	if err := saveParentCert([]byte(invite.ParentCert)); err != nil {
+		return fmt.Errorf("Unable to save parent certificate: %s", err)
+	}
+	config.SetParentAddress(invite.ParentAddress)
+	config.SetInviteToken(invite.Token)
+	log.Printf("Joined parent at %s with invite", invite.ParentAddress)
+	return nil
+}
+
+// joinAtStartup() joins the parent of the invite given with -invite, refusing
+// to start if the invite isn't usable.
+func joinAtStartup() {
+	if err := joinWithInvite(config.StartupInvite()); err != nil {
+		log.Fatalf("Unable to join with -invite: %s", err)
+	}
+}
+
+/*
+joinHandler() joins the parent of the invite code or link in the form value
+invite on POST.  We connect to the new parent once lantern is restarted.
+*/
+func joinHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		resp.WriteHeader(405)
+		resp.Write([]byte("POST an invite code or link in the form value invite"))
+		return
+	}
+	if err := joinWithInvite(req.FormValue("invite")); err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(err.Error()))
+		return
+	}
+	resp.Write([]byte(fmt.Sprintf("Joined parent at %s, restart lantern to connect to it", config.ParentAddress())))
+}
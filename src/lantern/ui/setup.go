@@ -0,0 +1,300 @@
+package ui
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/toqueteos/webbrowser"
+	"html"
+	"io/ioutil"
+	"lantern/config"
+	"lantern/control"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+On first start (see config.FirstRun()), nothing besides the UI starts until the
+user has gone through the setup wizard at
+http://[config.UIAddress()]/config/setup, which we open in the user's web
+browser.  The wizard replaces the defaults that we used to start with silently:
+
+1. choose a role - a node of a user, or a relay run by an operator (see
+   config.Role()), which still needs the certificate provisioned by its
+   operator (see package lantern/keys)
+2. enter the parent - either an invite code (see config.Invite) or the parent's
+   address and the PEM of its certificate, or nothing for a root node
+3. pick the ports of the local proxy, the signaling listener and the remote
+   proxy
+4. sign in - once the setup is saved, package lantern/keys requests our
+   certificate from our parent, which takes the user to the sign in page (see
+   package lantern/persona), unless the invite carries a token
+
+The settings are checked with config.Validate() before the setup completes,
+problems are shown in the wizard so that the user can fix them.  The parent's
+certificate is written to [config.ConfigDir]/keys/trusted/parentcert.pem,
+where package lantern/keys picks it up.
+*/
+const (
+	SETUP_PATH       = "/config/setup"                // where the setup wizard lives
+	PARENT_CERT_PATH = "/keys/trusted/parentcert.pem" // where package lantern/keys looks for our parent's certificate, relative to config.ConfigDir
+)
+
+var setupTemplate = `
+<html>
+  <head>
+    <title>Lantern Setup</title>
+  </head>
+  <body>
+    <h1>Welcome to Lantern</h1>
+%s
+    <form method="POST" action="%s">
+      <h2>1. Role</h2>
+      <p>
+        <label><input type="radio" name="role" value="%s"%s> I use this computer to get online</label><br>
+        <label><input type="radio" name="role" value="%s"%s> This is a relay that I run for others</label>
+      </p>
+      <h2>2. Parent</h2>
+      <p>Paste the invite code that you got from your parent:</p>
+      <p><textarea name="invite" rows="3" cols="80">%s</textarea></p>
+      <p>Or enter your parent's address and paste its certificate:</p>
+      <p><input type="text" name="parent" size="40" placeholder="host:port" value="%s"></p>
+      <p><textarea name="parentcert" rows="8" cols="80" placeholder="-----BEGIN CERTIFICATE-----">%s</textarea></p>
+      <p>Leave all of these blank to start a new network with this node as its root.</p>
+      <h2>3. Ports</h2>
+      <p>
+        Local proxy (for your browser): <input type="text" name="localproxyport" size="6" value="%s"><br>
+        Signaling (for nodes below this one): <input type="text" name="signalingport" size="6" value="%s"><br>
+        Remote proxy (for peers): <input type="text" name="remoteproxyport" size="6" value="%s">
+      </p>
+      <h2>4. Sign in</h2>
+      <p>Once you save, you'll be asked to sign in so that your parent can issue your certificate.</p>
+      <p><input type="submit" value="Save and continue"></p>
+    </form>
+  </body>
+</html>
+`
+
+var setupCompleteTemplate = `
+<html>
+  <head>
+    <title>Lantern Setup</title>
+  </head>
+  <body>
+    <h1>Setup complete</h1>
+    <p>%s</p>
+    <p><a href="%s">Continue</a></p>
+  </body>
+</html>
+`
+
+var (
+	setupDone     = make(chan bool) // closed once the setup is complete
+	setupComplete bool              // whether the setup is complete
+	setupMutex    sync.Mutex        // used to synchronize access to setupComplete
+)
+
+// runSetup() serves the setup wizard and blocks until the user has completed
+// it.
+func runSetup() {
+	HandleFunc(SETUP_PATH, setupHandler)
+	log.Printf("First start, opening browser to setup at: http://%s%s", config.UIAddress(), SETUP_PATH)
+	// The URL carries the UI token, which gets the browser past authenticate()
+	if err := webbrowser.Open(URL(SETUP_PATH)); err != nil {
+		log.Printf("Unable to open browser, please open http://%s%s?%s=[the token in %s/%s]: %s", config.UIAddress(), SETUP_PATH, UI_TOKEN_PARAM, config.ConfigDir, control.TOKEN_FILE, err)
+	}
+	<-setupDone
+	log.Print("Setup complete, starting up")
+}
+
+/*
+setupHandler() shows the setup wizard on GET and applies the settings from the
+form values role, invite, parent, parentcert, localproxyport, signalingport and
+remoteproxyport on POST, showing the wizard again with the problems if there
+are any.
+*/
+func setupHandler(resp http.ResponseWriter, req *http.Request) {
+	setupMutex.Lock()
+	defer setupMutex.Unlock()
+	if setupComplete {
+		http.Redirect(resp, req, "/", http.StatusSeeOther)
+		return
+	}
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if req.Method != "POST" {
+		writeSetupForm(resp, req, nil)
+		return
+	}
+	if problems := applySetup(req); len(problems) > 0 {
+		resp.WriteHeader(400)
+		writeSetupForm(resp, req, problems)
+		return
+	}
+	setupComplete = true
+	close(setupDone)
+	message, next := "Lantern is now starting up as the root of a new network.", "/"
+	if config.InviteToken() != "" {
+		message = "Lantern is now starting up and gets your certificate with your invite."
+	} else if !config.IsRootNode() && !config.IsRelay() {
+		message, next = "Lantern is now starting up. Sign in so that your parent can issue your certificate.", "/auth"
+	}
+	fmt.Fprintf(resp, setupCompleteTemplate, html.EscapeString(message), next)
+}
+
+// writeSetupForm() writes the setup wizard, prefilled from the given request
+// or the current config, listing the given problems.
+func writeSetupForm(resp http.ResponseWriter, req *http.Request, problems []string) {
+	problemList := ""
+	if len(problems) > 0 {
+		items := make([]string, 0, len(problems))
+		for _, problem := range problems {
+			items = append(items, fmt.Sprintf("      <li>%s</li>", html.EscapeString(problem)))
+		}
+		problemList = fmt.Sprintf("    <p>Please fix the following:</p>\n    <ul>\n%s\n    </ul>", strings.Join(items, "\n"))
+	}
+	value := func(name string, current string) string {
+		if req.Method == "POST" {
+			return html.EscapeString(req.FormValue(name))
+		}
+		return html.EscapeString(current)
+	}
+	role := config.Role()
+	if req.Method == "POST" {
+		role = req.FormValue("role")
+	}
+	checked := func(checked bool) string {
+		if checked {
+			return " checked"
+		}
+		return ""
+	}
+	fmt.Fprintf(resp, setupTemplate,
+		problemList,
+		SETUP_PATH,
+		config.ROLE_USER, checked(role != config.ROLE_RELAY),
+		config.ROLE_RELAY, checked(role == config.ROLE_RELAY),
+		value("invite", ""),
+		value("parent", config.ParentAddress()),
+		value("parentcert", ""),
+		value("localproxyport", portOf(config.LocalProxyAddress())),
+		value("signalingport", portOf(config.SignalingAddress())),
+		value("remoteproxyport", portOf(config.RemoteProxyAddress())))
+}
+
+/*
+applySetup() applies the settings from the form values of the given request to
+the config and saves our parent's certificate, returning the problems if the
+settings aren't usable.
+*/
+func applySetup(req *http.Request) []string {
+	problems := make([]string, 0)
+	role := req.FormValue("role")
+	if role != config.ROLE_USER && role != config.ROLE_RELAY {
+		problems = append(problems, "Choose a role")
+	}
+
+	parentAddress := strings.TrimSpace(req.FormValue("parent"))
+	parentCert := []byte(strings.TrimSpace(req.FormValue("parentcert")))
+	inviteToken := ""
+	if code := strings.TrimSpace(req.FormValue("invite")); code != "" {
+		invite, err := config.ParseInvite(code)
+		if err != nil {
+			problems = append(problems, err.Error())
+		} else {
+			parentAddress, parentCert, inviteToken = invite.ParentAddress, []byte(invite.ParentCert), invite.Token
+		}
+	}
+	if parentAddress == "" && len(parentCert) > 0 {
+		problems = append(problems, "Enter the address of the parent whose certificate you pasted")
+	} else if parentAddress != "" {
+		if err := config.ValidateAddress(parentAddress); err != nil {
+			problems = append(problems, fmt.Sprintf("Parent address: %s", err))
+		}
+		if err := checkPEMCertificate(parentCert); err != nil {
+			problems = append(problems, fmt.Sprintf("Parent certificate: %s", err))
+		}
+	}
+
+	addresses := make(map[string]string)
+	for _, field := range []struct{ name, label, address string }{
+		{"localproxyport", "Local proxy port", config.LocalProxyAddress()},
+		{"signalingport", "Signaling port", config.SignalingAddress()},
+		{"remoteproxyport", "Remote proxy port", config.RemoteProxyAddress()},
+	} {
+		address, err := withPort(field.address, req.FormValue(field.name))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", field.label, err))
+		}
+		addresses[field.name] = address
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+
+	config.SetRole(role)
+	config.SetParentAddress(parentAddress)
+	config.SetInviteToken(inviteToken)
+	config.SetLocalProxyAddress(addresses["localproxyport"])
+	config.SetSignalingAddress(addresses["signalingport"])
+	config.SetRemoteProxyAddress(addresses["remoteproxyport"])
+	if err := config.Validate(); err != nil {
+		if configErr, ok := err.(*config.ConfigError); ok {
+			return configErr.Problems
+		}
+		return []string{err.Error()}
+	}
+	if parentAddress != "" {
+		if err := saveParentCert(parentCert); err != nil {
+			return []string{fmt.Sprintf("Unable to save parent certificate: %s", err)}
+		}
+	}
+	return nil
+}
+
+// checkPEMCertificate() checks that the given data is a PEM encoded
+// certificate.
+func checkPEMCertificate(data []byte) error {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("Paste the certificate including the BEGIN and END lines")
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		return fmt.Errorf("Not a valid certificate: %s", err)
+	}
+	return nil
+}
+
+// saveParentCert() saves the given PEM encoded certificate where package
+// lantern/keys expects our parent's certificate.
+func saveParentCert(data []byte) error {
+	path := config.ConfigDir + PARENT_CERT_PATH
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// portOf() returns the port of the given host:port.
+func portOf(address string) string {
+	_, port, _ := net.SplitHostPort(address)
+	return port
+}
+
+// withPort() replaces the port of the given host:port with the given port.
+func withPort(address string, port string) (string, error) {
+	port = strings.TrimSpace(port)
+	if number, err := strconv.Atoi(port); err != nil || number < 1 || number > 65535 {
+		return address, fmt.Errorf("%q isn't a port between 1 and 65535", port)
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address, err
+	}
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,180 @@
+/*
+Package ui encapsulates the backend of lantern's UI, which is an HTTP server
+listening on config.UIAddress().
+
+Subsystems register their UI-facing handlers (login pages, diagnostics, settings
+and so on) using HandleFunc(), which keeps them on a ServeMux of their own
+rather than http.DefaultServeMux.  This way, they're only ever exposed on the
+UI address and never on whatever other server happens to use the default mux.
+Requests to sensitive endpoints have to carry our UI token (see Token()).
+
+The UI also exposes the following configuration API (which requires the UI
+token too):
+
+- / - the dashboard, which links to everything else that's registered
+
+- /config/ips - GET returns config.BindIP() and config.AdvertiseIP(), POST
+  validates and updates them from the form values bindIP and advertiseIP
+- /config/migration - GET returns the report of the last migration from an old
+  installation or, given the form value from, previews what a migration from
+  that path would carry over (see config.PreviewMigration())
+- /config/setup - the setup wizard, which runs on first start (see setup.go)
+- /config/invite - joins a parent with an invite (see invite.go)
+- /config/profiles - GET returns the active profile, the profile selected for
+  the next start and all profiles, POST selects (and if necessary creates) the
+  profile given in the form value profile (see config.SelectProfile())
+- /admin/audit - exports the audit log (see package lantern/audit), changes
+  through this API are recorded there too
+*/
+package ui
+
+import (
+	"encoding/json"
+	"lantern/config"
+	"lantern/util"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// ipSettings is the representation of config.BindIP() and config.AdvertiseIP()
+// used by the /config/ips API.
+type ipSettings struct {
+	BindIP      string
+	AdvertiseIP string
+}
+
+// profileSettings is the representation of the profiles used by the
+// /config/profiles API.
+type profileSettings struct {
+	Active   string   // the profile that we're running as
+	Selected string   // the profile that will be active on the next start
+	Profiles []string // all profiles besides the default one
+}
+
+var (
+	mux          = http.NewServeMux() // the ServeMux for the UI
+	patterns     = make([]string, 0)  // the patterns registered with HandleFunc(), in order
+	patternMutex sync.Mutex           // used to synchronize access to patterns
+)
+
+func init() {
+	HandleFunc("/config/ips", ipsHandler)
+	HandleFunc("/config/migration", migrationHandler)
+	HandleFunc("/config/invite", joinHandler)
+	HandleFunc("/config/profiles", profilesHandler)
+	HandleFunc("/admin/audit", auditHandler)
+	HandleFunc("/diagnostics/goroutines", goroutinesHandler)
+	HandleFunc("/{$}", dashboardHandler)
+	// Saves the token right away, so that local tools find it
+	Token()
+	go serve()
+	if config.StartupInvite() != "" {
+		joinAtStartup()
+	} else if config.FirstRun() {
+		runSetup()
+	}
+}
+
+// HandleFunc() registers the handler function for the given pattern on the UI.
+func HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	mux.HandleFunc(pattern, handler)
+	patternMutex.Lock()
+	defer patternMutex.Unlock()
+	patterns = append(patterns, pattern)
+}
+
+// serve() serves the UI on config.UIAddress()
+func serve() {
+	log.Printf("About to start UI at: %s", config.UIAddress())
+	util.Supervise("ui", func() error {
+		return http.ListenAndServe(config.UIAddress(), authenticate(mux))
+	})
+}
+
+/*
+ipsHandler() returns the current IP settings on GET and validates and updates
+them on POST with the form values bindIP and advertiseIP.
+*/
+func ipsHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		bindIP := req.FormValue("bindIP")
+		advertiseIP := req.FormValue("advertiseIP")
+		if err := config.ValidateIPs(bindIP, advertiseIP); err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+		config.SetBindIP(bindIP)
+		config.SetAdvertiseIP(advertiseIP)
+	}
+	settings := &ipSettings{BindIP: config.BindIP(), AdvertiseIP: config.AdvertiseIP()}
+	if settingsJson, err := json.MarshalIndent(settings, "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(settingsJson)
+	}
+}
+
+/*
+migrationHandler() returns the report of the last migration, or previews a
+migration from the path given in the form value from.
+*/
+func migrationHandler(resp http.ResponseWriter, req *http.Request) {
+	report := config.LastMigration()
+	if from := req.FormValue("from"); from != "" {
+		var err error
+		if report, err = config.PreviewMigration(from); err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+	}
+	if reportJson, err := json.MarshalIndent(report, "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(reportJson)
+	}
+}
+
+/*
+profilesHandler() returns the profiles on GET and selects the profile given in
+the form value profile on POST.
+*/
+func profilesHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		if err := config.SelectProfile(req.FormValue("profile")); err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(err.Error()))
+			return
+		}
+	}
+	settings := &profileSettings{
+		Active:   config.Profile(),
+		Selected: config.SelectedProfile(),
+		Profiles: config.Profiles(),
+	}
+	if settingsJson, err := json.MarshalIndent(settings, "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(settingsJson)
+	}
+}
+
+// goroutinesHandler() shows the metrics of our supervised goroutines (see
+// util.Supervise()).
+func goroutinesHandler(resp http.ResponseWriter, req *http.Request) {
+	if metricsJson, err := json.MarshalIndent(util.SupervisorMetrics(), "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(metricsJson)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package update
+
+import (
+	"syscall"
+)
+
+// restart() replaces our process with the given executable, keeping our pid
+// so that service managers don't notice.
+func restart(executable string, args []string) error {
+	return syscall.Exec(executable, append([]string{executable}, args...), syscall.Environ())
+}
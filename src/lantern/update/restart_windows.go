@@ -0,0 +1,19 @@
+package update
+
+import (
+	"os"
+	"os/exec"
+)
+
+// restart() starts the given executable and exits, since Windows can't
+// replace a running process.
+func restart(executable string, args []string) error {
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
@@ -0,0 +1,370 @@
+/*
+Package update keeps the lantern binary up to date.
+
+Every CHECK_INTERVAL, we fetch the signed Manifest of the release channel that
+we follow from config.Updates().URL.  Like all of our other traffic, the
+manifest and the binary are fetched through our own local proxy, so updating
+works where the update server is blocked.
+
+A Manifest is only trusted if it carries a valid Ed25519 signature from the
+release signing key, whose public half is baked into the build through
+PublicKey.  If it names a Version newer than ours and a binary for our
+platform, we download the binary and check that its signature in the manifest
+verifies and that its size matches before we swap it in:
+
+- the new binary is written next to the current one
+- the current binary is renamed to <executable>.old (which also works for a
+  running executable on Windows) and the new one is renamed into its place
+- if the second rename fails, the current binary is renamed back
+
+We then restart the new binary with the same arguments (including the
+subcommand, if any), except that the [config.BaseDir] is passed as an absolute
+path so that we come back with the same [config.ConfigDir].  The
+<executable>.old is removed the next time we start.
+
+Builds without a Version (development builds) and ephemeral nodes, whose
+images are replaced wholesale, never update themselves.  The state of updating
+can be seen at http://[config.UIAddress()]/update, where a POST checks for an
+update right away.
+*/
+package update
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lantern/config"
+	"lantern/ui"
+	"lantern/util"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CHECK_INTERVAL   = 12 * time.Hour    // how frequently we check for updates
+	MANIFEST_TIMEOUT = 1 * time.Minute   // how long fetching a manifest may take
+	BINARY_TIMEOUT   = 30 * time.Minute  // how long downloading a binary may take
+	MAX_BINARY_SIZE  = 256 * 1024 * 1024 // the largest binary that we accept
+	MAX_MANIFEST     = 64 * 1024         // the largest signed manifest that we accept
+)
+
+var (
+	// Version is the version of this build, set with -ldflags "-X lantern/update.Version=<version>"
+	Version = ""
+	// PublicKey is the base64 encoded Ed25519 public key of the release signing key, set with -ldflags "-X lantern/update.PublicKey=<base64 key>"
+	PublicKey = ""
+)
+
+// Manifest describes the latest release on a channel.
+type Manifest struct {
+	Channel  string            // the channel of the release
+	Version  string            // the version of the release
+	Released time.Time         // when the release was made
+	Binaries map[string]Binary // the binaries of the release, by <GOOS>/<GOARCH>
+}
+
+// Binary describes a single binary of a release.
+type Binary struct {
+	URL       string // where the binary can be downloaded
+	Size      int64  // the size of the binary in bytes
+	Signature []byte // the signature of the binary by the release signing key
+}
+
+// signedManifest is a Manifest as it's served.
+type signedManifest struct {
+	Manifest  []byte // the JSON encoded Manifest
+	Signature []byte // the signature of Manifest by the release signing key
+}
+
+// Status is the state of updating, as shown at /update.
+type Status struct {
+	Version     string    // the version that we're running
+	Channel     string    // the channel that we follow
+	LastCheck   time.Time // when we last checked for an update
+	LastError   string    // what went wrong with the last check (blank if nothing)
+	Latest      string    // the latest version on our channel, as of the last check
+	Downloading bool      // whether we're installing an update right now
+}
+
+var (
+	status      = Status{Version: Version} // the state of updating
+	checkNow    = make(chan bool, 1)       // used to ask the updater for a check right away
+	statusMutex sync.Mutex                 // used to synchronize access to status
+)
+
+func init() {
+	ui.HandleFunc("/update", updateHandler)
+	if executable, err := os.Executable(); err == nil {
+		os.Remove(executable + ".old")
+	}
+	if Version == "" || config.Ephemeral() {
+		return
+	}
+	util.GoLoop("updater", updater)
+}
+
+// updater() checks for updates every CHECK_INTERVAL or when asked to.
+func updater() {
+	for {
+		if updates := config.Updates(); updates.Enabled && updates.URL != "" {
+			err := check(updates)
+			statusMutex.Lock()
+			status.LastCheck = time.Now()
+			status.LastError = ""
+			if err != nil {
+				log.Printf("Unable to update: %s", err)
+				status.LastError = err.Error()
+			}
+			statusMutex.Unlock()
+		}
+		select {
+		case <-time.After(CHECK_INTERVAL):
+		case <-checkNow:
+		}
+	}
+}
+
+/*
+check() fetches the manifest of the channel that we follow and installs the
+release that it names if it's newer than ours, in which case it doesn't
+return.
+*/
+func check(updates config.UpdateConfig) error {
+	manifestUrl := strings.TrimSuffix(updates.URL, "/") + "/" + url.PathEscape(updates.Channel) + ".signed"
+	data, err := fetch(manifestUrl, MANIFEST_TIMEOUT, MAX_MANIFEST)
+	if err != nil {
+		return fmt.Errorf("Unable to fetch manifest: %s", err)
+	}
+	manifest, err := verifyManifest(data)
+	if err != nil {
+		return err
+	}
+	if manifest.Channel != updates.Channel {
+		return fmt.Errorf("Manifest is for channel %s instead of %s", manifest.Channel, updates.Channel)
+	}
+	statusMutex.Lock()
+	status.Channel = updates.Channel
+	status.Latest = manifest.Version
+	statusMutex.Unlock()
+	if compareVersions(manifest.Version, Version) <= 0 {
+		return nil
+	}
+	binary, found := manifest.Binaries[runtime.GOOS+"/"+runtime.GOARCH]
+	if !found {
+		return fmt.Errorf("Version %s has no binary for %s/%s", manifest.Version, runtime.GOOS, runtime.GOARCH)
+	}
+
+	log.Printf("Updating from version %s to %s", Version, manifest.Version)
+	setDownloading(true)
+	defer setDownloading(false)
+	content, err := fetch(binary.URL, BINARY_TIMEOUT, MAX_BINARY_SIZE)
+	if err != nil {
+		return fmt.Errorf("Unable to download version %s: %s", manifest.Version, err)
+	}
+	if int64(len(content)) != binary.Size {
+		return fmt.Errorf("Binary of version %s has %d bytes instead of %d", manifest.Version, len(content), binary.Size)
+	}
+	publicKey, err := publicKey()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, content, binary.Signature) {
+		return fmt.Errorf("Signature of the binary of version %s didn't verify", manifest.Version)
+	}
+	executable, err := install(content)
+	if err != nil {
+		return err
+	}
+	log.Printf("Installed version %s, restarting", manifest.Version)
+	return restart(executable, restartArgs())
+}
+
+// verifyManifest() checks the signature of the given signed manifest and
+// decodes it.
+func verifyManifest(data []byte) (*Manifest, error) {
+	publicKey, err := publicKey()
+	if err != nil {
+		return nil, err
+	}
+	signed := &signedManifest{}
+	if err := json.Unmarshal(data, signed); err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(publicKey, signed.Manifest, signed.Signature) {
+		return nil, fmt.Errorf("Signature of manifest didn't verify")
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(signed.Manifest, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// publicKey() decodes PublicKey.
+func publicKey() (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Invalid release public key: %s", PublicKey)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// fetch() fetches the given url through our local proxy, reading at most
+// limit bytes.
+func fetch(location string, timeout time.Duration, limit int64) ([]byte, error) {
+	proxyUrl, err := url.Parse("http://" + config.LocalProxyAddress())
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}, Timeout: timeout}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Unexpected response: %s", resp.Status)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > limit {
+		return nil, fmt.Errorf("More than %d bytes", limit)
+	}
+	return content, nil
+}
+
+/*
+install() swaps the given content in for our executable, returning the path of
+the executable.
+*/
+func install(content []byte) (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("Unable to determine executable: %s", err)
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		return "", fmt.Errorf("Unable to determine executable: %s", err)
+	}
+	newFile := executable + ".new"
+	oldFile := executable + ".old"
+	if err := ioutil.WriteFile(newFile, content, 0755); err != nil {
+		return "", fmt.Errorf("Unable to write new binary: %s", err)
+	}
+	os.Remove(oldFile)
+	if err := os.Rename(executable, oldFile); err != nil {
+		os.Remove(newFile)
+		return "", fmt.Errorf("Unable to move current binary aside: %s", err)
+	}
+	if err := os.Rename(newFile, executable); err != nil {
+		if restoreErr := os.Rename(oldFile, executable); restoreErr != nil {
+			log.Printf("Unable to restore current binary from %s: %s", oldFile, restoreErr)
+		}
+		os.Remove(newFile)
+		return "", fmt.Errorf("Unable to move new binary into place: %s", err)
+	}
+	return executable, nil
+}
+
+/*
+restartArgs() returns our command line arguments (not including the program
+name) with the [config.BaseDir] as an absolute path.
+*/
+func restartArgs() []string {
+	args := os.Args[1:]
+	rest := config.Args()
+	flags := args[:len(args)-len(rest)]
+	baseDir, err := filepath.Abs(config.BaseDir)
+	if err != nil {
+		baseDir = config.BaseDir
+	}
+	restarted := append([]string{}, flags...)
+	if subcommand := config.Subcommand(); subcommand != "" {
+		restarted = append(restarted, subcommand)
+		rest = rest[1:]
+	}
+	restarted = append(restarted, baseDir)
+	if len(rest) > 1 {
+		restarted = append(restarted, rest[1:]...)
+	}
+	return restarted
+}
+
+/*
+compareVersions() compares the given versions of the form
+<major>.<minor>.<patch>[-<pre-release>], returning a negative number if a is
+older than b, a positive number if it's newer and 0 if they're the same.  A
+pre-release is older than the release itself.
+*/
+func compareVersions(a string, b string) int {
+	aCore, aPre, aIsPre := strings.Cut(a, "-")
+	bCore, bPre, bIsPre := strings.Cut(b, "-")
+	aParts := strings.Split(aCore, ".")
+	bParts := strings.Split(bCore, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aNum, bNum int
+		if i < len(aParts) {
+			aNum, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			bNum, _ = strconv.Atoi(bParts[i])
+		}
+		if aNum != bNum {
+			return aNum - bNum
+		}
+	}
+	switch {
+	case aIsPre && !bIsPre:
+		return -1
+	case !aIsPre && bIsPre:
+		return 1
+	}
+	return strings.Compare(aPre, bPre)
+}
+
+func setDownloading(downloading bool) {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	status.Downloading = downloading
+}
+
+// updateHandler() shows the state of updating, and checks for an update right
+// away on a POST.
+func updateHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		if Version == "" || config.Ephemeral() {
+			resp.WriteHeader(400)
+			resp.Write([]byte("This build doesn't update itself"))
+			return
+		}
+		select {
+		case checkNow <- true:
+		default:
+		}
+	}
+	statusMutex.Lock()
+	current := status
+	statusMutex.Unlock()
+	if current.Channel == "" {
+		current.Channel = config.Updates().Channel
+	}
+	if statusJson, err := json.MarshalIndent(current, "", "   "); err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(err.Error()))
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(statusJson)
+	}
+}
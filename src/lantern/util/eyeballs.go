@@ -0,0 +1,161 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+/*
+Happy Eyeballs (RFC 8305) connects to a node that can be reached at more than
+one address, for example over IPv4 and IPv6, without waiting for broken
+addresses to time out.  DialHappyEyeballs() resolves the given addresses,
+orders the resulting IPs so that the address families alternate (IPv6 first),
+and starts a connection attempt to the next IP every CONNECTION_ATTEMPT_DELAY,
+or right away when all attempts so far failed.  The first connection that's
+established wins, the others are abandoned.
+*/
+const (
+	CONNECTION_ATTEMPT_DELAY = 250 * time.Millisecond // how long we wait before racing the next address, as recommended by RFC 8305
+)
+
+// attempt is the outcome of a connection attempt.
+type attempt struct {
+	conn net.Conn
+	err  error
+}
+
+/*
+DialHappyEyeballs() connects over TCP to whichever of the given host:ports
+answers first.
+*/
+func DialHappyEyeballs(ctx context.Context, addresses []string) (net.Conn, error) {
+	candidates, err := happyEyeballsCandidates(ctx, addresses)
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	if len(candidates) == 1 {
+		return dialer.DialContext(ctx, "tcp", candidates[0])
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan attempt, len(candidates))
+	next, pending := 0, 0
+	startAttempt := func() {
+		candidate := candidates[next]
+		next += 1
+		pending += 1
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", candidate)
+			results <- attempt{conn, err}
+		}()
+	}
+
+	startAttempt()
+	delay := time.NewTimer(CONNECTION_ATTEMPT_DELAY)
+	defer delay.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case <-delay.C:
+			if next < len(candidates) {
+				startAttempt()
+				delay.Reset(CONNECTION_ATTEMPT_DELAY)
+			}
+		case result := <-results:
+			pending -= 1
+			if result.err == nil {
+				go closeLosers(results, pending)
+				return result.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			if pending == 0 && next < len(candidates) {
+				// Nothing's in flight, so there's no point in waiting
+				if !delay.Stop() {
+					select {
+					case <-delay.C:
+					default:
+					}
+				}
+				startAttempt()
+				delay.Reset(CONNECTION_ATTEMPT_DELAY)
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+// closeLosers() closes the connections of the given number of attempts that
+// are still pending once another attempt has won.
+func closeLosers(results chan attempt, pending int) {
+	for ; pending > 0; pending -= 1 {
+		if result := <-results; result.conn != nil {
+			result.conn.Close()
+		}
+	}
+}
+
+/*
+happyEyeballsCandidates() resolves the given host:ports into IP:ports, ordered
+so that IPv6 and IPv4 alternate, starting with IPv6, while keeping the order of
+each family.
+*/
+func happyEyeballsCandidates(ctx context.Context, addresses []string) ([]string, error) {
+	ipv6 := make([]string, 0)
+	ipv4 := make([]string, 0)
+	var firstErr error
+	for _, address := range addresses {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if strings.Contains(host, "%") {
+			// Zoned IPv6 addresses only work as they are
+			ipv6 = append(ipv6, address)
+			continue
+		}
+		ips := []net.IP{net.ParseIP(host)}
+		if ips[0] == nil {
+			ipAddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			ips = ips[:0]
+			for _, ipAddr := range ipAddrs {
+				ips = append(ips, ipAddr.IP)
+			}
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				ipv4 = append(ipv4, net.JoinHostPort(ip.String(), port))
+			} else {
+				ipv6 = append(ipv6, net.JoinHostPort(ip.String(), port))
+			}
+		}
+	}
+	candidates := make([]string, 0, len(ipv6)+len(ipv4))
+	for i := 0; i < len(ipv6) || i < len(ipv4); i++ {
+		if i < len(ipv6) {
+			candidates = append(candidates, ipv6[i])
+		}
+		if i < len(ipv4) {
+			candidates = append(candidates, ipv4[i])
+		}
+	}
+	if len(candidates) == 0 {
+		if firstErr != nil {
+			return nil, firstErr
+		}
+		return nil, fmt.Errorf("No addresses to dial")
+	}
+	return candidates, nil
+}
@@ -0,0 +1,189 @@
+package util
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+The lifecycle manager moves servers to other addresses at runtime, for example
+when the operator changes the address of the local or remote proxy, without
+dropping the connections that they carry.
+
+A Rebinder serves an http.Server on a set of addresses.  When Rebind() is
+given a new set, it first listens on the addresses that are new, so that new
+connections are accepted there right away, and only then stops accepting on
+the addresses that are gone.  If any of the new addresses can't be bound,
+nothing changes.  Connections that the retired listeners accepted, including
+hijacked tunnels, carry on until they finish or REBIND_DRAIN_DEADLINE passes,
+when they're closed.
+*/
+const (
+	REBIND_DRAIN_DEADLINE = 5 * time.Minute // how long connections of retired listeners may carry on
+	REBIND_CHECK_INTERVAL = 1 * time.Second // how often we check whether retired listeners are drained
+)
+
+// Rebinder serves an http.Server on addresses that may change.
+type Rebinder struct {
+	name      string                          // what we serve, for logging
+	server    *http.Server                    // the server that we serve
+	wrap      func(net.Listener) net.Listener // wraps new listeners before serving, may be nil
+	listeners map[string]*trackingListener    // the listeners that accept, by address
+	mutex     sync.Mutex                      // used to synchronize access to listeners
+}
+
+// trackingListener is a net.Listener that keeps track of the connections that
+// it accepted until they're closed.
+type trackingListener struct {
+	net.Listener
+	conns   map[*trackedConn]bool // the open connections that we accepted
+	retired bool                  // whether we stopped accepting
+	mutex   sync.Mutex            // used to synchronize access to conns and retired
+}
+
+// trackedConn is a connection accepted by a trackingListener.
+type trackedConn struct {
+	net.Conn
+	listener *trackingListener // the listener that accepted us
+	once     sync.Once         // makes sure that we're only untracked once
+}
+
+/*
+NewRebinder() creates a Rebinder that serves the given server under the given
+name, wrapping each new listener with wrap unless that's nil.  It doesn't
+listen anywhere until Rebind() is called.
+*/
+func NewRebinder(name string, server *http.Server, wrap func(net.Listener) net.Listener) *Rebinder {
+	return &Rebinder{
+		name:      name,
+		server:    server,
+		wrap:      wrap,
+		listeners: make(map[string]*trackingListener),
+	}
+}
+
+/*
+Rebind() makes us listen on exactly the given addresses, draining the listeners
+on addresses that aren't among them anymore.  Returns an error if one of the
+new addresses can't be bound, in which case we keep listening where we did.
+*/
+func (rebinder *Rebinder) Rebind(addresses []string) error {
+	rebinder.mutex.Lock()
+	defer rebinder.mutex.Unlock()
+	wanted := NewStringSet(addresses...)
+	opened := make(map[string]*trackingListener)
+	for _, address := range addresses {
+		if rebinder.listeners[address] != nil || opened[address] != nil {
+			continue
+		}
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			for _, listener := range opened {
+				listener.Listener.Close()
+			}
+			return err
+		}
+		opened[address] = &trackingListener{Listener: listener, conns: make(map[*trackedConn]bool)}
+	}
+
+	for address, listener := range opened {
+		log.Printf("About to start %s at: %s", rebinder.name, address)
+		rebinder.listeners[address] = listener
+		go rebinder.serve(address, listener)
+	}
+	for address, listener := range rebinder.listeners {
+		if !wanted.Contains(address) {
+			delete(rebinder.listeners, address)
+			go listener.drain(rebinder.name, address)
+		}
+	}
+	return nil
+}
+
+/*
+serve() serves our server with the given listener until it's retired or
+fails.  A listener that fails is forgotten, so that the next Rebind() binds its
+address again.
+*/
+func (rebinder *Rebinder) serve(address string, listener *trackingListener) {
+	var served net.Listener = listener
+	if rebinder.wrap != nil {
+		served = rebinder.wrap(listener)
+	}
+	err := rebinder.server.Serve(served)
+	if listener.isRetired() {
+		return
+	}
+	log.Printf("%s at %s stopped: %s", rebinder.name, address, err)
+	rebinder.mutex.Lock()
+	defer rebinder.mutex.Unlock()
+	if rebinder.listeners[address] == listener {
+		delete(rebinder.listeners, address)
+	}
+}
+
+func (listener *trackingListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tracked := &trackedConn{Conn: conn, listener: listener}
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	listener.conns[tracked] = true
+	return tracked, nil
+}
+
+func (listener *trackingListener) isRetired() bool {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	return listener.retired
+}
+
+// open() returns how many of the connections that we accepted are still open.
+func (listener *trackingListener) open() int {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	return len(listener.conns)
+}
+
+/*
+drain() stops accepting and waits for the connections that we accepted to
+finish, closing those that are still open after REBIND_DRAIN_DEADLINE.
+*/
+func (listener *trackingListener) drain(name string, address string) {
+	listener.mutex.Lock()
+	listener.retired = true
+	listener.mutex.Unlock()
+	listener.Listener.Close()
+	log.Printf("Stopped accepting for %s at %s, draining %d connections", name, address, listener.open())
+
+	deadline := time.Now().Add(REBIND_DRAIN_DEADLINE)
+	for listener.open() > 0 && time.Now().Before(deadline) {
+		time.Sleep(REBIND_CHECK_INTERVAL)
+	}
+	listener.mutex.Lock()
+	remaining := make([]*trackedConn, 0, len(listener.conns))
+	for conn := range listener.conns {
+		remaining = append(remaining, conn)
+	}
+	listener.mutex.Unlock()
+	if len(remaining) > 0 {
+		log.Printf("Closing %d connections of %s at %s after the drain deadline", len(remaining), name, address)
+	}
+	for _, conn := range remaining {
+		conn.Close()
+	}
+}
+
+func (conn *trackedConn) Close() error {
+	conn.once.Do(func() {
+		conn.listener.mutex.Lock()
+		defer conn.listener.mutex.Unlock()
+		delete(conn.listener.conns, conn)
+	})
+	return conn.Conn.Close()
+}
@@ -0,0 +1,47 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+/*
+Everything that's logged through the standard logger still goes to stderr, but
+the last RECENT_LOG_LINES lines are also kept in memory so that they can be
+included in diagnostic reports (see RecentLogs()).
+*/
+const RECENT_LOG_LINES = 2000 // how many of the most recent log lines we keep
+
+var (
+	recentLogs      = make([]string, 0, RECENT_LOG_LINES) // the most recent log lines, oldest first
+	recentLogsMutex sync.Mutex                            // used to synchronize access to recentLogs
+)
+
+func init() {
+	log.SetOutput(io.MultiWriter(os.Stderr, logRecorder{}))
+}
+
+// RecentLogs() returns the most recent log lines, oldest first.
+func RecentLogs() []string {
+	recentLogsMutex.Lock()
+	defer recentLogsMutex.Unlock()
+	return append([]string{}, recentLogs...)
+}
+
+// logRecorder records what's written to the standard logger in recentLogs.
+type logRecorder struct{}
+
+func (recorder logRecorder) Write(p []byte) (int, error) {
+	recentLogsMutex.Lock()
+	defer recentLogsMutex.Unlock()
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		if len(recentLogs) == RECENT_LOG_LINES {
+			recentLogs = append(recentLogs[:0], recentLogs[1:]...)
+		}
+		recentLogs = append(recentLogs, string(line))
+	}
+	return len(p), nil
+}
@@ -3,28 +3,93 @@ Package util contains various utilities for use by the lantern system.
 */
 package util
 
+import (
+	"sync"
+)
+
+/*
+Set is a set of comparable values backed by a map.  Sets are safe for
+concurrent use.  The zero value is an empty set that's ready to use, though
+NewSet() is the usual way to create one.
+*/
+type Set[T comparable] struct {
+	m     map[T]bool
+	mutex sync.RWMutex // used to synchronize access to m
+}
+
 /*
-StringSet is a set of strings backed by a map of strings.
+StringSet is a set of strings.
 */
-type StringSet struct {
-	m map[string]bool
+type StringSet = Set[string]
+
+// NewSet() creates a set containing the given values.
+func NewSet[T comparable](vals ...T) *Set[T] {
+	set := &Set[T]{m: make(map[T]bool, len(vals))}
+	for _, val := range vals {
+		set.m[val] = true
+	}
+	return set
+}
+
+// NewStringSet() creates a set containing the given strings.
+func NewStringSet(vals ...string) *StringSet {
+	return NewSet(vals...)
 }
 
 // Add() adds the value to the set and returns true if it didn't exist
 // previously.
-func (set *StringSet) Add(val string) bool {
+func (set *Set[T]) Add(val T) bool {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	if set.m == nil {
+		set.m = make(map[T]bool)
+	}
 	_, found := set.m[val]
 	set.m[val] = true
 	return !found
 }
 
 // Remove() removes the value from the set.
-func (set *StringSet) Remove(val string) {
+func (set *Set[T]) Remove(val T) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
 	delete(set.m, val)
 }
 
 // Contains() checks if the set contains the given value.
-func (set *StringSet) Contains(val string) (found bool) {
+func (set *Set[T]) Contains(val T) (found bool) {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
 	_, found = set.m[val]
 	return
 }
+
+// Len() returns the number of values in the set.
+func (set *Set[T]) Len() int {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+	return len(set.m)
+}
+
+// Values() returns the values in the set, in no particular order.
+func (set *Set[T]) Values() []T {
+	set.mutex.RLock()
+	defer set.mutex.RUnlock()
+	vals := make([]T, 0, len(set.m))
+	for val := range set.m {
+		vals = append(vals, val)
+	}
+	return vals
+}
+
+/*
+Each() calls fn for every value in the set, in no particular order, until fn
+returns false.  fn sees a snapshot of the set, so it may modify the set.
+*/
+func (set *Set[T]) Each(fn func(val T) bool) {
+	for _, val := range set.Values() {
+		if !fn(val) {
+			return
+		}
+	}
+}
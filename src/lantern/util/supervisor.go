@@ -0,0 +1,137 @@
+package util
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+/*
+Supervision keeps long-running goroutines (servers, signaling receivers,
+savers and so on) alive, so that one panic doesn't silently kill a subsystem
+while the rest of the process keeps running.
+
+A supervised function is restarted whenever it panics or returns an error,
+waiting RESTART_MIN_BACKOFF after the first failure and doubling that up to
+RESTART_MAX_BACKOFF after consecutive failures.  A run that lasted longer than
+RESTART_MAX_BACKOFF before failing starts over at RESTART_MIN_BACKOFF.  Once
+the function returns nil, it's done and isn't restarted.
+
+Failures are counted per name in SupervisorMetrics(), which can be inspected
+at http://[config.UIAddress()]/diagnostics/goroutines.
+*/
+const (
+	RESTART_MIN_BACKOFF = time.Second     // how long we wait before the first restart
+	RESTART_MAX_BACKOFF = 2 * time.Minute // the longest that we wait between restarts
+)
+
+// GoroutineMetrics counts the failures of a supervised function.
+type GoroutineMetrics struct {
+	Running     bool      // whether the function is currently running
+	Restarts    int64     // how often the function has been restarted
+	Panics      int64     // how many of its failures were panics
+	LastError   string    // the last error or panic
+	LastFailure time.Time // when the function last failed
+}
+
+var (
+	supervised      = make(map[string]*GoroutineMetrics) // metrics of supervised functions, by name
+	supervisorMutex sync.Mutex                           // used to synchronize access to supervised
+)
+
+// Go() runs fn as a supervised goroutine under the given name (see
+// Supervise()).
+func Go(name string, fn func() error) {
+	go Supervise(name, fn)
+}
+
+// GoLoop() runs loop, which isn't meant to return, as a supervised goroutine
+// under the given name, restarting it whenever it panics.
+func GoLoop(name string, loop func()) {
+	Go(name, func() error {
+		loop()
+		return nil
+	})
+}
+
+/*
+Supervise() runs fn under the given name, restarting it with backoff whenever
+it panics or returns an error, until it returns nil.
+*/
+func Supervise(name string, fn func() error) {
+	backoff := RESTART_MIN_BACKOFF
+	for {
+		setRunning(name, true)
+		start := time.Now()
+		err, panicked := runProtected(name, fn)
+		setRunning(name, false)
+		if err == nil {
+			return
+		}
+		if time.Since(start) > RESTART_MAX_BACKOFF {
+			backoff = RESTART_MIN_BACKOFF
+		}
+		recordFailure(name, err, panicked)
+		log.Printf("%s failed, restarting in %s: %s", name, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > RESTART_MAX_BACKOFF {
+			backoff = RESTART_MAX_BACKOFF
+		}
+	}
+}
+
+// SupervisorMetrics() returns a snapshot of the metrics of all supervised
+// functions, by name.
+func SupervisorMetrics() map[string]GoroutineMetrics {
+	supervisorMutex.Lock()
+	defer supervisorMutex.Unlock()
+	metrics := make(map[string]GoroutineMetrics)
+	for name, m := range supervised {
+		metrics[name] = *m
+	}
+	return metrics
+}
+
+// runProtected() runs fn, turning a panic into an error.
+func runProtected(name string, fn func() error) (err error, panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("%s panicked: %v\n%s", name, r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+			panicked = true
+		}
+	}()
+	return fn(), false
+}
+
+// metricsFor() returns the metrics for the given name.  supervisorMutex must be
+// held.
+func metricsFor(name string) *GoroutineMetrics {
+	m, found := supervised[name]
+	if !found {
+		m = &GoroutineMetrics{}
+		supervised[name] = m
+	}
+	return m
+}
+
+func setRunning(name string, running bool) {
+	supervisorMutex.Lock()
+	defer supervisorMutex.Unlock()
+	metricsFor(name).Running = running
+}
+
+func recordFailure(name string, err error, panicked bool) {
+	supervisorMutex.Lock()
+	defer supervisorMutex.Unlock()
+	m := metricsFor(name)
+	m.Restarts += 1
+	if panicked {
+		m.Panics += 1
+	}
+	m.LastError = err.Error()
+	m.LastFailure = time.Now()
+}